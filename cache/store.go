@@ -0,0 +1,153 @@
+package cache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Store is a content-addressed cache on disk. Values are kept under the hash
+// of the inputs that produced them, so a later run with the same inputs, such
+// as the real run after a dry run, reuses them instead of computing or
+// downloading them again. Entries never go stale, since other inputs give
+// another key; the owner of the directory removes the ones unused for long
+// (see workspace.Cluster.GC). It is safe for concurrent use, also by several
+// processes.
+type Store struct {
+	dir string
+}
+
+// NewStore returns the store kept in dir. Nothing is created until a value
+// is put.
+func NewStore(dir string) *Store {
+	return &Store{dir: dir}
+}
+
+// Key returns the hash of inputs, which must be encodable as JSON. Include
+// everything the value depends on: two computations with the same key must
+// give the same value.
+func Key(inputs ...interface{}) (string, error) {
+	data, err := json.Marshal(inputs)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash cache inputs: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func (s *Store) path(kind, key string) string {
+	return filepath.Join(s.dir, kind, key[:2], key)
+}
+
+// Get returns the value of kind stored under key, a hash returned by Key. A
+// hit marks the entry as used, so that it outlives the age-based cleanup.
+func (s *Store) Get(kind, key string) ([]byte, bool) {
+	p := s.path(kind, key)
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return nil, false
+	}
+	now := time.Now()
+	_ = os.Chtimes(p, now, now)
+	return data, true
+}
+
+// Put stores data as the value of kind under key. The entry is replaced
+// atomically, so a concurrent Get never sees it half written.
+func (s *Store) Put(kind, key string, data []byte) error {
+	p := s.path(kind, key)
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	f, err := os.CreateTemp(filepath.Dir(p), "."+key+".*")
+	if err != nil {
+		return fmt.Errorf("failed to write cache entry: %w", err)
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), p)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to write cache entry: %w", err)
+	}
+	return nil
+}
+
+// Prune removes the entries not used since cutoff and returns their paths.
+func (s *Store) Prune(cutoff time.Time) ([]string, error) {
+	var removed []string
+	err := filepath.WalkDir(s.dir, func(p string, d os.DirEntry, err error) error {
+		if os.IsNotExist(err) && p == s.dir {
+			return filepath.SkipDir
+		}
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if info.ModTime().After(cutoff) {
+			return nil
+		}
+		if err := os.Remove(p); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", p, err)
+		}
+		removed = append(removed, p)
+		return nil
+	})
+	return removed, err
+}
+
+type storeKey struct{}
+
+// WithStore returns a context carrying s, which Memo uses.
+func WithStore(ctx context.Context, s *Store) context.Context {
+	return context.WithValue(ctx, storeKey{}, s)
+}
+
+// StoreFrom returns the store carried by ctx, if any.
+func StoreFrom(ctx context.Context) (*Store, bool) {
+	s, ok := ctx.Value(storeKey{}).(*Store)
+	return s, ok && s != nil
+}
+
+// Memo returns the value of kind computed from inputs: the one stored by an
+// earlier call with the same inputs if ctx carries a store (see WithStore),
+// else the result of compute, which is then stored. Values are stored as
+// JSON. The cache only saves work, so failing to hash the inputs or to read
+// or write an entry falls back to computing the value; errors from compute
+// are returned and never stored.
+func Memo[T any](ctx context.Context, kind string, inputs []interface{}, compute func() (T, error)) (T, error) {
+	s, ok := StoreFrom(ctx)
+	if !ok {
+		return compute()
+	}
+	key, err := Key(inputs...)
+	if err != nil {
+		return compute()
+	}
+	if data, ok := s.Get(kind, key); ok {
+		var v T
+		if json.Unmarshal(data, &v) == nil {
+			return v, nil
+		}
+	}
+	v, err := compute()
+	if err != nil {
+		return v, err
+	}
+	if data, err := json.Marshal(v); err == nil {
+		_ = s.Put(kind, key, data)
+	}
+	return v, nil
+}
@@ -0,0 +1,90 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestKey(t *testing.T) {
+	a, err := Key("https://example.com/SHA256SUMS", "etcd.tar.gz")
+	if err != nil {
+		t.Fatalf("Key() error = %v", err)
+	}
+	b, _ := Key("https://example.com/SHA256SUMS", "etcd.tar.gz")
+	c, _ := Key("https://example.com/SHA256SUMS", "kubeadm")
+	if a != b || a == c || len(a) != 64 {
+		t.Errorf("unexpected keys %s, %s, %s", a, b, c)
+	}
+	if _, err := Key(func() {}); err == nil {
+		t.Error("expected an error for inputs that are not JSON")
+	}
+}
+
+func TestMemo(t *testing.T) {
+	dir := t.TempDir()
+	calls := 0
+	compute := func() (map[string]int, error) {
+		calls++
+		return map[string]int{"calls": calls}, nil
+	}
+
+	v, err := Memo(context.Background(), "plan", []interface{}{"a"}, compute)
+	if err != nil || v["calls"] != 1 {
+		t.Fatalf("Memo() without a store = %v, %v", v, err)
+	}
+
+	ctx := WithStore(context.Background(), NewStore(dir))
+	for i := 0; i < 2; i++ {
+		v, err = Memo(ctx, "plan", []interface{}{"a"}, compute)
+		if err != nil || v["calls"] != 2 {
+			t.Fatalf("Memo() run %d = %v, %v; want the value of the first stored call", i, v, err)
+		}
+	}
+	v, _ = Memo(ctx, "plan", []interface{}{"b"}, compute)
+	if v["calls"] != 3 {
+		t.Errorf("Memo() with other inputs = %v, want a new computation", v)
+	}
+
+	failing := errors.New("offline")
+	if _, err := Memo(ctx, "plan", []interface{}{"c"}, func() (int, error) { return 0, failing }); !errors.Is(err, failing) {
+		t.Fatalf("Memo() error = %v", err)
+	}
+	if n, _ := Memo(ctx, "plan", []interface{}{"c"}, func() (int, error) { return 7, nil }); n != 7 {
+		t.Errorf("an error was stored: got %d", n)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	dir := t.TempDir()
+	s := NewStore(dir)
+	oldKey, _ := Key("old")
+	newKey, _ := Key("new")
+	for _, key := range []string{oldKey, newKey} {
+		if err := s.Put("checksum", key, []byte(`"x"`)); err != nil {
+			t.Fatalf("Put() error = %v", err)
+		}
+	}
+	old := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(s.path("checksum", oldKey), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := s.Prune(time.Now().Add(-24 * time.Hour))
+	if err != nil {
+		t.Fatalf("Prune() error = %v", err)
+	}
+	if len(removed) != 1 || removed[0] != filepath.Join(dir, "checksum", oldKey[:2], oldKey) {
+		t.Errorf("Prune() removed %v", removed)
+	}
+	if _, ok := s.Get("checksum", newKey); !ok {
+		t.Error("the recent entry was removed")
+	}
+
+	if removed, err := NewStore(filepath.Join(dir, "missing")).Prune(time.Now()); err != nil || len(removed) != 0 {
+		t.Errorf("Prune() of a missing store = %v, %v", removed, err)
+	}
+}
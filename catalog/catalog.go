@@ -0,0 +1,419 @@
+package catalog
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/mensylisir/xmcores/cache"
+	"github.com/mensylisir/xmcores/download"
+	"github.com/mensylisir/xmcores/util"
+)
+
+// Component identifies a binary shipped to cluster nodes.
+type Component string
+
+const (
+	Kubeadm    Component = "kubeadm"
+	Kubelet    Component = "kubelet"
+	Kubectl    Component = "kubectl"
+	Etcd       Component = "etcd"
+	Containerd Component = "containerd"
+	Runc       Component = "runc"
+	CNIPlugins Component = "cni-plugins"
+	Crictl     Component = "crictl"
+)
+
+// Components lists every component in installation order.
+var Components = []Component{Etcd, Containerd, Runc, CNIPlugins, Crictl, Kubeadm, Kubelet, Kubectl}
+
+var (
+	// ErrUnsupportedVersion is returned (wrapped) when a Kubernetes or component version is not in the catalog.
+	ErrUnsupportedVersion = errors.New("unsupported version")
+	// ErrUnsupportedArch is returned (wrapped) when an architecture has no published binaries.
+	ErrUnsupportedArch = errors.New("unsupported architecture")
+	// ErrIncompatibleVersion is returned (wrapped) when a pinned component version does not work
+	// with the requested Kubernetes version.
+	ErrIncompatibleVersion = errors.New("incompatible component version")
+	// ErrVersionSkew is returned (wrapped) when versions break the Kubernetes version skew policy.
+	ErrVersionSkew = errors.New("version skew")
+)
+
+// Release is the set of component versions validated against one Kubernetes minor release.
+type Release struct {
+	Kubernetes string // Minor release, e.g. "v1.30"
+	// Latest is the newest validated patch release, e.g. "v1.30.6". Upgrades
+	// that cross this minor release stop at it (see UpgradePath).
+	Latest     string
+	Etcd       string
+	Containerd string
+	Runc       string
+	CNIPlugins string
+	Crictl     string
+}
+
+func (r Release) version(c Component) string {
+	switch c {
+	case Etcd:
+		return r.Etcd
+	case Containerd:
+		return r.Containerd
+	case Runc:
+		return r.Runc
+	case CNIPlugins:
+		return r.CNIPlugins
+	case Crictl:
+		return r.Crictl
+	default:
+		return ""
+	}
+}
+
+// source describes where a component is published.
+type source struct {
+	urlTmpl      string
+	checksumTmpl string
+	// sameMinor requires pinned versions to keep the catalog's major.minor (etcd data format,
+	// crictl follows the Kubernetes CRI API). Otherwise any newer minor in the same major is accepted.
+	sameMinor bool
+}
+
+var defaultSources = map[Component]source{
+	Kubeadm: {urlTmpl: "https://dl.k8s.io/release/{{.Version}}/bin/linux/{{.Arch}}/kubeadm", checksumTmpl: "{{.URL}}.sha256", sameMinor: true},
+	Kubelet: {urlTmpl: "https://dl.k8s.io/release/{{.Version}}/bin/linux/{{.Arch}}/kubelet", checksumTmpl: "{{.URL}}.sha256", sameMinor: true},
+	Kubectl: {urlTmpl: "https://dl.k8s.io/release/{{.Version}}/bin/linux/{{.Arch}}/kubectl", checksumTmpl: "{{.URL}}.sha256", sameMinor: true},
+	Etcd: {
+		urlTmpl:      "https://github.com/etcd-io/etcd/releases/download/{{.Version}}/etcd-{{.Version}}-linux-{{.Arch}}.tar.gz",
+		checksumTmpl: "https://github.com/etcd-io/etcd/releases/download/{{.Version}}/SHA256SUMS",
+		sameMinor:    true,
+	},
+	Containerd: {
+		urlTmpl:      "https://github.com/containerd/containerd/releases/download/{{.Version}}/containerd-{{.BareVersion}}-linux-{{.Arch}}.tar.gz",
+		checksumTmpl: "{{.URL}}.sha256sum",
+	},
+	Runc: {
+		urlTmpl:      "https://github.com/opencontainers/runc/releases/download/{{.Version}}/runc.{{.Arch}}",
+		checksumTmpl: "https://github.com/opencontainers/runc/releases/download/{{.Version}}/runc.sha256sum",
+	},
+	CNIPlugins: {
+		urlTmpl:      "https://github.com/containernetworking/plugins/releases/download/{{.Version}}/cni-plugins-linux-{{.Arch}}-{{.Version}}.tgz",
+		checksumTmpl: "{{.URL}}.sha256",
+	},
+	Crictl: {
+		urlTmpl:      "https://github.com/kubernetes-sigs/cri-tools/releases/download/{{.Version}}/crictl-{{.Version}}-linux-{{.Arch}}.tar.gz",
+		checksumTmpl: "{{.URL}}.sha256",
+		sameMinor:    true,
+	},
+}
+
+var defaultReleases = []Release{
+	{Kubernetes: "v1.27", Latest: "v1.27.16", Etcd: "v3.5.7", Containerd: "v1.7.13", Runc: "v1.1.12", CNIPlugins: "v1.3.0", Crictl: "v1.27.1"},
+	{Kubernetes: "v1.28", Latest: "v1.28.15", Etcd: "v3.5.9", Containerd: "v1.7.13", Runc: "v1.1.12", CNIPlugins: "v1.4.0", Crictl: "v1.28.0"},
+	{Kubernetes: "v1.29", Latest: "v1.29.10", Etcd: "v3.5.10", Containerd: "v1.7.16", Runc: "v1.1.12", CNIPlugins: "v1.4.0", Crictl: "v1.29.0"},
+	{Kubernetes: "v1.30", Latest: "v1.30.6", Etcd: "v3.5.12", Containerd: "v1.7.18", Runc: "v1.1.13", CNIPlugins: "v1.5.1", Crictl: "v1.30.0"},
+	{Kubernetes: "v1.31", Latest: "v1.31.2", Etcd: "v3.5.15", Containerd: "v1.7.22", Runc: "v1.1.14", CNIPlugins: "v1.5.1", Crictl: "v1.31.1"},
+}
+
+// SupportedArches lists the architectures binaries are published for.
+var SupportedArches = []string{util.ArchAMD64, util.ArchARM64}
+
+// Binary is a resolved, downloadable component artifact.
+type Binary struct {
+	Component   Component
+	Version     string
+	Arch        string
+	URL         string
+	ChecksumURL string
+	// SHA256 is the pinned checksum, or empty until FetchChecksums fills it in.
+	SHA256 string
+}
+
+// FileName returns the base name of the artifact.
+func (b Binary) FileName() string {
+	return path.Base(b.URL)
+}
+
+// Bundle is the full set of binaries needed for one Kubernetes version on one architecture.
+type Bundle struct {
+	KubernetesVersion string
+	Arch              string
+	Binaries          map[Component]Binary
+}
+
+// Catalog maps Kubernetes releases to compatible component versions and their download locations.
+type Catalog struct {
+	releases  map[string]Release
+	sources   map[Component]source
+	checksums map[string]string
+	addons    map[string][]Image
+}
+
+// NewCatalog returns a catalog populated with the built-in releases.
+func NewCatalog() *Catalog {
+	c := &Catalog{
+		releases:  make(map[string]Release, len(defaultReleases)),
+		sources:   make(map[Component]source, len(defaultSources)),
+		checksums: make(map[string]string),
+		addons:    make(map[string][]Image, len(defaultAddons)),
+	}
+	for _, r := range defaultReleases {
+		c.AddRelease(r)
+	}
+	for comp, src := range defaultSources {
+		c.sources[comp] = src
+	}
+	for name, images := range defaultAddons {
+		c.AddAddon(name, images...)
+	}
+	return c
+}
+
+// AddRelease adds or replaces the component set for a Kubernetes minor release.
+func (c *Catalog) AddRelease(r Release) {
+	if v, err := ParseVersion(r.Kubernetes); err == nil {
+		r.Kubernetes = v.MinorString()
+	}
+	c.releases[r.Kubernetes] = r
+}
+
+// SetChecksum pins the SHA-256 of a component artifact so it does not have to be fetched.
+func (c *Catalog) SetChecksum(comp Component, version, arch, sha256sum string) {
+	c.checksums[checksumKey(comp, version, arch)] = strings.ToLower(strings.TrimSpace(sha256sum))
+}
+
+// SupportedVersions returns the supported Kubernetes minor releases in ascending order.
+func (c *Catalog) SupportedVersions() []string {
+	versions := make([]string, 0, len(c.releases))
+	for k := range c.releases {
+		versions = append(versions, k)
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return MustParseVersion(versions[i]).Compare(MustParseVersion(versions[j])) < 0
+	})
+	return versions
+}
+
+// Release returns the component set for the minor release of kubernetesVersion.
+func (c *Catalog) Release(kubernetesVersion string) (Release, error) {
+	v, err := ParseVersion(kubernetesVersion)
+	if err != nil {
+		return Release{}, fmt.Errorf("%w: kubernetes %q: %v", ErrUnsupportedVersion, kubernetesVersion, err)
+	}
+	r, ok := c.releases[v.MinorString()]
+	if !ok {
+		return Release{}, fmt.Errorf("%w: kubernetes %s (supported: %s)", ErrUnsupportedVersion, v, strings.Join(c.SupportedVersions(), ", "))
+	}
+	return r, nil
+}
+
+// Resolve returns the full set of binaries for kubernetesVersion on arch. Arch aliases such as
+// x86_64 and aarch64 are accepted. overrides pins individual component versions; they are checked
+// against the catalog's compatibility rules so unsupported combinations fail before anything is downloaded.
+func (c *Catalog) Resolve(kubernetesVersion, arch string, overrides map[Component]string) (*Bundle, error) {
+	release, err := c.Release(kubernetesVersion)
+	if err != nil {
+		return nil, err
+	}
+	k8sVersion := MustParseVersion(kubernetesVersion)
+
+	goArch := NormalizeArch(arch)
+	if !util.ContainsString(SupportedArches, goArch) {
+		return nil, fmt.Errorf("%w: %q (supported: %s)", ErrUnsupportedArch, arch, strings.Join(SupportedArches, ", "))
+	}
+
+	bundle := &Bundle{
+		KubernetesVersion: k8sVersion.String(),
+		Arch:              goArch,
+		Binaries:          make(map[Component]Binary, len(Components)),
+	}
+	for _, comp := range Components {
+		src, ok := c.sources[comp]
+		if !ok {
+			return nil, fmt.Errorf("no download source registered for component %s", comp)
+		}
+
+		defaultVersion := release.version(comp)
+		if defaultVersion == "" {
+			defaultVersion = k8sVersion.String() // kubeadm, kubelet and kubectl follow Kubernetes itself
+		}
+		version := defaultVersion
+		if pinned, ok := overrides[comp]; ok && pinned != "" {
+			if err := checkCompatible(comp, src, kubernetesVersion, defaultVersion, pinned); err != nil {
+				return nil, err
+			}
+			version = "v" + strings.TrimPrefix(pinned, "v")
+		}
+
+		bin, err := c.binary(comp, src, version, goArch)
+		if err != nil {
+			return nil, err
+		}
+		bundle.Binaries[comp] = bin
+	}
+	return bundle, nil
+}
+
+// CheckInstalled checks that version of comp, found installed on a node, can
+// be kept for kubernetesVersion: the rules applying to pinned versions (see
+// Resolve) apply to it.
+func (c *Catalog) CheckInstalled(kubernetesVersion string, comp Component, version string) error {
+	release, err := c.Release(kubernetesVersion)
+	if err != nil {
+		return err
+	}
+	src, ok := c.sources[comp]
+	if !ok {
+		return fmt.Errorf("no download source registered for component %s", comp)
+	}
+	defaultVersion := release.version(comp)
+	if defaultVersion == "" {
+		defaultVersion = MustParseVersion(kubernetesVersion).String()
+	}
+	return checkCompatible(comp, src, kubernetesVersion, defaultVersion, version)
+}
+
+func (c *Catalog) binary(comp Component, src source, version, arch string) (Binary, error) {
+	data := util.Data{
+		"Version":     version,
+		"BareVersion": strings.TrimPrefix(version, "v"),
+		"Arch":        arch,
+	}
+	url, err := util.RenderString(src.urlTmpl, data)
+	if err != nil {
+		return Binary{}, fmt.Errorf("failed to render download URL for %s %s: %w", comp, version, err)
+	}
+	data["URL"] = url
+	checksumURL, err := util.RenderString(src.checksumTmpl, data)
+	if err != nil {
+		return Binary{}, fmt.Errorf("failed to render checksum URL for %s %s: %w", comp, version, err)
+	}
+	return Binary{
+		Component:   comp,
+		Version:     version,
+		Arch:        arch,
+		URL:         url,
+		ChecksumURL: checksumURL,
+		SHA256:      c.checksums[checksumKey(comp, version, arch)],
+	}, nil
+}
+
+func checkCompatible(comp Component, src source, kubernetesVersion, defaultVersion, pinned string) error {
+	want, err := ParseVersion(defaultVersion)
+	if err != nil {
+		return fmt.Errorf("invalid catalog version %q for %s: %w", defaultVersion, comp, err)
+	}
+	got, err := ParseVersion(pinned)
+	if err != nil {
+		return fmt.Errorf("%w: %s %q: %v", ErrUnsupportedVersion, comp, pinned, err)
+	}
+	if src.sameMinor && !got.SameMinor(want) {
+		return fmt.Errorf("%w: %s %s with kubernetes %s (requires %s.x)", ErrIncompatibleVersion, comp, got, kubernetesVersion, want.MinorString())
+	}
+	if got.Major != want.Major || got.Minor < want.Minor {
+		return fmt.Errorf("%w: %s %s with kubernetes %s (requires >= %s.0, < v%d.0.0)", ErrIncompatibleVersion, comp, got, kubernetesVersion, want.MinorString(), want.Major+1)
+	}
+	return nil
+}
+
+// NormalizeArch converts architecture aliases (x86_64, aarch64, ...) to Go architecture names.
+func NormalizeArch(arch string) string {
+	a := strings.ToLower(strings.TrimSpace(arch))
+	if goArch := util.GoArchFromAlias(a); goArch != "" {
+		return goArch
+	}
+	return a
+}
+
+func checksumKey(comp Component, version, arch string) string {
+	return fmt.Sprintf("%s/v%s/%s", comp, strings.TrimPrefix(version, "v"), NormalizeArch(arch))
+}
+
+// FetchChecksums fills in missing SHA-256 values from each binary's published checksum file.
+// With a cache store in ctx (see cache.WithStore), each checksum file is fetched only once.
+func (b *Bundle) FetchChecksums(ctx context.Context, client *http.Client) error {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	for comp, bin := range b.Binaries {
+		if bin.SHA256 != "" {
+			continue
+		}
+		sum, err := cache.Memo(ctx, "checksum", []interface{}{bin.ChecksumURL, bin.FileName()}, func() (string, error) {
+			return fetchChecksum(ctx, client, bin)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to fetch checksum for %s %s (%s): %w", comp, bin.Version, bin.Arch, err)
+		}
+		bin.SHA256 = sum
+		b.Binaries[comp] = bin
+	}
+	return nil
+}
+
+// fetchChecksum understands both bare checksum files and "sha256  filename" listings.
+func fetchChecksum(ctx context.Context, client *http.Client, bin Binary) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, bin.ChecksumURL, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected HTTP status %s from %s", resp.Status, bin.ChecksumURL)
+	}
+
+	scanner := bufio.NewScanner(io.LimitReader(resp.Body, 1<<20))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		switch {
+		case len(fields) == 1 && isSHA256(fields[0]):
+			return strings.ToLower(fields[0]), nil
+		case len(fields) >= 2 && isSHA256(fields[0]) && strings.TrimPrefix(fields[1], "*") == bin.FileName():
+			return strings.ToLower(fields[0]), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("no checksum for %s found in %s", bin.FileName(), bin.ChecksumURL)
+}
+
+func isSHA256(s string) bool {
+	if len(s) != 64 {
+		return false
+	}
+	for _, r := range strings.ToLower(s) {
+		if (r < '0' || r > '9') && (r < 'a' || r > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// DownloadItems returns download items for every binary, placed under dir/<component>/<version>/<arch>/.
+func (b *Bundle) DownloadItems(dir string) []download.Item {
+	items := make([]download.Item, 0, len(b.Binaries))
+	for _, comp := range Components {
+		bin, ok := b.Binaries[comp]
+		if !ok {
+			continue
+		}
+		items = append(items, download.Item{
+			Name:   fmt.Sprintf("%s %s (%s)", comp, bin.Version, bin.Arch),
+			URL:    bin.URL,
+			SHA256: bin.SHA256,
+			Dest:   filepath.Join(dir, string(comp), bin.Version, bin.Arch, bin.FileName()),
+		})
+	}
+	return items
+}
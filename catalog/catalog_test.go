@@ -0,0 +1,325 @@
+package catalog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mensylisir/xmcores/cache"
+)
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Version
+		wantErr bool
+	}{
+		{"v1.30.2", Version{1, 30, 2, ""}, false},
+		{"1.30", Version{1, 30, 0, ""}, false},
+		{"v3.5.12-rc.1", Version{3, 5, 12, "-rc.1"}, false},
+		{"", Version{}, true},
+		{"v1", Version{}, true},
+		{"v1.x.0", Version{}, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseVersion(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseVersion(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseVersion(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+
+	if MustParseVersion("v1.29.9").Compare(MustParseVersion("v1.30.0")) != -1 {
+		t.Errorf("expected v1.29.9 < v1.30.0")
+	}
+}
+
+func TestResolve(t *testing.T) {
+	c := NewCatalog()
+	bundle, err := c.Resolve("v1.30.2", "x86_64", nil)
+	if err != nil {
+		t.Fatalf("Resolve() error = %v", err)
+	}
+	if bundle.Arch != "amd64" {
+		t.Errorf("Arch = %s, want amd64", bundle.Arch)
+	}
+	if len(bundle.Binaries) != len(Components) {
+		t.Fatalf("expected %d binaries, got %d", len(Components), len(bundle.Binaries))
+	}
+
+	expected := map[Component]string{
+		Kubeadm:    "https://dl.k8s.io/release/v1.30.2/bin/linux/amd64/kubeadm",
+		Etcd:       "https://github.com/etcd-io/etcd/releases/download/v3.5.12/etcd-v3.5.12-linux-amd64.tar.gz",
+		Containerd: "https://github.com/containerd/containerd/releases/download/v1.7.18/containerd-1.7.18-linux-amd64.tar.gz",
+		Runc:       "https://github.com/opencontainers/runc/releases/download/v1.1.13/runc.amd64",
+		CNIPlugins: "https://github.com/containernetworking/plugins/releases/download/v1.5.1/cni-plugins-linux-amd64-v1.5.1.tgz",
+		Crictl:     "https://github.com/kubernetes-sigs/cri-tools/releases/download/v1.30.0/crictl-v1.30.0-linux-amd64.tar.gz",
+	}
+	for comp, url := range expected {
+		if got := bundle.Binaries[comp].URL; got != url {
+			t.Errorf("%s URL = %s, want %s", comp, got, url)
+		}
+	}
+	if got := bundle.Binaries[Kubelet].ChecksumURL; got != "https://dl.k8s.io/release/v1.30.2/bin/linux/amd64/kubelet.sha256" {
+		t.Errorf("kubelet checksum URL = %s", got)
+	}
+}
+
+func TestResolve_Unsupported(t *testing.T) {
+	c := NewCatalog()
+	if _, err := c.Resolve("v1.19.0", "amd64", nil); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("Resolve(v1.19.0) error = %v, want ErrUnsupportedVersion", err)
+	}
+	if _, err := c.Resolve("latest", "amd64", nil); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("Resolve(latest) error = %v, want ErrUnsupportedVersion", err)
+	}
+	if _, err := c.Resolve("v1.30.2", "s390x", nil); !errors.Is(err, ErrUnsupportedArch) {
+		t.Errorf("Resolve(s390x) error = %v, want ErrUnsupportedArch", err)
+	}
+}
+
+func TestResolve_Overrides(t *testing.T) {
+	c := NewCatalog()
+	tests := []struct {
+		name      string
+		overrides map[Component]string
+		wantErr   error
+	}{
+		{"newer containerd minor", map[Component]string{Containerd: "1.8.0"}, nil},
+		{"etcd patch bump", map[Component]string{Etcd: "v3.5.16"}, nil},
+		{"etcd minor change", map[Component]string{Etcd: "v3.4.30"}, ErrIncompatibleVersion},
+		{"crictl from other release", map[Component]string{Crictl: "v1.28.0"}, ErrIncompatibleVersion},
+		{"containerd major change", map[Component]string{Containerd: "v2.0.0"}, ErrIncompatibleVersion},
+		{"older runc minor", map[Component]string{Runc: "v1.0.3"}, ErrIncompatibleVersion},
+		{"garbage", map[Component]string{Runc: "main"}, ErrUnsupportedVersion},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bundle, err := c.Resolve("v1.30.2", "arm64", tt.overrides)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("Resolve() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Resolve() error = %v", err)
+			}
+			for comp, v := range tt.overrides {
+				if got := bundle.Binaries[comp].Version; got != "v"+strings.TrimPrefix(v, "v") {
+					t.Errorf("%s version = %s, want %s", comp, got, v)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckInstalled(t *testing.T) {
+	c := NewCatalog()
+	tests := []struct {
+		comp    Component
+		version string
+		wantErr error
+	}{
+		{Kubelet, "v1.30.0", nil},
+		{Kubelet, "v1.29.8", ErrIncompatibleVersion},
+		{Containerd, "1.7.20", nil},
+		{Containerd, "v1.6.28", ErrIncompatibleVersion},
+		{Containerd, "", ErrUnsupportedVersion},
+	}
+	for _, tt := range tests {
+		err := c.CheckInstalled("v1.30.2", tt.comp, tt.version)
+		if tt.wantErr == nil && err != nil || tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+			t.Errorf("CheckInstalled(%s %q) error = %v, want %v", tt.comp, tt.version, err, tt.wantErr)
+		}
+	}
+	if err := c.CheckInstalled("v1.10.0", Kubelet, "v1.10.0"); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("CheckInstalled() with an unsupported Kubernetes error = %v, want ErrUnsupportedVersion", err)
+	}
+}
+
+func TestFetchChecksumsAndDownloadItems(t *testing.T) {
+	sum := strings.Repeat("ab", 32)
+	other := strings.Repeat("cd", 32)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/single.sha256":
+			fmt.Fprintln(w, sum)
+		case "/SHA256SUMS":
+			fmt.Fprintf(w, "%s  etcd-v3.5.12-linux-arm64.tar.gz\n%s  etcd-v3.5.12-linux-amd64.tar.gz\n", other, sum)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	c := NewCatalog()
+	c.SetChecksum(Kubeadm, "v1.30.2", "amd64", strings.Repeat("EF", 32))
+	bundle, err := c.Resolve("v1.30.2", "amd64", nil)
+	if err != nil {
+		t.Fatalf("Resolve() error = %v", err)
+	}
+	for comp, bin := range bundle.Binaries {
+		switch comp {
+		case Kubeadm:
+		case Etcd:
+			bin.ChecksumURL = srv.URL + "/SHA256SUMS"
+		default:
+			bin.ChecksumURL = srv.URL + "/single.sha256"
+		}
+		bundle.Binaries[comp] = bin
+	}
+
+	if err := bundle.FetchChecksums(context.Background(), srv.Client()); err != nil {
+		t.Fatalf("FetchChecksums() error = %v", err)
+	}
+	if got := bundle.Binaries[Kubeadm].SHA256; got != strings.Repeat("ef", 32) {
+		t.Errorf("pinned kubeadm checksum = %s", got)
+	}
+	if got := bundle.Binaries[Etcd].SHA256; got != sum {
+		t.Errorf("etcd checksum = %s, want %s", got, sum)
+	}
+
+	items := bundle.DownloadItems("/work/binaries")
+	if len(items) != len(Components) {
+		t.Fatalf("expected %d items, got %d", len(Components), len(items))
+	}
+	if items[0].Dest != filepath.Join("/work/binaries", "etcd", "v3.5.12", "amd64", "etcd-v3.5.12-linux-amd64.tar.gz") {
+		t.Errorf("unexpected etcd destination %s", items[0].Dest)
+	}
+	for _, item := range items {
+		if item.SHA256 == "" {
+			t.Errorf("item %s has no checksum", item.Name)
+		}
+	}
+}
+
+func TestFetchChecksumsCached(t *testing.T) {
+	sum := strings.Repeat("ab", 32)
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		fmt.Fprintln(w, sum)
+	}))
+	defer srv.Close()
+
+	ctx := cache.WithStore(context.Background(), cache.NewStore(t.TempDir()))
+	for run := 0; run < 2; run++ {
+		bundle, err := NewCatalog().Resolve("v1.30.2", "amd64", nil)
+		if err != nil {
+			t.Fatalf("Resolve() error = %v", err)
+		}
+		for comp, bin := range bundle.Binaries {
+			bin.ChecksumURL = srv.URL + "/" + string(comp) + ".sha256"
+			bundle.Binaries[comp] = bin
+		}
+		if err := bundle.FetchChecksums(ctx, srv.Client()); err != nil {
+			t.Fatalf("FetchChecksums() error = %v", err)
+		}
+		for comp, bin := range bundle.Binaries {
+			if bin.SHA256 != sum {
+				t.Errorf("run %d: %s checksum = %q", run, comp, bin.SHA256)
+			}
+		}
+	}
+	if requests != len(Components) {
+		t.Errorf("fetched %d checksum files, want %d: the second run should use the cache", requests, len(Components))
+	}
+}
+
+func TestResolveArches(t *testing.T) {
+	c := NewCatalog()
+	bundles, err := c.ResolveArches("v1.31.0", []string{"x86_64", "arm64", "amd64"}, nil)
+	if err != nil {
+		t.Fatalf("ResolveArches() error = %v", err)
+	}
+	if len(bundles) != 2 {
+		t.Fatalf("expected 2 bundles, got %d", len(bundles))
+	}
+	if got := bundles["arm64"].Binaries[Runc].URL; !strings.HasSuffix(got, "/runc.arm64") {
+		t.Errorf("arm64 runc URL = %s", got)
+	}
+}
+
+func TestValidateAddons(t *testing.T) {
+	c := NewCatalog()
+	if err := c.ValidateAddons([]string{"coredns", "calico"}, []string{"amd64", "aarch64"}); err != nil {
+		t.Errorf("ValidateAddons() error = %v", err)
+	}
+
+	c.AddAddon("legacy-dashboard", Image{Name: "example.com/dashboard", Platforms: []string{"amd64"}})
+	err := c.ValidateAddons([]string{"legacy-dashboard", "calico"}, []string{"amd64", "arm64", "arm"})
+	if !errors.Is(err, ErrMissingPlatform) {
+		t.Fatalf("ValidateAddons() error = %v, want ErrMissingPlatform", err)
+	}
+	if !strings.Contains(err.Error(), "example.com/dashboard lacks arm, arm64") || !strings.Contains(err.Error(), "calico/node lacks arm") {
+		t.Errorf("unexpected error message: %v", err)
+	}
+
+	if err := c.ValidateAddons([]string{"nope"}, []string{"amd64"}); err == nil {
+		t.Errorf("expected error for unknown addon")
+	}
+}
+
+func TestCheckKubeletSkew(t *testing.T) {
+	for _, tc := range []struct {
+		apiserver, kubelet string
+		ok                 bool
+	}{
+		{"v1.31.2", "v1.31.0", true},
+		{"v1.31.2", "v1.28.9", true},
+		{"v1.31.2", "v1.27.16", false},
+		{"v1.27.3", "v1.25.0", true},
+		{"v1.27.3", "v1.24.0", false},
+		{"v1.30.1", "v1.31.0", false},
+	} {
+		err := CheckKubeletSkew(tc.apiserver, tc.kubelet)
+		if tc.ok && err != nil {
+			t.Errorf("CheckKubeletSkew(%s, %s) error = %v", tc.apiserver, tc.kubelet, err)
+		}
+		if !tc.ok && !errors.Is(err, ErrVersionSkew) {
+			t.Errorf("CheckKubeletSkew(%s, %s) error = %v, want ErrVersionSkew", tc.apiserver, tc.kubelet, err)
+		}
+	}
+}
+
+func TestUpgradePath(t *testing.T) {
+	c := NewCatalog()
+	for _, tc := range []struct {
+		from, to string
+		want     string
+	}{
+		{"v1.30.2", "v1.30.6", "v1.30.6"},
+		{"v1.30.2", "v1.31.2", "v1.31.2"},
+		{"v1.28.3", "v1.31.2", "v1.29.10 v1.30.6 v1.31.2"},
+		{"v1.26.5", "v1.28.1", "v1.27.16 v1.28.1"},
+		{"v1.31.2", "v1.31.2", ""},
+	} {
+		path, err := c.UpgradePath(tc.from, tc.to)
+		if err != nil {
+			t.Fatalf("UpgradePath(%s, %s) error = %v", tc.from, tc.to, err)
+		}
+		if got := strings.Join(path, " "); got != tc.want {
+			t.Errorf("UpgradePath(%s, %s) = %q, want %q", tc.from, tc.to, got, tc.want)
+		}
+	}
+
+	if _, err := c.UpgradePath("v1.31.2", "v1.30.6"); !errors.Is(err, ErrVersionSkew) {
+		t.Errorf("downgrade error = %v, want ErrVersionSkew", err)
+	}
+	if _, err := c.UpgradePath("v1.30.2", "v1.33.0"); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("UpgradePath to an unknown release error = %v, want ErrUnsupportedVersion", err)
+	}
+	c.AddRelease(Release{Kubernetes: "v1.32", Latest: "v1.32.0", Etcd: "v3.4.30"})
+	if _, err := c.UpgradePath("v1.31.2", "v1.32.0"); !errors.Is(err, ErrVersionSkew) {
+		t.Errorf("etcd downgrade error = %v, want ErrVersionSkew", err)
+	}
+}
@@ -0,0 +1,99 @@
+package catalog
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ErrMissingPlatform is returned (wrapped) when an addon image is not published for an architecture in the cluster.
+var ErrMissingPlatform = errors.New("image not available for architecture")
+
+// Image is a container image together with the architectures its manifest list covers.
+type Image struct {
+	Name      string
+	Platforms []string
+}
+
+// Supports reports whether the image is published for arch.
+func (i Image) Supports(arch string) bool {
+	goArch := NormalizeArch(arch)
+	for _, p := range i.Platforms {
+		if NormalizeArch(p) == goArch {
+			return true
+		}
+	}
+	return false
+}
+
+var defaultAddons = map[string][]Image{
+	"coredns":        {{Name: "registry.k8s.io/coredns/coredns", Platforms: []string{"amd64", "arm64", "arm", "ppc64le", "s390x"}}},
+	"pause":          {{Name: "registry.k8s.io/pause", Platforms: []string{"amd64", "arm64", "arm", "ppc64le", "s390x"}}},
+	"metrics-server": {{Name: "registry.k8s.io/metrics-server/metrics-server", Platforms: []string{"amd64", "arm64", "arm", "ppc64le", "s390x"}}},
+	"calico": {
+		{Name: "docker.io/calico/cni", Platforms: []string{"amd64", "arm64", "ppc64le", "s390x"}},
+		{Name: "docker.io/calico/node", Platforms: []string{"amd64", "arm64", "ppc64le", "s390x"}},
+		{Name: "docker.io/calico/kube-controllers", Platforms: []string{"amd64", "arm64", "ppc64le", "s390x"}},
+	},
+	"flannel": {
+		{Name: "docker.io/flannel/flannel", Platforms: []string{"amd64", "arm64", "arm", "ppc64le", "s390x"}},
+		{Name: "docker.io/flannel/flannel-cni-plugin", Platforms: []string{"amd64", "arm64", "arm", "ppc64le", "s390x"}},
+	},
+}
+
+// AddAddon registers or replaces the images an addon deploys.
+func (c *Catalog) AddAddon(name string, images ...Image) {
+	c.addons[name] = images
+}
+
+// AddonImages returns the images registered for an addon.
+func (c *Catalog) AddonImages(name string) ([]Image, bool) {
+	images, ok := c.addons[name]
+	return images, ok
+}
+
+// ValidateAddons checks that every image of the requested addons is published for
+// every architecture in the cluster, so mixed amd64/arm64 clusters fail before
+// pods end up in ImagePullBackOff on part of the nodes.
+func (c *Catalog) ValidateAddons(addons []string, arches []string) error {
+	var errs []error
+	for _, name := range addons {
+		images, ok := c.addons[name]
+		if !ok {
+			errs = append(errs, fmt.Errorf("unknown addon %q", name))
+			continue
+		}
+		for _, img := range images {
+			var missing []string
+			for _, arch := range arches {
+				if !img.Supports(arch) {
+					missing = append(missing, NormalizeArch(arch))
+				}
+			}
+			if len(missing) > 0 {
+				sort.Strings(missing)
+				errs = append(errs, fmt.Errorf("%w: addon %s image %s lacks %s", ErrMissingPlatform, name, img.Name, strings.Join(missing, ", ")))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ResolveArches resolves one bundle per distinct architecture, keyed by Go architecture name,
+// so each node can be given binaries matching its own platform.
+func (c *Catalog) ResolveArches(kubernetesVersion string, arches []string, overrides map[Component]string) (map[string]*Bundle, error) {
+	bundles := make(map[string]*Bundle, len(arches))
+	for _, arch := range arches {
+		goArch := NormalizeArch(arch)
+		if _, ok := bundles[goArch]; ok {
+			continue
+		}
+		bundle, err := c.Resolve(kubernetesVersion, arch, overrides)
+		if err != nil {
+			return nil, err
+		}
+		bundles[goArch] = bundle
+	}
+	return bundles, nil
+}
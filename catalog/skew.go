@@ -0,0 +1,109 @@
+package catalog
+
+import "fmt"
+
+// KubeletSkew returns how many minor releases a kubelet may lag behind an
+// apiserver of version apiserver: three from v1.28 on, two before. A kubelet
+// is never newer than the apiserver.
+func KubeletSkew(apiserver Version) int {
+	if apiserver.Major == 1 && apiserver.Minor < 28 {
+		return 2
+	}
+	return 3
+}
+
+// CheckKubeletSkew checks that a kubelet of version kubelet may talk to an
+// apiserver of version apiserver.
+func CheckKubeletSkew(apiserver, kubelet string) error {
+	a, err := ParseVersion(apiserver)
+	if err != nil {
+		return fmt.Errorf("%w: kube-apiserver %q: %v", ErrUnsupportedVersion, apiserver, err)
+	}
+	k, err := ParseVersion(kubelet)
+	if err != nil {
+		return fmt.Errorf("%w: kubelet %q: %v", ErrUnsupportedVersion, kubelet, err)
+	}
+	switch {
+	case k.Major != a.Major:
+		return fmt.Errorf("%w: kubelet %s with kube-apiserver %s", ErrVersionSkew, k, a)
+	case k.Minor > a.Minor:
+		return fmt.Errorf("%w: kubelet %s is newer than kube-apiserver %s", ErrVersionSkew, k, a)
+	case a.Minor-k.Minor > KubeletSkew(a):
+		return fmt.Errorf("%w: kubelet %s is more than %d minor releases older than kube-apiserver %s", ErrVersionSkew, k, KubeletSkew(a), a)
+	}
+	return nil
+}
+
+// UpgradePath returns the versions a cluster at from goes through to reach
+// to. kubeadm upgrades the control plane one minor release at a time, so every
+// minor release in between is a hop, at its Latest patch release; to is the
+// last hop. Downgrades and hops that would downgrade etcd, whose data cannot
+// be moved back, are refused.
+func (c *Catalog) UpgradePath(from, to string) ([]string, error) {
+	f, err := ParseVersion(from)
+	if err != nil {
+		return nil, fmt.Errorf("%w: kubernetes %q: %v", ErrUnsupportedVersion, from, err)
+	}
+	t, err := ParseVersion(to)
+	if err != nil {
+		return nil, fmt.Errorf("%w: kubernetes %q: %v", ErrUnsupportedVersion, to, err)
+	}
+	switch {
+	case f.Major != t.Major:
+		return nil, fmt.Errorf("%w: cannot upgrade from %s to %s", ErrVersionSkew, f, t)
+	case t.Compare(f) < 0:
+		return nil, fmt.Errorf("%w: %s is older than %s, downgrades are not supported", ErrVersionSkew, t, f)
+	case t.Compare(f) == 0:
+		return nil, nil
+	}
+
+	// A cluster older than the catalog can still upgrade into it.
+	prev, known := c.releases[f.MinorString()]
+	var path []string
+	for minor := f.Minor + 1; minor <= t.Minor; minor++ {
+		hop := t.String()
+		r, err := c.Release(Version{Major: t.Major, Minor: minor}.String())
+		if err != nil {
+			return nil, err
+		}
+		if minor < t.Minor {
+			latest, err := ParseVersion(r.Latest)
+			if err != nil {
+				return nil, fmt.Errorf("%w: kubernetes %s has no patch release to upgrade through", ErrUnsupportedVersion, r.Kubernetes)
+			}
+			hop = latest.String()
+		}
+		if known {
+			if err := checkEtcdUpgrade(prev, r); err != nil {
+				return nil, err
+			}
+		}
+		path = append(path, hop)
+		prev, known = r, true
+	}
+	if f.Minor == t.Minor {
+		path = append(path, t.String())
+	}
+	return path, nil
+}
+
+// checkEtcdUpgrade checks that the etcd of release to can take over the data
+// of the etcd of release from.
+func checkEtcdUpgrade(from, to Release) error {
+	if from.Etcd == "" || to.Etcd == "" {
+		return nil
+	}
+	f, err := ParseVersion(from.Etcd)
+	if err != nil {
+		return fmt.Errorf("invalid catalog version %q for %s: %w", from.Etcd, Etcd, err)
+	}
+	t, err := ParseVersion(to.Etcd)
+	if err != nil {
+		return fmt.Errorf("invalid catalog version %q for %s: %w", to.Etcd, Etcd, err)
+	}
+	if t.Major != f.Major || t.Minor < f.Minor || t.Minor > f.Minor+1 {
+		return fmt.Errorf("%w: kubernetes %s comes with etcd %s, which cannot upgrade etcd %s of kubernetes %s",
+			ErrVersionSkew, to.Kubernetes, t, f, from.Kubernetes)
+	}
+	return nil
+}
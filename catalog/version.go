@@ -0,0 +1,79 @@
+package catalog
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Version is a parsed semantic version such as v1.30.2. Pre-release and build suffixes are kept
+// verbatim in Suffix and ignored by comparisons.
+type Version struct {
+	Major  int
+	Minor  int
+	Patch  int
+	Suffix string
+}
+
+// ParseVersion parses "v1.30.2", "1.30.2" or "1.30" (patch defaults to 0).
+func ParseVersion(s string) (Version, error) {
+	trimmed := strings.TrimPrefix(strings.TrimSpace(s), "v")
+	if trimmed == "" {
+		return Version{}, fmt.Errorf("empty version")
+	}
+	core := trimmed
+	var suffix string
+	if i := strings.IndexAny(trimmed, "-+"); i >= 0 {
+		core, suffix = trimmed[:i], trimmed[i:]
+	}
+	parts := strings.Split(core, ".")
+	if len(parts) < 2 || len(parts) > 3 {
+		return Version{}, fmt.Errorf("invalid version %q: expected major.minor[.patch]", s)
+	}
+	nums := make([]int, 3)
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return Version{}, fmt.Errorf("invalid version %q: %q is not a non-negative number", s, p)
+		}
+		nums[i] = n
+	}
+	return Version{Major: nums[0], Minor: nums[1], Patch: nums[2], Suffix: suffix}, nil
+}
+
+// MustParseVersion is like ParseVersion but panics on error. Intended for static catalog data.
+func MustParseVersion(s string) Version {
+	v, err := ParseVersion(s)
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+// String returns the version with a leading "v", e.g. v1.30.2.
+func (v Version) String() string {
+	return fmt.Sprintf("v%d.%d.%d%s", v.Major, v.Minor, v.Patch, v.Suffix)
+}
+
+// MinorString returns the major.minor part with a leading "v", e.g. v1.30.
+func (v Version) MinorString() string {
+	return fmt.Sprintf("v%d.%d", v.Major, v.Minor)
+}
+
+// Compare returns -1, 0 or 1 depending on whether v is lower than, equal to or higher than o.
+func (v Version) Compare(o Version) int {
+	for _, d := range []int{v.Major - o.Major, v.Minor - o.Minor, v.Patch - o.Patch} {
+		if d < 0 {
+			return -1
+		}
+		if d > 0 {
+			return 1
+		}
+	}
+	return 0
+}
+
+// SameMinor reports whether v and o share major and minor versions.
+func (v Version) SameMinor(o Version) bool {
+	return v.Major == o.Major && v.Minor == o.Minor
+}
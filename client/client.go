@@ -0,0 +1,345 @@
+// Package client runs the operations of the xm command from Go programs, so
+// they can manage clusters without shelling out to the binary. A Client works
+// on one cluster configuration and keeps its state in the same work directory
+// as xm, so the command and the programs embedding the package can take turns
+// on a cluster:
+//
+//	c, err := client.Load(ctx, "cluster.yaml", client.WithEvents(events, logrus.InfoLevel))
+//	...
+//	res, err := c.Apply(ctx, client.ApplyOptions{})
+//
+// Failures are classified as by the command (see package errs). The pipeline
+// policies carried by the context, like a pipeline.Quarantine, apply to the
+// operations as well.
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+
+	"github.com/mensylisir/xmcores/cache"
+	"github.com/mensylisir/xmcores/common"
+	"github.com/mensylisir/xmcores/config"
+	"github.com/mensylisir/xmcores/errs"
+	"github.com/mensylisir/xmcores/kube"
+	"github.com/mensylisir/xmcores/logger"
+	"github.com/mensylisir/xmcores/modules"
+	"github.com/mensylisir/xmcores/pipeline"
+	"github.com/mensylisir/xmcores/runhook"
+	"github.com/mensylisir/xmcores/workspace"
+)
+
+// Client runs operations on a cluster. It is safe for concurrent use, but
+// the operations that change the cluster hold its lock and fail fast while
+// another one runs.
+type Client struct {
+	cluster    *config.Cluster
+	configData []byte
+	workDir    string
+	server     string
+	retention  workspace.Retention
+	events     chan<- Event
+	eventLevel logrus.Level
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithWorkDir sets the directory holding the state of every managed cluster,
+// common.DefaultWorkDir by default.
+func WithWorkDir(dir string) Option {
+	return func(c *Client) { c.workDir = dir }
+}
+
+// WithConfigData sets the configuration saved to the work directory as
+// given, e.g. still encrypted; by default the parsed configuration is saved.
+func WithConfigData(data []byte) Option {
+	return func(c *Client) { c.configData = data }
+}
+
+// WithServer overrides the apiserver address of the admin kubeconfig.
+func WithServer(address string) Option {
+	return func(c *Client) { c.server = address }
+}
+
+// WithRetention sets what is kept of the work directory after each
+// operation, workspace.DefaultRetention by default.
+func WithRetention(r workspace.Retention) Option {
+	return func(c *Client) { c.retention = r }
+}
+
+// WithEvents streams the log entries of level or more severe to events while
+// operations run. Entries are dropped rather than stall the operation when
+// events is full. The log is process-wide, so operations running at the same
+// time share their events.
+func WithEvents(events chan<- Event, level logrus.Level) Option {
+	return func(c *Client) { c.events, c.eventLevel = events, level }
+}
+
+// New returns a client for cluster, whose defaults are applied and which is
+// validated. Addresses left to an inventory provider must have been resolved
+// (see config.Cluster.ResolveAddresses); Load does so.
+func New(cluster *config.Cluster, opts ...Option) (*Client, error) {
+	if cluster == nil {
+		return nil, errs.Wrap(errs.Config, errors.New("a cluster configuration is required"))
+	}
+	cluster.SetDefaults()
+	if err := cluster.Validate(); err != nil {
+		return nil, errs.Wrap(errs.Config, err)
+	}
+	c := &Client{cluster: cluster, workDir: common.DefaultWorkDir, retention: workspace.DefaultRetention}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c, nil
+}
+
+// Load returns a client for the configuration file path, with the host
+// addresses resolved. The file is saved to the work directory as given.
+func Load(ctx context.Context, path string, opts ...Option) (*Client, error) {
+	cluster, err := config.Load(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := cluster.ResolveAddresses(ctx); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errs.Wrap(errs.Config, err)
+	}
+	return New(cluster, append([]Option{WithConfigData(data)}, opts...)...)
+}
+
+// Cluster returns the configuration of the client.
+func (c *Client) Cluster() *config.Cluster {
+	return c.cluster
+}
+
+// Event is a log entry of a running operation.
+type Event struct {
+	Time    time.Time
+	Level   logrus.Level
+	Message string
+	// Module, Step and Node are set when the entry was logged for them.
+	Module, Step, Node string
+}
+
+func newEvent(rec logger.Record) Event {
+	field := func(key string) string {
+		if v, ok := rec.Fields[key]; ok {
+			return fmt.Sprint(v)
+		}
+		return ""
+	}
+	return Event{
+		Time:    rec.Time,
+		Level:   rec.Level,
+		Message: rec.Message,
+		Module:  field(common.ModuleName),
+		Step:    field(common.StepName),
+		Node:    field(common.NodeName),
+	}
+}
+
+// Result describes a completed operation.
+type Result struct {
+	// ID identifies the run in the history of the cluster.
+	ID                string
+	Command           string
+	Started, Finished time.Time
+	// Steps are the pipeline steps run, in the order they started.
+	Steps []pipeline.Span
+	// Hosts are the transfer and execution statistics of the hosts the
+	// operation connected to.
+	Hosts []workspace.HostStats
+	// Journal lists what the operation changed on the hosts, with
+	// spec.journal.
+	Journal []modules.Change
+}
+
+// Session runs fn as the operation command with the work directory of the
+// cluster, records the run in its history and then trims the directory.
+// With lock, the cluster lock is held meanwhile, so concurrent operations
+// that change the cluster fail fast. The context passed to fn carries the
+// cluster's cache store, so runs reuse what earlier ones computed, a
+// pipeline.Timeline and a modules.ConnStats the returned Result and the
+// recorded run are made of, with spec.sandbox, the modules.Sandbox
+// unprivileged steps run in and, with spec.journal, the modules.Journal
+// whose changes are appended to the change journal of the cluster. Operations that take the lock run the hooks of
+// spec.hooks around fn: a failing preRun hook aborts the operation, failing
+// postSuccess and postFailure hooks are only logged.
+func (c *Client) Session(ctx context.Context, command string, lock bool, fn func(ctx context.Context, ws *workspace.Cluster) error) (Result, error) {
+	res := Result{ID: uuid.New().String()[:8], Command: command, Started: time.Now()}
+	ws, err := workspace.New(c.workDir).Cluster(c.cluster.Metadata.Name)
+	if err != nil {
+		return res, errs.Wrap(errs.Config, err)
+	}
+	if lock {
+		unlock, err := ws.Lock(command)
+		if err != nil {
+			return res, errs.Wrap(errs.Preflight, err)
+		}
+		defer func() {
+			if err := unlock(); err != nil {
+				logger.Log.Warnf("failed to release the lock of cluster %s: %v", ws.Name, err)
+			}
+		}()
+	}
+	data := c.configData
+	if data == nil {
+		if data, err = c.cluster.Marshal(); err != nil {
+			return res, errs.Wrap(errs.Config, err)
+		}
+	}
+	if err := ws.SaveConfig(data); err != nil {
+		return res, err
+	}
+	if c.events != nil {
+		events := c.events
+		unsubscribe := logger.Log.Subscribe(c.eventLevel, func(rec logger.Record) {
+			select {
+			case events <- newEvent(rec):
+			default:
+			}
+		})
+		defer unsubscribe()
+	}
+	if sb := c.cluster.Spec.Sandbox; sb != nil {
+		ctx = modules.WithSandbox(ctx, modules.NewSandbox(*sb))
+	}
+	stats := modules.NewConnStats()
+	ctx = modules.WithConnStats(ctx, stats)
+	var journal *modules.Journal
+	if cfg := c.cluster.Spec.Journal; cfg != nil {
+		journal = modules.NewJournal(res.ID, *cfg)
+		ctx = modules.WithJournal(ctx, journal)
+	}
+	tl, ok := pipeline.TimelineFrom(ctx)
+	if !ok {
+		tl = &pipeline.Timeline{}
+		ctx = pipeline.WithTimeline(ctx, tl)
+	}
+
+	var hooks *runhook.Config
+	if lock {
+		hooks = c.cluster.Spec.Hooks
+	}
+	hookRun := runhook.Run{Cluster: ws.Name, Command: command, Started: res.Started}
+	run := workspace.Run{ID: res.ID, Command: command, Started: res.Started}
+	if hooks != nil {
+		if err = hooks.Before(ctx, hookRun); err != nil {
+			err = errs.Wrap(errs.Preflight, err)
+		}
+	}
+	if err == nil {
+		err = fn(cache.WithStore(ctx, ws.Store()), ws)
+	}
+	run.Finished, run.Hosts = time.Now(), hostStats(stats)
+	res.Finished, res.Steps, res.Hosts = run.Finished, tl.Spans(), run.Hosts
+	if err != nil {
+		run.Error = err.Error()
+	}
+	if hooks != nil {
+		hookRun.Finished, hookRun.Error = run.Finished, run.Error
+		if herr := hooks.After(ctx, hookRun); herr != nil {
+			logger.Log.Warnf("cluster %s: %v", ws.Name, herr)
+		}
+	}
+	if rerr := ws.RecordRun(run); rerr != nil {
+		logger.Log.Warnf("cluster %s: %v", ws.Name, rerr)
+	}
+	if journal != nil {
+		res.Journal = journal.Changes()
+		if jerr := ws.RecordChanges(res.Journal); jerr != nil {
+			logger.Log.Warnf("cluster %s: %v", ws.Name, jerr)
+		}
+	}
+	removed, gcErr := ws.GC(c.retention)
+	for _, p := range removed {
+		logger.Log.Infof("Cleaned %s", p)
+	}
+	if gcErr != nil {
+		logger.Log.Warnf("cluster %s: %v", ws.Name, gcErr)
+	}
+	return res, err
+}
+
+// hostStats returns the statistics of s, sorted by host.
+func hostStats(s *modules.ConnStats) []workspace.HostStats {
+	var out []workspace.HostStats
+	for host, st := range s.Hosts() {
+		out = append(out, workspace.HostStats{
+			Host:        host,
+			Uploaded:    st.Uploaded,
+			Downloaded:  st.Downloaded,
+			Commands:    st.Commands,
+			Failures:    st.Failures,
+			MeanLatency: st.MeanLatency(),
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Host < out[j].Host })
+	return out
+}
+
+// connect connects to the hosts of the cluster.
+func (c *Client) connect(ctx context.Context) ([]modules.Node, error) {
+	return modules.ConnectWith(ctx, c.cluster.Hosts(), c.cluster.Dialer())
+}
+
+// controlPlanes returns the control-plane nodes among nodes.
+func controlPlanes(nodes []modules.Node) ([]modules.Node, error) {
+	var out []modules.Node
+	for _, n := range nodes {
+		if n.Host.IsRole(common.RoleControlPlane) {
+			out = append(out, n)
+		}
+	}
+	if len(out) == 0 {
+		return nil, errs.Wrap(errs.Config, errors.New("the configuration has no control-plane host"))
+	}
+	return out, nil
+}
+
+// KubeClient creates an API client from the admin kubeconfig of the first
+// control-plane host and keeps the kubeconfig in the work directory ws.
+func (c *Client) KubeClient(ctx context.Context, ws *workspace.Cluster) (*kube.Client, error) {
+	hosts := c.cluster.HostsByRole(common.RoleControlPlane)
+	if len(hosts) == 0 {
+		return nil, errs.Wrap(errs.Config, errors.New("the configuration has no control-plane host"))
+	}
+	nodes, err := modules.ConnectWith(ctx, hosts[:1], c.cluster.Dialer())
+	if err != nil {
+		return nil, err
+	}
+	defer modules.Close(nodes)
+	return c.AdminClient(ctx, nodes[0], ws)
+}
+
+// AdminClient creates an API client from the admin kubeconfig of a
+// control-plane node and keeps the kubeconfig in the work directory ws. The
+// address set with WithServer replaces the one in the kubeconfig.
+func (c *Client) AdminClient(ctx context.Context, node modules.Node, ws *workspace.Cluster) (*kube.Client, error) {
+	data, err := kube.FetchAdminKubeconfig(ctx, node.Conn)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", node.Name(), err)
+	}
+	if err := ws.SaveKubeconfig(data); err != nil {
+		return nil, err
+	}
+	cfg, err := kube.ParseKubeconfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", node.Name(), err)
+	}
+	if c.server != "" {
+		cfg.Server = c.server
+	}
+	return kube.NewClient(cfg)
+}
@@ -0,0 +1,183 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mensylisir/xmcores/config"
+	"github.com/mensylisir/xmcores/connector"
+	"github.com/mensylisir/xmcores/connector/connectortest"
+	"github.com/mensylisir/xmcores/errs"
+	"github.com/mensylisir/xmcores/logger"
+	"github.com/mensylisir/xmcores/modules"
+	"github.com/mensylisir/xmcores/runhook"
+	"github.com/mensylisir/xmcores/workspace"
+)
+
+const testConfig = `apiVersion: xmcores.io/v1alpha1
+kind: Cluster
+metadata:
+  name: demo
+spec:
+  hosts:
+    - name: master1
+      address: 192.168.0.10
+      user: root
+      password: secret
+      roles: [control-plane, etcd]
+  kubernetes:
+    version: v1.30.2
+`
+
+func TestNew(t *testing.T) {
+	_, err := New(nil)
+	assert.Equal(t, errs.Config, errs.KindOf(err))
+
+	cluster, err := config.Parse([]byte(testConfig))
+	require.NoError(t, err)
+	cluster.Spec.Hosts = nil
+	_, err = New(cluster)
+	assert.Equal(t, errs.Config, errs.KindOf(err))
+}
+
+func TestSession(t *testing.T) {
+	cluster, err := config.Parse([]byte(testConfig))
+	require.NoError(t, err)
+	events := make(chan Event, 16)
+	dir := t.TempDir()
+	c, err := New(cluster, WithWorkDir(dir), WithConfigData([]byte(testConfig)), WithEvents(events, logrus.WarnLevel))
+	require.NoError(t, err)
+
+	failure := errs.Wrap(errs.Execution, errors.New("boom"))
+	res, err := c.Session(context.Background(), "test", true, func(ctx context.Context, ws *workspace.Cluster) error {
+		logger.Log.InfofNode("master1", "not streamed")
+		logger.Log.WarnfNode("master1", "streamed")
+		return failure
+	})
+	assert.Same(t, failure, err)
+	assert.Equal(t, "test", res.Command)
+	assert.False(t, res.Finished.Before(res.Started))
+
+	require.Len(t, events, 1)
+	ev := <-events
+	assert.Equal(t, logrus.WarnLevel, ev.Level)
+	assert.Equal(t, "streamed", ev.Message)
+	assert.Equal(t, "master1", ev.Node)
+
+	ws, err := workspace.New(dir).Cluster("demo")
+	require.NoError(t, err)
+	runs, err := ws.History()
+	require.NoError(t, err)
+	require.Len(t, runs, 1)
+	assert.Equal(t, "test", runs[0].Command)
+	assert.Equal(t, failure.Error(), runs[0].Error)
+
+	logger.Log.Warn("after the session")
+	assert.Empty(t, events, "the subscription ends with the session")
+}
+
+func TestSessionHooks(t *testing.T) {
+	cluster, err := config.Parse([]byte(testConfig))
+	require.NoError(t, err)
+	out := filepath.Join(t.TempDir(), "hooks")
+	record := `echo "$XM_HOOK_EVENT $XM_COMMAND" >> ` + out
+	cluster.Spec.Hooks = &runhook.Config{
+		PreRun:      []runhook.Hook{{Command: record}, {Command: "exit 1", Commands: []string{"blocked"}}},
+		PostFailure: []runhook.Hook{{Command: record}},
+	}
+	c, err := New(cluster, WithWorkDir(t.TempDir()), WithConfigData([]byte(testConfig)))
+	require.NoError(t, err)
+
+	ran := false
+	_, err = c.Session(context.Background(), "blocked", true, func(ctx context.Context, ws *workspace.Cluster) error {
+		ran = true
+		return nil
+	})
+	assert.Equal(t, errs.Preflight, errs.KindOf(err))
+	assert.False(t, ran, "a failing preRun hook aborts the operation")
+
+	_, err = c.Session(context.Background(), "status", false, func(ctx context.Context, ws *workspace.Cluster) error {
+		return nil
+	})
+	require.NoError(t, err)
+
+	data, err := os.ReadFile(out)
+	require.NoError(t, err)
+	assert.Equal(t, "preRun blocked\npostFailure blocked\n", string(data), "read-only operations run no hooks")
+}
+
+func TestSessionStats(t *testing.T) {
+	cluster, err := config.Parse([]byte(testConfig))
+	require.NoError(t, err)
+	c, err := New(cluster, WithWorkDir(t.TempDir()), WithConfigData([]byte(testConfig)))
+	require.NoError(t, err)
+
+	fake := connectortest.NewFake().On(`false`, connectortest.Result{ExitCode: 1})
+	dial := func(connector.Host) (connector.Connection, error) { return fake, nil }
+	var ws *workspace.Cluster
+	res, err := c.Session(context.Background(), "apply", true, func(ctx context.Context, w *workspace.Cluster) error {
+		ws = w
+		nodes, err := modules.ConnectWith(ctx, cluster.Hosts(), dial)
+		if err != nil {
+			return err
+		}
+		defer modules.Close(nodes)
+		_, _, _, _ = nodes[0].Conn.Exec(ctx, "true")
+		_, _, _, _ = nodes[0].Conn.Exec(ctx, "false")
+		return nodes[0].Conn.Scp(ctx, strings.NewReader("hello"), "/tmp/hello", 5, 0644)
+	})
+	require.NoError(t, err)
+	require.Len(t, res.Hosts, 1)
+	st := res.Hosts[0]
+	assert.Equal(t, "master1", st.Host)
+	assert.Equal(t, int64(5), st.Uploaded)
+	assert.Equal(t, 2, st.Commands)
+	assert.Equal(t, 1, st.Failures)
+
+	run, err := ws.Run(res.ID[:4])
+	require.NoError(t, err)
+	assert.Equal(t, res.Hosts, run.Hosts, "the statistics are recorded in the history")
+}
+
+func TestSessionJournal(t *testing.T) {
+	cluster, err := config.Parse([]byte(testConfig))
+	require.NoError(t, err)
+	c, err := New(cluster, WithWorkDir(t.TempDir()), WithConfigData([]byte(testConfig)))
+	require.NoError(t, err)
+	_, err = c.RevertChanges(context.Background(), "ab12cd34")
+	assert.Equal(t, errs.Config, errs.KindOf(err), "reverts are journaled, so the journal must be enabled")
+
+	cluster.Spec.Journal = &modules.JournalConfig{}
+	c, err = New(cluster, WithWorkDir(t.TempDir()), WithConfigData([]byte(testConfig)))
+	require.NoError(t, err)
+	fake := connectortest.NewFake()
+	dial := func(connector.Host) (connector.Connection, error) { return fake, nil }
+	var ws *workspace.Cluster
+	res, err := c.Session(context.Background(), "apply", true, func(ctx context.Context, w *workspace.Cluster) error {
+		ws = w
+		nodes, err := modules.ConnectWith(ctx, cluster.Hosts(), dial)
+		if err != nil {
+			return err
+		}
+		defer modules.Close(nodes)
+		_, err = modules.WriteFileWith(ctx, nodes[0], []byte("hello\n"), "/etc/hello", 0644, modules.WriteOptions{})
+		return err
+	})
+	require.NoError(t, err)
+	require.Len(t, res.Journal, 1)
+	assert.Equal(t, res.ID+".1", res.Journal[0].ID)
+	assert.Equal(t, "created /etc/hello", res.Journal[0].Describe())
+
+	changes, err := ws.Changes()
+	require.NoError(t, err)
+	assert.Equal(t, res.Journal[0].ID, changes[0].ID)
+	assert.Equal(t, "master1", changes[0].Host)
+}
@@ -0,0 +1,527 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/mensylisir/xmcores/catalog"
+	"github.com/mensylisir/xmcores/common"
+	"github.com/mensylisir/xmcores/connector"
+	"github.com/mensylisir/xmcores/drift"
+	"github.com/mensylisir/xmcores/errs"
+	"github.com/mensylisir/xmcores/logger"
+	"github.com/mensylisir/xmcores/modules"
+	"github.com/mensylisir/xmcores/modules/certrotate"
+	"github.com/mensylisir/xmcores/modules/csrapprove"
+	"github.com/mensylisir/xmcores/modules/endpointmigrate"
+	"github.com/mensylisir/xmcores/modules/etcdops"
+	"github.com/mensylisir/xmcores/modules/imagepush"
+	"github.com/mensylisir/xmcores/modules/k3s"
+	"github.com/mensylisir/xmcores/modules/nodeprep"
+	"github.com/mensylisir/xmcores/modules/nodereset"
+	"github.com/mensylisir/xmcores/modules/ping"
+	"github.com/mensylisir/xmcores/modules/registrycheck"
+	"github.com/mensylisir/xmcores/modules/systune"
+	"github.com/mensylisir/xmcores/modules/trustca"
+	"github.com/mensylisir/xmcores/reconcile"
+	"github.com/mensylisir/xmcores/registry"
+	"github.com/mensylisir/xmcores/workspace"
+)
+
+// DiffResult is the outcome of Diff.
+type DiffResult struct {
+	Result
+	Changes []drift.Change
+}
+
+// Diff reports how the live cluster differs from the configuration.
+func (c *Client) Diff(ctx context.Context) (DiffResult, error) {
+	var out DiffResult
+	res, err := c.Session(ctx, "diff", false, func(ctx context.Context, ws *workspace.Cluster) error {
+		kc, err := c.KubeClient(ctx, ws)
+		if err != nil {
+			return err
+		}
+		observed, err := drift.Observe(ctx, kc, drift.Addons(c.cluster))
+		if err != nil {
+			return errs.Wrap(errs.Execution, err)
+		}
+		out.Changes = drift.Compare(drift.Desired(c.cluster), observed)
+		return nil
+	})
+	out.Result = res
+	return out, err
+}
+
+// ApplyOptions control Apply.
+type ApplyOptions struct {
+	// DryRun computes the plan without changing anything.
+	DryRun bool
+	// Review sees the plan before it is checked and applied, e.g. to print it.
+	Review func(plan reconcile.Plan)
+	// Confirm is asked before nodes are drained and removed from the
+	// cluster; an error cancels the run. Nil refuses to remove nodes.
+	Confirm func(removals []reconcile.Step) error
+}
+
+// ApplyResult is the outcome of Apply.
+type ApplyResult struct {
+	Result
+	Plan reconcile.Plan
+	// Applied reports whether the plan was carried out.
+	Applied bool
+	// NodePrepare has what the swap, SELinux and firewall policies changed
+	// on each joined host.
+	NodePrepare []nodeprep.Result
+	// SysTune has a report per joined host of the sysctls corrected while
+	// preparing it.
+	SysTune []systune.Report
+}
+
+// Apply reconciles the live cluster toward the configuration: it joins the
+// nodes missing from the cluster, upgrades and relabels those that drifted,
+// installs the missing addons and removes the nodes missing from the
+// configuration. The cluster must be running: its admin kubeconfig is
+// fetched from the first control-plane host. The checksums of the binaries
+// spec.binaries downloads are fetched while planning, also in a dry run, and
+// kept in the workspace cache.
+func (c *Client) Apply(ctx context.Context, opts ApplyOptions) (ApplyResult, error) {
+	var out ApplyResult
+	res, err := c.Session(ctx, "apply", true, func(ctx context.Context, ws *workspace.Cluster) error {
+		nodes, err := c.connect(ctx)
+		if err != nil {
+			return err
+		}
+		defer modules.Close(nodes)
+		cps, err := controlPlanes(nodes)
+		if err != nil {
+			return err
+		}
+		kc, err := c.AdminClient(ctx, cps[0], ws)
+		if err != nil {
+			return err
+		}
+
+		observed, err := drift.Observe(ctx, kc, drift.Addons(c.cluster))
+		if err != nil {
+			return errs.Wrap(errs.Execution, err)
+		}
+		out.Plan = reconcile.NewPlan(drift.Compare(drift.Desired(c.cluster), observed))
+		if opts.Review != nil {
+			opts.Review(out.Plan)
+		}
+		if err := reconcile.CheckSkew(out.Plan, catalog.NewCatalog(), c.cluster.Spec.Kubernetes.Version); err != nil {
+			return err
+		}
+		byName := make(map[string]modules.Node, len(nodes))
+		for _, n := range nodes {
+			byName[n.Name()] = n
+		}
+		env := reconcile.Env{Cluster: c.cluster, Client: kc, Nodes: byName, CacheDir: ws.CacheDir()}
+		if err := reconcile.CheckArtifacts(ctx, env, out.Plan); err != nil {
+			return err
+		}
+		if opts.DryRun || out.Plan.Empty() {
+			return nil
+		}
+		if removals := out.Plan.Destructive(); len(removals) > 0 {
+			if opts.Confirm == nil {
+				targets := make([]string, 0, len(removals))
+				for _, s := range removals {
+					targets = append(targets, s.Target)
+				}
+				return errs.Wrap(errs.Config, fmt.Errorf("the plan removes %s, which was not confirmed", strings.Join(targets, ", ")))
+			}
+			if err := opts.Confirm(removals); err != nil {
+				return err
+			}
+		}
+		out.Applied = true
+		outcome, err := reconcile.Apply(ctx, env, out.Plan)
+		out.NodePrepare, out.SysTune = outcome.NodePrepare, outcome.SysTune
+		return err
+	})
+	out.Result = res
+	return out, err
+}
+
+// RotateResult is the outcome of RotateCertificates.
+type RotateResult struct {
+	Result
+	// Availability is that of the API during the rotation.
+	Availability certrotate.Availability
+}
+
+// RotateCertificates renews the control-plane and kubelet serving
+// certificates host by host (see certrotate.Rotate). The API availability is
+// probed through the admin kubeconfig unless opts.Probe is set.
+func (c *Client) RotateCertificates(ctx context.Context, opts certrotate.Options) (RotateResult, error) {
+	var out RotateResult
+	res, err := c.Session(ctx, "certs rotate", true, func(ctx context.Context, ws *workspace.Cluster) error {
+		nodes, err := c.connect(ctx)
+		if err != nil {
+			return err
+		}
+		defer modules.Close(nodes)
+		cps, err := controlPlanes(nodes)
+		if err != nil {
+			return err
+		}
+		kc, err := c.AdminClient(ctx, cps[0], ws)
+		if err != nil {
+			return err
+		}
+		if opts.Probe == nil {
+			opts.Probe = func(ctx context.Context) error {
+				return kc.Get(ctx, "/livez", nil)
+			}
+		}
+		if len(cps) == 1 {
+			logger.Log.Warnf("With a single control-plane host the API is unavailable while its apiserver restarts")
+		}
+		if out.Availability, err = certrotate.Rotate(ctx, cps, nodes, opts); err != nil {
+			return err
+		}
+		// The admin kubeconfig was renewed along with the certificates.
+		_, err = c.AdminClient(ctx, cps[0], ws)
+		return err
+	})
+	out.Result = res
+	return out, err
+}
+
+// MigrateEndpoint moves the cluster to its spec.kubernetes.controlPlaneEndpoint,
+// reissuing certificates and kubeconfigs (see endpointmigrate.Migrate). The
+// apiserver address set with WithServer must keep working meanwhile.
+func (c *Client) MigrateEndpoint(ctx context.Context, opts endpointmigrate.Options) (Result, error) {
+	opts.Endpoint = c.cluster.Spec.Kubernetes.ControlPlaneEndpoint
+	if opts.Endpoint == "" {
+		return Result{Command: "endpoint migrate"}, errs.Wrap(errs.Config, errors.New("spec.kubernetes.controlPlaneEndpoint must be set to the new endpoint"))
+	}
+	return c.Session(ctx, "endpoint migrate", true, func(ctx context.Context, ws *workspace.Cluster) error {
+		nodes, err := c.connect(ctx)
+		if err != nil {
+			return err
+		}
+		defer modules.Close(nodes)
+		cps, err := controlPlanes(nodes)
+		if err != nil {
+			return err
+		}
+		kc, err := c.AdminClient(ctx, cps[0], ws)
+		if err != nil {
+			return err
+		}
+		if err := endpointmigrate.Migrate(ctx, kc, nodes, opts); err != nil {
+			return err
+		}
+		// Save the admin kubeconfig, which now points at the new endpoint.
+		_, err = c.AdminClient(ctx, cps[0], ws)
+		return err
+	})
+}
+
+// InstallK3s installs K3s as spec.k3s configures it (see k3s.Install): the
+// control-plane hosts become servers and the other hosts agents.
+func (c *Client) InstallK3s(ctx context.Context, p k3s.Params) (Result, error) {
+	cfg := c.cluster.Spec.K3s
+	if cfg == nil {
+		return Result{Command: "k3s install"}, errs.Wrap(errs.Config, errors.New("spec.k3s must be set to install K3s"))
+	}
+	if p.Token == "" {
+		p.Token = cfg.Token
+	}
+	return c.Session(ctx, "k3s install", true, func(ctx context.Context, ws *workspace.Cluster) error {
+		nodes, err := c.connect(ctx)
+		if err != nil {
+			return err
+		}
+		defer modules.Close(nodes)
+		servers, err := controlPlanes(nodes)
+		if err != nil {
+			return err
+		}
+		var agents []modules.Node
+		for _, n := range nodes {
+			if !n.Host.IsRole(common.RoleControlPlane) {
+				agents = append(agents, n)
+			}
+		}
+		return k3s.Install(ctx, servers, agents, *cfg, c.cluster.Spec.Kubernetes.ControlPlaneEndpoint, p)
+	})
+}
+
+// EtcdStatusResult is the outcome of EtcdStatus.
+type EtcdStatusResult struct {
+	Result
+	Members []etcdops.Status
+}
+
+// EtcdStatus reports the status of every etcd member. It fails with
+// errs.Verification when the members are unhealthy, returning their status
+// all the same.
+func (c *Client) EtcdStatus(ctx context.Context) (EtcdStatusResult, error) {
+	var out EtcdStatusResult
+	res, err := c.Session(ctx, "etcd status", false, func(ctx context.Context, ws *workspace.Cluster) error {
+		nodes, err := c.ConnectEtcd(ctx)
+		if err != nil {
+			return err
+		}
+		defer modules.Close(nodes)
+		out.Members = etcdops.StatusAll(ctx, nodes, etcdops.DefaultPKI)
+		if err := etcdops.CheckCluster(out.Members); err != nil {
+			return errs.Wrap(errs.Verification, err)
+		}
+		return nil
+	})
+	out.Result = res
+	return out, err
+}
+
+// PingResult is the outcome of Ping.
+type PingResult struct {
+	Result
+	Hosts []ping.Status
+}
+
+// Ping logs in to every host concurrently, without running a pipeline, and
+// reports how it went. It fails with errs.Connectivity when a host cannot be
+// worked on, returning the statuses of all hosts all the same.
+func (c *Client) Ping(ctx context.Context) (PingResult, error) {
+	var out PingResult
+	res, err := c.Session(ctx, "ping", false, func(ctx context.Context, ws *workspace.Cluster) error {
+		out.Hosts = ping.ProbeAll(ctx, c.cluster.Hosts(), c.cluster.Dialer())
+		if err := ping.Check(out.Hosts); err != nil {
+			return errs.Wrap(errs.Connectivity, err)
+		}
+		return nil
+	})
+	out.Result = res
+	return out, err
+}
+
+// PushImagesResult is the outcome of PushImages.
+type PushImagesResult struct {
+	Result
+	Report imagepush.Report
+}
+
+// PushImages pushes the images of the OCI layout at layoutPath, by default
+// spec.imagePreload.path, to spec.registry (see imagepush.Push). Images and
+// blobs the registry already has are skipped. The registry is checked from
+// the controller first (see registrycheck.CheckController).
+func (c *Client) PushImages(ctx context.Context, layoutPath string, opts imagepush.Options) (PushImagesResult, error) {
+	out := PushImagesResult{Result: Result{Command: "images push"}}
+	cfg := c.cluster.Spec.Registry
+	if cfg == nil {
+		return out, errs.Wrap(errs.Config, errors.New("spec.registry must be set to push images"))
+	}
+	if layoutPath == "" && c.cluster.Spec.ImagePreload != nil {
+		layoutPath = c.cluster.Spec.ImagePreload.Path
+	}
+	if layoutPath == "" {
+		return out, errs.Wrap(errs.Config, errors.New("no image layout: set spec.imagePreload.path or pass one"))
+	}
+	rc, err := registry.NewClient(*cfg)
+	if err != nil {
+		return out, errs.Wrap(errs.Config, err)
+	}
+	res, err := c.Session(ctx, "images push", false, func(ctx context.Context, ws *workspace.Cluster) error {
+		if err := registrycheck.CheckController(ctx, *cfg); err != nil {
+			return err
+		}
+		var err error
+		out.Report, err = imagepush.Push(ctx, rc, *cfg, layoutPath, opts)
+		return err
+	})
+	out.Result = res
+	return out, err
+}
+
+// CheckRegistry checks that spec.registry is reachable, trusted and accepts
+// the credentials, from the controller and from a sample node, see
+// registrycheck.Preflight.
+func (c *Client) CheckRegistry(ctx context.Context) (Result, error) {
+	cfg := c.cluster.Spec.Registry
+	if cfg == nil {
+		return Result{Command: "images check"}, errs.Wrap(errs.Config, errors.New("spec.registry must be set to check it"))
+	}
+	return c.Session(ctx, "images check", false, func(ctx context.Context, ws *workspace.Cluster) error {
+		hosts := c.cluster.Hosts()
+		if len(hosts) > 1 {
+			hosts = hosts[:1]
+		}
+		nodes, err := modules.ConnectWith(ctx, hosts, c.cluster.Dialer())
+		if err != nil {
+			return err
+		}
+		defer modules.Close(nodes)
+		return registrycheck.Preflight(ctx, *cfg, nodes)
+	})
+}
+
+// ApproveCSRsResult is the outcome of ApproveServingCSRs.
+type ApproveCSRsResult struct {
+	Result
+	// Approved names the certificate signing requests approved.
+	Approved []string
+}
+
+// ApproveServingCSRs approves the pending kubelet serving certificate
+// requests of the hosts of the configuration that match them strictly (see
+// csrapprove.Check) and leaves the others pending.
+func (c *Client) ApproveServingCSRs(ctx context.Context) (ApproveCSRsResult, error) {
+	var out ApproveCSRsResult
+	res, err := c.Session(ctx, "certs approve", false, func(ctx context.Context, ws *workspace.Cluster) error {
+		kc, err := c.KubeClient(ctx, ws)
+		if err != nil {
+			return err
+		}
+		var nodes []csrapprove.Node
+		for _, h := range c.cluster.Hosts() {
+			nodes = append(nodes, csrapprove.NodeOf(h))
+		}
+		out.Approved, err = csrapprove.ApprovePending(ctx, kc, nodes)
+		return errs.Wrap(errs.Execution, err)
+	})
+	out.Result = res
+	return out, err
+}
+
+// TrustCAs installs the CAs of the configuration, see Cluster.TrustedCAs,
+// in the trust store of every host and in containerd for their registries
+// (see trustca.Deploy).
+func (c *Client) TrustCAs(ctx context.Context) (Result, error) {
+	cas := c.cluster.TrustedCAs()
+	if len(cas) == 0 {
+		return Result{Command: "certs trust"}, errs.Wrap(errs.Config, errors.New("spec.trustedCAs or spec.registry.caFile must be set"))
+	}
+	return c.Session(ctx, "certs trust", true, func(ctx context.Context, ws *workspace.Cluster) error {
+		nodes, err := c.connect(ctx)
+		if err != nil {
+			return err
+		}
+		defer modules.Close(nodes)
+		return trustca.Deploy(ctx, nodes, cas)
+	})
+}
+
+// ResetNode cleans the host name of everything Kubernetes left on it (see
+// nodereset.Node), so that it can be added to the cluster again.
+func (c *Client) ResetNode(ctx context.Context, name string, opts nodereset.Options) (Result, error) {
+	var host connector.Host
+	for _, h := range c.cluster.Hosts() {
+		if h.GetName() == name {
+			host = h
+		}
+	}
+	if host == nil {
+		return Result{Command: "reset node"}, errs.Wrap(errs.Config, fmt.Errorf("no host %q in the configuration", name))
+	}
+	return c.Session(ctx, "reset node", true, func(ctx context.Context, ws *workspace.Cluster) error {
+		nodes, err := modules.ConnectWith(ctx, []connector.Host{host}, c.cluster.Dialer())
+		if err != nil {
+			return err
+		}
+		defer modules.Close(nodes)
+		return errs.WithHost(nodereset.Node(ctx, nodes[0], opts), name)
+	})
+}
+
+// ConnectEtcd connects to the hosts running etcd members: those with the
+// etcd role, or the control-plane hosts of a stacked etcd.
+func (c *Client) ConnectEtcd(ctx context.Context) ([]modules.Node, error) {
+	hosts := c.cluster.HostsByRole(common.RoleEtcd)
+	if len(hosts) == 0 {
+		hosts = c.cluster.HostsByRole(common.RoleControlPlane)
+	}
+	if len(hosts) == 0 {
+		return nil, errs.Wrap(errs.Config, errors.New("no host has the etcd or control-plane role"))
+	}
+	return modules.ConnectWith(ctx, hosts, c.cluster.Dialer())
+}
+
+// RevertResult is the outcome of RevertChanges.
+type RevertResult struct {
+	Result
+	// Reverted are the journaled changes undone, Skipped those that cannot
+	// be (see modules.ErrNotRevertible) or were reverted before.
+	Reverted, Skipped []modules.Change
+}
+
+// RevertChanges undoes the journaled changes of the run whose ID is id or
+// starts with it, or the single change whose ID is id (see
+// workspace.Cluster.ChangesOf). Each host is reverted in the reverse order of
+// its changes and stops at the first change that fails; the reverts are
+// journaled like any other change, so spec.journal must be set.
+func (c *Client) RevertChanges(ctx context.Context, id string) (RevertResult, error) {
+	out := RevertResult{Result: Result{Command: "changes revert"}}
+	if c.cluster.Spec.Journal == nil {
+		return out, errs.Wrap(errs.Config, errors.New("spec.journal must be set to revert changes"))
+	}
+	res, err := c.Session(ctx, "changes revert", true, func(ctx context.Context, ws *workspace.Cluster) error {
+		changes, err := ws.ChangesOf(id)
+		if err != nil {
+			return errs.Wrap(errs.Config, err)
+		}
+		all, err := ws.Changes()
+		if err != nil {
+			return err
+		}
+		reverted := modules.Reverted(all)
+		configured := map[string]connector.Host{}
+		for _, h := range c.cluster.Hosts() {
+			configured[h.GetName()] = h
+		}
+		byHost := map[string][]modules.Change{}
+		var hosts []connector.Host
+		for i := len(changes) - 1; i >= 0; i-- {
+			ch := changes[i]
+			if reverted[ch.ID] != "" {
+				out.Skipped = append(out.Skipped, ch)
+				continue
+			}
+			if _, ok := byHost[ch.Host]; !ok {
+				h, ok := configured[ch.Host]
+				if !ok {
+					return errs.Wrap(errs.Config, fmt.Errorf("change %s: no host %q in the configuration", ch.ID, ch.Host))
+				}
+				hosts = append(hosts, h)
+			}
+			byHost[ch.Host] = append(byHost[ch.Host], ch)
+		}
+		if len(hosts) == 0 {
+			return nil
+		}
+		nodes, err := modules.ConnectWith(ctx, hosts, c.cluster.Dialer())
+		if err != nil {
+			return err
+		}
+		defer modules.Close(nodes)
+		var mu sync.Mutex
+		return modules.ForEach(ctx, nodes, func(ctx context.Context, node modules.Node) error {
+			for _, ch := range byHost[node.Name()] {
+				err := modules.Revert(ctx, node, ch)
+				mu.Lock()
+				switch {
+				case errors.Is(err, modules.ErrNotRevertible):
+					logger.Log.Warnf("%s: skipping change %s, %s: %v", node.Name(), ch.ID, ch.Describe(), err)
+					out.Skipped = append(out.Skipped, ch)
+					err = nil
+				case err == nil:
+					out.Reverted = append(out.Reverted, ch)
+				}
+				mu.Unlock()
+				if err != nil {
+					return fmt.Errorf("change %s, %s: %w", ch.ID, ch.Describe(), err)
+				}
+			}
+			return nil
+		})
+	})
+	out.Result = res
+	return out, err
+}
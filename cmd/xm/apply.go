@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/mensylisir/xmcores/client"
+	"github.com/mensylisir/xmcores/errs"
+	"github.com/mensylisir/xmcores/reconcile"
+)
+
+func runApply(ctx context.Context, args []string) error {
+	var (
+		cf     clusterFlags
+		server string
+		dryRun bool
+		yes    bool
+	)
+	fs := flag.NewFlagSet("xm apply", flag.ContinueOnError)
+	cf.register(fs)
+	fs.StringVar(&server, "server", "", "apiserver address overriding the one in the admin kubeconfig")
+	fs.BoolVar(&dryRun, "dry-run", false, "print the plan without changing anything")
+	fs.BoolVar(&yes, "yes", false, "remove nodes missing from the configuration without asking")
+	cluster, err := cf.parse(ctx, fs, args)
+	if err != nil {
+		return err
+	}
+
+	xc, err := cf.client(cluster, client.WithServer(server))
+	if err != nil {
+		return err
+	}
+
+	res, err := xc.Apply(ctx, client.ApplyOptions{
+		DryRun: dryRun,
+		Review: func(plan reconcile.Plan) { fmt.Print(reconcile.Format(plan)) },
+		Confirm: func(removals []reconcile.Step) error {
+			if yes {
+				return nil
+			}
+			targets := make([]string, 0, len(removals))
+			for _, s := range removals {
+				targets = append(targets, s.Target)
+			}
+			p := &prompter{in: bufio.NewReader(os.Stdin), out: os.Stderr}
+			answer := p.ask(fmt.Sprintf("Drain and remove %s from the cluster? (yes/no)", strings.Join(targets, ", ")), "no")
+			if p.err != nil {
+				return errs.Wrap(errs.Config, p.err)
+			}
+			if answer != "yes" && answer != "y" {
+				return errs.Wrap(errs.Config, errors.New("apply cancelled; rerun with -yes to remove the nodes"))
+			}
+			return nil
+		},
+	})
+	for _, r := range res.SysTune {
+		for _, d := range r.Drift {
+			fmt.Printf("%s: corrected sysctl %s\n", r.Node, d)
+		}
+	}
+	return err
+}
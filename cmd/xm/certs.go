@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"github.com/mensylisir/xmcores/client"
+	"github.com/mensylisir/xmcores/modules/certrotate"
+)
+
+func runCertsRotate(ctx context.Context, args []string) error {
+	var (
+		cf     clusterFlags
+		sf     stepFlags
+		opts   certrotate.Options
+		server string
+	)
+	fs := flag.NewFlagSet("xm certs rotate", flag.ContinueOnError)
+	cf.register(fs)
+	sf.register(fs)
+	fs.StringVar(&server, "server", "", "apiserver address overriding the one in the admin kubeconfig")
+	fs.DurationVar(&opts.MaxOutage, "max-outage", certrotate.DefaultMaxOutage, "longest API unavailability tolerated during the rotation")
+	fs.DurationVar(&opts.ComponentTimeout, "component-timeout", certrotate.DefaultComponentTimeout, "maximum wait for a restarted component to become healthy")
+	cluster, err := cf.parse(ctx, fs, args)
+	if err != nil {
+		return err
+	}
+
+	xc, err := cf.client(cluster, client.WithServer(server))
+	if err != nil {
+		return err
+	}
+
+	return sf.run(ctx, func(ctx context.Context) error {
+		_, err := xc.RotateCertificates(ctx, opts)
+		return err
+	})
+}
+
+func runCertsTrust(ctx context.Context, args []string) error {
+	var cf clusterFlags
+	fs := flag.NewFlagSet("xm certs trust", flag.ContinueOnError)
+	cf.register(fs)
+	cluster, err := cf.parse(ctx, fs, args)
+	if err != nil {
+		return err
+	}
+	xc, err := cf.client(cluster)
+	if err != nil {
+		return err
+	}
+	_, err = xc.TrustCAs(ctx)
+	return err
+}
+
+func runCertsApprove(ctx context.Context, args []string) error {
+	var cf clusterFlags
+	fs := flag.NewFlagSet("xm certs approve", flag.ContinueOnError)
+	cf.register(fs)
+	cluster, err := cf.parse(ctx, fs, args)
+	if err != nil {
+		return err
+	}
+	xc, err := cf.client(cluster)
+	if err != nil {
+		return err
+	}
+	res, err := xc.ApproveServingCSRs(ctx)
+	if err != nil {
+		return err
+	}
+	if len(res.Approved) == 0 {
+		fmt.Println("No pending kubelet serving certificate request to approve")
+		return nil
+	}
+	for _, name := range res.Approved {
+		fmt.Println("approved", name)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mensylisir/xmcores/errs"
+	"github.com/mensylisir/xmcores/modules"
+)
+
+func runChangesList(ctx context.Context, args []string) error {
+	var (
+		rf           runsFlags
+		run, host    string
+		output       string
+		showReverted bool
+	)
+	fs := flag.NewFlagSet("xm changes list", flag.ContinueOnError)
+	rf.register(fs)
+	fs.StringVar(&run, "run", "", "only the changes of this run ID, or of the runs whose ID starts with it")
+	fs.StringVar(&host, "host", "", "only the changes of this host")
+	fs.BoolVar(&showReverted, "all", false, "include the changes already reverted")
+	fs.StringVar(&output, "o", "text", "output format: text or json")
+	if err := fs.Parse(args); err != nil {
+		return errs.Wrap(errs.Config, err)
+	}
+	if output != "text" && output != "json" {
+		return errs.Wrap(errs.Config, fmt.Errorf("unsupported output format %q", output))
+	}
+	c, err := rf.open()
+	if err != nil {
+		return err
+	}
+	all, err := c.Changes()
+	if err != nil {
+		return err
+	}
+	reverted := modules.Reverted(all)
+	var changes []modules.Change
+	for _, ch := range all {
+		if (run == "" || strings.HasPrefix(ch.Run, run)) && (host == "" || ch.Host == host) && (showReverted || reverted[ch.ID] == "") {
+			changes = append(changes, ch)
+		}
+	}
+	if output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(changes)
+	}
+	if len(changes) == 0 {
+		fmt.Fprintf(os.Stderr, "No journaled changes of cluster %s\n", c.Name)
+		return nil
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tTIME\tHOST\tCHANGE\tREVERTED BY")
+	for _, ch := range changes {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", ch.ID, ch.Time.Local().Format(time.DateTime), ch.Host, ch.Describe(), orDash(reverted[ch.ID]))
+	}
+	return tw.Flush()
+}
+
+func runChangesRevert(ctx context.Context, args []string) error {
+	var (
+		cf clusterFlags
+		id string
+	)
+	// The ID comes first, as in "xm changes revert 1a2b3c4d -f cluster.yaml".
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		id, args = args[0], args[1:]
+	}
+	fs := flag.NewFlagSet("xm changes revert <run-or-change-id>", flag.ContinueOnError)
+	cf.register(fs)
+	cluster, err := cf.parse(ctx, fs, args)
+	if err != nil {
+		return err
+	}
+	if id == "" {
+		return errs.Wrap(errs.Config, errors.New("usage: xm changes revert <run-or-change-id> -f <config> [flags]"))
+	}
+	xc, err := cf.client(cluster)
+	if err != nil {
+		return err
+	}
+	res, err := xc.RevertChanges(ctx, id)
+	for _, ch := range res.Reverted {
+		fmt.Printf("reverted %s on %s: %s\n", ch.ID, ch.Host, ch.Describe())
+	}
+	for _, ch := range res.Skipped {
+		fmt.Printf("skipped %s on %s: %s\n", ch.ID, ch.Host, ch.Describe())
+	}
+	return err
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"time"
+
+	"github.com/mensylisir/xmcores/common"
+	"github.com/mensylisir/xmcores/modules"
+	"github.com/mensylisir/xmcores/workspace"
+)
+
+func runClean(ctx context.Context, args []string) error {
+	var (
+		cf        clusterFlags
+		remote    bool
+		remoteAge time.Duration
+	)
+	fs := flag.NewFlagSet("xm clean", flag.ContinueOnError)
+	cf.register(fs)
+	fs.IntVar(&cf.retention.MaxRuns, "keep-runs", workspace.DefaultRetention.MaxRuns, "runs kept in the history, 0 keeps all")
+	fs.DurationVar(&cf.retention.MaxAge, "max-age", workspace.DefaultRetention.MaxAge, "remove cached artifacts and diagnostic bundles not modified for this long, 0 keeps them")
+	fs.BoolVar(&remote, "remote", false, "also remove the temporary files under "+common.GetTmpDir()+" on every host")
+	fs.DurationVar(&remoteAge, "remote-age", 0, "only remove remote temporary files not modified for this long")
+	cluster, err := cf.parse(ctx, fs, args)
+	if err != nil {
+		return err
+	}
+
+	// The work directory is trimmed by the session once the run is recorded.
+	return cf.session(ctx, cluster, "clean", true, func(ctx context.Context, ws *workspace.Cluster) error {
+		if !remote {
+			return nil
+		}
+		nodes, err := modules.ConnectWith(ctx, cluster.Hosts(), cluster.Dialer())
+		if err != nil {
+			return err
+		}
+		defer modules.Close(nodes)
+		return modules.ForEach(ctx, nodes, func(ctx context.Context, node modules.Node) error {
+			return modules.CleanTmpDir(ctx, node, remoteAge)
+		})
+	})
+}
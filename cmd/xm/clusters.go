@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mensylisir/xmcores/errs"
+	"github.com/mensylisir/xmcores/workspace"
+)
+
+func runClustersList(ctx context.Context, args []string) error {
+	var workDir string
+	fs := flag.NewFlagSet("xm clusters list", flag.ContinueOnError)
+	registerWorkDir(fs, &workDir)
+	if err := fs.Parse(args); err != nil {
+		return errs.Wrap(errs.Config, err)
+	}
+	infos, err := workspace.New(workDir).Clusters()
+	if err != nil {
+		return err
+	}
+	if len(infos) == 0 {
+		fmt.Fprintf(os.Stderr, "No clusters in %s\n", workDir)
+		return nil
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tLAST RUN\tRESULT\tRUNS\tKUBECONFIG\tLOCKED BY")
+	for _, info := range infos {
+		last, result := "-", "-"
+		if r := info.LastRun; r != nil {
+			last = r.Command + " " + r.Finished.Local().Format(time.DateTime)
+			result = "ok"
+			if !r.Succeeded() {
+				result = "failed"
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%s\n", info.Name, last, result, info.Runs, orDash(info.Kubeconfig), orDash(info.LockedBy))
+	}
+	return tw.Flush()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/mensylisir/xmcores/common"
+	"github.com/mensylisir/xmcores/config"
+	"github.com/mensylisir/xmcores/errs"
+)
+
+func runConfigMigrate(ctx context.Context, args []string) error {
+	var path, output string
+	fs := flag.NewFlagSet("xm config migrate", flag.ContinueOnError)
+	fs.StringVar(&path, "f", "", "cluster configuration file")
+	fs.StringVar(&output, "o", "", "file to write, - for stdout (default: rewrite -f, keeping the original as .bak)")
+	if err := fs.Parse(args); err != nil {
+		return errs.Wrap(errs.Config, err)
+	}
+	if path == "" {
+		return errs.Wrap(errs.Config, fmt.Errorf("a cluster configuration is required (-f)"))
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return errs.Wrap(errs.Config, err)
+	}
+	if enc := config.DetectEncryption(data); enc != config.EncryptionNone {
+		return errs.Wrap(errs.Config, fmt.Errorf("%s is encrypted with %s: decrypt it, migrate it and encrypt it again", path, enc))
+	}
+	migrated, from, err := config.Migrate(data)
+	if err != nil {
+		return errs.Wrap(errs.Config, fmt.Errorf("%s: %w", path, err))
+	}
+	if _, err := config.Parse(migrated); err != nil {
+		return fmt.Errorf("%s: the migrated configuration is invalid: %w", path, err)
+	}
+	if output == "-" {
+		_, err := os.Stdout.Write(migrated)
+		return err
+	}
+	if from == config.APIVersion && output == "" {
+		fmt.Fprintf(os.Stderr, "%s already has apiVersion %s\n", path, config.APIVersion)
+		return nil
+	}
+	if output == "" {
+		if err := os.WriteFile(path+".bak", data, common.FileMode0600); err != nil {
+			return err
+		}
+		output = path
+	}
+	if err := os.WriteFile(output, migrated, common.FileMode0600); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Cluster configuration migrated from %s to %s and written to %s\n", from, config.APIVersion, output)
+	return nil
+}
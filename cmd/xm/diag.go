@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"github.com/mensylisir/xmcores/modules"
+	"github.com/mensylisir/xmcores/modules/diag"
+	"github.com/mensylisir/xmcores/workspace"
+)
+
+func runDiagCollect(ctx context.Context, args []string) error {
+	var (
+		cf  clusterFlags
+		cfg diag.Config
+	)
+	fs := flag.NewFlagSet("xm diag collect", flag.ContinueOnError)
+	cf.register(fs)
+	fs.DurationVar(&cfg.Since, "since", diag.DefaultSince, "collect journal entries and pod logs of this window")
+	fs.IntVar(&cfg.MaxLines, "max-lines", diag.DefaultMaxLines, "maximum lines per journal and log file")
+	cluster, err := cf.parse(ctx, fs, args)
+	if err != nil {
+		return err
+	}
+
+	return cf.session(ctx, cluster, "diag collect", false, func(ctx context.Context, ws *workspace.Cluster) error {
+		nodes, err := modules.ConnectWith(ctx, cluster.Hosts(), cluster.Dialer())
+		if err != nil {
+			return err
+		}
+		defer modules.Close(nodes)
+		bundle, err := diag.Collect(ctx, nodes, cfg, ws.DiagDir())
+		if err != nil {
+			return err
+		}
+		fmt.Println(bundle)
+		return nil
+	})
+}
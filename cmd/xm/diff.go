@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/mensylisir/xmcores/client"
+	"github.com/mensylisir/xmcores/drift"
+	"github.com/mensylisir/xmcores/errs"
+)
+
+func runDiff(ctx context.Context, args []string) error {
+	var (
+		cf     clusterFlags
+		output string
+		server string
+	)
+	fs := flag.NewFlagSet("xm diff", flag.ContinueOnError)
+	cf.register(fs)
+	fs.StringVar(&output, "o", "text", "output format: text or json")
+	fs.StringVar(&server, "server", "", "apiserver address overriding the one in the admin kubeconfig")
+	cluster, err := cf.parse(ctx, fs, args)
+	if err != nil {
+		return err
+	}
+	if output != "text" && output != "json" {
+		return errs.Wrap(errs.Config, fmt.Errorf("unsupported output format %q", output))
+	}
+	xc, err := cf.client(cluster, client.WithServer(server))
+	if err != nil {
+		return err
+	}
+
+	res, err := xc.Diff(ctx)
+	if err != nil {
+		return err
+	}
+	changes := res.Changes
+	if output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if changes == nil {
+			changes = []drift.Change{}
+		}
+		return enc.Encode(changes)
+	}
+	fmt.Print(drift.Format(changes))
+	return nil
+}
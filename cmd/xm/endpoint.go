@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"flag"
+
+	"github.com/mensylisir/xmcores/client"
+	"github.com/mensylisir/xmcores/modules/certrotate"
+	"github.com/mensylisir/xmcores/modules/endpointmigrate"
+)
+
+func runEndpointMigrate(ctx context.Context, args []string) error {
+	var (
+		cf     clusterFlags
+		sf     stepFlags
+		opts   endpointmigrate.Options
+		server string
+	)
+	fs := flag.NewFlagSet("xm endpoint migrate", flag.ContinueOnError)
+	cf.register(fs)
+	sf.register(fs)
+	fs.StringVar(&server, "server", "", "apiserver address overriding the one in the admin kubeconfig, which must keep working during the migration")
+	fs.DurationVar(&opts.ComponentTimeout, "component-timeout", certrotate.DefaultComponentTimeout, "maximum wait for a restarted component to become healthy")
+	fs.DurationVar(&opts.RolloutTimeout, "rollout-timeout", endpointmigrate.DefaultRolloutTimeout, "maximum wait for the restart of kube-proxy")
+	cluster, err := cf.parse(ctx, fs, args)
+	if err != nil {
+		return err
+	}
+	xc, err := cf.client(cluster, client.WithServer(server))
+	if err != nil {
+		return err
+	}
+
+	return sf.run(ctx, func(ctx context.Context) error {
+		_, err := xc.MigrateEndpoint(ctx, opts)
+		return err
+	})
+}
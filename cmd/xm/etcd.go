@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/mensylisir/xmcores/errs"
+	"github.com/mensylisir/xmcores/modules"
+	"github.com/mensylisir/xmcores/modules/etcdops"
+	"github.com/mensylisir/xmcores/workspace"
+)
+
+func runEtcdStatus(ctx context.Context, args []string) error {
+	var (
+		cf     clusterFlags
+		output string
+	)
+	fs := flag.NewFlagSet("xm etcd status", flag.ContinueOnError)
+	cf.register(fs)
+	fs.StringVar(&output, "o", "text", "output format: text or json")
+	cluster, err := cf.parse(ctx, fs, args)
+	if err != nil {
+		return err
+	}
+	if output != "text" && output != "json" {
+		return errs.Wrap(errs.Config, fmt.Errorf("unsupported output format %q", output))
+	}
+
+	xc, err := cf.client(cluster)
+	if err != nil {
+		return err
+	}
+
+	res, err := xc.EtcdStatus(ctx)
+	if res.Members == nil {
+		return err
+	}
+	if output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if perr := enc.Encode(res.Members); perr != nil {
+			return perr
+		}
+	} else if perr := printEtcdStatus(res.Members); perr != nil {
+		return perr
+	}
+	return err
+}
+
+func printEtcdStatus(statuses []etcdops.Status) error {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NODE\tMEMBER ID\tVERSION\tDB SIZE\tIN USE\tLEADER\tRAFT TERM\tRAFT INDEX\tALARMS\tERRORS")
+	for _, s := range statuses {
+		if s.Err != nil {
+			fmt.Fprintf(tw, "%s\t-\t-\t-\t-\t-\t-\t-\t-\t%v\n", s.Node, s.Err)
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%x\t%s\t%s\t%s\t%t\t%d\t%d\t%s\t%s\n", s.Node, s.MemberID, s.Version,
+			modules.FormatSize(s.DBSize), modules.FormatSize(s.DBSizeInUse), s.IsLeader(), s.RaftTerm, s.RaftIndex,
+			orDash(strings.Join(s.Alarms, ",")), orDash(strings.Join(s.Errors, "; ")))
+	}
+	return tw.Flush()
+}
+
+func runEtcdDefrag(ctx context.Context, args []string) error {
+	var (
+		cf   clusterFlags
+		opts etcdops.DefragOptions
+	)
+	fs := flag.NewFlagSet("xm etcd defrag", flag.ContinueOnError)
+	cf.register(fs)
+	fs.Float64Var(&opts.MinFragmentation, "min-fragmentation", 0, "skip members with a smaller share of unused database space, from 0 to 1")
+	fs.DurationVar(&opts.Timeout, "timeout", etcdops.DefaultDefragTimeout, "maximum duration of the defragmentation of one member")
+	cluster, err := cf.parse(ctx, fs, args)
+	if err != nil {
+		return err
+	}
+	if opts.MinFragmentation < 0 || opts.MinFragmentation > 1 {
+		return errs.Wrap(errs.Config, fmt.Errorf("-min-fragmentation must be between 0 and 1, not %g", opts.MinFragmentation))
+	}
+
+	xc, err := cf.client(cluster)
+	if err != nil {
+		return err
+	}
+
+	_, err = xc.Session(ctx, "etcd defrag", true, func(ctx context.Context, ws *workspace.Cluster) error {
+		nodes, err := xc.ConnectEtcd(ctx)
+		if err != nil {
+			return err
+		}
+		defer modules.Close(nodes)
+		done, err := etcdops.Defrag(ctx, nodes, opts)
+		if len(done) > 0 {
+			if perr := printEtcdStatus(done); perr != nil {
+				return perr
+			}
+		} else if err == nil {
+			fmt.Fprintln(os.Stderr, "No member needed defragmentation")
+		}
+		if err != nil {
+			return errs.Wrap(errs.Execution, err)
+		}
+		return nil
+	})
+	return err
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/mensylisir/xmcores/errs"
+	"github.com/mensylisir/xmcores/modules"
+	"github.com/mensylisir/xmcores/modules/imagepush"
+)
+
+func runImagesPush(ctx context.Context, args []string) error {
+	var (
+		cf     clusterFlags
+		layout string
+		output string
+		opts   imagepush.Options
+	)
+	fs := flag.NewFlagSet("xm images push", flag.ContinueOnError)
+	cf.register(fs)
+	fs.StringVar(&layout, "layout", "", "OCI image layout to push, a directory or a .tar.gz archive (default spec.imagePreload.path)")
+	fs.IntVar(&opts.Concurrency, "concurrency", imagepush.DefaultConcurrency, "number of images pushed at once")
+	fs.StringVar(&output, "o", "text", "output format: text or json")
+	cluster, err := cf.parse(ctx, fs, args)
+	if err != nil {
+		return err
+	}
+	if output != "text" && output != "json" {
+		return errs.Wrap(errs.Config, fmt.Errorf("unsupported output format %q", output))
+	}
+	if opts.Concurrency < 1 {
+		return errs.Wrap(errs.Config, fmt.Errorf("-concurrency must be at least 1, got %d", opts.Concurrency))
+	}
+
+	xc, err := cf.client(cluster)
+	if err != nil {
+		return err
+	}
+
+	res, err := xc.PushImages(ctx, layout, opts)
+	if res.Report.Images == nil {
+		return err
+	}
+	if output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if perr := enc.Encode(res.Report); perr != nil {
+			return perr
+		}
+	} else if perr := printImagesPush(res.Report); perr != nil {
+		return perr
+	}
+	return err
+}
+
+func printImagesPush(r imagepush.Report) error {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "IMAGE\tTARGET\tRESULT\tBLOBS PUSHED\tBYTES PUSHED\tBLOBS SKIPPED\tBYTES SKIPPED")
+	for _, img := range r.Images {
+		result := "pushed"
+		switch {
+		case img.Error != "":
+			result = "failed: " + img.Error
+		case img.Skipped:
+			result = "up to date"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%d\t%s\n", img.Name, img.Target, result,
+			img.BlobsPushed, modules.FormatSize(img.BytesPushed), img.BlobsSkipped, modules.FormatSize(img.BytesSkipped))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Printf("\n%d images pushed (%d blobs, %s), %d up to date; %d blobs (%s) skipped\n",
+		r.ImagesPushed, r.BlobsPushed, modules.FormatSize(r.BytesPushed), r.ImagesSkipped, r.BlobsSkipped, modules.FormatSize(r.BytesSkipped))
+	return err
+}
+
+func runImagesCheck(ctx context.Context, args []string) error {
+	var cf clusterFlags
+	fs := flag.NewFlagSet("xm images check", flag.ContinueOnError)
+	cf.register(fs)
+	cluster, err := cf.parse(ctx, fs, args)
+	if err != nil {
+		return err
+	}
+	xc, err := cf.client(cluster)
+	if err != nil {
+		return err
+	}
+	if _, err := xc.CheckRegistry(ctx); err != nil {
+		return err
+	}
+	fmt.Printf("registry %s is reachable, trusted and accepts the credentials\n", cluster.Spec.Registry.Address)
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/mensylisir/xmcores/common"
+	"github.com/mensylisir/xmcores/config"
+	"github.com/mensylisir/xmcores/errs"
+)
+
+func runInitConfig(ctx context.Context, args []string) error {
+	var (
+		opts           config.GenerateOptions
+		output         string
+		controlPlanes  string
+		workers        string
+		nonInteractive bool
+		force          bool
+	)
+	fs := flag.NewFlagSet("xm init config", flag.ContinueOnError)
+	fs.StringVar(&output, "o", "cluster.yaml", "file to write, - for stdout")
+	fs.StringVar(&opts.Name, "name", "cluster", "cluster name")
+	fs.StringVar(&controlPlanes, "control-plane", "", "comma-separated control-plane node addresses")
+	fs.StringVar(&workers, "worker", "", "comma-separated worker node addresses")
+	fs.StringVar(&opts.User, "user", "root", "SSH user")
+	fs.IntVar(&opts.Port, "port", common.DefaultSSHPort, "SSH port")
+	fs.StringVar(&opts.Password, "password", "", "SSH password")
+	fs.StringVar(&opts.PrivateKeyPath, "key-file", "", "SSH private key file")
+	fs.StringVar(&opts.KubernetesVersion, "kubernetes-version", config.DefaultKubernetesVersion, "Kubernetes version")
+	fs.StringVar(&opts.NetworkPlugin, "network", config.NetworkCalico, "CNI plugin: "+strings.Join(config.NetworkPlugins, ", "))
+	fs.BoolVar(&nonInteractive, "non-interactive", false, "fail instead of asking for missing values")
+	fs.BoolVar(&force, "force", false, "overwrite an existing file")
+	if err := fs.Parse(args); err != nil {
+		return errs.Wrap(errs.Config, err)
+	}
+
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	if !nonInteractive {
+		p := &prompter{in: bufio.NewReader(os.Stdin), out: os.Stderr}
+		ask := func(name string, value *string, question string) {
+			if !set[name] && p.err == nil {
+				*value = p.ask(question, *value)
+			}
+		}
+		ask("name", &opts.Name, "Cluster name")
+		ask("control-plane", &controlPlanes, "Control-plane node addresses (comma-separated)")
+		ask("worker", &workers, "Worker node addresses (comma-separated, empty for none)")
+		ask("user", &opts.User, "SSH user")
+		if !set["port"] && p.err == nil {
+			port := p.ask("SSH port", strconv.Itoa(opts.Port))
+			if opts.Port, p.err = strconv.Atoi(port); p.err != nil {
+				p.err = fmt.Errorf("invalid SSH port %q", port)
+			}
+		}
+		if !set["password"] {
+			ask("key-file", &opts.PrivateKeyPath, "SSH private key file (empty to use a password)")
+		}
+		if opts.PrivateKeyPath == "" {
+			ask("password", &opts.Password, "SSH password (input is echoed)")
+		}
+		ask("kubernetes-version", &opts.KubernetesVersion, "Kubernetes version")
+		ask("network", &opts.NetworkPlugin, "CNI plugin ("+strings.Join(config.NetworkPlugins, ", ")+")")
+		if p.err != nil {
+			return errs.Wrap(errs.Config, p.err)
+		}
+	}
+	opts.ControlPlanes = splitList(controlPlanes)
+	opts.Workers = splitList(workers)
+
+	data, err := config.Generate(opts)
+	if err != nil {
+		return errs.Wrap(errs.Config, err)
+	}
+	if output == "-" {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+	if _, err := os.Stat(output); err == nil && !force {
+		return errs.Wrap(errs.Config, fmt.Errorf("%s already exists, use -force to overwrite it", output))
+	}
+	if err := os.WriteFile(output, data, common.FileMode0600); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Cluster configuration written to %s\n", output)
+	return nil
+}
+
+// prompter asks questions on a terminal. The first read error is kept and
+// stops further questions.
+type prompter struct {
+	in  *bufio.Reader
+	out io.Writer
+	err error
+}
+
+// ask prints question with its default and returns the answer, or def for an
+// empty answer.
+func (p *prompter) ask(question, def string) string {
+	if def != "" {
+		fmt.Fprintf(p.out, "%s [%s]: ", question, def)
+	} else {
+		fmt.Fprintf(p.out, "%s: ", question)
+	}
+	line, err := p.in.ReadString('\n')
+	if err != nil && !(errors.Is(err, io.EOF) && line != "") {
+		p.err = fmt.Errorf("failed to read answer: %w", err)
+		return def
+	}
+	if answer := strings.TrimSpace(line); answer != "" {
+		return answer
+	}
+	return def
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"flag"
+
+	"github.com/mensylisir/xmcores/modules/k3s"
+)
+
+func runK3sInstall(ctx context.Context, args []string) error {
+	var (
+		cf clusterFlags
+		sf stepFlags
+		p  k3s.Params
+	)
+	fs := flag.NewFlagSet("xm k3s install", flag.ContinueOnError)
+	cf.register(fs)
+	sf.register(fs)
+	fs.DurationVar(&p.ReadyTimeout, "ready-timeout", k3s.DefaultReadyTimeout, "maximum wait for a node to be ready")
+	cluster, err := cf.parse(ctx, fs, args)
+	if err != nil {
+		return err
+	}
+	xc, err := cf.client(cluster)
+	if err != nil {
+		return err
+	}
+
+	return sf.run(ctx, func(ctx context.Context) error {
+		_, err := xc.InstallK3s(ctx, p)
+		return err
+	})
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/mensylisir/xmcores/config"
+	"github.com/mensylisir/xmcores/errs"
+	"github.com/mensylisir/xmcores/modules/localdocker"
+	"github.com/mensylisir/xmcores/workspace"
+)
+
+// parseLocal parses the flags of the local commands and checks the
+// configuration uses the local-docker runtime.
+func parseLocal(ctx context.Context, name string, args []string) (*clusterFlags, *config.Cluster, error) {
+	cf := &clusterFlags{}
+	fs := flag.NewFlagSet("xm local "+name, flag.ContinueOnError)
+	cf.register(fs)
+	cluster, err := cf.parse(ctx, fs, args)
+	if err != nil {
+		return nil, nil, err
+	}
+	if cluster.Spec.Runtime.Backend != config.RuntimeLocalDocker {
+		return nil, nil, errs.Wrap(errs.Config, errors.New("spec.runtime.backend must be "+config.RuntimeLocalDocker))
+	}
+	return cf, cluster, nil
+}
+
+func runLocalUp(ctx context.Context, args []string) error {
+	cf, cluster, err := parseLocal(ctx, "up", args)
+	if err != nil {
+		return err
+	}
+	return cf.session(ctx, cluster, "local up", true, func(ctx context.Context, ws *workspace.Cluster) error {
+		err := localdocker.Provision(ctx, cluster.Metadata.Name, cluster.Hosts(), cluster.Spec.Runtime.LocalDocker, cluster.Spec.Kubernetes.Version)
+		if err != nil {
+			return errs.Wrap(errs.Preflight, err)
+		}
+		fmt.Fprintf(os.Stderr, "%d node containers of %s are running\n", len(cluster.Spec.Hosts), cluster.Metadata.Name)
+		return nil
+	})
+}
+
+func runLocalDown(ctx context.Context, args []string) error {
+	cf, cluster, err := parseLocal(ctx, "down", args)
+	if err != nil {
+		return err
+	}
+	return cf.session(ctx, cluster, "local down", true, func(ctx context.Context, ws *workspace.Cluster) error {
+		return localdocker.Delete(ctx, cluster.Metadata.Name, cluster.Spec.Runtime.LocalDocker)
+	})
+}
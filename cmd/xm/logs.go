@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"os"
+	"strings"
+
+	"github.com/mensylisir/xmcores/errs"
+	"github.com/mensylisir/xmcores/modules"
+	"github.com/mensylisir/xmcores/modules/logs"
+	"github.com/mensylisir/xmcores/workspace"
+)
+
+func runLogs(ctx context.Context, args []string) error {
+	var (
+		cf   clusterFlags
+		opts logs.Options
+		pos  []string
+	)
+	// The hosts and the unit or file come first, as in
+	// "xm logs master1,worker1 kubelet -f cluster.yaml -follow".
+	for len(args) > 0 && len(pos) < 2 && !strings.HasPrefix(args[0], "-") {
+		pos, args = append(pos, args[0]), args[1:]
+	}
+	fs := flag.NewFlagSet("xm logs <host>[,<host>...]|all <unit>|<file>", flag.ContinueOnError)
+	cf.register(fs)
+	fs.BoolVar(&opts.Follow, "follow", false, "keep streaming new lines until interrupted")
+	fs.IntVar(&opts.Lines, "n", logs.DefaultLines, "number of past lines to show")
+	fs.DurationVar(&opts.Since, "since", 0, "show the journal entries of this window only, 0 for no limit")
+	cluster, err := cf.parse(ctx, fs, args)
+	if err != nil {
+		return err
+	}
+	if len(pos) != 2 {
+		return errs.Wrap(errs.Config, errors.New("usage: xm logs <host>[,<host>...]|all <unit>|<file> [flags]"))
+	}
+	target, err := logs.ParseTarget(pos[1])
+	if err != nil {
+		return errs.Wrap(errs.Config, err)
+	}
+	hosts := cluster.Hosts()
+	if pos[0] != "all" {
+		hosts = nil
+		for _, name := range strings.Split(pos[0], ",") {
+			host, err := findHost(cluster.Hosts(), name)
+			if err != nil {
+				return err
+			}
+			hosts = append(hosts, host)
+		}
+	}
+
+	return cf.session(ctx, cluster, "logs "+pos[0]+" "+pos[1], false, func(ctx context.Context, ws *workspace.Cluster) error {
+		nodes, err := modules.ConnectWith(ctx, hosts, cluster.Dialer())
+		if err != nil {
+			return err
+		}
+		defer modules.Close(nodes)
+		return logs.Stream(ctx, nodes, target, opts, os.Stdout)
+	})
+}
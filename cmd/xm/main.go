@@ -0,0 +1,416 @@
+// Command xm operates Kubernetes clusters described by an xmcores cluster
+// configuration file.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/mensylisir/xmcores/client"
+	"github.com/mensylisir/xmcores/common"
+	"github.com/mensylisir/xmcores/config"
+	"github.com/mensylisir/xmcores/errs"
+	"github.com/mensylisir/xmcores/logger"
+	"github.com/mensylisir/xmcores/pipeline"
+	"github.com/mensylisir/xmcores/runtime"
+	"github.com/mensylisir/xmcores/workspace"
+)
+
+// command is a node of the command tree: either run is set or subcommands are.
+type command struct {
+	name    string
+	summary string
+	run     func(ctx context.Context, args []string) error
+	sub     []command
+}
+
+var commands = []command{
+	{name: "init", summary: "Create starting files", sub: []command{
+		{name: "config", summary: "Write a cluster configuration from answers or flags", run: runInitConfig},
+	}},
+	{name: "config", summary: "Manage the cluster configuration file", sub: []command{
+		{name: "migrate", summary: "Rewrite a cluster configuration of an older apiVersion in the current schema", run: runConfigMigrate},
+	}},
+	{name: "apply", summary: "Reconcile the live cluster toward the configuration", run: runApply},
+	{name: "diff", summary: "Show how the live cluster differs from the configuration", run: runDiff},
+	{name: "ping", summary: "Log in to every host and report reachability, authentication, sudo and OS", run: runPing},
+	{name: "clusters", summary: "Clusters known to the work directory", sub: []command{
+		{name: "list", summary: "List the clusters with their last run", run: runClustersList},
+	}},
+	{name: "runs", summary: "Inspect the run history of a cluster", sub: []command{
+		{name: "list", summary: "List the recorded runs, the latest first", run: runRunsList},
+		{name: "stats", summary: "Show the transfer and execution statistics of each host in a run", run: runRunsStats},
+	}},
+	{name: "changes", summary: "Inspect and revert what runs changed on the hosts (spec.journal)", sub: []command{
+		{name: "list", summary: "List the journaled file, package and service changes, the oldest first", run: runChangesList},
+		{name: "revert", summary: "Undo the changes of a run or a single change, newest first, where the hosts still match", run: runChangesRevert},
+	}},
+	{name: "export", summary: "Export managed state for handover to another workstation", sub: []command{
+		{name: "state", summary: "Write the configuration, run history, change journal, cached facts and kubeconfig of a cluster to an encrypted archive", run: runExportState},
+	}},
+	{name: "import", summary: "Import state exported from another workstation", sub: []command{
+		{name: "state", summary: "Restore a cluster from an archive written by xm export state", run: runImportState},
+	}},
+	{name: "local", summary: "Nodes as containers on the local Docker daemon (spec.runtime.backend: local-docker)", sub: []command{
+		{name: "up", summary: "Start the node containers", run: runLocalUp},
+		{name: "down", summary: "Remove the node containers", run: runLocalDown},
+	}},
+	{name: "clean", summary: "Trim the work directory and remove temporary files from the hosts", run: runClean},
+	{name: "certs", summary: "Manage the cluster certificates", sub: []command{
+		{name: "rotate", summary: "Renew the control-plane and kubelet serving certificates host by host", run: runCertsRotate},
+		{name: "approve", summary: "Approve the pending kubelet serving certificate requests of the configured hosts that match them strictly", run: runCertsApprove},
+		{name: "trust", summary: "Install spec.trustedCAs and the CA of spec.registry in the trust store and containerd of every host", run: runCertsTrust},
+	}},
+	{name: "endpoint", summary: "Manage the control-plane endpoint", sub: []command{
+		{name: "migrate", summary: "Move the cluster to spec.kubernetes.controlPlaneEndpoint, reissuing certificates and kubeconfigs", run: runEndpointMigrate},
+	}},
+	{name: "etcd", summary: "Inspect and maintain the etcd members", sub: []command{
+		{name: "status", summary: "Report database size, leader, raft state and alarms of every member", run: runEtcdStatus},
+		{name: "defrag", summary: "Defragment the members one at a time, the leader last", run: runEtcdDefrag},
+	}},
+	{name: "images", summary: "Manage the container images of the cluster", sub: []command{
+		{name: "check", summary: "Check that spec.registry is reachable, trusted and accepts the credentials from the controller and a node", run: runImagesCheck},
+		{name: "push", summary: "Push the images of the OCI layout to spec.registry, skipping what the registry has", run: runImagesPush},
+	}},
+	{name: "k3s", summary: "Install K3s instead of kubeadm (spec.k3s)", sub: []command{
+		{name: "install", summary: "Install the K3s servers on the control-plane hosts and the agents on the others", run: runK3sInstall},
+	}},
+	{name: "pipelines", summary: "Discover the pipelines xm runs", sub: []command{
+		{name: "list", summary: "List the pipelines with the configuration kinds they work on", run: runPipelinesList},
+		{name: "describe", summary: "Show the capabilities, parameters and steps of a pipeline", run: runPipelinesDescribe},
+	}},
+	{name: "steps", summary: "Discover the step types of YAML-defined pipelines", sub: []command{
+		{name: "list", summary: "List the step types with their parameters", run: runStepsList},
+	}},
+	{name: "sudoers", summary: "Manage the sudoers file granting spec.sudoers.user the commands of the pipelines", sub: []command{
+		{name: "install", summary: "Install the sudoers file on every host, checked with visudo", run: runSudoersInstall},
+		{name: "remove", summary: "Remove the sudoers file from every host", run: runSudoersRemove},
+	}},
+	{name: "reset", summary: "Clean hosts of what Kubernetes left on them", sub: []command{
+		{name: "node", summary: "Reset a host: kubeadm reset, CNI interfaces, iptables and IPVS rules, state directories and optionally the binaries", run: runResetNode},
+	}},
+	{name: "shell", summary: "Open an interactive shell on a host of the configuration", run: runShell},
+	{name: "logs", summary: "Stream the journal of a unit or a file from hosts, merged with host prefixes", run: runLogs},
+	{name: "tunnel", summary: "Forward ports to or from a host over its SSH connection", run: runTunnel},
+	{name: "diag", summary: "Troubleshooting helpers", sub: []command{
+		{name: "collect", summary: "Collect logs and system state from all nodes into a tarball", run: runDiagCollect},
+	}},
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	err := run(ctx, os.Args[1:])
+	stop()
+	if err != nil && !errors.Is(err, flag.ErrHelp) {
+		if kind := errs.KindOf(err); kind != errs.Unknown {
+			fmt.Fprintf(os.Stderr, "Error (%s): %v\n", kind, err)
+		} else {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		}
+		reportContext(os.Stderr, err)
+		os.Exit(errs.ExitCode(err))
+	}
+}
+
+// run parses the global flags, which precede the command, and dispatches.
+func run(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("xm", flag.ContinueOnError)
+	fs.Usage = func() {
+		usage(fs.Output(), "xm", commands)
+		fmt.Fprintln(fs.Output(), "\nGlobal flags:")
+		fs.PrintDefaults()
+	}
+	level := fs.String("log-level", logger.Log.GetLevel().String(), "default log level")
+	overrides := fs.String("log-level-override", "", "per-component log levels, e.g. connector=debug,pipeline=trace")
+	bufferSize := fs.Int("debug-buffer", logger.DefaultRingSize, "debug entries kept in memory and reported on failure, 0 disables")
+	var sinks sinkFlags
+	fs.Var(&sinks, "log-sink", "additional log destination, repeatable, e.g. syslog:address=udp://logs:514,level=debug or file:path=/var/log/xm.log,format=json,maxSize=100")
+	fs.DurationVar(&logRotation.Every, "log-rotate-every", 0, "time between rotations of the XM_LOG_OUTPUT_PATH log file (default 24h)")
+	fs.IntVar(&logRotation.MaxSize, "log-max-size", 0, "rotate the log file when it exceeds this many megabytes, 0 rotates by time only")
+	fs.DurationVar(&logRotation.MaxAge, "log-max-age", 0, "remove rotated log files older than this (default 168h unless -log-max-backups is set)")
+	fs.IntVar(&logRotation.MaxBackups, "log-max-backups", 0, "number of rotated log files to keep, 0 keeps them by age only")
+	fs.BoolVar(&logRotation.Compress, "log-compress", false, "gzip rotated log files")
+	if err := fs.Parse(args); err != nil {
+		return errs.Wrap(errs.Config, err)
+	}
+	def, err := logrus.ParseLevel(*level)
+	if err != nil {
+		return errs.Wrap(errs.Config, fmt.Errorf("invalid -log-level: %w", err))
+	}
+	levels, err := logger.ParseLevelOverrides(*overrides)
+	if err != nil {
+		return errs.Wrap(errs.Config, err)
+	}
+	opts, err := runtime.NewOptions(
+		runtime.WithLogLevel(def),
+		runtime.WithComponentLevels(levels),
+		runtime.WithDebugBuffer(*bufferSize),
+		runtime.WithSinks(sinks...),
+		runtime.WithRotation(logRotation),
+	)
+	if err != nil {
+		return err
+	}
+	// Cluster configurations add their sinks when loaded (see clusterFlags.parse).
+	defer func() {
+		if err := logger.Log.CloseSinks(); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+		}
+	}()
+	if err := opts.Apply(logger.Log); err != nil {
+		return err
+	}
+	return dispatch(ctx, os.Stderr, "xm", commands, fs.Args())
+}
+
+// sinkFlags collects the -log-sink flags.
+type sinkFlags []logger.Sink
+
+func (f *sinkFlags) String() string {
+	if f == nil {
+		return ""
+	}
+	types := make([]string, len(*f))
+	for i, s := range *f {
+		types[i] = s.Type
+	}
+	return strings.Join(types, ",")
+}
+
+func (f *sinkFlags) Set(spec string) error {
+	s, err := logger.ParseSink(spec)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, s)
+	return nil
+}
+
+// logRotation holds the -log-rotate-* and -log-max-* flags.
+var logRotation logger.Rotation
+
+// setRotation applies the rotation of a cluster configuration, if any,
+// overridden by the flags, to the log file.
+func setRotation(cluster *logger.Rotation) error {
+	r := logRotation
+	if cluster != nil {
+		r = cluster.Merge(logRotation)
+	}
+	if err := logger.Log.SetRotation(r); err != nil {
+		return errs.Wrap(errs.Config, fmt.Errorf("log rotation: %w", err))
+	}
+	return nil
+}
+
+// addSinks sends the log to sinks in addition to the console.
+func addSinks(sinks []logger.Sink) error {
+	for _, s := range sinks {
+		if err := logger.Log.AddSink(s); err != nil {
+			return errs.Wrap(errs.Config, err)
+		}
+	}
+	return nil
+}
+
+// maxContextRecords bounds the debug context printed after a failure.
+const maxContextRecords = 100
+
+// reportContext prints the buffered debug and trace entries of the failing
+// host and step, which the console level hid while running.
+func reportContext(w io.Writer, err error) {
+	ring := logger.Log.RingBuffer()
+	if ring == nil {
+		return
+	}
+	var records []logger.Record
+	for _, rec := range ring.Context(errs.HostOf(err), errs.StepOf(err)) {
+		if rec.Level >= logrus.DebugLevel {
+			records = append(records, rec)
+		}
+	}
+	if len(records) == 0 {
+		return
+	}
+	if len(records) > maxContextRecords {
+		records = records[len(records)-maxContextRecords:]
+	}
+	fmt.Fprintf(w, "\nDebug context before the failure (last %d entries):\n", len(records))
+	for _, rec := range records {
+		fmt.Fprintln(w, "  "+rec.String())
+	}
+}
+
+// dispatch runs the command named by the first argument.
+func dispatch(ctx context.Context, w io.Writer, path string, cmds []command, args []string) error {
+	if len(args) == 0 || args[0] == "-h" || args[0] == "--help" || args[0] == "help" {
+		usage(w, path, cmds)
+		if len(args) == 0 {
+			return errs.Wrap(errs.Config, fmt.Errorf("%s: missing command", path))
+		}
+		return flag.ErrHelp
+	}
+	for _, c := range cmds {
+		if c.name != args[0] {
+			continue
+		}
+		if c.run != nil {
+			return c.run(ctx, args[1:])
+		}
+		return dispatch(ctx, w, path+" "+c.name, c.sub, args[1:])
+	}
+	usage(w, path, cmds)
+	return errs.Wrap(errs.Config, fmt.Errorf("%s: unknown command %q", path, args[0]))
+}
+
+func usage(w io.Writer, path string, cmds []command) {
+	fmt.Fprintf(w, "Usage: %s <command> [flags]\n\nCommands:\n", path)
+	for _, c := range cmds {
+		fmt.Fprintf(w, "  %-12s %s\n", c.name, c.summary)
+	}
+}
+
+// clusterFlags are the flags shared by commands working on a cluster.
+type clusterFlags struct {
+	config  string
+	workDir string
+	// retention is applied to the cluster directory after every run.
+	retention workspace.Retention
+}
+
+func (f *clusterFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.config, "f", "", "cluster configuration file")
+	registerWorkDir(fs, &f.workDir)
+	f.retention = workspace.DefaultRetention
+}
+
+func registerWorkDir(fs *flag.FlagSet, dir *string) {
+	fs.StringVar(dir, "work-dir", common.DefaultWorkDir, "directory holding the state of every managed cluster")
+}
+
+// stepFlags selects the pipeline steps a command runs, to resume a failed run
+// or to run one step again. Steps are designated as logged, e.g. "2.3",
+// "control-plane/2.3" or "renew-certs" (see pipeline.StepID.Matches). It
+// also exports when the steps ran, to find those that serialize a run, and
+// sets the quarantine policy for hosts that keep failing.
+type stepFlags struct {
+	sel             pipeline.Selection
+	timeline        string
+	quarantineAfter int
+}
+
+func (f *stepFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.sel.StartAt, "start-at-step", "", "skip the steps before this one")
+	fs.StringVar(&f.sel.Only, "limit-to-step", "", "run only this step")
+	fs.StringVar(&f.timeline, "timeline", "", "write when each step ran on each host to this file, as an HTML chart if it ends in .html, as Chrome trace-event JSON otherwise")
+	fs.IntVar(&f.quarantineAfter, "quarantine-after", 0, "set a host aside after this many failed step attempts and go on without it while etcd and the control plane keep quorum; 0 fails the run instead")
+}
+
+// run runs fn with the selection and fails if a step flag matched no step or
+// a host was quarantined. The timeline is written even when fn fails, to
+// show where the run stopped.
+func (f *stepFlags) run(ctx context.Context, fn func(ctx context.Context) error) (err error) {
+	if f.timeline != "" {
+		tl := &pipeline.Timeline{}
+		ctx = pipeline.WithTimeline(ctx, tl)
+		defer func() {
+			if werr := tl.WriteFile(f.timeline); werr != nil {
+				err = errors.Join(err, fmt.Errorf("failed to write the timeline: %w", werr))
+			}
+		}()
+	}
+	var q *pipeline.Quarantine
+	if f.quarantineAfter != 0 {
+		q = &pipeline.Quarantine{After: f.quarantineAfter}
+		if err := q.Validate(); err != nil {
+			return err
+		}
+		ctx = pipeline.WithQuarantine(ctx, q)
+	}
+	selected := f.sel.StartAt != "" || f.sel.Only != ""
+	if selected {
+		ctx = pipeline.WithSelection(ctx, &f.sel)
+	}
+	if err := fn(ctx); err != nil {
+		if q != nil {
+			// The failure decides the exit code; the quarantined hosts need
+			// repair all the same.
+			return errors.Join(err, q.Err())
+		}
+		return err
+	}
+	if selected {
+		if err := f.sel.Err(); err != nil {
+			return err
+		}
+	}
+	if q != nil {
+		return q.Err()
+	}
+	return nil
+}
+
+// parse parses args, loads the cluster configuration and resolves the host
+// addresses left to the inventory provider.
+func (f *clusterFlags) parse(ctx context.Context, fs *flag.FlagSet, args []string) (*config.Cluster, error) {
+	if err := fs.Parse(args); err != nil {
+		return nil, errs.Wrap(errs.Config, err)
+	}
+	if fs.NArg() > 0 {
+		return nil, errs.Wrap(errs.Config, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " ")))
+	}
+	if f.config == "" {
+		return nil, errs.Wrap(errs.Config, errors.New("a cluster configuration is required (-f)"))
+	}
+	cluster, err := config.Load(f.config)
+	if err != nil {
+		return nil, err
+	}
+	if cluster.Spec.Logging != nil {
+		if err := addSinks(cluster.Spec.Logging.Sinks); err != nil {
+			return nil, err
+		}
+		if cluster.Spec.Logging.Rotation != nil {
+			if err := setRotation(cluster.Spec.Logging.Rotation); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := cluster.ResolveAddresses(ctx); err != nil {
+		return nil, err
+	}
+	return cluster, nil
+}
+
+// client returns the client of cluster, which saves the configuration file
+// as given, so an encrypted config stays encrypted in the work dir.
+func (f *clusterFlags) client(cluster *config.Cluster, opts ...client.Option) (*client.Client, error) {
+	data, err := os.ReadFile(f.config)
+	if err != nil {
+		return nil, errs.Wrap(errs.Config, err)
+	}
+	return client.New(cluster, append([]client.Option{
+		client.WithWorkDir(f.workDir),
+		client.WithConfigData(data),
+		client.WithRetention(f.retention),
+	}, opts...)...)
+}
+
+// session runs fn in a session of the client of cluster (see
+// client.Client.Session).
+func (f *clusterFlags) session(ctx context.Context, cluster *config.Cluster, command string, lock bool, fn func(ctx context.Context, ws *workspace.Cluster) error) error {
+	c, err := f.client(cluster)
+	if err != nil {
+		return err
+	}
+	_, err = c.Session(ctx, command, lock, fn)
+	return err
+}
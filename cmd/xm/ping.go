@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/mensylisir/xmcores/errs"
+	"github.com/mensylisir/xmcores/modules/ping"
+)
+
+func runPing(ctx context.Context, args []string) error {
+	var (
+		cf     clusterFlags
+		output string
+	)
+	fs := flag.NewFlagSet("xm ping", flag.ContinueOnError)
+	cf.register(fs)
+	fs.StringVar(&output, "o", "text", "output format: text or json")
+	cluster, err := cf.parse(ctx, fs, args)
+	if err != nil {
+		return err
+	}
+	if output != "text" && output != "json" {
+		return errs.Wrap(errs.Config, fmt.Errorf("unsupported output format %q", output))
+	}
+
+	xc, err := cf.client(cluster)
+	if err != nil {
+		return err
+	}
+
+	res, err := xc.Ping(ctx)
+	if res.Hosts == nil {
+		return err
+	}
+	if output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if perr := enc.Encode(res.Hosts); perr != nil {
+			return perr
+		}
+	} else if perr := printPing(res.Hosts); perr != nil {
+		return perr
+	}
+	return err
+}
+
+func printPing(statuses []ping.Status) error {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "HOST\tADDRESS\tREACHABLE\tLATENCY\tAUTH\tSUDO\tOS\tERRORS")
+	for _, s := range statuses {
+		fmt.Fprintf(tw, "%s\t%s\t%t\t%s\t%s\t%s\t%s\t%s\n", s.Node, s.Address, s.Reachable, s.Latency,
+			orDash(s.Auth), orDash(s.Sudo), orDash(s.OS), orDash(strings.Join(s.Errors, "; ")))
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/mensylisir/xmcores/errs"
+	"github.com/mensylisir/xmcores/pipeline"
+)
+
+// pipelineInfo is a pipeline definition as output by the pipelines commands.
+type pipelineInfo struct {
+	pipeline.Definition
+	// Steps are the steps run, as designated to -start-at and -step.
+	Steps []string `json:"steps,omitempty"`
+}
+
+func newPipelineInfo(d pipeline.Definition) pipelineInfo {
+	info := pipelineInfo{Definition: d}
+	if d.Pipelines != nil {
+		for _, p := range d.Pipelines() {
+			for _, id := range p.StepIDs() {
+				info.Steps = append(info.Steps, id.String())
+			}
+		}
+	}
+	return info
+}
+
+func parseOutput(fs *flag.FlagSet, args []string) (string, error) {
+	output := fs.String("o", "text", "output format: text or json")
+	if err := fs.Parse(args); err != nil {
+		return "", errs.Wrap(errs.Config, err)
+	}
+	if *output != "text" && *output != "json" {
+		return "", errs.Wrap(errs.Config, fmt.Errorf("unsupported output format %q", *output))
+	}
+	return *output, nil
+}
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func runPipelinesList(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("xm pipelines list", flag.ContinueOnError)
+	output, err := parseOutput(fs, args)
+	if err != nil {
+		return err
+	}
+	defs := pipeline.Definitions()
+	if output == "json" {
+		infos := make([]pipelineInfo, 0, len(defs))
+		for _, d := range defs {
+			infos = append(infos, newPipelineInfo(d))
+		}
+		return printJSON(infos)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tKINDS\tCOMMAND\tDESCRIPTION")
+	for _, d := range defs {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", d.Name, strings.Join(d.Kinds, ","), orDash(d.Command), d.Description)
+	}
+	return tw.Flush()
+}
+
+func runPipelinesDescribe(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("xm pipelines describe", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: xm pipelines describe [flags] <name>")
+		fs.PrintDefaults()
+	}
+	output, err := parseOutput(fs, args)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errs.Wrap(errs.Config, errors.New("expected the name of one pipeline; see xm pipelines list"))
+	}
+	d, ok := pipeline.Lookup(fs.Arg(0))
+	if !ok {
+		return errs.Wrap(errs.Config, fmt.Errorf("no pipeline named %q; see xm pipelines list", fs.Arg(0)))
+	}
+	info := newPipelineInfo(d)
+	if output == "json" {
+		return printJSON(info)
+	}
+
+	caps := make([]string, 0, len(d.Capabilities))
+	for _, c := range d.Capabilities {
+		caps = append(caps, string(c))
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "Name:\t%s\n", d.Name)
+	fmt.Fprintf(tw, "Description:\t%s\n", d.Description)
+	fmt.Fprintf(tw, "Command:\t%s\n", orDash(d.Command))
+	fmt.Fprintf(tw, "Kinds:\t%s\n", strings.Join(d.Kinds, ", "))
+	fmt.Fprintf(tw, "Capabilities:\t%s\n", orDash(strings.Join(caps, ", ")))
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if len(d.Parameters) > 0 {
+		fmt.Println("\nParameters:")
+		tw = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "  NAME\tDEFAULT\tREQUIRED\tDESCRIPTION")
+		for _, p := range d.Parameters {
+			fmt.Fprintf(tw, "  %s\t%s\t%t\t%s\n", p.Name, orDash(p.Default), p.Required, p.Description)
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+	if len(info.Steps) > 0 {
+		fmt.Println("\nSteps:")
+		for _, s := range info.Steps {
+			fmt.Printf("  %s\n", s)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/mensylisir/xmcores/common"
+	"github.com/mensylisir/xmcores/errs"
+	"github.com/mensylisir/xmcores/modules/nodereset"
+)
+
+func runResetNode(ctx context.Context, args []string) error {
+	var (
+		cf   clusterFlags
+		name string
+		opts nodereset.Options
+		yes  bool
+	)
+	// The host comes first, as in "xm reset node worker1 -f cluster.yaml".
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	fs := flag.NewFlagSet("xm reset node <host>", flag.ContinueOnError)
+	cf.register(fs)
+	fs.BoolVar(&opts.Uninstall, "uninstall", false, "also remove the containerd and kubelet installations")
+	fs.BoolVar(&yes, "yes", false, "reset the host without asking")
+	cluster, err := cf.parse(ctx, fs, args)
+	if err != nil {
+		return err
+	}
+	if name == "" {
+		return errs.Wrap(errs.Config, errors.New("usage: xm reset node <host> [flags]"))
+	}
+	host, err := findHost(cluster.Hosts(), name)
+	if err != nil {
+		return err
+	}
+
+	if !yes {
+		question := fmt.Sprintf("Delete the Kubernetes and etcd state of %s? (yes/no)", name)
+		if host.IsRole(common.RoleControlPlane) || host.IsRole(common.RoleEtcd) {
+			question = fmt.Sprintf("%s runs the control plane or etcd. %s", name, question)
+		}
+		p := &prompter{in: bufio.NewReader(os.Stdin), out: os.Stderr}
+		answer := p.ask(question, "no")
+		if p.err != nil {
+			return errs.Wrap(errs.Config, p.err)
+		}
+		if answer != "yes" && answer != "y" {
+			return errs.Wrap(errs.Config, errors.New("reset cancelled; rerun with -yes to reset the host"))
+		}
+	}
+
+	xc, err := cf.client(cluster)
+	if err != nil {
+		return err
+	}
+	if _, err := xc.ResetNode(ctx, name, opts); err != nil {
+		return err
+	}
+	fmt.Printf("%s is reset; if it was registered, delete its Node (kubectl delete node %s) before adding it again\n", name, name)
+	return nil
+}
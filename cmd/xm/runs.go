@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mensylisir/xmcores/errs"
+	"github.com/mensylisir/xmcores/modules"
+	"github.com/mensylisir/xmcores/workspace"
+)
+
+// runsFlags select the cluster whose run history is shown.
+type runsFlags struct {
+	workDir, cluster string
+}
+
+func (f *runsFlags) register(fs *flag.FlagSet) {
+	registerWorkDir(fs, &f.workDir)
+	fs.StringVar(&f.cluster, "cluster", "", "name of the cluster")
+}
+
+func (f *runsFlags) open() (*workspace.Cluster, error) {
+	if f.cluster == "" {
+		return nil, errs.Wrap(errs.Config, errors.New("-cluster is required"))
+	}
+	c, err := workspace.New(f.workDir).Cluster(f.cluster)
+	if err != nil {
+		return nil, errs.Wrap(errs.Config, err)
+	}
+	return c, nil
+}
+
+func runRunsList(ctx context.Context, args []string) error {
+	var rf runsFlags
+	fs := flag.NewFlagSet("xm runs list", flag.ContinueOnError)
+	rf.register(fs)
+	if err := fs.Parse(args); err != nil {
+		return errs.Wrap(errs.Config, err)
+	}
+	c, err := rf.open()
+	if err != nil {
+		return err
+	}
+	runs, err := c.History()
+	if err != nil {
+		return err
+	}
+	if len(runs) == 0 {
+		fmt.Fprintf(os.Stderr, "No runs of cluster %s\n", c.Name)
+		return nil
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tCOMMAND\tSTARTED\tDURATION\tRESULT\tHOSTS")
+	for i := len(runs) - 1; i >= 0; i-- {
+		r := runs[i]
+		result := "ok"
+		if !r.Succeeded() {
+			result = "failed"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%d\n", orDash(r.ID), r.Command, r.Started.Local().Format(time.DateTime),
+			r.Finished.Sub(r.Started).Round(time.Second), result, len(r.Hosts))
+	}
+	return tw.Flush()
+}
+
+func runRunsStats(ctx context.Context, args []string) error {
+	var (
+		rf     runsFlags
+		output string
+		id     string
+	)
+	// The run ID comes first, as in "xm runs stats 1a2b3c4d -cluster demo".
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		id, args = args[0], args[1:]
+	}
+	fs := flag.NewFlagSet("xm runs stats <id>", flag.ContinueOnError)
+	rf.register(fs)
+	fs.StringVar(&output, "o", "text", "output format: text or json")
+	if err := fs.Parse(args); err != nil {
+		return errs.Wrap(errs.Config, err)
+	}
+	if id == "" || fs.NArg() > 0 {
+		return errs.Wrap(errs.Config, errors.New("usage: xm runs stats <id> -cluster <name> [flags]"))
+	}
+	if output != "text" && output != "json" {
+		return errs.Wrap(errs.Config, fmt.Errorf("unsupported output format %q", output))
+	}
+	c, err := rf.open()
+	if err != nil {
+		return err
+	}
+	run, err := c.Run(id)
+	if err != nil {
+		return errs.Wrap(errs.Config, err)
+	}
+	// The slowest hosts first, those failing the most among equals.
+	hosts := append([]workspace.HostStats(nil), run.Hosts...)
+	sort.SliceStable(hosts, func(i, j int) bool {
+		if hosts[i].MeanLatency != hosts[j].MeanLatency {
+			return hosts[i].MeanLatency > hosts[j].MeanLatency
+		}
+		return hosts[i].Failures > hosts[j].Failures
+	})
+	if output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(hosts)
+	}
+	if len(hosts) == 0 {
+		fmt.Fprintf(os.Stderr, "Run %s of cluster %s recorded no host statistics\n", run.ID, c.Name)
+		return nil
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "HOST\tUPLOADED\tDOWNLOADED\tCOMMANDS\tFAILURES\tMEAN LATENCY")
+	for _, h := range hosts {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\t%s\n", h.Host, modules.FormatSize(h.Uploaded), modules.FormatSize(h.Downloaded),
+			h.Commands, h.Failures, h.MeanLatency.Round(time.Millisecond))
+	}
+	return tw.Flush()
+}
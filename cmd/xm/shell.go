@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/mensylisir/xmcores/connector"
+	"github.com/mensylisir/xmcores/errs"
+	"github.com/mensylisir/xmcores/logger"
+	"github.com/mensylisir/xmcores/workspace"
+)
+
+// defaultTerm is the remote TERM when the local one is not set.
+const defaultTerm = "xterm-256color"
+
+func runShell(ctx context.Context, args []string) error {
+	var (
+		cf   clusterFlags
+		name string
+	)
+	// The host comes first, as in "xm shell master1 -f cluster.yaml".
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	fs := flag.NewFlagSet("xm shell <host>", flag.ContinueOnError)
+	cf.register(fs)
+	cluster, err := cf.parse(ctx, fs, args)
+	if err != nil {
+		return err
+	}
+	if name == "" {
+		return errs.Wrap(errs.Config, errors.New("usage: xm shell <host> [flags]"))
+	}
+	host, err := findHost(cluster.Hosts(), name)
+	if err != nil {
+		return err
+	}
+
+	return cf.session(ctx, cluster, "shell "+name, false, func(ctx context.Context, ws *workspace.Cluster) error {
+		conn, err := cluster.Dialer()(host)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		sh, ok := conn.(connector.Shell)
+		if !ok {
+			return errs.Wrap(errs.Config, fmt.Errorf("%s: the connection does not support interactive shells", name))
+		}
+
+		fd := int(os.Stdin.Fd())
+		size, err := windowSize(fd)
+		if err != nil {
+			return errs.Wrap(errs.Config, fmt.Errorf("standard input is not a terminal: %w", err))
+		}
+		restore, err := makeRaw(fd)
+		if err != nil {
+			return errs.Wrap(errs.Config, fmt.Errorf("failed to put the terminal in raw mode: %w", err))
+		}
+		resize := make(chan connector.WindowSize, 1)
+		stop := notifyResize(fd, resize)
+		term := os.Getenv("TERM")
+		if term == "" {
+			term = defaultTerm
+		}
+
+		code, err := sh.Shell(ctx, term, size, resize, os.Stdin, os.Stdout, os.Stderr)
+		stop()
+		if rerr := restore(); rerr != nil {
+			logger.Log.Warnf("failed to restore the terminal: %v", rerr)
+		}
+		if err != nil {
+			return errs.Wrap(errs.Connectivity, fmt.Errorf("%s: %w", name, err))
+		}
+		logger.Log.Debugf("the shell on %s exited with status %d", name, code)
+		return nil
+	})
+}
+
+// findHost returns the host called name.
+func findHost(hosts []connector.Host, name string) (connector.Host, error) {
+	var names []string
+	for _, h := range hosts {
+		if h.GetName() == name {
+			return h, nil
+		}
+		names = append(names, h.GetName())
+	}
+	return nil, errs.Wrap(errs.Config, fmt.Errorf("no host %q in the configuration, known hosts: %s", name, strings.Join(names, ", ")))
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mensylisir/xmcores/common"
+	"github.com/mensylisir/xmcores/errs"
+	"github.com/mensylisir/xmcores/kube"
+	"github.com/mensylisir/xmcores/workspace"
+)
+
+// envStatePassphrase holds the passphrase of state archives when
+// -passphrase-file is not given.
+const envStatePassphrase = "XM_STATE_PASSPHRASE"
+
+func registerPassphrase(fs *flag.FlagSet, file *string) {
+	fs.StringVar(file, "passphrase-file", "", "file holding the passphrase of the archive (default $"+envStatePassphrase+")")
+}
+
+func readPassphrase(file string) ([]byte, error) {
+	if file == "" {
+		if p := os.Getenv(envStatePassphrase); p != "" {
+			return []byte(p), nil
+		}
+		return nil, errs.Wrap(errs.Config, fmt.Errorf("set -passphrase-file or $%s", envStatePassphrase))
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, errs.Wrap(errs.Config, fmt.Errorf("failed to read the passphrase: %w", err))
+	}
+	p := strings.TrimRight(string(data), "\r\n")
+	if p == "" {
+		return nil, errs.Wrap(errs.Config, fmt.Errorf("passphrase file %s is empty", file))
+	}
+	return []byte(p), nil
+}
+
+func runExportState(ctx context.Context, args []string) error {
+	var workDir, name, output, passFile string
+	fs := flag.NewFlagSet("xm export state", flag.ContinueOnError)
+	registerWorkDir(fs, &workDir)
+	registerPassphrase(fs, &passFile)
+	fs.StringVar(&name, "cluster", "", "name of the cluster to export")
+	fs.StringVar(&output, "o", "", "archive to write (default <cluster>.xmstate)")
+	if err := fs.Parse(args); err != nil {
+		return errs.Wrap(errs.Config, err)
+	}
+	if name == "" {
+		return errs.Wrap(errs.Config, errors.New("-cluster is required"))
+	}
+	if output == "" {
+		output = name + ".xmstate"
+	}
+	passphrase, err := readPassphrase(passFile)
+	if err != nil {
+		return err
+	}
+	c, err := workspace.New(workDir).Cluster(name)
+	if err != nil {
+		return errs.Wrap(errs.Config, err)
+	}
+	var m workspace.Manifest
+	if data, err := os.ReadFile(c.KubeconfigPath()); err == nil {
+		if m.Certificates, err = kubeconfigCertificates(data); err != nil {
+			return fmt.Errorf("cluster %s: %w", name, err)
+		}
+	}
+
+	f, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, common.FileMode0600)
+	if err != nil {
+		return err
+	}
+	err = c.Export(f, passphrase, m)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(output)
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Exported the state of cluster %s to %s\n", name, output)
+	return nil
+}
+
+func runImportState(ctx context.Context, args []string) error {
+	var workDir, name, passFile string
+	var overwrite bool
+	fs := flag.NewFlagSet("xm import state", flag.ContinueOnError)
+	registerWorkDir(fs, &workDir)
+	registerPassphrase(fs, &passFile)
+	fs.StringVar(&name, "cluster", "", "name to import the cluster as (default the exported name)")
+	fs.BoolVar(&overwrite, "overwrite", false, "replace the state of a cluster of the same name")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: xm import state [flags] <archive>")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return errs.Wrap(errs.Config, err)
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errs.Wrap(errs.Config, errors.New("expected the archive to import"))
+	}
+	passphrase, err := readPassphrase(passFile)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	c, m, err := workspace.New(workDir).Import(f, passphrase, name, overwrite)
+	if errors.Is(err, workspace.ErrPassphrase) {
+		return errs.Wrap(errs.Config, err)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Imported cluster %s into %s (exported from %s at %s, %d files)\n", c.Name, c.Dir, orDash(m.Hostname), m.Exported.Local().Format(time.DateTime), len(m.Files))
+	for _, cert := range m.Certificates {
+		fmt.Fprintf(os.Stderr, "  %s %s expires %s\n", cert.Name, cert.Subject, cert.NotAfter.Local().Format(time.DateOnly))
+	}
+	return nil
+}
+
+// kubeconfigCertificates describes the CA and client certificates of the
+// current context of a kubeconfig.
+func kubeconfigCertificates(data []byte) ([]workspace.Certificate, error) {
+	cfg, err := kube.ParseKubeconfig(data)
+	if err != nil {
+		return nil, err
+	}
+	var certs []workspace.Certificate
+	for _, c := range []struct {
+		name string
+		data []byte
+	}{{"ca", cfg.CAData}, {"admin", cfg.CertData}} {
+		for rest := c.data; ; {
+			var block *pem.Block
+			if block, rest = pem.Decode(rest); block == nil {
+				break
+			}
+			if block.Type != "CERTIFICATE" {
+				continue
+			}
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse the %s certificate: %w", c.name, err)
+			}
+			certs = append(certs, workspace.Certificate{
+				Name:     c.name,
+				Subject:  cert.Subject.String(),
+				Issuer:   cert.Issuer.String(),
+				NotAfter: cert.NotAfter,
+			})
+		}
+	}
+	return certs, nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/mensylisir/xmcores/pipeline"
+)
+
+func runStepsList(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("xm steps list", flag.ContinueOnError)
+	output, err := parseOutput(fs, args)
+	if err != nil {
+		return err
+	}
+	common, types := pipeline.CommonStepParameters(), pipeline.StepTypes()
+	if output == "json" {
+		return printJSON(struct {
+			Common []pipeline.StepParameter `json:"common"`
+			Types  []pipeline.StepType      `json:"types"`
+		}{common, types})
+	}
+
+	fmt.Println("Every step:")
+	if err := printStepParameters(common); err != nil {
+		return err
+	}
+	for _, st := range types {
+		fmt.Printf("\n%s: %s\n", st.Name, st.Description)
+		if err := printStepParameters(st.Parameters); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func printStepParameters(params []pipeline.StepParameter) error {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "  NAME\tTYPE\tREQUIRED\tDESCRIPTION")
+	for _, p := range params {
+		fmt.Fprintf(tw, "  %s\t%s\t%t\t%s\n", p.Name, p.Type, p.Required, p.Description)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+
+	"github.com/mensylisir/xmcores/errs"
+	"github.com/mensylisir/xmcores/modules"
+	"github.com/mensylisir/xmcores/modules/sudoers"
+	"github.com/mensylisir/xmcores/workspace"
+)
+
+func runSudoersInstall(ctx context.Context, args []string) error {
+	return runSudoers(ctx, "install", args, sudoers.Install)
+}
+
+func runSudoersRemove(ctx context.Context, args []string) error {
+	return runSudoers(ctx, "remove", args, sudoers.Remove)
+}
+
+func runSudoers(ctx context.Context, action string, args []string, apply func(context.Context, []modules.Node, sudoers.Config) error) error {
+	var cf clusterFlags
+	fs := flag.NewFlagSet("xm sudoers "+action, flag.ContinueOnError)
+	cf.register(fs)
+	cluster, err := cf.parse(ctx, fs, args)
+	if err != nil {
+		return err
+	}
+	if cluster.Spec.Sudoers == nil {
+		return errs.Wrap(errs.Config, errors.New("spec.sudoers is not set"))
+	}
+	cfg := *cluster.Spec.Sudoers
+
+	return cf.session(ctx, cluster, "sudoers "+action, true, func(ctx context.Context, ws *workspace.Cluster) error {
+		nodes, err := modules.ConnectWith(ctx, cluster.Hosts(), cluster.Dialer())
+		if err != nil {
+			return err
+		}
+		defer modules.Close(nodes)
+		return apply(ctx, nodes, cfg)
+	})
+}
@@ -0,0 +1,23 @@
+//go:build !linux && !darwin
+
+package main
+
+import (
+	"errors"
+
+	"github.com/mensylisir/xmcores/connector"
+)
+
+var errNoTerminal = errors.New("interactive shells are only supported on Linux and macOS terminals")
+
+func makeRaw(int) (func() error, error) {
+	return nil, errNoTerminal
+}
+
+func windowSize(int) (connector.WindowSize, error) {
+	return connector.WindowSize{}, errNoTerminal
+}
+
+func notifyResize(int, chan<- connector.WindowSize) func() {
+	return func() {}
+}
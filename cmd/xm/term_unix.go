@@ -0,0 +1,70 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/mensylisir/xmcores/connector"
+)
+
+// makeRaw puts the terminal fd in raw mode, so that keys such as Ctrl-C reach
+// the remote shell, and returns the function restoring its previous state.
+func makeRaw(fd int) (func() error, error) {
+	old, err := unix.IoctlGetTermios(fd, ioctlReadTermios)
+	if err != nil {
+		return nil, err
+	}
+	raw := *old
+	raw.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+	raw.Oflag &^= unix.OPOST
+	raw.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	raw.Cflag &^= unix.CSIZE | unix.PARENB
+	raw.Cflag |= unix.CS8
+	raw.Cc[unix.VMIN] = 1
+	raw.Cc[unix.VTIME] = 0
+	if err := unix.IoctlSetTermios(fd, ioctlWriteTermios, &raw); err != nil {
+		return nil, err
+	}
+	return func() error { return unix.IoctlSetTermios(fd, ioctlWriteTermios, old) }, nil
+}
+
+// windowSize returns the size of the terminal fd.
+func windowSize(fd int) (connector.WindowSize, error) {
+	ws, err := unix.IoctlGetWinsize(fd, unix.TIOCGWINSZ)
+	if err != nil {
+		return connector.WindowSize{}, err
+	}
+	return connector.WindowSize{Rows: int(ws.Row), Cols: int(ws.Col)}, nil
+}
+
+// notifyResize relays the window size changes of the terminal fd to ch until
+// the returned function is called.
+func notifyResize(fd int, ch chan<- connector.WindowSize) func() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGWINCH)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-sig:
+				if size, err := windowSize(fd); err == nil {
+					select {
+					case ch <- size:
+					default:
+					}
+				}
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(sig)
+		close(done)
+	}
+}
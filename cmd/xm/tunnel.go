@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/mensylisir/xmcores/connector"
+	"github.com/mensylisir/xmcores/errs"
+	"github.com/mensylisir/xmcores/workspace"
+)
+
+// forwardSpec is ssh's [bind_address:]port:host:hostport, IPv6 addresses in
+// brackets.
+var forwardSpec = regexp.MustCompile(`^(?:(\[[^\]]+\]|[^:\[\]]+):)?(\d+):(\[[^\]]+\]|[^:\[\]]+):(\d+)$`)
+
+// forward is a -L or -R flag: connections to listen are forwarded to target.
+type forward struct {
+	listen, target string
+}
+
+// parseForward parses spec; the bind address defaults to the loopback.
+func parseForward(spec string) (forward, error) {
+	m := forwardSpec.FindStringSubmatch(spec)
+	if m == nil {
+		return forward{}, fmt.Errorf("%q is not [bind_address:]port:host:hostport", spec)
+	}
+	bind := strings.Trim(m[1], "[]")
+	if bind == "" {
+		bind = "127.0.0.1"
+	}
+	return forward{
+		listen: net.JoinHostPort(bind, m[2]),
+		target: net.JoinHostPort(strings.Trim(m[3], "[]"), m[4]),
+	}, nil
+}
+
+func forwardFlag(fs *flag.FlagSet, name, usage string, list *[]forward) {
+	fs.Func(name, usage, func(s string) error {
+		f, err := parseForward(s)
+		if err != nil {
+			return err
+		}
+		*list = append(*list, f)
+		return nil
+	})
+}
+
+func runTunnel(ctx context.Context, args []string) error {
+	var (
+		cf            clusterFlags
+		name          string
+		local, remote []forward
+	)
+	// The host comes first, as in "xm tunnel master1 -f cluster.yaml -L 2381:127.0.0.1:2381".
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	fs := flag.NewFlagSet("xm tunnel <host>", flag.ContinueOnError)
+	cf.register(fs)
+	forwardFlag(fs, "L", "forward `[bind_address:]port:host:hostport`, listening here and connecting from the host; repeatable", &local)
+	forwardFlag(fs, "R", "forward `[bind_address:]port:host:hostport`, listening on the host and connecting from here; repeatable", &remote)
+	cluster, err := cf.parse(ctx, fs, args)
+	if err != nil {
+		return err
+	}
+	if name == "" {
+		return errs.Wrap(errs.Config, errors.New("usage: xm tunnel <host> -L|-R [bind_address:]port:host:hostport [flags]"))
+	}
+	if len(local)+len(remote) == 0 {
+		return errs.Wrap(errs.Config, errors.New("at least one -L or -R forwarding is required"))
+	}
+	host, err := findHost(cluster.Hosts(), name)
+	if err != nil {
+		return err
+	}
+
+	return cf.session(ctx, cluster, "tunnel "+name, false, func(ctx context.Context, ws *workspace.Cluster) error {
+		conn, err := cluster.Dialer()(host)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		fw, ok := conn.(connector.Forwarder)
+		if !ok {
+			return errs.Wrap(errs.Config, fmt.Errorf("%s: the connection does not support port forwarding", name))
+		}
+
+		var tunnels []*connector.Tunnel
+		defer func() {
+			for _, t := range tunnels {
+				_ = t.Close()
+			}
+		}()
+		for _, f := range local {
+			t, err := fw.ForwardLocalPort(ctx, f.listen, f.target)
+			if err != nil {
+				return errs.Wrap(errs.Connectivity, fmt.Errorf("%s: %w", name, err))
+			}
+			tunnels = append(tunnels, t)
+			fmt.Fprintf(os.Stderr, "Forwarding %s to %s on %s\n", t.Addr(), f.target, name)
+		}
+		for _, f := range remote {
+			t, err := fw.ForwardRemotePort(ctx, f.listen, f.target)
+			if err != nil {
+				return errs.Wrap(errs.Connectivity, fmt.Errorf("%s: %w", name, err))
+			}
+			tunnels = append(tunnels, t)
+			fmt.Fprintf(os.Stderr, "Forwarding %s on %s to %s\n", t.Addr(), name, f.target)
+		}
+		fmt.Fprintln(os.Stderr, "Press Ctrl-C to stop")
+
+		// A tunnel ends early when the connection to the host breaks.
+		stopped := make(chan *connector.Tunnel, len(tunnels))
+		for _, t := range tunnels {
+			go func() {
+				<-t.Done()
+				stopped <- t
+			}()
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case t := <-stopped:
+			if ctx.Err() != nil {
+				return nil
+			}
+			return errs.Wrap(errs.Connectivity, fmt.Errorf("%s: the forwarding of %s stopped", name, t.Addr()))
+		}
+	})
+}
@@ -2,16 +2,20 @@ package common
 
 import (
 	"io/fs"
-	"path/filepath"
+	"path"
 )
 
 const (
 	AppName    = "xmcores"
 	TmpDirBase = "/tmp/"
+	// DefaultWorkDir is the local directory holding generated artifacts.
+	DefaultWorkDir = ".xmcores"
 )
 
+// GetTmpDir returns the temporary directory on the nodes. It is a remote path,
+// so it uses forward slashes whatever the controller's OS.
 func GetTmpDir() string {
-	return filepath.Join(TmpDirBase, AppName) + "/"
+	return path.Join(TmpDirBase, AppName) + "/"
 }
 
 const (
@@ -20,6 +24,7 @@ const (
 	TaskName      = "Task"
 	StepName      = "Step"
 	NodeName      = "Node"
+	ComponentName = "Component"
 	LocalHostname = "LocalHost"
 )
 
@@ -62,6 +67,13 @@ const (
 	DefaultSSHPort = 22
 )
 
+// Host roles used in the inventory.
+const (
+	RoleControlPlane = "control-plane"
+	RoleEtcd         = "etcd"
+	RoleWorker       = "worker"
+)
+
 // Status or State constants (iota can be useful here)
 type OperationState int
 
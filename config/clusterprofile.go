@@ -0,0 +1,60 @@
+package config
+
+import (
+	"fmt"
+
+	"github.com/mensylisir/xmcores/modules/kubeadm"
+)
+
+// Cluster profiles selected by spec.profile. A profile only changes defaults:
+// every setting it tunes can still be set explicitly.
+const (
+	// ClusterProfileDefault suits servers.
+	ClusterProfileDefault = ""
+	// ClusterProfileEdge suits low-memory nodes such as ARM single-board
+	// computers: flannel instead of calico, smaller kubelet reservations and
+	// eviction thresholds, and fewer pods per node. Optional addons (ingress,
+	// storage, image preloading) stay off unless configured.
+	ClusterProfileEdge = "edge"
+)
+
+// edgeKubelet is the KubeletConfiguration of the edge profile, which
+// spec.kubeadmExtra.kubeletConfiguration overrides key by key.
+func edgeKubelet() map[string]interface{} {
+	return map[string]interface{}{
+		"kubeReserved":   map[string]interface{}{"cpu": "50m", "memory": "96Mi"},
+		"systemReserved": map[string]interface{}{"cpu": "50m", "memory": "96Mi"},
+		"evictionHard": map[string]interface{}{
+			"memory.available":  "64Mi",
+			"nodefs.available":  "5%",
+			"imagefs.available": "10%",
+		},
+		"maxPods":                     40,
+		"imageGCHighThresholdPercent": 70,
+		"imageGCLowThresholdPercent":  50,
+	}
+}
+
+// setProfileDefaults fills the settings spec.profile tunes, before the
+// generic defaults apply.
+func (c *Cluster) setProfileDefaults() {
+	if c.Spec.Profile == ClusterProfileEdge && c.Spec.Network.Plugin == "" {
+		c.Spec.Network.Plugin = NetworkFlannel
+	}
+}
+
+// profileExtra returns e with the kubeadm settings of spec.profile beneath it.
+func (c *Cluster) profileExtra(e kubeadm.Extra) kubeadm.Extra {
+	if c.Spec.Profile == ClusterProfileEdge {
+		e.KubeletConfiguration = kubeadm.DeepMerge(edgeKubelet(), e.KubeletConfiguration)
+	}
+	return e
+}
+
+func validateClusterProfile(profile string) error {
+	switch profile {
+	case ClusterProfileDefault, ClusterProfileEdge:
+		return nil
+	}
+	return fmt.Errorf("spec.profile: unsupported profile %q (want %s)", profile, ClusterProfileEdge)
+}
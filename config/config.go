@@ -0,0 +1,684 @@
+// Package config defines the cluster configuration file.
+package config
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/mensylisir/xmcores/catalog"
+	"github.com/mensylisir/xmcores/common"
+	"github.com/mensylisir/xmcores/connector"
+	"github.com/mensylisir/xmcores/errs"
+	"github.com/mensylisir/xmcores/facts"
+	"github.com/mensylisir/xmcores/inventory"
+	"github.com/mensylisir/xmcores/logger"
+	"github.com/mensylisir/xmcores/modules"
+	"github.com/mensylisir/xmcores/modules/binaries"
+	"github.com/mensylisir/xmcores/modules/existing"
+	"github.com/mensylisir/xmcores/modules/imagepreload"
+	"github.com/mensylisir/xmcores/modules/ingress"
+	"github.com/mensylisir/xmcores/modules/k3s"
+	"github.com/mensylisir/xmcores/modules/kubeadm"
+	"github.com/mensylisir/xmcores/modules/localdocker"
+	"github.com/mensylisir/xmcores/modules/nodemeta"
+	"github.com/mensylisir/xmcores/modules/nodeprep"
+	"github.com/mensylisir/xmcores/modules/osrepo"
+	"github.com/mensylisir/xmcores/modules/proxy"
+	"github.com/mensylisir/xmcores/modules/security"
+	"github.com/mensylisir/xmcores/modules/storage"
+	"github.com/mensylisir/xmcores/modules/sudoers"
+	"github.com/mensylisir/xmcores/modules/systune"
+	"github.com/mensylisir/xmcores/modules/timesync"
+	"github.com/mensylisir/xmcores/modules/trustca"
+	"github.com/mensylisir/xmcores/registry"
+	"github.com/mensylisir/xmcores/runhook"
+)
+
+const (
+	// APIVersion is the current configuration schema; Parse converts older
+	// ones to it, see Migrate.
+	APIVersion  = "xmcores.io/v1alpha2"
+	KindCluster = "Cluster"
+)
+
+// Cluster is the root of a cluster configuration file.
+type Cluster struct {
+	APIVersion string      `yaml:"apiVersion" json:"apiVersion"`
+	Kind       string      `yaml:"kind" json:"kind"`
+	Metadata   Metadata    `yaml:"metadata" json:"metadata"`
+	Spec       ClusterSpec `yaml:"spec" json:"spec"`
+}
+
+// Metadata identifies the cluster.
+type Metadata struct {
+	Name string `yaml:"name" json:"name"`
+}
+
+// ClusterSpec describes the desired cluster.
+type ClusterSpec struct {
+	// Profile tunes the defaults for a kind of cluster, see ClusterProfileEdge.
+	Profile string `yaml:"profile,omitempty" json:"profile,omitempty"`
+	Hosts   []Host `yaml:"hosts" json:"hosts"`
+	// RoleGroups assign roles to hosts by name, in addition to their own
+	// roles, e.g. etcd: [etcd1, etcd2, etcd3]. Etcd hosts that are not
+	// control-plane hosts run etcd on their own, see TopologyExternalEtcd.
+	RoleGroups map[string][]string `yaml:"roleGroups,omitempty" json:"roleGroups,omitempty"`
+	Runtime    Runtime             `yaml:"runtime,omitempty" json:"runtime,omitempty"`
+	// Connection holds the SSH settings shared by all hosts, see Connection.
+	Connection *Connection `yaml:"connection,omitempty" json:"connection,omitempty"`
+	// Inventory resolves the addresses hosts leave empty, see ResolveAddresses.
+	Inventory *inventory.Config `yaml:"inventory,omitempty" json:"inventory,omitempty"`
+	// Resolution turns host addresses given as names into IP addresses.
+	Resolution   *Resolution      `yaml:"resolution,omitempty" json:"resolution,omitempty"`
+	Kubernetes   Kubernetes       `yaml:"kubernetes" json:"kubernetes"`
+	Network      Network          `yaml:"network,omitempty" json:"network,omitempty"`
+	OSRepository *osrepo.Config   `yaml:"osRepository,omitempty" json:"osRepository,omitempty"`
+	TimeSync     *timesync.Config `yaml:"timeSync,omitempty" json:"timeSync,omitempty"`
+	SysTune      systune.Config   `yaml:"sysTune,omitempty" json:"sysTune,omitempty"`
+	NodePrepare  nodeprep.Config  `yaml:"nodePrepare,omitempty" json:"nodePrepare,omitempty"`
+	Storage      *storage.Config  `yaml:"storage,omitempty" json:"storage,omitempty"`
+	Ingress      *ingress.Config  `yaml:"ingress,omitempty" json:"ingress,omitempty"`
+	Security     *security.Config `yaml:"security,omitempty" json:"security,omitempty"`
+	// ExistingComponents decides what becomes of the containerd and kubelet
+	// found on a node before it joins, adopted by default when compatible.
+	ExistingComponents existing.Config `yaml:"existingComponents,omitempty" json:"existingComponents,omitempty"`
+	// ImagePreload imports images from a local OCI layout instead of pulling them.
+	ImagePreload *imagepreload.Config `yaml:"imagePreload,omitempty" json:"imagePreload,omitempty"`
+	// Binaries installs kubeadm, kubelet and kubectl on the joining hosts,
+	// built for the architecture of each; without it they must be installed
+	// already.
+	Binaries *binaries.Config `yaml:"binaries,omitempty" json:"binaries,omitempty"`
+	// Registry is the private registry xm images push pushes to.
+	Registry *registry.Config `yaml:"registry,omitempty" json:"registry,omitempty"`
+	// TrustedCAs are installed in the trust store of every node, see
+	// Cluster.TrustedCAs.
+	TrustedCAs []trustca.CA `yaml:"trustedCAs,omitempty" json:"trustedCAs,omitempty"`
+	// Proxy is the HTTP proxy of the nodes, see Cluster.Proxy.
+	Proxy        *proxy.Config `yaml:"proxy,omitempty" json:"proxy,omitempty"`
+	KubeadmExtra kubeadm.Extra `yaml:"kubeadmExtra,omitempty" json:"kubeadmExtra,omitempty"`
+	// K3s configures the K3s distribution installed by xm k3s install
+	// instead of kubeadm.
+	K3s *k3s.Config `yaml:"k3s,omitempty" json:"k3s,omitempty"`
+	// Logging adds log destinations to those given on the command line.
+	Logging *Logging `yaml:"logging,omitempty" json:"logging,omitempty"`
+	// Hooks run local commands or notify endpoints before and after the
+	// commands that change the cluster.
+	Hooks *runhook.Config `yaml:"hooks,omitempty" json:"hooks,omitempty"`
+	// Sandbox runs the unprivileged commands of steps as a dedicated
+	// low-privilege user rather than the connecting one.
+	Sandbox *modules.SandboxConfig `yaml:"sandbox,omitempty" json:"sandbox,omitempty"`
+	// Sudoers lists the commands xm sudoers install lets a restricted user
+	// run as root.
+	Sudoers *sudoers.Config `yaml:"sudoers,omitempty" json:"sudoers,omitempty"`
+	// Journal records what the commands that change the cluster change on
+	// the hosts, for xm changes list and revert.
+	Journal *modules.JournalConfig `yaml:"journal,omitempty" json:"journal,omitempty"`
+
+	// Vars are variables of every host, overridden by group and host vars
+	// (see HostVars). Strings in kubeadmExtra are templates rendered per host
+	// with them, e.g. "{{ .Vars.dataDir }}/kubelet".
+	Vars   map[string]interface{} `yaml:"vars,omitempty" json:"vars,omitempty"`
+	Groups []Group                `yaml:"groups,omitempty" json:"groups,omitempty"`
+	// Profiles are node settings hosts use by name, see HostProfile.
+	Profiles []Profile `yaml:"profiles,omitempty" json:"profiles,omitempty"`
+}
+
+// Logging configures where the runs against the cluster are logged.
+type Logging struct {
+	Sinks []logger.Sink `yaml:"sinks,omitempty" json:"sinks,omitempty"`
+	// Rotation rotates the log file of XM_LOG_OUTPUT_PATH; the -log-rotate-*
+	// and -log-max-* flags override it. File sinks have their own.
+	Rotation *logger.Rotation `yaml:"rotation,omitempty" json:"rotation,omitempty"`
+}
+
+// Host is an inventory entry.
+type Host struct {
+	connector.BaseHost `yaml:",inline" json:",inline"`
+	Roles              []string          `yaml:"roles,omitempty" json:"roles,omitempty"`
+	Labels             map[string]string `yaml:"labels,omitempty" json:"labels,omitempty"`
+	Annotations        map[string]string `yaml:"annotations,omitempty" json:"annotations,omitempty"`
+	// Taints are registered by kubeadm when the node joins and reconciled
+	// afterwards. On control-plane hosts they replace the default taint.
+	Taints []nodemeta.Taint `yaml:"taints,omitempty" json:"taints,omitempty"`
+	// Vars override the cluster and group vars for this host.
+	Vars map[string]interface{} `yaml:"vars,omitempty" json:"vars,omitempty"`
+	// Profiles name the spec.profiles whose settings apply to this host, in
+	// increasing precedence; the host's own labels and taints come last.
+	Profiles []string `yaml:"profiles,omitempty" json:"profiles,omitempty"`
+	// Connection overrides the inherited SSH settings for this host.
+	Connection *Connection `yaml:"connection,omitempty" json:"connection,omitempty"`
+	// ExternalAddress is the address clients outside the cluster network
+	// reach the host at, when it has another one there. Those of the
+	// control-plane hosts are added to the apiserver certificate.
+	ExternalAddress string `yaml:"externalAddress,omitempty" json:"externalAddress,omitempty"`
+	// Interface is the network interface carrying InternalAddress, over
+	// which the pod network tunnels (VXLAN) or peers (BGP).
+	Interface string `yaml:"interface,omitempty" json:"interface,omitempty"`
+}
+
+// Kubernetes holds the Kubernetes version and cluster-wide settings.
+type Kubernetes struct {
+	Version              string   `yaml:"version" json:"version"`
+	ControlPlaneEndpoint string   `yaml:"controlPlaneEndpoint,omitempty" json:"controlPlaneEndpoint,omitempty"`
+	PodSubnet            string   `yaml:"podSubnet,omitempty" json:"podSubnet,omitempty"`
+	ServiceSubnet        string   `yaml:"serviceSubnet,omitempty" json:"serviceSubnet,omitempty"`
+	DNSDomain            string   `yaml:"dnsDomain,omitempty" json:"dnsDomain,omitempty"`
+	ImageRepository      string   `yaml:"imageRepository,omitempty" json:"imageRepository,omitempty"`
+	CertSANs             []string `yaml:"certSANs,omitempty" json:"certSANs,omitempty"`
+	// ExtraArgs are the flags of the kubelet and the control-plane
+	// components of every host, overridden by those of spec.groups, see
+	// Cluster.ExtraArgs.
+	kubeadm.ExtraArgs `yaml:",inline" json:",inline"`
+}
+
+// CNI plugins supported by Network.
+const (
+	NetworkCalico  = "calico"
+	NetworkFlannel = "flannel"
+	// NetworkNone leaves the CNI to be installed by the user.
+	NetworkNone = "none"
+)
+
+// NetworkPlugins lists the accepted values of Network.Plugin.
+var NetworkPlugins = []string{NetworkCalico, NetworkFlannel, NetworkNone}
+
+// Network selects the pod network (CNI) plugin.
+type Network struct {
+	Plugin string `yaml:"plugin,omitempty" json:"plugin,omitempty"`
+	// NodeSubnets are the subnets of the internal addresses of the hosts.
+	// An internal address outside them is rejected, which catches hosts
+	// declaring an address of another network.
+	NodeSubnets []string `yaml:"nodeSubnets,omitempty" json:"nodeSubnets,omitempty"`
+}
+
+// SetDefaults fills unset fields.
+func (n *Network) SetDefaults() {
+	if n.Plugin == "" {
+		n.Plugin = NetworkCalico
+	}
+}
+
+// Validate checks the network settings.
+func (n *Network) Validate() error {
+	var errList []error
+	supported := false
+	for _, p := range NetworkPlugins {
+		supported = supported || n.Plugin == p
+	}
+	if !supported {
+		errList = append(errList, fmt.Errorf("unsupported network plugin %q (want one of %s)", n.Plugin, strings.Join(NetworkPlugins, ", ")))
+	}
+	for _, s := range n.NodeSubnets {
+		if _, _, err := net.ParseCIDR(s); err != nil {
+			errList = append(errList, fmt.Errorf("nodeSubnets: %q is not a CIDR", s))
+		}
+	}
+	return errors.Join(errList...)
+}
+
+// Runtime backends reaching the nodes.
+const (
+	RuntimeSSH = "ssh"
+	// RuntimeLocalDocker runs the nodes as containers on the local Docker
+	// daemon, for testing without machines.
+	RuntimeLocalDocker = "local-docker"
+)
+
+// Runtime selects how the nodes are provisioned and reached.
+type Runtime struct {
+	Backend     string             `yaml:"backend,omitempty" json:"backend,omitempty"`
+	LocalDocker localdocker.Config `yaml:"localDocker,omitempty" json:"localDocker,omitempty"`
+}
+
+// SetDefaults fills unset fields.
+func (r *Runtime) SetDefaults() {
+	if r.Backend == "" {
+		r.Backend = RuntimeSSH
+	}
+	if r.Backend == RuntimeLocalDocker {
+		r.LocalDocker.SetDefaults()
+	}
+}
+
+// Dialer returns how the cluster's nodes are connected to.
+func (c *Cluster) Dialer() modules.Dialer {
+	if c.Spec.Runtime.Backend == RuntimeLocalDocker {
+		return localdocker.Dial(c.Spec.Runtime.LocalDocker, c.Metadata.Name)
+	}
+	return func(host connector.Host) (connector.Connection, error) {
+		return connector.NewConnection(c.ConnectionConfig(host))
+	}
+}
+
+// Load reads and parses a cluster configuration file, applies defaults and validates it.
+// Files encrypted with age or SOPS are decrypted in memory; SOPS needs the
+// sops binary (see Decrypt).
+func Load(path string) (*Cluster, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errs.Wrap(errs.Config, fmt.Errorf("failed to read cluster config %s: %w", path, err))
+	}
+	if data, err = Decrypt(context.Background(), data); err != nil {
+		return nil, errs.Wrap(errs.Config, fmt.Errorf("%s: %w", path, err))
+	}
+	c, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return c, nil
+}
+
+// Parse decodes a cluster configuration, applies defaults and validates it.
+// Configurations of older apiVersions are converted first (see Migrate).
+// Unknown fields are rejected so typos do not silently fall back to defaults.
+// Failures are classified as errs.Config.
+func Parse(data []byte) (*Cluster, error) {
+	data, from, err := Migrate(data)
+	if err != nil {
+		return nil, errs.Wrap(errs.Config, err)
+	}
+	if from != APIVersion {
+		logger.Log.Warnf("the cluster config has apiVersion %s, converted to %s; run xm config migrate to rewrite it", from, APIVersion)
+	}
+	c := &Cluster{}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil {
+		return nil, errs.Wrap(errs.Config, fmt.Errorf("failed to parse cluster config: %w", err))
+	}
+	c.SetDefaults()
+	if err := c.Validate(); err != nil {
+		return nil, errs.Wrap(errs.Config, err)
+	}
+	return c, nil
+}
+
+// SetDefaults fills unset fields.
+func (c *Cluster) SetDefaults() {
+	if c.APIVersion == "" {
+		c.APIVersion = APIVersion
+	}
+	if c.Kind == "" {
+		c.Kind = KindCluster
+	}
+	c.Spec.Runtime.SetDefaults()
+	c.applyRoleGroups()
+	if c.Spec.Inventory != nil {
+		c.Spec.Inventory.SetDefaults()
+	}
+	for i := range c.Spec.Hosts {
+		h := &c.Spec.Hosts[i]
+		c.applyConnection(h)
+		if h.Port == 0 {
+			h.Port = 22
+		}
+		if c.Spec.Runtime.Backend == RuntimeLocalDocker && h.User == "" {
+			h.User = "root"
+		}
+		if h.InternalAddress == "" {
+			h.InternalAddress = h.Address
+		}
+	}
+	if c.Spec.OSRepository != nil {
+		c.Spec.OSRepository.SetDefaults()
+	}
+	if c.Spec.ImagePreload != nil {
+		c.Spec.ImagePreload.SetDefaults()
+	}
+	if c.Spec.Binaries != nil {
+		c.Spec.Binaries.SetDefaults()
+	}
+	if c.Spec.TimeSync != nil {
+		c.Spec.TimeSync.SetDefaults()
+	}
+	if c.Spec.Hooks != nil {
+		c.Spec.Hooks.SetDefaults()
+	}
+	if c.Spec.Sandbox != nil {
+		c.Spec.Sandbox.SetDefaults()
+	}
+	if c.Spec.Sudoers != nil {
+		if c.Spec.Sudoers.User == "" && c.Spec.Sandbox != nil {
+			c.Spec.Sudoers.User = c.Spec.Sandbox.User
+		}
+		c.Spec.Sudoers.SetDefaults()
+	}
+	if c.Spec.Journal != nil {
+		c.Spec.Journal.SetDefaults()
+	}
+	c.setProfileDefaults()
+	c.Spec.Network.SetDefaults()
+	c.Spec.NodePrepare.SetDefaults()
+	c.Spec.ExistingComponents.SetDefaults()
+	if c.Spec.Storage != nil {
+		c.Spec.Storage.SetDefaults()
+	}
+	if c.Spec.Ingress != nil {
+		c.Spec.Ingress.SetDefaults()
+	}
+	if c.Spec.Security != nil {
+		c.Spec.Security.SetDefaults()
+	}
+	if c.Spec.K3s != nil {
+		c.Spec.K3s.SetDefaults(c.Spec.Kubernetes.Version)
+	}
+}
+
+// Validate checks the configuration and returns all problems found.
+func (c *Cluster) Validate() error {
+	var errs []error
+	if c.APIVersion != APIVersion {
+		errs = append(errs, fmt.Errorf("unsupported apiVersion %q (want %s)", c.APIVersion, APIVersion))
+	}
+	if c.Kind != KindCluster {
+		errs = append(errs, fmt.Errorf("unsupported kind %q (want %s)", c.Kind, KindCluster))
+	}
+	if c.Metadata.Name == "" {
+		errs = append(errs, errors.New("metadata.name must be set"))
+	}
+	if err := validateClusterProfile(c.Spec.Profile); err != nil {
+		errs = append(errs, err)
+	}
+	if len(c.Spec.Hosts) == 0 {
+		errs = append(errs, errors.New("spec.hosts must list at least one host"))
+	}
+	seen := make(map[string]bool, len(c.Spec.Hosts))
+	for _, h := range c.Spec.Hosts {
+		if seen[h.Name] {
+			errs = append(errs, fmt.Errorf("duplicate host name %q", h.Name))
+		}
+		seen[h.Name] = true
+		base := h.BaseHost
+		if c.Spec.Inventory != nil && base.Address == "" {
+			// Resolved from the inventory at run time.
+			base.Address = c.Spec.Inventory.Provider
+		}
+		if agent := c.connection(h).AgentSocket; agent != "" && base.Password == "" && base.PrivateKey == "" && base.PrivateKeyPath == "" {
+			// The agent authenticates, which BaseHost.Validate does not know about.
+			base.PrivateKeyPath = agent
+		}
+		errs = append(errs, c.validateConnection(h)...)
+		if c.Spec.Runtime.Backend == RuntimeLocalDocker {
+			// Containers are reached through docker exec and need no credentials.
+			if base.Name == "" || base.Address == "" {
+				errs = append(errs, fmt.Errorf("host %q: name and address must be set", base.Name))
+			}
+		} else if err := base.Validate(); err != nil {
+			errs = append(errs, err)
+		}
+		if err := c.hostMetadata(h).Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("host %s: %w", h.Name, err))
+		}
+	}
+	if c.Spec.Kubernetes.Version == "" {
+		errs = append(errs, errors.New("spec.kubernetes.version must be set"))
+	} else if _, err := c.ResolveComponents(); err != nil {
+		errs = append(errs, fmt.Errorf("spec.kubernetes.version: %w", err))
+	}
+	if c.Spec.Inventory != nil {
+		if err := c.Spec.Inventory.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("spec.inventory: %w", err))
+		}
+	}
+	switch c.Spec.Runtime.Backend {
+	case RuntimeSSH:
+	case RuntimeLocalDocker:
+		addresses := make([]string, 0, len(c.Spec.Hosts))
+		for _, h := range c.Spec.Hosts {
+			addresses = append(addresses, h.InternalAddress)
+		}
+		if err := c.Spec.Runtime.LocalDocker.Validate(addresses); err != nil {
+			errs = append(errs, fmt.Errorf("spec.runtime.localDocker: %w", err))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("spec.runtime: unsupported backend %q (want %s or %s)", c.Spec.Runtime.Backend, RuntimeSSH, RuntimeLocalDocker))
+	}
+	if err := c.Spec.Network.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("spec.network: %w", err))
+	}
+	if err := c.Spec.KubeadmExtra.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("spec.%w", err))
+	}
+	if err := c.Spec.Kubernetes.ExtraArgs.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("spec.kubernetes: %w", err))
+	}
+	errs = append(errs, c.validateVars()...)
+	errs = append(errs, c.validateProfiles()...)
+	errs = append(errs, c.validateTopology()...)
+	errs = append(errs, c.validateResolution()...)
+	errs = append(errs, c.validateAddresses()...)
+
+	if c.Spec.OSRepository != nil {
+		if err := c.Spec.OSRepository.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("spec.osRepository: %w", err))
+		}
+	}
+	if c.Spec.ImagePreload != nil {
+		if err := c.Spec.ImagePreload.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("spec.imagePreload: %w", err))
+		}
+	}
+	if c.Spec.Binaries != nil {
+		if err := c.Spec.Binaries.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("spec.binaries: %w", err))
+		}
+	}
+	if c.Spec.Registry != nil {
+		if err := c.Spec.Registry.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("spec.registry: %w", err))
+		}
+	}
+	names := map[string]bool{}
+	for i := range c.Spec.TrustedCAs {
+		ca := &c.Spec.TrustedCAs[i]
+		if err := ca.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("spec.trustedCAs[%d]: %w", i, err))
+		}
+		if names[ca.Name] {
+			errs = append(errs, fmt.Errorf("spec.trustedCAs[%d]: duplicate name %q", i, ca.Name))
+		}
+		names[ca.Name] = true
+	}
+	if c.Spec.TimeSync != nil {
+		if err := c.Spec.TimeSync.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("spec.timeSync: %w", err))
+		}
+	}
+	if err := c.Spec.SysTune.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("spec.sysTune: %w", err))
+	}
+	if err := c.Spec.NodePrepare.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("spec.nodePrepare: %w", err))
+	}
+	if err := c.Spec.ExistingComponents.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("spec.existingComponents: %w", err))
+	}
+	if c.Spec.Storage != nil {
+		if err := c.Spec.Storage.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("spec.storage: %w", err))
+		}
+	}
+	if c.Spec.Ingress != nil {
+		if err := c.Spec.Ingress.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("spec.ingress: %w", err))
+		}
+	}
+	if c.Spec.Security != nil {
+		if err := c.Spec.Security.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("spec.security: %w", err))
+		}
+	}
+	if c.Spec.K3s != nil {
+		if err := c.Spec.K3s.Validate(len(c.HostsByRole(common.RoleControlPlane))); err != nil {
+			errs = append(errs, fmt.Errorf("spec.k3s: %w", err))
+		}
+	}
+	if c.Spec.Proxy != nil {
+		if err := c.Spec.Proxy.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("spec.proxy: %w", err))
+		}
+	}
+	if c.Spec.Hooks != nil {
+		if err := c.Spec.Hooks.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("spec.hooks: %w", err))
+		}
+	}
+	if c.Spec.Sandbox != nil {
+		if err := c.Spec.Sandbox.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("spec.sandbox: %w", err))
+		}
+	}
+	if c.Spec.Journal != nil {
+		if err := c.Spec.Journal.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("spec.journal: %w", err))
+		}
+	}
+	if c.Spec.Sudoers != nil {
+		if err := c.Spec.Sudoers.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("spec.sudoers: %w", err))
+		}
+	}
+	if c.Spec.Logging != nil {
+		for i, sink := range c.Spec.Logging.Sinks {
+			if err := sink.Validate(); err != nil {
+				errs = append(errs, fmt.Errorf("spec.logging.sinks[%d]: %w", i, err))
+			}
+		}
+		if r := c.Spec.Logging.Rotation; r != nil {
+			if err := r.Validate(); err != nil {
+				errs = append(errs, fmt.Errorf("spec.logging.rotation: %w", err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ResolveAddresses asks the inventory provider for the addresses of the hosts
+// that leave them empty, then resolves addresses given as names as selected
+// by spec.resolution. Hosts with an IP address keep it.
+func (c *Cluster) ResolveAddresses(ctx context.Context) error {
+	if err := c.resolveInventory(ctx); err != nil {
+		return err
+	}
+	if err := c.resolveNames(ctx); err != nil {
+		return errs.Wrap(errs.Config, err)
+	}
+	return nil
+}
+
+func (c *Cluster) resolveInventory(ctx context.Context) error {
+	inv := c.Spec.Inventory
+	if inv == nil {
+		return nil
+	}
+	provider, err := inventory.New(*inv, nil)
+	if err != nil {
+		return errs.Wrap(errs.Config, err)
+	}
+	machines, err := provider.Addresses(ctx)
+	if err != nil {
+		return errs.Wrap(errs.Connectivity, fmt.Errorf("%s inventory: %w", inv.Provider, err))
+	}
+	var missing []string
+	for i := range c.Spec.Hosts {
+		h := &c.Spec.Hosts[i]
+		if h.Address != "" {
+			continue
+		}
+		m, ok := machines[h.Name]
+		if !ok {
+			missing = append(missing, h.Name)
+			continue
+		}
+		address, internal := inv.Select(m)
+		h.Address = address
+		if h.InternalAddress == "" {
+			h.InternalAddress = internal
+		}
+	}
+	if len(missing) > 0 {
+		return errs.Wrap(errs.Config, fmt.Errorf("%s inventory has no machine named %s", inv.Provider, strings.Join(missing, ", ")))
+	}
+	return nil
+}
+
+// ResolveComponents resolves the binaries of spec.kubernetes.version from
+// the catalog for each architecture of the hosts, keyed by Go architecture
+// name. Before the architectures are gathered, amd64 stands in for them, so
+// that unsupported versions are still rejected.
+func (c *Cluster) ResolveComponents() (map[string]*catalog.Bundle, error) {
+	arches := facts.Arches(c.Hosts())
+	if len(arches) == 0 {
+		arches = []string{string(common.ArchAmd64)}
+	}
+	return catalog.NewCatalog().ResolveArches(c.Spec.Kubernetes.Version, arches, nil)
+}
+
+// Hosts returns the inventory as connector hosts with their roles and merged
+// vars applied.
+func (c *Cluster) Hosts() []connector.Host {
+	hosts := make([]connector.Host, 0, len(c.Spec.Hosts))
+	for _, h := range c.Spec.Hosts {
+		bh := h.BaseHost
+		bh.SetVars(c.HostVars(h.Name))
+		bh.SetRoles(h.Roles)
+		hosts = append(hosts, &bh)
+	}
+	return hosts
+}
+
+// NodeMetadata returns the labels, annotations and taints declared for the host.
+func (h Host) NodeMetadata() nodemeta.Metadata {
+	return nodemeta.Metadata{Node: h.Name, Labels: h.Labels, Annotations: h.Annotations, Taints: h.Taints}
+}
+
+// hostMetadata returns the metadata of h with the labels and taints of its
+// profiles applied.
+func (c *Cluster) hostMetadata(h Host) nodemeta.Metadata {
+	m := h.NodeMetadata()
+	if len(h.Profiles) > 0 {
+		p := c.HostProfile(h.Name)
+		m.Labels, m.Taints = p.Labels, p.Taints
+	}
+	return m
+}
+
+// NodeMetadata returns the metadata of every host that declares any, directly
+// or through its profiles.
+func (c *Cluster) NodeMetadata() []nodemeta.Metadata {
+	var metas []nodemeta.Metadata
+	for _, h := range c.Spec.Hosts {
+		if m := c.hostMetadata(h); !m.Empty() {
+			metas = append(metas, m)
+		}
+	}
+	return metas
+}
+
+// host returns the inventory entry named name.
+func (c *Cluster) host(name string) (Host, bool) {
+	for _, h := range c.Spec.Hosts {
+		if h.Name == name {
+			return h, true
+		}
+	}
+	return Host{}, false
+}
+
+// HostsByRole returns the hosts carrying role.
+func (c *Cluster) HostsByRole(role string) []connector.Host {
+	var hosts []connector.Host
+	for _, h := range c.Hosts() {
+		if h.IsRole(role) {
+			hosts = append(hosts, h)
+		}
+	}
+	return hosts
+}
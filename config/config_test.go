@@ -0,0 +1,985 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mensylisir/xmcores/common"
+	"github.com/mensylisir/xmcores/errs"
+	"github.com/mensylisir/xmcores/facts"
+	"github.com/mensylisir/xmcores/logger"
+	"github.com/mensylisir/xmcores/modules"
+	"github.com/mensylisir/xmcores/modules/etchosts"
+	"github.com/mensylisir/xmcores/modules/existing"
+	"github.com/mensylisir/xmcores/modules/ingress"
+	"github.com/mensylisir/xmcores/modules/kubeadm"
+	"github.com/mensylisir/xmcores/modules/nodemeta"
+	"github.com/mensylisir/xmcores/modules/nodeprep"
+	"github.com/mensylisir/xmcores/modules/storage"
+	"github.com/mensylisir/xmcores/modules/sudoers"
+	"github.com/mensylisir/xmcores/modules/systune"
+	"github.com/mensylisir/xmcores/modules/trustca"
+	"github.com/mensylisir/xmcores/runhook"
+)
+
+const sampleConfig = `apiVersion: xmcores.io/v1alpha1
+kind: Cluster
+metadata:
+  name: demo
+spec:
+  hosts:
+    - name: master1
+      address: 192.168.0.10
+      user: root
+      password: secret
+      roles: [control-plane, etcd]
+    - name: worker1
+      address: 192.168.0.20
+      internalAddress: 10.0.0.20
+      port: 2222
+      user: root
+      privateKeyPath: ~/.ssh/id_ed25519
+      arch: arm64
+      roles: [worker]
+  kubernetes:
+    version: v1.30.2
+  timeSync:
+    servers: [ntp.example.com]
+    syncTimeout: 30s
+  sysTune:
+    sysctls:
+      vm.max_map_count: "262144"
+  storage:
+    backend: longhorn
+    defaultClass: true
+`
+
+func TestParse(t *testing.T) {
+	c, err := Parse([]byte(sampleConfig))
+	require.NoError(t, err)
+
+	assert.Equal(t, "demo", c.Metadata.Name)
+	require.Len(t, c.Spec.Hosts, 2)
+	assert.Equal(t, 22, c.Spec.Hosts[0].Port)
+	assert.Equal(t, "192.168.0.10", c.Spec.Hosts[0].InternalAddress)
+	assert.Equal(t, 2222, c.Spec.Hosts[1].Port)
+	assert.Equal(t, common.ArchArm64, c.Spec.Hosts[1].HostArch)
+
+	require.NotNil(t, c.Spec.TimeSync)
+	assert.Equal(t, 30*time.Second, c.Spec.TimeSync.SyncTimeout)
+	assert.Equal(t, "chrony", c.Spec.TimeSync.Provider)
+	assert.Equal(t, nodeprep.SwapDisable, c.Spec.NodePrepare.Swap)
+	assert.Equal(t, existing.PolicyAdopt, c.Spec.ExistingComponents.Policy)
+
+	require.NotNil(t, c.Spec.Storage)
+	assert.Equal(t, storage.BackendLonghorn, c.Spec.Storage.Backend)
+	assert.Equal(t, "v1.6.2", c.Spec.Storage.Version)
+
+	hosts := c.Hosts()
+	require.Len(t, hosts, 2)
+	assert.True(t, hosts[0].IsRole(common.RoleEtcd))
+	assert.Len(t, c.HostsByRole(common.RoleWorker), 1)
+	assert.Equal(t, "worker1", c.HostsByRole(common.RoleWorker)[0].GetName())
+}
+
+func TestParseErrors(t *testing.T) {
+	_, err := Parse([]byte("apiVersion: xmcores.io/v1alpha1\nkind: Cluster\nspec:\n  hostz: []\n"))
+	assert.ErrorContains(t, err, "hostz")
+	assert.Equal(t, errs.ExitConfig, errs.ExitCode(err))
+
+	_, err = Parse([]byte(`apiVersion: xmcores.io/v1alpha1
+kind: Cluster
+metadata:
+  name: demo
+spec:
+  hosts:
+    - {name: a, address: 10.0.0.1, user: root, password: x}
+    - {name: a, address: 10.0.0.2, user: root}
+  kubernetes: {version: v1.22.4}
+  storage: {backend: ceph}
+  existingComponents: {policy: keep}
+`))
+	require.Error(t, err)
+	assert.ErrorContains(t, err, `duplicate host name "a"`)
+	assert.ErrorContains(t, err, "authentication method")
+	assert.ErrorContains(t, err, "spec.storage: unsupported storage backend")
+	assert.ErrorContains(t, err, `spec.existingComponents: unsupported policy "keep"`)
+	assert.ErrorContains(t, err, "spec.kubernetes.version: unsupported version: kubernetes v1.22.4")
+	assert.Equal(t, errs.Config, errs.KindOf(err))
+}
+
+func TestResolveComponents(t *testing.T) {
+	c, err := Parse([]byte(sampleConfig))
+	require.NoError(t, err)
+	bundles, err := c.ResolveComponents()
+	require.NoError(t, err)
+	assert.Len(t, bundles, 1, "the architecture of master1 is not known yet")
+	assert.Equal(t, "v1.30.2", bundles["arm64"].KubernetesVersion)
+
+	_, err = Parse([]byte(strings.Replace(sampleConfig, "arch: arm64", "arch: arm", 1)))
+	assert.ErrorContains(t, err, `spec.kubernetes.version: unsupported architecture: "arm"`)
+}
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cluster.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(sampleConfig), 0600))
+	c, err := Load(path)
+	require.NoError(t, err)
+	assert.Equal(t, "v1.30.2", c.Spec.Kubernetes.Version)
+
+	_, err = Load(filepath.Join(t.TempDir(), "missing.yaml"))
+	assert.Error(t, err)
+}
+
+func TestKubeadmInitConfig(t *testing.T) {
+	c, err := Parse([]byte(sampleConfig + `  security:
+    audit: {}
+  kubeadmExtra:
+    clusterConfiguration:
+      controllerManager:
+        extraArgs:
+          node-cidr-mask-size: "25"
+`))
+	require.NoError(t, err)
+	out, err := c.KubeadmInitConfig(c.Hosts()[0])
+	require.NoError(t, err)
+	assert.Contains(t, string(out), "node-cidr-mask-size: \"25\"")
+	assert.Contains(t, string(out), "audit-policy-file: /etc/kubernetes/audit/policy.yaml")
+	assert.Contains(t, string(out), "clusterName: demo")
+	assert.Contains(t, string(out), "advertiseAddress: 192.168.0.10")
+
+	_, err = Parse([]byte(sampleConfig + "  kubeadmExtra:\n    initConfiguration:\n      kind: Foo\n"))
+	assert.ErrorContains(t, err, "spec.kubeadmExtra.initConfiguration must not set kind")
+}
+
+func TestEdgeProfile(t *testing.T) {
+	edge := strings.Replace(sampleConfig, "spec:\n", "spec:\n  profile: edge\n", 1)
+	c, err := Parse([]byte(edge + `  kubeadmExtra:
+    kubeletConfiguration:
+      maxPods: 60
+      kubeReserved: {memory: 128Mi}
+`))
+	require.NoError(t, err)
+	assert.Equal(t, NetworkFlannel, c.Spec.Network.Plugin)
+	out, err := c.KubeadmInitConfig(c.Hosts()[0])
+	require.NoError(t, err)
+	assert.Contains(t, string(out), "maxPods: 60", "explicit settings override the profile")
+	assert.Contains(t, string(out), "memory: 128Mi")
+	assert.Contains(t, string(out), "cpu: 50m", "the other reserved resources keep the profile's values")
+	assert.Contains(t, string(out), "memory.available: 64Mi")
+
+	c, err = Parse([]byte(strings.Replace(edge, "spec:\n", "spec:\n  network: {plugin: calico}\n", 1)))
+	require.NoError(t, err)
+	assert.Equal(t, NetworkCalico, c.Spec.Network.Plugin)
+
+	c, err = Parse([]byte(sampleConfig))
+	require.NoError(t, err)
+	out, err = c.KubeadmInitConfig(c.Hosts()[0])
+	require.NoError(t, err)
+	assert.NotContains(t, string(out), "kubeReserved")
+
+	_, err = Parse([]byte(strings.Replace(sampleConfig, "spec:\n", "spec:\n  profile: tiny\n", 1)))
+	assert.ErrorContains(t, err, `spec.profile: unsupported profile "tiny"`)
+}
+
+func TestK3s(t *testing.T) {
+	c, err := Parse([]byte(sampleConfig + "  k3s: {}\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "v1.30.2+k3s1", c.Spec.K3s.Version)
+
+	_, err = Parse([]byte(strings.Replace(sampleConfig, "roles: [worker]", "roles: [control-plane]", 1) + "  k3s: {datastore: sqlite}\n"))
+	assert.ErrorContains(t, err, "spec.k3s: the sqlite datastore supports a single server, not 2")
+}
+
+func TestTopology(t *testing.T) {
+	const topology = `apiVersion: xmcores.io/v1alpha1
+kind: Cluster
+metadata: {name: demo}
+spec:
+  connection: {user: root, password: x}
+  roleGroups:
+    etcd: [etcd1, etcd2, etcd3]
+    control-plane: [cp1]
+    worker: [worker1]
+  hosts:
+    - {name: etcd1, address: 10.0.1.1}
+    - {name: etcd2, address: 10.0.1.2}
+    - {name: etcd3, address: 10.0.1.3}
+    - {name: cp1, address: 10.0.0.1}
+    - {name: worker1, address: 10.0.2.1}
+  kubernetes: {version: v1.30.2}
+`
+	c, err := Parse([]byte(topology))
+	require.NoError(t, err)
+	assert.Equal(t, TopologyExternalEtcd, c.Topology())
+	assert.Len(t, c.HostsByRole(common.RoleEtcd), 3)
+	assert.Equal(t, []string{"https://10.0.1.1:2379", "https://10.0.1.2:2379", "https://10.0.1.3:2379"}, c.EtcdEndpoints())
+
+	hosts := c.Hosts()
+	out, err := c.KubeadmInitConfig(hosts[3])
+	require.NoError(t, err)
+	assert.Contains(t, string(out), "external:")
+	assert.Contains(t, string(out), "- https://10.0.1.2:2379")
+	out, err = c.KubeadmEtcdConfig(hosts[1])
+	require.NoError(t, err)
+	assert.Contains(t, string(out), "initial-cluster: etcd1=https://10.0.1.1:2380,etcd2=https://10.0.1.2:2380,etcd3=https://10.0.1.3:2380")
+	assert.Contains(t, string(out), "listen-client-urls: https://10.0.1.2:2379")
+
+	c, err = Parse([]byte(sampleConfig))
+	require.NoError(t, err)
+	assert.Equal(t, TopologyStacked, c.Topology())
+	assert.Nil(t, c.EtcdEndpoints())
+
+	_, err = Parse([]byte(strings.NewReplacer(
+		"etcd: [etcd1, etcd2, etcd3]", "etcd: [etcd1, etcd2, worker1, cp1, ghost]\n    storage: [etcd3]",
+		"address: 10.0.1.2", "address: 10.0.1.1",
+	).Replace(topology)))
+	require.Error(t, err)
+	for _, want := range []string{
+		`spec.roleGroups: unknown role "storage"`,
+		`spec.roleGroups.etcd: unknown host "ghost"`,
+		"etcd hosts etcd1 and etcd2 share the address 10.0.1.1",
+		"etcd must run either on control-plane hosts or on dedicated hosts, not both",
+		"dedicated etcd needs an odd number of hosts to keep quorum, got 4",
+		"host worker1: dedicated etcd hosts must not be workers",
+	} {
+		assert.ErrorContains(t, err, want)
+	}
+	_, err = Parse([]byte(strings.Replace(topology, "address: 10.0.0.1", "address: 10.0.1.3", 1)))
+	assert.ErrorContains(t, err, "control-plane host cp1 shares the address 10.0.1.3 with etcd host etcd3")
+}
+
+func TestNodeMetadata(t *testing.T) {
+	c, err := Parse([]byte(`apiVersion: xmcores.io/v1alpha1
+kind: Cluster
+metadata:
+  name: demo
+spec:
+  hosts:
+    - name: master1
+      address: 10.0.0.1
+      user: root
+      password: x
+      roles: [control-plane]
+    - name: gpu1
+      address: 10.0.0.2
+      user: root
+      password: x
+      roles: [worker]
+      labels: {node.example.com/gpu: "true"}
+      annotations: {example.com/rack: r12}
+      taints:
+        - {key: dedicated, value: gpu, effect: NoSchedule}
+  kubernetes: {version: v1.30.2}
+`))
+	require.NoError(t, err)
+	metas := c.NodeMetadata()
+	require.Len(t, metas, 1)
+	assert.Equal(t, "gpu1", metas[0].Node)
+	assert.Equal(t, "r12", metas[0].Annotations["example.com/rack"])
+
+	out, err := c.KubeadmJoinConfig(c.Hosts()[1], kubeadm.JoinParams{APIServerEndpoint: "10.0.0.1:6443", Token: "abcdef.0123456789abcdef"})
+	require.NoError(t, err)
+	assert.Contains(t, string(out), "key: dedicated")
+
+	_, err = Parse([]byte(strings.Replace(sampleConfig, "roles: [worker]", "roles: [worker]\n      taints: [{key: a, effect: Always}]", 1)))
+	assert.ErrorContains(t, err, `host worker1: taint a: unsupported effect "Always"`)
+}
+
+func TestProfiles(t *testing.T) {
+	c, err := Parse([]byte(`apiVersion: xmcores.io/v1alpha1
+kind: Cluster
+metadata:
+  name: demo
+spec:
+  hosts:
+    - name: master1
+      address: 10.0.0.1
+      user: root
+      password: x
+      roles: [control-plane]
+    - name: gpu1
+      address: 10.0.0.2
+      user: root
+      password: x
+      roles: [worker]
+      profiles: [edge-node, gpu-worker]
+      labels: {example.com/zone: b}
+  kubernetes: {version: v1.30.2}
+  sysTune:
+    sysctls: {vm.swappiness: "0", fs.file-max: "1000000"}
+  profiles:
+    - name: gpu-worker
+      packages: [nvidia-container-toolkit]
+      kernelModules: [nvidia]
+      sysctls: {vm.max_map_count: "262144"}
+      labels: {node.example.com/gpu: "true"}
+      taints:
+        - {key: dedicated, value: gpu, effect: NoSchedule}
+      kubeletArgs: {max-pods: "64"}
+    - name: edge-node
+      packages: [wireguard-tools, nvidia-container-toolkit]
+      sysctls: {vm.swappiness: "10"}
+      labels: {example.com/zone: a, node.example.com/edge: "true"}
+      taints:
+        - {key: dedicated, value: edge, effect: NoSchedule}
+      kubeletArgs: {max-pods: "32", node-status-update-frequency: 20s}
+`))
+	require.NoError(t, err)
+
+	p := c.HostProfile("gpu1")
+	assert.Equal(t, map[string]string{"node.example.com/gpu": "true", "node.example.com/edge": "true", "example.com/zone": "b"}, p.Labels)
+	assert.Equal(t, []nodemeta.Taint{{Key: "dedicated", Value: "gpu", Effect: "NoSchedule"}}, p.Taints, "the later profile replaces the taint")
+	assert.Equal(t, map[string]string{"max-pods": "64", "node-status-update-frequency": "20s"}, p.KubeletArgs)
+	assert.Equal(t, []string{"nvidia-container-toolkit", "wireguard-tools"}, c.Packages("gpu1"))
+	assert.Empty(t, c.Packages("master1"))
+	assert.Equal(t, systune.Config{
+		KernelModules: []string{"nvidia"},
+		Sysctls:       map[string]string{"vm.swappiness": "10", "fs.file-max": "1000000", "vm.max_map_count": "262144"},
+	}, c.SysTune("gpu1"))
+	assert.Equal(t, c.Spec.SysTune.Sysctls, c.SysTune("master1").Sysctls)
+
+	metas := c.NodeMetadata()
+	require.Len(t, metas, 1)
+	assert.Equal(t, "true", metas[0].Labels["node.example.com/gpu"])
+	out, err := c.KubeadmJoinConfig(c.Hosts()[1], kubeadm.JoinParams{APIServerEndpoint: "10.0.0.1:6443", Token: "abcdef.0123456789abcdef"})
+	require.NoError(t, err)
+	assert.Contains(t, string(out), "value: gpu")
+	assert.Contains(t, string(out), "max-pods: \"64\"")
+
+	_, err = Parse([]byte(strings.Replace(sampleConfig, "roles: [worker]", "roles: [worker]\n      profiles: [missing]", 1)))
+	assert.ErrorContains(t, err, `host worker1: unknown profile "missing"`)
+}
+
+func TestGenerate(t *testing.T) {
+	data, err := Generate(GenerateOptions{
+		Name:           "demo",
+		ControlPlanes:  []string{"10.0.0.1"},
+		Workers:        []string{"10.0.0.1", "10.0.0.2"},
+		Port:           2222,
+		PrivateKeyPath: "~/.ssh/id_ed25519",
+		NetworkPlugin:  NetworkFlannel,
+	})
+	require.NoError(t, err)
+	c, err := Parse(data)
+	require.NoError(t, err)
+	require.Len(t, c.Spec.Hosts, 2)
+	assert.Equal(t, "master1", c.Spec.Hosts[0].Name)
+	assert.Equal(t, []string{common.RoleControlPlane, common.RoleEtcd, common.RoleWorker}, c.Spec.Hosts[0].Roles)
+	assert.Equal(t, "worker1", c.Spec.Hosts[1].Name)
+	assert.Equal(t, 2222, c.Spec.Hosts[1].Port)
+	assert.Equal(t, "root", c.Spec.Hosts[1].User)
+	assert.Equal(t, DefaultKubernetesVersion, c.Spec.Kubernetes.Version)
+	assert.Equal(t, NetworkFlannel, c.Spec.Network.Plugin)
+
+	_, err = Generate(GenerateOptions{ControlPlanes: []string{"10.0.0.1"}, Password: "x", KubernetesVersion: "v1.12.0"})
+	assert.ErrorContains(t, err, "kubernetes version v1.12.0")
+	_, err = Generate(GenerateOptions{ControlPlanes: []string{"master"}, Password: "x"})
+	assert.ErrorContains(t, err, `invalid node address "master"`)
+	_, err = Generate(GenerateOptions{ControlPlanes: []string{"10.0.0.1"}})
+	assert.ErrorContains(t, err, "authentication method")
+}
+
+func TestRuntime(t *testing.T) {
+	c, err := Parse([]byte(`apiVersion: xmcores.io/v1alpha1
+kind: Cluster
+metadata: {name: demo}
+spec:
+  runtime: {backend: local-docker}
+  hosts:
+    - {name: master1, address: 172.30.0.10, roles: [control-plane, etcd]}
+  kubernetes: {version: v1.31.2}
+`))
+	require.NoError(t, err)
+	assert.Equal(t, "root", c.Spec.Hosts[0].User)
+	assert.Equal(t, "xmcores", c.Spec.Runtime.LocalDocker.Network)
+
+	_, err = Parse([]byte(strings.Replace(sampleConfig, "  kubernetes:\n", "  runtime: {backend: local-docker}\n  kubernetes:\n", 1)))
+	assert.ErrorContains(t, err, "spec.runtime.localDocker: address 192.168.0.10 is not in subnet")
+	_, err = Parse([]byte(strings.Replace(sampleConfig, "  kubernetes:\n", "  runtime: {backend: vagrant}\n  kubernetes:\n", 1)))
+	assert.ErrorContains(t, err, `unsupported backend "vagrant"`)
+
+	c, err = Parse([]byte(sampleConfig))
+	require.NoError(t, err)
+	assert.Equal(t, RuntimeSSH, c.Spec.Runtime.Backend)
+}
+
+func TestResolveAddresses(t *testing.T) {
+	dir := t.TempDir()
+	state := filepath.Join(dir, "terraform.tfstate")
+	require.NoError(t, os.WriteFile(state, []byte(`{"version": 4, "resources": [
+  {"mode": "managed", "type": "aws_instance", "name": "n", "instances": [
+    {"attributes": {"tags": {"Name": "master1"}, "public_ip": "54.1.1.1", "private_ip": "10.0.0.1"}}]}]}`), 0600))
+	c, err := Parse([]byte(`apiVersion: xmcores.io/v1alpha1
+kind: Cluster
+metadata: {name: demo}
+spec:
+  inventory:
+    provider: terraform
+    terraform: {stateFile: ` + state + `}
+  hosts:
+    - {name: master1, user: root, password: x, roles: [control-plane, etcd]}
+    - {name: worker1, address: 10.0.0.2, user: root, password: x, roles: [worker]}
+  kubernetes: {version: v1.31.2}
+`))
+	require.NoError(t, err)
+	require.NoError(t, c.ResolveAddresses(context.Background()))
+	assert.Equal(t, "54.1.1.1", c.Spec.Hosts[0].Address)
+	assert.Equal(t, "10.0.0.1", c.Spec.Hosts[0].InternalAddress)
+	assert.Equal(t, "10.0.0.2", c.Spec.Hosts[1].Address)
+
+	c.Spec.Hosts[0].Address = ""
+	c.Spec.Hosts[0].Name = "master2"
+	err = c.ResolveAddresses(context.Background())
+	assert.ErrorContains(t, err, "terraform inventory has no machine named master2")
+	assert.Equal(t, errs.Config, errs.KindOf(err))
+}
+
+func TestHostVars(t *testing.T) {
+	c, err := Parse([]byte(sampleConfig + `  vars:
+    dataDir: /var/lib
+    nic: eth0
+  groups:
+    - name: arm
+      hosts: [worker1]
+      vars: {dataDir: /data, nic: enp1s0}
+  kubeadmExtra:
+    joinConfiguration:
+      nodeRegistration:
+        kubeletExtraArgs:
+          root-dir: "{{ .Vars.dataDir }}/kubelet"
+          node-labels: "xmcores.io/nic={{ .Vars.nic }},xmcores.io/host={{ .Host.Name }}"
+`))
+	require.NoError(t, err)
+	c.Spec.Hosts[1].Vars = map[string]interface{}{"nic": "bond0"}
+
+	assert.Equal(t, map[string]interface{}{"dataDir": "/var/lib", "nic": "eth0"}, c.HostVars("master1"))
+	assert.Equal(t, map[string]interface{}{"dataDir": "/data", "nic": "bond0"}, c.HostVars("worker1"))
+	worker := c.Hosts()[1]
+	nic, ok := worker.GetVar("nic")
+	assert.True(t, ok)
+	assert.Equal(t, "bond0", nic)
+
+	out, err := c.KubeadmJoinConfig(worker, kubeadm.JoinParams{APIServerEndpoint: "10.0.0.1:6443", Token: "abcdef.0123456789abcdef"})
+	require.NoError(t, err)
+	assert.Contains(t, string(out), "root-dir: /data/kubelet")
+	assert.Contains(t, string(out), "node-labels: xmcores.io/nic=bond0,xmcores.io/host=worker1")
+
+	_, err = Parse([]byte(sampleConfig + `  groups:
+    - {name: gpu, hosts: [worker9]}
+  kubeadmExtra:
+    kubeletConfiguration:
+      rootDir: "{{ .Vars.missing }}"
+`))
+	assert.ErrorContains(t, err, `spec.groups.gpu: unknown host "worker9"`)
+	assert.ErrorContains(t, err, "spec.kubeadmExtra.kubeletConfiguration: rootDir")
+}
+
+func TestDecrypt(t *testing.T) {
+	ctx := context.Background()
+	assert.Equal(t, EncryptionNone, DetectEncryption([]byte(sampleConfig)))
+	assert.Equal(t, EncryptionAge, DetectEncryption([]byte("age-encryption.org/v1\n-> X25519 abc\n")))
+	assert.Equal(t, EncryptionAge, DetectEncryption([]byte("\n-----BEGIN AGE ENCRYPTED FILE-----\nYWdl\n-----END AGE ENCRYPTED FILE-----\n")))
+	sopsConfig := "apiVersion: ENC[AES256_GCM,data:x,type:str]\nsops:\n  mac: ENC[AES256_GCM,data:y,type:str]\n  version: 3.8.1\n"
+	assert.Equal(t, EncryptionSOPS, DetectEncryption([]byte(sopsConfig)))
+
+	plain, err := Decrypt(ctx, []byte(sampleConfig))
+	require.NoError(t, err)
+	assert.Equal(t, sampleConfig, string(plain))
+
+	// A stand-in for sops checks the arguments and prints the sample config.
+	bin := t.TempDir()
+	t.Setenv("PATH", bin)
+	_, err = Decrypt(ctx, []byte(sopsConfig))
+	assert.ErrorContains(t, err, "sops is not installed")
+
+	config := filepath.Join(t.TempDir(), "plain.yaml")
+	require.NoError(t, os.WriteFile(config, []byte(sampleConfig), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(bin, "sops"), []byte(`#!/bin/sh
+[ "$*" = "--decrypt --input-type yaml --output-type yaml /dev/stdin" ] || exit 2
+exec /bin/cat `+config+"\n"), 0755))
+	plain, err = Decrypt(ctx, []byte(sopsConfig))
+	require.NoError(t, err)
+	assert.Equal(t, sampleConfig, string(plain))
+}
+
+// encryptAge encrypts sampleConfig to recipient, armored or not.
+func encryptAge(t *testing.T, recipient age.Recipient, armored bool) []byte {
+	var buf bytes.Buffer
+	var dst io.WriteCloser = nopCloser{&buf}
+	if armored {
+		dst = armor.NewWriter(&buf)
+	}
+	w, err := age.Encrypt(dst, recipient)
+	require.NoError(t, err)
+	_, err = io.WriteString(w, sampleConfig)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	require.NoError(t, dst.Close())
+	return buf.Bytes()
+}
+
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
+
+func TestDecryptAge(t *testing.T) {
+	// No age binary is needed.
+	t.Setenv("PATH", t.TempDir())
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	encrypted := filepath.Join(t.TempDir(), "cluster.yaml.age")
+	require.NoError(t, os.WriteFile(encrypted, encryptAge(t, identity.Recipient(), false), 0600))
+	other, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	t.Setenv(EnvAgeKey, other.String())
+	_, err = Load(encrypted)
+	assert.ErrorContains(t, err, "no identity matched any of the recipients")
+	assert.Equal(t, errs.Config, errs.KindOf(err))
+	t.Setenv(EnvAgeKey, "# created: 2024-01-31\n"+identity.String()+"\n")
+	c, err := Load(encrypted)
+	require.NoError(t, err)
+	assert.Equal(t, "demo", c.Metadata.Name)
+
+	keys := filepath.Join(t.TempDir(), "keys.txt")
+	require.NoError(t, os.WriteFile(keys, []byte(identity.String()+"\n"), 0600))
+	t.Setenv(EnvAgeKey, "")
+	t.Setenv(EnvAgeKeyFile, keys)
+	plain, err := Decrypt(context.Background(), append([]byte("\n"), encryptAge(t, identity.Recipient(), true)...))
+	require.NoError(t, err)
+	assert.Equal(t, sampleConfig, string(plain), "armored files are read from the key file's identities")
+}
+
+func TestConnection(t *testing.T) {
+	c, err := Parse([]byte(`apiVersion: xmcores.io/v1alpha1
+kind: Cluster
+metadata:
+  name: demo
+spec:
+  connection:
+    user: ops
+    privateKeyPath: /home/ops/.ssh/id_ed25519
+    timeout: 10s
+  groups:
+    - name: dmz
+      hosts: [edge1]
+      connection:
+        port: 2222
+        bastion: {address: jump.example.com, user: jump}
+        sudoFileOps: true
+        shell: /bin/sh
+        umask: "0022"
+  hosts:
+    - name: master1
+      address: 10.0.0.1
+      roles: [control-plane]
+    - name: edge1
+      address: 172.16.0.5
+      password: secret
+      roles: [worker]
+      connection:
+        agentSocket: env:SSH_AUTH_SOCK
+        fileTransfer: exec
+    - name: legacy1
+      address: 10.0.0.3
+      user: root
+      port: 2200
+      connection:
+        agentSocket: /run/agent.sock
+  kubernetes: {version: v1.30.2}
+`))
+	require.NoError(t, err)
+
+	hosts := c.Hosts()
+	master := c.ConnectionConfig(hosts[0])
+	assert.Equal(t, "ops", master.Username)
+	assert.Equal(t, 22, master.Port)
+	assert.Equal(t, "/home/ops/.ssh/id_ed25519", master.KeyFile)
+	assert.Equal(t, 10*time.Second, master.Timeout)
+	assert.Empty(t, master.Bastion)
+	assert.False(t, master.UseSudoForFileOps)
+	assert.Empty(t, master.Shell, "the shell is detected on the host")
+
+	edge := c.ConnectionConfig(hosts[1])
+	assert.Equal(t, 2222, edge.Port)
+	assert.Equal(t, "secret", edge.Password)
+	assert.Equal(t, "jump.example.com", edge.Bastion)
+	assert.Equal(t, "jump", edge.BastionUser)
+	assert.True(t, edge.UseSudoForFileOps)
+	assert.Equal(t, "env:SSH_AUTH_SOCK", edge.AgentSocket)
+	assert.Equal(t, "exec", edge.FileTransfer)
+	assert.Equal(t, "/bin/sh", edge.Shell)
+	assert.Equal(t, "0022", edge.Umask)
+	assert.Equal(t, 2222, hosts[1].GetPort(), "inherited settings are visible through the host")
+
+	legacy := c.ConnectionConfig(hosts[2])
+	assert.Equal(t, "root", legacy.Username, "the host's own fields override spec.connection")
+	assert.Equal(t, 2200, legacy.Port)
+	assert.Equal(t, "/run/agent.sock", legacy.AgentSocket)
+
+	_, err = Parse([]byte(strings.Replace(sampleConfig, "roles: [worker]", "roles: [worker]\n      connection: {fileTransfer: scp, bastion: {port: 22}, sudoPrompt: \"([\", shell: sh, umask: \"999\"}", 1)))
+	assert.ErrorContains(t, err, `host worker1: unsupported file transfer "scp"`)
+	assert.ErrorContains(t, err, "host worker1: bastion address must be set")
+	assert.ErrorContains(t, err, "host worker1: invalid sudo prompt")
+	assert.ErrorContains(t, err, `host worker1: 无效的 shell "sh"`)
+	assert.ErrorContains(t, err, `host worker1: 无效的 umask "999"`)
+}
+
+func TestResolution(t *testing.T) {
+	const hosts = `apiVersion: xmcores.io/v1alpha1
+kind: Cluster
+metadata: {name: demo}
+spec:
+  hosts:
+    - {name: master1, address: master1.lab, user: root, password: x, roles: [control-plane, etcd]}
+    - {name: worker1, address: 10.0.0.2, internalAddress: worker1.lab, user: root, password: x, roles: [worker]}
+  kubernetes: {version: v1.31.2, controlPlaneEndpoint: "api.lab:6443"}
+`
+	defer func(orig func(context.Context, string) ([]string, error)) { lookupHost = orig }(lookupHost)
+	lookupHost = func(_ context.Context, name string) ([]string, error) {
+		switch name {
+		case "master1.lab":
+			return []string{"fd00::1", "10.0.0.1"}, nil
+		case "worker1.lab":
+			return []string{"10.0.0.2"}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+
+	c, err := Parse([]byte(hosts))
+	require.NoError(t, err)
+	require.NoError(t, c.ResolveAddresses(context.Background()))
+	assert.Equal(t, "master1.lab", c.Spec.Hosts[0].Address, "the controller resolves SSH addresses itself")
+	assert.Equal(t, "10.0.0.1", c.Spec.Hosts[0].InternalAddress, "IPv4 is preferred")
+	assert.Equal(t, "10.0.0.2", c.Spec.Hosts[1].InternalAddress)
+	assert.Nil(t, c.HostsEntries())
+
+	_, err = Parse([]byte(hosts + "  resolution: {strategy: static}\n"))
+	assert.ErrorContains(t, err, "host master1: master1.lab is not in spec.resolution.addresses")
+	_, err = Parse([]byte(hosts + "  resolution: {strategy: mdns}\n"))
+	assert.ErrorContains(t, err, `unsupported strategy "mdns"`)
+	_, err = Parse([]byte(hosts + "  resolution: {addresses: {registry.lab: registry}}\n"))
+	assert.ErrorContains(t, err, `registry.lab: "registry" is not an IP address`)
+
+	c, err = Parse([]byte(hosts + `  resolution:
+    strategy: hosts
+    addresses:
+      master1.lab: 192.168.0.1
+      worker1.lab: 192.168.0.2
+      registry.lab: 192.168.0.100
+`))
+	require.NoError(t, err)
+	require.NoError(t, c.ResolveAddresses(context.Background()))
+	assert.Equal(t, "192.168.0.1", c.Spec.Hosts[0].Address)
+	assert.Equal(t, "192.168.0.1", c.Spec.Hosts[0].InternalAddress)
+	assert.Equal(t, "10.0.0.2", c.Spec.Hosts[1].Address)
+	assert.Equal(t, "192.168.0.2", c.Spec.Hosts[1].InternalAddress)
+	assert.Equal(t, []etchosts.Entry{
+		{Address: "192.168.0.1", Names: []string{"api.lab", "master1", "master1.lab"}},
+		{Address: "192.168.0.100", Names: []string{"registry.lab"}},
+		{Address: "192.168.0.2", Names: []string{"worker1", "worker1.lab"}},
+	}, c.HostsEntries())
+}
+
+func TestProxy(t *testing.T) {
+	const cluster = `apiVersion: xmcores.io/v1alpha1
+kind: Cluster
+metadata: {name: demo}
+spec:
+  hosts:
+    - {name: master1, address: 192.168.0.1, internalAddress: "10.0.0.1,fd00::1", user: root, password: x, roles: [control-plane, etcd]}
+    - {name: worker1, address: 10.0.0.2, user: root, password: x, roles: [worker]}
+  kubernetes: {version: v1.31.2, controlPlaneEndpoint: "api.lab:6443", podSubnet: "10.244.0.0/16"}
+`
+	c, err := Parse([]byte(cluster))
+	require.NoError(t, err)
+	_, ok := c.Proxy()
+	assert.False(t, ok)
+
+	_, err = Parse([]byte(cluster + "  proxy: {httpProxy: \"proxy:3128\"}\n"))
+	assert.ErrorContains(t, err, "spec.proxy: httpProxy")
+
+	c, err = Parse([]byte(cluster + `  proxy:
+    httpProxy: http://proxy.lab:3128
+    noProxy: [.corp.example.com]
+  resolution:
+    addresses: {registry.lab: 10.0.0.100}
+`))
+	require.NoError(t, err)
+	p, ok := c.Proxy()
+	require.True(t, ok)
+	assert.Equal(t, "http://proxy.lab:3128", p.HTTPProxy)
+	assert.Equal(t, []string{
+		"localhost", "127.0.0.1", "::1", ".corp.example.com",
+		"master1", "192.168.0.1", "10.0.0.1", "fd00::1", "worker1", "10.0.0.2",
+		"10.244.0.0/16", "10.233.0.0/18", ".svc", ".cluster.local", "api.lab", "registry.lab",
+	}, p.NoProxy)
+}
+
+func TestLogging(t *testing.T) {
+	c, err := Parse([]byte(sampleConfig + `  logging:
+    sinks:
+      - {type: file, path: /var/log/xm/demo.log, level: debug, format: json, rotation: {maxAge: 72h, maxSize: 100}}
+      - {type: syslog, address: "udp://logs.lab:514", facility: local3}
+    rotation: {maxBackups: 5, compress: true}
+`))
+	require.NoError(t, err)
+	require.Len(t, c.Spec.Logging.Sinks, 2)
+	assert.Equal(t, logger.Rotation{MaxAge: 72 * time.Hour, MaxSize: 100}, c.Spec.Logging.Sinks[0].Rotation)
+	assert.Equal(t, "local3", c.Spec.Logging.Sinks[1].Facility)
+	assert.Equal(t, &logger.Rotation{MaxBackups: 5, Compress: true}, c.Spec.Logging.Rotation)
+
+	_, err = Parse([]byte(sampleConfig + "  logging:\n    sinks:\n      - {type: network, address: logs.lab:514}\n"))
+	assert.ErrorContains(t, err, "spec.logging.sinks[0]: network log sink")
+	_, err = Parse([]byte(sampleConfig + "  logging:\n    rotation: {every: 1s}\n"))
+	assert.ErrorContains(t, err, "spec.logging.rotation: every must be at least a minute")
+}
+
+func TestTrustedCAs(t *testing.T) {
+	cert, _, err := ingress.GenerateSelfSigned([]string{"ca.lab"}, time.Hour)
+	require.NoError(t, err)
+	caFile := filepath.Join(t.TempDir(), "ca.crt")
+	require.NoError(t, os.WriteFile(caFile, cert, 0o644))
+
+	c, err := Parse([]byte(sampleConfig + `  trustedCAs:
+    - {name: corp-root, file: ` + caFile + `}
+  registry: {address: "registry.lab:5000", caFile: ` + caFile + `}
+`))
+	require.NoError(t, err)
+	assert.Equal(t, []trustca.CA{
+		{Name: "corp-root", File: caFile},
+		{Name: RegistryCAName, File: caFile, Registries: []string{"registry.lab:5000"}},
+	}, c.TrustedCAs())
+
+	_, err = Parse([]byte(sampleConfig + "  trustedCAs:\n    - {name: a, file: " + caFile + "}\n    - {name: a, file: /nonexistent}\n"))
+	assert.ErrorContains(t, err, `spec.trustedCAs[1]: duplicate name "a"`)
+	assert.ErrorContains(t, err, "spec.trustedCAs[1]: open /nonexistent")
+}
+
+func TestExtraArgs(t *testing.T) {
+	global := strings.Replace(sampleConfig, "    version: v1.30.2\n", `    version: v1.30.2
+    kubeletExtraArgs: {max-pods: "110", serialize-image-pulls: "false"}
+    apiServerExtraArgs: {v: "2", audit-log-maxage: "7"}
+`, 1)
+	c, err := Parse([]byte(global + `  groups:
+    - name: big
+      hosts: [master1, worker1]
+      kubeletExtraArgs: {max-pods: "250"}
+    - name: masters
+      hosts: [master1]
+      apiServerExtraArgs: {v: "4"}
+`))
+	require.NoError(t, err)
+	master, worker := c.Hosts()[0], c.Hosts()[1]
+	assert.Equal(t, kubeadm.ExtraArgs{
+		Kubelet:   map[string]string{"max-pods": "250", "serialize-image-pulls": "false"},
+		APIServer: map[string]string{"v": "4", "audit-log-maxage": "7"},
+	}, c.ExtraArgs(master.GetName()))
+
+	out, err := c.KubeadmInitConfig(master)
+	require.NoError(t, err)
+	assert.Contains(t, string(out), "max-pods: \"250\"")
+	assert.Contains(t, string(out), "directory: "+kubeadm.PatchesDir)
+	patches, err := c.KubeadmPatches(master)
+	require.NoError(t, err)
+	assert.Contains(t, string(patches["kube-apiserver+json.yaml"]), "--v=4")
+
+	patches, err = c.KubeadmPatches(worker)
+	require.NoError(t, err)
+	assert.Empty(t, patches, "workers run no control-plane component")
+	out, err = c.KubeadmJoinConfig(worker, kubeadm.JoinParams{APIServerEndpoint: "lb:6443", Token: "t"})
+	require.NoError(t, err)
+	assert.NotContains(t, string(out), "patches")
+
+	_, err = Parse([]byte(sampleConfig + "  groups:\n    - {name: g, hosts: [worker1], schedulerExtraArgs: {--v: \"2\"}}\n"))
+	assert.ErrorContains(t, err, "spec.groups.g: schedulerExtraArgs: invalid flag name")
+	_, err = Parse([]byte(strings.Replace(sampleConfig, "    version: v1.30.2\n", "    version: v1.30.2\n    kubeletExtraArgs: {\"\": x}\n", 1)))
+	assert.ErrorContains(t, err, "spec.kubernetes: kubeletExtraArgs")
+}
+
+func TestKubeletServingCSRs(t *testing.T) {
+	c, err := Parse([]byte(sampleConfig))
+	require.NoError(t, err)
+	assert.False(t, c.KubeletServingCSRs(c.Hosts()[0]))
+
+	c, err = Parse([]byte(sampleConfig + "  groups:\n    - {name: g, hosts: [worker1], kubeletExtraArgs: {rotate-server-certificates: \"true\"}}\n"))
+	require.NoError(t, err)
+	master, worker := c.Hosts()[0], c.Hosts()[1]
+	assert.False(t, c.KubeletServingCSRs(master))
+	assert.True(t, c.KubeletServingCSRs(worker))
+
+	c, err = Parse([]byte(sampleConfig + "  kubeadmExtra:\n    kubeletConfiguration: {serverTLSBootstrap: true}\n"))
+	require.NoError(t, err)
+	assert.True(t, c.KubeletServingCSRs(c.Hosts()[0]))
+}
+
+func TestKubeletCgroupDriver(t *testing.T) {
+	c, err := Parse([]byte(sampleConfig))
+	require.NoError(t, err)
+	assert.Equal(t, kubeadm.DefaultCgroupDriver, c.KubeletCgroupDriver(c.Hosts()[0]))
+
+	c, err = Parse([]byte(sampleConfig + "  kubeadmExtra:\n    kubeletConfiguration: {cgroupDriver: cgroupfs}\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "cgroupfs", c.KubeletCgroupDriver(c.Hosts()[1]))
+}
+
+func TestMultiHomedHosts(t *testing.T) {
+	multi := strings.Replace(sampleConfig, "      internalAddress: 10.0.0.20\n", "      internalAddress: 10.0.0.20\n      interface: eth1\n", 1)
+	multi = strings.Replace(multi, "      roles: [control-plane, etcd]\n", "      roles: [control-plane, etcd]\n      externalAddress: 203.0.113.10\n", 1)
+	c, err := Parse([]byte(multi + "  network:\n    nodeSubnets: [10.0.0.0/16, 192.168.0.0/24]\n"))
+	require.NoError(t, err)
+	master, worker := c.Hosts()[0], c.Hosts()[1]
+
+	assert.Equal(t, "10.0.0.20", c.NodeIP(worker.GetName()))
+	assert.Equal(t, "192.168.0.10", c.NodeIP(master.GetName()), "an external address makes the host multi-homed")
+	out, err := c.KubeadmJoinConfig(worker, kubeadm.JoinParams{APIServerEndpoint: "lb:6443", Token: "t"})
+	require.NoError(t, err)
+	assert.Contains(t, string(out), "node-ip: 10.0.0.20")
+	out, err = c.KubeadmInitConfig(master)
+	require.NoError(t, err)
+	assert.Contains(t, string(out), "203.0.113.10", "the external address is in the apiserver certificate")
+
+	assert.Equal(t, "interface=^(eth1)$", c.CalicoIPAutodetection())
+	assert.Equal(t, []string{"--iface=eth1"}, c.FlannelArgs())
+
+	nn := c.NodeNetwork(worker.GetName())
+	assert.NoError(t, nn.CheckAddresses(facts.ParseAddresses("3: eth1    inet 10.0.0.20/16 scope global eth1\n")))
+	assert.ErrorContains(t, nn.CheckAddresses(facts.ParseAddresses("3: eth1    inet 10.0.0.21/16 scope global eth1\n")),
+		"internal address 10.0.0.20 is not assigned to any interface")
+
+	c, err = Parse([]byte(sampleConfig))
+	require.NoError(t, err)
+	assert.Equal(t, "", c.NodeIP(c.Hosts()[0].GetName()), "a host with a single address is left to the kubelet")
+	assert.Equal(t, "kubernetes-internal-ip", c.CalicoIPAutodetection())
+	assert.Empty(t, c.FlannelArgs())
+
+	_, err = Parse([]byte(sampleConfig + "  network:\n    nodeSubnets: [10.0.0.0/16]\n"))
+	assert.ErrorContains(t, err, "host master1: internal address 192.168.0.10 is outside spec.network.nodeSubnets")
+	_, err = Parse([]byte(sampleConfig + "  network:\n    nodeSubnets: [10.233.0.0/16, 192.168.0.0/24]\n"))
+	assert.ErrorContains(t, err, "spec.network.nodeSubnets: 10.233.0.0/16 overlaps the pod subnet 10.233.64.0/18")
+	_, err = Parse([]byte(strings.Replace(sampleConfig, "internalAddress: 10.0.0.20", "internalAddress: 10.233.64.5", 1)))
+	assert.ErrorContains(t, err, "host worker1: internal address 10.233.64.5 lies in the pod subnet 10.233.64.0/18")
+	_, err = Parse([]byte(strings.Replace(sampleConfig, "      internalAddress: 10.0.0.20\n", "      internalAddress: 10.0.0.20\n      interface: \"eth 1\"\n", 1)))
+	assert.ErrorContains(t, err, `host worker1: invalid interface name "eth 1"`)
+}
+
+func TestMigrate(t *testing.T) {
+	const old = `apiVersion: xmcores.io/v1alpha1
+kind: Cluster
+metadata: {name: demo}
+spec:
+  hosts:
+    - {name: master1, address: 10.0.0.1, user: root, password: x, roles: [control-plane, etcd, worker], profiles: [gpu]}
+  kubernetes: {version: v1.30.2}
+  profiles:
+    # GPU workers run fewer, larger pods.
+    - name: gpu
+      kubeletArgs: {max-pods: "64"}
+`
+	out, from, err := Migrate([]byte(old))
+	require.NoError(t, err)
+	assert.Equal(t, APIVersionV1alpha1, from)
+	assert.Contains(t, string(out), "apiVersion: "+APIVersion)
+	assert.Contains(t, string(out), "# GPU workers run fewer, larger pods.", "comments are kept")
+	assert.Contains(t, string(out), `kubeletExtraArgs: {max-pods: "64"}`)
+	assert.NotContains(t, string(out), "kubeletArgs")
+
+	again, from, err := Migrate(out)
+	require.NoError(t, err)
+	assert.Equal(t, APIVersion, from)
+	assert.Equal(t, out, again, "a current configuration is left as is")
+
+	c, err := Parse([]byte(old))
+	require.NoError(t, err, "older versions are converted on load")
+	assert.Equal(t, APIVersion, c.APIVersion)
+	assert.Equal(t, map[string]string{"max-pods": "64"}, c.ExtraArgs("master1").Kubelet)
+
+	_, err = Parse([]byte(strings.Replace(old, "name: gpu\n", "name: gpu\n      kubeletExtraArgs: {}\n", 1)))
+	assert.ErrorContains(t, err, "converting from xmcores.io/v1alpha1 to "+APIVersion+": spec.profiles[0]: kubeletArgs and kubeletExtraArgs must not both be set")
+	_, err = Parse([]byte(strings.Replace(old, "v1alpha1", "v9", 1)))
+	assert.ErrorContains(t, err, `unsupported apiVersion "xmcores.io/v9"`)
+	assert.Equal(t, []string{APIVersionV1alpha1, APIVersion}, Versions())
+}
+
+func TestHooks(t *testing.T) {
+	const cluster = `apiVersion: xmcores.io/v1alpha1
+kind: Cluster
+metadata: {name: demo}
+spec:
+  hosts:
+    - {name: master1, address: 192.168.0.1, user: root, password: x, roles: [control-plane, etcd]}
+  kubernetes: {version: v1.31.2}
+`
+	_, err := Parse([]byte(cluster + "  hooks: {preRun: [{url: \"cmdb.lab\"}]}\n"))
+	assert.ErrorContains(t, err, "spec.hooks: preRun[0]: url")
+
+	c, err := Parse([]byte(cluster + `  hooks:
+    preRun:
+      - {name: ticket, command: ./open-ticket.sh, commands: [apply]}
+    postFailure:
+      - {url: "https://cmdb.lab/xm", timeout: 5s}
+`))
+	require.NoError(t, err)
+	require.NotNil(t, c.Spec.Hooks)
+	assert.Equal(t, runhook.DefaultTimeout, c.Spec.Hooks.PreRun[0].Timeout)
+	assert.Equal(t, 5*time.Second, c.Spec.Hooks.PostFailure[0].Timeout)
+}
+
+func TestSandbox(t *testing.T) {
+	const cluster = `apiVersion: xmcores.io/v1alpha1
+kind: Cluster
+metadata: {name: demo}
+spec:
+  hosts:
+    - {name: master1, address: 192.168.0.1, user: root, password: x, roles: [control-plane, etcd]}
+  kubernetes: {version: v1.31.2}
+`
+	c, err := Parse([]byte(cluster + "  sandbox: {sudo: [/usr/bin/systemctl restart myapp]}\n"))
+	require.NoError(t, err)
+	require.NotNil(t, c.Spec.Sandbox)
+	assert.Equal(t, modules.DefaultSandboxUser, c.Spec.Sandbox.User)
+
+	_, err = Parse([]byte(cluster + "  sandbox: {user: root}\n"))
+	assert.ErrorContains(t, err, "spec.sandbox: user")
+}
+
+func TestJournal(t *testing.T) {
+	c, err := Parse([]byte(sampleConfig + "  journal: {}\n"))
+	require.NoError(t, err)
+	require.NotNil(t, c.Spec.Journal)
+	assert.Equal(t, modules.DefaultJournalBackupDir, c.Spec.Journal.BackupDir)
+
+	_, err = Parse([]byte(sampleConfig + "  journal: {backupDir: backups}\n"))
+	assert.ErrorContains(t, err, "spec.journal: backupDir")
+}
+
+func TestSudoers(t *testing.T) {
+	const cluster = `apiVersion: xmcores.io/v1alpha1
+kind: Cluster
+metadata: {name: demo}
+spec:
+  hosts:
+    - {name: master1, address: 192.168.0.1, user: root, password: x, roles: [control-plane, etcd]}
+  kubernetes: {version: v1.31.2}
+`
+	c, err := Parse([]byte(cluster + "  sandbox: {}\n  sudoers: {packages: [socat]}\n"))
+	require.NoError(t, err)
+	require.NotNil(t, c.Spec.Sudoers)
+	assert.Equal(t, modules.DefaultSandboxUser, c.Spec.Sudoers.User, "the sandbox user by default")
+	assert.Equal(t, sudoers.DefaultServices, c.Spec.Sudoers.Services)
+
+	_, err = Parse([]byte(cluster + "  sudoers: {packages: [socat]}\n"))
+	assert.ErrorContains(t, err, "spec.sudoers: user is required")
+}
@@ -0,0 +1,181 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/mensylisir/xmcores/connector"
+	"github.com/mensylisir/xmcores/modules"
+)
+
+// Connection holds the settings for reaching hosts over SSH. spec.connection
+// applies to every host, the connection of each group listing a host to that
+// host in declaration order, then the host's own fields (port, user, ...) and
+// finally its connection section; each set field overrides the earlier ones.
+type Connection struct {
+	Port           int    `yaml:"port,omitempty" json:"port,omitempty"`
+	User           string `yaml:"user,omitempty" json:"user,omitempty"`
+	Password       string `yaml:"password,omitempty" json:"password,omitempty"`
+	PrivateKey     string `yaml:"privateKey,omitempty" json:"privateKey,omitempty"`
+	PrivateKeyPath string `yaml:"privateKeyPath,omitempty" json:"privateKeyPath,omitempty"`
+	// AgentSocket authenticates with an SSH agent: a socket path, a Windows
+	// named pipe, or env:NAME for the path in environment variable NAME.
+	AgentSocket string        `yaml:"agentSocket,omitempty" json:"agentSocket,omitempty"`
+	Timeout     time.Duration `yaml:"timeout,omitempty" json:"timeout,omitempty"`
+	// Bastion is the jump host in front of the host. A bastion set at a more
+	// specific level replaces the inherited one as a whole.
+	Bastion *Bastion `yaml:"bastion,omitempty" json:"bastion,omitempty"`
+	// SudoFileOps transfers files through sudo, for users that cannot write
+	// the target paths themselves.
+	SudoFileOps *bool `yaml:"sudoFileOps,omitempty" json:"sudoFileOps,omitempty"`
+	// SudoUser owns the files written with sudo; defaults to the user.
+	SudoUser string `yaml:"sudoUser,omitempty" json:"sudoUser,omitempty"`
+	// FileTransfer is auto (the default), sftp or exec, see connector.FileTransferAuto.
+	FileTransfer string `yaml:"fileTransfer,omitempty" json:"fileTransfer,omitempty"`
+	// SudoPrompt is a regular expression matching the prompt sudo prints to
+	// ask for the password; defaults to connector.DefaultSudoPrompt, which
+	// recognizes localized prompts too.
+	SudoPrompt string `yaml:"sudoPrompt,omitempty" json:"sudoPrompt,omitempty"`
+	// Shell is the absolute path of the shell sudo runs commands with;
+	// defaults to /bin/bash, or /bin/sh on hosts without bash (e.g. Alpine).
+	Shell string `yaml:"shell,omitempty" json:"shell,omitempty"`
+	// Umask applies to commands run with sudo, e.g. 0022; defaults to the
+	// one sudo sets.
+	Umask string `yaml:"umask,omitempty" json:"umask,omitempty"`
+}
+
+// Bastion is a jump host. Unset user and credentials are those of the host.
+type Bastion struct {
+	Address        string `yaml:"address" json:"address"`
+	Port           int    `yaml:"port,omitempty" json:"port,omitempty"`
+	User           string `yaml:"user,omitempty" json:"user,omitempty"`
+	Password       string `yaml:"password,omitempty" json:"password,omitempty"`
+	PrivateKey     string `yaml:"privateKey,omitempty" json:"privateKey,omitempty"`
+	PrivateKeyPath string `yaml:"privateKeyPath,omitempty" json:"privateKeyPath,omitempty"`
+	AgentSocket    string `yaml:"agentSocket,omitempty" json:"agentSocket,omitempty"`
+}
+
+func (c *Connection) merge(o *Connection) {
+	if o == nil {
+		return
+	}
+	if o.Port != 0 {
+		c.Port = o.Port
+	}
+	for _, f := range []struct{ dst, src *string }{
+		{&c.User, &o.User},
+		{&c.Password, &o.Password},
+		{&c.PrivateKey, &o.PrivateKey},
+		{&c.PrivateKeyPath, &o.PrivateKeyPath},
+		{&c.AgentSocket, &o.AgentSocket},
+		{&c.SudoUser, &o.SudoUser},
+		{&c.FileTransfer, &o.FileTransfer},
+		{&c.SudoPrompt, &o.SudoPrompt},
+		{&c.Shell, &o.Shell},
+		{&c.Umask, &o.Umask},
+	} {
+		if *f.src != "" {
+			*f.dst = *f.src
+		}
+	}
+	if o.Timeout != 0 {
+		c.Timeout = o.Timeout
+	}
+	if o.Bastion != nil {
+		c.Bastion = o.Bastion
+	}
+	if o.SudoFileOps != nil {
+		c.SudoFileOps = o.SudoFileOps
+	}
+}
+
+// connection returns the effective connection settings of h, see Connection.
+func (c *Cluster) connection(h Host) Connection {
+	var conn Connection
+	conn.merge(c.Spec.Connection)
+	for _, g := range c.Spec.Groups {
+		for _, member := range g.Hosts {
+			if member == h.Name {
+				conn.merge(g.Connection)
+			}
+		}
+	}
+	conn.merge(&Connection{
+		Port:           h.Port,
+		User:           h.User,
+		Password:       h.Password,
+		PrivateKey:     h.PrivateKey,
+		PrivateKeyPath: h.PrivateKeyPath,
+		Timeout:        h.ConnectionTimeout,
+	})
+	conn.merge(h.Connection)
+	return conn
+}
+
+// applyConnection stores the inherited port, user, credentials and timeout
+// in the host's own fields, where the rest of the code reads them.
+func (c *Cluster) applyConnection(h *Host) {
+	conn := c.connection(*h)
+	h.Port, h.User, h.Password = conn.Port, conn.User, conn.Password
+	h.PrivateKey, h.PrivateKeyPath, h.ConnectionTimeout = conn.PrivateKey, conn.PrivateKeyPath, conn.Timeout
+}
+
+// ConnectionConfig returns the SSH settings of host, including those only the
+// connection sections carry: agent, bastion and sudo file operations.
+func (c *Cluster) ConnectionConfig(host connector.Host) connector.Config {
+	cfg := modules.ConnectionConfig(host)
+	h, ok := c.host(host.GetName())
+	if !ok {
+		return cfg
+	}
+	conn := c.connection(h)
+	cfg.AgentSocket = conn.AgentSocket
+	cfg.FileTransfer = conn.FileTransfer
+	cfg.SudoPrompt = conn.SudoPrompt
+	cfg.Shell, cfg.Umask = conn.Shell, conn.Umask
+	if conn.SudoFileOps != nil && *conn.SudoFileOps {
+		cfg.UseSudoForFileOps = true
+		cfg.UserForSudoFileOps = conn.SudoUser
+	}
+	if b := conn.Bastion; b != nil {
+		cfg.Bastion = b.Address
+		cfg.BastionPort = b.Port
+		cfg.BastionUser = b.User
+		cfg.BastionPassword = b.Password
+		cfg.BastionPrivateKey = b.PrivateKey
+		cfg.BastionKeyFile = b.PrivateKeyPath
+		cfg.BastionAgentSocket = b.AgentSocket
+	}
+	return cfg
+}
+
+// validateConnection checks the connection settings of h.
+func (c *Cluster) validateConnection(h Host) []error {
+	conn := c.connection(h)
+	var errs []error
+	switch conn.FileTransfer {
+	case connector.FileTransferAuto, connector.FileTransferSFTP, connector.FileTransferExec:
+	default:
+		errs = append(errs, fmt.Errorf("host %s: unsupported file transfer %q (want %s or %s)", h.Name, conn.FileTransfer, connector.FileTransferSFTP, connector.FileTransferExec))
+	}
+	if conn.SudoPrompt != "" {
+		if _, err := regexp.Compile(conn.SudoPrompt); err != nil {
+			errs = append(errs, fmt.Errorf("host %s: invalid sudo prompt: %w", h.Name, err))
+		}
+	}
+	for _, err := range []error{connector.ValidateShell(conn.Shell), connector.ValidateUmask(conn.Umask)} {
+		if err != nil {
+			errs = append(errs, fmt.Errorf("host %s: %w", h.Name, err))
+		}
+	}
+	if b := conn.Bastion; b != nil {
+		if b.Address == "" {
+			errs = append(errs, fmt.Errorf("host %s: bastion address must be set", h.Name))
+		}
+		if b.Port < 0 || b.Port > 65535 {
+			errs = append(errs, fmt.Errorf("host %s: invalid bastion port %d", h.Name, b.Port))
+		}
+	}
+	return errs
+}
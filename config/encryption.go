@@ -0,0 +1,144 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"gopkg.in/yaml.v3"
+)
+
+// Encryption envelopes Load recognizes.
+const (
+	EncryptionNone = ""
+	// EncryptionAge is a whole file encrypted with age, binary or armored.
+	EncryptionAge = "age"
+	// EncryptionSOPS is a YAML or JSON document with values encrypted by
+	// SOPS, recognized by its top-level sops metadata.
+	EncryptionSOPS = "sops"
+)
+
+// Environment variables holding the age identity that decrypts configs, the
+// same SOPS reads. SOPS_AGE_KEY holds the identities themselves, so no key
+// file is needed; otherwise the file named by SOPS_AGE_KEY_FILE, then the
+// SOPS default keys.txt under the user config directory, is used.
+const (
+	EnvAgeKey     = "SOPS_AGE_KEY"
+	EnvAgeKeyFile = "SOPS_AGE_KEY_FILE"
+)
+
+const (
+	ageHeader        = "age-encryption.org/v1\n"
+	ageArmoredHeader = "-----BEGIN AGE ENCRYPTED FILE-----"
+)
+
+// DetectEncryption returns the envelope data is encrypted with, if any.
+func DetectEncryption(data []byte) string {
+	trimmed := bytes.TrimLeft(data, " \t\r\n")
+	if bytes.HasPrefix(data, []byte(ageHeader)) || bytes.HasPrefix(trimmed, []byte(ageArmoredHeader)) {
+		return EncryptionAge
+	}
+	var doc struct {
+		SOPS map[string]interface{} `yaml:"sops"`
+	}
+	if yaml.Unmarshal(data, &doc) == nil && doc.SOPS["mac"] != nil {
+		return EncryptionSOPS
+	}
+	return EncryptionNone
+}
+
+// Decrypt returns data decrypted if it is encrypted (see DetectEncryption),
+// else data itself; the plain text is kept in memory only. age files are
+// decrypted in-process. SOPS documents are decrypted by the sops binary,
+// which must be on the PATH and reads the same identities, with data on
+// stdin.
+func Decrypt(ctx context.Context, data []byte) ([]byte, error) {
+	switch DetectEncryption(data) {
+	case EncryptionAge:
+		return decryptAge(data)
+	case EncryptionSOPS:
+		// JSON is YAML, but the MAC only verifies when sops parses the
+		// document the way it was written.
+		inputType := "yaml"
+		if bytes.HasPrefix(bytes.TrimLeft(data, " \t\r\n"), []byte("{")) {
+			inputType = "json"
+		}
+		return decryptWith(ctx, data, "sops", "--decrypt", "--input-type", inputType, "--output-type", "yaml", "/dev/stdin")
+	default:
+		return data, nil
+	}
+}
+
+func decryptAge(data []byte) ([]byte, error) {
+	identities, err := ageIdentities()
+	if err != nil {
+		return nil, err
+	}
+	var src io.Reader = bytes.NewReader(data)
+	if trimmed := bytes.TrimLeft(data, " \t\r\n"); bytes.HasPrefix(trimmed, []byte(ageArmoredHeader)) {
+		src = armor.NewReader(bytes.NewReader(trimmed))
+	}
+	r, err := age.Decrypt(src, identities...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt config with age: %w", err)
+	}
+	plain, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt config with age: %w", err)
+	}
+	return plain, nil
+}
+
+// ageIdentities parses the identities of EnvAgeKey, else of the key file
+// named by EnvAgeKeyFile or the SOPS default.
+func ageIdentities() ([]age.Identity, error) {
+	if key := os.Getenv(EnvAgeKey); key != "" {
+		identities, err := age.ParseIdentities(strings.NewReader(key))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", EnvAgeKey, err)
+		}
+		return identities, nil
+	}
+	keyFile := os.Getenv(EnvAgeKeyFile)
+	if keyFile == "" {
+		dir, err := os.UserConfigDir()
+		if err != nil {
+			return nil, fmt.Errorf("no age identity: set %s or %s", EnvAgeKey, EnvAgeKeyFile)
+		}
+		keyFile = filepath.Join(dir, "sops", "age", "keys.txt")
+	}
+	f, err := os.Open(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("no age identity: set %s or %s (%w)", EnvAgeKey, EnvAgeKeyFile, err)
+	}
+	defer f.Close()
+	identities, err := age.ParseIdentities(f)
+	if err != nil {
+		return nil, fmt.Errorf("invalid age identities in %s: %w", keyFile, err)
+	}
+	return identities, nil
+}
+
+// decryptWith runs the decryption command with data on stdin and returns its
+// stdout.
+func decryptWith(ctx context.Context, data []byte, name string, args ...string) ([]byte, error) {
+	if _, err := exec.LookPath(name); err != nil {
+		return nil, fmt.Errorf("config is encrypted, but %s is not installed: %w", name, err)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("failed to decrypt config with %s: %w: %s", name, err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
@@ -0,0 +1,125 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/mensylisir/xmcores/catalog"
+	"github.com/mensylisir/xmcores/common"
+	"github.com/mensylisir/xmcores/connector"
+)
+
+// DefaultKubernetesVersion is proposed by Generate when no version is given.
+const DefaultKubernetesVersion = "v1.31.2"
+
+// GenerateOptions are the answers a new cluster configuration is built from.
+type GenerateOptions struct {
+	Name string
+	// ControlPlanes and Workers are node addresses. An address listed in both
+	// becomes a control-plane node that also runs workloads.
+	ControlPlanes []string
+	Workers       []string
+	// SSH credentials shared by all hosts.
+	User           string
+	Port           int
+	Password       string
+	PrivateKeyPath string
+
+	KubernetesVersion string
+	NetworkPlugin     string
+}
+
+// Generate builds a cluster configuration from opts and returns it as YAML.
+// The output is parsed back before it is returned, so it is always valid.
+func Generate(opts GenerateOptions) ([]byte, error) {
+	if opts.Name == "" {
+		opts.Name = "cluster"
+	}
+	if opts.User == "" {
+		opts.User = "root"
+	}
+	if opts.KubernetesVersion == "" {
+		opts.KubernetesVersion = DefaultKubernetesVersion
+	}
+	if len(opts.ControlPlanes) == 0 {
+		return nil, errors.New("at least one control-plane address is required")
+	}
+	if _, err := catalog.NewCatalog().Release(opts.KubernetesVersion); err != nil {
+		return nil, fmt.Errorf("kubernetes version %s: %w", opts.KubernetesVersion, err)
+	}
+
+	c := &Cluster{
+		APIVersion: APIVersion,
+		Kind:       KindCluster,
+		Metadata:   Metadata{Name: opts.Name},
+	}
+	c.Spec.Kubernetes.Version = opts.KubernetesVersion
+	c.Spec.Network.Plugin = opts.NetworkPlugin
+
+	index := make(map[string]int)
+	counts := make(map[string]int)
+	add := func(addr, prefix, role string) error {
+		if net.ParseIP(addr) == nil {
+			return fmt.Errorf("invalid node address %q", addr)
+		}
+		if i, ok := index[addr]; ok {
+			c.Spec.Hosts[i].Roles = append(c.Spec.Hosts[i].Roles, role)
+			return nil
+		}
+		index[addr] = len(c.Spec.Hosts)
+		counts[prefix]++
+		h := Host{BaseHost: connector.BaseHost{
+			Name:           fmt.Sprintf("%s%d", prefix, counts[prefix]),
+			Address:        addr,
+			User:           opts.User,
+			Password:       opts.Password,
+			PrivateKeyPath: opts.PrivateKeyPath,
+		}}
+		if opts.Port != 0 && opts.Port != common.DefaultSSHPort {
+			h.Port = opts.Port
+		}
+		h.Roles = []string{role}
+		if role == common.RoleControlPlane {
+			h.Roles = append(h.Roles, common.RoleEtcd)
+		}
+		c.Spec.Hosts = append(c.Spec.Hosts, h)
+		return nil
+	}
+	for _, addr := range opts.ControlPlanes {
+		if err := add(addr, "master", common.RoleControlPlane); err != nil {
+			return nil, err
+		}
+	}
+	for _, addr := range opts.Workers {
+		if err := add(addr, "worker", common.RoleWorker); err != nil {
+			return nil, err
+		}
+	}
+
+	data, err := c.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := Parse(data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Marshal encodes the configuration as YAML.
+func (c *Cluster) Marshal() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(c); err != nil {
+		return nil, fmt.Errorf("failed to encode cluster config: %w", err)
+	}
+	if err := enc.Close(); err != nil {
+		return nil, fmt.Errorf("failed to encode cluster config: %w", err)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,157 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/mensylisir/xmcores/common"
+	"github.com/mensylisir/xmcores/connector"
+	"github.com/mensylisir/xmcores/modules/kubeadm"
+)
+
+// KubeadmParams returns the kubeadm parameters for host, including the
+// apiserver flags and volumes required by the security section and the etcd
+// endpoints of dedicated etcd hosts.
+func (c *Cluster) KubeadmParams(host connector.Host) kubeadm.Params {
+	k := c.Spec.Kubernetes
+	p := kubeadm.Params{
+		KubernetesVersion:    k.Version,
+		ClusterName:          c.Metadata.Name,
+		ControlPlaneEndpoint: k.ControlPlaneEndpoint,
+		PodSubnet:            k.PodSubnet,
+		ServiceSubnet:        k.ServiceSubnet,
+		DNSDomain:            k.DNSDomain,
+		ImageRepository:      k.ImageRepository,
+		CertSANs:             c.APIServerCertSANs(),
+		NodeName:             host.GetName(),
+		AdvertiseAddress:     host.GetInternalIPv4Address(),
+	}
+	p.Taints = c.kubeadmTaints(host)
+	args := c.ExtraArgs(host.GetName())
+	p.KubeletArgs = c.kubeletArgs(host.GetName(), args.Kubelet)
+	if host.IsRole(common.RoleControlPlane) && args.ControlPlane() {
+		p.PatchesDir = kubeadm.PatchesDir
+	}
+	p.EtcdEndpoints = c.EtcdEndpoints()
+	if sec := c.Spec.Security; sec != nil {
+		p.APIServerArgs = sec.APIServerArgs()
+		for _, m := range sec.APIServerMounts() {
+			p.APIServerVolumes = append(p.APIServerVolumes, kubeadm.Volume(m))
+		}
+	}
+	return p
+}
+
+// KubeadmInitConfig renders the kubeadm init configuration for the first control-plane host.
+func (c *Cluster) KubeadmInitConfig(host connector.Host) ([]byte, error) {
+	extra, err := c.kubeadmExtra(host)
+	if err != nil {
+		return nil, fmt.Errorf("host %s: %w", host.GetName(), err)
+	}
+	docs, err := kubeadm.InitDocuments(c.KubeadmParams(host), extra)
+	if err != nil {
+		return nil, fmt.Errorf("host %s: %w", host.GetName(), err)
+	}
+	return kubeadm.Marshal(docs...)
+}
+
+// KubeadmJoinConfig renders the kubeadm join configuration for host.
+func (c *Cluster) KubeadmJoinConfig(host connector.Host, join kubeadm.JoinParams) ([]byte, error) {
+	join.NodeName = host.GetName()
+	join.Taints = c.kubeadmTaints(host)
+	args := c.ExtraArgs(host.GetName())
+	join.KubeletArgs = c.kubeletArgs(host.GetName(), args.Kubelet)
+	if join.ControlPlane && args.ControlPlane() {
+		join.PatchesDir = kubeadm.PatchesDir
+	}
+	if join.ControlPlane && join.AdvertiseAddress == "" {
+		join.AdvertiseAddress = host.GetInternalIPv4Address()
+	}
+	extra, err := c.kubeadmExtra(host)
+	if err != nil {
+		return nil, fmt.Errorf("host %s: %w", host.GetName(), err)
+	}
+	doc, err := kubeadm.JoinDocument(join, extra)
+	if err != nil {
+		return nil, fmt.Errorf("host %s: %w", host.GetName(), err)
+	}
+	return kubeadm.Marshal(doc)
+}
+
+// ExtraArgs returns the component flags of the host named name: those of
+// spec.kubernetes, overridden by those of each group listing the host in
+// declaration order, then by the kubelet flags of its profiles.
+func (c *Cluster) ExtraArgs(name string) kubeadm.ExtraArgs {
+	args := kubeadm.ExtraArgs{}.Merge(c.Spec.Kubernetes.ExtraArgs)
+	for _, g := range c.Spec.Groups {
+		for _, member := range g.Hosts {
+			if member == name {
+				args = args.Merge(g.ExtraArgs)
+			}
+		}
+	}
+	return args.Merge(kubeadm.ExtraArgs{Kubelet: c.HostProfile(name).KubeletArgs})
+}
+
+// KubeletServingCSRs reports whether the kubelet of host requests its serving
+// certificate from the cluster, with the rotate-server-certificates flag or
+// serverTLSBootstrap in spec.kubeadmExtra.kubeletConfiguration, rather than
+// signing its own. Its requests must then be approved, see csrapprove.
+func (c *Cluster) KubeletServingCSRs(host connector.Host) bool {
+	if on, err := strconv.ParseBool(c.ExtraArgs(host.GetName()).Kubelet["rotate-server-certificates"]); err == nil && on {
+		return true
+	}
+	extra, err := c.kubeadmExtra(host)
+	if err != nil {
+		return false
+	}
+	switch v := extra.KubeletConfiguration["serverTLSBootstrap"].(type) {
+	case bool:
+		return v
+	case string:
+		on, _ := strconv.ParseBool(v)
+		return on
+	}
+	return false
+}
+
+// KubeletCgroupDriver returns the cgroup driver the kubelet of host is
+// configured with: that of spec.kubeadmExtra.kubeletConfiguration, else the
+// kubeadm default.
+func (c *Cluster) KubeletCgroupDriver(host connector.Host) string {
+	if extra, err := c.kubeadmExtra(host); err == nil {
+		if driver, ok := extra.KubeletConfiguration["cgroupDriver"].(string); ok && driver != "" {
+			return driver
+		}
+	}
+	return kubeadm.DefaultCgroupDriver
+}
+
+// KubeadmPatches returns the kubeadm patches to write to kubeadm.PatchesDir
+// on host before it is initialized, joined or upgraded, by file name; none
+// unless host is a control-plane host with component flags.
+func (c *Cluster) KubeadmPatches(host connector.Host) (map[string][]byte, error) {
+	if !host.IsRole(common.RoleControlPlane) {
+		return nil, nil
+	}
+	patches, err := c.ExtraArgs(host.GetName()).Patches()
+	if err != nil {
+		return nil, fmt.Errorf("host %s: %w", host.GetName(), err)
+	}
+	return patches, nil
+}
+
+// kubeadmTaints returns the taints host registers with, including those of
+// its profiles.
+func (c *Cluster) kubeadmTaints(host connector.Host) []kubeadm.Taint {
+	h, ok := c.host(host.GetName())
+	if !ok {
+		return nil
+	}
+	hostTaints := c.hostMetadata(h).Taints
+	taints := make([]kubeadm.Taint, 0, len(hostTaints))
+	for _, t := range hostTaints {
+		taints = append(taints, kubeadm.Taint(t))
+	}
+	return taints
+}
@@ -0,0 +1,143 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+)
+
+// APIVersionV1alpha1 is the first configuration schema. Its profiles named
+// the kubelet flags kubeletArgs.
+const APIVersionV1alpha1 = "xmcores.io/v1alpha1"
+
+// conversion upgrades a configuration document from one apiVersion to the
+// next.
+type conversion struct {
+	from, to string
+	// convert rewrites the root mapping of the document in place.
+	convert func(root *yaml.Node) error
+}
+
+// conversions chain the apiVersions Parse reads to APIVersion, oldest first.
+var conversions = []conversion{
+	{from: APIVersionV1alpha1, to: APIVersion, convert: convertV1alpha1},
+}
+
+// Versions returns the apiVersions Parse reads, oldest first; the last one
+// is APIVersion.
+func Versions() []string {
+	versions := make([]string, 0, len(conversions)+1)
+	for _, c := range conversions {
+		versions = append(versions, c.from)
+	}
+	return append(versions, APIVersion)
+}
+
+// convertV1alpha1 renames spec.profiles[].kubeletArgs to kubeletExtraArgs,
+// the name of the flags of spec.kubernetes and spec.groups.
+func convertV1alpha1(root *yaml.Node) error {
+	profiles := mappingValue(mappingValue(root, "spec"), "profiles")
+	if profiles == nil {
+		return nil
+	}
+	if profiles.Kind != yaml.SequenceNode {
+		return errors.New("spec.profiles must be a list")
+	}
+	for i, p := range profiles.Content {
+		if err := renameKey(p, "kubeletArgs", "kubeletExtraArgs"); err != nil {
+			return fmt.Errorf("spec.profiles[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// Migrate upgrades data, a configuration document of any of Versions, to
+// APIVersion. Comments and the order of fields are kept. It returns the
+// apiVersion data had, and data itself when that already is APIVersion.
+func Migrate(data []byte) ([]byte, string, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, "", fmt.Errorf("failed to parse cluster config: %w", err)
+	}
+	from, err := migrate(&doc)
+	if err != nil || from == APIVersion {
+		return data, from, err
+	}
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return nil, from, fmt.Errorf("failed to render cluster config: %w", err)
+	}
+	if err := enc.Close(); err != nil {
+		return nil, from, fmt.Errorf("failed to render cluster config: %w", err)
+	}
+	return buf.Bytes(), from, nil
+}
+
+// migrate upgrades the document node doc in place and returns the
+// apiVersion it had. A document without apiVersion is taken as APIVersion.
+func migrate(doc *yaml.Node) (string, error) {
+	if doc.Kind == 0 {
+		// Empty: left to the decoder to reject.
+		return APIVersion, nil
+	}
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return "", errors.New("cluster config must be a YAML mapping")
+	}
+	root := doc.Content[0]
+	versionNode := mappingValue(root, "apiVersion")
+	if versionNode == nil {
+		return APIVersion, nil
+	}
+	from := versionNode.Value
+	i := 0
+	for i < len(conversions) && conversions[i].from != from {
+		i++
+	}
+	if i == len(conversions) {
+		if from != APIVersion {
+			return from, fmt.Errorf("unsupported apiVersion %q (want one of %v)", from, Versions())
+		}
+		return from, nil
+	}
+	for _, c := range conversions[i:] {
+		if err := c.convert(root); err != nil {
+			return from, fmt.Errorf("converting from %s to %s: %w", c.from, c.to, err)
+		}
+		versionNode.Value = c.to
+	}
+	return from, nil
+}
+
+// mappingValue returns the value of key in the mapping node m, or nil.
+func mappingValue(m *yaml.Node, key string) *yaml.Node {
+	if m == nil || m.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			return m.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// renameKey renames the key from of the mapping node m to to, failing when
+// both are set.
+func renameKey(m *yaml.Node, from, to string) error {
+	if m.Kind != yaml.MappingNode {
+		return nil
+	}
+	if mappingValue(m, from) != nil && mappingValue(m, to) != nil {
+		return fmt.Errorf("%s and %s must not both be set", from, to)
+	}
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == from {
+			m.Content[i].Value = to
+		}
+	}
+	return nil
+}
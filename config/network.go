@@ -0,0 +1,247 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/mensylisir/xmcores/common"
+	"github.com/mensylisir/xmcores/facts"
+	"github.com/mensylisir/xmcores/modules/kubeadm"
+)
+
+// interfacePattern matches a Linux network interface name.
+var interfacePattern = regexp.MustCompile(`^[A-Za-z0-9_.:-]{1,15}$`)
+
+// internalIPs returns the internal addresses of h, the IPv4 one first, leaving
+// out names not resolved yet.
+func internalIPs(h Host) []net.IP {
+	var ips []net.IP
+	for _, a := range strings.Split(h.InternalAddress, ",") {
+		if ip := net.ParseIP(strings.TrimSpace(a)); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// multiHomed reports whether h is attached to the cluster network by another
+// address or interface than the one it is managed through, in which case the
+// kubelet and the pod network cannot be left to guess it.
+func (h Host) multiHomed() bool {
+	return h.Interface != "" || h.ExternalAddress != "" || (h.InternalAddress != "" && h.InternalAddress != h.Address)
+}
+
+// NodeIP returns the kubelet --node-ip of the host named name: its internal
+// addresses when it is multi-homed, since the kubelet would otherwise register
+// the address of the default route, else "".
+func (c *Cluster) NodeIP(name string) string {
+	h, ok := c.host(name)
+	if !ok || !h.multiHomed() {
+		return ""
+	}
+	ips := internalIPs(h)
+	list := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		list = append(list, ip.String())
+	}
+	return strings.Join(list, ",")
+}
+
+// kubeletArgs returns args with the --node-ip of the host named name added,
+// unless args set it.
+func (c *Cluster) kubeletArgs(name string, args map[string]string) map[string]string {
+	ip := c.NodeIP(name)
+	if _, set := args["node-ip"]; set || ip == "" {
+		return args
+	}
+	out := make(map[string]string, len(args)+1)
+	for k, v := range args {
+		out[k] = v
+	}
+	out["node-ip"] = ip
+	return out
+}
+
+// APIServerCertSANs returns spec.kubernetes.certSANs with the external
+// addresses of the control-plane hosts.
+func (c *Cluster) APIServerCertSANs() []string {
+	sans := append([]string(nil), c.Spec.Kubernetes.CertSANs...)
+	seen := map[string]bool{}
+	for _, s := range sans {
+		seen[s] = true
+	}
+	for _, h := range c.Spec.Hosts {
+		if h.ExternalAddress != "" && !seen[h.ExternalAddress] && hasRole(h, common.RoleControlPlane) {
+			seen[h.ExternalAddress] = true
+			sans = append(sans, h.ExternalAddress)
+		}
+	}
+	return sans
+}
+
+// NetworkInterfaces returns the interfaces the hosts declare, sorted.
+func (c *Cluster) NetworkInterfaces() []string {
+	seen := map[string]bool{}
+	var ifaces []string
+	for _, h := range c.Spec.Hosts {
+		if h.Interface != "" && !seen[h.Interface] {
+			seen[h.Interface] = true
+			ifaces = append(ifaces, h.Interface)
+		}
+	}
+	sort.Strings(ifaces)
+	return ifaces
+}
+
+// CalicoIPAutodetection returns the IP_AUTODETECTION_METHOD of calico-node
+// matching the hosts: the interfaces they declare, else the internal address
+// the kubelet registers (see NodeIP) when some are multi-homed. "" keeps the
+// default of Calico, the first interface found.
+func (c *Cluster) CalicoIPAutodetection() string {
+	if ifaces := c.NetworkInterfaces(); len(ifaces) > 0 {
+		quoted := make([]string, 0, len(ifaces))
+		for _, i := range ifaces {
+			quoted = append(quoted, regexp.QuoteMeta(i))
+		}
+		return "interface=^(" + strings.Join(quoted, "|") + ")$"
+	}
+	for _, h := range c.Spec.Hosts {
+		if h.multiHomed() {
+			return "kubernetes-internal-ip"
+		}
+	}
+	return ""
+}
+
+// FlannelArgs returns the flags of flanneld selecting the interfaces the
+// hosts declare; flanneld uses the first of them a node has.
+func (c *Cluster) FlannelArgs() []string {
+	var args []string
+	for _, i := range c.NetworkInterfaces() {
+		args = append(args, "--iface="+i)
+	}
+	return args
+}
+
+// NodeNetwork is how a host is expected to be attached to the cluster
+// network. It is checked against the addresses of the host before the host
+// joins, see CheckAddresses.
+type NodeNetwork struct {
+	// InternalIPs are the internal addresses of the host.
+	InternalIPs []net.IP
+	// Interface must carry them when set.
+	Interface string
+	// Subnets are spec.network.nodeSubnets.
+	Subnets []*net.IPNet
+}
+
+// NodeNetwork returns the network attachment expected of the host named name.
+func (c *Cluster) NodeNetwork(name string) NodeNetwork {
+	h, _ := c.host(name)
+	return NodeNetwork{InternalIPs: internalIPs(h), Interface: h.Interface, Subnets: c.nodeSubnets()}
+}
+
+func (c *Cluster) nodeSubnets() []*net.IPNet {
+	return parseCIDRs(strings.Join(c.Spec.Network.NodeSubnets, ","))
+}
+
+// clusterSubnets returns the pod and service subnets, with the kubeadm
+// defaults when unset, keyed by their name in errors.
+func (c *Cluster) clusterSubnets() map[string][]*net.IPNet {
+	pod, service := c.Spec.Kubernetes.PodSubnet, c.Spec.Kubernetes.ServiceSubnet
+	if pod == "" {
+		pod = kubeadm.DefaultPodSubnet
+	}
+	if service == "" {
+		service = kubeadm.DefaultServiceSubnet
+	}
+	return map[string][]*net.IPNet{"pod": parseCIDRs(pod), "service": parseCIDRs(service)}
+}
+
+// parseCIDRs parses a comma-separated list of subnets, leaving out invalid
+// ones.
+func parseCIDRs(list string) []*net.IPNet {
+	var subnets []*net.IPNet
+	for _, s := range strings.Split(list, ",") {
+		if _, n, err := net.ParseCIDR(strings.TrimSpace(s)); err == nil {
+			subnets = append(subnets, n)
+		}
+	}
+	return subnets
+}
+
+func containedIn(ip net.IP, subnets []*net.IPNet) *net.IPNet {
+	for _, s := range subnets {
+		if s.Contains(ip) {
+			return s
+		}
+	}
+	return nil
+}
+
+// validateAddresses checks the addresses of the hosts against each other and
+// the subnets of the cluster: mismatched subnets are a common cause of
+// broken multi-homed installations.
+func (c *Cluster) validateAddresses() []error {
+	var errList []error
+	nodeSubnets, clusterSubnets := c.nodeSubnets(), c.clusterSubnets()
+	for _, h := range c.Spec.Hosts {
+		if h.Interface != "" && !interfacePattern.MatchString(h.Interface) {
+			errList = append(errList, fmt.Errorf("host %s: invalid interface name %q", h.Name, h.Interface))
+		}
+		ips := internalIPs(h)
+		if len(ips) == 0 {
+			continue
+		}
+		for _, ip := range ips {
+			if len(nodeSubnets) > 0 && containedIn(ip, nodeSubnets) == nil {
+				errList = append(errList, fmt.Errorf("host %s: internal address %s is outside spec.network.nodeSubnets %v", h.Name, ip, c.Spec.Network.NodeSubnets))
+			}
+			for _, name := range []string{"pod", "service"} {
+				if s := containedIn(ip, clusterSubnets[name]); s != nil {
+					errList = append(errList, fmt.Errorf("host %s: internal address %s lies in the %s subnet %s", h.Name, ip, name, s))
+				}
+			}
+		}
+		if ext := net.ParseIP(h.ExternalAddress); ext != nil {
+			for _, ip := range ips {
+				if ext.Equal(ip) {
+					errList = append(errList, fmt.Errorf("host %s: externalAddress %s is its internal address", h.Name, ext))
+				}
+			}
+		}
+	}
+	for _, s := range nodeSubnets {
+		for _, name := range []string{"pod", "service"} {
+			for _, cs := range clusterSubnets[name] {
+				if s.Contains(cs.IP) || cs.Contains(s.IP) {
+					errList = append(errList, fmt.Errorf("spec.network.nodeSubnets: %s overlaps the %s subnet %s", s, name, cs))
+				}
+			}
+		}
+	}
+	return errList
+}
+
+// CheckAddresses checks addrs, the addresses a host has (see
+// facts.AddressesCommand), against n: each internal address must be assigned
+// to the host, on n.Interface when set and in a subnet of n.Subnets, if any.
+func (n NodeNetwork) CheckAddresses(addrs []facts.Address) error {
+	var errList []error
+	for _, ip := range n.InternalIPs {
+		a, ok := facts.FindAddress(addrs, ip)
+		switch {
+		case !ok:
+			errList = append(errList, fmt.Errorf("internal address %s is not assigned to any interface", ip))
+		case n.Interface != "" && a.Interface != n.Interface:
+			errList = append(errList, fmt.Errorf("internal address %s is on interface %s, not %s", ip, a.Interface, n.Interface))
+		case len(n.Subnets) > 0 && containedIn(ip, n.Subnets) == nil:
+			errList = append(errList, fmt.Errorf("internal address %s is in subnet %s, outside spec.network.nodeSubnets", ip, a.Network))
+		}
+	}
+	return errors.Join(errList...)
+}
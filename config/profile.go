@@ -0,0 +1,149 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/mensylisir/xmcores/modules/nodemeta"
+	"github.com/mensylisir/xmcores/modules/systune"
+)
+
+// Profile bundles the node settings shared by one kind of host, such as GPU
+// workers or edge nodes, so that large inventories need not repeat them.
+// Hosts use profiles by listing their names.
+type Profile struct {
+	Name string `yaml:"name" json:"name"`
+	// Packages are installed on the hosts in addition to the required ones.
+	Packages []string `yaml:"packages,omitempty" json:"packages,omitempty"`
+	// KernelModules and Sysctls extend and override spec.sysTune.
+	KernelModules []string          `yaml:"kernelModules,omitempty" json:"kernelModules,omitempty"`
+	Sysctls       map[string]string `yaml:"sysctls,omitempty" json:"sysctls,omitempty"`
+	Labels        map[string]string `yaml:"labels,omitempty" json:"labels,omitempty"`
+	Taints        []nodemeta.Taint  `yaml:"taints,omitempty" json:"taints,omitempty"`
+	// KubeletArgs are kubelet flags without the leading --, overridden by
+	// spec.kubeadmExtra. They were named kubeletArgs before v1alpha2.
+	KubeletArgs map[string]string `yaml:"kubeletExtraArgs,omitempty" json:"kubeletExtraArgs,omitempty"`
+}
+
+// HostProfile returns the settings of the host named name: those of its
+// profiles merged in the order listed, then its own labels and taints. Later
+// values win; lists are joined without duplicates, and a taint replaces an
+// earlier one with the same key and effect.
+func (c *Cluster) HostProfile(name string) Profile {
+	merged := Profile{Name: name}
+	h, ok := c.host(name)
+	if !ok {
+		return merged
+	}
+	for _, p := range h.Profiles {
+		if profile, ok := c.profile(p); ok {
+			merged.merge(profile)
+		}
+	}
+	merged.merge(Profile{Labels: h.Labels, Taints: h.Taints})
+	return merged
+}
+
+// SysTune returns spec.sysTune with the kernel modules and sysctls of the
+// profiles of the host named name applied.
+func (c *Cluster) SysTune(name string) systune.Config {
+	p := c.HostProfile(name)
+	return systune.Config{
+		KernelModules: appendUnique(append([]string{}, c.Spec.SysTune.KernelModules...), p.KernelModules...),
+		Sysctls:       mergeStrings(mergeStrings(nil, c.Spec.SysTune.Sysctls), p.Sysctls),
+	}
+}
+
+// Packages returns the extra packages the profiles of the host named name
+// ask for, sorted.
+func (c *Cluster) Packages(name string) []string {
+	pkgs := c.HostProfile(name).Packages
+	sort.Strings(pkgs)
+	return pkgs
+}
+
+func (p *Profile) merge(o Profile) {
+	p.Packages = appendUnique(p.Packages, o.Packages...)
+	p.KernelModules = appendUnique(p.KernelModules, o.KernelModules...)
+	p.Sysctls = mergeStrings(p.Sysctls, o.Sysctls)
+	p.Labels = mergeStrings(p.Labels, o.Labels)
+	p.KubeletArgs = mergeStrings(p.KubeletArgs, o.KubeletArgs)
+	for _, t := range o.Taints {
+		replaced := false
+		for i, existing := range p.Taints {
+			if existing.Key == t.Key && existing.Effect == t.Effect {
+				p.Taints[i] = t
+				replaced = true
+			}
+		}
+		if !replaced {
+			p.Taints = append(p.Taints, t)
+		}
+	}
+}
+
+// profile returns the profile named name.
+func (c *Cluster) profile(name string) (Profile, bool) {
+	for _, p := range c.Spec.Profiles {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return Profile{}, false
+}
+
+// validateProfiles checks the profiles and the references to them.
+func (c *Cluster) validateProfiles() []error {
+	var errs []error
+	names := make(map[string]bool, len(c.Spec.Profiles))
+	for i, p := range c.Spec.Profiles {
+		if p.Name == "" {
+			errs = append(errs, fmt.Errorf("spec.profiles[%d]: name must be set", i))
+			continue
+		}
+		if names[p.Name] {
+			errs = append(errs, fmt.Errorf("spec.profiles: duplicate profile %q", p.Name))
+		}
+		names[p.Name] = true
+		if err := (systune.Config{KernelModules: p.KernelModules, Sysctls: p.Sysctls}).Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("spec.profiles.%s: %w", p.Name, err))
+		}
+	}
+	for _, h := range c.Spec.Hosts {
+		for _, p := range h.Profiles {
+			if !names[p] {
+				errs = append(errs, fmt.Errorf("host %s: unknown profile %q", h.Name, p))
+			}
+		}
+	}
+	return errs
+}
+
+func appendUnique(list []string, items ...string) []string {
+	for _, item := range items {
+		found := false
+		for _, existing := range list {
+			if existing == item {
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func mergeStrings(dst, src map[string]string) map[string]string {
+	if len(src) == 0 {
+		return dst
+	}
+	if dst == nil {
+		dst = make(map[string]string, len(src))
+	}
+	for k, v := range src {
+		dst[k] = v
+	}
+	return dst
+}
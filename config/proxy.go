@@ -0,0 +1,49 @@
+package config
+
+import (
+	"net"
+	"strings"
+
+	"github.com/mensylisir/xmcores/modules/kubeadm"
+	"github.com/mensylisir/xmcores/modules/proxy"
+)
+
+// Proxy returns the proxy settings of spec.proxy with NO_PROXY covering the
+// cluster: every host's name and addresses, the pod and service subnets, the
+// service domains, the control-plane endpoint and the names of
+// spec.resolution.addresses, such as a local registry. ok is false without
+// spec.proxy.
+func (c *Cluster) Proxy() (cfg proxy.Config, ok bool) {
+	if c.Spec.Proxy == nil {
+		return proxy.Config{}, false
+	}
+	var exclude []string
+	for _, h := range c.Spec.Hosts {
+		exclude = append(exclude, h.Name, h.Address, h.GetInternalIPv4Address(), h.GetInternalIPv6Address())
+	}
+	k := c.Spec.Kubernetes
+	for _, subnet := range []string{or(k.PodSubnet, kubeadm.DefaultPodSubnet), or(k.ServiceSubnet, kubeadm.DefaultServiceSubnet)} {
+		exclude = append(exclude, strings.Split(subnet, ",")...)
+	}
+	exclude = append(exclude, ".svc", "."+or(k.DNSDomain, kubeadm.DefaultDNSDomain))
+	if endpoint := endpointHost(k.ControlPlaneEndpoint); endpoint != "" {
+		exclude = append(exclude, endpoint)
+	}
+	if r := c.Spec.Resolution; r != nil {
+		exclude = append(exclude, sortedKeys(r.Addresses)...)
+	}
+	for i, e := range exclude {
+		exclude[i] = strings.TrimSpace(e)
+		if ip := net.ParseIP(exclude[i]); ip != nil {
+			exclude[i] = ip.String()
+		}
+	}
+	return c.Spec.Proxy.Effective(exclude...), true
+}
+
+func or(v, def string) string {
+	if v == "" {
+		return def
+	}
+	return v
+}
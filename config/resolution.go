@@ -0,0 +1,168 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/mensylisir/xmcores/common"
+	"github.com/mensylisir/xmcores/modules/etchosts"
+)
+
+// Strategies of Resolution.
+const (
+	// ResolveDNS resolves host names with the DNS of the machine running xm.
+	ResolveDNS = "dns"
+	// ResolveStatic looks host names up in Resolution.Addresses.
+	ResolveStatic = "static"
+	// ResolveHostsFile is ResolveStatic, and additionally writes the names
+	// of HostsEntries to /etc/hosts on every node.
+	ResolveHostsFile = "hosts"
+)
+
+// Resolution says how host addresses given as names are turned into IP
+// addresses, which kubeadm and the CNI need.
+type Resolution struct {
+	// Strategy is ResolveDNS (the default), ResolveStatic or ResolveHostsFile.
+	Strategy string `yaml:"strategy,omitempty" json:"strategy,omitempty"`
+	// Addresses maps names to IP addresses: of hosts with the static
+	// strategies, and of other names such as a load balancer or registry,
+	// which ResolveHostsFile writes to /etc/hosts as well.
+	Addresses map[string]string `yaml:"addresses,omitempty" json:"addresses,omitempty"`
+}
+
+// lookupHost resolves names for ResolveDNS; tests replace it.
+var lookupHost = net.DefaultResolver.LookupHost
+
+func (r *Resolution) strategy() string {
+	if r == nil || r.Strategy == "" {
+		return ResolveDNS
+	}
+	return r.Strategy
+}
+
+func (r *Resolution) validate() []error {
+	var errList []error
+	switch r.strategy() {
+	case ResolveDNS, ResolveStatic, ResolveHostsFile:
+	default:
+		errList = append(errList, fmt.Errorf("spec.resolution: unsupported strategy %q (want %s, %s or %s)", r.Strategy, ResolveDNS, ResolveStatic, ResolveHostsFile))
+	}
+	if r == nil {
+		return errList
+	}
+	for _, name := range sortedKeys(r.Addresses) {
+		if net.ParseIP(r.Addresses[name]) == nil {
+			errList = append(errList, fmt.Errorf("spec.resolution.addresses: %s: %q is not an IP address", name, r.Addresses[name]))
+		}
+	}
+	return errList
+}
+
+// validateResolution checks that the static strategies know the address of
+// every host given by name.
+func (c *Cluster) validateResolution() []error {
+	r := c.Spec.Resolution
+	errList := r.validate()
+	if r.strategy() == ResolveDNS {
+		return errList
+	}
+	for _, h := range c.Spec.Hosts {
+		for _, addr := range []string{h.Address, h.InternalAddress} {
+			if addr != "" && net.ParseIP(addr) == nil && !strings.Contains(addr, ",") && r.Addresses[addr] == "" {
+				errList = append(errList, fmt.Errorf("host %s: %s is not in spec.resolution.addresses", h.Name, addr))
+			}
+		}
+	}
+	return errList
+}
+
+// resolveNames replaces host addresses given as names with IP addresses, as
+// selected by spec.resolution. The SSH address keeps its name with
+// ResolveDNS, since the controller resolves it anyway.
+func (c *Cluster) resolveNames(ctx context.Context) error {
+	r := c.Spec.Resolution
+	var errList []error
+	resolve := func(name string) (string, error) {
+		if name == "" || net.ParseIP(name) != nil || strings.Contains(name, ",") {
+			// Dual-stack internal addresses are given as "IPv4,IPv6".
+			return name, nil
+		}
+		if r.strategy() != ResolveDNS {
+			if ip := r.Addresses[name]; ip != "" {
+				return ip, nil
+			}
+			return "", fmt.Errorf("%s is not in spec.resolution.addresses", name)
+		}
+		addrs, err := lookupHost(ctx, name)
+		if err != nil {
+			return "", err
+		}
+		sort.SliceStable(addrs, func(i, j int) bool {
+			// Prefer IPv4, the family kubeadm advertises by default.
+			return net.ParseIP(addrs[i]).To4() != nil && net.ParseIP(addrs[j]).To4() == nil
+		})
+		return addrs[0], nil
+	}
+	for i := range c.Spec.Hosts {
+		h := &c.Spec.Hosts[i]
+		internal, err := resolve(h.InternalAddress)
+		if err != nil {
+			errList = append(errList, fmt.Errorf("host %s: %w", h.Name, err))
+			continue
+		}
+		h.InternalAddress = internal
+		if r.strategy() != ResolveDNS {
+			// Validate ensures the name is known.
+			h.Address, _ = resolve(h.Address)
+		}
+	}
+	return errors.Join(errList...)
+}
+
+// HostsEntries returns the /etc/hosts entries every node gets with
+// ResolveHostsFile, nil with the other strategies: each host name at its
+// internal address, the names of spec.resolution.addresses and, unless
+// listed there, the control-plane endpoint at the first control-plane host.
+// Registries are mapped by listing their names in spec.resolution.addresses.
+func (c *Cluster) HostsEntries() []etchosts.Entry {
+	r := c.Spec.Resolution
+	if r.strategy() != ResolveHostsFile {
+		return nil
+	}
+	var entries []etchosts.Entry
+	for _, h := range c.Spec.Hosts {
+		if ip := h.GetInternalIPv4Address(); net.ParseIP(ip) != nil {
+			entries = append(entries, etchosts.Entry{Address: ip, Names: []string{h.Name}})
+		}
+	}
+	for _, name := range sortedKeys(r.Addresses) {
+		entries = append(entries, etchosts.Entry{Address: r.Addresses[name], Names: []string{name}})
+	}
+	if endpoint := endpointHost(c.Spec.Kubernetes.ControlPlaneEndpoint); endpoint != "" && net.ParseIP(endpoint) == nil && r.Addresses[endpoint] == "" {
+		if cps := c.HostsByRole(common.RoleControlPlane); len(cps) > 0 {
+			entries = append(entries, etchosts.Entry{Address: cps[0].GetInternalAddress(), Names: []string{endpoint}})
+		}
+	}
+	return etchosts.Normalize(entries)
+}
+
+// endpointHost returns the host part of a host[:port] endpoint.
+func endpointHost(endpoint string) string {
+	if host, _, err := net.SplitHostPort(endpoint); err == nil {
+		return host
+	}
+	return strings.Trim(endpoint, "[]")
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
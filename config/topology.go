@@ -0,0 +1,156 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/mensylisir/xmcores/common"
+	"github.com/mensylisir/xmcores/connector"
+	"github.com/mensylisir/xmcores/modules/kubeadm"
+)
+
+// Topologies of the control plane, see Cluster.Topology.
+const (
+	// TopologyStacked runs an etcd member on every control-plane host.
+	TopologyStacked = "stacked"
+	// TopologyExternalEtcd runs etcd as static pods on dedicated hosts,
+	// which the control-plane hosts reach over the network.
+	TopologyExternalEtcd = "external-etcd"
+)
+
+// roles are the roles spec.roleGroups may assign.
+var roles = []string{common.RoleControlPlane, common.RoleEtcd, common.RoleWorker}
+
+// Topology returns TopologyExternalEtcd when the etcd hosts are not
+// control-plane hosts, else TopologyStacked.
+func (c *Cluster) Topology() string {
+	for _, h := range c.Spec.Hosts {
+		if hasRole(h, common.RoleEtcd) && !hasRole(h, common.RoleControlPlane) {
+			return TopologyExternalEtcd
+		}
+	}
+	return TopologyStacked
+}
+
+// EtcdEndpoints returns the client URLs of the etcd hosts in the
+// TopologyExternalEtcd topology, nil in the stacked one.
+func (c *Cluster) EtcdEndpoints() []string {
+	if c.Topology() != TopologyExternalEtcd {
+		return nil
+	}
+	var endpoints []string
+	for _, h := range c.HostsByRole(common.RoleEtcd) {
+		endpoints = append(endpoints, kubeadm.EtcdEndpoint(h.GetInternalIPv4Address()))
+	}
+	return endpoints
+}
+
+// KubeadmEtcdConfig renders the configuration with which `kubeadm init phase
+// etcd local` starts the etcd member of host, a dedicated etcd host.
+func (c *Cluster) KubeadmEtcdConfig(host connector.Host) ([]byte, error) {
+	var members []kubeadm.EtcdMember
+	for _, h := range c.HostsByRole(common.RoleEtcd) {
+		members = append(members, kubeadm.EtcdMember{Name: h.GetName(), Address: h.GetInternalIPv4Address()})
+	}
+	member := kubeadm.EtcdMember{Name: host.GetName(), Address: host.GetInternalIPv4Address()}
+	docs, err := kubeadm.EtcdDocuments(c.KubeadmParams(host), member, members)
+	if err != nil {
+		return nil, fmt.Errorf("host %s: %w", host.GetName(), err)
+	}
+	return kubeadm.Marshal(docs...)
+}
+
+// applyRoleGroups adds the roles spec.roleGroups assigns to the hosts.
+func (c *Cluster) applyRoleGroups() {
+	for _, role := range c.roleGroupNames() {
+		for _, name := range c.Spec.RoleGroups[role] {
+			for i := range c.Spec.Hosts {
+				if h := &c.Spec.Hosts[i]; h.Name == name && !hasRole(*h, role) {
+					h.Roles = append(h.Roles, role)
+				}
+			}
+		}
+	}
+}
+
+// validateTopology checks spec.roleGroups and the placement of the etcd
+// members: with dedicated etcd hosts their number must be odd, so that a
+// failure of a minority keeps quorum, and no two members, nor a member and a
+// control-plane host, may share a machine, so that one machine failing takes
+// down a single member.
+func (c *Cluster) validateTopology() []error {
+	var errs []error
+	for _, role := range c.roleGroupNames() {
+		if !contains(roles, role) {
+			errs = append(errs, fmt.Errorf("spec.roleGroups: unknown role %q (want one of %v)", role, roles))
+		}
+		for _, name := range c.Spec.RoleGroups[role] {
+			if _, ok := c.host(name); !ok {
+				errs = append(errs, fmt.Errorf("spec.roleGroups.%s: unknown host %q", role, name))
+			}
+		}
+	}
+
+	var etcd, dedicated []Host
+	for _, h := range c.Spec.Hosts {
+		if hasRole(h, common.RoleEtcd) {
+			etcd = append(etcd, h)
+			if !hasRole(h, common.RoleControlPlane) {
+				dedicated = append(dedicated, h)
+			}
+		}
+	}
+	machines := map[string]string{}
+	for _, h := range etcd {
+		if other, ok := machines[h.InternalAddress]; ok && h.InternalAddress != "" {
+			errs = append(errs, fmt.Errorf("etcd hosts %s and %s share the address %s", other, h.Name, h.InternalAddress))
+		}
+		machines[h.InternalAddress] = h.Name
+	}
+	if len(dedicated) == 0 {
+		return errs
+	}
+	if len(dedicated) != len(etcd) {
+		errs = append(errs, fmt.Errorf("etcd must run either on control-plane hosts or on dedicated hosts, not both"))
+	}
+	if len(etcd)%2 == 0 {
+		errs = append(errs, fmt.Errorf("dedicated etcd needs an odd number of hosts to keep quorum, got %d", len(etcd)))
+	}
+	if len(c.HostsByRole(common.RoleControlPlane)) == 0 {
+		errs = append(errs, fmt.Errorf("dedicated etcd needs at least one control-plane host"))
+	}
+	for _, h := range dedicated {
+		if hasRole(h, common.RoleWorker) {
+			errs = append(errs, fmt.Errorf("host %s: dedicated etcd hosts must not be workers", h.Name))
+		}
+	}
+	for _, h := range c.Spec.Hosts {
+		if other, ok := machines[h.InternalAddress]; ok && h.InternalAddress != "" && other != h.Name && hasRole(h, common.RoleControlPlane) {
+			errs = append(errs, fmt.Errorf("control-plane host %s shares the address %s with etcd host %s", h.Name, h.InternalAddress, other))
+		}
+	}
+	return errs
+}
+
+func hasRole(h Host, role string) bool {
+	return contains(h.Roles, role)
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// roleGroupNames returns the roles of spec.roleGroups, sorted.
+func (c *Cluster) roleGroupNames() []string {
+	keys := make([]string, 0, len(c.Spec.RoleGroups))
+	for k := range c.Spec.RoleGroups {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
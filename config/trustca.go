@@ -0,0 +1,23 @@
+package config
+
+import "github.com/mensylisir/xmcores/modules/trustca"
+
+// RegistryCAName names the CA of spec.registry.caFile in the trust store.
+const RegistryCAName = "registry"
+
+// TrustedCAs returns the CAs of spec.trustedCAs and, unless one of them is
+// named RegistryCAName, the CA of spec.registry.caFile trusted for the
+// registry.
+func (c *Cluster) TrustedCAs() []trustca.CA {
+	cas := append([]trustca.CA(nil), c.Spec.TrustedCAs...)
+	r := c.Spec.Registry
+	if r == nil || r.CAFile == "" {
+		return cas
+	}
+	for _, ca := range cas {
+		if ca.Name == RegistryCAName {
+			return cas
+		}
+	}
+	return append(cas, trustca.CA{Name: RegistryCAName, File: r.CAFile, Registries: []string{r.Address}})
+}
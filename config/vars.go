@@ -0,0 +1,105 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/mensylisir/xmcores/connector"
+	"github.com/mensylisir/xmcores/modules"
+	"github.com/mensylisir/xmcores/modules/kubeadm"
+)
+
+// Group gives variables, connection settings and component flags to a set
+// of hosts.
+type Group struct {
+	Name  string                 `yaml:"name" json:"name"`
+	Hosts []string               `yaml:"hosts" json:"hosts"`
+	Vars  map[string]interface{} `yaml:"vars,omitempty" json:"vars,omitempty"`
+	// Connection overrides spec.connection for the hosts, see Connection.
+	Connection *Connection `yaml:"connection,omitempty" json:"connection,omitempty"`
+	// ExtraArgs override the flags of spec.kubernetes for the hosts, see
+	// Cluster.ExtraArgs.
+	kubeadm.ExtraArgs `yaml:",inline" json:",inline"`
+}
+
+// HostVars returns the variables of the host named name: spec.vars, overridden
+// by the vars of each group listing the host in declaration order, overridden
+// by the host's own vars. Values are merged per top-level key.
+func (c *Cluster) HostVars(name string) map[string]interface{} {
+	vars := make(map[string]interface{}, len(c.Spec.Vars))
+	for k, v := range c.Spec.Vars {
+		vars[k] = v
+	}
+	for _, g := range c.Spec.Groups {
+		for _, member := range g.Hosts {
+			if member != name {
+				continue
+			}
+			for k, v := range g.Vars {
+				vars[k] = v
+			}
+		}
+	}
+	if h, ok := c.host(name); ok {
+		for k, v := range h.Vars {
+			vars[k] = v
+		}
+	}
+	return vars
+}
+
+// validateVars checks the groups and that the kubeadmExtra templates render
+// for every host.
+func (c *Cluster) validateVars() []error {
+	var errs []error
+	names := make(map[string]bool, len(c.Spec.Groups))
+	for i, g := range c.Spec.Groups {
+		if g.Name == "" {
+			errs = append(errs, fmt.Errorf("spec.groups[%d]: name must be set", i))
+			continue
+		}
+		if names[g.Name] {
+			errs = append(errs, fmt.Errorf("spec.groups: duplicate group %q", g.Name))
+		}
+		names[g.Name] = true
+		for _, member := range g.Hosts {
+			if _, ok := c.host(member); !ok {
+				errs = append(errs, fmt.Errorf("spec.groups.%s: unknown host %q", g.Name, member))
+			}
+		}
+		if err := g.ExtraArgs.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("spec.groups.%s: %w", g.Name, err))
+		}
+	}
+	for _, h := range c.Hosts() {
+		if _, err := c.kubeadmExtra(h); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// kubeadmExtra returns spec.kubeadmExtra with its string values rendered for
+// host, so per-host settings such as the kubelet node IP or root directory can
+// come from host variables. The settings of spec.profile lie beneath it.
+func (c *Cluster) kubeadmExtra(host connector.Host) (kubeadm.Extra, error) {
+	e := c.Spec.KubeadmExtra
+	var errs []error
+	for _, f := range []struct {
+		name string
+		doc  *map[string]interface{}
+	}{
+		{"initConfiguration", &e.InitConfiguration},
+		{"clusterConfiguration", &e.ClusterConfiguration},
+		{"joinConfiguration", &e.JoinConfiguration},
+		{"kubeletConfiguration", &e.KubeletConfiguration},
+	} {
+		rendered, err := modules.RenderValues(host, *f.doc)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("spec.kubeadmExtra.%s: %w", f.name, err))
+			continue
+		}
+		*f.doc = rendered
+	}
+	return c.profileExtra(e), errors.Join(errs...)
+}
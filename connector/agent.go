@@ -0,0 +1,44 @@
+package connector
+
+import (
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+)
+
+// WindowsAgentPipe 是 Windows 自带的 OpenSSH agent 服务监听的命名管道
+const WindowsAgentPipe = `\\.\pipe\openssh-ssh-agent`
+
+// agentAddress 解析 agent socket 配置. "env:NAME" 形式取环境变量 NAME 的值;
+// 该变量为空时, Windows 上回退到 WindowsAgentPipe (其 OpenSSH 不设置 SSH_AUTH_SOCK), 其它系统保留原始值.
+func agentAddress(socket, who string) string {
+	if !strings.HasPrefix(socket, socketEnvPrefix) {
+		return socket
+	}
+	name := strings.TrimPrefix(socket, socketEnvPrefix)
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	if runtime.GOOS == "windows" {
+		clog().Debugf("环境变量 %s 未设置或为空, %s SSH Agent 使用 OpenSSH 命名管道 %s", name, who, WindowsAgentPipe)
+		return WindowsAgentPipe
+	}
+	clog().Warnf("环境变量 %s 未设置或为空, %s SSH Agent Socket 将尝试使用原始值 %s", name, who, socket)
+	return socket
+}
+
+// isNamedPipe 判断 addr 是否为 Windows 命名管道路径
+func isNamedPipe(addr string) bool {
+	return strings.HasPrefix(addr, `\\.\pipe\`) || strings.HasPrefix(addr, `//./pipe/`)
+}
+
+// dialAgent 连接 SSH agent. 命名管道以文件方式打开 (agent 协议是一问一答, 同步读写即可),
+// 其它地址作为 unix socket 连接.
+func dialAgent(addr string) (io.ReadWriteCloser, error) {
+	if isNamedPipe(addr) {
+		return os.OpenFile(addr, os.O_RDWR, 0)
+	}
+	return net.Dial("unix", addr)
+}
@@ -0,0 +1,73 @@
+package connector
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestAgentAddress(t *testing.T) {
+	assert.Equal(t, "/run/agent.sock", agentAddress("/run/agent.sock", "目标"))
+	t.Setenv("XM_TEST_AGENT", "/run/user/1000/agent.sock")
+	assert.Equal(t, "/run/user/1000/agent.sock", agentAddress("env:XM_TEST_AGENT", "目标"))
+	t.Setenv("XM_TEST_AGENT", "")
+	if runtime.GOOS == "windows" {
+		assert.Equal(t, WindowsAgentPipe, agentAddress("env:XM_TEST_AGENT", "目标"))
+	} else {
+		assert.Equal(t, "env:XM_TEST_AGENT", agentAddress("env:XM_TEST_AGENT", "目标"))
+	}
+
+	assert.True(t, isNamedPipe(WindowsAgentPipe))
+	assert.True(t, isNamedPipe("//./pipe/openssh-ssh-agent"))
+	assert.False(t, isNamedPipe("/tmp/ssh-XXXX/agent.1"))
+}
+
+func TestDialAgent(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix sockets")
+	}
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	keyring := agent.NewKeyring()
+	require.NoError(t, keyring.Add(agent.AddedKey{PrivateKey: key}))
+
+	// Socket paths are limited to about 100 bytes, which t.TempDir can exceed on macOS.
+	dir, err := os.MkdirTemp("", "xm-agent-")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	sock := filepath.Join(dir, "agent.sock")
+	l, err := net.Listen("unix", sock)
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				_ = agent.ServeAgent(keyring, c)
+			}()
+		}
+	}()
+
+	t.Setenv("XM_TEST_AGENT", sock)
+	conn, err := dialAgent(agentAddress("env:XM_TEST_AGENT", "目标"))
+	require.NoError(t, err)
+	defer conn.Close()
+	signers, err := agent.NewClient(conn).Signers()
+	require.NoError(t, err)
+	assert.Len(t, signers, 1)
+
+	_, err = dialAgent(filepath.Join(dir, "missing.sock"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,43 @@
+package connector
+
+import (
+	"bytes"
+	"context"
+	"os/exec"
+	"time"
+
+	"github.com/mensylisir/xmcores/errs"
+	"github.com/mensylisir/xmcores/shellquote"
+)
+
+// ArgvExecutor 由能不经 shell 直接执行程序的连接实现, 参数原样传给程序, 无需引用
+type ArgvExecutor interface {
+	ExecArgv(ctx context.Context, argv []string) (stdout []byte, stderr []byte, exitCode int, err error)
+}
+
+var _ ArgvExecutor = (*dockerConnection)(nil)
+
+// ExecArgs 执行 argv[0], 以 argv[1:] 为参数. 连接实现 ArgvExecutor 时完全绕过 shell;
+// 否则 (如 SSH, 协议只能传递命令行) 每个参数经 shellquote 引用后再交给 Exec,
+// 因此参数中的空格、引号、$() 等都不会被远端 shell 解释.
+func ExecArgs(ctx context.Context, e Executor, argv []string) ([]byte, []byte, int, error) {
+	if len(argv) == 0 {
+		return nil, nil, -1, errs.Newf(CodeEmptyArgv)
+	}
+	if a, ok := e.(ArgvExecutor); ok {
+		return a.ExecArgv(ctx, argv)
+	}
+	return e.Exec(ctx, shellquote.Join(argv...))
+}
+
+// ExecArgv 见 ArgvExecutor, 通过 docker exec 直接执行 argv
+func (c *dockerConnection) ExecArgv(ctx context.Context, argv []string) (stdout []byte, stderr []byte, exitCode int, err error) {
+	defer func(start time.Time) { c.stats.Command(start, exitCode, err) }(time.Now())
+	clog().Debugf("[ExecArgv docker:%s] Argv: %q", c.config.Container, argv)
+	var outBuf, errBuf bytes.Buffer
+	command := exec.CommandContext(ctx, c.config.Binary, append([]string{"exec", c.config.Container}, argv...)...)
+	command.Stdout = &outBuf
+	command.Stderr = &errBuf
+	exitCode, err = c.exitCode(ctx, command.Run())
+	return outBuf.Bytes(), errBuf.Bytes(), exitCode, err
+}
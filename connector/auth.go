@@ -0,0 +1,64 @@
+package connector
+
+import (
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// 认证方式, 见 AuthReporter
+const (
+	AuthPassword  = "password"
+	AuthPublicKey = "publickey"
+	AuthAgent     = "agent"
+)
+
+// AuthReporter 由能报告登录所用认证方式的连接实现
+type AuthReporter interface {
+	// AuthMethod 返回成功登录目标主机的认证方式 (AuthPassword/AuthPublicKey/AuthAgent),
+	// 未知时返回空串
+	AuthMethod() string
+}
+
+var _ AuthReporter = (*connection)(nil)
+
+// authRecorder 记录最后一次尝试的认证方式. SSH 客户端按顺序尝试认证方式, 某一方式
+// 成功即停止, 因此握手完成后记录的就是成功的方式.
+type authRecorder struct {
+	mu     sync.Mutex
+	method string
+}
+
+func (r *authRecorder) tried(method string) {
+	r.mu.Lock()
+	r.method = method
+	r.mu.Unlock()
+}
+
+func (r *authRecorder) get() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.method
+}
+
+func (r *authRecorder) password(password string) ssh.AuthMethod {
+	return ssh.PasswordCallback(func() (string, error) {
+		r.tried(AuthPassword)
+		return password, nil
+	})
+}
+
+func (r *authRecorder) publicKeys(method string, signers ...ssh.Signer) ssh.AuthMethod {
+	return ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+		r.tried(method)
+		return signers, nil
+	})
+}
+
+// AuthMethod 实现 AuthReporter
+func (c *connection) AuthMethod() string {
+	if c.auth == nil {
+		return ""
+	}
+	return c.auth.get()
+}
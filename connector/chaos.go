@@ -0,0 +1,229 @@
+package connector
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/mensylisir/xmcores/errs"
+)
+
+// EnvChaos 开启故障注入, 仅用于开发和 CI, 以便在没有不稳定基础设施的情况下验证重试和回滚逻辑.
+// 取值为逗号分隔的 key=value, 例如 "fail=0.1,delay=0.2,max-delay=2s,seed=42,ops=exec+upload":
+//   - fail: 操作失败的概率 (0-1), 失败以 errs.Transient 错误返回, 与连接抖动一样可被重试
+//   - delay: 操作被延迟的概率 (0-1), 延迟时间在 0 到 max-delay 之间随机, max-delay 默认 1s
+//   - seed: 随机数种子, 默认取当前时间; 实际使用的种子会打印到日志, 以便复现
+//   - ops: 受影响的操作, exec (Exec, PExec) 和/或 upload (UploadFile, Scp), 默认两者
+const EnvChaos = "XM_CHAOS"
+
+// 可注入故障的操作
+const (
+	ChaosExec   = "exec"
+	ChaosUpload = "upload"
+)
+
+// DefaultChaosMaxDelay 是未设置 max-delay 时的最长延迟
+const DefaultChaosMaxDelay = time.Second
+
+// ErrChaos 是注入的失败, 可用 errors.Is 识别
+var ErrChaos = errs.Newf(CodeChaos)
+
+// Chaos 按概率延迟或失败连接上的操作, 可被多个连接并发使用
+type Chaos struct {
+	FailRate  float64
+	DelayRate float64
+	MaxDelay  time.Duration
+	Seed      int64
+	// Ops 为空时影响所有操作
+	Ops []string
+
+	once sync.Once
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+// ParseChaos 解析 EnvChaos 格式的配置
+func ParseChaos(spec string) (*Chaos, error) {
+	c := &Chaos{MaxDelay: DefaultChaosMaxDelay, Seed: time.Now().UnixNano()}
+	for _, field := range strings.Split(spec, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return nil, errs.Newf(CodeChaosField, field)
+		}
+		var err error
+		switch key {
+		case "fail":
+			c.FailRate, err = parseRate(value)
+		case "delay":
+			c.DelayRate, err = parseRate(value)
+		case "max-delay":
+			c.MaxDelay, err = time.ParseDuration(value)
+		case "seed":
+			c.Seed, err = strconv.ParseInt(value, 10, 64)
+		case "ops":
+			for _, op := range strings.Split(value, "+") {
+				if op != ChaosExec && op != ChaosUpload {
+					return nil, errs.Newf(CodeChaosOp, op, ChaosExec, ChaosUpload)
+				}
+				c.Ops = append(c.Ops, op)
+			}
+		default:
+			return nil, errs.Newf(CodeChaosKey, key)
+		}
+		if err != nil {
+			return nil, errs.WrapCode(err, CodeChaosValue, key)
+		}
+	}
+	return c, nil
+}
+
+func parseRate(s string) (float64, error) {
+	r, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	if r < 0 || r > 1 {
+		return 0, errs.Newf(CodeChaosFraction, s)
+	}
+	return r, nil
+}
+
+// ChaosFromEnv 返回 EnvChaos 配置的故障注入, 未设置时返回 nil
+func ChaosFromEnv() (*Chaos, error) {
+	spec := os.Getenv(EnvChaos)
+	if spec == "" {
+		return nil, nil
+	}
+	c, err := ParseChaos(spec)
+	if err != nil {
+		return nil, errs.Wrap(errs.Config, errors.Wrap(err, EnvChaos))
+	}
+	return c, nil
+}
+
+// Wrap 返回在 conn 上注入故障的 Connection, name 用于日志和错误信息. c 为 nil 时原样返回 conn.
+// 包装后的连接不再提供 Shell 和 Forwarder 等可选接口.
+func (c *Chaos) Wrap(conn Connection, name string) Connection {
+	if c == nil {
+		return conn
+	}
+	c.once.Do(func() {
+		c.rand = rand.New(rand.NewSource(c.Seed))
+		clog().Warnf("[Chaos] 故障注入已开启: fail=%g delay=%g max-delay=%s seed=%d", c.FailRate, c.DelayRate, c.MaxDelay, c.Seed)
+	})
+	return &chaosConnection{Connection: conn, chaos: c, name: name}
+}
+
+func (c *Chaos) affects(op string) bool {
+	if len(c.Ops) == 0 {
+		return true
+	}
+	for _, o := range c.Ops {
+		if o == op {
+			return true
+		}
+	}
+	return false
+}
+
+// inject 按概率延迟和失败一次操作, what 描述该操作
+func (c *Chaos) inject(ctx context.Context, op, name, what string) error {
+	if !c.affects(op) {
+		return nil
+	}
+	c.mu.Lock()
+	delay := c.rand.Float64() < c.DelayRate
+	var d time.Duration
+	if delay && c.MaxDelay > 0 {
+		d = time.Duration(c.rand.Int63n(int64(c.MaxDelay)))
+	}
+	fail := c.rand.Float64() < c.FailRate
+	c.mu.Unlock()
+
+	if d > 0 {
+		clog().Debugf("[Chaos %s] %s 延迟 %s", name, what, d)
+		t := time.NewTimer(d)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+	if fail {
+		clog().Warnf("[Chaos %s] %s 注入失败", name, what)
+		return errs.Transient(fmt.Errorf("%s on %s: %w", what, name, ErrChaos))
+	}
+	return nil
+}
+
+// chaosConnection 在 Exec 和上传操作前注入故障, 其余操作直接转发
+type chaosConnection struct {
+	Connection
+	chaos *Chaos
+	name  string
+}
+
+func (c *chaosConnection) Exec(ctx context.Context, cmd string) ([]byte, []byte, int, error) {
+	if err := c.chaos.inject(ctx, ChaosExec, c.name, fmt.Sprintf("exec %q", cmd)); err != nil {
+		return nil, nil, -1, err
+	}
+	return c.Connection.Exec(ctx, cmd)
+}
+
+func (c *chaosConnection) PExec(ctx context.Context, cmd string, stdin io.Reader, stdout io.Writer, stderr io.Writer) (int, error) {
+	if err := c.chaos.inject(ctx, ChaosExec, c.name, fmt.Sprintf("exec %q", cmd)); err != nil {
+		return -1, err
+	}
+	return c.Connection.PExec(ctx, cmd, stdin, stdout, stderr)
+}
+
+func (c *chaosConnection) UploadFile(ctx context.Context, localPath string, remotePath string) error {
+	if err := c.chaos.inject(ctx, ChaosUpload, c.name, "upload "+remotePath); err != nil {
+		return err
+	}
+	return c.Connection.UploadFile(ctx, localPath, remotePath)
+}
+
+func (c *chaosConnection) Scp(ctx context.Context, localReader io.Reader, remotePath string, sizeHint int64, mode os.FileMode) error {
+	if err := c.chaos.inject(ctx, ChaosUpload, c.name, "upload "+remotePath); err != nil {
+		return err
+	}
+	return c.Connection.Scp(ctx, localReader, remotePath, sizeHint, mode)
+}
+
+// CommandShell 转发给被包装的连接, 使 SudoCommand 仍能识别其 shell
+func (c *chaosConnection) CommandShell(ctx context.Context) string {
+	if p, ok := c.Connection.(ShellProvider); ok {
+		return p.CommandShell(ctx)
+	}
+	return DefaultShell
+}
+
+// Umask 转发给被包装的连接
+func (c *chaosConnection) Umask() string {
+	if p, ok := c.Connection.(ShellProvider); ok {
+		return p.Umask()
+	}
+	return ""
+}
+
+// AuthMethod 转发给被包装的连接
+func (c *chaosConnection) AuthMethod() string {
+	if r, ok := c.Connection.(AuthReporter); ok {
+		return r.AuthMethod()
+	}
+	return ""
+}
@@ -0,0 +1,82 @@
+package connector
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mensylisir/xmcores/errs"
+)
+
+// countingConnection counts the operations that reach it.
+type countingConnection struct {
+	Connection
+	execs, uploads int
+}
+
+func (c *countingConnection) Exec(context.Context, string) ([]byte, []byte, int, error) {
+	c.execs++
+	return []byte("ok"), nil, 0, nil
+}
+
+func (c *countingConnection) UploadFile(context.Context, string, string) error {
+	c.uploads++
+	return nil
+}
+
+func TestParseChaos(t *testing.T) {
+	c, err := ParseChaos("fail=0.25, delay=0.5,max-delay=10ms,seed=7,ops=exec+upload")
+	require.NoError(t, err)
+	assert.Equal(t, 0.25, c.FailRate)
+	assert.Equal(t, 0.5, c.DelayRate)
+	assert.Equal(t, 10*time.Millisecond, c.MaxDelay)
+	assert.Equal(t, int64(7), c.Seed)
+	assert.Equal(t, []string{ChaosExec, ChaosUpload}, c.Ops)
+
+	for _, spec := range []string{"fail", "fail=2", "ops=exec+shell", "rate=0.1", "max-delay=soon"} {
+		_, err := ParseChaos(spec)
+		assert.Error(t, err, spec)
+	}
+
+	t.Setenv(EnvChaos, "")
+	c, err = ChaosFromEnv()
+	require.NoError(t, err)
+	assert.Nil(t, c)
+	conn := &countingConnection{}
+	assert.Same(t, Connection(conn), c.Wrap(conn, "node1"), "a nil Chaos leaves connections alone")
+	t.Setenv(EnvChaos, "fail=x")
+	_, err = ChaosFromEnv()
+	assert.Equal(t, errs.Config, errs.KindOf(err))
+}
+
+func TestChaos(t *testing.T) {
+	ctx := context.Background()
+	inner := &countingConnection{}
+	conn := (&Chaos{FailRate: 1, Ops: []string{ChaosExec}}).Wrap(inner, "node1")
+	_, _, code, err := conn.Exec(ctx, "true")
+	assert.Equal(t, -1, code)
+	assert.ErrorIs(t, err, ErrChaos)
+	assert.True(t, errs.IsTransient(err), "injected failures are retried like network glitches")
+	assert.Zero(t, inner.execs)
+	require.NoError(t, conn.UploadFile(ctx, "a", "/tmp/a"), "uploads are not affected")
+	assert.Equal(t, 1, inner.uploads)
+
+	conn = (&Chaos{FailRate: 0.5, Seed: 1}).Wrap(inner, "node1")
+	failed := 0
+	for i := 0; i < 200; i++ {
+		if _, _, _, err := conn.Exec(ctx, "true"); err != nil {
+			failed++
+		}
+	}
+	assert.InDelta(t, 100, failed, 30)
+	assert.Equal(t, 200-failed, inner.execs)
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	conn = (&Chaos{DelayRate: 1, MaxDelay: time.Hour}).Wrap(inner, "node1")
+	err = conn.UploadFile(cancelled, "a", "/tmp/a")
+	assert.ErrorIs(t, err, context.Canceled)
+}
@@ -0,0 +1,170 @@
+package connectortest_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mensylisir/xmcores/connector"
+	"github.com/mensylisir/xmcores/connector/connectortest"
+)
+
+func TestFakeExec(t *testing.T) {
+	ctx := context.Background()
+	f := connectortest.NewFake().
+		On(`^uname -m$`, connectortest.Result{Stdout: "x86_64\n"}).
+		On(`systemctl is-active`, connectortest.Result{Stdout: "inactive\n", ExitCode: 3}).
+		On(`unreachable`, connectortest.Result{Err: errors.New("connection reset")})
+
+	stdout, _, code, err := f.Exec(ctx, "uname -m")
+	require.NoError(t, err)
+	assert.Equal(t, "x86_64\n", string(stdout))
+	assert.Zero(t, code)
+
+	_, _, code, err = f.Exec(ctx, connector.SudoPrefix("systemctl is-active kubelet"))
+	require.NoError(t, err)
+	assert.Equal(t, 3, code)
+
+	_, _, _, err = f.Exec(ctx, "unreachable")
+	assert.Error(t, err)
+
+	_, _, code, err = f.Exec(ctx, "true")
+	require.NoError(t, err)
+	assert.Zero(t, code, "unmatched commands succeed by default")
+
+	f.SetDefault(connectortest.Result{ExitCode: 127})
+	var out strings.Builder
+	code, err = f.PExec(ctx, "missing", strings.NewReader("input"), &out, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 127, code)
+
+	assert.Equal(t, []string{"uname -m", connector.SudoPrefix("systemctl is-active kubelet"), "unreachable", "true", "missing"}, f.Commands())
+	assert.True(t, f.Ran(`kubelet`))
+	assert.False(t, f.Ran(`kubeadm`))
+}
+
+func TestFakeFiles(t *testing.T) {
+	ctx := context.Background()
+	f := connectortest.NewFake()
+
+	require.NoError(t, f.Scp(ctx, strings.NewReader("data"), "/etc/xmcores/a.conf", 4, 0600))
+	info, err := f.StatRemote(ctx, "/etc/xmcores/a.conf")
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), info.Size())
+	assert.Equal(t, os.FileMode(0600), info.Mode())
+
+	ok, err := f.RemoteDirExist(ctx, "/etc/xmcores")
+	require.NoError(t, err)
+	assert.True(t, ok, "parent directories are created")
+	ok, err = f.RemoteFileExist(ctx, "/etc/xmcores")
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	_, err = f.StatRemote(ctx, "/missing")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	require.NoError(t, f.Chmod(ctx, "/etc/xmcores/a.conf", 0644))
+	info, err = f.StatRemote(ctx, "/etc/xmcores/a.conf")
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0644), info.Mode())
+
+	require.NoError(t, f.MkDirAll(ctx, "/var/lib/xmcores/cache", 0755))
+	assert.Error(t, f.MkDirAll(ctx, "/etc/xmcores/a.conf/sub", 0755))
+
+	local := filepath.Join(t.TempDir(), "a.conf")
+	require.NoError(t, f.DownloadFile(ctx, "/etc/xmcores/a.conf", local))
+	require.NoError(t, f.UploadFile(ctx, local, "/tmp/copy"))
+	data, ok := f.ReadFile("/tmp/copy")
+	require.True(t, ok)
+	assert.Equal(t, "data", string(data))
+	assert.Equal(t, []string{"/etc/xmcores/a.conf", "/tmp/copy"}, f.Files())
+
+	require.NoError(t, f.Close())
+	_, _, _, err = f.Exec(ctx, "true")
+	assert.Error(t, err, "closed connections fail")
+}
+
+func TestConnector(t *testing.T) {
+	ctx := context.Background()
+	c := connectortest.NewConnector()
+	c.Host("node1").On(`hostname`, connectortest.Result{Stdout: "node1"})
+	c.FailHost("node2", errors.New("no route to host"))
+
+	node1 := connector.NewHost()
+	node1.SetName("node1")
+	conn, err := c.Connect(ctx, node1)
+	require.NoError(t, err)
+	stdout, _, _, err := conn.Exec(ctx, "hostname")
+	require.NoError(t, err)
+	assert.Equal(t, "node1", string(stdout))
+	assert.Same(t, c.Host("node1"), conn)
+
+	node2 := connector.NewHost()
+	node2.SetName("node2")
+	_, err = c.Dial(node2)
+	assert.Error(t, err)
+
+	require.NoError(t, c.Close())
+	assert.True(t, c.Host("node1").Closed())
+}
+
+func TestSSHServer(t *testing.T) {
+	ctx := context.Background()
+	fake := connectortest.NewFake().
+		On(`^echo hello$`, connectortest.Result{Stdout: "hello\n"}).
+		On(`^fail$`, connectortest.Result{Stderr: "boom\n", ExitCode: 2})
+	srv := connectortest.NewSSHServer(t, fake.Run)
+
+	for name, cfg := range map[string]connector.Config{"password": srv.Config(), "key": srv.KeyConfig()} {
+		t.Run(name, func(t *testing.T) {
+			conn, err := connector.NewConnection(cfg)
+			require.NoError(t, err)
+			defer conn.Close()
+			want := map[string]string{"password": connector.AuthPassword, "key": connector.AuthPublicKey}[name]
+			assert.Equal(t, want, conn.(connector.AuthReporter).AuthMethod())
+
+			stdout, _, code, err := conn.Exec(ctx, "echo hello")
+			require.NoError(t, err)
+			assert.Zero(t, code)
+			assert.Equal(t, "hello", strings.TrimSpace(string(stdout)))
+
+			// The SSH connection reports a non-zero exit as an *ssh.ExitError as well.
+			stdout, _, code, err = conn.Exec(ctx, "fail")
+			assert.Error(t, err)
+			assert.Equal(t, 2, code)
+			assert.Contains(t, string(stdout), "boom", "the PTY merges stderr into stdout")
+		})
+	}
+	assert.True(t, fake.Ran(`^echo hello$`))
+
+	t.Run("sftp", func(t *testing.T) {
+		conn, err := connector.NewConnection(srv.Config())
+		require.NoError(t, err)
+		defer conn.Close()
+
+		require.NoError(t, conn.Scp(ctx, strings.NewReader("payload"), "/tmp/xmcores/file", 7, 0644))
+		ok, err := conn.RemoteFileExist(ctx, "/tmp/xmcores/file")
+		require.NoError(t, err)
+		assert.True(t, ok)
+		rc, err := conn.Fetch(ctx, "/tmp/xmcores/file")
+		require.NoError(t, err)
+		defer rc.Close()
+		data, err := io.ReadAll(rc)
+		require.NoError(t, err)
+		assert.Equal(t, "payload", string(data))
+	})
+
+	t.Run("wrong password", func(t *testing.T) {
+		cfg := srv.Config()
+		cfg.Password = "wrong"
+		_, err := connector.NewConnection(cfg)
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,482 @@
+// Package connectortest 提供 connector 接口的测试替身: 可编排命令响应、带内存文件系统的
+// Fake 连接, 按主机分配 Fake 的 Connector, 以及进程内的 SSH 服务端, 使模块和步骤的
+// 单元测试无需真实主机即可在 CI 中运行.
+package connectortest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/mensylisir/xmcores/connector"
+	"github.com/mensylisir/xmcores/errs"
+)
+
+// Result 是一条命令的编排结果. Err 非空时表示传输错误, 与 Connection.Exec 的 err 返回值对应.
+type Result struct {
+	Stdout   string
+	Stderr   string
+	ExitCode int
+	Err      error
+}
+
+// Handler 根据命令返回其结果
+type Handler func(cmd string) Result
+
+type rule struct {
+	match func(cmd string) bool
+	fn    Handler
+}
+
+type file struct {
+	data    []byte
+	mode    os.FileMode
+	modTime time.Time
+}
+
+// Fake 是内存实现的 connector.Connection. 命令按注册顺序匹配规则, 第一条匹配的规则生效;
+// 没有规则匹配时返回 SetDefault 设置的结果 (默认为退出码 0 的空输出).
+// 文件操作作用于内存文件系统, 不会执行任何命令. Fake 可被并发使用.
+type Fake struct {
+	mu       sync.Mutex
+	rules    []rule
+	fallback Result
+	commands []string
+	files    map[string]*file
+	closed   bool
+	stats    connector.StatsCounter
+	// reconnect 决定 Reconnect 的结果, 见 OnReconnect
+	reconnect  func() error
+	reconnects int
+}
+
+var (
+	_ connector.Connection    = (*Fake)(nil)
+	_ connector.StatsReporter = (*Fake)(nil)
+	_ connector.Reconnector   = (*Fake)(nil)
+)
+
+// NewFake 返回只包含根目录的 Fake
+func NewFake() *Fake {
+	return &Fake{files: map[string]*file{"/": {mode: os.ModeDir | 0755, modTime: time.Now()}}}
+}
+
+// On 为匹配正则表达式 pattern 的命令编排固定结果. 命令在匹配前未做 sudo 解包,
+// 因此 pattern 通常只需匹配命令中的关键部分.
+func (f *Fake) On(pattern string, r Result) *Fake {
+	re := regexp.MustCompile(pattern)
+	return f.OnFunc(re.MatchString, func(string) Result { return r })
+}
+
+// OnFunc 为 match 返回 true 的命令注册动态结果
+func (f *Fake) OnFunc(match func(cmd string) bool, fn Handler) *Fake {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rules = append(f.rules, rule{match: match, fn: fn})
+	return f
+}
+
+// SetDefault 设置没有规则匹配时的结果
+func (f *Fake) SetDefault(r Result) *Fake {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fallback = r
+	return f
+}
+
+// Run 记录并解析命令, 返回编排的结果. 它满足 Handler, 可直接作为 SSHServer 的处理函数.
+func (f *Fake) Run(cmd string) Result {
+	f.mu.Lock()
+	f.commands = append(f.commands, cmd)
+	rules := append([]rule(nil), f.rules...)
+	fallback := f.fallback
+	f.mu.Unlock()
+	// 规则在锁外执行, 以便处理函数可以访问 Fake 的文件系统
+	for _, r := range rules {
+		if r.match(cmd) {
+			return r.fn(cmd)
+		}
+	}
+	return fallback
+}
+
+// Commands 返回已执行命令的副本, 按执行顺序排列
+func (f *Fake) Commands() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.commands...)
+}
+
+// Ran 报告是否执行过匹配正则表达式 pattern 的命令
+func (f *Fake) Ran(pattern string) bool {
+	re := regexp.MustCompile(pattern)
+	for _, cmd := range f.Commands() {
+		if re.MatchString(cmd) {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteFile 在内存文件系统中写入文件, 并自动创建其父目录
+func (f *Fake) WriteFile(name string, data []byte, mode os.FileMode) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.writeLocked(name, data, mode)
+}
+
+// ReadFile 返回内存文件系统中文件的内容
+func (f *Fake) ReadFile(name string) ([]byte, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fi, ok := f.files[path.Clean(name)]
+	if !ok || fi.mode.IsDir() {
+		return nil, false
+	}
+	return append([]byte(nil), fi.data...), true
+}
+
+// Files 返回内存文件系统中所有普通文件的路径, 按字典序排列
+func (f *Fake) Files() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var names []string
+	for name, fi := range f.files {
+		if !fi.mode.IsDir() {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (f *Fake) writeLocked(name string, data []byte, mode os.FileMode) {
+	name = path.Clean(name)
+	f.mkdirLocked(path.Dir(name), 0755)
+	f.files[name] = &file{data: append([]byte(nil), data...), mode: mode.Perm(), modTime: time.Now()}
+}
+
+func (f *Fake) mkdirLocked(dir string, mode os.FileMode) error {
+	dir = path.Clean(dir)
+	if fi, ok := f.files[dir]; ok {
+		if !fi.mode.IsDir() {
+			return errors.Errorf("%s 已存在且不是目录", dir)
+		}
+		return nil
+	}
+	if dir != "/" && dir != "." {
+		if err := f.mkdirLocked(path.Dir(dir), mode); err != nil {
+			return err
+		}
+	}
+	f.files[dir] = &file{mode: os.ModeDir | mode.Perm(), modTime: time.Now()}
+	return nil
+}
+
+func (f *Fake) lookup(name string) (*file, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return nil, errs.Newf(connector.CodeConnClosed)
+	}
+	fi, ok := f.files[path.Clean(name)]
+	if !ok {
+		return nil, errors.Wrapf(os.ErrNotExist, "stat %s", name)
+	}
+	return fi, nil
+}
+
+func (f *Fake) checkOpen(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return errs.Newf(connector.CodeConnClosed)
+	}
+	return nil
+}
+
+// Close 关闭连接, 之后的操作均返回错误
+func (f *Fake) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	return nil
+}
+
+// OnReconnect 设置 Reconnect 的结果: fn 返回错误时重新连接失败, 连接保持关闭
+func (f *Fake) OnReconnect(fn func() error) *Fake {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.reconnect = fn
+	return f
+}
+
+// Reconnect 实现 connector.Reconnector, 重新打开连接. 默认总是成功.
+func (f *Fake) Reconnect(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	f.closed = true
+	f.reconnects++
+	fn := f.reconnect
+	f.mu.Unlock()
+	if fn != nil {
+		if err := fn(); err != nil {
+			return err
+		}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = false
+	return nil
+}
+
+// Reconnects 返回 Reconnect 被调用的次数
+func (f *Fake) Reconnects() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.reconnects
+}
+
+// Closed 报告连接是否已关闭
+func (f *Fake) Closed() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.closed
+}
+
+func (f *Fake) Exec(ctx context.Context, cmd string) (stdout []byte, stderr []byte, exitCode int, err error) {
+	defer func(start time.Time) { f.stats.Command(start, exitCode, err) }(time.Now())
+	if err := f.checkOpen(ctx); err != nil {
+		return nil, nil, -1, err
+	}
+	r := f.Run(cmd)
+	if r.Err != nil {
+		return []byte(r.Stdout), []byte(r.Stderr), -1, r.Err
+	}
+	return []byte(r.Stdout), []byte(r.Stderr), r.ExitCode, nil
+}
+
+// PExec 与 Exec 相同, stdin 被读取并丢弃
+func (f *Fake) PExec(ctx context.Context, cmd string, stdin io.Reader, stdout io.Writer, stderr io.Writer) (exitCode int, err error) {
+	defer func(start time.Time) { f.stats.Command(start, exitCode, err) }(time.Now())
+	if err := f.checkOpen(ctx); err != nil {
+		return -1, err
+	}
+	if stdin != nil {
+		if _, err := io.Copy(io.Discard, stdin); err != nil {
+			return -1, errors.Wrap(err, "读取 stdin 失败")
+		}
+	}
+	r := f.Run(cmd)
+	if stdout != nil {
+		_, _ = io.WriteString(stdout, r.Stdout)
+	}
+	if stderr != nil {
+		_, _ = io.WriteString(stderr, r.Stderr)
+	}
+	if r.Err != nil {
+		return -1, r.Err
+	}
+	return r.ExitCode, nil
+}
+
+func (f *Fake) Fetch(ctx context.Context, remotePath string) (io.ReadCloser, error) {
+	if err := f.checkOpen(ctx); err != nil {
+		return nil, err
+	}
+	data, ok := f.ReadFile(remotePath)
+	if !ok {
+		f.stats.Downloaded(0, os.ErrNotExist)
+		return nil, errs.WrapCode(os.ErrNotExist, connector.CodeRemoteRead, remotePath)
+	}
+	return f.stats.DownloadReader(io.NopCloser(bytes.NewReader(data))), nil
+}
+
+func (f *Fake) DownloadFile(ctx context.Context, remotePath string, localPath string) error {
+	rc, err := f.Fetch(ctx, remotePath)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return err
+	}
+	return errs.WrapCode(os.WriteFile(localPath, data, 0644), connector.CodeLocalWrite, localPath)
+}
+
+func (f *Fake) UploadFile(ctx context.Context, localPath string, remotePath string) error {
+	data, err := os.ReadFile(localPath)
+	if err != nil {
+		return errs.WrapCode(err, connector.CodeLocalOpen, localPath)
+	}
+	return f.Scp(ctx, bytes.NewReader(data), remotePath, int64(len(data)), 0644)
+}
+
+// Scp 将内容写入内存文件系统, 父目录不存在时自动创建
+func (f *Fake) Scp(ctx context.Context, localReader io.Reader, remotePath string, sizeHint int64, mode os.FileMode) error {
+	if err := f.checkOpen(ctx); err != nil {
+		return err
+	}
+	if localReader == nil {
+		return errs.Newf(connector.CodeNilReader)
+	}
+	data, err := io.ReadAll(localReader)
+	f.stats.Uploaded(int64(len(data)), err)
+	if err != nil {
+		return errs.WrapCode(err, connector.CodeLocalRead)
+	}
+	f.WriteFile(remotePath, data, mode)
+	return nil
+}
+
+// Stats 实现 connector.StatsReporter, 统计 Fake 上执行的命令和传输的字节
+func (f *Fake) Stats() connector.Stats {
+	return f.stats.Stats()
+}
+
+func (f *Fake) StatRemote(ctx context.Context, remotePath string) (os.FileInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	fi, err := f.lookup(remotePath)
+	if err != nil {
+		return nil, err
+	}
+	return fileInfo{name: path.Base(remotePath), size: int64(len(fi.data)), mode: fi.mode, modTime: fi.modTime}, nil
+}
+
+func (f *Fake) RemoteFileExist(ctx context.Context, remotePath string) (bool, error) {
+	info, err := f.StatRemote(ctx, remotePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return info.Mode().IsRegular(), nil
+}
+
+func (f *Fake) RemoteDirExist(ctx context.Context, remotePath string) (bool, error) {
+	info, err := f.StatRemote(ctx, remotePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return info.IsDir(), nil
+}
+
+func (f *Fake) MkDirAll(ctx context.Context, remotePath string, mode os.FileMode) error {
+	if err := f.checkOpen(ctx); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.mkdirLocked(remotePath, mode)
+}
+
+func (f *Fake) Chmod(ctx context.Context, remotePath string, mode os.FileMode) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	fi, err := f.lookup(remotePath)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fi.mode = fi.mode&os.ModeType | mode.Perm()
+	return nil
+}
+
+type fileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (i fileInfo) Name() string       { return i.name }
+func (i fileInfo) Size() int64        { return i.size }
+func (i fileInfo) Mode() os.FileMode  { return i.mode }
+func (i fileInfo) ModTime() time.Time { return i.modTime }
+func (i fileInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i fileInfo) Sys() interface{}   { return nil }
+
+// Connector 为每台主机 (按主机名) 分配一个 Fake, 实现 connector.Connector.
+type Connector struct {
+	mu    sync.Mutex
+	fakes map[string]*Fake
+	// fail 中的主机连接时返回对应的错误
+	fail map[string]error
+}
+
+var _ connector.Connector = (*Connector)(nil)
+
+// NewConnector 返回空的 Connector
+func NewConnector() *Connector {
+	return &Connector{fakes: map[string]*Fake{}, fail: map[string]error{}}
+}
+
+// Host 返回主机 name 的 Fake, 不存在时创建, 以便在连接前编排响应
+func (c *Connector) Host(name string) *Fake {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f, ok := c.fakes[name]
+	if !ok {
+		f = NewFake()
+		c.fakes[name] = f
+	}
+	return f
+}
+
+// FailHost 使主机 name 的连接返回 err
+func (c *Connector) FailHost(name string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.fail[name] = err
+}
+
+// Dial 返回主机的 Fake. 其签名与 modules.Dialer 一致, 可直接传给 modules.ConnectWith.
+func (c *Connector) Dial(host connector.Host) (connector.Connection, error) {
+	c.mu.Lock()
+	err := c.fail[host.GetName()]
+	c.mu.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("连接 %s 失败: %w", host.GetName(), err)
+	}
+	return c.Host(host.GetName()), nil
+}
+
+func (c *Connector) Connect(ctx context.Context, host connector.Host) (connector.Connection, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.Dial(host)
+}
+
+// Close 关闭所有已分配的 Fake
+func (c *Connector) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, f := range c.fakes {
+		_ = f.Close()
+	}
+	return nil
+}
@@ -0,0 +1,279 @@
+package connectortest
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/pem"
+	"io"
+	"net"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/mensylisir/xmcores/connector"
+)
+
+const (
+	// DefaultUser 和 DefaultPassword 是 SSHServer 接受的默认凭据
+	DefaultUser     = "xmcores"
+	DefaultPassword = "xmcores"
+)
+
+// SSHServer 是监听在回环地址上的进程内 SSH 服务端, 用于在不依赖真实主机的情况下测试
+// connector 的 SSH 实现. exec 请求交给 Handler 处理; 申请了 PTY 的会话与真实终端一样把
+// stderr 合并到 stdout; sftp 子系统由服务端共享的内存文件系统提供, 与 Handler 互不相通.
+type SSHServer struct {
+	// Addr 是 "127.0.0.1:<port>" 形式的监听地址
+	Addr string
+	Host string
+	Port int
+	// ClientKey 是服务端接受的客户端私钥 (PEM), 与密码认证二选一使用
+	ClientKey string
+
+	listener net.Listener
+	config   *ssh.ServerConfig
+	handler  Handler
+	sftp     sftp.Handlers
+	wg       sync.WaitGroup
+	noSFTP   atomic.Bool
+	mu       sync.Mutex
+	conns    map[net.Conn]struct{}
+}
+
+// Shell 是在本机用 /bin/bash 执行命令的 Handler, 用于需要真实执行效果的测试 (例如 exec 方式的文件传输).
+// 命令作用于本机文件系统, 测试应只操作 t.TempDir() 下的路径.
+func Shell(cmd string) Result {
+	var stdout, stderr bytes.Buffer
+	c := exec.Command("/bin/bash", "-c", cmd)
+	c.Stdout = &stdout
+	c.Stderr = &stderr
+	err := c.Run()
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+	case errors.As(err, &exitErr):
+		return Result{Stdout: stdout.String(), Stderr: stderr.String(), ExitCode: exitErr.ExitCode()}
+	default:
+		return Result{Err: err}
+	}
+	return Result{Stdout: stdout.String(), Stderr: stderr.String()}
+}
+
+// NewSSHServer 启动 SSHServer, 测试结束时自动关闭. handler 为 nil 时所有命令返回退出码 127.
+func NewSSHServer(t testing.TB, handler Handler) *SSHServer {
+	t.Helper()
+	if handler == nil {
+		handler = func(cmd string) Result {
+			return Result{Stderr: "command not found: " + cmd + "\n", ExitCode: 127}
+		}
+	}
+
+	_, hostPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("生成主机密钥失败: %v", err)
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostPriv)
+	if err != nil {
+		t.Fatalf("创建主机密钥签名器失败: %v", err)
+	}
+	_, clientPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("生成客户端密钥失败: %v", err)
+	}
+	clientSigner, err := ssh.NewSignerFromKey(clientPriv)
+	if err != nil {
+		t.Fatalf("创建客户端密钥签名器失败: %v", err)
+	}
+	block, err := ssh.MarshalPrivateKey(clientPriv, "")
+	if err != nil {
+		t.Fatalf("编码客户端私钥失败: %v", err)
+	}
+	authorized := string(clientSigner.PublicKey().Marshal())
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if c.User() == DefaultUser && string(password) == DefaultPassword {
+				return nil, nil
+			}
+			return nil, errors.New("密码错误")
+		},
+		PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if c.User() == DefaultUser && string(key.Marshal()) == authorized {
+				return nil, nil
+			}
+			return nil, errors.New("未授权的公钥")
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("监听回环地址失败: %v", err)
+	}
+	addr := l.Addr().(*net.TCPAddr)
+	s := &SSHServer{
+		Addr:      addr.String(),
+		Host:      addr.IP.String(),
+		Port:      addr.Port,
+		ClientKey: string(pem.EncodeToMemory(block)),
+		listener:  l,
+		config:    config,
+		handler:   handler,
+		sftp:      sftp.InMemHandler(),
+		conns:     map[net.Conn]struct{}{},
+	}
+	s.wg.Add(1)
+	go s.serve()
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Config 返回使用密码认证连接到该服务端的 connector.Config
+func (s *SSHServer) Config() connector.Config {
+	return connector.Config{Username: DefaultUser, Password: DefaultPassword, Address: s.Host, Port: s.Port}
+}
+
+// KeyConfig 返回使用私钥认证连接到该服务端的 connector.Config
+func (s *SSHServer) KeyConfig() connector.Config {
+	return connector.Config{Username: DefaultUser, PrivateKey: s.ClientKey, Address: s.Host, Port: s.Port}
+}
+
+// NewHost 返回指向该服务端的 connector.Host, 可交给 modules.ConnectWith 使用真实的 SSH 连接
+func (s *SSHServer) NewHost(name string) connector.Host {
+	h := connector.NewHost()
+	h.SetName(name)
+	h.SetAddress(s.Host)
+	h.SetInternalAddress(s.Host)
+	h.SetPort(s.Port)
+	h.SetUser(DefaultUser)
+	h.SetPassword(DefaultPassword)
+	return h
+}
+
+// DisableSFTP 使之后的 sftp 子系统请求被拒绝, 模拟禁用了 SFTP 的 sshd
+func (s *SSHServer) DisableSFTP() {
+	s.noSFTP.Store(true)
+}
+
+// Close 停止监听, 断开所有连接并等待其处理结束
+func (s *SSHServer) Close() {
+	_ = s.listener.Close()
+	s.mu.Lock()
+	for nc := range s.conns {
+		_ = nc.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+func (s *SSHServer) serve() {
+	defer s.wg.Done()
+	for {
+		nc, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns[nc] = struct{}{}
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handleConn(nc)
+			s.mu.Lock()
+			delete(s.conns, nc)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+func (s *SSHServer) handleConn(nc net.Conn) {
+	conn, chans, reqs, err := ssh.NewServerConn(nc, s.config)
+	if err != nil {
+		_ = nc.Close()
+		return
+	}
+	defer conn.Close()
+	go ssh.DiscardRequests(reqs)
+
+	var wg sync.WaitGroup
+	for newCh := range chans {
+		if newCh.ChannelType() != "session" {
+			_ = newCh.Reject(ssh.UnknownChannelType, "只支持 session 通道")
+			continue
+		}
+		ch, chReqs, err := newCh.Accept()
+		if err != nil {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.handleSession(ch, chReqs)
+		}()
+	}
+	wg.Wait()
+}
+
+func (s *SSHServer) handleSession(ch ssh.Channel, reqs <-chan *ssh.Request) {
+	defer ch.Close()
+	pty := false
+	for req := range reqs {
+		switch req.Type {
+		case "pty-req":
+			pty = true
+			_ = req.Reply(true, nil)
+		case "env":
+			_ = req.Reply(true, nil)
+		case "exec":
+			var payload struct{ Command string }
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+				_ = req.Reply(false, nil)
+				continue
+			}
+			_ = req.Reply(true, nil)
+			go ssh.DiscardRequests(reqs)
+			s.exec(ch, payload.Command, pty)
+			return
+		case "subsystem":
+			var payload struct{ Name string }
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil || payload.Name != "sftp" || s.noSFTP.Load() {
+				_ = req.Reply(false, nil)
+				continue
+			}
+			_ = req.Reply(true, nil)
+			go ssh.DiscardRequests(reqs)
+			server := sftp.NewRequestServer(ch, s.sftp)
+			if err := server.Serve(); err == io.EOF {
+				_ = server.Close()
+			}
+			return
+		default:
+			_ = req.Reply(false, nil)
+		}
+	}
+}
+
+func (s *SSHServer) exec(ch ssh.Channel, cmd string, pty bool) {
+	r := s.handler(cmd)
+	_, _ = io.WriteString(ch, r.Stdout)
+	if pty {
+		_, _ = io.WriteString(ch, r.Stderr)
+	} else {
+		_, _ = io.WriteString(ch.Stderr(), r.Stderr)
+	}
+	if r.Err != nil {
+		// 传输错误: 不发送退出状态直接关闭通道, 客户端会得到 ExitMissingError
+		return
+	}
+	status := make([]byte, 4)
+	binary.BigEndian.PutUint32(status, uint32(r.ExitCode))
+	_, _ = ch.SendRequest("exit-status", false, status)
+}
@@ -0,0 +1,284 @@
+package connector
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/mensylisir/xmcores/errs"
+	"github.com/mensylisir/xmcores/shellquote"
+)
+
+// DefaultDockerBinary 是 DockerConfig.Binary 为空时使用的 docker 命令
+const DefaultDockerBinary = "docker"
+
+// DockerConfig 标识本地 Docker 守护进程上的一个节点容器
+type DockerConfig struct {
+	Container string
+	// Binary 是 docker CLI, 为空时使用 DefaultDockerBinary
+	Binary string
+}
+
+// dockerConnection 通过 `docker exec` 实现 Connection 接口, 用于 local-docker 运行时.
+// 命令以容器的默认用户 (通常为 root) 执行; 节点镜像需提供 sudo 或等效的包装脚本,
+// 因为上层模块统一使用 SudoCommand 包装命令.
+type dockerConnection struct {
+	config DockerConfig
+	shell  shellState
+	stats  StatsCounter
+}
+
+var _ Connection = (*dockerConnection)(nil)
+
+// NewDockerConnection 检查容器处于运行状态并返回其 Connection, 失败时返回 errs.Connectivity 类别的错误
+func NewDockerConnection(cfg DockerConfig) (Connection, error) {
+	if cfg.Container == "" {
+		return nil, errs.Wrap(errs.Connectivity, errs.Newf(CodeNoContainer))
+	}
+	if cfg.Binary == "" {
+		cfg.Binary = DefaultDockerBinary
+	}
+	c := &dockerConnection{config: cfg}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, cfg.Binary, "inspect", "-f", "{{.State.Running}}", cfg.Container).CombinedOutput()
+	if err != nil {
+		return nil, errs.Wrap(errs.Connectivity, errs.WrapCode(err, CodeContainerInspect, cfg.Container, strings.TrimSpace(string(out))))
+	}
+	if strings.TrimSpace(string(out)) != "true" {
+		return nil, errs.Wrap(errs.Connectivity, classify(errs.Newf(CodeContainerNotRunning, cfg.Container), ErrHostUnreachable))
+	}
+	clog().Debugf("[Docker %s] 已连接", cfg.Container)
+	return c, nil
+}
+
+func (c *dockerConnection) Close() error {
+	return nil
+}
+
+// CommandShell 见 ShellProvider, 探测容器中是否有 DefaultShell
+func (c *dockerConnection) CommandShell(ctx context.Context) string {
+	return c.shell.detect(ctx, "", func(ctx context.Context, cmd string) int {
+		code, _ := c.runWith(ctx, FallbackShell, cmd, nil, io.Discard, io.Discard)
+		return code
+	})
+}
+
+// Umask 见 ShellProvider, 容器中的命令沿用默认 umask
+func (c *dockerConnection) Umask() string {
+	return ""
+}
+
+// run 在容器中以 CommandShell 执行 cmd. 命令本身的非零退出码通过 exitCode 返回, err 仅表示 docker 调用失败.
+func (c *dockerConnection) run(ctx context.Context, cmd string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	return c.runWith(ctx, c.CommandShell(ctx), cmd, stdin, stdout, stderr)
+}
+
+func (c *dockerConnection) runWith(ctx context.Context, shell, cmd string, stdin io.Reader, stdout, stderr io.Writer) (exitCode int, err error) {
+	defer func(start time.Time) { c.stats.Command(start, exitCode, err) }(time.Now())
+	args := []string{"exec"}
+	if stdin != nil {
+		args = append(args, "-i")
+	}
+	args = append(args, c.config.Container, shell, "-c", cmd)
+	command := exec.CommandContext(ctx, c.config.Binary, args...)
+	command.Stdin = stdin
+	command.Stdout = stdout
+	command.Stderr = stderr
+	return c.exitCode(ctx, command.Run())
+}
+
+// exitCode 把 docker exec 的结果 err 转换为命令的退出码
+func (c *dockerConnection) exitCode(ctx context.Context, err error) (int, error) {
+	if err == nil {
+		return 0, nil
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && ctx.Err() == nil {
+		// 125 表示 docker 本身失败 (例如容器已停止), 126/127 表示 shell 或程序无法执行
+		if code := exitErr.ExitCode(); code != 125 {
+			return code, nil
+		}
+	}
+	return -1, errs.WrapCode(err, CodeContainerExec, c.config.Container)
+}
+
+func (c *dockerConnection) Exec(ctx context.Context, cmd string) (stdout []byte, stderr []byte, exitCode int, err error) {
+	clog().Debugf("[Exec docker:%s] Cmd: %s", c.config.Container, cmd)
+	var outBuf, errBuf bytes.Buffer
+	exitCode, err = c.run(ctx, cmd, nil, &outBuf, &errBuf)
+	return outBuf.Bytes(), errBuf.Bytes(), exitCode, err
+}
+
+func (c *dockerConnection) PExec(ctx context.Context, cmd string, stdin io.Reader, stdout io.Writer, stderr io.Writer) (exitCode int, err error) {
+	clog().Debugf("[PExec docker:%s] Cmd: %s", c.config.Container, cmd)
+	if stdout == nil {
+		stdout = io.Discard
+	}
+	if stderr == nil {
+		stderr = io.Discard
+	}
+	return c.run(ctx, cmd, stdin, stdout, stderr)
+}
+
+// check 执行 cmd, 非零退出码作为错误返回, 错误信息包含 stderr
+func (c *dockerConnection) check(ctx context.Context, cmd string, stdin io.Reader) ([]byte, error) {
+	var outBuf, errBuf bytes.Buffer
+	exitCode, err := c.run(ctx, cmd, stdin, &outBuf, &errBuf)
+	if err != nil {
+		return nil, err
+	}
+	if exitCode != 0 {
+		return nil, errs.Newf(CodeCommandExit, cmd, exitCode, strings.TrimSpace(errBuf.String()))
+	}
+	return outBuf.Bytes(), nil
+}
+
+func (c *dockerConnection) Fetch(ctx context.Context, remotePath string) (io.ReadCloser, error) {
+	out, err := c.check(ctx, "cat "+shellquote.Quote(remotePath), nil)
+	if err != nil {
+		c.stats.Downloaded(0, err)
+		return nil, errs.WrapCode(err, CodeRemoteRead, remotePath)
+	}
+	return c.stats.DownloadReader(io.NopCloser(bytes.NewReader(out))), nil
+}
+
+func (c *dockerConnection) DownloadFile(ctx context.Context, remotePath string, localPath string) error {
+	rc, err := c.Fetch(ctx, remotePath)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	f, err := os.Create(localPath)
+	if err != nil {
+		return errs.WrapCode(err, CodeLocalCreate, localPath)
+	}
+	if _, err := io.Copy(f, rc); err != nil {
+		f.Close()
+		return errs.WrapCode(err, CodeLocalWrite, localPath)
+	}
+	return f.Close()
+}
+
+func (c *dockerConnection) UploadFile(ctx context.Context, localPath string, remotePath string) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return errs.WrapCode(err, CodeLocalOpen, localPath)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return errs.WrapCode(err, CodeLocalStat, localPath)
+	}
+	return c.Scp(ctx, f, remotePath, info.Size(), info.Mode().Perm())
+}
+
+func (c *dockerConnection) Scp(ctx context.Context, localReader io.Reader, remotePath string, sizeHint int64, mode os.FileMode) error {
+	p := shellquote.Quote(remotePath)
+	cmd := fmt.Sprintf("mkdir -p %s && cat > %s && chmod %o %s", shellquote.Quote(path.Dir(remotePath)), p, mode.Perm(), p)
+	r, done := c.stats.UploadReader(localReader)
+	_, err := c.check(ctx, cmd, r)
+	done(err)
+	if err != nil {
+		return errs.WrapCode(err, CodeRemoteWrite, remotePath)
+	}
+	return nil
+}
+
+// statFileInfo 是根据 `stat` 输出构造的 os.FileInfo, 供不使用 SFTP 的连接共用
+type statFileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (i *statFileInfo) Name() string       { return i.name }
+func (i *statFileInfo) Size() int64        { return i.size }
+func (i *statFileInfo) Mode() os.FileMode  { return i.mode }
+func (i *statFileInfo) ModTime() time.Time { return i.modTime }
+func (i *statFileInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i *statFileInfo) Sys() interface{}   { return nil }
+
+// parseStat 解析 `stat -c '%s %f %Y'` 的输出: 大小, 十六进制原始模式, 修改时间
+func parseStat(name, out string) (os.FileInfo, error) {
+	fields := strings.Fields(out)
+	if len(fields) != 3 {
+		return nil, errs.Newf(CodeStatParse, out)
+	}
+	size, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return nil, errs.WrapCode(err, CodeStatParse, out)
+	}
+	raw, err := strconv.ParseUint(fields[1], 16, 32)
+	if err != nil {
+		return nil, errs.WrapCode(err, CodeStatParse, out)
+	}
+	mtime, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return nil, errs.WrapCode(err, CodeStatParse, out)
+	}
+	mode := os.FileMode(raw & 0777)
+	switch raw & 0170000 {
+	case 0040000:
+		mode |= os.ModeDir
+	case 0120000:
+		mode |= os.ModeSymlink
+	}
+	return &statFileInfo{name: path.Base(name), size: size, mode: mode, modTime: time.Unix(mtime, 0)}, nil
+}
+
+func (c *dockerConnection) StatRemote(ctx context.Context, remotePath string) (os.FileInfo, error) {
+	var outBuf, errBuf bytes.Buffer
+	exitCode, err := c.run(ctx, "stat -c '%s %f %Y' "+shellquote.Quote(remotePath), nil, &outBuf, &errBuf)
+	if err != nil {
+		return nil, err
+	}
+	if exitCode != 0 {
+		if strings.Contains(errBuf.String(), "No such file") {
+			return nil, errors.Wrapf(os.ErrNotExist, "stat %s", remotePath)
+		}
+		return nil, errs.Newf(CodeStat, remotePath, strings.TrimSpace(errBuf.String()))
+	}
+	return parseStat(remotePath, outBuf.String())
+}
+
+func (c *dockerConnection) test(ctx context.Context, flag, remotePath string) (bool, error) {
+	exitCode, err := c.run(ctx, "test "+flag+" "+shellquote.Quote(remotePath), nil, io.Discard, io.Discard)
+	if err != nil {
+		return false, err
+	}
+	return exitCode == 0, nil
+}
+
+func (c *dockerConnection) RemoteFileExist(ctx context.Context, remotePath string) (bool, error) {
+	return c.test(ctx, "-f", remotePath)
+}
+
+func (c *dockerConnection) RemoteDirExist(ctx context.Context, remotePath string) (bool, error) {
+	return c.test(ctx, "-d", remotePath)
+}
+
+func (c *dockerConnection) MkDirAll(ctx context.Context, remotePath string, mode os.FileMode) error {
+	p := shellquote.Quote(remotePath)
+	if _, err := c.check(ctx, fmt.Sprintf("mkdir -p %s && chmod %o %s", p, mode.Perm(), p), nil); err != nil {
+		return errs.WrapCode(err, CodeRemoteMkdir, remotePath)
+	}
+	return nil
+}
+
+func (c *dockerConnection) Chmod(ctx context.Context, remotePath string, mode os.FileMode) error {
+	if _, err := c.check(ctx, fmt.Sprintf("chmod %o %s", mode.Perm(), shellquote.Quote(remotePath)), nil); err != nil {
+		return errs.WrapCode(err, CodeRemoteChmod, remotePath)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package connector
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeDocker is a docker CLI that runs exec'd commands on the local machine.
+const fakeDocker = `#!/bin/sh
+case "$1" in
+inspect) echo true ;;
+exec) shift; [ "$1" = "-i" ] && shift; shift; exec "$@" ;;
+*) exit 125 ;;
+esac
+`
+
+func TestDockerConnection(t *testing.T) {
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "docker")
+	require.NoError(t, os.WriteFile(bin, []byte(fakeDocker), 0755))
+	conn, err := NewDockerConnection(DockerConfig{Container: "node1", Binary: bin})
+	require.NoError(t, err)
+	defer conn.Close()
+	ctx := context.Background()
+
+	stdout, stderr, code, err := conn.Exec(ctx, "echo out; echo err >&2; exit 3")
+	require.NoError(t, err)
+	assert.Equal(t, 3, code)
+	assert.Equal(t, "out\n", string(stdout))
+	assert.Equal(t, "err\n", string(stderr))
+
+	remote := filepath.Join(dir, "etc", "it's.conf")
+	require.NoError(t, conn.Scp(ctx, strings.NewReader("hello"), remote, 5, 0640))
+	info, err := conn.StatRemote(ctx, remote)
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), info.Size())
+	assert.Equal(t, os.FileMode(0640), info.Mode())
+	assert.False(t, info.IsDir())
+
+	rc, err := conn.Fetch(ctx, remote)
+	require.NoError(t, err)
+	data, _ := io.ReadAll(rc)
+	assert.Equal(t, "hello", string(data))
+
+	exists, err := conn.RemoteFileExist(ctx, remote)
+	require.NoError(t, err)
+	assert.True(t, exists)
+	exists, err = conn.RemoteDirExist(ctx, remote)
+	require.NoError(t, err)
+	assert.False(t, exists)
+	_, err = conn.StatRemote(ctx, filepath.Join(dir, "missing"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	sub := filepath.Join(dir, "a", "b")
+	require.NoError(t, conn.MkDirAll(ctx, sub, 0700))
+	info, err = conn.StatRemote(ctx, sub)
+	require.NoError(t, err)
+	assert.True(t, info.IsDir())
+
+	var out bytes.Buffer
+	code, err = conn.PExec(ctx, "cat", strings.NewReader("piped"), &out, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "piped", out.String())
+
+	_, err = NewDockerConnection(DockerConfig{})
+	assert.Error(t, err)
+}
+
+func TestDockerShell(t *testing.T) {
+	bin := filepath.Join(t.TempDir(), "docker")
+	require.NoError(t, os.WriteFile(bin, []byte("#!/bin/sh\n[ \"$1\" = inspect ] && echo true && exit 0\n[ \"$4\" = -c ] && exit 0\necho \"$@\"; read line; echo \"got $line\"; exit 4\n"), 0755))
+	conn, err := NewDockerConnection(DockerConfig{Container: "node1", Binary: bin})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	resize := make(chan WindowSize, 1)
+	resize <- WindowSize{Rows: 50, Cols: 120}
+	var out bytes.Buffer
+	code, err := conn.(Shell).Shell(context.Background(), "xterm", WindowSize{Rows: 24, Cols: 80}, resize, strings.NewReader("exit\n"), &out, io.Discard)
+	require.NoError(t, err)
+	assert.Equal(t, 4, code)
+	assert.Equal(t, "exec -it -e TERM=xterm node1 /bin/bash -l\ngot exit\n", out.String())
+}
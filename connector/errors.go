@@ -0,0 +1,109 @@
+package connector
+
+import (
+	"net"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/mensylisir/xmcores/errs"
+)
+
+// 连接器失败的哨兵错误, 调用方 (如重试逻辑) 用 errors.Is 识别它们, 而不是匹配错误信息.
+// 被归类的错误信息保持不变, 见 classify.
+var (
+	// ErrAuthFailed 表示目标主机或堡垒机拒绝了所有认证方式, 重试无济于事
+	ErrAuthFailed = errs.Newf(CodeAuthFailed)
+	// ErrHostUnreachable 表示无法建立到主机的连接: 拒绝连接, 超时, 无路由, 域名无法解析或容器未运行
+	ErrHostUnreachable = errs.Newf(CodeHostUnreachable)
+	// ErrSudoPasswordRequired 表示 sudo 要求输入密码, 而连接没有配置密码
+	ErrSudoPasswordRequired = errs.Newf(CodeSudoPasswordRequired)
+	// ErrSFTPUnavailable 表示主机的 SFTP 子系统不可用, 或连接的 SFTP 客户端已关闭
+	ErrSFTPUnavailable = errs.Newf(CodeSFTPUnavailable)
+	// ErrPermissionDenied 表示远程文件操作被拒绝
+	ErrPermissionDenied = errs.Newf(CodePermissionDenied)
+)
+
+// classified 把错误归入一个哨兵错误, 信息不变
+type classified struct {
+	err      error
+	sentinel error
+}
+
+func (e *classified) Error() string   { return e.err.Error() }
+func (e *classified) Unwrap() []error { return []error{e.err, e.sentinel} }
+
+// Cause 让 github.com/pkg/errors.Cause 越过归类继续查找, 例如 *ssh.ExitError
+func (e *classified) Cause() error { return e.err }
+
+// classify 使 errors.Is(err, sentinel) 成立, err 为 nil 时返回 nil
+func classify(err, sentinel error) error {
+	if err == nil {
+		return nil
+	}
+	return &classified{err: err, sentinel: sentinel}
+}
+
+// dialError 把拨号错误归入 ErrAuthFailed 或 ErrHostUnreachable
+func dialError(err error) error {
+	switch {
+	case isAuthFailure(err):
+		return classify(err, ErrAuthFailed)
+	case isUnreachable(err):
+		return classify(err, ErrHostUnreachable)
+	}
+	return err
+}
+
+// isAuthFailure 判断 err 是否为认证失败. x/crypto/ssh 没有导出该错误的类型, 只能识别其固定的信息.
+func isAuthFailure(err error) bool {
+	return strings.Contains(err.Error(), "ssh: unable to authenticate")
+}
+
+// isUnreachable 判断 err 是否表示无法连接到主机, 包括经堡垒机转发失败
+func isUnreachable(err error) bool {
+	var (
+		dnsErr     *net.DNSError
+		opErr      *net.OpError
+		channelErr *ssh.OpenChannelError
+		netErr     net.Error
+	)
+	switch {
+	case errors.As(err, &dnsErr):
+		return true
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		return true
+	case errors.As(err, &channelErr):
+		return channelErr.Reason == ssh.ConnectionFailed
+	}
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// sftpError 把 SFTP 权限错误归入 ErrPermissionDenied
+func sftpError(err error) error {
+	if isSftpPermissionDenied(err) {
+		return classify(err, ErrPermissionDenied)
+	}
+	return err
+}
+
+// errSFTPNotInitialized 是 SFTP 客户端不存在 (连接已关闭) 时文件操作返回的错误
+var errSFTPNotInitialized = classify(errs.Newf(CodeSFTPNotInitialized), ErrSFTPUnavailable)
+
+// sudoRefusal 匹配 sudo 得不到密码时自身输出的信息 (会话的 LANG 为 en_US.UTF-8)
+var sudoRefusal = regexp.MustCompile(`sudo: (a password is required|no password was provided|a terminal is required)`)
+
+// promptedForPassword 判断命令输出中是否出现了 sudo 密码提示或 sudo 因缺少密码拒绝执行的信息
+func (c *connection) promptedForPassword(out []byte) bool {
+	if sudoRefusal.Match(out) {
+		return true
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if c.isSudoPrompt(strings.TrimRight(line, "\r")) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,59 @@
+package connector_test
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mensylisir/xmcores/connector"
+	"github.com/mensylisir/xmcores/connector/connectortest"
+	"github.com/mensylisir/xmcores/errs"
+)
+
+func TestDialErrors(t *testing.T) {
+	srv := connectortest.NewSSHServer(t, nil)
+	cfg := srv.Config()
+	cfg.Password = "wrong"
+	_, err := connector.NewConnection(cfg)
+	assert.ErrorIs(t, err, connector.ErrAuthFailed)
+	assert.NotErrorIs(t, err, connector.ErrHostUnreachable)
+	assert.Equal(t, errs.Connectivity, errs.KindOf(err))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	cfg = srv.Config()
+	cfg.Port = l.Addr().(*net.TCPAddr).Port
+	require.NoError(t, l.Close())
+	_, err = connector.NewConnection(cfg)
+	assert.ErrorIs(t, err, connector.ErrHostUnreachable)
+	assert.NotErrorIs(t, err, connector.ErrAuthFailed)
+}
+
+func TestSFTPUnavailable(t *testing.T) {
+	srv := connectortest.NewSSHServer(t, nil)
+	srv.DisableSFTP()
+	cfg := srv.Config()
+	cfg.FileTransfer = connector.FileTransferSFTP
+	_, err := connector.NewConnection(cfg)
+	assert.ErrorIs(t, err, connector.ErrSFTPUnavailable)
+}
+
+func TestSudoPasswordRequired(t *testing.T) {
+	ctx := context.Background()
+	fake := connectortest.NewFake().
+		On(`^sudo -E /bin/bash -c "id -u"$`, connectortest.Result{Stdout: "[sudo] password for xmcores: \n", Stderr: "sudo: no password was provided\n", ExitCode: 1}).
+		On(`^false$`, connectortest.Result{ExitCode: 1})
+	srv := connectortest.NewSSHServer(t, fake.Run)
+	conn, err := connector.NewConnection(srv.KeyConfig())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, _, _, err = conn.Exec(ctx, `sudo -E /bin/bash -c "id -u"`)
+	assert.ErrorIs(t, err, connector.ErrSudoPasswordRequired)
+	r := connector.Execute(ctx, conn, "node1", "false")
+	assert.NoError(t, r.Err, "an ordinary failure is an exit code")
+	assert.Equal(t, 1, r.ExitCode)
+}
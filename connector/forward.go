@@ -0,0 +1,183 @@
+package connector
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/mensylisir/xmcores/errs"
+)
+
+// Forwarder 由支持端口转发的连接实现. 转发经过已建立的 SSH 连接, 因此同样适用于经堡垒机的连接.
+type Forwarder interface {
+	// ForwardLocalPort 在本地 localAddr 上监听, 把每个连接转发到远程主机上可达的 remoteAddr, 等同于 ssh -L.
+	ForwardLocalPort(ctx context.Context, localAddr, remoteAddr string) (*Tunnel, error)
+	// ForwardRemotePort 在远程主机的 remoteAddr 上监听, 把每个连接转发到本地可达的 localAddr, 等同于 ssh -R.
+	// 远程 sshd 需允许 TCP 转发.
+	ForwardRemotePort(ctx context.Context, remoteAddr, localAddr string) (*Tunnel, error)
+}
+
+var _ Forwarder = (*connection)(nil)
+
+// Tunnel 是一个端口转发, 直到 Close 或创建它的 ctx 结束
+type Tunnel struct {
+	listener net.Listener
+	dial     func() (net.Conn, error)
+	target   string
+
+	closeOnce sync.Once
+	done      chan struct{}
+	wg        sync.WaitGroup
+	mu        sync.Mutex
+	conns     map[net.Conn]struct{}
+}
+
+// newTunnel 把 l 接受的每个连接与 dial 建立的连接对接
+func newTunnel(ctx context.Context, l net.Listener, target string, dial func() (net.Conn, error)) *Tunnel {
+	t := &Tunnel{listener: l, dial: dial, target: target, done: make(chan struct{}), conns: map[net.Conn]struct{}{}}
+	t.wg.Add(1)
+	go t.serve()
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = t.Close()
+		case <-t.done:
+		}
+	}()
+	return t
+}
+
+// Addr 返回监听地址, 监听端口为 0 时可由此得到实际端口
+func (t *Tunnel) Addr() net.Addr {
+	return t.listener.Addr()
+}
+
+// Done 在隧道关闭后关闭
+func (t *Tunnel) Done() <-chan struct{} {
+	return t.done
+}
+
+// Close 停止监听并断开所有转发中的连接
+func (t *Tunnel) Close() error {
+	var err error
+	t.closeOnce.Do(func() {
+		close(t.done)
+		err = t.listener.Close()
+		t.mu.Lock()
+		for c := range t.conns {
+			_ = c.Close()
+		}
+		t.mu.Unlock()
+		t.wg.Wait()
+	})
+	return err
+}
+
+func (t *Tunnel) serve() {
+	defer t.wg.Done()
+	for {
+		in, err := t.listener.Accept()
+		if err != nil {
+			select {
+			case <-t.done:
+			default:
+				clog().Warnf("[Tunnel %s -> %s] 停止接受连接: %v", t.listener.Addr(), t.target, err)
+				go t.Close()
+			}
+			return
+		}
+		t.wg.Add(1)
+		go func() {
+			defer t.wg.Done()
+			t.forward(in)
+		}()
+	}
+}
+
+// track 记录转发中的连接以便 Close 断开它们, 隧道已关闭时返回 false
+func (t *Tunnel) track(c net.Conn, add bool) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !add {
+		delete(t.conns, c)
+		return true
+	}
+	select {
+	case <-t.done:
+		return false
+	default:
+	}
+	t.conns[c] = struct{}{}
+	return true
+}
+
+func (t *Tunnel) forward(in net.Conn) {
+	defer in.Close()
+	if !t.track(in, true) {
+		return
+	}
+	defer t.track(in, false)
+	out, err := t.dial()
+	if err != nil {
+		clog().Warnf("[Tunnel %s -> %s] 连接目标失败: %v", t.listener.Addr(), t.target, err)
+		return
+	}
+	defer out.Close()
+	if !t.track(out, true) {
+		return
+	}
+	defer t.track(out, false)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	pipe := func(dst, src net.Conn) {
+		defer wg.Done()
+		_, _ = io.Copy(dst, src)
+		// 一端读完后关闭另一端的写方向, 不支持半关闭的连接直接关闭
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+			_ = cw.CloseWrite()
+		} else {
+			_ = dst.Close()
+		}
+	}
+	go pipe(out, in)
+	go pipe(in, out)
+	wg.Wait()
+}
+
+func (c *connection) ForwardLocalPort(ctx context.Context, localAddr, remoteAddr string) (*Tunnel, error) {
+	c.mu.Lock()
+	client := c.sshclient
+	c.mu.Unlock()
+	if client == nil {
+		return nil, errs.Newf(CodeConnClosed)
+	}
+	l, err := net.Listen("tcp", localAddr)
+	if err != nil {
+		return nil, errs.WrapCode(err, CodeListen, localAddr)
+	}
+	clog().Debugf("[Tunnel %s:%d] 本地 %s -> 远程 %s", c.config.Address, c.config.Port, l.Addr(), remoteAddr)
+	return newTunnel(ctx, l, fmt.Sprintf("%s:%s", c.config.Address, remoteAddr), func() (net.Conn, error) {
+		return client.Dial("tcp", remoteAddr)
+	}), nil
+}
+
+func (c *connection) ForwardRemotePort(ctx context.Context, remoteAddr, localAddr string) (*Tunnel, error) {
+	c.mu.Lock()
+	client := c.sshclient
+	c.mu.Unlock()
+	if client == nil {
+		return nil, errs.Newf(CodeConnClosed)
+	}
+	l, err := client.Listen("tcp", remoteAddr)
+	if err != nil {
+		return nil, errs.WrapCode(err, CodeRemoteListen, c.config.Address, remoteAddr)
+	}
+	clog().Debugf("[Tunnel %s:%d] 远程 %s -> 本地 %s", c.config.Address, c.config.Port, remoteAddr, localAddr)
+	var d net.Dialer
+	return newTunnel(ctx, l, localAddr, func() (net.Conn, error) {
+		return d.DialContext(ctx, "tcp", localAddr)
+	}), nil
+}
@@ -0,0 +1,85 @@
+package connector
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// echoServer answers every line it receives with the line prefixed by "echo ".
+func echoServer(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				s := bufio.NewScanner(c)
+				for s.Scan() {
+					_, _ = io.WriteString(c, "echo "+s.Text()+"\n")
+				}
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestTunnel(t *testing.T) {
+	target := echoServer(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	tunnel := newTunnel(ctx, l, target, func() (net.Conn, error) { return net.Dial("tcp", target) })
+
+	for i := 0; i < 2; i++ {
+		c, err := net.Dial("tcp", tunnel.Addr().String())
+		require.NoError(t, err)
+		_, err = io.WriteString(c, "hello\n")
+		require.NoError(t, err)
+		line, err := bufio.NewReader(c).ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "echo hello\n", line)
+		c.Close()
+	}
+
+	// An open connection is cut when the tunnel ends with its context.
+	c, err := net.Dial("tcp", tunnel.Addr().String())
+	require.NoError(t, err)
+	defer c.Close()
+	_, err = io.WriteString(c, "ping\n")
+	require.NoError(t, err)
+	r := bufio.NewReader(c)
+	_, err = r.ReadString('\n')
+	require.NoError(t, err)
+	cancel()
+	<-tunnel.Done()
+	require.NoError(t, tunnel.Close())
+	_, err = r.ReadString('\n')
+	assert.Error(t, err)
+	_, err = net.Dial("tcp", tunnel.Addr().String())
+	assert.Error(t, err, "the listener is closed")
+}
+
+func TestTunnelUnreachableTarget(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	tunnel := newTunnel(context.Background(), l, "nowhere", func() (net.Conn, error) { return nil, net.UnknownNetworkError("nowhere") })
+	defer tunnel.Close()
+
+	c, err := net.Dial("tcp", tunnel.Addr().String())
+	require.NoError(t, err)
+	defer c.Close()
+	_, err = c.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF, "the client connection is closed")
+}
@@ -0,0 +1,314 @@
+package connector
+
+import "github.com/mensylisir/xmcores/errs"
+
+// 连接器错误的代码, 调用方用 errs.CodeOf 或 errors.Is 匹配它们, 而不是匹配错误信息.
+// 信息按 errs.EnvLang 选择的语言渲染, 目录见本文件末尾.
+const (
+	// 哨兵错误, 见 errors.go
+	CodeAuthFailed           errs.Code = "connector.auth-failed"
+	CodeHostUnreachable      errs.Code = "connector.host-unreachable"
+	CodeSudoPasswordRequired errs.Code = "connector.sudo-password-required"
+	CodeSFTPUnavailable      errs.Code = "connector.sftp-unavailable"
+	CodePermissionDenied     errs.Code = "connector.permission-denied"
+
+	// 连接参数
+	CodeInvalidOptions    errs.Code = "connector.options.invalid"
+	CodeNoUsername        errs.Code = "connector.options.no-username"
+	CodeNoAddress         errs.Code = "connector.options.no-address"
+	CodeNoAuth            errs.Code = "connector.options.no-auth"
+	CodeReadKeyFile       errs.Code = "connector.options.read-key-file"
+	CodeReadBastionKey    errs.Code = "connector.options.read-bastion-key-file"
+	CodeInvalidEnvName    errs.Code = "connector.options.invalid-env-name"
+	CodeInvalidUmask      errs.Code = "connector.options.invalid-umask"
+	CodeInvalidShell      errs.Code = "connector.options.invalid-shell"
+	CodeInvalidSudoPrompt errs.Code = "connector.options.invalid-sudo-prompt"
+	CodeInvalidTransfer   errs.Code = "connector.options.invalid-file-transfer"
+
+	// 认证和拨号
+	CodeParseKey            errs.Code = "connector.auth.parse-key"
+	CodeParseBastionKey     errs.Code = "connector.auth.parse-bastion-key"
+	CodeAgentDial           errs.Code = "connector.auth.agent-dial"
+	CodeBastionAgentDial    errs.Code = "connector.auth.bastion-agent-dial"
+	CodeAgentSigners        errs.Code = "connector.auth.agent-signers"
+	CodeBastionAgentSigners errs.Code = "connector.auth.bastion-agent-signers"
+	CodeNoAuthMethod        errs.Code = "connector.auth.no-method"
+	CodeNoBastionAuthMethod errs.Code = "connector.auth.no-bastion-method"
+	CodeDial                errs.Code = "connector.dial"
+	CodeBastionDial         errs.Code = "connector.dial.bastion"
+	CodeBastionDialTarget   errs.Code = "connector.dial.bastion-target"
+	CodeBastionHandshake    errs.Code = "connector.dial.bastion-handshake"
+	CodeSFTPClient          errs.Code = "connector.sftp.client"
+
+	// 连接和会话
+	CodeConnClosed    errs.Code = "connector.closed"
+	CodeClose         errs.Code = "connector.close"
+	CodeSessionCreate errs.Code = "connector.session.create"
+	CodePTYRequest    errs.Code = "connector.session.pty"
+	CodeExecPrepare   errs.Code = "connector.exec.prepare"
+	CodeExecPipe      errs.Code = "connector.exec.pipe"
+	CodeExecStart     errs.Code = "connector.exec.start"
+	CodeExecWait      errs.Code = "connector.exec.wait"
+	CodeExecTimeout   errs.Code = "connector.exec.timeout"
+	CodeEmptyArgv     errs.Code = "connector.exec.empty-argv"
+	CodeCommandExit   errs.Code = "connector.exec.exit"
+	CodeSudoProbe     errs.Code = "connector.sudo.probe"
+	CodeSudoCommand   errs.Code = "connector.sudo.command"
+	CodeShellStart    errs.Code = "connector.shell.start"
+	CodeShellAborted  errs.Code = "connector.shell.aborted"
+	CodeListen        errs.Code = "connector.forward.listen"
+	CodeRemoteListen  errs.Code = "connector.forward.remote-listen"
+
+	// 远程文件
+	CodeSFTPNotInitialized errs.Code = "connector.sftp.not-initialized"
+	CodeSFTPOpen           errs.Code = "connector.sftp.open"
+	CodeSFTPCreate         errs.Code = "connector.sftp.create"
+	CodeSFTPClose          errs.Code = "connector.sftp.close"
+	CodeSFTPMkdir          errs.Code = "connector.sftp.mkdir"
+	CodeSFTPChmod          errs.Code = "connector.sftp.chmod"
+	CodeSFTPStat           errs.Code = "connector.sftp.stat"
+	CodeSFTPStatDenied     errs.Code = "connector.sftp.stat-denied"
+	CodeDownload           errs.Code = "connector.file.download"
+	CodeUpload             errs.Code = "connector.file.upload"
+	CodeChecksumMismatch   errs.Code = "connector.file.checksum"
+	CodeNilReader          errs.Code = "connector.file.nil-reader"
+	CodeRemoteRead         errs.Code = "connector.file.read"
+	CodeRemoteWrite        errs.Code = "connector.file.write"
+	CodeRemoteCreate       errs.Code = "connector.file.create"
+	CodeRemoteRename       errs.Code = "connector.file.rename"
+	CodeRemoteMkdir        errs.Code = "connector.file.mkdir"
+	CodeRemoteChmod        errs.Code = "connector.file.chmod"
+	CodeRemoteTest         errs.Code = "connector.file.test"
+	CodeStat               errs.Code = "connector.file.stat"
+	CodeStatParse          errs.Code = "connector.file.stat-parse"
+	CodeDecode             errs.Code = "connector.file.decode"
+	CodeSudoDownload       errs.Code = "connector.file.sudo-download"
+	CodeBase64LineTooLong  errs.Code = "connector.file.base64-line-too-long"
+	CodeBase64Line         errs.Code = "connector.file.base64-line"
+	CodeNoEndMarker        errs.Code = "connector.file.no-end-marker"
+
+	// 本地文件
+	CodeLocalMkdir  errs.Code = "connector.local.mkdir"
+	CodeLocalCreate errs.Code = "connector.local.create"
+	CodeLocalOpen   errs.Code = "connector.local.open"
+	CodeLocalStat   errs.Code = "connector.local.stat"
+	CodeLocalRead   errs.Code = "connector.local.read"
+	CodeLocalWrite  errs.Code = "connector.local.write"
+	CodeLocalRename errs.Code = "connector.local.rename"
+
+	// docker
+	CodeNoContainer         errs.Code = "connector.docker.no-container"
+	CodeContainerInspect    errs.Code = "connector.docker.inspect"
+	CodeContainerNotRunning errs.Code = "connector.docker.not-running"
+	CodeContainerExec       errs.Code = "connector.docker.exec"
+	CodeContainerShell      errs.Code = "connector.docker.shell"
+
+	// 故障注入
+	CodeChaos         errs.Code = "connector.chaos"
+	CodeChaosField    errs.Code = "connector.chaos.field"
+	CodeChaosOp       errs.Code = "connector.chaos.op"
+	CodeChaosKey      errs.Code = "connector.chaos.key"
+	CodeChaosValue    errs.Code = "connector.chaos.value"
+	CodeChaosFraction errs.Code = "connector.chaos.fraction"
+)
+
+func init() {
+	errs.RegisterMessages(errs.LangZH, map[errs.Code]string{
+		CodeAuthFailed:           "SSH 认证失败",
+		CodeHostUnreachable:      "主机不可达",
+		CodeSudoPasswordRequired: "sudo 需要密码, 但连接没有配置密码",
+		CodeSFTPUnavailable:      "SFTP 不可用",
+		CodePermissionDenied:     "权限被拒绝",
+
+		CodeInvalidOptions:    "验证 SSH 连接参数失败",
+		CodeNoUsername:        "未指定 SSH 连接的用户名",
+		CodeNoAddress:         "未指定 SSH 连接的地址",
+		CodeNoAuth:            "必须为目标连接指定密码、私钥内容、私钥文件或 agent socket 中的至少一种",
+		CodeReadKeyFile:       "读取目标主机密钥文件 %q 失败",
+		CodeReadBastionKey:    "读取 bastion 密钥文件 %q 失败",
+		CodeInvalidEnvName:    "无效的环境变量名 %q",
+		CodeInvalidUmask:      "无效的 umask %q (应为如 0022 的八进制数)",
+		CodeInvalidShell:      "无效的 shell %q (应为不含空白和引号的绝对路径)",
+		CodeInvalidSudoPrompt: "无效的 sudo 密码提示正则 %q",
+		CodeInvalidTransfer:   "不支持的文件传输方式 %q (可选 %q 或 %q)",
+
+		CodeParseKey:            "解析目标主机 SSH 私钥失败",
+		CodeParseBastionKey:     "解析 bastion 主机 SSH 私钥失败",
+		CodeAgentDial:           "打开目标主机 SSH agent socket %q 失败",
+		CodeBastionAgentDial:    "打开 bastion 主机 SSH agent socket %q 失败",
+		CodeAgentSigners:        "从目标主机 SSH agent 创建 signer 失败",
+		CodeBastionAgentSigners: "从 bastion 主机 SSH agent 创建 signer 失败",
+		CodeNoAuthMethod:        "目标主机没有可用的 SSH 认证方法",
+		CodeNoBastionAuthMethod: "没有可用于 bastion 连接的认证方法",
+		CodeDial:                "直接连接到 %s (用户 %s) 失败",
+		CodeBastionDial:         "连接 bastion 主机 %s (用户 %s) 失败",
+		CodeBastionDialTarget:   "通过 bastion %s 拨号目标 %s 失败",
+		CodeBastionHandshake:    "通过 bastion 建立到 %s (用户 %s) 的 SSH 客户端连接失败",
+		CodeSFTPClient:          "创建 SFTP 客户端失败",
+
+		CodeConnClosed:    "ssh 连接已关闭",
+		CodeClose:         "关闭 %s 失败: %v",
+		CodeSessionCreate: "创建 ssh 会话失败",
+		CodePTYRequest:    "请求 PTY 失败",
+		CodeExecPrepare:   "准备命令执行失败",
+		CodeExecPipe:      "获取 %s pipe 失败",
+		CodeExecStart:     "启动命令 '%s' 失败",
+		CodeExecWait:      "等待命令 '%s' 完成失败",
+		CodeExecTimeout:   "命令超过 %s 未完成",
+		CodeEmptyArgv:     "ExecArgs: argv 为空",
+		CodeCommandExit:   "命令 %q 退出码 %d: %s",
+		CodeSudoProbe:     "探测 sudo 是否需要密码失败",
+		CodeSudoCommand:   "sudo %s: 执行命令 '%s' 失败, 退出码 %d (stderr: %s)",
+		CodeShellStart:    "在 %s 上启动 shell 失败",
+		CodeShellAborted:  "%s 上的 shell 异常结束",
+		CodeListen:        "在本地 %s 上监听失败",
+		CodeRemoteListen:  "在 %s 的 %s 上监听失败 (sshd 是否允许 TCP 转发?)",
+
+		CodeSFTPNotInitialized: "sftp 客户端未初始化",
+		CodeSFTPOpen:           "sftp: 打开远程文件 %s 失败",
+		CodeSFTPCreate:         "sftp: 创建远程文件 %s 失败",
+		CodeSFTPClose:          "sftp: 关闭远程文件 %s 失败",
+		CodeSFTPMkdir:          "sftp: 创建远程目录 %s 失败 (stat: %v)",
+		CodeSFTPChmod:          "sftp: Chmod %s 到 %s 失败",
+		CodeSFTPStat:           "sftp stat 对 %s 失败",
+		CodeSFTPStatDenied:     "sftp stat 对 %s 权限被拒绝 (完整的 sudo stat 未实现)",
+		CodeDownload:           "从远程 %s 复制数据到本地 %s 失败 (已复制 %d 字节)",
+		CodeUpload:             "复制数据到远程 %s 失败 (已复制 %d 字节)",
+		CodeChecksumMismatch:   "%s 的校验和不一致 (本地 %s, 远程 %q)",
+		CodeNilReader:          "Scp: localReader 不能为空",
+		CodeRemoteRead:         "读取远程文件 %s 失败",
+		CodeRemoteWrite:        "写入远程文件 %s 失败",
+		CodeRemoteCreate:       "创建远程文件 %s 失败",
+		CodeRemoteRename:       "移动临时文件到 %s 失败",
+		CodeRemoteMkdir:        "创建远程目录 %s 失败",
+		CodeRemoteChmod:        "修改远程文件 %s 权限失败",
+		CodeRemoteTest:         "test %s %s 失败",
+		CodeStat:               "stat %s 失败: %s",
+		CodeStatParse:          "无法解析 stat 输出 %q",
+		CodeDecode:             "解码 %s 的内容失败",
+		CodeSudoDownload:       "sudo 下载: 读取远程文件 %s 失败 (退出码 %d): %v %s",
+		CodeBase64LineTooLong:  "base64 行过长",
+		CodeBase64Line:         "无效的 base64 行 %q",
+		CodeNoEndMarker:        "输出不完整, 未找到结束标记: %s",
+
+		CodeLocalMkdir:  "创建本地目录 %s 失败",
+		CodeLocalCreate: "创建本地文件 %s 失败",
+		CodeLocalOpen:   "打开本地文件 %s 失败",
+		CodeLocalStat:   "获取本地文件 %s 状态失败",
+		CodeLocalRead:   "读取本地内容失败",
+		CodeLocalWrite:  "写入本地文件 %s 失败",
+		CodeLocalRename: "重命名 %s 为 %s 失败",
+
+		CodeNoContainer:         "docker 连接需要容器名称",
+		CodeContainerInspect:    "检查容器 %s 失败: %s",
+		CodeContainerNotRunning: "容器 %s 未运行",
+		CodeContainerExec:       "在容器 %s 中执行命令失败",
+		CodeContainerShell:      "在容器 %s 中打开 shell 失败",
+
+		CodeChaos:         "chaos: 注入的故障",
+		CodeChaosField:    "chaos 配置项 %q 应为 key=value",
+		CodeChaosOp:       "未知的 chaos 操作 %q, 可选 %s 和 %s",
+		CodeChaosKey:      "未知的 chaos 配置项 %q",
+		CodeChaosValue:    "chaos 配置项 %s",
+		CodeChaosFraction: "概率 %s 不在 0 到 1 之间",
+	})
+	errs.RegisterMessages(errs.LangEN, map[errs.Code]string{
+		CodeAuthFailed:           "SSH authentication failed",
+		CodeHostUnreachable:      "host unreachable",
+		CodeSudoPasswordRequired: "sudo requires a password, but the connection has none",
+		CodeSFTPUnavailable:      "SFTP unavailable",
+		CodePermissionDenied:     "permission denied",
+
+		CodeInvalidOptions:    "invalid SSH connection options",
+		CodeNoUsername:        "no SSH username set",
+		CodeNoAddress:         "no SSH address set",
+		CodeNoAuth:            "set at least one of a password, a private key, a key file or an agent socket for the target",
+		CodeReadKeyFile:       "failed to read the target key file %q",
+		CodeReadBastionKey:    "failed to read the bastion key file %q",
+		CodeInvalidEnvName:    "invalid environment variable name %q",
+		CodeInvalidUmask:      "invalid umask %q (want an octal number such as 0022)",
+		CodeInvalidShell:      "invalid shell %q (want an absolute path without blanks or quotes)",
+		CodeInvalidSudoPrompt: "invalid sudo password prompt pattern %q",
+		CodeInvalidTransfer:   "unsupported file transfer %q (want %q or %q)",
+
+		CodeParseKey:            "failed to parse the target SSH private key",
+		CodeParseBastionKey:     "failed to parse the bastion SSH private key",
+		CodeAgentDial:           "failed to open the target SSH agent socket %q",
+		CodeBastionAgentDial:    "failed to open the bastion SSH agent socket %q",
+		CodeAgentSigners:        "failed to get signers from the target SSH agent",
+		CodeBastionAgentSigners: "failed to get signers from the bastion SSH agent",
+		CodeNoAuthMethod:        "no SSH authentication method available for the target",
+		CodeNoBastionAuthMethod: "no SSH authentication method available for the bastion",
+		CodeDial:                "failed to connect to %s as %s",
+		CodeBastionDial:         "failed to connect to bastion %s as %s",
+		CodeBastionDialTarget:   "failed to dial %[2]s through bastion %[1]s",
+		CodeBastionHandshake:    "failed to open the SSH client connection to %s as %s through the bastion",
+		CodeSFTPClient:          "failed to create the SFTP client",
+
+		CodeConnClosed:    "ssh connection closed",
+		CodeClose:         "failed to close the %s: %v",
+		CodeSessionCreate: "failed to create an ssh session",
+		CodePTYRequest:    "failed to request a PTY",
+		CodeExecPrepare:   "failed to prepare the command",
+		CodeExecPipe:      "failed to get the %s pipe",
+		CodeExecStart:     "failed to start command '%s'",
+		CodeExecWait:      "failed waiting for command '%s'",
+		CodeExecTimeout:   "command did not finish within %s",
+		CodeEmptyArgv:     "ExecArgs: empty argv",
+		CodeCommandExit:   "command %q exited with %d: %s",
+		CodeSudoProbe:     "failed to check whether sudo requires a password",
+		CodeSudoCommand:   "sudo %s: command '%s' failed with exit code %d (stderr: %s)",
+		CodeShellStart:    "failed to start a shell on %s",
+		CodeShellAborted:  "the shell on %s ended abnormally",
+		CodeListen:        "failed to listen on local %s",
+		CodeRemoteListen:  "failed to listen on %[2]s of %[1]s (does sshd allow TCP forwarding?)",
+
+		CodeSFTPNotInitialized: "sftp client not initialized",
+		CodeSFTPOpen:           "sftp: failed to open remote file %s",
+		CodeSFTPCreate:         "sftp: failed to create remote file %s",
+		CodeSFTPClose:          "sftp: failed to close remote file %s",
+		CodeSFTPMkdir:          "sftp: failed to create remote directory %s (stat: %v)",
+		CodeSFTPChmod:          "sftp: failed to chmod %s to %s",
+		CodeSFTPStat:           "sftp: failed to stat %s",
+		CodeSFTPStatDenied:     "sftp: permission denied to stat %s (sudo stat not implemented)",
+		CodeDownload:           "failed to copy remote %s to local %s (%d bytes copied)",
+		CodeUpload:             "failed to copy data to remote %s (%d bytes copied)",
+		CodeChecksumMismatch:   "checksum mismatch for %s (local %s, remote %q)",
+		CodeNilReader:          "Scp: localReader must not be nil",
+		CodeRemoteRead:         "failed to read remote file %s",
+		CodeRemoteWrite:        "failed to write remote file %s",
+		CodeRemoteCreate:       "failed to create remote file %s",
+		CodeRemoteRename:       "failed to move the temporary file to %s",
+		CodeRemoteMkdir:        "failed to create remote directory %s",
+		CodeRemoteChmod:        "failed to change the mode of remote file %s",
+		CodeRemoteTest:         "test %s %s failed",
+		CodeStat:               "stat %s failed: %s",
+		CodeStatParse:          "cannot parse stat output %q",
+		CodeDecode:             "failed to decode the content of %s",
+		CodeSudoDownload:       "sudo download: failed to read remote file %s (exit code %d): %v %s",
+		CodeBase64LineTooLong:  "base64 line too long",
+		CodeBase64Line:         "invalid base64 line %q",
+		CodeNoEndMarker:        "incomplete output, end marker not found: %s",
+
+		CodeLocalMkdir:  "failed to create local directory %s",
+		CodeLocalCreate: "failed to create local file %s",
+		CodeLocalOpen:   "failed to open local file %s",
+		CodeLocalStat:   "failed to stat local file %s",
+		CodeLocalRead:   "failed to read local content",
+		CodeLocalWrite:  "failed to write local file %s",
+		CodeLocalRename: "failed to rename %s to %s",
+
+		CodeNoContainer:         "a docker connection needs a container name",
+		CodeContainerInspect:    "failed to inspect container %s: %s",
+		CodeContainerNotRunning: "container %s is not running",
+		CodeContainerExec:       "failed to run a command in container %s",
+		CodeContainerShell:      "failed to open a shell in container %s",
+
+		CodeChaos:         "chaos: injected failure",
+		CodeChaosField:    "chaos field %q should be key=value",
+		CodeChaosOp:       "unknown chaos operation %q, want %s or %s",
+		CodeChaosKey:      "unknown chaos key %q",
+		CodeChaosValue:    "chaos key %s",
+		CodeChaosFraction: "probability %s is not between 0 and 1",
+	})
+}
@@ -0,0 +1,121 @@
+package connector
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/mensylisir/xmcores/errs"
+	"github.com/mensylisir/xmcores/shellquote"
+)
+
+// ExecOptions 是 ExecWith 的执行选项, 让调用方不必为每次执行自行构造超时 ctx 和 sudo 包装
+type ExecOptions struct {
+	// Timeout 限制命令的执行时间, 0 表示只受 ctx 约束
+	Timeout time.Duration
+	// Env 是命令额外的环境变量
+	Env map[string]string
+	// Dir 是命令的工作目录, 为空时使用登录用户的默认目录
+	Dir string
+	// Sudo 以 root 执行命令 (见 SudoCommand), Env 和 Dir 在 sudo 之后生效
+	Sudo bool
+	// Stdin 作为命令的标准输入
+	Stdin []byte
+	// MaxOutput 是 stdout / stderr 各自保留的最大字节数, 超出部分被丢弃并标记截断;
+	// 0 表示 MaxResultOutput, 负数表示不限制
+	MaxOutput int
+}
+
+var envNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Command 返回按 o 包装后实际执行的命令, Sudo 时按 SudoPrefix 包装
+func (o ExecOptions) Command(cmd string) (string, error) {
+	return o.command(cmd, SudoPrefix)
+}
+
+// command 同 Command, Sudo 时用 sudo 包装命令
+func (o ExecOptions) command(cmd string, sudo func(string) string) (string, error) {
+	var b strings.Builder
+	names := make([]string, 0, len(o.Env))
+	for name := range o.Env {
+		if !envNamePattern.MatchString(name) {
+			return "", errs.Newf(CodeInvalidEnvName, name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		b.WriteString("export " + name + "=" + shellquote.Quote(o.Env[name]) + "; ")
+	}
+	if o.Dir != "" {
+		b.WriteString("cd " + shellquote.Quote(o.Dir) + " && ")
+	}
+	b.WriteString(cmd)
+	if o.Sudo {
+		return sudo(b.String()), nil
+	}
+	return b.String(), nil
+}
+
+// ExecWith 按 opts 在 exec 上执行 cmd 并返回结构化结果, host 仅用于记录. 结果总是非 nil.
+// 输出边读边截断, 因此输出巨大的命令也不会占用超过 MaxOutput 的内存.
+// 超时表现为 Err 中的传输错误, 与 ctx 取消相同.
+func ExecWith(ctx context.Context, exec Executor, host, cmd string, opts ExecOptions) *CmdResult {
+	r := &CmdResult{Host: host, Command: cmd, ExitCode: -1}
+	wrapped, err := opts.command(cmd, func(c string) string { return SudoCommand(ctx, exec, c) })
+	if err != nil {
+		r.Err = err
+		return r
+	}
+	r.Command = wrapped
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+	limit := opts.MaxOutput
+	if limit == 0 {
+		limit = MaxResultOutput
+	}
+	stdout, stderr := &limitedBuffer{limit: limit}, &limitedBuffer{limit: limit}
+	var stdin io.Reader
+	if opts.Stdin != nil {
+		stdin = bytes.NewReader(opts.Stdin)
+	}
+
+	start := time.Now()
+	r.ExitCode, err = exec.PExec(ctx, wrapped, stdin, stdout, stderr)
+	r.Duration = time.Since(start)
+	r.Stdout, r.StdoutTruncated = stdout.buf.Bytes(), stdout.truncated
+	r.Stderr, r.StderrTruncated = stderr.buf.Bytes(), stderr.truncated
+	if err != nil && opts.Timeout > 0 && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		err = errs.WrapCode(err, CodeExecTimeout, opts.Timeout)
+	}
+	r.setErr(err)
+	return r
+}
+
+// limitedBuffer 最多保留 limit 字节 (负数不限制), 多余的写入被丢弃但仍报告成功, 以免中断命令
+type limitedBuffer struct {
+	buf       bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.limit < 0 {
+		return b.buf.Write(p)
+	}
+	if room := b.limit - b.buf.Len(); len(p) > room {
+		b.buf.Write(p[:room])
+		b.truncated = true
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
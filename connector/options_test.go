@@ -0,0 +1,91 @@
+package connector_test
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mensylisir/xmcores/connector"
+	"github.com/mensylisir/xmcores/connector/connectortest"
+)
+
+// stdinExecutor echoes stdin to stdout and blocks until ctx is done when the
+// command is "sleep".
+type stdinExecutor struct{}
+
+func (stdinExecutor) Exec(ctx context.Context, cmd string) ([]byte, []byte, int, error) {
+	panic("ExecWith uses PExec")
+}
+
+func (stdinExecutor) PExec(ctx context.Context, cmd string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	if cmd == "sleep" {
+		<-ctx.Done()
+		return -1, ctx.Err()
+	}
+	if stdin != nil {
+		if _, err := io.Copy(stdout, stdin); err != nil {
+			return -1, err
+		}
+	}
+	return 0, nil
+}
+
+func TestExecOptionsCommand(t *testing.T) {
+	cmd, err := connector.ExecOptions{
+		Env:  map[string]string{"KUBECONFIG": "/etc/kubernetes/admin.conf", "A": "it's"},
+		Dir:  "/var/lib/xm",
+		Sudo: true,
+	}.Command("kubectl get nodes")
+	require.NoError(t, err)
+	assert.Equal(t, connector.SudoPrefix(`export A='it'\''s'; export KUBECONFIG=/etc/kubernetes/admin.conf; cd /var/lib/xm && kubectl get nodes`), cmd)
+
+	cmd, err = connector.ExecOptions{}.Command("uptime")
+	require.NoError(t, err)
+	assert.Equal(t, "uptime", cmd)
+
+	_, err = connector.ExecOptions{Env: map[string]string{"BAD-NAME": "x"}}.Command("uptime")
+	assert.Error(t, err)
+}
+
+func TestExecWith(t *testing.T) {
+	ctx := context.Background()
+	fake := connectortest.NewFake().
+		On(`cd /opt && ls`, connectortest.Result{Stdout: "bin\n"}).
+		On(`dmesg`, connectortest.Result{Stdout: strings.Repeat("x", 100), Stderr: "warn\n"}).
+		On(`false`, connectortest.Result{ExitCode: 1})
+
+	r := connector.ExecWith(ctx, fake, "node1", "ls", connector.ExecOptions{Dir: "/opt", Sudo: true})
+	assert.True(t, r.Success())
+	assert.Equal(t, "bin", r.StdoutString())
+	assert.Equal(t, connector.SudoPrefix("cd /opt && ls"), r.Command)
+
+	r = connector.ExecWith(ctx, fake, "node1", "dmesg", connector.ExecOptions{MaxOutput: 10})
+	assert.Equal(t, strings.Repeat("x", 10), string(r.Stdout))
+	assert.True(t, r.StdoutTruncated)
+	assert.False(t, r.StderrTruncated)
+	r = connector.ExecWith(ctx, fake, "node1", "dmesg", connector.ExecOptions{MaxOutput: -1})
+	assert.Len(t, r.Stdout, 100)
+
+	r = connector.ExecWith(ctx, fake, "node1", "false", connector.ExecOptions{})
+	assert.NoError(t, r.Err)
+	assert.Equal(t, 1, r.ExitCode)
+
+	r = connector.ExecWith(ctx, fake, "node1", "uptime", connector.ExecOptions{Env: map[string]string{"1X": ""}})
+	assert.Error(t, r.Err)
+	assert.Equal(t, -1, r.ExitCode)
+
+	r = connector.ExecWith(ctx, stdinExecutor{}, "node1", "cat", connector.ExecOptions{Stdin: []byte("token\n")})
+	assert.Equal(t, "token", r.StdoutString())
+
+	start := time.Now()
+	r = connector.ExecWith(ctx, stdinExecutor{}, "node1", "sleep", connector.ExecOptions{Timeout: 20 * time.Millisecond})
+	assert.Less(t, time.Since(start), 5*time.Second)
+	require.Error(t, r.Err)
+	assert.Contains(t, r.Err.Error(), "20ms")
+	assert.False(t, r.Success())
+}
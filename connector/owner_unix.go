@@ -0,0 +1,32 @@
+//go:build !windows
+
+package connector
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// fileOwner 返回本地文件 f 所属的用户和组名称, 本机上没有名称的返回数字 id
+func fileOwner(f *os.File) (owner, group string, err error) {
+	info, err := f.Stat()
+	if err != nil {
+		return "", "", err
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", "", fmt.Errorf("ownership of %s is not available", f.Name())
+	}
+	owner = strconv.FormatUint(uint64(st.Uid), 10)
+	if u, err := user.LookupId(owner); err == nil {
+		owner = u.Username
+	}
+	group = strconv.FormatUint(uint64(st.Gid), 10)
+	if g, err := user.LookupGroupId(group); err == nil {
+		group = g.Name
+	}
+	return owner, group, nil
+}
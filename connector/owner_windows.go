@@ -0,0 +1,11 @@
+package connector
+
+import (
+	"errors"
+	"os"
+)
+
+// fileOwner 在 Windows 上不受支持, 其文件没有 uid 和 gid
+func fileOwner(*os.File) (string, string, error) {
+	return "", "", errors.New("file ownership cannot be preserved from Windows")
+}
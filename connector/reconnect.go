@@ -0,0 +1,45 @@
+package connector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Reconnector 由能重新建立自身连接的连接实现, 例如在主机重启之后.
+// 重新连接后同一 Connection 继续可用, 持有它的各方无需替换.
+type Reconnector interface {
+	// Reconnect 关闭现有连接并按原配置重新拨号. 失败时原连接已关闭, 可再次调用重试.
+	Reconnect(ctx context.Context) error
+}
+
+var _ Reconnector = (*connection)(nil)
+
+// Reconnect 实现 Reconnector. 统计、sudo 探测结果和探测到的 shell 均保留.
+func (c *connection) Reconnect(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	_ = c.Close()
+	fresh, err := newConnection(c.config)
+	if err != nil {
+		return err
+	}
+	n := fresh.(*connection)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sshclient, c.sftpclient = n.sshclient, n.sftpclient
+	c.ctx, c.cancel = n.ctx, n.cancel
+	c.agentSocketConn = n.agentSocketConn
+	c.bastionSSHClient, c.bastionAgentSocketConn = n.bastionSSHClient, n.bastionAgentSocketConn
+	c.auth = n.auth
+	return nil
+}
+
+// Reconnect 转发给被包装的连接
+func (c *chaosConnection) Reconnect(ctx context.Context) error {
+	if r, ok := c.Connection.(Reconnector); ok {
+		return r.Reconnect(ctx)
+	}
+	return fmt.Errorf("%s: %w", c.name, errors.ErrUnsupported)
+}
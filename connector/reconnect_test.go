@@ -0,0 +1,38 @@
+package connector_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mensylisir/xmcores/connector"
+	"github.com/mensylisir/xmcores/connector/connectortest"
+)
+
+func TestReconnect(t *testing.T) {
+	ctx := context.Background()
+	fake := connectortest.NewFake().On(`^hostname$`, connectortest.Result{Stdout: "node1\n"})
+	srv := connectortest.NewSSHServer(t, fake.Run)
+	conn, err := connector.NewConnection(srv.KeyConfig())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	r, ok := conn.(connector.Reconnector)
+	require.True(t, ok)
+	require.NoError(t, r.Reconnect(ctx))
+	out, _, _, err := conn.Exec(ctx, "hostname")
+	require.NoError(t, err)
+	assert.Equal(t, "node1\n", string(out), "the same connection works after reconnecting")
+	assert.Equal(t, 1, conn.(connector.StatsReporter).Stats().Commands, "statistics survive reconnecting")
+
+	srv.Close()
+	assert.Error(t, r.Reconnect(ctx), "the host is down")
+	_, _, _, err = conn.Exec(ctx, "hostname")
+	assert.Error(t, err)
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	assert.ErrorIs(t, r.Reconnect(canceled), context.Canceled)
+}
@@ -0,0 +1,108 @@
+package connector
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// MaxResultOutput 是 CmdResult 保留的 stdout / stderr 各自的最大字节数, 超出部分被截断,
+// 避免 `journalctl` 之类输出巨大的命令占满内存和日志
+const MaxResultOutput = 1 << 20
+
+// CmdResult 是一次远程命令执行的结果. 命令本身的失败 (非零退出码) 与传输失败分开记录:
+// 前者体现在 ExitCode, 后者在 Err.
+type CmdResult struct {
+	Host     string
+	Command  string
+	Stdout   []byte
+	Stderr   []byte
+	ExitCode int
+	Duration time.Duration
+	// StdoutTruncated / StderrTruncated 表示对应输出超过 MaxResultOutput 被截断
+	StdoutTruncated bool
+	StderrTruncated bool
+	// Err 是传输层错误 (连接断开, 会话创建失败, ctx 取消等), 此时 ExitCode 为 -1
+	Err error
+}
+
+// Execute 在 exec 上执行 cmd 并返回结构化结果, host 仅用于记录. 结果总是非 nil.
+// SSH 连接把非零退出码同时作为 *ssh.ExitError 返回, 这里将其归入 ExitCode 而不是 Err.
+func Execute(ctx context.Context, exec Executor, host, cmd string) *CmdResult {
+	start := time.Now()
+	stdout, stderr, exitCode, err := exec.Exec(ctx, cmd)
+	r := &CmdResult{Host: host, Command: cmd, ExitCode: exitCode, Duration: time.Since(start)}
+	r.setErr(err)
+	r.Stdout, r.StdoutTruncated = truncateOutput(stdout)
+	r.Stderr, r.StderrTruncated = truncateOutput(stderr)
+	return r
+}
+
+// setErr 记录 Exec / PExec 返回的错误: *ssh.ExitError 只表示非零退出码, 其它为传输错误
+func (r *CmdResult) setErr(err error) {
+	var exitErr *ssh.ExitError
+	switch {
+	case errors.As(err, &exitErr):
+		if r.ExitCode == 0 {
+			r.ExitCode = exitErr.ExitStatus()
+		}
+	case err != nil:
+		r.Err = err
+		r.ExitCode = -1
+	}
+}
+
+func truncateOutput(b []byte) ([]byte, bool) {
+	if len(b) <= MaxResultOutput {
+		return b, false
+	}
+	return b[:MaxResultOutput], true
+}
+
+// Success 表示命令已执行且退出码为 0
+func (r *CmdResult) Success() bool {
+	return r.Err == nil && r.ExitCode == 0
+}
+
+// StdoutString 返回去除首尾空白的 stdout
+func (r *CmdResult) StdoutString() string {
+	return strings.TrimSpace(string(r.Stdout))
+}
+
+// StderrString 返回去除首尾空白的 stderr
+func (r *CmdResult) StderrString() string {
+	return strings.TrimSpace(string(r.Stderr))
+}
+
+// Combined 返回 stdout 与 stderr 拼接后的输出 (去除首尾空白), 用于错误信息和日志.
+// SSH 连接启用了 PTY, 两者已合并在 stdout 中, stderr 为空.
+func (r *CmdResult) Combined() string {
+	out, errOut := r.StdoutString(), r.StderrString()
+	switch {
+	case out == "":
+		return errOut
+	case errOut == "":
+		return out
+	}
+	return out + "\n" + errOut
+}
+
+// String 返回一行摘要, 用于日志和报告
+func (r *CmdResult) String() string {
+	var status string
+	switch {
+	case r.Err != nil:
+		status = "error: " + r.Err.Error()
+	default:
+		status = fmt.Sprintf("exit %d", r.ExitCode)
+	}
+	s := fmt.Sprintf("%s: %q %s in %s", r.Host, r.Command, status, r.Duration.Round(time.Millisecond))
+	if r.StdoutTruncated || r.StderrTruncated {
+		s += " (output truncated)"
+	}
+	return s
+}
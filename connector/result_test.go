@@ -0,0 +1,58 @@
+package connector_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mensylisir/xmcores/connector"
+	"github.com/mensylisir/xmcores/connector/connectortest"
+)
+
+func TestExecute(t *testing.T) {
+	ctx := context.Background()
+	fake := connectortest.NewFake().
+		On(`^hostname$`, connectortest.Result{Stdout: "node1\n"}).
+		On(`^fail$`, connectortest.Result{Stdout: "partial\n", Stderr: "boom\n", ExitCode: 2}).
+		On(`^unreachable$`, connectortest.Result{Err: errors.New("connection reset")}).
+		On(`^journalctl$`, connectortest.Result{Stdout: strings.Repeat("x", connector.MaxResultOutput+10)})
+
+	r := connector.Execute(ctx, fake, "node1", "hostname")
+	assert.True(t, r.Success())
+	assert.Equal(t, "node1", r.StdoutString())
+	assert.Equal(t, "node1", r.Host)
+	assert.Equal(t, "hostname", r.Command)
+
+	r = connector.Execute(ctx, fake, "node1", "fail")
+	assert.False(t, r.Success())
+	assert.NoError(t, r.Err)
+	assert.Equal(t, 2, r.ExitCode)
+	assert.Equal(t, "partial\nboom", r.Combined())
+	assert.Contains(t, r.String(), `node1: "fail" exit 2 in`)
+
+	r = connector.Execute(ctx, fake, "node1", "unreachable")
+	assert.False(t, r.Success())
+	assert.EqualError(t, r.Err, "connection reset")
+	assert.Equal(t, -1, r.ExitCode)
+
+	r = connector.Execute(ctx, fake, "node1", "journalctl")
+	assert.True(t, r.StdoutTruncated)
+	assert.False(t, r.StderrTruncated)
+	assert.Len(t, r.Stdout, connector.MaxResultOutput)
+	assert.Contains(t, r.String(), "(output truncated)")
+
+	// The SSH connection reports a non-zero exit as an *ssh.ExitError, which
+	// is still an executed command.
+	srv := connectortest.NewSSHServer(t, fake.Run)
+	conn, err := connector.NewConnection(srv.Config())
+	require.NoError(t, err)
+	defer conn.Close()
+	r = connector.Execute(ctx, conn, "node1", "fail")
+	assert.NoError(t, r.Err)
+	assert.Equal(t, 2, r.ExitCode)
+	assert.Contains(t, r.Combined(), "boom")
+}
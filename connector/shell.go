@@ -0,0 +1,123 @@
+package connector
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/mensylisir/xmcores/errs"
+)
+
+// WindowSize 是终端窗口的行数和列数
+type WindowSize struct {
+	Rows int
+	Cols int
+}
+
+// Shell 由支持交互式会话的连接实现
+type Shell interface {
+	// Shell 在主机上打开一个带 PTY 的登录 shell 并等待其退出. term 是远程的 TERM,
+	// size 是初始窗口大小, 之后的窗口变化通过 resize 传入. 返回 shell 的退出码,
+	// err 仅表示会话本身失败.
+	Shell(ctx context.Context, term string, size WindowSize, resize <-chan WindowSize, stdin io.Reader, stdout, stderr io.Writer) (exitCode int, err error)
+}
+
+var (
+	_ Shell = (*connection)(nil)
+	_ Shell = (*dockerConnection)(nil)
+)
+
+func (c *connection) Shell(ctx context.Context, term string, size WindowSize, resize <-chan WindowSize, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	hostAddr := fmt.Sprintf("%s:%d", c.config.Address, c.config.Port)
+	c.mu.Lock()
+	client := c.sshclient
+	c.mu.Unlock()
+	if client == nil {
+		return -1, errs.Newf(CodeConnClosed)
+	}
+	sess, err := client.NewSession()
+	if err != nil {
+		return -1, errs.WrapCode(err, CodeSessionCreate)
+	}
+	defer sess.Close()
+
+	// 与 createSession 不同, 交互式会话需要回显, 并使用本地终端的类型和大小
+	modes := ssh.TerminalModes{ssh.ECHO: 1, ssh.TTY_OP_ISPEED: 14400, ssh.TTY_OP_OSPEED: 14400}
+	if err := sess.RequestPty(term, size.Rows, size.Cols, modes); err != nil {
+		return -1, errs.WrapCode(err, CodePTYRequest)
+	}
+	sess.Stdin, sess.Stdout, sess.Stderr = stdin, stdout, stderr
+	if err := sess.Shell(); err != nil {
+		return -1, errs.WrapCode(err, CodeShellStart, hostAddr)
+	}
+	clog().Debugf("[Shell %s] 交互式 shell 已启动", hostAddr)
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				_ = sess.Close()
+				return
+			case s, ok := <-resize:
+				if !ok {
+					resize = nil
+					continue
+				}
+				if err := sess.WindowChange(s.Rows, s.Cols); err != nil {
+					clog().Debugf("[Shell %s] 调整窗口大小失败: %v", hostAddr, err)
+				}
+			}
+		}
+	}()
+
+	err = sess.Wait()
+	if err == nil {
+		return 0, nil
+	}
+	if exitErr, ok := errors.Cause(err).(*ssh.ExitError); ok {
+		return exitErr.ExitStatus(), nil
+	}
+	if ctx.Err() != nil {
+		return -1, ctx.Err()
+	}
+	return -1, errs.WrapCode(err, CodeShellAborted, hostAddr)
+}
+
+// Shell 通过 `docker exec -it` 打开 shell. stdin 须是本地终端, 窗口大小由 docker CLI 自行同步,
+// 因此 size 和 resize 只被忽略.
+func (c *dockerConnection) Shell(ctx context.Context, term string, _ WindowSize, resize <-chan WindowSize, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case _, ok := <-resize:
+				if !ok {
+					return
+				}
+			}
+		}
+	}()
+
+	command := exec.CommandContext(ctx, c.config.Binary, "exec", "-it", "-e", "TERM="+term, c.config.Container, c.CommandShell(ctx), "-l")
+	command.Stdin, command.Stdout, command.Stderr = stdin, stdout, stderr
+	err := command.Run()
+	if err == nil {
+		return 0, nil
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && ctx.Err() == nil && exitErr.ExitCode() != 125 {
+		return exitErr.ExitCode(), nil
+	}
+	return -1, errs.WrapCode(err, CodeContainerShell, c.config.Container)
+}
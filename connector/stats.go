@@ -0,0 +1,170 @@
+package connector
+
+import (
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Stats 是一个连接累计的传输和执行统计
+type Stats struct {
+	// Uploaded 和 Downloaded 是上传和下载的字节数
+	Uploaded   int64
+	Downloaded int64
+	// Commands 是执行的命令数, 包括文件操作内部执行的命令
+	Commands int
+	// Failures 是无法执行或以非零退出码结束的命令数, 加上失败的传输数
+	Failures int
+	// Latency 是所有命令耗时之和
+	Latency time.Duration
+}
+
+// MeanLatency 返回命令的平均耗时, 没有命令时为 0
+func (s Stats) MeanLatency() time.Duration {
+	if s.Commands == 0 {
+		return 0
+	}
+	return s.Latency / time.Duration(s.Commands)
+}
+
+// Add 返回 s 与 o 之和
+func (s Stats) Add(o Stats) Stats {
+	return Stats{
+		Uploaded:   s.Uploaded + o.Uploaded,
+		Downloaded: s.Downloaded + o.Downloaded,
+		Commands:   s.Commands + o.Commands,
+		Failures:   s.Failures + o.Failures,
+		Latency:    s.Latency + o.Latency,
+	}
+}
+
+// StatsReporter 由能报告自身统计的连接实现
+type StatsReporter interface {
+	// Stats 返回连接建立以来的统计, 连接关闭后仍可调用
+	Stats() Stats
+}
+
+var (
+	_ StatsReporter = (*connection)(nil)
+	_ StatsReporter = (*dockerConnection)(nil)
+)
+
+// StatsCounter 累计 Stats, 可并发使用. 连接实现在执行命令和传输文件后记录到其中.
+type StatsCounter struct {
+	mu    sync.Mutex
+	stats Stats
+}
+
+// Stats 返回累计的统计
+func (c *StatsCounter) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+// Command 记录一条从 start 开始, 以 exitCode 和 err 结束的命令
+func (c *StatsCounter) Command(start time.Time, exitCode int, err error) {
+	d := time.Since(start)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stats.Commands++
+	c.stats.Latency += d
+	if err != nil || exitCode != 0 {
+		c.stats.Failures++
+	}
+}
+
+// Uploaded 记录上传的 n 字节, err 非空时另记一次失败
+func (c *StatsCounter) Uploaded(n int64, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stats.Uploaded += n
+	if err != nil {
+		c.stats.Failures++
+	}
+}
+
+// Downloaded 记录下载的 n 字节, err 非空时另记一次失败
+func (c *StatsCounter) Downloaded(n int64, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stats.Downloaded += n
+	if err != nil {
+		c.stats.Failures++
+	}
+}
+
+// UploadedFile 记录本地文件 localPath 的上传, 成功时计入其大小
+func (c *StatsCounter) UploadedFile(localPath string, err error) {
+	c.Uploaded(fileSize(localPath, err), err)
+}
+
+// DownloadedFile 记录远程文件下载到 localPath, 成功时计入其大小
+func (c *StatsCounter) DownloadedFile(localPath string, err error) {
+	c.Downloaded(fileSize(localPath, err), err)
+}
+
+func fileSize(localPath string, err error) int64 {
+	if err != nil {
+		return 0
+	}
+	info, statErr := os.Stat(localPath)
+	if statErr != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// UploadReader 包装 r, 记录从中读出 (即上传) 的字节数, 由调用方在传输结束后调用 done
+func (c *StatsCounter) UploadReader(r io.Reader) (io.Reader, func(err error)) {
+	cr := &countingReader{r: r}
+	return cr, func(err error) { c.Uploaded(cr.n, err) }
+}
+
+// DownloadReader 包装 rc, 随读取记录下载的字节数
+func (c *StatsCounter) DownloadReader(rc io.ReadCloser) io.ReadCloser {
+	return &downloadReader{ReadCloser: rc, stats: c}
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+type downloadReader struct {
+	io.ReadCloser
+	stats *StatsCounter
+}
+
+func (r *downloadReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		r.stats.Downloaded(int64(n), nil)
+	}
+	return n, err
+}
+
+// Stats 实现 StatsReporter
+func (c *connection) Stats() Stats {
+	return c.stats.Stats()
+}
+
+// Stats 实现 StatsReporter
+func (c *dockerConnection) Stats() Stats {
+	return c.stats.Stats()
+}
+
+// Stats 转发给被包装的连接
+func (c *chaosConnection) Stats() Stats {
+	if r, ok := c.Connection.(StatsReporter); ok {
+		return r.Stats()
+	}
+	return Stats{}
+}
@@ -0,0 +1,46 @@
+package connector_test
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mensylisir/xmcores/connector"
+)
+
+func TestStatsCounter(t *testing.T) {
+	var c connector.StatsCounter
+	start := time.Now().Add(-2 * time.Second)
+	c.Command(start, 0, nil)
+	c.Command(start, 1, nil)
+	c.Command(start, -1, errors.New("session closed"))
+
+	r, done := c.UploadReader(strings.NewReader("hello"))
+	_, err := io.Copy(io.Discard, r)
+	require.NoError(t, err)
+	done(nil)
+	rc := c.DownloadReader(io.NopCloser(strings.NewReader("abc")))
+	_, err = io.Copy(io.Discard, rc)
+	require.NoError(t, err)
+
+	local := filepath.Join(t.TempDir(), "f")
+	require.NoError(t, os.WriteFile(local, make([]byte, 10), 0600))
+	c.UploadedFile(local, nil)
+	c.DownloadedFile(local, errors.New("no such file"))
+
+	s := c.Stats()
+	assert.Equal(t, int64(15), s.Uploaded)
+	assert.Equal(t, int64(3), s.Downloaded)
+	assert.Equal(t, 3, s.Commands)
+	assert.Equal(t, 3, s.Failures, "non-zero exits, errors and failed transfers")
+	assert.GreaterOrEqual(t, s.MeanLatency(), 2*time.Second)
+	assert.Equal(t, time.Duration(0), connector.Stats{}.MeanLatency())
+	assert.Equal(t, 6, s.Add(s).Commands)
+}
@@ -0,0 +1,168 @@
+package connector
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mensylisir/xmcores/errs"
+	"github.com/mensylisir/xmcores/shellquote"
+)
+
+// 流式下载输出中的分隔行. sudo 的密码提示等噪音会出现在开始标记之前, 因此只解码两个标记之间的内容.
+const (
+	streamBeginMarker = "__XM_STREAM_BEGIN__"
+	streamEndMarker   = "__XM_STREAM_END__"
+)
+
+// sudoDownload 通过 sudo 把远程文件以 base64 流的形式经 PExec 传回, 边解码边写入本地临时文件,
+// 同时计算 SHA-256 并与远程 sha256sum 的结果比对, 一致后再改名为 localPath. 内存占用与文件大小无关.
+// PTY 会改写二进制输出中的换行和控制字符, 所以不直接传输 cat 的原始输出.
+func (c *connection) sudoDownload(ctx context.Context, remotePath, localPath string) error {
+	hostAddr := fmt.Sprintf("%s:%d", c.config.Address, c.config.Port)
+	if err := os.MkdirAll(filepath.Dir(localPath), os.ModePerm); err != nil {
+		return errs.WrapCode(err, CodeLocalMkdir, filepath.Dir(localPath))
+	}
+	part := localPath + ".part"
+	f, err := os.OpenFile(part, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return errs.WrapCode(err, CodeLocalCreate, part)
+	}
+	fail := func(err error) error {
+		f.Close()
+		os.Remove(part)
+		return err
+	}
+
+	src := shellquote.Quote(remotePath)
+	cmd := c.sudoCommand(ctx, fmt.Sprintf("echo %s && cat %s | base64 && echo %s && sha256sum < %s",
+		streamBeginMarker, src, streamEndMarker, src))
+	w := newBase64StreamWriter(f)
+	exitCode, err := c.PExec(ctx, cmd, nil, w, nil)
+	if err != nil || exitCode != 0 {
+		return fail(errs.Newf(CodeSudoDownload, remotePath, exitCode, err, strings.TrimSpace(w.noise.String())))
+	}
+	if err := w.finish(); err != nil {
+		return fail(errs.WrapCode(err, CodeDecode, remotePath))
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(part)
+		return errs.WrapCode(err, CodeLocalWrite, part)
+	}
+
+	local := hex.EncodeToString(w.hash.Sum(nil))
+	remote := strings.Fields(w.trailer.String())
+	if len(remote) == 0 || remote[0] != local {
+		os.Remove(part)
+		return errs.Newf(CodeChecksumMismatch, remotePath, local, strings.TrimSpace(w.trailer.String()))
+	}
+	if err := os.Rename(part, localPath); err != nil {
+		os.Remove(part)
+		return errs.WrapCode(err, CodeLocalRename, part, localPath)
+	}
+	clog().Infof("[DownloadFile %s] Sudo: 成功下载 %s 到 %s (大小: %d bytes, sha256: %s)", hostAddr, remotePath, localPath, w.written, local)
+	return nil
+}
+
+// base64StreamWriter 按行解析 PExec 的输出: 开始标记之前的内容记入 noise, 标记之间的 base64 行
+// 逐行解码后写入 dst 并计入 hash, 结束标记之后的内容记入 trailer.
+type base64StreamWriter struct {
+	dst     io.Writer
+	hash    hash.Hash
+	line    []byte
+	state   int
+	written int64
+	err     error
+
+	noise   bytes.Buffer
+	trailer bytes.Buffer
+}
+
+const (
+	streamBeforeData = iota
+	streamInData
+	streamAfterData
+)
+
+// maxNoise 限制开始标记之前保留的输出, 只用于错误信息
+const maxNoise = 4096
+
+func newBase64StreamWriter(dst io.Writer) *base64StreamWriter {
+	return &base64StreamWriter{dst: dst, hash: sha256.New()}
+}
+
+func (w *base64StreamWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	for _, b := range p {
+		if b != '\n' {
+			w.line = append(w.line, b)
+			// base64 每行 76 个字符, 数据段中出现超长行说明输出已损坏
+			if w.state == streamInData && len(w.line) > 1024 {
+				w.err = errs.Newf(CodeBase64LineTooLong)
+				return 0, w.err
+			}
+			continue
+		}
+		if err := w.handleLine(strings.TrimRight(string(w.line), "\r")); err != nil {
+			w.err = err
+			return 0, err
+		}
+		w.line = w.line[:0]
+	}
+	return len(p), nil
+}
+
+func (w *base64StreamWriter) handleLine(line string) error {
+	switch w.state {
+	case streamBeforeData:
+		if line == streamBeginMarker {
+			w.state = streamInData
+		} else if w.noise.Len() < maxNoise {
+			w.noise.WriteString(line + "\n")
+		}
+	case streamInData:
+		if line == streamEndMarker {
+			w.state = streamAfterData
+			return nil
+		}
+		data, err := base64.StdEncoding.DecodeString(line)
+		if err != nil {
+			return errs.WrapCode(err, CodeBase64Line, line)
+		}
+		if _, err := w.dst.Write(data); err != nil {
+			return err
+		}
+		w.hash.Write(data)
+		w.written += int64(len(data))
+	case streamAfterData:
+		w.trailer.WriteString(line + "\n")
+	}
+	return nil
+}
+
+// finish 处理最后一个不以换行结尾的行, 并检查数据段是否完整
+func (w *base64StreamWriter) finish() error {
+	if w.err != nil {
+		return w.err
+	}
+	if len(w.line) > 0 {
+		if err := w.handleLine(strings.TrimRight(string(w.line), "\r")); err != nil {
+			return err
+		}
+		w.line = w.line[:0]
+	}
+	if w.state != streamAfterData {
+		return errs.Newf(CodeNoEndMarker, strings.TrimSpace(w.noise.String()))
+	}
+	return nil
+}
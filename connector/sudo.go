@@ -0,0 +1,185 @@
+package connector
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/mensylisir/xmcores/errs"
+	"github.com/mensylisir/xmcores/shellquote"
+)
+
+// DefaultSudoPrompt 匹配 sudo 和 PAM 的密码提示. 它只依赖不随语言变化的部分:
+// sudo 的 "[sudo] " 前缀, 或常见语言中 "密码" 一词, 加上行尾的冒号 (含全角冒号),
+// 因此远端 sshd 不接受 LANG/LC_ALL 而输出本地化提示时仍能识别.
+const DefaultSudoPrompt = `(?i)^(\[sudo\] .*|.*(password|passwort|mot de passe|contraseña|senha|parola|пароль|密码|密碼|パスワード|암호).*)[:：]\s*$`
+
+// SudoProber 由能探测 sudo 是否需要密码的连接实现
+type SudoProber interface {
+	// SudoNoPassword 报告以连接用户执行 sudo 是否无需密码 (NOPASSWD)
+	SudoNoPassword(ctx context.Context) (bool, error)
+}
+
+// sudoState 缓存 sudo -n true 的探测结果, 每个连接只探测一次
+type sudoState struct {
+	mu     sync.Mutex
+	probed bool
+	nopass bool
+}
+
+func compileSudoPrompt(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		pattern = DefaultSudoPrompt
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, errs.WrapCode(err, CodeInvalidSudoPrompt, pattern)
+	}
+	return re, nil
+}
+
+// isSudoPrompt 判断 PTY 输出的当前行是否为密码提示
+func (c *connection) isSudoPrompt(line string) bool {
+	re := c.sudoPrompt
+	if re == nil {
+		re = regexp.MustCompile(DefaultSudoPrompt)
+	}
+	return re.MatchString(line)
+}
+
+// SudoNoPassword 执行 sudo -n true 探测 sudo 是否无需密码. 探测成功 (无论结果)
+// 后缓存在连接上; 命令未能执行 (如连接中断) 时返回错误且不缓存, 下次重新探测.
+func (c *connection) SudoNoPassword(ctx context.Context) (bool, error) {
+	c.sudo.mu.Lock()
+	defer c.sudo.mu.Unlock()
+	if c.sudo.probed {
+		return c.sudo.nopass, nil
+	}
+	_, _, exitCode, err := c.exec(ctx, "sudo -n true", "")
+	if exitCode < 0 {
+		return false, errs.WrapCode(err, CodeSudoProbe)
+	}
+	c.sudo.probed, c.sudo.nopass = true, exitCode == 0
+	clog().Debugf("[Sudo %s:%d] sudo 无需密码: %t", c.config.Address, c.config.Port, c.sudo.nopass)
+	return c.sudo.nopass, nil
+}
+
+// sudoPassword 返回执行命令时需要注入的 sudo 密码. 未配置密码, 或探测到 sudo 无需
+// 密码时返回空串, 跳过整个密码注入流程; 探测失败时保守地照常注入.
+func (c *connection) sudoPassword(ctx context.Context) string {
+	if c.config.Password == "" {
+		return ""
+	}
+	nopass, err := c.SudoNoPassword(ctx)
+	if err != nil {
+		clog().Debugf("[Sudo %s:%d] %v, 将照常注入密码", c.config.Address, c.config.Port, err)
+		return c.config.Password
+	}
+	if nopass {
+		return ""
+	}
+	return c.config.Password
+}
+
+const (
+	// DefaultShell 是 sudo 包装命令使用的 shell
+	DefaultShell = "/bin/bash"
+	// FallbackShell 在主机没有 DefaultShell 时使用 (如 Alpine 等精简镜像), 任何 POSIX 系统都提供
+	FallbackShell = "/bin/sh"
+)
+
+var umaskPattern = regexp.MustCompile(`^0?[0-7]{3}$`)
+
+// ShellProvider 由知道目标主机 shell 和 umask 的连接实现, 见 SudoCommand
+type ShellProvider interface {
+	// CommandShell 返回包装命令使用的 shell: 配置的 shell, 否则探测 DefaultShell 是否存在, 不存在时为 FallbackShell
+	CommandShell(ctx context.Context) string
+	// Umask 返回以 sudo 执行的命令使用的 umask, 空串表示沿用 sudo 的默认值
+	Umask() string
+}
+
+// ValidateUmask 检查 umask 是否为三或四位八进制数, 空串表示不设置
+func ValidateUmask(umask string) error {
+	if umask != "" && !umaskPattern.MatchString(umask) {
+		return errs.Newf(CodeInvalidUmask, umask)
+	}
+	return nil
+}
+
+// SudoPrefixWith 使用 "<shell> -c" 将命令包装起来以便用 sudo 执行, shell 为空时使用 DefaultShell;
+// umask 非空时命令在该 umask 下执行. 命令整体以单引号传给 shell, 登录 shell 不会展开其中的
+// $(...), 反引号和变量, 因此 shellquote.Quote 过的单词原样到达 sudo 启动的 shell.
+func SudoPrefixWith(shell, umask, command string) string {
+	if shell == "" {
+		shell = DefaultShell
+	}
+	if umask != "" {
+		command = "umask " + umask + "; " + command
+	}
+	return "sudo -E " + shell + " -c " + shellquote.Quote(command)
+}
+
+// SudoCommand 返回在 exec 上以 sudo 执行 command 的命令: exec 实现 ShellProvider 时使用其 shell 和 umask,
+// 否则与 SudoPrefix 相同.
+func SudoCommand(ctx context.Context, exec Executor, command string) string {
+	if p, ok := exec.(ShellProvider); ok {
+		return SudoPrefixWith(p.CommandShell(ctx), p.Umask(), command)
+	}
+	return SudoPrefix(command)
+}
+
+// shellState 缓存 shell 的探测结果, 每个连接只探测一次
+type shellState struct {
+	mu   sync.Mutex
+	path string
+}
+
+// detect 返回 configured, 未配置时用 run 探测: DefaultShell 可执行时使用它, 否则使用 FallbackShell.
+// run 返回命令的退出码, -1 表示无法执行, 此时不缓存并假定为 DefaultShell, 由之后的命令报告错误.
+func (s *shellState) detect(ctx context.Context, configured string, run func(ctx context.Context, cmd string) int) string {
+	if configured != "" {
+		return configured
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.path != "" {
+		return s.path
+	}
+	switch code := run(ctx, "test -x "+DefaultShell); {
+	case code == 0:
+		s.path = DefaultShell
+	case code > 0:
+		s.path = FallbackShell
+	default:
+		return DefaultShell
+	}
+	clog().Debugf("探测到 shell: %s", s.path)
+	return s.path
+}
+
+// CommandShell 见 ShellProvider
+func (c *connection) CommandShell(ctx context.Context) string {
+	return c.shell.detect(ctx, c.config.Shell, func(ctx context.Context, cmd string) int {
+		_, _, exitCode, _ := c.exec(ctx, cmd, "")
+		return exitCode
+	})
+}
+
+// Umask 见 ShellProvider
+func (c *connection) Umask() string {
+	return c.config.Umask
+}
+
+// sudoCommand 按该连接的 shell 和 umask 包装 command 以便用 sudo 执行
+func (c *connection) sudoCommand(ctx context.Context, command string) string {
+	return SudoPrefixWith(c.CommandShell(ctx), c.Umask(), command)
+}
+
+// ValidateShell 检查 shell 是否为不含空白和引号的绝对路径, 空串表示自动探测
+func ValidateShell(shell string) error {
+	if shell != "" && (!strings.HasPrefix(shell, "/") || strings.ContainsAny(shell, " \t\"'")) {
+		return errs.Newf(CodeInvalidShell, shell)
+	}
+	return nil
+}
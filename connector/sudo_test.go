@@ -0,0 +1,100 @@
+package connector_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mensylisir/xmcores/connector"
+	"github.com/mensylisir/xmcores/connector/connectortest"
+)
+
+func TestSudoNoPassword(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		name   string
+		result connectortest.Result
+		nopass bool
+	}{
+		{"nopasswd", connectortest.Result{}, true},
+		{"password required", connectortest.Result{Stderr: "sudo: a password is required\n", ExitCode: 1}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fake := connectortest.NewFake().
+				On(`^sudo -n true$`, tc.result).
+				On(`^hostname$`, connectortest.Result{Stdout: "node1\n"})
+			srv := connectortest.NewSSHServer(t, fake.Run)
+			conn, err := connector.NewConnection(srv.Config())
+			require.NoError(t, err)
+			defer conn.Close()
+
+			for i := 0; i < 2; i++ {
+				out, _, code, err := conn.Exec(ctx, "hostname")
+				require.NoError(t, err)
+				assert.Zero(t, code)
+				assert.Contains(t, string(out), "node1")
+			}
+			nopass, err := conn.(connector.SudoProber).SudoNoPassword(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, tc.nopass, nopass)
+			assert.Equal(t, []string{"sudo -n true", "hostname", "hostname"}, fake.Commands(), "probed once per connection")
+		})
+	}
+
+	// Without a password there is nothing to inject, so nothing is probed.
+	fake := connectortest.NewFake().On(`^hostname$`, connectortest.Result{Stdout: "node1\n"})
+	srv := connectortest.NewSSHServer(t, fake.Run)
+	conn, err := connector.NewConnection(srv.KeyConfig())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, _, _, err = conn.Exec(ctx, "hostname")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"hostname"}, fake.Commands())
+}
+
+func TestSudoPrompt(t *testing.T) {
+	cfg := connectortest.NewSSHServer(t, nil).Config()
+	cfg.SudoPrompt = "(["
+	_, err := connector.NewConnection(cfg)
+	assert.Error(t, err)
+}
+
+func TestSudoCommand(t *testing.T) {
+	ctx := context.Background()
+	fake := connectortest.NewFake().On(`^test -x /bin/bash$`, connectortest.Result{ExitCode: 1})
+	srv := connectortest.NewSSHServer(t, fake.Run)
+	cfg := srv.KeyConfig()
+	cfg.Umask = "0027"
+	conn, err := connector.NewConnection(cfg)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, `sudo -E /bin/sh -c 'umask 0027; id -u'`, connector.SudoCommand(ctx, conn, "id -u"))
+	}
+	assert.Equal(t, []string{"test -x /bin/bash"}, fake.Commands(), "detected once per connection")
+
+	// A configured shell is used as is.
+	cfg.Shell, cfg.Umask = "/usr/bin/zsh", ""
+	configured, err := connector.NewConnection(cfg)
+	require.NoError(t, err)
+	defer configured.Close()
+	assert.Equal(t, `sudo -E /usr/bin/zsh -c 'id -u'`, connector.SudoCommand(ctx, configured, "id -u"))
+	assert.Len(t, fake.Commands(), 1)
+
+	// Executors that know nothing about the host fall back to SudoPrefix.
+	assert.Equal(t, connector.SudoPrefix("id -u"), connector.SudoCommand(ctx, connectortest.NewFake(), "id -u"))
+
+	for _, bad := range []func(*connector.Config){
+		func(c *connector.Config) { c.Shell = "sh" },
+		func(c *connector.Config) { c.Shell = "/bin/sh -x" },
+		func(c *connector.Config) { c.Umask = "u=rwx" },
+	} {
+		cfg := srv.KeyConfig()
+		bad(&cfg)
+		_, err := connector.NewConnection(cfg)
+		assert.Error(t, err)
+	}
+}
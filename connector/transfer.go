@@ -0,0 +1,217 @@
+package connector
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/mensylisir/xmcores/errs"
+	"github.com/mensylisir/xmcores/shellquote"
+)
+
+// 文件传输方式, 用于 Config.FileTransfer
+const (
+	// FileTransferAuto 优先使用 SFTP, 目标主机的 sshd 未启用 SFTP 子系统时自动回退到 exec
+	FileTransferAuto = ""
+	// FileTransferSFTP 只使用 SFTP, SFTP 不可用时连接失败
+	FileTransferSFTP = "sftp"
+	// FileTransferExec 不使用 SFTP, 通过执行 cat/base64 等命令传输文件
+	FileTransferExec = "exec"
+)
+
+// execChunkSize 是 exec 方式上传时每条命令携带的原始字节数. 编码后约 64KiB,
+// 低于 Linux 单个命令行参数 128KiB 的上限; 取 3 的倍数使每块的 base64 不含填充.
+const execChunkSize = 48 * 1024
+
+func validateFileTransfer(mode string) error {
+	switch mode {
+	case FileTransferAuto, FileTransferSFTP, FileTransferExec:
+		return nil
+	default:
+		return errs.Newf(CodeInvalidTransfer, mode, FileTransferSFTP, FileTransferExec)
+	}
+}
+
+// FileTransfer 返回该连接实际使用的文件传输方式: FileTransferSFTP 或 FileTransferExec
+func (c *connection) FileTransfer() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sftpclient == nil {
+		return FileTransferExec
+	}
+	return FileTransferSFTP
+}
+
+func (c *connection) useExecTransfer() bool {
+	return c.FileTransfer() == FileTransferExec
+}
+
+// execRun 执行 cmd (UseSudoForFileOps 时通过 sudo), 返回 PTY 合并后的输出和退出码.
+// 命令的非零退出码不作为错误返回, err 仅表示执行失败.
+func (c *connection) execRun(ctx context.Context, cmd string) ([]byte, int, error) {
+	if c.config.UseSudoForFileOps {
+		cmd = c.sudoCommand(ctx, cmd)
+	}
+	stdout, stderr, exitCode, err := c.Exec(ctx, cmd)
+	if err != nil {
+		if _, ok := errors.Cause(err).(*ssh.ExitError); !ok {
+			return nil, -1, err
+		}
+	}
+	return append(stdout, stderr...), exitCode, nil
+}
+
+// execCheck 执行 cmd, 非零退出码作为错误返回, 错误信息包含命令输出
+func (c *connection) execCheck(ctx context.Context, cmd string) ([]byte, error) {
+	out, exitCode, err := c.execRun(ctx, cmd)
+	if err != nil {
+		return nil, err
+	}
+	if exitCode != 0 {
+		return nil, errs.Newf(CodeCommandExit, cmd, exitCode, strings.TrimSpace(string(out)))
+	}
+	return out, nil
+}
+
+// chownSuffix 返回 sudo 文件操作后把 remotePath 交给 UserForSudoFileOps 的命令片段
+func (c *connection) chownSuffix(remotePath string) string {
+	if !c.config.UseSudoForFileOps || c.config.UserForSudoFileOps == "" {
+		return ""
+	}
+	return fmt.Sprintf(" && chown %s %s", shellquote.Quote(c.config.UserForSudoFileOps), shellquote.Quote(remotePath))
+}
+
+func (c *connection) execFetch(ctx context.Context, remotePath string) ([]byte, error) {
+	out, err := c.execCheck(ctx, "base64 < "+shellquote.Quote(remotePath))
+	if err != nil {
+		return nil, errs.WrapCode(err, CodeRemoteRead, remotePath)
+	}
+	// base64 按行折叠输出, PTY 还会把换行转换为 \r\n, 解码前去掉所有空白
+	data, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(out)), ""))
+	if err != nil {
+		return nil, errs.WrapCode(err, CodeDecode, remotePath)
+	}
+	return data, nil
+}
+
+// execWrite 把 r 的内容分块编码为 base64, 逐块追加到同目录的临时文件, 最后原子地移动到 remotePath.
+// PTY 会改写二进制的标准输入, 因此不通过 stdin 传输内容.
+func (c *connection) execWrite(ctx context.Context, r io.Reader, remotePath string, mode os.FileMode) error {
+	hostAddr := fmt.Sprintf("%s:%d", c.config.Address, c.config.Port)
+	tmp := shellquote.Quote(remotePath + ".xm-upload")
+	dst := shellquote.Quote(remotePath)
+	if _, err := c.execCheck(ctx, fmt.Sprintf("mkdir -p %s && : > %s", shellquote.Quote(path.Dir(remotePath)), tmp)); err != nil {
+		return errs.WrapCode(err, CodeRemoteCreate, remotePath)
+	}
+	cleanup := func() {
+		if _, err := c.execCheck(ctx, "rm -f "+tmp); err != nil {
+			clog().Warnf("[execWrite %s] 删除临时文件 %s.xm-upload 失败: %v", hostAddr, remotePath, err)
+		}
+	}
+
+	buf := make([]byte, execChunkSize)
+	var total int64
+	for {
+		n, readErr := io.ReadFull(r, buf)
+		if n > 0 {
+			chunk := base64.StdEncoding.EncodeToString(buf[:n])
+			if _, err := c.execCheck(ctx, fmt.Sprintf("printf '%%s' '%s' | base64 -d >> %s", chunk, tmp)); err != nil {
+				cleanup()
+				return errs.WrapCode(err, CodeUpload, remotePath, total)
+			}
+			total += int64(n)
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			cleanup()
+			return errs.WrapCode(readErr, CodeLocalRead)
+		}
+	}
+
+	if _, err := c.execCheck(ctx, fmt.Sprintf("mv -f %s %s && chmod %04o %s%s", tmp, dst, mode.Perm(), dst, c.chownSuffix(remotePath))); err != nil {
+		cleanup()
+		return errs.WrapCode(err, CodeRemoteRename, remotePath)
+	}
+	clog().Debugf("[execWrite %s] 成功写入 %d 字节到 %s", hostAddr, total, remotePath)
+	return nil
+}
+
+func (c *connection) execStat(ctx context.Context, remotePath string) (os.FileInfo, error) {
+	out, exitCode, err := c.execRun(ctx, "stat -c '%s %f %Y' "+shellquote.Quote(remotePath))
+	if err != nil {
+		return nil, err
+	}
+	if exitCode != 0 {
+		if strings.Contains(string(out), "No such file") {
+			return nil, errors.Wrapf(os.ErrNotExist, "stat %s", remotePath)
+		}
+		return nil, errs.Newf(CodeStat, remotePath, strings.TrimSpace(string(out)))
+	}
+	return parseStat(remotePath, string(out))
+}
+
+func (c *connection) execTest(ctx context.Context, flag, remotePath string) (bool, error) {
+	_, exitCode, err := c.execRun(ctx, "test "+flag+" "+shellquote.Quote(remotePath))
+	if err != nil {
+		return false, errs.WrapCode(err, CodeRemoteTest, flag, remotePath)
+	}
+	return exitCode == 0, nil
+}
+
+func (c *connection) execMkDirAll(ctx context.Context, remotePath string, mode os.FileMode) error {
+	p := shellquote.Quote(remotePath)
+	if _, err := c.execCheck(ctx, fmt.Sprintf("mkdir -p %s && chmod %04o %s%s", p, mode.Perm(), p, c.chownSuffix(remotePath))); err != nil {
+		return errs.WrapCode(err, CodeRemoteMkdir, remotePath)
+	}
+	return nil
+}
+
+func (c *connection) execChmod(ctx context.Context, remotePath string, mode os.FileMode) error {
+	if _, err := c.execCheck(ctx, fmt.Sprintf("chmod %04o %s", mode.Perm(), shellquote.Quote(remotePath))); err != nil {
+		return errs.WrapCode(err, CodeRemoteChmod, remotePath)
+	}
+	return nil
+}
+
+func (c *connection) execDownload(ctx context.Context, remotePath, localPath string) error {
+	data, err := c.execFetch(ctx, remotePath)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(localPath), os.ModePerm); err != nil {
+		return errs.WrapCode(err, CodeLocalMkdir, filepath.Dir(localPath))
+	}
+	return errs.WrapCode(os.WriteFile(localPath, data, 0644), CodeLocalWrite, localPath)
+}
+
+func (c *connection) execUpload(ctx context.Context, localPath, remotePath string) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return errs.WrapCode(err, CodeLocalOpen, localPath)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return errs.WrapCode(err, CodeLocalStat, localPath)
+	}
+	return c.execWrite(ctx, f, remotePath, info.Mode().Perm())
+}
+
+func (c *connection) execFetchReader(ctx context.Context, remotePath string) (io.ReadCloser, error) {
+	data, err := c.execFetch(ctx, remotePath)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
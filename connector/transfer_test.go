@@ -0,0 +1,151 @@
+package connector_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mensylisir/xmcores/connector"
+	"github.com/mensylisir/xmcores/connector/connectortest"
+)
+
+func fileTransfer(t *testing.T, conn connector.Connection) string {
+	t.Helper()
+	c, ok := conn.(interface{ FileTransfer() string })
+	require.True(t, ok)
+	return c.FileTransfer()
+}
+
+func TestExecFileTransferFallback(t *testing.T) {
+	ctx := context.Background()
+	srv := connectortest.NewSSHServer(t, connectortest.Shell)
+	srv.DisableSFTP()
+
+	conn, err := connector.NewConnection(srv.Config())
+	require.NoError(t, err, "a missing SFTP subsystem must not fail the connection")
+	defer conn.Close()
+	assert.Equal(t, connector.FileTransferExec, fileTransfer(t, conn))
+
+	dir := t.TempDir()
+	remote := filepath.Join(dir, "etc", "xm", "data.bin")
+	// Larger than one chunk and covering every byte value, which a PTY would mangle on stdin.
+	content := bytes.Repeat([]byte{0, 1, '\n', '\r', 4, 0x7f, 0xff, '\''}, 20000)
+	for i := 0; i < 256; i++ {
+		content = append(content, byte(i))
+	}
+	require.NoError(t, conn.Scp(ctx, bytes.NewReader(content), remote, int64(len(content)), 0640))
+
+	written, err := os.ReadFile(remote)
+	require.NoError(t, err)
+	assert.Equal(t, content, written)
+
+	info, err := conn.StatRemote(ctx, remote)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(content)), info.Size())
+	assert.Equal(t, os.FileMode(0640), info.Mode())
+	_, err = conn.StatRemote(ctx, filepath.Join(dir, "missing"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	rc, err := conn.Fetch(ctx, remote)
+	require.NoError(t, err)
+	fetched, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	assert.Equal(t, content, fetched)
+
+	local := filepath.Join(dir, "local", "copy")
+	require.NoError(t, conn.DownloadFile(ctx, remote, local))
+	require.NoError(t, conn.UploadFile(ctx, local, filepath.Join(dir, "uploaded")))
+	uploaded, err := os.ReadFile(filepath.Join(dir, "uploaded"))
+	require.NoError(t, err)
+	assert.Equal(t, content, uploaded)
+
+	sub := filepath.Join(dir, "a", "b")
+	require.NoError(t, conn.MkDirAll(ctx, sub, 0700))
+	ok, err := conn.RemoteDirExist(ctx, sub)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = conn.RemoteFileExist(ctx, sub)
+	require.NoError(t, err)
+	assert.False(t, ok)
+	ok, err = conn.RemoteFileExist(ctx, remote)
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	require.NoError(t, conn.Chmod(ctx, remote, 0600))
+	st, err := os.Stat(remote)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), st.Mode().Perm())
+}
+
+func TestFileTransferSelection(t *testing.T) {
+	srv := connectortest.NewSSHServer(t, connectortest.Shell)
+
+	conn, err := connector.NewConnection(srv.Config())
+	require.NoError(t, err)
+	assert.Equal(t, connector.FileTransferSFTP, fileTransfer(t, conn))
+	require.NoError(t, conn.Close())
+
+	cfg := srv.Config()
+	cfg.FileTransfer = connector.FileTransferExec
+	conn, err = connector.NewConnection(cfg)
+	require.NoError(t, err)
+	assert.Equal(t, connector.FileTransferExec, fileTransfer(t, conn))
+	require.NoError(t, conn.Close())
+
+	srv.DisableSFTP()
+	cfg.FileTransfer = connector.FileTransferSFTP
+	_, err = connector.NewConnection(cfg)
+	assert.Error(t, err, "sftp was required")
+
+	cfg.FileTransfer = "scp"
+	_, err = connector.NewConnection(cfg)
+	assert.Error(t, err)
+}
+
+func TestSudoDownloadStreams(t *testing.T) {
+	ctx := context.Background()
+	srv := connectortest.NewSSHServer(t, func(cmd string) connectortest.Result {
+		if !strings.HasPrefix(cmd, "sudo -E ") {
+			return connectortest.Shell(cmd)
+		}
+		// Prompt noise before the payload must be skipped.
+		res := connectortest.Shell(strings.TrimPrefix(cmd, "sudo -E "))
+		res.Stdout = "[sudo] password for xm: \n" + res.Stdout
+		return res
+	})
+	cfg := srv.Config()
+	cfg.UseSudoForFileOps = true
+	conn, err := connector.NewConnection(cfg)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	dir := t.TempDir()
+	remote := filepath.Join(dir, "remote", "data.bin")
+	require.NoError(t, os.MkdirAll(filepath.Dir(remote), 0755))
+	content := bytes.Repeat([]byte{0, 1, '\n', '\r', 4, 0x7f, 0xff, '\''}, 20000)
+	for i := 0; i < 256; i++ {
+		content = append(content, byte(i))
+	}
+	require.NoError(t, os.WriteFile(remote, content, 0600))
+
+	local := filepath.Join(dir, "local", "data.bin")
+	require.NoError(t, conn.DownloadFile(ctx, remote, local))
+	downloaded, err := os.ReadFile(local)
+	require.NoError(t, err)
+	assert.Equal(t, content, downloaded)
+	_, err = os.Stat(local + ".part")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	missing := filepath.Join(dir, "local", "missing.bin")
+	assert.Error(t, conn.DownloadFile(ctx, filepath.Join(dir, "remote", "missing.bin"), missing))
+	_, err = os.Stat(missing + ".part")
+	assert.ErrorIs(t, err, os.ErrNotExist, "a failed download must not leave a partial file")
+}
@@ -0,0 +1,169 @@
+package connector
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/mensylisir/xmcores/errs"
+	"github.com/mensylisir/xmcores/shellquote"
+)
+
+// BackupTimeFormat 是 WriteOptions.Backup 保留的备份文件名中的时间戳, 如 kubelet.env.20240131-150405.bak
+const BackupTimeFormat = "20060102-150405"
+
+// WriteOptions 控制 WriteRemoteFile, UploadFileWith 和 ReplaceFile 如何替换远程文件
+type WriteOptions struct {
+	// Atomic 先写入目标旁的临时文件再改名到位, 读者不会看到写了一半的文件
+	Atomic bool
+	// Backup 先把被替换的文件复制为 <path>.<时间戳>.bak, 隐含 Atomic
+	Backup bool
+	// Owner 和 Group 为用户和组的名称或数字 id, 以 chown 赋予文件; 为空时文件属于连接用户, 以 sudo 写入时属于 root
+	Owner string
+	Group string
+	// PreserveOwner 在未设置 Owner 和 Group 时赋予文件本地文件所属的用户和组名称, 只对本地文件有效,
+	// 这些名称须在主机上存在
+	PreserveOwner bool
+}
+
+// chown 返回把 p 赋予 opts 中用户和组的 chown 命令, 两者均未设置时返回空串
+func (opts WriteOptions) chown(p string) string {
+	switch {
+	case opts.Owner == "" && opts.Group == "":
+		return ""
+	case opts.Group == "":
+		return fmt.Sprintf("chown %s %s", shellquote.Quote(opts.Owner), shellquote.Quote(p))
+	default:
+		return fmt.Sprintf("chown %s %s", shellquote.Quote(opts.Owner+":"+opts.Group), shellquote.Quote(p))
+	}
+}
+
+// ReplaceHooks 让调用方介入 ReplaceFile 的各个阶段, 如记录变更或登记临时文件以便中断后清理. 各字段均可为 nil
+type ReplaceHooks struct {
+	// Before 在内容改变的文件被写入前调用, sum 为新内容的 sha256, prior 为被替换文件的 sha256,
+	// 文件不存在时为空串. 返回错误时不写入
+	Before func(ctx context.Context, sum, prior string) error
+	// Temp 在写入临时文件前调用
+	Temp func(tmp string)
+	// Placed 在临时文件改名到位后调用
+	Placed func(tmp string)
+}
+
+// WriteRemoteFile 把 content 写入 remotePath, 内容相同时不改动文件, 否则按 opts 替换; 所有者总是按 opts 设置.
+// 返回内容是否改变.
+func WriteRemoteFile(ctx context.Context, c Connection, content []byte, remotePath string, mode os.FileMode, opts WriteOptions) (bool, error) {
+	return ReplaceFile(ctx, c, bytes.NewReader(content), remotePath, mode, opts, ReplaceHooks{})
+}
+
+// UploadFileWith 与 WriteRemoteFile 相同, 内容为本地文件 localPath, 以流的方式传输而不读入内存
+func UploadFileWith(ctx context.Context, c Connection, localPath, remotePath string, mode os.FileMode, opts WriteOptions) (bool, error) {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return false, errs.WrapCode(err, CodeLocalOpen, localPath)
+	}
+	defer f.Close()
+	return ReplaceFile(ctx, c, f, remotePath, mode, opts, ReplaceHooks{})
+}
+
+// ReplaceFile 是 WriteRemoteFile 和 UploadFileWith 的实现, 内容读自 src. src 为 *os.File 时 opts.PreserveOwner 生效.
+// 命令以 sudo 执行, 错误的类别同 runSudo.
+func ReplaceFile(ctx context.Context, c Connection, src io.ReadSeeker, remotePath string, mode os.FileMode, opts WriteOptions, hooks ReplaceHooks) (bool, error) {
+	if f, ok := src.(*os.File); ok && opts.PreserveOwner && opts.Owner == "" && opts.Group == "" {
+		var err error
+		if opts.Owner, opts.Group, err = fileOwner(f); err != nil {
+			return false, errs.WrapCode(err, CodeLocalStat, f.Name())
+		}
+	}
+	h := sha256.New()
+	size, err := io.Copy(h, src)
+	if err != nil {
+		return false, errs.WrapCode(err, CodeLocalRead)
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	write := func(dst string) error {
+		if _, err := src.Seek(0, io.SeekStart); err != nil {
+			return errs.WrapCode(err, CodeLocalRead)
+		}
+		return errs.WrapCode(c.Scp(ctx, src, dst, size, mode), CodeRemoteWrite, dst)
+	}
+
+	current, err := runSudo(ctx, c, fmt.Sprintf("test ! -f %[1]s || sha256sum %[1]s", shellquote.Quote(remotePath)))
+	if err != nil {
+		return false, err
+	}
+	prior := ""
+	if fields := strings.Fields(current); len(fields) > 0 {
+		prior = fields[0]
+	}
+	if prior == sum {
+		if chown := opts.chown(remotePath); chown != "" {
+			if _, err := runSudo(ctx, c, chown); err != nil {
+				return false, err
+			}
+		}
+		return false, nil
+	}
+	if hooks.Before != nil {
+		if err := hooks.Before(ctx, sum, prior); err != nil {
+			return false, err
+		}
+	}
+	if !opts.Atomic && !opts.Backup {
+		if err := write(remotePath); err != nil {
+			return false, err
+		}
+		if chown := opts.chown(remotePath); chown != "" {
+			if _, err := runSudo(ctx, c, chown); err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	}
+
+	// 临时文件须在同一文件系统上, mv 才是改名
+	tmp := path.Join(path.Dir(remotePath), fmt.Sprintf(".%s.%s.tmp", path.Base(remotePath), uuid.New().String()[:8]))
+	if hooks.Temp != nil {
+		hooks.Temp(tmp)
+	}
+	if err := write(tmp); err != nil {
+		return false, err
+	}
+	var cmd bytes.Buffer
+	if chown := opts.chown(tmp); chown != "" {
+		cmd.WriteString(chown + " && ")
+	}
+	if opts.Backup {
+		fmt.Fprintf(&cmd, "if [ -f %[1]s ]; then cp -p %[1]s %[2]s; fi && ",
+			shellquote.Quote(remotePath), shellquote.Quote(remotePath+"."+time.Now().Format(BackupTimeFormat)+".bak"))
+	}
+	fmt.Fprintf(&cmd, "mv -f %s %s", shellquote.Quote(tmp), shellquote.Quote(remotePath))
+	if _, err := runSudo(ctx, c, cmd.String()); err != nil {
+		return false, err
+	}
+	if hooks.Placed != nil {
+		hooks.Placed(tmp)
+	}
+	return true, nil
+}
+
+// runSudo 以 sudo 执行 cmd 并返回其标准输出. 无法执行时返回 errs.Connectivity 类别的错误,
+// 非零退出码返回 errs.Execution 类别的错误.
+func runSudo(ctx context.Context, c Executor, cmd string) (string, error) {
+	r := Execute(ctx, c, "", SudoCommand(ctx, c, cmd))
+	switch {
+	case r.Err != nil:
+		return "", errs.Wrap(errs.Connectivity, r.Err)
+	case r.ExitCode != 0:
+		return "", errs.Wrap(errs.Execution, errs.Newf(CodeCommandExit, cmd, r.ExitCode, strings.TrimSpace(r.StderrString())))
+	}
+	return r.StdoutString(), nil
+}
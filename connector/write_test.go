@@ -0,0 +1,56 @@
+package connector_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mensylisir/xmcores/connector"
+	"github.com/mensylisir/xmcores/connector/connectortest"
+	"github.com/mensylisir/xmcores/errs"
+)
+
+func TestWriteRemoteFile(t *testing.T) {
+	ctx := context.Background()
+	content := []byte("KUBELET_EXTRA_ARGS=--max-pods=200\n")
+	sum := sha256.Sum256(content)
+
+	fake := connectortest.NewFake().
+		On(`sha256sum /etc/default/kubelet`, connectortest.Result{Stdout: hex.EncodeToString(sum[:]) + "  /etc/default/kubelet\n"})
+	changed, err := connector.WriteRemoteFile(ctx, fake, content, "/etc/default/kubelet", 0644, connector.WriteOptions{Atomic: true})
+	require.NoError(t, err)
+	assert.False(t, changed, "内容相同的文件不被替换")
+	assert.False(t, fake.Ran(`mv -f`))
+
+	fake = connectortest.NewFake().
+		On(`sha256sum /etc/default/kubelet`, connectortest.Result{Stdout: "0000  /etc/default/kubelet\n"})
+	var prior, tmp string
+	hooks := connector.ReplaceHooks{
+		Before: func(_ context.Context, _, p string) error { prior = p; return nil },
+		Temp:   func(p string) { tmp = p },
+	}
+	changed, err = connector.ReplaceFile(ctx, fake, bytes.NewReader(content), "/etc/default/kubelet", 0644, connector.WriteOptions{Atomic: true, Owner: "root"}, hooks)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, "0000", prior)
+	assert.Regexp(t, `^/etc/default/\.kubelet\.[0-9a-f]{8}\.tmp$`, tmp, "临时文件与目标位于同一目录")
+	assert.True(t, fake.Ran(`chown root /etc/default/\.kubelet\.[0-9a-f]{8}\.tmp && mv -f /etc/default/\.kubelet\.[0-9a-f]{8}\.tmp /etc/default/kubelet`))
+	written, ok := fake.ReadFile(tmp)
+	require.True(t, ok)
+	assert.Equal(t, content, written)
+
+	local := filepath.Join(t.TempDir(), "kubelet.env")
+	require.NoError(t, os.WriteFile(local, content, 0600))
+	fake = connectortest.NewFake().On(`mv -f`, connectortest.Result{Stderr: "Read-only file system\n", ExitCode: 1})
+	_, err = connector.UploadFileWith(ctx, fake, local, "/etc/default/kubelet", 0644, connector.WriteOptions{Backup: true})
+	assert.Equal(t, errs.Execution, errs.KindOf(err))
+	assert.ErrorContains(t, err, "Read-only file system")
+	assert.True(t, fake.Ran(`cp -p /etc/default/kubelet /etc/default/kubelet\.\d{8}-\d{6}\.bak; fi && mv -f`))
+}
@@ -0,0 +1,392 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mensylisir/xmcores/common"
+	"github.com/mensylisir/xmcores/file"
+	"github.com/mensylisir/xmcores/logger"
+)
+
+const (
+	// DefaultRetries is the number of additional attempts made against each URL.
+	DefaultRetries = 3
+	// DefaultRetryDelay is the base delay between attempts; it doubles after every failed attempt.
+	DefaultRetryDelay = 2 * time.Second
+	// partialSuffix is appended to the destination while a download is in progress.
+	partialSuffix = ".part"
+)
+
+var (
+	// ErrChecksumMismatch is returned (wrapped) when downloaded content does not match the expected SHA-256.
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+	// ErrAllSourcesFailed is returned (wrapped) when neither the primary URL nor any mirror succeeded.
+	ErrAllSourcesFailed = errors.New("all download sources failed")
+)
+
+// Item describes a single file to download.
+type Item struct {
+	// Name is used in log messages, e.g. "kubeadm".
+	Name string
+	// URL is the primary download location.
+	URL string
+	// Mirrors are tried in order when URL fails.
+	Mirrors []string
+	// SHA256 is the expected hex-encoded checksum. When empty the content is not verified
+	// and the shared cache is bypassed.
+	SHA256 string
+	// Dest is the local path the file is written to.
+	Dest string
+}
+
+// Downloader fetches files over HTTP(S) with resume, checksum verification, retries,
+// mirror fallback and a shared on-disk cache keyed by checksum.
+type Downloader struct {
+	client     *http.Client
+	proxy      *url.URL
+	cacheDir   string
+	retries    int
+	retryDelay time.Duration
+	userAgent  string
+}
+
+// Option is a functional option type for Downloader configuration.
+type Option func(*Downloader)
+
+// WithHTTPClient sets the HTTP client used for requests. WithProxy is ignored when the
+// client's transport is not an *http.Transport.
+func WithHTTPClient(client *http.Client) Option {
+	return func(d *Downloader) {
+		if client != nil {
+			d.client = client
+		}
+	}
+}
+
+// WithProxy routes all requests through the given proxy URL instead of the
+// HTTP_PROXY/HTTPS_PROXY/NO_PROXY environment variables.
+func WithProxy(proxy *url.URL) Option {
+	return func(d *Downloader) {
+		d.proxy = proxy
+	}
+}
+
+// WithCacheDir enables the shared cache. Verified files are stored under dir keyed by their
+// SHA-256, so the same binary is only downloaded once across clusters and runs.
+func WithCacheDir(dir string) Option {
+	return func(d *Downloader) {
+		d.cacheDir = dir
+	}
+}
+
+// WithRetries sets how many additional attempts are made against each URL and the base delay
+// between them. A negative retries value is treated as zero.
+func WithRetries(retries int, delay time.Duration) Option {
+	return func(d *Downloader) {
+		if retries < 0 {
+			retries = 0
+		}
+		d.retries = retries
+		d.retryDelay = delay
+	}
+}
+
+// WithUserAgent sets the User-Agent header sent with every request.
+func WithUserAgent(userAgent string) Option {
+	return func(d *Downloader) {
+		d.userAgent = userAgent
+	}
+}
+
+// NewDownloader creates a Downloader with optional configurations.
+func NewDownloader(opts ...Option) *Downloader {
+	d := &Downloader{
+		retries:    DefaultRetries,
+		retryDelay: DefaultRetryDelay,
+		userAgent:  common.AppName,
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+
+	if d.client == nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		d.client = &http.Client{Transport: transport}
+	}
+	if d.proxy != nil {
+		if transport, ok := d.client.Transport.(*http.Transport); ok {
+			transport = transport.Clone()
+			transport.Proxy = http.ProxyURL(d.proxy)
+			d.client = &http.Client{Transport: transport, Timeout: d.client.Timeout, Jar: d.client.Jar}
+		} else {
+			logger.Log.Warnf("Custom HTTP transport in use, ignoring download proxy %s", d.proxy.Redacted())
+		}
+	}
+	return d
+}
+
+// CachePath returns the location of the cache entry for the given checksum,
+// or an empty string if caching is disabled or the checksum is empty.
+func (d *Downloader) CachePath(sha256sum string) string {
+	sum := strings.ToLower(strings.TrimSpace(sha256sum))
+	if d.cacheDir == "" || sum == "" {
+		return ""
+	}
+	return filepath.Join(d.cacheDir, "sha256", sum)
+}
+
+// Download fetches item to item.Dest. An existing destination or cache entry with a matching
+// checksum is reused without any network access. Otherwise the primary URL and then each mirror
+// are tried, each with the configured retries; interrupted transfers are resumed with HTTP Range requests.
+func (d *Downloader) Download(ctx context.Context, item Item) error {
+	if item.Dest == "" {
+		return fmt.Errorf("download %s: destination path is empty", item.displayName())
+	}
+	sources := item.sources()
+	if len(sources) == 0 {
+		return fmt.Errorf("download %s: no URL specified", item.displayName())
+	}
+	expected := strings.ToLower(strings.TrimSpace(item.SHA256))
+	if expected == "" {
+		logger.Log.Warnf("No SHA-256 checksum given for %s, the download will not be verified", item.displayName())
+	}
+
+	if expected != "" {
+		if ok, _ := verifySHA256(item.Dest, expected); ok {
+			logger.Log.Debugf("%s already exists at %s with the expected checksum, skipping download", item.displayName(), item.Dest)
+			return nil
+		}
+		if cached := d.CachePath(expected); cached != "" {
+			if ok, _ := verifySHA256(cached, expected); ok {
+				logger.Log.Infof("Using cached %s (sha256 %s)", item.displayName(), expected)
+				return copyFile(cached, item.Dest)
+			}
+		}
+	}
+
+	if err := file.CreateFileDir(item.Dest); err != nil {
+		return fmt.Errorf("download %s: %w", item.displayName(), err)
+	}
+
+	var errs []error
+	for _, source := range sources {
+		err := d.downloadWithRetries(ctx, item, source, expected)
+		if err == nil {
+			d.storeInCache(item, expected)
+			return nil
+		}
+		if ctx.Err() != nil {
+			return fmt.Errorf("download %s: %w", item.displayName(), ctx.Err())
+		}
+		logger.Log.Warnf("Download of %s from %s failed: %v", item.displayName(), redact(source), err)
+		errs = append(errs, fmt.Errorf("%s: %w", redact(source), err))
+	}
+	return fmt.Errorf("download %s: %w: %w", item.displayName(), ErrAllSourcesFailed, errors.Join(errs...))
+}
+
+func (d *Downloader) downloadWithRetries(ctx context.Context, item Item, source, expected string) error {
+	var lastErr error
+	delay := d.retryDelay
+	for attempt := 0; attempt <= d.retries; attempt++ {
+		if attempt > 0 {
+			logger.Log.Debugf("Retrying download of %s from %s in %s (attempt %d/%d)", item.displayName(), redact(source), delay, attempt+1, d.retries+1)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(delay):
+			}
+			delay *= 2
+		}
+
+		lastErr = d.fetch(ctx, item, source, expected)
+		if lastErr == nil {
+			return nil
+		}
+		var statusErr *statusError
+		if errors.As(lastErr, &statusErr) && !statusErr.retryable() {
+			return lastErr // e.g. 404: retrying the same URL will not help, move on to the next mirror
+		}
+	}
+	return lastErr
+}
+
+// fetch performs one attempt, resuming from an existing partial file when possible.
+func (d *Downloader) fetch(ctx context.Context, item Item, source, expected string) error {
+	partPath := item.Dest + partialSuffix
+	var offset int64
+	if info, err := os.Stat(partPath); err == nil {
+		offset = info.Size()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	if d.userAgent != "" {
+		req.Header.Set("User-Agent", d.userAgent)
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	flags := os.O_CREATE | os.O_WRONLY
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		logger.Log.Debugf("Resuming download of %s at byte %d", item.displayName(), offset)
+		flags |= os.O_APPEND
+	case resp.StatusCode == http.StatusOK:
+		flags |= os.O_TRUNC // Server ignored the Range header, start over
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		// The partial file may already be complete; otherwise discard it and start over.
+		if err := d.finish(item, partPath, expected); err == nil {
+			return nil
+		}
+		_ = os.Remove(partPath)
+		return &statusError{code: resp.StatusCode, status: resp.Status}
+	default:
+		return &statusError{code: resp.StatusCode, status: resp.Status}
+	}
+
+	out, err := os.OpenFile(partPath, flags, common.FileMode0644)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", partPath, err)
+	}
+	n, copyErr := io.Copy(out, resp.Body)
+	closeErr := out.Close()
+	if copyErr != nil {
+		// Keep the partial file so the next attempt can resume.
+		return fmt.Errorf("transfer interrupted after %d bytes: %w", n, copyErr)
+	}
+	if closeErr != nil {
+		return fmt.Errorf("failed to close %s: %w", partPath, closeErr)
+	}
+	return d.finish(item, partPath, expected)
+}
+
+// finish verifies the partial file and moves it into place.
+func (d *Downloader) finish(item Item, partPath, expected string) error {
+	if expected != "" {
+		ok, actual := verifySHA256(partPath, expected)
+		if !ok {
+			_ = os.Remove(partPath)
+			return fmt.Errorf("%w for %s: expected %s, got %s", ErrChecksumMismatch, item.displayName(), expected, actual)
+		}
+	}
+	if err := os.Rename(partPath, item.Dest); err != nil {
+		return fmt.Errorf("failed to move %s to %s: %w", partPath, item.Dest, err)
+	}
+	logger.Log.Infof("Downloaded %s to %s", item.displayName(), item.Dest)
+	return nil
+}
+
+func (d *Downloader) storeInCache(item Item, expected string) {
+	cached := d.CachePath(expected)
+	if cached == "" {
+		return
+	}
+	if err := file.CreateFileDir(cached); err != nil {
+		logger.Log.Warnf("Failed to create download cache directory for %s: %v", item.displayName(), err)
+		return
+	}
+	// Hard links keep the cache free when it lives on the same filesystem as the work dir.
+	_ = os.Remove(cached)
+	if err := os.Link(item.Dest, cached); err == nil {
+		return
+	}
+	if err := copyFile(item.Dest, cached); err != nil {
+		logger.Log.Warnf("Failed to store %s in download cache: %v", item.displayName(), err)
+	}
+}
+
+func (i Item) displayName() string {
+	if i.Name != "" {
+		return i.Name
+	}
+	return filepath.Base(i.Dest)
+}
+
+func (i Item) sources() []string {
+	sources := make([]string, 0, len(i.Mirrors)+1)
+	for _, u := range append([]string{i.URL}, i.Mirrors...) {
+		if strings.TrimSpace(u) != "" {
+			sources = append(sources, u)
+		}
+	}
+	return sources
+}
+
+// statusError is returned for unexpected HTTP status codes.
+type statusError struct {
+	code   int
+	status string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("unexpected HTTP status %s", e.status)
+}
+
+// retryable reports whether retrying the same URL can succeed.
+func (e *statusError) retryable() bool {
+	return e.code == http.StatusRequestTimeout || e.code == http.StatusTooManyRequests ||
+		e.code == http.StatusRequestedRangeNotSatisfiable || e.code >= 500
+}
+
+// verifySHA256 reports whether the file at p has the expected checksum, along with the actual checksum.
+func verifySHA256(p, expected string) (bool, string) {
+	actual, err := file.FileSHA256(p)
+	if err != nil {
+		return false, ""
+	}
+	return actual == expected, actual
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", src, err)
+	}
+	defer in.Close()
+
+	if err := file.CreateFileDir(dst); err != nil {
+		return err
+	}
+	tmp := dst + partialSuffix
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, common.FileMode0644)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", tmp, err)
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		_ = os.Remove(tmp)
+		return fmt.Errorf("failed to copy %s to %s: %w", src, dst, err)
+	}
+	if err := out.Close(); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("failed to close %s: %w", tmp, err)
+	}
+	return os.Rename(tmp, dst)
+}
+
+// redact hides credentials embedded in a URL before it is logged.
+func redact(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	return u.Redacted()
+}
@@ -0,0 +1,188 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var testPayload = bytes.Repeat([]byte("kubelet-binary-"), 4096)
+
+func testPayloadSHA256() string {
+	sum := sha256.Sum256(testPayload)
+	return hex.EncodeToString(sum[:])
+}
+
+// newPayloadServer serves testPayload with Range support and counts requests.
+func newPayloadServer(t *testing.T, requests *atomic.Int32, ranges *atomic.Int32) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.Header.Get("Range") != "" && ranges != nil {
+			ranges.Add(1)
+		}
+		http.ServeContent(w, r, "kubelet", time.Time{}, bytes.NewReader(testPayload))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestDownload_VerifiesChecksum(t *testing.T) {
+	var requests atomic.Int32
+	srv := newPayloadServer(t, &requests, nil)
+	dest := filepath.Join(t.TempDir(), "bin", "kubelet")
+
+	d := NewDownloader(WithRetries(0, time.Millisecond))
+	err := d.Download(context.Background(), Item{Name: "kubelet", URL: srv.URL, SHA256: testPayloadSHA256(), Dest: dest})
+	if err != nil {
+		t.Fatalf("Download() error = %v", err)
+	}
+	content, err := os.ReadFile(dest)
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	if !bytes.Equal(content, testPayload) {
+		t.Errorf("downloaded content does not match payload")
+	}
+
+	// A second call finds the verified destination and does not hit the server.
+	if err := d.Download(context.Background(), Item{URL: srv.URL, SHA256: testPayloadSHA256(), Dest: dest}); err != nil {
+		t.Fatalf("second Download() error = %v", err)
+	}
+	if got := requests.Load(); got != 1 {
+		t.Errorf("expected 1 request, got %d", got)
+	}
+}
+
+func TestDownload_ChecksumMismatch(t *testing.T) {
+	var requests atomic.Int32
+	srv := newPayloadServer(t, &requests, nil)
+	dest := filepath.Join(t.TempDir(), "kubelet")
+
+	d := NewDownloader(WithRetries(1, time.Millisecond))
+	err := d.Download(context.Background(), Item{URL: srv.URL, SHA256: strings.Repeat("0", 64), Dest: dest})
+	if !errors.Is(err, ErrChecksumMismatch) || !errors.Is(err, ErrAllSourcesFailed) {
+		t.Fatalf("Download() error = %v, want ErrChecksumMismatch and ErrAllSourcesFailed", err)
+	}
+	if _, statErr := os.Stat(dest); !os.IsNotExist(statErr) {
+		t.Errorf("destination should not exist after checksum mismatch")
+	}
+	if _, statErr := os.Stat(dest + partialSuffix); !os.IsNotExist(statErr) {
+		t.Errorf("partial file should be removed after checksum mismatch")
+	}
+	if got := requests.Load(); got != 2 {
+		t.Errorf("expected 2 attempts, got %d", got)
+	}
+}
+
+func TestDownload_ResumesPartialFile(t *testing.T) {
+	var requests, ranges atomic.Int32
+	srv := newPayloadServer(t, &requests, &ranges)
+	dest := filepath.Join(t.TempDir(), "kubelet")
+
+	half := len(testPayload) / 2
+	if err := os.WriteFile(dest+partialSuffix, testPayload[:half], 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	d := NewDownloader(WithRetries(0, time.Millisecond))
+	if err := d.Download(context.Background(), Item{URL: srv.URL, SHA256: testPayloadSHA256(), Dest: dest}); err != nil {
+		t.Fatalf("Download() error = %v", err)
+	}
+	if got := ranges.Load(); got != 1 {
+		t.Errorf("expected a Range request, got %d", got)
+	}
+	content, _ := os.ReadFile(dest)
+	if !bytes.Equal(content, testPayload) {
+		t.Errorf("resumed content does not match payload")
+	}
+}
+
+func TestDownload_MirrorFallback(t *testing.T) {
+	var brokenRequests, notFoundRequests, mirrorRequests atomic.Int32
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		brokenRequests.Add(1)
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer broken.Close()
+	notFound := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		notFoundRequests.Add(1)
+		http.NotFound(w, r)
+	}))
+	defer notFound.Close()
+	mirror := newPayloadServer(t, &mirrorRequests, nil)
+
+	dest := filepath.Join(t.TempDir(), "kubelet")
+	d := NewDownloader(WithRetries(2, time.Millisecond))
+	err := d.Download(context.Background(), Item{
+		URL:     broken.URL,
+		Mirrors: []string{notFound.URL, mirror.URL},
+		SHA256:  testPayloadSHA256(),
+		Dest:    dest,
+	})
+	if err != nil {
+		t.Fatalf("Download() error = %v", err)
+	}
+	if got := brokenRequests.Load(); got != 3 {
+		t.Errorf("expected 3 attempts against the 503 source, got %d", got)
+	}
+	if got := notFoundRequests.Load(); got != 1 {
+		t.Errorf("expected a 404 source to be tried only once, got %d", got)
+	}
+	if got := mirrorRequests.Load(); got != 1 {
+		t.Errorf("expected 1 request to the mirror, got %d", got)
+	}
+}
+
+func TestDownload_SharedCache(t *testing.T) {
+	var requests atomic.Int32
+	srv := newPayloadServer(t, &requests, nil)
+	cacheDir := t.TempDir()
+	d := NewDownloader(WithCacheDir(cacheDir), WithRetries(0, time.Millisecond))
+
+	first := filepath.Join(t.TempDir(), "cluster-a", "kubelet")
+	if err := d.Download(context.Background(), Item{URL: srv.URL, SHA256: testPayloadSHA256(), Dest: first}); err != nil {
+		t.Fatalf("Download() error = %v", err)
+	}
+	if _, err := os.Stat(d.CachePath(testPayloadSHA256())); err != nil {
+		t.Fatalf("expected cache entry: %v", err)
+	}
+
+	srv.Close()
+	second := filepath.Join(t.TempDir(), "cluster-b", "kubelet")
+	if err := d.Download(context.Background(), Item{URL: srv.URL, SHA256: testPayloadSHA256(), Dest: second}); err != nil {
+		t.Fatalf("Download() from cache error = %v", err)
+	}
+	content, _ := os.ReadFile(second)
+	if !bytes.Equal(content, testPayload) {
+		t.Errorf("cached content does not match payload")
+	}
+	if got := requests.Load(); got != 1 {
+		t.Errorf("expected 1 request, got %d", got)
+	}
+}
+
+func TestDownload_ContextCancelled(t *testing.T) {
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer broken.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	d := NewDownloader(WithRetries(5, time.Second))
+	err := d.Download(ctx, Item{URL: broken.URL, Dest: filepath.Join(t.TempDir(), "kubelet")})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Download() error = %v, want context.DeadlineExceeded", err)
+	}
+}
@@ -0,0 +1,263 @@
+// Package drift compares a cluster configuration with the live cluster and
+// reports what differs: versions, node membership, node metadata, addons and
+// the kubeadm cluster settings. The resulting changes are what an apply or
+// upgrade would have to carry out.
+package drift
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/mensylisir/xmcores/common"
+	"github.com/mensylisir/xmcores/config"
+	"github.com/mensylisir/xmcores/modules/kubeadm"
+	"github.com/mensylisir/xmcores/modules/nodemeta"
+)
+
+// Action says how the live cluster has to change to match the configuration.
+type Action string
+
+const (
+	ActionAdd    Action = "add"
+	ActionRemove Action = "remove"
+	ActionUpdate Action = "update"
+)
+
+// Kinds of compared items.
+const (
+	KindVersion = "version"
+	KindNode    = "node"
+	KindRole    = "role"
+	KindLabel   = "label"
+	KindTaint   = "taint"
+	KindAddon   = "addon"
+	KindSetting = "setting"
+)
+
+// Change is one difference between the configuration and the cluster.
+type Change struct {
+	Action Action `json:"action"`
+	Kind   string `json:"kind"`
+	// Name is the node, addon or setting concerned.
+	Name string `json:"name"`
+	// Field narrows Name, e.g. the label key of a node.
+	Field    string `json:"field,omitempty"`
+	Desired  string `json:"desired,omitempty"`
+	Observed string `json:"observed,omitempty"`
+}
+
+func (c Change) String() string {
+	target := c.Name
+	if c.Field != "" {
+		target += " " + c.Field
+	}
+	switch c.Action {
+	case ActionAdd:
+		if c.Desired != "" {
+			return fmt.Sprintf("+ %s %s: %s", c.Kind, target, c.Desired)
+		}
+		return fmt.Sprintf("+ %s %s", c.Kind, target)
+	case ActionRemove:
+		if c.Observed != "" {
+			return fmt.Sprintf("- %s %s: %s", c.Kind, target, c.Observed)
+		}
+		return fmt.Sprintf("- %s %s", c.Kind, target)
+	default:
+		return fmt.Sprintf("~ %s %s: %s -> %s", c.Kind, target, c.Observed, c.Desired)
+	}
+}
+
+// Addon is a component whose presence is checked by fetching an API object.
+type Addon struct {
+	Name string
+	Path string
+}
+
+// Node is the compared state of one node.
+type Node struct {
+	ControlPlane   bool
+	KubeletVersion string
+	Labels         map[string]string
+	Taints         []nodemeta.Taint
+}
+
+// State is the comparable state of a cluster, either desired or observed.
+type State struct {
+	KubernetesVersion string
+	Nodes             map[string]Node
+	// Addons maps addon names to whether they are present.
+	Addons map[string]bool
+	// Settings are the kubeadm cluster settings, keyed by their kubeadm name.
+	Settings map[string]string
+}
+
+var networkAddons = map[string]string{
+	config.NetworkCalico:  "/apis/apps/v1/namespaces/kube-system/daemonsets/calico-node",
+	config.NetworkFlannel: "/apis/apps/v1/namespaces/kube-flannel/daemonsets/kube-flannel-ds",
+}
+
+// Addons returns the addons the configuration deploys, with the object that
+// proves each one is installed.
+func Addons(c *config.Cluster) []Addon {
+	addons := []Addon{{Name: "coredns", Path: "/apis/apps/v1/namespaces/kube-system/deployments/coredns"}}
+	if path, ok := networkAddons[c.Spec.Network.Plugin]; ok {
+		addons = append(addons, Addon{Name: c.Spec.Network.Plugin, Path: path})
+	}
+	if in := c.Spec.Ingress; in != nil {
+		ns, name := in.Workload()
+		addons = append(addons, Addon{Name: "ingress-" + in.Controller, Path: "/apis/apps/v1/namespaces/" + ns + "/deployments/" + name})
+	}
+	if st := c.Spec.Storage; st != nil && st.StorageClass() != "" {
+		addons = append(addons, Addon{Name: "storage-" + st.Backend, Path: "/apis/storage.k8s.io/v1/storageclasses/" + st.StorageClass()})
+	}
+	return addons
+}
+
+// Desired returns the state the configuration asks for. Settings left empty
+// in the configuration carry the kubeadm defaults xmcores installs with.
+func Desired(c *config.Cluster) State {
+	s := State{
+		KubernetesVersion: c.Spec.Kubernetes.Version,
+		Nodes:             make(map[string]Node, len(c.Spec.Hosts)),
+		Addons:            make(map[string]bool),
+		Settings:          make(map[string]string),
+	}
+	for _, h := range c.Spec.Hosts {
+		cp := false
+		for _, r := range h.Roles {
+			cp = cp || r == common.RoleControlPlane
+		}
+		s.Nodes[h.Name] = Node{
+			ControlPlane:   cp,
+			KubeletVersion: c.Spec.Kubernetes.Version,
+			Labels:         h.Labels,
+			Taints:         h.Taints,
+		}
+	}
+	for _, a := range Addons(c) {
+		s.Addons[a.Name] = true
+	}
+	k := c.Spec.Kubernetes
+	settings := map[string]string{
+		"controlPlaneEndpoint": k.ControlPlaneEndpoint,
+		"podSubnet":            or(k.PodSubnet, kubeadm.DefaultPodSubnet),
+		"serviceSubnet":        or(k.ServiceSubnet, kubeadm.DefaultServiceSubnet),
+		"dnsDomain":            or(k.DNSDomain, kubeadm.DefaultDNSDomain),
+		"imageRepository":      k.ImageRepository,
+	}
+	for key, v := range settings {
+		if v != "" {
+			s.Settings[key] = v
+		}
+	}
+	return s
+}
+
+func or(v, def string) string {
+	if v != "" {
+		return v
+	}
+	return def
+}
+
+// Compare lists the changes that turn observed into desired, sorted by kind
+// and name. Observed labels and taints not mentioned in the configuration are
+// left alone, as are settings the configuration does not pin.
+func Compare(desired, observed State) []Change {
+	var changes []Change
+	if desired.KubernetesVersion != "" && observed.KubernetesVersion != "" && desired.KubernetesVersion != observed.KubernetesVersion {
+		changes = append(changes, Change{Action: ActionUpdate, Kind: KindVersion, Name: "control-plane",
+			Desired: desired.KubernetesVersion, Observed: observed.KubernetesVersion})
+	}
+
+	for name, want := range desired.Nodes {
+		got, ok := observed.Nodes[name]
+		if !ok {
+			changes = append(changes, Change{Action: ActionAdd, Kind: KindNode, Name: name})
+			continue
+		}
+		if want.KubeletVersion != "" && got.KubeletVersion != want.KubeletVersion {
+			changes = append(changes, Change{Action: ActionUpdate, Kind: KindVersion, Name: name, Field: "kubelet",
+				Desired: want.KubeletVersion, Observed: got.KubeletVersion})
+		}
+		if want.ControlPlane != got.ControlPlane {
+			changes = append(changes, Change{Action: ActionUpdate, Kind: KindRole, Name: name, Field: common.RoleControlPlane,
+				Desired: fmt.Sprint(want.ControlPlane), Observed: fmt.Sprint(got.ControlPlane)})
+		}
+		for key, v := range want.Labels {
+			switch cur, ok := got.Labels[key]; {
+			case !ok:
+				changes = append(changes, Change{Action: ActionAdd, Kind: KindLabel, Name: name, Field: key, Desired: v})
+			case cur != v:
+				changes = append(changes, Change{Action: ActionUpdate, Kind: KindLabel, Name: name, Field: key, Desired: v, Observed: cur})
+			}
+		}
+		for _, t := range want.Taints {
+			if !hasTaint(got.Taints, t) {
+				changes = append(changes, Change{Action: ActionAdd, Kind: KindTaint, Name: name, Field: t.Key, Desired: t.String()})
+			}
+		}
+	}
+	for name := range observed.Nodes {
+		if _, ok := desired.Nodes[name]; !ok {
+			changes = append(changes, Change{Action: ActionRemove, Kind: KindNode, Name: name})
+		}
+	}
+
+	for name := range desired.Addons {
+		if !observed.Addons[name] {
+			changes = append(changes, Change{Action: ActionAdd, Kind: KindAddon, Name: name})
+		}
+	}
+
+	for key, want := range desired.Settings {
+		if got, ok := observed.Settings[key]; ok && got != want {
+			changes = append(changes, Change{Action: ActionUpdate, Kind: KindSetting, Name: key, Desired: want, Observed: got})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		a, b := changes[i], changes[j]
+		if a.Kind != b.Kind {
+			return kindOrder(a.Kind) < kindOrder(b.Kind)
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.Field < b.Field
+	})
+	return changes
+}
+
+func hasTaint(taints []nodemeta.Taint, t nodemeta.Taint) bool {
+	for _, cur := range taints {
+		if cur.Key == t.Key && cur.Effect == t.Effect && cur.Value == t.Value {
+			return true
+		}
+	}
+	return false
+}
+
+var kinds = []string{KindVersion, KindNode, KindRole, KindLabel, KindTaint, KindAddon, KindSetting}
+
+func kindOrder(kind string) int {
+	for i, k := range kinds {
+		if k == kind {
+			return i
+		}
+	}
+	return len(kinds)
+}
+
+// Format renders changes one per line, or a note when there are none.
+func Format(changes []Change) string {
+	if len(changes) == 0 {
+		return "No differences: the cluster matches the configuration.\n"
+	}
+	var b strings.Builder
+	for _, c := range changes {
+		b.WriteString(c.String() + "\n")
+	}
+	return b.String()
+}
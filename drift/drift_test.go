@@ -0,0 +1,103 @@
+package drift
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mensylisir/xmcores/config"
+	"github.com/mensylisir/xmcores/kube"
+	"github.com/mensylisir/xmcores/modules/nodemeta"
+)
+
+const clusterConfig = `apiVersion: xmcores.io/v1alpha1
+kind: Cluster
+metadata: {name: demo}
+spec:
+  hosts:
+    - {name: master1, address: 10.0.0.1, user: root, password: x, roles: [control-plane, etcd]}
+    - name: worker1
+      address: 10.0.0.2
+      user: root
+      password: x
+      roles: [worker]
+      labels: {tier: edge}
+      taints: [{key: dedicated, value: edge, effect: NoSchedule}]
+    - {name: worker2, address: 10.0.0.3, user: root, password: x, roles: [worker]}
+  kubernetes: {version: v1.31.2, podSubnet: 10.244.0.0/16}
+  network: {plugin: flannel}
+  ingress: {controller: nginx}
+`
+
+func TestCompare(t *testing.T) {
+	c, err := config.Parse([]byte(clusterConfig))
+	require.NoError(t, err)
+	desired := Desired(c)
+
+	observed := State{
+		KubernetesVersion: "v1.30.5",
+		Nodes: map[string]Node{
+			"master1": {ControlPlane: true, KubeletVersion: "v1.30.5"},
+			"worker1": {KubeletVersion: "v1.31.2", Labels: map[string]string{"tier": "core", "extra": "kept"}},
+			"old":     {KubeletVersion: "v1.31.2"},
+		},
+		Addons:   map[string]bool{"coredns": true, "flannel": true, "ingress-nginx": false},
+		Settings: map[string]string{"podSubnet": "10.244.0.0/16", "serviceSubnet": "10.96.0.0/12", "dnsDomain": "cluster.local"},
+	}
+	var lines []string
+	for _, ch := range Compare(desired, observed) {
+		lines = append(lines, ch.String())
+	}
+	assert.Equal(t, []string{
+		"~ version control-plane: v1.30.5 -> v1.31.2",
+		"~ version master1 kubelet: v1.30.5 -> v1.31.2",
+		"- node old",
+		"+ node worker2",
+		"~ label worker1 tier: core -> edge",
+		"+ taint worker1 dedicated: dedicated=edge:NoSchedule",
+		"+ addon ingress-nginx",
+		"~ setting serviceSubnet: 10.96.0.0/12 -> 10.233.0.0/18",
+	}, lines)
+
+	observed = desired
+	assert.Empty(t, Compare(desired, observed))
+	assert.Contains(t, Format(nil), "No differences")
+}
+
+func TestObserve(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/version":
+			_, _ = w.Write([]byte(`{"gitVersion":"v1.31.2"}`))
+		case "/api/v1/nodes":
+			_, _ = w.Write([]byte(`{"items":[{"metadata":{"name":"master1","labels":{"node-role.kubernetes.io/control-plane":""}},
+				"spec":{"taints":[{"key":"node-role.kubernetes.io/control-plane","effect":"NoSchedule"}]},
+				"status":{"nodeInfo":{"kubeletVersion":"v1.31.2"}}}]}`))
+		case "/apis/apps/v1/namespaces/kube-system/deployments/coredns":
+			_, _ = w.Write([]byte(`{}`))
+		case kubeadmConfigPath:
+			_, _ = w.Write([]byte(`{"data":{"ClusterConfiguration":"networking:\n  podSubnet: 10.244.0.0/16\n  dnsDomain: cluster.local\n"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	client, err := kube.NewClient(kube.RESTConfig{Server: srv.URL})
+	require.NoError(t, err)
+
+	s, err := Observe(context.Background(), client, []Addon{
+		{Name: "coredns", Path: "/apis/apps/v1/namespaces/kube-system/deployments/coredns"},
+		{Name: "calico", Path: "/apis/apps/v1/namespaces/kube-system/daemonsets/calico-node"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "v1.31.2", s.KubernetesVersion)
+	assert.Equal(t, map[string]bool{"coredns": true, "calico": false}, s.Addons)
+	assert.Equal(t, map[string]string{"podSubnet": "10.244.0.0/16", "dnsDomain": "cluster.local"}, s.Settings)
+	require.Contains(t, s.Nodes, "master1")
+	assert.True(t, s.Nodes["master1"].ControlPlane)
+	assert.Equal(t, []nodemeta.Taint{{Key: "node-role.kubernetes.io/control-plane", Effect: "NoSchedule"}}, s.Nodes["master1"].Taints)
+}
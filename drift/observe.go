@@ -0,0 +1,106 @@
+package drift
+
+import (
+	"context"
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/mensylisir/xmcores/kube"
+	"github.com/mensylisir/xmcores/modules/nodemeta"
+)
+
+// ControlPlaneLabel marks control-plane nodes.
+const ControlPlaneLabel = "node-role.kubernetes.io/control-plane"
+
+const kubeadmConfigPath = "/api/v1/namespaces/kube-system/configmaps/kubeadm-config"
+
+// Observe reads the live state of the cluster. addons are probed by fetching
+// their objects; a missing kubeadm-config leaves Settings empty.
+func Observe(ctx context.Context, client *kube.Client, addons []Addon) (State, error) {
+	s := State{
+		Nodes:    make(map[string]Node),
+		Addons:   make(map[string]bool, len(addons)),
+		Settings: make(map[string]string),
+	}
+
+	var version struct {
+		GitVersion string `json:"gitVersion"`
+	}
+	if err := client.Get(ctx, "/version", &version); err != nil {
+		return s, fmt.Errorf("failed to get server version: %w", err)
+	}
+	s.KubernetesVersion = version.GitVersion
+
+	nodes, err := client.Nodes(ctx)
+	if err != nil {
+		return s, err
+	}
+	for _, n := range nodes {
+		_, cp := n.Metadata.Labels[ControlPlaneLabel]
+		node := Node{ControlPlane: cp, KubeletVersion: n.Status.NodeInfo.KubeletVersion, Labels: n.Metadata.Labels}
+		for _, t := range n.Spec.Taints {
+			node.Taints = append(node.Taints, nodemeta.Taint{Key: t.Key, Value: t.Value, Effect: t.Effect})
+		}
+		s.Nodes[n.Metadata.Name] = node
+	}
+
+	for _, a := range addons {
+		err := client.Get(ctx, a.Path, nil)
+		switch {
+		case err == nil:
+			s.Addons[a.Name] = true
+		case kube.IsNotFound(err):
+			s.Addons[a.Name] = false
+		default:
+			return s, fmt.Errorf("failed to check addon %s: %w", a.Name, err)
+		}
+	}
+
+	var cm struct {
+		Data map[string]string `json:"data"`
+	}
+	err = client.Get(ctx, kubeadmConfigPath, &cm)
+	if kube.IsNotFound(err) {
+		return s, nil
+	}
+	if err != nil {
+		return s, fmt.Errorf("failed to get kubeadm-config: %w", err)
+	}
+	settings, err := parseClusterConfiguration(cm.Data["ClusterConfiguration"])
+	if err != nil {
+		return s, err
+	}
+	s.Settings = settings
+	return s, nil
+}
+
+// parseClusterConfiguration extracts the compared settings from a kubeadm
+// ClusterConfiguration document.
+func parseClusterConfiguration(doc string) (map[string]string, error) {
+	var cc struct {
+		ControlPlaneEndpoint string `yaml:"controlPlaneEndpoint"`
+		ImageRepository      string `yaml:"imageRepository"`
+		Networking           struct {
+			PodSubnet     string `yaml:"podSubnet"`
+			ServiceSubnet string `yaml:"serviceSubnet"`
+			DNSDomain     string `yaml:"dnsDomain"`
+		} `yaml:"networking"`
+	}
+	if err := yaml.Unmarshal([]byte(doc), &cc); err != nil {
+		return nil, fmt.Errorf("failed to parse kubeadm ClusterConfiguration: %w", err)
+	}
+	settings := make(map[string]string)
+	for key, v := range map[string]string{
+		"controlPlaneEndpoint": cc.ControlPlaneEndpoint,
+		"imageRepository":      cc.ImageRepository,
+		"podSubnet":            cc.Networking.PodSubnet,
+		"serviceSubnet":        cc.Networking.ServiceSubnet,
+		"dnsDomain":            cc.Networking.DNSDomain,
+	} {
+		if v != "" {
+			settings[key] = v
+		}
+	}
+	return settings, nil
+}
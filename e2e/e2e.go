@@ -0,0 +1,380 @@
+// Package e2e runs the connector and pipelines against real sshd servers:
+// containers of the image built from testdata, started on the local Docker
+// daemon, which accept the fixed key pair of testdata and the password
+// Password for User. The tests are built with the e2e tag and skip when no
+// Docker daemon is reachable:
+//
+//	go test -tags e2e ./e2e/
+//
+// The harness drives the docker CLI rather than testcontainers-go. Each
+// harness removes its containers and network when its test ends. Everything
+// it creates is labelled with an expiry past the deadline of the test
+// binary, so the first Start of a later run reaps what interrupted runs left
+// behind, as the testcontainers reaper would.
+package e2e
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"embed"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mensylisir/xmcores/common"
+	"github.com/mensylisir/xmcores/config"
+	"github.com/mensylisir/xmcores/connector"
+	"github.com/mensylisir/xmcores/modules"
+)
+
+//go:embed testdata
+var testdata embed.FS
+
+const (
+	// Image is the tag of the sshd image.
+	Image = "xmcores-e2e-sshd:latest"
+	// User logs in with the key pair of testdata or Password, and has
+	// passwordless sudo.
+	User     = "xm"
+	Password = "xm-e2e"
+	// Label marks the containers and networks of the harness, so that
+	// leftovers of interrupted runs can be found with docker ps --filter.
+	Label = "io.xmcores.e2e"
+	// LabelExpires holds the Unix time after which a container or network
+	// of the harness is a leftover that Start removes.
+	LabelExpires = Label + ".expires"
+
+	// EnvDocker overrides the docker binary.
+	EnvDocker = "XM_E2E_DOCKER"
+
+	readyTimeout = time.Minute
+	// lifetime bounds how long the objects of a harness are kept when the
+	// test binary has no deadline.
+	lifetime = 24 * time.Hour
+)
+
+// Node is an sshd container.
+type Node struct {
+	Name      string
+	Container string
+	// Address and Port reach sshd from the tests, through a port published
+	// on the loopback interface.
+	Address string
+	Port    int
+	// InternalAddress is the address of the container on the harness
+	// network, through which the nodes reach each other on port 22.
+	InternalAddress string
+}
+
+// Harness is a set of sshd containers on a network of their own.
+type Harness struct {
+	Name  string
+	Nodes []Node
+	// KeyFile is the private key the nodes accept for User.
+	KeyFile string
+
+	docker  string
+	network string
+	labels  []string
+}
+
+var (
+	buildOnce sync.Once
+	buildErr  error
+	reapOnce  sync.Once
+)
+
+// Start starts n sshd containers, named node1 to nodeN, and waits for them
+// to accept logins. They are removed when t ends. t is skipped when Docker is
+// unavailable.
+func Start(t testing.TB, n int) *Harness {
+	t.Helper()
+	docker := os.Getenv(EnvDocker)
+	if docker == "" {
+		docker = connector.DefaultDockerBinary
+	}
+	if _, err := exec.LookPath(docker); err != nil {
+		t.Skipf("docker is not available: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+	if _, err := run(ctx, docker, "version", "--format", "{{.Server.Version}}"); err != nil {
+		t.Skipf("docker daemon is not reachable: %v", err)
+	}
+
+	reapOnce.Do(func() {
+		if err := reap(ctx, docker, time.Now()); err != nil {
+			t.Logf("failed to remove leftovers of earlier runs: %v", err)
+		}
+	})
+	buildOnce.Do(func() { buildErr = build(ctx, docker) })
+	if buildErr != nil {
+		t.Fatalf("failed to build %s: %v", Image, buildErr)
+	}
+
+	expires := time.Now().Add(lifetime)
+	if dt, ok := t.(interface{ Deadline() (time.Time, bool) }); ok {
+		if deadline, ok := dt.Deadline(); ok {
+			expires = deadline.Add(readyTimeout)
+		}
+	}
+	h := &Harness{Name: "xm-e2e-" + randomSuffix(), docker: docker}
+	h.network = h.Name
+	h.labels = []string{"--label", Label, "--label", LabelExpires + "=" + strconv.FormatInt(expires.Unix(), 10)}
+	t.Cleanup(h.remove)
+	if _, err := run(ctx, docker, append(append([]string{"network", "create"}, h.labels...), h.network)...); err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := testdata.ReadFile("testdata/id_ed25519")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.KeyFile = filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(h.KeyFile, key, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i <= n; i++ {
+		node, err := h.startNode(ctx, fmt.Sprintf("node%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		h.Nodes = append(h.Nodes, node)
+	}
+	for _, node := range h.Nodes {
+		if err := h.waitReady(ctx, node); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return h
+}
+
+// build builds Image from the embedded testdata.
+func build(ctx context.Context, docker string) error {
+	dir, err := os.MkdirTemp("", "xm-e2e-image")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	err = fs.WalkDir(testdata, "testdata", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := testdata.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(filepath.Join(dir, d.Name()), data, 0o600)
+	})
+	if err != nil {
+		return err
+	}
+	_, err = run(ctx, docker, "build", "--label", Label, "-t", Image, dir)
+	return err
+}
+
+func (h *Harness) startNode(ctx context.Context, name string) (Node, error) {
+	node := Node{Name: name, Container: h.Name + "-" + name, Address: "127.0.0.1"}
+	args := append([]string{"run", "-d",
+		"--name", node.Container,
+		"--hostname", name,
+		"--network", h.network,
+		"--publish", "127.0.0.1::22"}, h.labels...)
+	if _, err := run(ctx, h.docker, append(args, Image)...); err != nil {
+		return node, err
+	}
+	out, err := run(ctx, h.docker, "port", node.Container, "22/tcp")
+	if err != nil {
+		return node, err
+	}
+	// One line per published address; only the loopback one is published.
+	_, port, err := net.SplitHostPort(strings.SplitN(out, "\n", 2)[0])
+	if err != nil {
+		return node, fmt.Errorf("unexpected docker port output %q: %w", out, err)
+	}
+	if node.Port, err = strconv.Atoi(port); err != nil {
+		return node, fmt.Errorf("unexpected docker port output %q: %w", out, err)
+	}
+	node.InternalAddress, err = run(ctx, h.docker, "inspect", "-f",
+		"{{range .NetworkSettings.Networks}}{{.IPAddress}}{{end}}", node.Container)
+	if err != nil {
+		return node, err
+	}
+	return node, nil
+}
+
+// waitReady waits until node accepts a login, which sshd does shortly after
+// the container starts.
+func (h *Harness) waitReady(ctx context.Context, node Node) error {
+	deadline := time.Now().Add(readyTimeout)
+	for {
+		conn, err := connector.NewConnection(h.ConnectionConfig(node))
+		if err == nil {
+			_, _, _, err = conn.Exec(ctx, "true")
+			_ = conn.Close()
+			if err == nil {
+				return nil
+			}
+		}
+		if time.Now().After(deadline) {
+			logs, _ := run(ctx, h.docker, "logs", node.Container)
+			return fmt.Errorf("%s did not accept logins within %s: %w\n%s", node.Name, readyTimeout, err, logs)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+// remove removes the containers and the network.
+func (h *Harness) remove() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	for _, node := range h.Nodes {
+		_, _ = run(ctx, h.docker, "rm", "-f", "-v", node.Container)
+	}
+	_, _ = run(ctx, h.docker, "network", "rm", h.network)
+}
+
+// reap removes the containers and networks of the harness whose expiry
+// passed before now: those of runs killed before their cleanup ran.
+func reap(ctx context.Context, docker string, now time.Time) error {
+	format := `{{.ID}} {{.Label "` + LabelExpires + `"}}`
+	containers, err := run(ctx, docker, "ps", "-a", "--filter", "label="+Label, "--format", format)
+	if err != nil {
+		return err
+	}
+	for _, id := range expired(containers, now) {
+		if _, err := run(ctx, docker, "rm", "-f", "-v", id); err != nil {
+			return err
+		}
+	}
+	networks, err := run(ctx, docker, "network", "ls", "--filter", "label="+Label, "--format", format)
+	if err != nil {
+		return err
+	}
+	for _, id := range expired(networks, now) {
+		if _, err := run(ctx, docker, "network", "rm", id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expired returns the IDs of the lines "ID EXPIRES" whose expiry is before
+// now. Objects without an expiry predate it and are expired.
+func expired(out string, now time.Time) []string {
+	var ids []string
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) > 1 {
+			if unix, err := strconv.ParseInt(fields[1], 10, 64); err == nil && !time.Unix(unix, 0).Before(now) {
+				continue
+			}
+		}
+		ids = append(ids, fields[0])
+	}
+	return ids
+}
+
+// ConnectionConfig returns the key-based SSH settings of node.
+func (h *Harness) ConnectionConfig(node Node) connector.Config {
+	return connector.Config{
+		Username: User,
+		Address:  node.Address,
+		Port:     node.Port,
+		KeyFile:  h.KeyFile,
+		Timeout:  10 * time.Second,
+	}
+}
+
+// Cluster returns a cluster configuration with a host per node: the first is
+// the control plane and runs etcd, the others are workers.
+func (h *Harness) Cluster() *config.Cluster {
+	c := &config.Cluster{
+		APIVersion: config.APIVersion,
+		Kind:       config.KindCluster,
+		Metadata:   config.Metadata{Name: h.Name},
+	}
+	c.Spec.Kubernetes.Version = config.DefaultKubernetesVersion
+	for i, node := range h.Nodes {
+		host := config.Host{BaseHost: connector.BaseHost{
+			Name:            node.Name,
+			Address:         node.Address,
+			InternalAddress: node.InternalAddress,
+			Port:            node.Port,
+			User:            User,
+			PrivateKeyPath:  h.KeyFile,
+		}}
+		host.Roles = []string{common.RoleWorker}
+		if i == 0 {
+			host.Roles = []string{common.RoleControlPlane, common.RoleEtcd}
+		}
+		c.Spec.Hosts = append(c.Spec.Hosts, host)
+	}
+	return c
+}
+
+// ConfigFile writes the configuration of Cluster to a file in t's temporary
+// directory, checks that it loads and returns its path, for the xm commands.
+func (h *Harness) ConfigFile(t testing.TB) string {
+	t.Helper()
+	data, err := h.Cluster().Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "cluster.yaml")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := config.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// Connect loads the configuration of ConfigFile and connects to its hosts
+// the way the xm commands do, including the fault injection of
+// connector.EnvChaos. The connections are closed when t ends.
+func (h *Harness) Connect(t testing.TB) []modules.Node {
+	t.Helper()
+	c, err := config.Load(h.ConfigFile(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes, err := modules.ConnectWith(context.Background(), c.Hosts(), c.Dialer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { modules.Close(nodes) })
+	return nodes
+}
+
+func run(ctx context.Context, docker string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, docker, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("docker %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+func randomSuffix() string {
+	b := make([]byte, 4)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,182 @@
+//go:build e2e
+
+package e2e
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mensylisir/xmcores/connector"
+	"github.com/mensylisir/xmcores/modules"
+	"github.com/mensylisir/xmcores/pipeline"
+)
+
+func TestConnection(t *testing.T) {
+	h := Start(t, 1)
+	node := h.Nodes[0]
+	ctx := context.Background()
+
+	for _, transfer := range []string{connector.FileTransferAuto, connector.FileTransferExec} {
+		t.Run("transfer="+transfer, func(t *testing.T) {
+			cfg := h.ConnectionConfig(node)
+			cfg.FileTransfer = transfer
+			conn, err := connector.NewConnection(cfg)
+			require.NoError(t, err)
+			defer conn.Close()
+
+			stdout, _, code, err := conn.Exec(ctx, "hostname")
+			require.NoError(t, err)
+			assert.Equal(t, 0, code)
+			assert.Equal(t, node.Name, strings.TrimSpace(string(stdout)))
+
+			out, err := modules.Run(ctx, conn, "id -u")
+			require.NoError(t, err)
+			assert.Equal(t, "0", out, "sudo runs as root")
+
+			_, _, code, err = conn.Exec(ctx, "exit 3")
+			require.NoError(t, err)
+			assert.Equal(t, 3, code)
+
+			var buf bytes.Buffer
+			code, err = conn.PExec(ctx, "cat", strings.NewReader("from stdin"), &buf, io.Discard)
+			require.NoError(t, err)
+			assert.Equal(t, 0, code)
+			assert.Equal(t, "from stdin", buf.String())
+
+			local := filepath.Join(t.TempDir(), "upload")
+			data := bytes.Repeat([]byte("xmcores"), 32*1024)
+			require.NoError(t, os.WriteFile(local, data, 0o644))
+			require.NoError(t, conn.UploadFile(ctx, local, "/tmp/upload"))
+			r, err := conn.Fetch(ctx, "/tmp/upload")
+			require.NoError(t, err)
+			fetched, err := io.ReadAll(r)
+			require.NoError(t, r.Close())
+			require.NoError(t, err)
+			assert.Equal(t, data, fetched)
+
+			require.NoError(t, modules.WriteFile(ctx, conn, []byte("written\n"), "/tmp/xm-e2e", 0o600))
+			out, err = modules.Run(ctx, conn, "cat /tmp/xm-e2e")
+			require.NoError(t, err)
+			assert.Equal(t, "written", out)
+		})
+	}
+}
+
+func TestPasswordAuth(t *testing.T) {
+	h := Start(t, 1)
+	node := h.Nodes[0]
+	conn, err := connector.NewConnection(connector.Config{
+		Username: User,
+		Password: Password,
+		Address:  node.Address,
+		Port:     node.Port,
+		Timeout:  10 * time.Second,
+	})
+	require.NoError(t, err)
+	defer conn.Close()
+	out, err := modules.Run(context.Background(), conn, "whoami")
+	require.NoError(t, err)
+	assert.Equal(t, "root", out)
+
+	_, err = connector.NewConnection(connector.Config{
+		Username: User,
+		Password: "wrong",
+		Address:  node.Address,
+		Port:     node.Port,
+		Timeout:  10 * time.Second,
+	})
+	assert.Error(t, err)
+}
+
+func TestBastion(t *testing.T) {
+	h := Start(t, 2)
+	bastion, target := h.Nodes[0], h.Nodes[1]
+	conn, err := connector.NewConnection(connector.Config{
+		Username:       User,
+		Address:        target.InternalAddress,
+		Port:           22,
+		KeyFile:        h.KeyFile,
+		Timeout:        10 * time.Second,
+		Bastion:        bastion.Address,
+		BastionPort:    bastion.Port,
+		BastionUser:    User,
+		BastionKeyFile: h.KeyFile,
+	})
+	require.NoError(t, err)
+	defer conn.Close()
+	stdout, _, _, err := conn.Exec(context.Background(), "hostname")
+	require.NoError(t, err)
+	assert.Equal(t, target.Name, strings.TrimSpace(string(stdout)))
+}
+
+func TestForwardLocalPort(t *testing.T) {
+	h := Start(t, 2)
+	conn, err := connector.NewConnection(h.ConnectionConfig(h.Nodes[0]))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// Reach the sshd of node2 through node1.
+	tunnel, err := conn.(connector.Forwarder).ForwardLocalPort(context.Background(),
+		"127.0.0.1:0", net.JoinHostPort(h.Nodes[1].InternalAddress, "22"))
+	require.NoError(t, err)
+	defer tunnel.Close()
+	c, err := net.Dial("tcp", tunnel.Addr().String())
+	require.NoError(t, err)
+	defer c.Close()
+	banner, err := bufio.NewReader(c).ReadString('\n')
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(banner, "SSH-2.0-"), banner)
+}
+
+func TestPipeline(t *testing.T) {
+	h := Start(t, 3)
+	// Every command fails now and then; the retries must absorb it.
+	t.Setenv(connector.EnvChaos, "fail=0.2,seed=1,ops=exec")
+	nodes := h.Connect(t)
+
+	p := &pipeline.Pipeline{
+		Name: "e2e",
+		Tasks: []pipeline.Task{{
+			Name: "Prepare",
+			Steps: []pipeline.Step{
+				{Name: "write-marker", Command: "echo {{ .Host.Name }} > /etc/xm-e2e-marker", Retries: 10, RetryDelay: 10 * time.Millisecond},
+				{Name: "read-marker", Command: "cat /etc/xm-e2e-marker", Register: "marker", Retries: 10, RetryDelay: 10 * time.Millisecond},
+			},
+		}, {
+			Name:     "Rolling",
+			Strategy: "rolling(1)",
+			Steps: []pipeline.Step{
+				{Name: "control-plane-only", When: `host.name == "node1"`, Command: "touch /etc/xm-e2e-control-plane", Retries: 10, RetryDelay: 10 * time.Millisecond},
+			},
+		}},
+	}
+	require.NoError(t, p.Run(context.Background(), nodes))
+
+	t.Setenv(connector.EnvChaos, "")
+	for _, n := range h.Connect(t) {
+		out, err := modules.Run(context.Background(), n.Conn, "cat /etc/xm-e2e-marker")
+		require.NoError(t, err)
+		assert.Equal(t, n.Name(), out)
+		ok, err := modules.Succeeds(context.Background(), n.Conn, "test -f /etc/xm-e2e-control-plane")
+		require.NoError(t, err)
+		assert.Equal(t, n.Name() == "node1", ok, n.Name())
+	}
+}
+
+func TestExpired(t *testing.T) {
+	now := time.Unix(1000, 0)
+	out := "a 999\nb 1000\nc 2000\nd\n\ne not-a-time\n"
+	assert.Equal(t, []string{"a", "d", "e"}, expired(out, now))
+	assert.Empty(t, expired("", now))
+}
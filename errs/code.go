@@ -0,0 +1,124 @@
+package errs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Code identifies a failure independently of the language of its message,
+// so callers match on it (see CodeOf and CodedError.Is) rather than on text.
+type Code string
+
+// Languages of the message catalog.
+const (
+	LangZH = "zh"
+	LangEN = "en"
+)
+
+// EnvLang selects the language of the messages of coded errors, LangEN or
+// LangZH (the default). Locale names such as en_US.UTF-8 are accepted.
+const EnvLang = "XM_LANG"
+
+var catalog = struct {
+	sync.RWMutex
+	messages map[string]map[Code]string
+}{messages: map[string]map[Code]string{}}
+
+// RegisterMessages adds the fmt formats of the messages of codes in lang.
+// Packages register theirs from init.
+func RegisterMessages(lang string, messages map[Code]string) {
+	catalog.Lock()
+	defer catalog.Unlock()
+	m := catalog.messages[lang]
+	if m == nil {
+		m = make(map[Code]string, len(messages))
+		catalog.messages[lang] = m
+	}
+	for code, format := range messages {
+		m[code] = format
+	}
+}
+
+// Lang returns the language selected by EnvLang.
+func Lang() string {
+	lang := strings.ToLower(os.Getenv(EnvLang))
+	if i := strings.IndexAny(lang, "_-."); i >= 0 {
+		lang = lang[:i]
+	}
+	if lang == LangEN {
+		return LangEN
+	}
+	return LangZH
+}
+
+// Message formats the message of code with args in the language of Lang,
+// falling back to English, then to the code itself.
+func Message(code Code, args ...interface{}) string {
+	catalog.RLock()
+	format, ok := catalog.messages[Lang()][code]
+	if !ok {
+		format, ok = catalog.messages[LangEN][code]
+	}
+	catalog.RUnlock()
+	if !ok {
+		if len(args) == 0 {
+			return string(code)
+		}
+		return fmt.Sprintf("%s %v", code, args)
+	}
+	return fmt.Sprintf(format, args...)
+}
+
+// CodedError is a failure identified by Code, its message rendered from the
+// catalog when printed, followed by the one of the cause Err, if any.
+type CodedError struct {
+	Code Code
+	Args []interface{}
+	Err  error
+}
+
+// Error renders the message in the language of Lang.
+func (e *CodedError) Error() string {
+	msg := Message(e.Code, e.Args...)
+	if e.Err != nil {
+		return msg + ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *CodedError) Unwrap() error {
+	return e.Err
+}
+
+// Is matches a CodedError with the same code and neither arguments nor
+// cause, so that such a value serves as a sentinel for errors.Is.
+func (e *CodedError) Is(target error) bool {
+	t, ok := target.(*CodedError)
+	return ok && t.Code == e.Code && t.Args == nil && t.Err == nil
+}
+
+// Newf returns the error code with the arguments of its message.
+func Newf(code Code, args ...interface{}) error {
+	return &CodedError{Code: code, Args: args}
+}
+
+// WrapCode returns the error code with the arguments of its message, caused
+// by err. It returns nil for a nil err.
+func WrapCode(err error, code Code, args ...interface{}) error {
+	if err == nil {
+		return nil
+	}
+	return &CodedError{Code: code, Args: args, Err: err}
+}
+
+// CodeOf returns the outermost code in the chain of err, or "".
+func CodeOf(err error) Code {
+	var e *CodedError
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return ""
+}
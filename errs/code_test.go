@@ -0,0 +1,36 @@
+package errs
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const codeTest Code = "errs.test"
+
+func init() {
+	RegisterMessages(LangZH, map[Code]string{codeTest: "读取 %s 失败"})
+	RegisterMessages(LangEN, map[Code]string{codeTest: "failed to read %s"})
+}
+
+func TestCodedError(t *testing.T) {
+	cause := errors.New("permission denied")
+	coded := WrapCode(cause, codeTest, "/etc/hosts")
+
+	t.Setenv(EnvLang, "")
+	assert.Equal(t, "读取 /etc/hosts 失败: permission denied", coded.Error())
+	t.Setenv(EnvLang, "en_US.UTF-8")
+	assert.Equal(t, LangEN, Lang())
+	err := fmt.Errorf("node1: %w", coded)
+	assert.Equal(t, "node1: failed to read /etc/hosts: permission denied", err.Error())
+
+	assert.Equal(t, codeTest, CodeOf(err))
+	assert.ErrorIs(t, err, cause)
+	assert.ErrorIs(t, err, Newf(codeTest), "a code without arguments is a sentinel")
+	assert.NotErrorIs(t, err, Newf("errs.other"))
+	assert.Equal(t, Code(""), CodeOf(cause))
+	assert.Nil(t, WrapCode(nil, codeTest))
+	assert.Equal(t, "errs.unknown [x]", Message("errs.unknown", "x"))
+}
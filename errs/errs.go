@@ -0,0 +1,216 @@
+// Package errs classifies failures so callers can tell a bad configuration
+// from an unreachable host or a failed command, and exit with a code that
+// automation can branch on. Errors keep their messages; classification and the
+// failing host and step travel alongside them through the usual %w wrapping.
+package errs
+
+import (
+	"errors"
+	"strings"
+)
+
+// Kind is the failure category of an error.
+type Kind int
+
+const (
+	// Unknown is the kind of errors that were never classified.
+	Unknown Kind = iota
+	// Config means the cluster configuration is invalid or unreadable.
+	Config
+	// Connectivity means a host could not be reached or authenticated.
+	Connectivity
+	// Preflight means a host does not meet the requirements of the operation.
+	Preflight
+	// Execution means a remote command or API call failed.
+	Execution
+	// Verification means the operation ran but the result did not become healthy in time.
+	Verification
+	// Quarantined means the operation completed without some hosts, set
+	// aside after failing repeatedly; they need repair and another run.
+	Quarantined
+)
+
+// Process exit codes, one per Kind.
+const (
+	ExitOK           = 0
+	ExitUnknown      = 1
+	ExitConfig       = 2
+	ExitConnectivity = 3
+	ExitPreflight    = 4
+	ExitExecution    = 5
+	ExitVerification = 6
+	ExitQuarantined  = 7
+)
+
+var kindNames = map[Kind]string{
+	Unknown:      "unknown",
+	Config:       "config",
+	Connectivity: "connectivity",
+	Preflight:    "preflight",
+	Execution:    "execution",
+	Verification: "verification",
+	Quarantined:  "quarantined",
+}
+
+func (k Kind) String() string {
+	if name, ok := kindNames[k]; ok {
+		return name
+	}
+	return kindNames[Unknown]
+}
+
+// ExitCode returns the process exit code of the kind.
+func (k Kind) ExitCode() int {
+	switch k {
+	case Config:
+		return ExitConfig
+	case Connectivity:
+		return ExitConnectivity
+	case Preflight:
+		return ExitPreflight
+	case Execution:
+		return ExitExecution
+	case Verification:
+		return ExitVerification
+	case Quarantined:
+		return ExitQuarantined
+	default:
+		return ExitUnknown
+	}
+}
+
+// Error annotates Err with a kind, a host or a step. Unset fields are
+// inherited from errors further down the chain.
+type Error struct {
+	Kind Kind
+	Host string
+	Step string
+	Err  error
+}
+
+// Error prefixes the message with the host and step, if set.
+func (e *Error) Error() string {
+	var b strings.Builder
+	if e.Host != "" {
+		b.WriteString(e.Host + ": ")
+	}
+	if e.Step != "" {
+		b.WriteString(e.Step + ": ")
+	}
+	b.WriteString(e.Err.Error())
+	return b.String()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Wrap classifies err as kind. The outermost classification wins, so a caller
+// can reclassify, e.g., a failed command as a preflight failure. Wrap returns
+// nil for a nil err.
+func Wrap(kind Kind, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Kind: kind, Err: err}
+}
+
+// WithHost records the host err happened on; its message gets a "host: " prefix.
+func WithHost(err error, host string) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Host: host, Err: err}
+}
+
+// WithStep records the step err happened in; its message gets a "step: " prefix.
+func WithStep(err error, step string) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Step: step, Err: err}
+}
+
+// KindOf returns the outermost classification in the chain of err, including
+// errors combined with errors.Join.
+func KindOf(err error) Kind {
+	var kind Kind
+	walk(err, func(e *Error) bool {
+		kind = e.Kind
+		return kind != Unknown
+	})
+	return kind
+}
+
+// HostOf returns the outermost host recorded in the chain of err.
+func HostOf(err error) string {
+	var host string
+	walk(err, func(e *Error) bool {
+		host = e.Host
+		return host != ""
+	})
+	return host
+}
+
+// StepOf returns the outermost step recorded in the chain of err.
+func StepOf(err error) string {
+	var step string
+	walk(err, func(e *Error) bool {
+		step = e.Step
+		return step != ""
+	})
+	return step
+}
+
+// ExitCode returns the process exit code for err: ExitOK for nil, ExitUnknown
+// for unclassified errors.
+func ExitCode(err error) int {
+	if err == nil {
+		return ExitOK
+	}
+	return KindOf(err).ExitCode()
+}
+
+// walk visits the *Error values in the chain of err depth first until fn returns true.
+func walk(err error, fn func(*Error) bool) bool {
+	if err == nil {
+		return false
+	}
+	if e, ok := err.(*Error); ok && fn(e) {
+		return true
+	}
+	switch u := err.(type) {
+	case interface{ Unwrap() error }:
+		return walk(u.Unwrap(), fn)
+	case interface{ Unwrap() []error }:
+		for _, inner := range u.Unwrap() {
+			if walk(inner, fn) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// transient marks an error as worth retrying.
+type transient struct {
+	err error
+}
+
+func (t *transient) Error() string { return t.err.Error() }
+func (t *transient) Unwrap() error { return t.err }
+
+// Transient marks err as a temporary failure, e.g. a lock held by another
+// process, that may succeed when retried. Transient returns nil for a nil err.
+func Transient(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &transient{err: err}
+}
+
+// IsTransient reports whether err, or an error in its chain, was marked with Transient.
+func IsTransient(err error) bool {
+	var t *transient
+	return errors.As(err, &t)
+}
@@ -0,0 +1,51 @@
+package errs
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassification(t *testing.T) {
+	assert.Nil(t, Wrap(Execution, nil))
+	assert.Equal(t, ExitOK, ExitCode(nil))
+	assert.Equal(t, ExitUnknown, ExitCode(errors.New("plain")))
+
+	base := errors.New("command \"systemctl start kubelet\" exited with code 1")
+	err := WithStep(Wrap(Execution, base), "StartKubelet")
+	err = fmt.Errorf("install kubelet: %w", WithHost(err, "node1"))
+	assert.Equal(t, `install kubelet: node1: StartKubelet: command "systemctl start kubelet" exited with code 1`, err.Error())
+	assert.Equal(t, Execution, KindOf(err))
+	assert.Equal(t, ExitExecution, ExitCode(err))
+	assert.Equal(t, "node1", HostOf(err))
+	assert.Equal(t, "StartKubelet", StepOf(err))
+	assert.ErrorIs(t, err, base)
+
+	assert.Equal(t, Preflight, KindOf(Wrap(Preflight, err)), "outermost classification wins")
+}
+
+func TestJoined(t *testing.T) {
+	err := errors.Join(
+		WithHost(errors.New("unclassified"), "node1"),
+		WithHost(Wrap(Connectivity, errors.New("dial tcp: i/o timeout")), "node2"),
+	)
+	assert.Equal(t, Connectivity, KindOf(err))
+	assert.Equal(t, ExitConnectivity, ExitCode(err))
+	assert.Equal(t, "node1", HostOf(err))
+	assert.Equal(t, "connectivity", Connectivity.String())
+	assert.Equal(t, "unknown", Kind(42).String())
+	assert.Equal(t, ExitQuarantined, Quarantined.ExitCode())
+}
+
+func TestTransient(t *testing.T) {
+	assert.Nil(t, Transient(nil))
+	base := errors.New("could not get lock /var/lib/dpkg/lock-frontend")
+	err := WithHost(Wrap(Execution, Transient(base)), "node1")
+	assert.True(t, IsTransient(err))
+	assert.Equal(t, Execution, KindOf(err))
+	assert.ErrorIs(t, err, base)
+	assert.Equal(t, "node1: "+base.Error(), err.Error())
+	assert.False(t, IsTransient(Wrap(Execution, base)))
+}
@@ -0,0 +1,87 @@
+package facts
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/mensylisir/xmcores/common"
+	"github.com/mensylisir/xmcores/connector"
+	"github.com/mensylisir/xmcores/util"
+)
+
+// NormalizeArch converts uname -m output and other aliases to a Go architecture.
+// Unknown values are returned as common.ArchUnknown.
+func NormalizeArch(raw string) common.Arch {
+	a := strings.ToLower(strings.TrimSpace(raw))
+	switch a {
+	case "":
+		return common.ArchUnknown
+	case util.ArchAMD64, util.ArchARM64, util.ArchARM:
+		return common.Arch(a)
+	}
+	if goArch := util.GoArchFromAlias(a); goArch != "" {
+		return common.Arch(goArch)
+	}
+	return common.ArchUnknown
+}
+
+// DetectArch runs uname -m on the remote host and returns its normalized architecture.
+func DetectArch(ctx context.Context, exec connector.Executor) (common.Arch, error) {
+	stdout, stderr, exitCode, err := exec.Exec(ctx, "uname -m")
+	if err != nil {
+		return common.ArchUnknown, fmt.Errorf("failed to run uname -m: %w", err)
+	}
+	if exitCode != 0 {
+		return common.ArchUnknown, fmt.Errorf("uname -m exited with code %d: %s", exitCode, strings.TrimSpace(string(stderr)))
+	}
+	arch := NormalizeArch(string(stdout))
+	if arch == common.ArchUnknown {
+		return arch, fmt.Errorf("unrecognized architecture %q", strings.TrimSpace(string(stdout)))
+	}
+	return arch, nil
+}
+
+// GatherArch determines the architecture of host and records it with SetArch.
+// An architecture already set on the host (configured in the inventory or detected
+// earlier) is normalized and kept; otherwise it is detected over exec.
+func GatherArch(ctx context.Context, host connector.Host, exec connector.Executor) (common.Arch, error) {
+	if configured := host.GetArch(); configured != "" && configured != common.ArchUnknown {
+		arch := NormalizeArch(string(configured))
+		if arch == common.ArchUnknown {
+			return arch, fmt.Errorf("host %s: unrecognized architecture %q", host.GetName(), configured)
+		}
+		host.SetArch(arch)
+		return arch, nil
+	}
+	arch, err := DetectArch(ctx, exec)
+	if err != nil {
+		return arch, fmt.Errorf("host %s: %w", host.GetName(), err)
+	}
+	host.SetArch(arch)
+	return arch, nil
+}
+
+// GroupByArch groups hosts by their recorded architecture. Hosts whose
+// architecture has not been gathered are grouped under common.ArchUnknown.
+func GroupByArch(hosts []connector.Host) map[common.Arch][]connector.Host {
+	groups := make(map[common.Arch][]connector.Host)
+	for _, h := range hosts {
+		arch := NormalizeArch(string(h.GetArch()))
+		groups[arch] = append(groups[arch], h)
+	}
+	return groups
+}
+
+// Arches returns the distinct, known architectures of hosts in sorted order.
+func Arches(hosts []connector.Host) []string {
+	var arches []string
+	for arch := range GroupByArch(hosts) {
+		if arch != common.ArchUnknown {
+			arches = append(arches, string(arch))
+		}
+	}
+	sort.Strings(arches)
+	return arches
+}
@@ -0,0 +1,94 @@
+package facts
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mensylisir/xmcores/common"
+	"github.com/mensylisir/xmcores/connector"
+)
+
+type fakeExecutor struct {
+	stdout   string
+	exitCode int
+	err      error
+	calls    int
+}
+
+func (f *fakeExecutor) Exec(ctx context.Context, cmd string) ([]byte, []byte, int, error) {
+	f.calls++
+	return []byte(f.stdout), nil, f.exitCode, f.err
+}
+
+func (f *fakeExecutor) PExec(ctx context.Context, cmd string, stdin io.Reader, stdout io.Writer, stderr io.Writer) (int, error) {
+	return 0, errors.New("not implemented")
+}
+
+func TestNormalizeArch(t *testing.T) {
+	tests := map[string]common.Arch{
+		"x86_64\n": common.ArchAmd64,
+		"amd64":    common.ArchAmd64,
+		"aarch64":  common.ArchArm64,
+		"ARM64":    common.ArchArm64,
+		"armv7l":   common.ArchArm,
+		"mips":     common.ArchUnknown,
+		"":         common.ArchUnknown,
+	}
+	for in, want := range tests {
+		assert.Equal(t, want, NormalizeArch(in), "input %q", in)
+	}
+}
+
+func TestDetectArch(t *testing.T) {
+	arch, err := DetectArch(context.Background(), &fakeExecutor{stdout: "aarch64\n"})
+	require.NoError(t, err)
+	assert.Equal(t, common.ArchArm64, arch)
+
+	_, err = DetectArch(context.Background(), &fakeExecutor{stdout: "sparc64\n"})
+	assert.Error(t, err)
+
+	_, err = DetectArch(context.Background(), &fakeExecutor{exitCode: 127})
+	assert.Error(t, err)
+}
+
+func TestGatherArch(t *testing.T) {
+	configured := connector.NewHost()
+	configured.SetName("node1")
+	configured.SetArch(common.ArchX86_64)
+	exec := &fakeExecutor{stdout: "aarch64"}
+	arch, err := GatherArch(context.Background(), configured, exec)
+	require.NoError(t, err)
+	assert.Equal(t, common.ArchAmd64, arch)
+	assert.Equal(t, common.ArchAmd64, configured.GetArch())
+	assert.Zero(t, exec.calls, "configured arch must not trigger detection")
+
+	detected := connector.NewHost()
+	detected.SetName("node2")
+	arch, err = GatherArch(context.Background(), detected, exec)
+	require.NoError(t, err)
+	assert.Equal(t, common.ArchArm64, arch)
+	assert.Equal(t, common.ArchArm64, detected.GetArch())
+
+	_, err = GatherArch(context.Background(), detected, exec)
+	require.NoError(t, err)
+	assert.Equal(t, 1, exec.calls, "detected arch should be reused")
+}
+
+func TestGroupByArch(t *testing.T) {
+	var hosts []connector.Host
+	for _, a := range []common.Arch{common.ArchAmd64, common.ArchArm64, common.ArchX86_64, ""} {
+		h := connector.NewHost()
+		h.SetArch(a)
+		hosts = append(hosts, h)
+	}
+	groups := GroupByArch(hosts)
+	assert.Len(t, groups[common.ArchAmd64], 2)
+	assert.Len(t, groups[common.ArchArm64], 1)
+	assert.Len(t, groups[common.ArchUnknown], 1)
+	assert.Equal(t, []string{"amd64", "arm64"}, Arches(hosts))
+}
@@ -0,0 +1,114 @@
+package facts
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Component names, see ComponentsCommand.
+const (
+	ComponentContainerd = "containerd"
+	ComponentKubelet    = "kubelet"
+)
+
+// ComponentConfigs are the configuration files of each detected component,
+// including those kubeadm writes for the kubelet when a node joins.
+var ComponentConfigs = map[string][]string{
+	ComponentContainerd: {"/etc/containerd/config.toml"},
+	ComponentKubelet:    {"/var/lib/kubelet/config.yaml", "/etc/kubernetes/kubelet.conf", "/etc/kubernetes/bootstrap-kubelet.conf"},
+}
+
+// Component is a cluster component found installed on a host, possibly
+// partially: by a failed previous attempt or set up by hand.
+type Component struct {
+	Name string
+	// Path is the binary, empty when only configuration files are left.
+	Path string
+	// Version is the version the binary reports, e.g. v1.7.13, empty when it
+	// cannot be told.
+	Version string
+	// Package is the system package owning the binary, empty when it was
+	// not installed by the package manager.
+	Package string
+	// Active reports whether the service of the component is running.
+	Active bool
+	// Configs are the configuration files of ComponentConfigs present.
+	Configs []string
+}
+
+// ComponentsCommand prints the components present on a host, see
+// ParseComponents. It should run as root: some configuration files are only
+// visible to it.
+var ComponentsCommand = componentsCommand()
+
+func componentsCommand() string {
+	names := make([]string, 0, len(ComponentConfigs))
+	var configs []string
+	for name, files := range ComponentConfigs {
+		names = append(names, name)
+		configs = append(configs, files...)
+	}
+	sort.Strings(names)
+	sort.Strings(configs)
+	return "for c in " + strings.Join(names, " ") + "; do " +
+		`p=$(command -v $c) || continue; ` +
+		`v=$($p --version 2>/dev/null | head -n 1); ` +
+		`a=inactive; { systemctl is-active --quiet $c || rc-service $c status; } >/dev/null 2>&1 && a=active; ` +
+		`o=$(dpkg -S $p 2>/dev/null | cut -d: -f1); [ -n "$o" ] || o=$(rpm -qf --qf '%{NAME}' $p 2>/dev/null) || o=; ` +
+		`printf 'binary\t%s\t%s\t%s\t%s\t%s\n' "$c" "$p" "$a" "$o" "$v"; ` +
+		"done; for f in " + strings.Join(configs, " ") + `; do [ -e $f ] && printf 'config\t%s\n' $f; done; true`
+}
+
+var versionPattern = regexp.MustCompile(`^v?\d+\.\d+(\.\d+)?([-+]\S*)?$`)
+
+// parseComponentVersion returns the first word of the --version output of a
+// binary that looks like a version, with a leading "v".
+func parseComponentVersion(out string) string {
+	for _, f := range strings.Fields(out) {
+		if versionPattern.MatchString(f) {
+			return "v" + strings.TrimPrefix(f, "v")
+		}
+	}
+	return ""
+}
+
+// ParseComponents parses the output of ComponentsCommand into the components
+// present, sorted by name.
+func ParseComponents(out string) []Component {
+	byName := map[string]*Component{}
+	get := func(name string) *Component {
+		c := byName[name]
+		if c == nil {
+			c = &Component{Name: name}
+			byName[name] = c
+		}
+		return c
+	}
+	owner := map[string]string{}
+	for name, files := range ComponentConfigs {
+		for _, f := range files {
+			owner[f] = name
+		}
+	}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Split(strings.TrimRight(line, "\r"), "\t")
+		switch {
+		case fields[0] == "binary" && len(fields) == 6:
+			c := get(fields[1])
+			c.Path = fields[2]
+			c.Active = fields[3] == "active"
+			c.Package = fields[4]
+			c.Version = parseComponentVersion(fields[5])
+		case fields[0] == "config" && len(fields) == 2 && owner[fields[1]] != "":
+			c := get(owner[fields[1]])
+			c.Configs = append(c.Configs, fields[1])
+		}
+	}
+	components := make([]Component, 0, len(byName))
+	for _, c := range byName {
+		components = append(components, *c)
+	}
+	sort.Slice(components, func(i, j int) bool { return components[i].Name < components[j].Name })
+	return components
+}
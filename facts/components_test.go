@@ -0,0 +1,28 @@
+package facts
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseComponents(t *testing.T) {
+	out := "binary\tkubelet\t/usr/bin/kubelet\tinactive\tkubelet\tKubernetes v1.30.2\n" +
+		"binary\tcontainerd\t/usr/local/bin/containerd\tactive\t\tcontainerd github.com/containerd/containerd v1.7.13 7c3aca7a610df76212171d200ca3811ff6096eb8\n" +
+		"config\t/etc/kubernetes/kubelet.conf\n" +
+		"config\t/var/lib/kubelet/config.yaml\n" +
+		"config\t/etc/unknown.conf\n"
+	assert.Equal(t, []Component{
+		{Name: "containerd", Path: "/usr/local/bin/containerd", Version: "v1.7.13", Active: true},
+		{Name: "kubelet", Path: "/usr/bin/kubelet", Version: "v1.30.2", Package: "kubelet",
+			Configs: []string{"/etc/kubernetes/kubelet.conf", "/var/lib/kubelet/config.yaml"}},
+	}, ParseComponents(out))
+
+	assert.Equal(t, []Component{{Name: "containerd", Configs: []string{"/etc/containerd/config.toml"}}},
+		ParseComponents("config\t/etc/containerd/config.toml\n"), "configuration left without the binary")
+	assert.Empty(t, ParseComponents(""))
+
+	assert.Equal(t, "v1.6.28", parseComponentVersion("containerd containerd.io 1.6.28 ae07eda36dd25f8a1b98dfbf587313b99c0190bb"))
+	assert.Empty(t, parseComponentVersion("unknown flag: --version"))
+	assert.Contains(t, ComponentsCommand, "for c in containerd kubelet; do")
+}
@@ -0,0 +1,48 @@
+package facts
+
+import (
+	"net"
+	"strings"
+)
+
+// AddressesCommand prints the IP addresses of a host with their interfaces,
+// see ParseAddresses.
+const AddressesCommand = "ip -o addr show"
+
+// Address is an IP address assigned to an interface of a host.
+type Address struct {
+	Interface string
+	IP        net.IP
+	// Network is the subnet of the address, from its prefix length.
+	Network *net.IPNet
+}
+
+// ParseAddresses parses the output of AddressesCommand, whose lines look like
+// "2: eth0    inet 10.0.0.5/24 brd 10.0.0.255 scope global eth0".
+func ParseAddresses(out string) []Address {
+	var addrs []Address
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 || (fields[2] != "inet" && fields[2] != "inet6") {
+			continue
+		}
+		ip, network, err := net.ParseCIDR(fields[3])
+		if err != nil {
+			continue
+		}
+		// VLAN interfaces are shown as eth0.10@eth0.
+		iface, _, _ := strings.Cut(fields[1], "@")
+		addrs = append(addrs, Address{Interface: iface, IP: ip, Network: network})
+	}
+	return addrs
+}
+
+// FindAddress returns the address of addrs equal to ip, if any.
+func FindAddress(addrs []Address, ip net.IP) (Address, bool) {
+	for _, a := range addrs {
+		if a.IP.Equal(ip) {
+			return a, true
+		}
+	}
+	return Address{}, false
+}
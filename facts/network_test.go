@@ -0,0 +1,32 @@
+package facts
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseAddresses(t *testing.T) {
+	out := "1: lo    inet 127.0.0.1/8 scope host lo\\       valid_lft forever preferred_lft forever\n" +
+		"2: eth0    inet 192.168.0.20/24 brd 192.168.0.255 scope global eth0\\       valid_lft forever preferred_lft forever\n" +
+		"3: eth1.10@eth1    inet 10.0.0.20/16 brd 10.0.255.255 scope global eth1.10\\       valid_lft forever preferred_lft forever\n" +
+		"3: eth1.10@eth1    inet6 fd00::20/64 scope global \\       valid_lft forever preferred_lft forever\n" +
+		"4: eth2    link/ether 52:54:00:12:34:56 brd ff:ff:ff:ff:ff:ff\n"
+	addrs := ParseAddresses(out)
+	require.Len(t, addrs, 4)
+
+	a, ok := FindAddress(addrs, net.ParseIP("10.0.0.20"))
+	require.True(t, ok)
+	assert.Equal(t, "eth1.10", a.Interface)
+	assert.Equal(t, "10.0.0.0/16", a.Network.String())
+
+	a, ok = FindAddress(addrs, net.ParseIP("fd00::20"))
+	require.True(t, ok)
+	assert.Equal(t, "fd00::/64", a.Network.String())
+
+	_, ok = FindAddress(addrs, net.ParseIP("10.0.0.21"))
+	assert.False(t, ok)
+	assert.Empty(t, ParseAddresses(""))
+}
@@ -0,0 +1,114 @@
+package facts
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/mensylisir/xmcores/connector"
+)
+
+// Package manager families.
+const (
+	PackageManagerApt = "apt"
+	PackageManagerYum = "yum"
+	PackageManagerDnf = "dnf"
+	PackageManagerApk = "apk"
+)
+
+// Init systems.
+const (
+	InitSystemd = "systemd"
+	InitOpenRC  = "openrc"
+)
+
+// OSRelease holds the fields of /etc/os-release the installer cares about.
+type OSRelease struct {
+	ID        string
+	IDLike    []string
+	VersionID string
+	Codename  string
+	Pretty    string
+}
+
+// ParseOSRelease parses the contents of /etc/os-release.
+func ParseOSRelease(content string) OSRelease {
+	var rel OSRelease
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if !ok || strings.HasPrefix(key, "#") {
+			continue
+		}
+		value = strings.Trim(value, `"'`)
+		switch key {
+		case "ID":
+			rel.ID = strings.ToLower(value)
+		case "ID_LIKE":
+			rel.IDLike = strings.Fields(strings.ToLower(value))
+		case "VERSION_ID":
+			rel.VersionID = value
+		case "VERSION_CODENAME":
+			rel.Codename = value
+		case "PRETTY_NAME":
+			rel.Pretty = value
+		}
+	}
+	return rel
+}
+
+// Is reports whether the distribution is id or is derived from it.
+func (r OSRelease) Is(id string) bool {
+	if r.ID == id {
+		return true
+	}
+	for _, like := range r.IDLike {
+		if like == id {
+			return true
+		}
+	}
+	return false
+}
+
+// PackageManager returns the package manager family of the distribution, or
+// an empty string when it is not recognized.
+func (r OSRelease) PackageManager() string {
+	switch {
+	case r.Is("alpine"):
+		return PackageManagerApk
+	case r.Is("debian"), r.Is("ubuntu"):
+		return PackageManagerApt
+	case (r.Is("rhel") || r.Is("centos")) && strings.HasPrefix(r.VersionID, "7"):
+		return PackageManagerYum
+	case r.Is("fedora"), r.Is("rhel"), r.Is("centos"):
+		return PackageManagerDnf
+	default:
+		return ""
+	}
+}
+
+// InitSystem returns the init system managing services on the distribution:
+// OpenRC on Alpine, systemd everywhere else.
+func (r OSRelease) InitSystem() string {
+	if r.Is("alpine") {
+		return InitOpenRC
+	}
+	return InitSystemd
+}
+
+// DetectOSRelease reads /etc/os-release from the remote host.
+func DetectOSRelease(ctx context.Context, exec connector.Executor) (OSRelease, error) {
+	stdout, stderr, exitCode, err := exec.Exec(ctx, "cat /etc/os-release")
+	if err != nil {
+		return OSRelease{}, fmt.Errorf("failed to read /etc/os-release: %w", err)
+	}
+	if exitCode != 0 {
+		return OSRelease{}, fmt.Errorf("reading /etc/os-release exited with code %d: %s", exitCode, strings.TrimSpace(string(stderr)))
+	}
+	rel := ParseOSRelease(string(stdout))
+	if rel.ID == "" {
+		return rel, fmt.Errorf("/etc/os-release has no ID field")
+	}
+	return rel, nil
+}
@@ -0,0 +1,45 @@
+package facts
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseOSRelease(t *testing.T) {
+	rel := ParseOSRelease(`NAME="Rocky Linux"
+VERSION="9.3 (Blue Onyx)"
+ID="rocky"
+ID_LIKE="rhel centos fedora"
+VERSION_ID="9.3"
+PRETTY_NAME="Rocky Linux 9.3 (Blue Onyx)"
+`)
+	assert.Equal(t, "rocky", rel.ID)
+	assert.Equal(t, []string{"rhel", "centos", "fedora"}, rel.IDLike)
+	assert.Equal(t, "9.3", rel.VersionID)
+	assert.True(t, rel.Is("rhel"))
+	assert.Equal(t, PackageManagerDnf, rel.PackageManager())
+}
+
+func TestPackageManager(t *testing.T) {
+	tests := []struct {
+		content string
+		want    string
+	}{
+		{"ID=ubuntu\nID_LIKE=debian\nVERSION_CODENAME=jammy", PackageManagerApt},
+		{"ID=debian", PackageManagerApt},
+		{"ID=\"centos\"\nID_LIKE=\"rhel fedora\"\nVERSION_ID=\"7\"", PackageManagerYum},
+		{"ID=alpine", PackageManagerApk},
+		{"ID=fedora", PackageManagerDnf},
+		{"ID=gentoo", ""},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, ParseOSRelease(tt.content).PackageManager(), tt.content)
+	}
+}
+
+func TestInitSystem(t *testing.T) {
+	assert.Equal(t, InitOpenRC, ParseOSRelease("ID=alpine\nVERSION_ID=3.20.1").InitSystem())
+	assert.Equal(t, InitSystemd, ParseOSRelease("ID=ubuntu\nID_LIKE=debian").InitSystem())
+	assert.Equal(t, InitSystemd, ParseOSRelease("ID=rocky\nID_LIKE=\"rhel centos fedora\"").InitSystem())
+}
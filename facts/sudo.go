@@ -0,0 +1,23 @@
+package facts
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/mensylisir/xmcores/connector"
+)
+
+// DetectSudoNoPassword reports whether the user running commands over exec
+// can use sudo without a password (NOPASSWD). Connections that probe it
+// themselves (see connector.SudoProber) answer from their cache; for the
+// others sudo -n true is run. A host without sudo reports false.
+func DetectSudoNoPassword(ctx context.Context, exec connector.Executor) (bool, error) {
+	if p, ok := exec.(connector.SudoProber); ok {
+		return p.SudoNoPassword(ctx)
+	}
+	_, _, exitCode, err := exec.Exec(ctx, "sudo -n true")
+	if exitCode < 0 {
+		return false, fmt.Errorf("failed to run sudo -n true: %w", err)
+	}
+	return exitCode == 0, nil
+}
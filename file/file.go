@@ -4,15 +4,19 @@ import (
 	"archive/tar"
 	"compress/gzip"
 	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 
 	"github.com/mensylisir/xmcores/common"
+	"github.com/mensylisir/xmcores/logger"
 )
 
 // PathExists checks if a path exists.
@@ -120,6 +124,22 @@ func FileMD5(path string) (string, error) {
 	return fmt.Sprintf("%x", hash.Sum(nil)), nil
 }
 
+// FileSHA256 calculates the hex-encoded SHA-256 checksum of a file.
+func FileSHA256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open file %s: %w", path, err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", fmt.Errorf("failed to copy file content to hash for %s: %w", path, err)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
 // LocalMd5Sum is a wrapper around FileMD5 that panics on error.
 // Consider if panicking is the desired behavior for a utility function.
 // It's generally better to return errors.
@@ -299,8 +319,51 @@ func Tar(srcPath, dstTarball, trimPathPrefix string) error {
 	})
 }
 
+const (
+	// DefaultUntarMaxFiles is the default limit on the number of entries Untar extracts.
+	DefaultUntarMaxFiles = 1000000
+	// DefaultUntarMaxTotalSize is the default limit on the total size of regular file content Untar writes (64 GiB).
+	DefaultUntarMaxTotalSize int64 = 64 << 30
+)
+
+var (
+	// ErrUnsafeTarEntry is returned (wrapped) when an archive entry would be written outside the
+	// destination directory or is of a type that is not allowed.
+	ErrUnsafeTarEntry = errors.New("unsafe tar entry")
+	// ErrUntarLimitExceeded is returned (wrapped) when an archive exceeds the configured file count or size limits.
+	ErrUntarLimitExceeded = errors.New("untar limit exceeded")
+)
+
+// UntarOptions controls how UntarWithOptions validates archive entries.
+type UntarOptions struct {
+	// Strict makes any unsafe entry (absolute path, ".." traversal, link escaping the destination,
+	// device or fifo) fail the whole extraction. When false, such entries are skipped with a warning.
+	// Entries are never written outside the destination directory in either mode.
+	Strict bool
+	// MaxFiles limits the number of archive entries. Zero means no limit.
+	MaxFiles int
+	// MaxTotalSize limits the total number of bytes of regular file content. Zero means no limit.
+	MaxTotalSize int64
+}
+
+// DefaultUntarOptions returns the options used by Untar: strict mode with the default limits.
+func DefaultUntarOptions() UntarOptions {
+	return UntarOptions{
+		Strict:       true,
+		MaxFiles:     DefaultUntarMaxFiles,
+		MaxTotalSize: DefaultUntarMaxTotalSize,
+	}
+}
+
 // Untar extracts a gzipped tarball (srcTarball) to the destination directory (dstDir).
+// It uses DefaultUntarOptions, so archives containing unsafe entries are rejected.
 func Untar(srcTarball, dstDir string) error {
+	return UntarWithOptions(srcTarball, dstDir, DefaultUntarOptions())
+}
+
+// UntarWithOptions extracts a gzipped tarball (srcTarball) to dstDir, validating every entry
+// against path traversal and symlink escapes and enforcing the limits in opts.
+func UntarWithOptions(srcTarball, dstDir string, opts UntarOptions) error {
 	fr, err := os.Open(srcTarball)
 	if err != nil {
 		return fmt.Errorf("failed to open source tarball %s: %w", srcTarball, err)
@@ -313,7 +376,33 @@ func Untar(srcTarball, dstDir string) error {
 	}
 	defer gr.Close()
 
+	if err := os.MkdirAll(dstDir, common.FileMode0755); err != nil {
+		return fmt.Errorf("failed to create destination directory %s: %w", dstDir, err)
+	}
+	// All containment checks are done against the fully resolved destination, so a dstDir
+	// that is itself a symlink (e.g. /tmp on macOS) does not make every entry look unsafe.
+	absDst, err := filepath.Abs(dstDir)
+	if err != nil {
+		return fmt.Errorf("failed to get absolute path of %s: %w", dstDir, err)
+	}
+	root, err := filepath.EvalSymlinks(absDst)
+	if err != nil {
+		return fmt.Errorf("failed to resolve destination directory %s: %w", dstDir, err)
+	}
+
+	// unsafe either aborts the extraction (strict) or logs and skips the entry.
+	unsafe := func(name, reason string) error {
+		if opts.Strict {
+			return fmt.Errorf("%w: %q in %s: %s", ErrUnsafeTarEntry, name, srcTarball, reason)
+		}
+		logger.Log.Warnf("Skipping unsafe tar entry %q in %s: %s", name, srcTarball, reason)
+		return nil
+	}
+
 	tr := tar.NewReader(gr)
+	var entries int
+	var totalSize int64
+	var symlinks []string
 
 	for {
 		hdr, err := tr.Next()
@@ -326,69 +415,223 @@ func Untar(srcTarball, dstDir string) error {
 		if hdr == nil { // Should not happen if err is nil and not EOF
 			continue
 		}
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			continue // PAX global headers carry metadata only (e.g. archives produced by git archive)
+		}
+
+		entries++
+		if opts.MaxFiles > 0 && entries > opts.MaxFiles {
+			return fmt.Errorf("%w: %s contains more than %d entries", ErrUntarLimitExceeded, srcTarball, opts.MaxFiles)
+		}
 
-		// Important: Sanitize hdr.Name to prevent path traversal attacks (zip slip)
-		// filepath.Join will clean paths, but ensuring no ".." components escape dstDir is crucial.
-		targetPath := filepath.Join(dstDir, hdr.Name)
-		// Check if the cleaned targetPath is still within dstDir
-		if !strings.HasPrefix(filepath.Clean(targetPath), filepath.Clean(dstDir)+string(os.PathSeparator)) && filepath.Clean(targetPath) != filepath.Clean(dstDir) {
-			return fmt.Errorf("invalid tar entry path: %s (potential zip slip attack)", hdr.Name)
+		name, reason := sanitizeTarEntryName(hdr.Name)
+		if reason != "" {
+			if err := unsafe(hdr.Name, reason); err != nil {
+				return err
+			}
+			continue
+		}
+		if name == "." {
+			continue // The destination directory itself
 		}
 
+		// Resolve the parent through any symlinks already extracted, so entries cannot be
+		// written through a link that points outside the destination.
+		lexicalTarget := filepath.Join(root, filepath.FromSlash(name))
+		parentDir, err := resolveExistingPath(filepath.Dir(lexicalTarget))
+		if err != nil || !isWithinDir(root, parentDir) {
+			if err := unsafe(hdr.Name, "parent directory resolves outside the destination"); err != nil {
+				return err
+			}
+			continue
+		}
+		targetPath := filepath.Join(parentDir, filepath.Base(lexicalTarget))
+
 		switch hdr.Typeflag {
 		case tar.TypeDir:
-			// Create directory if it doesn't exist.
-			// Use hdr.Mode for permissions, but ensure it's a directory mode.
-			// os.MkdirAll is generally safe and will use correct permissions for intermediate dirs.
-			if err := os.MkdirAll(targetPath, fs.FileMode(hdr.Mode)|0700); err != nil { // Ensure execute for user at least
-				// Or use common.FileMode0755 as a standard
-				// if err := os.MkdirAll(targetPath, common.FileMode0755); err != nil {
+			if info, lstatErr := os.Lstat(targetPath); lstatErr == nil && info.Mode()&os.ModeSymlink != 0 {
+				resolved, resolveErr := resolveExistingPath(targetPath)
+				if resolveErr != nil || !isWithinDir(root, resolved) {
+					if err := unsafe(hdr.Name, "directory is an existing symlink pointing outside the destination"); err != nil {
+						return err
+					}
+					continue
+				}
+			}
+			// Ensure execute for user at least so the directory stays traversable.
+			if err := os.MkdirAll(targetPath, hdr.FileInfo().Mode().Perm()|0700); err != nil {
 				return fmt.Errorf("failed to create directory %s from tar: %w", targetPath, err)
 			}
-		case tar.TypeReg:
-			// Create parent directory for the file
-			parentDir := filepath.Dir(targetPath)
+
+		case tar.TypeReg, tar.TypeRegA:
+			if opts.MaxTotalSize > 0 && totalSize+hdr.Size > opts.MaxTotalSize {
+				return fmt.Errorf("%w: %s expands to more than %d bytes", ErrUntarLimitExceeded, srcTarball, opts.MaxTotalSize)
+			}
 			if err := os.MkdirAll(parentDir, common.FileMode0755); err != nil {
 				return fmt.Errorf("failed to create parent directory %s for file from tar: %w", parentDir, err)
 			}
+			// Replace whatever is there instead of writing through an existing symlink.
+			if err := removeNonDir(targetPath); err != nil {
+				return err
+			}
 
-			// Create the file
-			// Use O_TRUNC to overwrite if file already exists, which is typical for untar.
-			file, err := os.OpenFile(targetPath, os.O_CREATE|os.O_RDWR|os.O_TRUNC, fs.FileMode(hdr.Mode))
+			file, err := os.OpenFile(targetPath, os.O_CREATE|os.O_RDWR|os.O_TRUNC|os.O_EXCL, hdr.FileInfo().Mode().Perm())
 			if err != nil {
 				return fmt.Errorf("failed to create file %s from tar: %w", targetPath, err)
 			}
-			// defer file.Close() // Close in loop for each file
-
-			if _, err := io.Copy(file, tr); err != nil {
-				file.Close() // Close explicitly before returning error
+			n, err := io.Copy(file, tr)
+			file.Close()
+			if err != nil {
 				return fmt.Errorf("failed to write content to file %s from tar: %w", targetPath, err)
 			}
-			file.Close() // Close successfully written file
+			totalSize += n
 
 		case tar.TypeSymlink:
-			// Create parent directory for the symlink
-			parentDir := filepath.Dir(targetPath)
+			if filepath.IsAbs(hdr.Linkname) || path.IsAbs(filepath.ToSlash(hdr.Linkname)) {
+				if err := unsafe(hdr.Name, fmt.Sprintf("symlink target %q is absolute", hdr.Linkname)); err != nil {
+					return err
+				}
+				continue
+			}
+			if !isWithinDir(root, filepath.Join(parentDir, filepath.FromSlash(hdr.Linkname))) {
+				if err := unsafe(hdr.Name, fmt.Sprintf("symlink target %q points outside the destination", hdr.Linkname)); err != nil {
+					return err
+				}
+				continue
+			}
 			if err := os.MkdirAll(parentDir, common.FileMode0755); err != nil {
 				return fmt.Errorf("failed to create parent directory %s for symlink from tar: %w", parentDir, err)
 			}
-			// Check if symlink already exists and remove it to avoid error on os.Symlink if it's a different type
-			if _, lstatErr := os.Lstat(targetPath); lstatErr == nil {
-				if removeErr := os.Remove(targetPath); removeErr != nil {
-					return fmt.Errorf("failed to remove existing file at symlink target %s: %w", targetPath, removeErr)
-				}
+			if err := removeNonDir(targetPath); err != nil {
+				return err
 			}
-
 			if err := os.Symlink(hdr.Linkname, targetPath); err != nil {
 				return fmt.Errorf("failed to create symlink %s -> %s from tar: %w", targetPath, hdr.Linkname, err)
 			}
+			symlinks = append(symlinks, targetPath)
+
+		case tar.TypeLink:
+			linkName, reason := sanitizeTarEntryName(hdr.Linkname)
+			if reason != "" {
+				if err := unsafe(hdr.Name, "hard link target: "+reason); err != nil {
+					return err
+				}
+				continue
+			}
+			linkTarget, err := resolveExistingPath(filepath.Join(root, filepath.FromSlash(linkName)))
+			if err != nil || !isWithinDir(root, linkTarget) {
+				if err := unsafe(hdr.Name, fmt.Sprintf("hard link target %q resolves outside the destination", hdr.Linkname)); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := os.MkdirAll(parentDir, common.FileMode0755); err != nil {
+				return fmt.Errorf("failed to create parent directory %s for hard link from tar: %w", parentDir, err)
+			}
+			if err := removeNonDir(targetPath); err != nil {
+				return err
+			}
+			if err := os.Link(linkTarget, targetPath); err != nil {
+				return fmt.Errorf("failed to create hard link %s -> %s from tar: %w", targetPath, linkTarget, err)
+			}
+
+		case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			if err := unsafe(hdr.Name, fmt.Sprintf("entry type %q (device or fifo) is not allowed", hdr.Typeflag)); err != nil {
+				return err
+			}
 
 		default:
-			// Handle other types if necessary (e.g., hard links, char/block devices)
-			// For now, we can log or ignore them.
-			// fmt.Printf("Unsupported tar entry type %c for %s\n", hdr.Typeflag, hdr.Name)
-			// For KubeKey, regular files, directories, and symlinks are probably the most important.
+			// Other types (e.g. GNU sparse or vendor extensions) carry nothing we need to extract.
+		}
+	}
+
+	// A symlink that looked contained when it was created can be redirected outside by links
+	// extracted later (e.g. "a -> b/../x" followed by "b -> ."), so verify the final layout.
+	for _, link := range symlinks {
+		resolved, err := filepath.EvalSymlinks(link)
+		if err != nil {
+			continue // Dangling links cannot be followed, so they cannot escape either
+		}
+		if isWithinDir(root, resolved) {
+			continue
+		}
+		rel, _ := filepath.Rel(root, link)
+		if rmErr := os.Remove(link); rmErr != nil {
+			return fmt.Errorf("failed to remove escaping symlink %s: %w", link, rmErr)
+		}
+		if err := unsafe(filepath.ToSlash(rel), fmt.Sprintf("symlink resolves to %s outside the destination", resolved)); err != nil {
+			return err
 		}
 	}
 	return nil
 }
+
+// sanitizeTarEntryName normalizes an archive entry name to a clean, slash-separated relative path.
+// It returns a non-empty reason if the name is absolute or escapes via "..".
+func sanitizeTarEntryName(name string) (string, string) {
+	if name == "" {
+		return "", "empty entry name"
+	}
+	slashed := filepath.ToSlash(name)
+	if path.IsAbs(slashed) || filepath.IsAbs(name) || filepath.VolumeName(name) != "" {
+		return "", "absolute path"
+	}
+	cleaned := path.Clean(slashed)
+	if cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", "path traversal via \"..\""
+	}
+	return cleaned, ""
+}
+
+// resolveExistingPath resolves symlinks in the longest existing prefix of p and appends the
+// remaining, not yet existing, components unchanged.
+func resolveExistingPath(p string) (string, error) {
+	existing := p
+	var rest []string
+	for {
+		if _, err := os.Lstat(existing); err == nil {
+			break
+		} else if !os.IsNotExist(err) {
+			return "", err
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			break
+		}
+		rest = append([]string{filepath.Base(existing)}, rest...)
+		existing = parent
+	}
+	resolved, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(append([]string{resolved}, rest...)...), nil
+}
+
+// isWithinDir reports whether p is root or lies below it. Both paths must be absolute and clean.
+func isWithinDir(root, p string) bool {
+	rel, err := filepath.Rel(root, p)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(os.PathSeparator))
+}
+
+// removeNonDir removes an existing file or symlink at p so it can be replaced.
+// Directories are left alone and reported as an error by the subsequent create.
+func removeNonDir(p string) error {
+	info, err := os.Lstat(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to stat %s: %w", p, err)
+	}
+	if info.IsDir() {
+		return nil
+	}
+	if err := os.Remove(p); err != nil {
+		return fmt.Errorf("failed to remove existing file %s: %w", p, err)
+	}
+	return nil
+}
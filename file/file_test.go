@@ -2,8 +2,11 @@
 package file
 
 import (
+	"archive/tar"
 	"bytes"
+	"compress/gzip"
 	"crypto/md5"
+	"errors"
 	"fmt"
 	"github.com/mensylisir/xmcores/common"
 	"io/fs"
@@ -542,6 +545,168 @@ func TestTarAndUntar(t *testing.T) {
 
 }
 
+// testTarEntry describes one entry written by writeTestTarball.
+type testTarEntry struct {
+	name     string
+	typeflag byte
+	linkname string
+	content  string
+}
+
+// writeTestTarball builds a gzipped tarball with arbitrary (possibly malicious) entries.
+func writeTestTarball(t *testing.T, tarballPath string, entries []testTarEntry) {
+	t.Helper()
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Typeflag: e.typeflag, Linkname: e.linkname, Mode: 0644}
+		switch e.typeflag {
+		case tar.TypeReg:
+			hdr.Size = int64(len(e.content))
+		case tar.TypeDir:
+			hdr.Mode = 0755
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("Failed to write tar header for %s: %v", e.name, err)
+		}
+		if e.typeflag == tar.TypeReg {
+			if _, err := tw.Write([]byte(e.content)); err != nil {
+				t.Fatalf("Failed to write tar content for %s: %v", e.name, err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Failed to close tar writer: %v", err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatalf("Failed to close gzip writer: %v", err)
+	}
+	if err := os.WriteFile(tarballPath, buf.Bytes(), common.FileMode0644); err != nil {
+		t.Fatalf("Failed to write tarball %s: %v", tarballPath, err)
+	}
+}
+
+func TestUntarRejectsUnsafeEntries(t *testing.T) {
+	safeFile := testTarEntry{name: "safe.txt", typeflag: tar.TypeReg, content: "safe"}
+
+	tests := []struct {
+		name    string
+		entries []testTarEntry
+	}{
+		{"absolute path", []testTarEntry{{name: "/tmp/evil.txt", typeflag: tar.TypeReg, content: "x"}}},
+		{"parent traversal", []testTarEntry{{name: "../evil.txt", typeflag: tar.TypeReg, content: "x"}}},
+		{"nested traversal", []testTarEntry{{name: "a/../../evil.txt", typeflag: tar.TypeReg, content: "x"}}},
+		{"absolute symlink target", []testTarEntry{{name: "link", typeflag: tar.TypeSymlink, linkname: "/etc/passwd"}}},
+		{"escaping symlink target", []testTarEntry{{name: "a/link", typeflag: tar.TypeSymlink, linkname: "../../outside"}}},
+		{"symlink through symlinked parent", []testTarEntry{
+			{name: "a/b/up", typeflag: tar.TypeSymlink, linkname: "../.."},
+			{name: "a/b/up/link", typeflag: tar.TypeSymlink, linkname: "../secret"},
+		}},
+		{"symlink redirected by later symlink", []testTarEntry{
+			{name: "a", typeflag: tar.TypeSymlink, linkname: "b/../secret"},
+			{name: "b", typeflag: tar.TypeSymlink, linkname: "."},
+		}},
+		{"escaping hard link", []testTarEntry{{name: "hard", typeflag: tar.TypeLink, linkname: "../secret"}}},
+		{"fifo", []testTarEntry{{name: "pipe", typeflag: tar.TypeFifo}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			workDir := createTestDir(t)
+			defer os.RemoveAll(workDir)
+			createTestFile(t, workDir, "secret", []byte("do not touch"))
+			dstDir := filepath.Join(workDir, "dst")
+			tarballPath := filepath.Join(workDir, "evil.tar.gz")
+
+			writeTestTarball(t, tarballPath, append([]testTarEntry{safeFile}, tt.entries...))
+
+			err := Untar(tarballPath, dstDir)
+			if !errors.Is(err, ErrUnsafeTarEntry) {
+				t.Fatalf("Untar() error = %v, want ErrUnsafeTarEntry", err)
+			}
+			if _, statErr := os.Stat(filepath.Join(workDir, "evil.txt")); !os.IsNotExist(statErr) {
+				t.Errorf("Untar() wrote outside the destination directory")
+			}
+
+			// Non-strict mode skips the offending entries but still extracts the safe ones.
+			lenientDst := filepath.Join(workDir, "lenient")
+			opts := DefaultUntarOptions()
+			opts.Strict = false
+			if err := UntarWithOptions(tarballPath, lenientDst, opts); err != nil {
+				t.Fatalf("UntarWithOptions(non-strict) error = %v", err)
+			}
+			verifyFileContent(t, filepath.Join(lenientDst, "safe.txt"), "safe")
+			verifyFileContent(t, filepath.Join(workDir, "secret"), "do not touch")
+			resolvedDst, err := filepath.EvalSymlinks(lenientDst)
+			if err != nil {
+				t.Fatalf("EvalSymlinks(%s) error = %v", lenientDst, err)
+			}
+			for _, e := range tt.entries {
+				if e.typeflag != tar.TypeSymlink {
+					continue
+				}
+				if resolved, err := filepath.EvalSymlinks(filepath.Join(lenientDst, e.name)); err == nil {
+					if !strings.HasPrefix(resolved, resolvedDst) {
+						t.Errorf("symlink %s resolves outside the destination: %s", e.name, resolved)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestUntarAllowsContainedLinks(t *testing.T) {
+	workDir := createTestDir(t)
+	defer os.RemoveAll(workDir)
+	tarballPath := filepath.Join(workDir, "links.tar.gz")
+	dstDir := filepath.Join(workDir, "dst")
+
+	writeTestTarball(t, tarballPath, []testTarEntry{
+		{name: "./", typeflag: tar.TypeDir},
+		{name: "bin/", typeflag: tar.TypeDir},
+		{name: "bin/kubelet-1.30", typeflag: tar.TypeReg, content: "binary"},
+		{name: "bin/kubelet", typeflag: tar.TypeSymlink, linkname: "kubelet-1.30"},
+		{name: "current", typeflag: tar.TypeSymlink, linkname: "bin"},
+		{name: "bin/kubelet.hard", typeflag: tar.TypeLink, linkname: "bin/kubelet-1.30"},
+	})
+
+	if err := Untar(tarballPath, dstDir); err != nil {
+		t.Fatalf("Untar() error = %v", err)
+	}
+	verifyFileContent(t, filepath.Join(dstDir, "current", "kubelet"), "binary")
+	verifyFileContent(t, filepath.Join(dstDir, "bin", "kubelet.hard"), "binary")
+	verifyIsSymlinkTo(t, filepath.Join(dstDir, "bin", "kubelet"), "kubelet-1.30")
+}
+
+func TestUntarLimits(t *testing.T) {
+	workDir := createTestDir(t)
+	defer os.RemoveAll(workDir)
+	tarballPath := filepath.Join(workDir, "big.tar.gz")
+
+	writeTestTarball(t, tarballPath, []testTarEntry{
+		{name: "one.txt", typeflag: tar.TypeReg, content: "0123456789"},
+		{name: "two.txt", typeflag: tar.TypeReg, content: "0123456789"},
+	})
+
+	opts := DefaultUntarOptions()
+	opts.MaxFiles = 1
+	if err := UntarWithOptions(tarballPath, filepath.Join(workDir, "files"), opts); !errors.Is(err, ErrUntarLimitExceeded) {
+		t.Errorf("UntarWithOptions(MaxFiles=1) error = %v, want ErrUntarLimitExceeded", err)
+	}
+
+	opts = DefaultUntarOptions()
+	opts.MaxTotalSize = 15
+	if err := UntarWithOptions(tarballPath, filepath.Join(workDir, "size"), opts); !errors.Is(err, ErrUntarLimitExceeded) {
+		t.Errorf("UntarWithOptions(MaxTotalSize=15) error = %v, want ErrUntarLimitExceeded", err)
+	}
+
+	opts.MaxTotalSize = 20
+	if err := UntarWithOptions(tarballPath, filepath.Join(workDir, "ok"), opts); err != nil {
+		t.Errorf("UntarWithOptions(MaxTotalSize=20) error = %v", err)
+	}
+}
+
 // Helper for Tar/Untar tests
 func verifyFileContent(t *testing.T, filePath, expectedContent string) {
 	t.Helper()
@@ -0,0 +1,202 @@
+package inventory
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const ec2APIVersion = "2016-11-15"
+
+// AWSConfig reads running EC2 instances carrying a tag. Instances are named
+// by their Name tag. Credentials come from the standard AWS_* environment
+// variables.
+type AWSConfig struct {
+	Region string `yaml:"region,omitempty" json:"region,omitempty"`
+	// TagKey and TagValue select the cluster's instances.
+	TagKey   string `yaml:"tagKey,omitempty" json:"tagKey,omitempty"`
+	TagValue string `yaml:"tagValue,omitempty" json:"tagValue,omitempty"`
+	// Endpoint overrides the regional EC2 endpoint.
+	Endpoint string `yaml:"endpoint,omitempty" json:"endpoint,omitempty"`
+}
+
+// SetDefaults fills unset fields from the environment.
+func (c *AWSConfig) SetDefaults() {
+	if c.Region == "" {
+		c.Region = os.Getenv("AWS_REGION")
+	}
+	if c.Region == "" {
+		c.Region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if c.Endpoint == "" && c.Region != "" {
+		c.Endpoint = "https://ec2." + c.Region + ".amazonaws.com"
+	}
+}
+
+// Validate checks the settings.
+func (c *AWSConfig) Validate() error {
+	if c == nil || c.Region == "" {
+		return errors.New("aws.region must be set")
+	}
+	if c.TagKey == "" || c.TagValue == "" {
+		return errors.New("aws.tagKey and aws.tagValue must be set")
+	}
+	return nil
+}
+
+type aws struct {
+	cfg    AWSConfig
+	client *http.Client
+	now    func() time.Time
+}
+
+type ec2Response struct {
+	Reservations []struct {
+		Instances []struct {
+			PrivateIP string `xml:"privateIpAddress"`
+			PublicIP  string `xml:"ipAddress"`
+			Tags      []struct {
+				Key   string `xml:"key"`
+				Value string `xml:"value"`
+			} `xml:"tagSet>item"`
+		} `xml:"instancesSet>item"`
+	} `xml:"reservationSet>item"`
+	NextToken string `xml:"nextToken"`
+}
+
+type ec2Error struct {
+	Errors []struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	} `xml:"Errors>Error"`
+}
+
+func (a *aws) Addresses(ctx context.Context) (map[string]Address, error) {
+	accessKey, secretKey := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if accessKey == "" || secretKey == "" {
+		return nil, errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+	machines := make(map[string]Address)
+	next := ""
+	for {
+		q := url.Values{
+			"Action":           {"DescribeInstances"},
+			"Version":          {ec2APIVersion},
+			"Filter.1.Name":    {"tag:" + a.cfg.TagKey},
+			"Filter.1.Value.1": {a.cfg.TagValue},
+			"Filter.2.Name":    {"instance-state-name"},
+			"Filter.2.Value.1": {"running"},
+		}
+		if next != "" {
+			q.Set("NextToken", next)
+		}
+		var resp ec2Response
+		if err := a.call(ctx, q, accessKey, secretKey, &resp); err != nil {
+			return nil, err
+		}
+		for _, r := range resp.Reservations {
+			for _, inst := range r.Instances {
+				for _, t := range inst.Tags {
+					if t.Key == "Name" && t.Value != "" {
+						machines[t.Value] = Address{Public: inst.PublicIP, Private: inst.PrivateIP}
+					}
+				}
+			}
+		}
+		if next = resp.NextToken; next == "" {
+			return machines, nil
+		}
+	}
+}
+
+func (a *aws) call(ctx context.Context, q url.Values, accessKey, secretKey string, out interface{}) error {
+	endpoint, err := url.Parse(a.cfg.Endpoint)
+	if err != nil {
+		return fmt.Errorf("invalid EC2 endpoint: %w", err)
+	}
+	endpoint.Path = "/"
+	endpoint.RawQuery = strings.ReplaceAll(q.Encode(), "+", "%20")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint.String(), nil)
+	if err != nil {
+		return err
+	}
+	signV4(req, a.cfg.Region, "ec2", accessKey, secretKey, os.Getenv("AWS_SESSION_TOKEN"), a.now().UTC())
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("EC2 DescribeInstances: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("EC2 DescribeInstances: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		var e ec2Error
+		if xml.Unmarshal(body, &e) == nil && len(e.Errors) > 0 {
+			return fmt.Errorf("EC2 DescribeInstances: %s: %s", e.Errors[0].Code, e.Errors[0].Message)
+		}
+		return fmt.Errorf("EC2 DescribeInstances: status %d", resp.StatusCode)
+	}
+	if err := xml.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("EC2 DescribeInstances: failed to parse response: %w", err)
+	}
+	return nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+// signV4 signs a bodiless request with AWS Signature Version 4.
+func signV4(req *http.Request, region, service, accessKey, secretKey, sessionToken string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	if sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host, "x-amz-date": amzDate}
+	signed := []string{"host", "x-amz-date"}
+	if sessionToken != "" {
+		headers["x-amz-security-token"] = sessionToken
+		signed = append(signed, "x-amz-security-token")
+	}
+	var canonicalHeaders strings.Builder
+	for _, h := range signed {
+		canonicalHeaders.WriteString(h + ":" + headers[h] + "\n")
+	}
+	signedHeaders := strings.Join(signed, ";")
+	canonicalRequest := strings.Join([]string{
+		req.Method, "/", req.URL.RawQuery, canonicalHeaders.String(), signedHeaders, sha256Hex(""),
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex(canonicalRequest)
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
@@ -0,0 +1,113 @@
+// Package inventory resolves host addresses from an external source at run
+// time, so a cluster configuration can name its hosts and leave the addresses
+// to Terraform state or a cloud API instead of hardcoding IPs.
+package inventory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Providers supported by Config.Provider.
+const (
+	ProviderTerraform = "terraform"
+	ProviderAWS       = "aws"
+	ProviderOpenStack = "openstack"
+)
+
+const requestTimeout = 30 * time.Second
+
+// Address is what a provider knows about one machine.
+type Address struct {
+	// Public is the address reachable from outside the network, if any.
+	Public string
+	// Private is the address on the machines' network.
+	Private string
+}
+
+// Provider resolves machine addresses keyed by machine name, which is matched
+// against the host names of the configuration.
+type Provider interface {
+	Addresses(ctx context.Context) (map[string]Address, error)
+}
+
+// Config selects and configures the provider.
+type Config struct {
+	Provider string `yaml:"provider" json:"provider"`
+	// UsePrivateAddress connects to the private address even when a public
+	// one exists, for running from inside the machines' network.
+	UsePrivateAddress bool             `yaml:"usePrivateAddress,omitempty" json:"usePrivateAddress,omitempty"`
+	Terraform         *TerraformConfig `yaml:"terraform,omitempty" json:"terraform,omitempty"`
+	AWS               *AWSConfig       `yaml:"aws,omitempty" json:"aws,omitempty"`
+	OpenStack         *OpenStackConfig `yaml:"openstack,omitempty" json:"openstack,omitempty"`
+}
+
+// SetDefaults fills unset fields.
+func (c *Config) SetDefaults() {
+	switch c.Provider {
+	case ProviderTerraform:
+		if c.Terraform == nil {
+			c.Terraform = &TerraformConfig{}
+		}
+		c.Terraform.SetDefaults()
+	case ProviderAWS:
+		if c.AWS == nil {
+			c.AWS = &AWSConfig{}
+		}
+		c.AWS.SetDefaults()
+	case ProviderOpenStack:
+		if c.OpenStack == nil {
+			c.OpenStack = &OpenStackConfig{}
+		}
+		c.OpenStack.SetDefaults()
+	}
+}
+
+// Validate checks the provider settings.
+func (c *Config) Validate() error {
+	switch c.Provider {
+	case ProviderTerraform:
+		return c.Terraform.Validate()
+	case ProviderAWS:
+		return c.AWS.Validate()
+	case ProviderOpenStack:
+		return c.OpenStack.Validate()
+	case "":
+		return errors.New("provider must be set")
+	default:
+		return fmt.Errorf("unsupported provider %q (want %s, %s or %s)", c.Provider, ProviderTerraform, ProviderAWS, ProviderOpenStack)
+	}
+}
+
+// New returns the configured provider. client is used for the cloud APIs and
+// defaults to an HTTP client with a request timeout.
+func New(cfg Config, client *http.Client) (Provider, error) {
+	if client == nil {
+		client = &http.Client{Timeout: requestTimeout}
+	}
+	switch cfg.Provider {
+	case ProviderTerraform:
+		return &terraform{cfg: *cfg.Terraform}, nil
+	case ProviderAWS:
+		return &aws{cfg: *cfg.AWS, client: client, now: time.Now}, nil
+	case ProviderOpenStack:
+		return &openStack{cfg: *cfg.OpenStack, client: client}, nil
+	default:
+		return nil, fmt.Errorf("unsupported inventory provider %q", cfg.Provider)
+	}
+}
+
+// Select returns the address to connect to and the internal address.
+func (c *Config) Select(a Address) (address, internal string) {
+	internal = a.Private
+	if internal == "" {
+		internal = a.Public
+	}
+	if c.UsePrivateAddress || a.Public == "" {
+		return internal, internal
+	}
+	return a.Public, internal
+}
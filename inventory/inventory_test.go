@@ -0,0 +1,152 @@
+package inventory
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const tfStateFixture = `{
+  "version": 4,
+  "resources": [
+    {"mode": "managed", "type": "aws_instance", "name": "master", "instances": [
+      {"attributes": {"tags": {"Name": "master1"}, "public_ip": "54.1.1.1", "private_ip": "10.0.0.1"}}
+    ]},
+    {"mode": "managed", "type": "openstack_compute_instance_v2", "name": "worker", "instances": [
+      {"attributes": {"name": "worker1", "access_ip_v4": "172.24.4.10", "network": [{"fixed_ip_v4": "192.168.1.10"}]}},
+      {"attributes": {"name": "worker2", "access_ip_v4": "192.168.1.11", "network": [{"fixed_ip_v4": "192.168.1.11"}]}}
+    ]},
+    {"mode": "data", "type": "aws_instance", "name": "other", "instances": [
+      {"attributes": {"tags": {"Name": "ignored"}, "private_ip": "10.0.0.9"}}
+    ]},
+    {"mode": "managed", "type": "aws_security_group", "name": "sg", "instances": [{"attributes": {"name": "sg"}}]}
+  ]
+}`
+
+func TestTerraform(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "terraform.tfstate")
+	require.NoError(t, os.WriteFile(path, []byte(tfStateFixture), 0600))
+	cfg := Config{Provider: ProviderTerraform, Terraform: &TerraformConfig{StateFile: path}}
+	cfg.SetDefaults()
+	require.NoError(t, cfg.Validate())
+	p, err := New(cfg, nil)
+	require.NoError(t, err)
+
+	machines, err := p.Addresses(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, map[string]Address{
+		"master1": {Public: "54.1.1.1", Private: "10.0.0.1"},
+		"worker1": {Public: "172.24.4.10", Private: "192.168.1.10"},
+		"worker2": {Private: "192.168.1.11"},
+	}, machines)
+
+	address, internal := cfg.Select(machines["master1"])
+	assert.Equal(t, "54.1.1.1", address)
+	assert.Equal(t, "10.0.0.1", internal)
+	cfg.UsePrivateAddress = true
+	address, _ = cfg.Select(machines["master1"])
+	assert.Equal(t, "10.0.0.1", address)
+
+	_, err = parseTerraformState([]byte(`{"version": 3}`))
+	assert.ErrorContains(t, err, "unsupported terraform state version 3")
+}
+
+func TestAWS(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_SESSION_TOKEN", "")
+	var calls int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		assert.Equal(t, "DescribeInstances", r.URL.Query().Get("Action"))
+		assert.Equal(t, "tag:kubernetes.io/cluster", r.URL.Query().Get("Filter.1.Name"))
+		assert.Equal(t, "demo", r.URL.Query().Get("Filter.1.Value.1"))
+		assert.True(t, strings.HasPrefix(r.Header.Get("Authorization"),
+			"AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20240102/eu-west-1/ec2/aws4_request, SignedHeaders=host;x-amz-date, Signature="))
+		if r.URL.Query().Get("NextToken") == "" {
+			_, _ = w.Write([]byte(`<DescribeInstancesResponse><reservationSet><item><instancesSet><item>
+				<privateIpAddress>10.0.0.1</privateIpAddress><ipAddress>54.1.1.1</ipAddress>
+				<tagSet><item><key>Name</key><value>master1</value></item></tagSet>
+			</item></instancesSet></item></reservationSet><nextToken>page2</nextToken></DescribeInstancesResponse>`))
+			return
+		}
+		_, _ = w.Write([]byte(`<DescribeInstancesResponse><reservationSet><item><instancesSet><item>
+			<privateIpAddress>10.0.0.2</privateIpAddress>
+			<tagSet><item><key>Name</key><value>worker1</value></item></tagSet>
+		</item></instancesSet></item></reservationSet></DescribeInstancesResponse>`))
+	}))
+	defer srv.Close()
+
+	cfg := Config{Provider: ProviderAWS, AWS: &AWSConfig{Region: "eu-west-1", TagKey: "kubernetes.io/cluster", TagValue: "demo", Endpoint: srv.URL}}
+	cfg.SetDefaults()
+	require.NoError(t, cfg.Validate())
+	p := &aws{cfg: *cfg.AWS, client: srv.Client(), now: func() time.Time { return time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC) }}
+	machines, err := p.Addresses(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 2, calls)
+	assert.Equal(t, map[string]Address{
+		"master1": {Public: "54.1.1.1", Private: "10.0.0.1"},
+		"worker1": {Private: "10.0.0.2"},
+	}, machines)
+
+	assert.ErrorContains(t, (&Config{Provider: ProviderAWS, AWS: &AWSConfig{Region: "x"}}).Validate(), "tagKey")
+}
+
+func TestSignV4(t *testing.T) {
+	// Request and signature from the AWS Signature Version 4 test suite
+	// (get-vanilla-query-order-key-case); callers pass the query sorted.
+	req := httptest.NewRequest(http.MethodGet, "https://example.amazonaws.com/?Param1=value1&Param2=value2", nil)
+	signV4(req, "us-east-1", "service", "AKIDEXAMPLE", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", "",
+		time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+	assert.Equal(t, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, "+
+		"SignedHeaders=host;x-amz-date, Signature=b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500",
+		req.Header.Get("Authorization"))
+}
+
+func TestOpenStack(t *testing.T) {
+	t.Setenv("OS_PASSWORD", "pw")
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v3/auth/tokens":
+			var body map[string]interface{}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+			w.Header().Set("X-Subject-Token", "tok")
+			w.WriteHeader(http.StatusCreated)
+			_, _ = w.Write([]byte(`{"token":{"catalog":[{"type":"compute","endpoints":[
+				{"interface":"internal","region":"RegionOne","url":"http://internal"},
+				{"interface":"public","region":"RegionOne","url":"` + srv.URL + `/compute/v2.1/"}]}]}}`))
+		case "/compute/v2.1/servers/detail":
+			assert.Equal(t, "tok", r.Header.Get("X-Auth-Token"))
+			_, _ = w.Write([]byte(`{"servers":[
+				{"name":"master1","metadata":{"cluster":"demo"},"addresses":{"private":[
+					{"addr":"fd00::1","version":6,"OS-EXT-IPS:type":"fixed"},
+					{"addr":"192.168.1.10","version":4,"OS-EXT-IPS:type":"fixed"},
+					{"addr":"172.24.4.10","version":4,"OS-EXT-IPS:type":"floating"}]}},
+				{"name":"other","metadata":{"cluster":"prod"},"addresses":{"private":[{"addr":"192.168.1.99","version":4}]}}]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	cfg := Config{Provider: ProviderOpenStack, OpenStack: &OpenStackConfig{
+		AuthURL: srv.URL, Region: "RegionOne", Username: "admin", ProjectName: "demo", Metadata: map[string]string{"cluster": "demo"},
+	}}
+	cfg.SetDefaults()
+	require.NoError(t, cfg.Validate())
+	p, err := New(cfg, srv.Client())
+	require.NoError(t, err)
+	machines, err := p.Addresses(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, map[string]Address{"master1": {Public: "172.24.4.10", Private: "192.168.1.10"}}, machines)
+}
@@ -0,0 +1,209 @@
+package inventory
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+// OpenStackConfig reads servers from Nova. Unset credentials are taken from
+// the standard OS_* environment variables of an openrc file.
+type OpenStackConfig struct {
+	AuthURL       string `yaml:"authURL,omitempty" json:"authURL,omitempty"`
+	Region        string `yaml:"region,omitempty" json:"region,omitempty"`
+	Username      string `yaml:"username,omitempty" json:"username,omitempty"`
+	ProjectName   string `yaml:"projectName,omitempty" json:"projectName,omitempty"`
+	UserDomain    string `yaml:"userDomain,omitempty" json:"userDomain,omitempty"`
+	ProjectDomain string `yaml:"projectDomain,omitempty" json:"projectDomain,omitempty"`
+	// Metadata selects the servers carrying all of these metadata items.
+	Metadata map[string]string `yaml:"metadata,omitempty" json:"metadata,omitempty"`
+}
+
+// SetDefaults fills unset fields from the environment.
+func (c *OpenStackConfig) SetDefaults() {
+	for _, f := range []struct {
+		field *string
+		env   string
+	}{
+		{&c.AuthURL, "OS_AUTH_URL"},
+		{&c.Region, "OS_REGION_NAME"},
+		{&c.Username, "OS_USERNAME"},
+		{&c.ProjectName, "OS_PROJECT_NAME"},
+		{&c.UserDomain, "OS_USER_DOMAIN_NAME"},
+		{&c.ProjectDomain, "OS_PROJECT_DOMAIN_NAME"},
+	} {
+		if *f.field == "" {
+			*f.field = os.Getenv(f.env)
+		}
+	}
+	if c.UserDomain == "" {
+		c.UserDomain = "Default"
+	}
+	if c.ProjectDomain == "" {
+		c.ProjectDomain = "Default"
+	}
+}
+
+// Validate checks the settings.
+func (c *OpenStackConfig) Validate() error {
+	if c == nil || c.AuthURL == "" {
+		return errors.New("openstack.authURL must be set")
+	}
+	if c.Username == "" || c.ProjectName == "" {
+		return errors.New("openstack.username and openstack.projectName must be set")
+	}
+	return nil
+}
+
+type openStack struct {
+	cfg    OpenStackConfig
+	client *http.Client
+}
+
+type osCatalog []struct {
+	Type      string `json:"type"`
+	Endpoints []struct {
+		Interface string `json:"interface"`
+		Region    string `json:"region"`
+		URL       string `json:"url"`
+	} `json:"endpoints"`
+}
+
+type osServers struct {
+	Servers []struct {
+		Name      string            `json:"name"`
+		Metadata  map[string]string `json:"metadata"`
+		Addresses map[string][]struct {
+			Addr    string `json:"addr"`
+			Version int    `json:"version"`
+			Type    string `json:"OS-EXT-IPS:type"`
+		} `json:"addresses"`
+	} `json:"servers"`
+}
+
+// authenticate obtains a Keystone v3 token with the password from OS_PASSWORD
+// and returns it with the compute endpoint.
+func (o *openStack) authenticate(ctx context.Context) (token, compute string, err error) {
+	password := os.Getenv("OS_PASSWORD")
+	if password == "" {
+		return "", "", errors.New("OS_PASSWORD must be set")
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"auth": map[string]interface{}{
+			"identity": map[string]interface{}{
+				"methods": []string{"password"},
+				"password": map[string]interface{}{"user": map[string]interface{}{
+					"name": o.cfg.Username, "password": password, "domain": map[string]string{"name": o.cfg.UserDomain},
+				}},
+			},
+			"scope": map[string]interface{}{"project": map[string]interface{}{
+				"name": o.cfg.ProjectName, "domain": map[string]string{"name": o.cfg.ProjectDomain},
+			}},
+		},
+	})
+	if err != nil {
+		return "", "", err
+	}
+	url := strings.TrimSuffix(o.cfg.AuthURL, "/")
+	if !strings.HasSuffix(url, "/v3") {
+		url += "/v3"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url+"/auth/tokens", bytes.NewReader(body))
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return "", "", fmt.Errorf("keystone authentication: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return "", "", fmt.Errorf("keystone authentication: status %d", resp.StatusCode)
+	}
+	var out struct {
+		Token struct {
+			Catalog osCatalog `json:"catalog"`
+		} `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return "", "", fmt.Errorf("keystone authentication: failed to parse response: %w", err)
+	}
+	for _, svc := range out.Token.Catalog {
+		if svc.Type != "compute" {
+			continue
+		}
+		for _, ep := range svc.Endpoints {
+			if ep.Interface == "public" && (o.cfg.Region == "" || ep.Region == o.cfg.Region) {
+				return resp.Header.Get("X-Subject-Token"), strings.TrimSuffix(ep.URL, "/"), nil
+			}
+		}
+	}
+	return "", "", fmt.Errorf("no public compute endpoint in region %q", o.cfg.Region)
+}
+
+func (o *openStack) Addresses(ctx context.Context) (map[string]Address, error) {
+	token, compute, err := o.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, compute+"/servers/detail", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Auth-Token", token)
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("nova list servers: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("nova list servers: status %d", resp.StatusCode)
+	}
+	var list osServers
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("nova list servers: failed to parse response: %w", err)
+	}
+
+	machines := make(map[string]Address)
+	for _, s := range list.Servers {
+		if !matches(s.Metadata, o.cfg.Metadata) {
+			continue
+		}
+		// Networks are visited in name order so the choice is stable.
+		networks := make([]string, 0, len(s.Addresses))
+		for name := range s.Addresses {
+			networks = append(networks, name)
+		}
+		sort.Strings(networks)
+		var a Address
+		for _, network := range networks {
+			for _, addr := range s.Addresses[network] {
+				switch {
+				case addr.Version != 4:
+				case addr.Type == "floating" && a.Public == "":
+					a.Public = addr.Addr
+				case addr.Type != "floating" && a.Private == "":
+					a.Private = addr.Addr
+				}
+			}
+		}
+		machines[s.Name] = a
+	}
+	return machines, nil
+}
+
+func matches(have, want map[string]string) bool {
+	for k, v := range want {
+		if have[k] != v {
+			return false
+		}
+	}
+	return true
+}
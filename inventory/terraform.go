@@ -0,0 +1,117 @@
+package inventory
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// DefaultStateFile is the state file of a local Terraform backend.
+const DefaultStateFile = "terraform.tfstate"
+
+// TerraformConfig reads machines from a Terraform state file.
+type TerraformConfig struct {
+	StateFile string `yaml:"stateFile,omitempty" json:"stateFile,omitempty"`
+}
+
+// SetDefaults fills unset fields.
+func (c *TerraformConfig) SetDefaults() {
+	if c.StateFile == "" {
+		c.StateFile = DefaultStateFile
+	}
+}
+
+// Validate checks the settings.
+func (c *TerraformConfig) Validate() error {
+	if c == nil || c.StateFile == "" {
+		return errors.New("terraform.stateFile must be set")
+	}
+	return nil
+}
+
+type terraform struct {
+	cfg TerraformConfig
+}
+
+// tfState is the part of the state format (version 4) read here.
+type tfState struct {
+	Version   int `json:"version"`
+	Resources []struct {
+		Mode      string `json:"mode"`
+		Type      string `json:"type"`
+		Instances []struct {
+			Attributes map[string]interface{} `json:"attributes"`
+		} `json:"instances"`
+	} `json:"resources"`
+}
+
+// tfMachine extracts the name and addresses of a machine resource, per
+// resource type.
+var tfMachine = map[string]func(attrs map[string]interface{}) (string, Address){
+	"aws_instance": func(attrs map[string]interface{}) (string, Address) {
+		tags, _ := attrs["tags"].(map[string]interface{})
+		return str(tags["Name"]), Address{Public: str(attrs["public_ip"]), Private: str(attrs["private_ip"])}
+	},
+	"openstack_compute_instance_v2": func(attrs map[string]interface{}) (string, Address) {
+		// access_ip_v4 is the floating address when one is attached.
+		access := str(attrs["access_ip_v4"])
+		a := Address{Private: access}
+		if nets, ok := attrs["network"].([]interface{}); ok && len(nets) > 0 {
+			n, _ := nets[0].(map[string]interface{})
+			if fixed := str(n["fixed_ip_v4"]); fixed != "" && fixed != access {
+				a = Address{Public: access, Private: fixed}
+			}
+		}
+		return str(attrs["name"]), a
+	},
+	"google_compute_instance": func(attrs map[string]interface{}) (string, Address) {
+		var a Address
+		if nics, ok := attrs["network_interface"].([]interface{}); ok && len(nics) > 0 {
+			nic, _ := nics[0].(map[string]interface{})
+			a.Private = str(nic["network_ip"])
+			if acs, ok := nic["access_config"].([]interface{}); ok && len(acs) > 0 {
+				ac, _ := acs[0].(map[string]interface{})
+				a.Public = str(ac["nat_ip"])
+			}
+		}
+		return str(attrs["name"]), a
+	},
+}
+
+func str(v interface{}) string {
+	s, _ := v.(string)
+	return s
+}
+
+func (t *terraform) Addresses(ctx context.Context) (map[string]Address, error) {
+	data, err := os.ReadFile(t.cfg.StateFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read terraform state: %w", err)
+	}
+	return parseTerraformState(data)
+}
+
+func parseTerraformState(data []byte) (map[string]Address, error) {
+	var state tfState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse terraform state: %w", err)
+	}
+	if state.Version != 4 {
+		return nil, fmt.Errorf("unsupported terraform state version %d (want 4)", state.Version)
+	}
+	machines := make(map[string]Address)
+	for _, r := range state.Resources {
+		extract, ok := tfMachine[r.Type]
+		if r.Mode != "managed" || !ok {
+			continue
+		}
+		for _, inst := range r.Instances {
+			if name, addr := extract(inst.Attributes); name != "" {
+				machines[name] = addr
+			}
+		}
+	}
+	return machines, nil
+}
@@ -0,0 +1,187 @@
+package kube
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/mensylisir/xmcores/common"
+)
+
+// ApplyPatch is the content type of server-side apply requests.
+const ApplyPatch = "application/apply-patch+yaml"
+
+// Object is a decoded manifest document.
+type Object map[string]interface{}
+
+// APIVersion returns the apiVersion of the object.
+func (o Object) APIVersion() string {
+	s, _ := o["apiVersion"].(string)
+	return s
+}
+
+// Kind returns the kind of the object.
+func (o Object) Kind() string {
+	s, _ := o["kind"].(string)
+	return s
+}
+
+func (o Object) metadata() map[string]interface{} {
+	m, _ := o["metadata"].(map[string]interface{})
+	return m
+}
+
+// Name returns metadata.name.
+func (o Object) Name() string {
+	s, _ := o.metadata()["name"].(string)
+	return s
+}
+
+// Namespace returns metadata.namespace.
+func (o Object) Namespace() string {
+	s, _ := o.metadata()["namespace"].(string)
+	return s
+}
+
+// String identifies the object in messages, e.g. "Deployment kube-system/coredns".
+func (o Object) String() string {
+	if ns := o.Namespace(); ns != "" {
+		return o.Kind() + " " + ns + "/" + o.Name()
+	}
+	return o.Kind() + " " + o.Name()
+}
+
+// DecodeManifest splits a multi-document YAML manifest into objects. Empty
+// documents are skipped and List kinds are flattened.
+func DecodeManifest(data []byte) ([]Object, error) {
+	var objs []Object
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	for i := 0; ; i++ {
+		// Decode into a plain map so nested mappings keep their generic type.
+		var doc map[string]interface{}
+		err := dec.Decode(&doc)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode manifest document %d: %w", i, err)
+		}
+		obj := Object(doc)
+		if len(obj) == 0 {
+			continue
+		}
+		if strings.HasSuffix(obj.Kind(), "List") {
+			items, _ := obj["items"].([]interface{})
+			for _, item := range items {
+				if m, ok := item.(map[string]interface{}); ok {
+					objs = append(objs, Object(m))
+				}
+			}
+			continue
+		}
+		if obj.APIVersion() == "" || obj.Kind() == "" || obj.Name() == "" {
+			return nil, fmt.Errorf("manifest document %d must set apiVersion, kind and metadata.name", i)
+		}
+		objs = append(objs, obj)
+	}
+	return objs, nil
+}
+
+// apiResource is an entry of the discovery document of a group version.
+type apiResource struct {
+	Name       string `json:"name"`
+	Kind       string `json:"kind"`
+	Namespaced bool   `json:"namespaced"`
+}
+
+// resourceFor resolves the resource name of kind in apiVersion through the
+// discovery API. Results are cached per group version; a miss refreshes the
+// cache once so kinds of freshly applied CRDs are found.
+func (c *Client) resourceFor(ctx context.Context, apiVersion, kind string) (apiResource, error) {
+	for attempt := 0; attempt < 2; attempt++ {
+		c.mu.Lock()
+		resources, ok := c.discovery[apiVersion]
+		c.mu.Unlock()
+		if !ok || attempt > 0 {
+			path := "/apis/" + apiVersion
+			if !strings.Contains(apiVersion, "/") {
+				path = "/api/" + apiVersion
+			}
+			var list struct {
+				Resources []apiResource `json:"resources"`
+			}
+			if err := c.Get(ctx, path, &list); err != nil && !IsNotFound(err) {
+				return apiResource{}, fmt.Errorf("failed to discover %s: %w", apiVersion, err)
+			}
+			resources = list.Resources
+			c.mu.Lock()
+			c.discovery[apiVersion] = resources
+			c.mu.Unlock()
+		}
+		for _, r := range resources {
+			if r.Kind == kind && !strings.Contains(r.Name, "/") {
+				return r, nil
+			}
+		}
+	}
+	return apiResource{}, fmt.Errorf("kind %s is not served by %s", kind, apiVersion)
+}
+
+// ObjectPath returns the API path of obj.
+func (c *Client) ObjectPath(ctx context.Context, obj Object) (string, error) {
+	res, err := c.resourceFor(ctx, obj.APIVersion(), obj.Kind())
+	if err != nil {
+		return "", err
+	}
+	prefix := "/apis/" + obj.APIVersion()
+	if !strings.Contains(obj.APIVersion(), "/") {
+		prefix = "/api/" + obj.APIVersion()
+	}
+	if res.Namespaced {
+		ns := obj.Namespace()
+		if ns == "" {
+			ns = "default"
+		}
+		prefix += "/namespaces/" + url.PathEscape(ns)
+	}
+	return prefix + "/" + res.Name + "/" + url.PathEscape(obj.Name()), nil
+}
+
+// ApplyObject creates or updates obj with server-side apply, taking ownership
+// of conflicting fields.
+func (c *Client) ApplyObject(ctx context.Context, obj Object) error {
+	path, err := c.ObjectPath(ctx, obj)
+	if err != nil {
+		return fmt.Errorf("%s: %w", obj, err)
+	}
+	body, err := json.Marshal(obj)
+	if err != nil {
+		return fmt.Errorf("%s: failed to encode: %w", obj, err)
+	}
+	query := "?fieldManager=" + common.AppName + "&force=true"
+	if err := c.Patch(ctx, path+query, ApplyPatch, body, nil); err != nil {
+		return fmt.Errorf("failed to apply %s: %w", obj, err)
+	}
+	return nil
+}
+
+// Apply applies every object of a multi-document manifest in order.
+func (c *Client) Apply(ctx context.Context, manifest []byte) error {
+	objs, err := DecodeManifest(manifest)
+	if err != nil {
+		return err
+	}
+	for _, obj := range objs {
+		if err := c.ApplyObject(ctx, obj); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package kube
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mensylisir/xmcores/catalog"
+)
+
+// apiChange records the Kubernetes minor versions that started and stopped
+// serving a kind in a group version. Empty versions are not checked.
+type apiChange struct {
+	apiVersion  string
+	kinds       []string
+	introduced  string
+	deprecated  string
+	removed     string
+	replacement string
+}
+
+// apiChanges lists the built-in APIs whose availability depends on the
+// Kubernetes version, after the upstream deprecation guide.
+var apiChanges = []apiChange{
+	{apiVersion: "extensions/v1beta1", kinds: []string{"Deployment", "DaemonSet", "ReplicaSet"}, deprecated: "1.9", removed: "1.16", replacement: "apps/v1"},
+	{apiVersion: "extensions/v1beta1", kinds: []string{"NetworkPolicy"}, deprecated: "1.9", removed: "1.16", replacement: "networking.k8s.io/v1"},
+	{apiVersion: "extensions/v1beta1", kinds: []string{"PodSecurityPolicy"}, deprecated: "1.10", removed: "1.16", replacement: "policy/v1beta1"},
+	{apiVersion: "apps/v1beta1", kinds: []string{"Deployment", "StatefulSet", "ReplicaSet"}, deprecated: "1.9", removed: "1.16", replacement: "apps/v1"},
+	{apiVersion: "apps/v1beta2", kinds: []string{"Deployment", "StatefulSet", "DaemonSet", "ReplicaSet"}, deprecated: "1.9", removed: "1.16", replacement: "apps/v1"},
+
+	{apiVersion: "extensions/v1beta1", kinds: []string{"Ingress"}, deprecated: "1.14", removed: "1.22", replacement: "networking.k8s.io/v1"},
+	{apiVersion: "networking.k8s.io/v1beta1", kinds: []string{"Ingress", "IngressClass"}, deprecated: "1.19", removed: "1.22", replacement: "networking.k8s.io/v1"},
+	{apiVersion: "networking.k8s.io/v1", kinds: []string{"Ingress", "IngressClass"}, introduced: "1.19"},
+	{apiVersion: "apiextensions.k8s.io/v1beta1", kinds: []string{"CustomResourceDefinition"}, deprecated: "1.16", removed: "1.22", replacement: "apiextensions.k8s.io/v1"},
+	{apiVersion: "apiregistration.k8s.io/v1beta1", kinds: []string{"APIService"}, deprecated: "1.19", removed: "1.22", replacement: "apiregistration.k8s.io/v1"},
+	{apiVersion: "admissionregistration.k8s.io/v1beta1", kinds: []string{"MutatingWebhookConfiguration", "ValidatingWebhookConfiguration"}, deprecated: "1.16", removed: "1.22", replacement: "admissionregistration.k8s.io/v1"},
+	{apiVersion: "rbac.authorization.k8s.io/v1beta1", kinds: []string{"ClusterRole", "ClusterRoleBinding", "Role", "RoleBinding"}, deprecated: "1.17", removed: "1.22", replacement: "rbac.authorization.k8s.io/v1"},
+	{apiVersion: "scheduling.k8s.io/v1beta1", kinds: []string{"PriorityClass"}, deprecated: "1.14", removed: "1.22", replacement: "scheduling.k8s.io/v1"},
+	{apiVersion: "storage.k8s.io/v1beta1", kinds: []string{"CSIDriver", "CSINode", "StorageClass", "VolumeAttachment"}, deprecated: "1.19", removed: "1.22", replacement: "storage.k8s.io/v1"},
+	{apiVersion: "coordination.k8s.io/v1beta1", kinds: []string{"Lease"}, deprecated: "1.19", removed: "1.22", replacement: "coordination.k8s.io/v1"},
+	{apiVersion: "certificates.k8s.io/v1beta1", kinds: []string{"CertificateSigningRequest"}, deprecated: "1.19", removed: "1.22", replacement: "certificates.k8s.io/v1"},
+
+	{apiVersion: "batch/v1beta1", kinds: []string{"CronJob"}, deprecated: "1.21", removed: "1.25", replacement: "batch/v1"},
+	{apiVersion: "batch/v1", kinds: []string{"CronJob"}, introduced: "1.21"},
+	{apiVersion: "discovery.k8s.io/v1beta1", kinds: []string{"EndpointSlice"}, deprecated: "1.21", removed: "1.25", replacement: "discovery.k8s.io/v1"},
+	{apiVersion: "discovery.k8s.io/v1", kinds: []string{"EndpointSlice"}, introduced: "1.21"},
+	{apiVersion: "events.k8s.io/v1beta1", kinds: []string{"Event"}, deprecated: "1.19", removed: "1.25", replacement: "events.k8s.io/v1"},
+	{apiVersion: "policy/v1beta1", kinds: []string{"PodDisruptionBudget"}, deprecated: "1.21", removed: "1.25", replacement: "policy/v1"},
+	{apiVersion: "policy/v1", kinds: []string{"PodDisruptionBudget"}, introduced: "1.21"},
+	{apiVersion: "policy/v1beta1", kinds: []string{"PodSecurityPolicy"}, deprecated: "1.21", removed: "1.25", replacement: "Pod Security Admission"},
+	{apiVersion: "node.k8s.io/v1beta1", kinds: []string{"RuntimeClass"}, deprecated: "1.22", removed: "1.25", replacement: "node.k8s.io/v1"},
+	{apiVersion: "node.k8s.io/v1", kinds: []string{"RuntimeClass"}, introduced: "1.20"},
+	{apiVersion: "autoscaling/v2beta1", kinds: []string{"HorizontalPodAutoscaler"}, deprecated: "1.22", removed: "1.25", replacement: "autoscaling/v2"},
+	{apiVersion: "autoscaling/v2beta2", kinds: []string{"HorizontalPodAutoscaler"}, deprecated: "1.23", removed: "1.26", replacement: "autoscaling/v2"},
+	{apiVersion: "autoscaling/v2", kinds: []string{"HorizontalPodAutoscaler"}, introduced: "1.23"},
+
+	{apiVersion: "flowcontrol.apiserver.k8s.io/v1beta1", kinds: []string{"FlowSchema", "PriorityLevelConfiguration"}, deprecated: "1.23", removed: "1.26", replacement: "flowcontrol.apiserver.k8s.io/v1"},
+	{apiVersion: "flowcontrol.apiserver.k8s.io/v1beta2", kinds: []string{"FlowSchema", "PriorityLevelConfiguration"}, deprecated: "1.26", removed: "1.29", replacement: "flowcontrol.apiserver.k8s.io/v1"},
+	{apiVersion: "flowcontrol.apiserver.k8s.io/v1beta3", kinds: []string{"FlowSchema", "PriorityLevelConfiguration"}, introduced: "1.26", deprecated: "1.29", removed: "1.32", replacement: "flowcontrol.apiserver.k8s.io/v1"},
+	{apiVersion: "flowcontrol.apiserver.k8s.io/v1", kinds: []string{"FlowSchema", "PriorityLevelConfiguration"}, introduced: "1.29"},
+	{apiVersion: "storage.k8s.io/v1beta1", kinds: []string{"CSIStorageCapacity"}, deprecated: "1.24", removed: "1.27", replacement: "storage.k8s.io/v1"},
+	{apiVersion: "storage.k8s.io/v1", kinds: []string{"CSIStorageCapacity"}, introduced: "1.24"},
+	{apiVersion: "admissionregistration.k8s.io/v1", kinds: []string{"ValidatingAdmissionPolicy", "ValidatingAdmissionPolicyBinding"}, introduced: "1.30"},
+}
+
+// requiresSelector lists the kinds of apps/v1 whose spec.selector became
+// mandatory; manifests converted from the older group versions often lack it.
+var requiresSelector = map[string]bool{"Deployment": true, "StatefulSet": true, "DaemonSet": true, "ReplicaSet": true}
+
+// Problem is an object that a Kubernetes version rejects, or still accepts
+// through an API that is deprecated.
+type Problem struct {
+	Object  string
+	Message string
+	// Deprecated is set when the version still serves the object.
+	Deprecated bool
+}
+
+func (p Problem) String() string {
+	return p.Object + ": " + p.Message
+}
+
+// CheckObjects checks objs against the built-in APIs of the Kubernetes
+// version: group versions it does not serve yet or no longer, deprecated
+// ones and required fields that older group versions did not require.
+func CheckObjects(objs []Object, version string) ([]Problem, error) {
+	v, err := catalog.ParseVersion(version)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Kubernetes version: %w", err)
+	}
+	var problems []Problem
+	for _, obj := range objs {
+		for _, c := range apiChanges {
+			if c.apiVersion != obj.APIVersion() || !contains(c.kinds, obj.Kind()) {
+				continue
+			}
+			switch {
+			case c.introduced != "" && before(v, c.introduced):
+				problems = append(problems, Problem{Object: obj.String(),
+					Message: fmt.Sprintf("%s is served from Kubernetes v%s, not by %s", c.apiVersion, c.introduced, v.MinorString())})
+			case c.removed != "" && !before(v, c.removed):
+				problems = append(problems, Problem{Object: obj.String(),
+					Message: fmt.Sprintf("%s was removed in Kubernetes v%s, use %s", c.apiVersion, c.removed, c.replacement)})
+			case c.deprecated != "" && !before(v, c.deprecated):
+				msg := fmt.Sprintf("%s is deprecated since Kubernetes v%s", c.apiVersion, c.deprecated)
+				if c.removed != "" {
+					msg += fmt.Sprintf(" and removed in v%s", c.removed)
+				}
+				problems = append(problems, Problem{Object: obj.String(), Message: msg + ", use " + c.replacement, Deprecated: true})
+			}
+		}
+		if obj.APIVersion() == "apps/v1" && requiresSelector[obj.Kind()] {
+			spec, _ := obj["spec"].(map[string]interface{})
+			if _, ok := spec["selector"].(map[string]interface{}); !ok {
+				problems = append(problems, Problem{Object: obj.String(), Message: "apps/v1 requires spec.selector"})
+			}
+		}
+	}
+	return problems, nil
+}
+
+// CheckManifest decodes a multi-document manifest and checks its objects for
+// the Kubernetes version (see CheckObjects). It fails when the version would
+// reject an object and returns the deprecations otherwise.
+func CheckManifest(manifest []byte, version string) ([]Problem, error) {
+	objs, err := DecodeManifest(manifest)
+	if err != nil {
+		return nil, err
+	}
+	problems, err := CheckObjects(objs, version)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		warnings []Problem
+		rejected []string
+	)
+	for _, p := range problems {
+		if p.Deprecated {
+			warnings = append(warnings, p)
+		} else {
+			rejected = append(rejected, p.String())
+		}
+	}
+	if len(rejected) > 0 {
+		return warnings, fmt.Errorf("the manifest does not suit Kubernetes %s:\n  %s", version, strings.Join(rejected, "\n  "))
+	}
+	return warnings, nil
+}
+
+// before reports whether v is older than the minor version minor, e.g. "1.25".
+func before(v catalog.Version, minor string) bool {
+	return v.Compare(catalog.MustParseVersion(minor)) < 0
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,358 @@
+// Package kube is the Kubernetes API client used by the post-install
+// modules. It talks to the apiserver directly with the credentials of the admin
+// kubeconfig, so nothing needs kubectl on the nodes or on the controller. The
+// transport and the typed clientset come from client-go; Do and its helpers
+// remain for manifests whose kinds are only known at run time.
+package kube
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	"github.com/mensylisir/xmcores/common"
+	"github.com/mensylisir/xmcores/connector"
+	"github.com/mensylisir/xmcores/modules"
+)
+
+// DefaultTimeout bounds a single API request.
+const DefaultTimeout = 30 * time.Second
+
+// Content types accepted by Patch.
+const (
+	MergePatch          = "application/merge-patch+json"
+	StrategicMergePatch = "application/strategic-merge-patch+json"
+	JSONPatch           = "application/json-patch+json"
+)
+
+// RESTConfig holds the apiserver address and the client credentials.
+type RESTConfig struct {
+	Server   string
+	CAData   []byte
+	CertData []byte
+	KeyData  []byte
+	Token    string
+	// Insecure skips verification of the apiserver certificate.
+	Insecure bool
+	Timeout  time.Duration
+}
+
+type kubeconfig struct {
+	CurrentContext string `yaml:"current-context"`
+	Clusters       []struct {
+		Name    string `yaml:"name"`
+		Cluster struct {
+			Server                   string `yaml:"server"`
+			CertificateAuthorityData string `yaml:"certificate-authority-data"`
+			CertificateAuthority     string `yaml:"certificate-authority"`
+			InsecureSkipTLSVerify    bool   `yaml:"insecure-skip-tls-verify"`
+		} `yaml:"cluster"`
+	} `yaml:"clusters"`
+	Contexts []struct {
+		Name    string `yaml:"name"`
+		Context struct {
+			Cluster string `yaml:"cluster"`
+			User    string `yaml:"user"`
+		} `yaml:"context"`
+	} `yaml:"contexts"`
+	Users []struct {
+		Name string `yaml:"name"`
+		User struct {
+			ClientCertificateData string `yaml:"client-certificate-data"`
+			ClientKeyData         string `yaml:"client-key-data"`
+			ClientCertificate     string `yaml:"client-certificate"`
+			ClientKey             string `yaml:"client-key"`
+			Token                 string `yaml:"token"`
+		} `yaml:"user"`
+	} `yaml:"users"`
+}
+
+// ParseKubeconfig extracts the current context of a kubeconfig. Embedded and
+// file-referenced certificates are both supported.
+func ParseKubeconfig(data []byte) (RESTConfig, error) {
+	var kc kubeconfig
+	if err := yaml.Unmarshal(data, &kc); err != nil {
+		return RESTConfig{}, fmt.Errorf("failed to parse kubeconfig: %w", err)
+	}
+	ctxName := kc.CurrentContext
+	if ctxName == "" && len(kc.Contexts) == 1 {
+		ctxName = kc.Contexts[0].Name
+	}
+	var clusterName, userName string
+	found := false
+	for _, c := range kc.Contexts {
+		if c.Name == ctxName {
+			clusterName, userName, found = c.Context.Cluster, c.Context.User, true
+			break
+		}
+	}
+	if !found {
+		return RESTConfig{}, fmt.Errorf("kubeconfig context %q not found", ctxName)
+	}
+
+	var cfg RESTConfig
+	found = false
+	for _, c := range kc.Clusters {
+		if c.Name != clusterName {
+			continue
+		}
+		found = true
+		cfg.Server = c.Cluster.Server
+		cfg.Insecure = c.Cluster.InsecureSkipTLSVerify
+		var err error
+		if cfg.CAData, err = dataOrFile(c.Cluster.CertificateAuthorityData, c.Cluster.CertificateAuthority); err != nil {
+			return RESTConfig{}, fmt.Errorf("cluster %s: %w", clusterName, err)
+		}
+	}
+	if !found {
+		return RESTConfig{}, fmt.Errorf("kubeconfig cluster %q not found", clusterName)
+	}
+	for _, u := range kc.Users {
+		if u.Name != userName {
+			continue
+		}
+		var err error
+		if cfg.CertData, err = dataOrFile(u.User.ClientCertificateData, u.User.ClientCertificate); err != nil {
+			return RESTConfig{}, fmt.Errorf("user %s: %w", userName, err)
+		}
+		if cfg.KeyData, err = dataOrFile(u.User.ClientKeyData, u.User.ClientKey); err != nil {
+			return RESTConfig{}, fmt.Errorf("user %s: %w", userName, err)
+		}
+		cfg.Token = u.User.Token
+	}
+	if cfg.Server == "" {
+		return RESTConfig{}, errors.New("kubeconfig has no server address")
+	}
+	return cfg, nil
+}
+
+func dataOrFile(b64, path string) ([]byte, error) {
+	if b64 != "" {
+		data, err := base64.StdEncoding.DecodeString(b64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid base64 data: %w", err)
+		}
+		return data, nil
+	}
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return data, nil
+}
+
+// Client sends requests to the apiserver.
+type Client struct {
+	server    string
+	http      *http.Client
+	clientset kubernetes.Interface
+
+	mu        sync.Mutex
+	discovery map[string][]apiResource
+}
+
+// NewClient creates a client from cfg.
+func NewClient(cfg RESTConfig) (*Client, error) {
+	if len(cfg.CAData) > 0 && !x509.NewCertPool().AppendCertsFromPEM(cfg.CAData) {
+		return nil, errors.New("no valid certificates in the apiserver CA data")
+	}
+	timeout := cfg.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	rc := &rest.Config{
+		Host:        strings.TrimSuffix(cfg.Server, "/"),
+		BearerToken: cfg.Token,
+		UserAgent:   common.AppName,
+		Timeout:     timeout,
+		TLSClientConfig: rest.TLSClientConfig{
+			Insecure: cfg.Insecure,
+			CertData: cfg.CertData,
+			KeyData:  cfg.KeyData,
+		},
+	}
+	// client-go refuses a CA together with Insecure.
+	if !cfg.Insecure {
+		rc.TLSClientConfig.CAData = cfg.CAData
+	}
+	httpClient, err := rest.HTTPClientFor(rc)
+	if err != nil {
+		return nil, fmt.Errorf("invalid apiserver client configuration: %w", err)
+	}
+	clientset, err := kubernetes.NewForConfigAndClient(rc, httpClient)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the Kubernetes clientset: %w", err)
+	}
+	return &Client{
+		server:    rc.Host,
+		http:      httpClient,
+		clientset: clientset,
+		discovery: make(map[string][]apiResource),
+	}, nil
+}
+
+// Clientset returns the typed client-go clientset sharing the connection of c.
+func (c *Client) Clientset() kubernetes.Interface {
+	return c.clientset
+}
+
+// NewClientFromKubeconfig parses data and creates a client from it.
+func NewClientFromKubeconfig(data []byte) (*Client, error) {
+	cfg, err := ParseKubeconfig(data)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(cfg)
+}
+
+// FetchAdminKubeconfig reads the admin kubeconfig from a control-plane node.
+func FetchAdminKubeconfig(ctx context.Context, exec connector.Executor) ([]byte, error) {
+	out, err := modules.Run(ctx, exec, "cat "+modules.AdminKubeconfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch admin kubeconfig: %w", err)
+	}
+	return []byte(out), nil
+}
+
+// NewClientForNode creates a client from the admin kubeconfig of a
+// control-plane node. A non-empty server replaces the address in the
+// kubeconfig, for when the controller cannot reach the configured endpoint.
+func NewClientForNode(ctx context.Context, node modules.Node, server string) (*Client, error) {
+	data, err := FetchAdminKubeconfig(ctx, node.Conn)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", node.Name(), err)
+	}
+	cfg, err := ParseKubeconfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", node.Name(), err)
+	}
+	if server != "" {
+		cfg.Server = server
+	}
+	return NewClient(cfg)
+}
+
+// StatusError is returned for responses with a status code of 400 or above.
+type StatusError struct {
+	Code    int
+	Reason  string
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("apiserver returned %d %s: %s", e.Code, e.Reason, e.Message)
+	}
+	return fmt.Sprintf("apiserver returned %d %s", e.Code, e.Reason)
+}
+
+// IsNotFound reports whether err is a 404 from the apiserver.
+func IsNotFound(err error) bool {
+	return hasCode(err, http.StatusNotFound)
+}
+
+// IsConflict reports whether err is a 409 from the apiserver.
+func IsConflict(err error) bool {
+	return hasCode(err, http.StatusConflict)
+}
+
+func hasCode(err error, code int) bool {
+	var se *StatusError
+	return errors.As(err, &se) && se.Code == code
+}
+
+// Do sends a request with an optional body and decodes a JSON response into
+// out when out is not nil.
+func (c *Client) Do(ctx context.Context, method, path, contentType string, body []byte, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.server+path, reader)
+	if err != nil {
+		return fmt.Errorf("failed to build request %s %s: %w", method, path, err)
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s %s: %w", method, path, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("%s %s: failed to read response: %w", method, path, err)
+	}
+	if resp.StatusCode >= 400 {
+		se := &StatusError{Code: resp.StatusCode, Reason: http.StatusText(resp.StatusCode)}
+		var status struct {
+			Reason  string `json:"reason"`
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(data, &status) == nil {
+			if status.Reason != "" {
+				se.Reason = status.Reason
+			}
+			se.Message = status.Message
+		}
+		return fmt.Errorf("%s %s: %w", method, path, se)
+	}
+	if out != nil && len(data) > 0 {
+		if err := json.Unmarshal(data, out); err != nil {
+			return fmt.Errorf("%s %s: failed to decode response: %w", method, path, err)
+		}
+	}
+	return nil
+}
+
+// Get fetches path into out.
+func (c *Client) Get(ctx context.Context, path string, out interface{}) error {
+	return c.Do(ctx, http.MethodGet, path, "", nil, out)
+}
+
+// Post creates obj at path.
+func (c *Client) Post(ctx context.Context, path string, obj interface{}, out interface{}) error {
+	body, err := json.Marshal(obj)
+	if err != nil {
+		return fmt.Errorf("failed to encode request body: %w", err)
+	}
+	return c.Do(ctx, http.MethodPost, path, "application/json", body, out)
+}
+
+// Put replaces the object at path with obj.
+func (c *Client) Put(ctx context.Context, path string, obj interface{}, out interface{}) error {
+	body, err := json.Marshal(obj)
+	if err != nil {
+		return fmt.Errorf("failed to encode request body: %w", err)
+	}
+	return c.Do(ctx, http.MethodPut, path, "application/json", body, out)
+}
+
+// Patch applies patch of the given content type to path.
+func (c *Client) Patch(ctx context.Context, path, patchType string, patch []byte, out interface{}) error {
+	return c.Do(ctx, http.MethodPatch, path, patchType, patch, out)
+}
+
+// Delete removes the object at path.
+func (c *Client) Delete(ctx context.Context, path string) error {
+	return c.Do(ctx, http.MethodDelete, path, "", nil, nil)
+}
@@ -0,0 +1,250 @@
+package kube
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/mensylisir/xmcores/common"
+	"github.com/mensylisir/xmcores/wait"
+)
+
+func TestParseKubeconfig(t *testing.T) {
+	data := []byte(`apiVersion: v1
+kind: Config
+current-context: admin@demo
+clusters:
+  - name: other
+    cluster: {server: https://other:6443}
+  - name: demo
+    cluster:
+      server: https://lb.example.com:6443
+      certificate-authority-data: ` + base64.StdEncoding.EncodeToString([]byte("ca")) + `
+contexts:
+  - name: admin@demo
+    context: {cluster: demo, user: admin}
+users:
+  - name: admin
+    user:
+      token: abc
+`)
+	cfg, err := ParseKubeconfig(data)
+	require.NoError(t, err)
+	assert.Equal(t, "https://lb.example.com:6443", cfg.Server)
+	assert.Equal(t, []byte("ca"), cfg.CAData)
+	assert.Equal(t, "abc", cfg.Token)
+
+	_, err = ParseKubeconfig([]byte("current-context: missing\n"))
+	assert.ErrorContains(t, err, `context "missing" not found`)
+
+	_, err = NewClient(RESTConfig{Server: "https://x", CAData: []byte("not pem")})
+	assert.Error(t, err)
+}
+
+func TestClientDo(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer abc", r.Header.Get("Authorization"))
+		assert.Equal(t, common.AppName, r.Header.Get("User-Agent"))
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/api/v1/nodes/node1":
+			_, _ = w.Write([]byte(`{"metadata":{"name":"node1"},"status":{"conditions":[{"type":"Ready","status":"True"}]}}`))
+		case "/api/v1/namespaces/default/configmaps":
+			w.WriteHeader(http.StatusConflict)
+			_, _ = w.Write([]byte(`{"kind":"Status","reason":"AlreadyExists","message":"configmaps \"demo\" already exists"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	client, err := NewClient(RESTConfig{Server: srv.URL + "/", Token: "abc"})
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	var node Node
+	require.NoError(t, client.Get(ctx, NodePath("node1"), &node))
+	assert.Equal(t, "node1", node.Metadata.Name)
+	assert.Equal(t, "True", ConditionStatus(node.Status.Conditions, "Ready"))
+	assert.Equal(t, "Unknown", ConditionStatus(node.Status.Conditions, "MemoryPressure"))
+
+	err = client.Post(ctx, "/api/v1/namespaces/default/configmaps", map[string]string{}, nil)
+	assert.True(t, IsConflict(err))
+	assert.ErrorContains(t, err, "already exists")
+
+	assert.True(t, IsNotFound(client.Get(ctx, NodePath("missing"), &node)))
+
+	typed, err := client.Clientset().CoreV1().Nodes().Get(ctx, "node1", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "node1", typed.Name)
+}
+
+func TestDecodeManifest(t *testing.T) {
+	objs, err := DecodeManifest([]byte(`---
+apiVersion: v1
+kind: Namespace
+metadata: {name: demo}
+---
+---
+apiVersion: v1
+kind: List
+items:
+  - {apiVersion: v1, kind: ConfigMap, metadata: {name: a, namespace: demo}}
+`))
+	require.NoError(t, err)
+	require.Len(t, objs, 2)
+	assert.Equal(t, "Namespace demo", objs[0].String())
+	assert.Equal(t, "ConfigMap demo/a", objs[1].String())
+
+	_, err = DecodeManifest([]byte("kind: ConfigMap\n"))
+	assert.ErrorContains(t, err, "must set apiVersion")
+}
+
+func TestCheckManifest(t *testing.T) {
+	manifest := []byte(`apiVersion: policy/v1beta1
+kind: PodDisruptionBudget
+metadata: {name: web, namespace: demo}
+---
+apiVersion: batch/v1
+kind: CronJob
+metadata: {name: backup, namespace: demo}
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata: {name: web, namespace: demo}
+spec:
+  selector: {matchLabels: {app: web}}
+`)
+	warnings, err := CheckManifest(manifest, "v1.23.4")
+	require.NoError(t, err)
+	require.Len(t, warnings, 1)
+	assert.Equal(t, "PodDisruptionBudget demo/web: policy/v1beta1 is deprecated since Kubernetes v1.21 and removed in v1.25, use policy/v1", warnings[0].String())
+
+	_, err = CheckManifest(manifest, "v1.25.0")
+	assert.EqualError(t, err, "the manifest does not suit Kubernetes v1.25.0:\n  PodDisruptionBudget demo/web: policy/v1beta1 was removed in Kubernetes v1.25, use policy/v1")
+	_, err = CheckManifest(manifest, "1.20")
+	assert.ErrorContains(t, err, "CronJob demo/backup: batch/v1 is served from Kubernetes v1.21, not by v1.20")
+
+	_, err = CheckManifest([]byte("apiVersion: apps/v1\nkind: DaemonSet\nmetadata: {name: agent}\nspec: {}\n"), "v1.31.2")
+	assert.ErrorContains(t, err, "DaemonSet agent: apps/v1 requires spec.selector")
+	_, err = CheckManifest(manifest, "latest")
+	assert.ErrorContains(t, err, "invalid Kubernetes version")
+}
+
+func TestApply(t *testing.T) {
+	var (
+		applied     []string
+		crdServed   bool
+		discoveries int
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/api/v1":
+			_, _ = w.Write([]byte(`{"resources":[{"name":"namespaces","kind":"Namespace","namespaced":false},{"name":"configmaps","kind":"ConfigMap","namespaced":true}]}`))
+		case r.URL.Path == "/apis/example.com/v1":
+			discoveries++
+			if crdServed {
+				_, _ = w.Write([]byte(`{"resources":[{"name":"widgets","kind":"Widget","namespaced":true},{"name":"widgets/status","kind":"Widget","namespaced":true}]}`))
+				return
+			}
+			w.WriteHeader(http.StatusNotFound)
+		case r.Method == http.MethodPatch:
+			assert.Equal(t, ApplyPatch, r.Header.Get("Content-Type"))
+			assert.Equal(t, "xmcores", r.URL.Query().Get("fieldManager"))
+			applied = append(applied, r.URL.Path)
+			_, _ = w.Write([]byte(`{}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	client, err := NewClient(RESTConfig{Server: srv.URL})
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	require.NoError(t, client.Apply(ctx, []byte(`apiVersion: v1
+kind: Namespace
+metadata: {name: demo}
+---
+apiVersion: v1
+kind: ConfigMap
+metadata: {name: settings}
+`)))
+	assert.Equal(t, []string{"/api/v1/namespaces/demo", "/api/v1/namespaces/default/configmaps/settings"}, applied)
+
+	widget := []byte("apiVersion: example.com/v1\nkind: Widget\nmetadata: {name: w, namespace: demo}\n")
+	assert.ErrorContains(t, client.Apply(ctx, widget), "kind Widget is not served by example.com/v1")
+	crdServed = true
+	require.NoError(t, client.Apply(ctx, widget))
+	assert.Equal(t, "/apis/example.com/v1/namespaces/demo/widgets/w", applied[2])
+	assert.Equal(t, 3, discoveries)
+}
+
+func TestRolledOut(t *testing.T) {
+	var w workload
+	three := int32(3)
+	w.Spec.Replicas = &three
+	w.Metadata.Generation = 2
+	w.Status.ObservedGeneration = 1
+	done, reason := w.rolledOut(KindDeployment)
+	assert.False(t, done)
+	assert.Contains(t, reason, "observe")
+
+	w.Status.ObservedGeneration = 2
+	w.Status.Replicas, w.Status.UpdatedReplicas, w.Status.AvailableReplicas = 3, 3, 2
+	done, reason = w.rolledOut(KindDeployment)
+	assert.False(t, done)
+	assert.Equal(t, "2 of 3 updated replicas ready", reason)
+	w.Status.AvailableReplicas = 3
+	done, _ = w.rolledOut(KindDeployment)
+	assert.True(t, done)
+
+	var ds workload
+	ds.Status.DesiredNumberScheduled, ds.Status.UpdatedNumberScheduled, ds.Status.NumberAvailable = 4, 4, 3
+	done, reason = ds.rolledOut(KindDaemonSet)
+	assert.False(t, done)
+	assert.Equal(t, "3 of 4 updated pods available", reason)
+}
+
+func TestWaitForRollout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/apis/apps/v1/namespaces/kube-system/deployments/coredns", r.URL.Path)
+		_, _ = w.Write([]byte(`{"metadata":{"generation":1},"spec":{"replicas":2},"status":{"observedGeneration":1,"replicas":2,"updatedReplicas":2,"availableReplicas":2}}`))
+	}))
+	defer srv.Close()
+	client, err := NewClient(RESTConfig{Server: srv.URL})
+	require.NoError(t, err)
+	require.NoError(t, client.WaitForRollout(context.Background(), KindDeployment, "kube-system", "coredns", time.Second))
+	assert.Error(t, client.WaitForRollout(context.Background(), "Job", "default", "x", time.Second))
+}
+
+func TestWaitForCondition(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		status := "False"
+		if calls > 1 {
+			status = "True"
+		}
+		_, _ = w.Write([]byte(`{"status":{"conditions":[{"type":"Ready","status":"` + status + `"}]}}`))
+	}))
+	defer srv.Close()
+	client, err := NewClient(RESTConfig{Server: srv.URL})
+	require.NoError(t, err)
+
+	opts := wait.Options{Timeout: time.Second, Interval: time.Millisecond}
+	require.NoError(t, client.WaitForCondition(context.Background(), NodePath("node1"), "Ready", opts))
+	assert.Equal(t, 2, calls)
+
+	opts.Timeout = 20 * time.Millisecond
+	err = client.WaitForCondition(context.Background(), NodePath("node1"), "MemoryPressure", opts)
+	assert.ErrorIs(t, err, wait.ErrTimeout)
+	assert.ErrorContains(t, err, "condition MemoryPressure is Unknown")
+}
@@ -0,0 +1,161 @@
+package kube
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/mensylisir/xmcores/wait"
+)
+
+// DefaultPollInterval is the delay between status checks while waiting.
+const DefaultPollInterval = 2 * time.Second
+
+// Workload kinds supported by WaitForRollout.
+const (
+	KindDeployment  = "Deployment"
+	KindDaemonSet   = "DaemonSet"
+	KindStatefulSet = "StatefulSet"
+)
+
+var workloadResources = map[string]string{
+	KindDeployment:  "deployments",
+	KindDaemonSet:   "daemonsets",
+	KindStatefulSet: "statefulsets",
+}
+
+type workload struct {
+	Metadata struct {
+		Generation int64 `json:"generation"`
+	} `json:"metadata"`
+	Spec struct {
+		Replicas *int32 `json:"replicas"`
+	} `json:"spec"`
+	Status struct {
+		ObservedGeneration int64 `json:"observedGeneration"`
+		// Deployment and StatefulSet.
+		Replicas          int32 `json:"replicas"`
+		UpdatedReplicas   int32 `json:"updatedReplicas"`
+		ReadyReplicas     int32 `json:"readyReplicas"`
+		AvailableReplicas int32 `json:"availableReplicas"`
+		// DaemonSet.
+		DesiredNumberScheduled int32 `json:"desiredNumberScheduled"`
+		UpdatedNumberScheduled int32 `json:"updatedNumberScheduled"`
+		NumberAvailable        int32 `json:"numberAvailable"`
+	} `json:"status"`
+}
+
+// rolledOut reports whether the workload reached its desired state and, if
+// not, what it is waiting for.
+func (w workload) rolledOut(kind string) (bool, string) {
+	if w.Status.ObservedGeneration < w.Metadata.Generation {
+		return false, "waiting for the controller to observe the latest spec"
+	}
+	st := w.Status
+	switch kind {
+	case KindDaemonSet:
+		if st.UpdatedNumberScheduled < st.DesiredNumberScheduled || st.NumberAvailable < st.DesiredNumberScheduled {
+			return false, fmt.Sprintf("%d of %d updated pods available", st.NumberAvailable, st.DesiredNumberScheduled)
+		}
+	default:
+		want := int32(1)
+		if w.Spec.Replicas != nil {
+			want = *w.Spec.Replicas
+		}
+		ready := st.AvailableReplicas
+		if kind == KindStatefulSet {
+			ready = st.ReadyReplicas
+		}
+		if st.UpdatedReplicas < want || ready < want || st.Replicas > want {
+			return false, fmt.Sprintf("%d of %d updated replicas ready", ready, want)
+		}
+	}
+	return true, ""
+}
+
+// WaitForRollout waits until the Deployment, DaemonSet or StatefulSet has all
+// replicas updated and available, or timeout expires.
+func (c *Client) WaitForRollout(ctx context.Context, kind, namespace, name string, timeout time.Duration) error {
+	resource, ok := workloadResources[kind]
+	if !ok {
+		return fmt.Errorf("unsupported workload kind %q", kind)
+	}
+	path := "/apis/apps/v1/namespaces/" + url.PathEscape(namespace) + "/" + resource + "/" + url.PathEscape(name)
+	opts := wait.Options{Timeout: timeout, Interval: DefaultPollInterval}
+	return wait.Poll(ctx, opts, "rollout of "+kind+" "+namespace+"/"+name, func(ctx context.Context) (bool, error) {
+		var w workload
+		if err := c.Get(ctx, path, &w); err != nil {
+			return false, err
+		}
+		if done, reason := w.rolledOut(kind); !done {
+			return false, errors.New(reason)
+		}
+		return true, nil
+	})
+}
+
+// WaitForCondition waits until the object at path reports condType with
+// status True, e.g. "Ready" for a node or "Established" for a CRD.
+func (c *Client) WaitForCondition(ctx context.Context, path, condType string, opts wait.Options) error {
+	return wait.Poll(ctx, opts, condType+" condition of "+path, func(ctx context.Context) (bool, error) {
+		var obj struct {
+			Status struct {
+				Conditions []Condition `json:"conditions"`
+			} `json:"status"`
+		}
+		if err := c.Get(ctx, path, &obj); err != nil {
+			return false, err
+		}
+		if status := ConditionStatus(obj.Status.Conditions, condType); status != "True" {
+			return false, fmt.Errorf("condition %s is %s", condType, status)
+		}
+		return true, nil
+	})
+}
+
+// Nodes lists the cluster nodes.
+func (c *Client) Nodes(ctx context.Context) ([]Node, error) {
+	var list NodeList
+	if err := c.Get(ctx, "/api/v1/nodes", &list); err != nil {
+		return nil, fmt.Errorf("failed to list nodes: %w", err)
+	}
+	return list.Items, nil
+}
+
+// Node fetches one node.
+func (c *Client) Node(ctx context.Context, name string) (Node, error) {
+	var node Node
+	if err := c.Get(ctx, NodePath(name), &node); err != nil {
+		return node, fmt.Errorf("failed to get node %s: %w", name, err)
+	}
+	return node, nil
+}
+
+// Pods lists the pods of namespace matching labelSelector. An empty namespace
+// lists all namespaces.
+func (c *Client) Pods(ctx context.Context, namespace, labelSelector string) ([]Pod, error) {
+	path := "/api/v1/pods"
+	if namespace != "" {
+		path = "/api/v1/namespaces/" + url.PathEscape(namespace) + "/pods"
+	}
+	if labelSelector != "" {
+		path += "?labelSelector=" + url.QueryEscape(labelSelector)
+	}
+	var list PodList
+	if err := c.Get(ctx, path, &list); err != nil {
+		return nil, fmt.Errorf("failed to list pods: %w", err)
+	}
+	return list.Items, nil
+}
+
+// NodeReady reports whether the node's Ready condition is True.
+func NodeReady(node Node) bool {
+	return ConditionStatus(node.Status.Conditions, "Ready") == "True"
+}
+
+// PodReady reports whether the pod is running with its Ready condition True.
+func PodReady(pod Pod) bool {
+	return pod.Status.Phase == PodRunning && ConditionStatus(pod.Status.Conditions, "Ready") == "True"
+}
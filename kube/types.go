@@ -0,0 +1,148 @@
+package kube
+
+import (
+	"net/url"
+	"time"
+)
+
+// ObjectMeta holds the metadata fields the modules use.
+type ObjectMeta struct {
+	Name              string            `json:"name,omitempty"`
+	Namespace         string            `json:"namespace,omitempty"`
+	UID               string            `json:"uid,omitempty"`
+	ResourceVersion   string            `json:"resourceVersion,omitempty"`
+	Labels            map[string]string `json:"labels,omitempty"`
+	Annotations       map[string]string `json:"annotations,omitempty"`
+	OwnerReferences   []OwnerReference  `json:"ownerReferences,omitempty"`
+	DeletionTimestamp *time.Time        `json:"deletionTimestamp,omitempty"`
+}
+
+// OwnerReference identifies the owner of an object.
+type OwnerReference struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Name       string `json:"name"`
+	Controller *bool  `json:"controller,omitempty"`
+}
+
+// Controller returns the owner reference marked as controller, if any.
+func (m ObjectMeta) Controller() (OwnerReference, bool) {
+	for _, ref := range m.OwnerReferences {
+		if ref.Controller != nil && *ref.Controller {
+			return ref, true
+		}
+	}
+	return OwnerReference{}, false
+}
+
+// Taint is a node taint.
+type Taint struct {
+	Key    string `json:"key"`
+	Value  string `json:"value,omitempty"`
+	Effect string `json:"effect"`
+}
+
+// Condition is a status condition of a node or pod.
+type Condition struct {
+	Type    string `json:"type"`
+	Status  string `json:"status"`
+	Reason  string `json:"reason,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// Node is a cluster node.
+type Node struct {
+	Metadata ObjectMeta `json:"metadata"`
+	Spec     struct {
+		Unschedulable bool    `json:"unschedulable,omitempty"`
+		Taints        []Taint `json:"taints,omitempty"`
+	} `json:"spec"`
+	Status struct {
+		Conditions []Condition `json:"conditions,omitempty"`
+		NodeInfo   struct {
+			KubeletVersion          string `json:"kubeletVersion"`
+			ContainerRuntimeVersion string `json:"containerRuntimeVersion"`
+			KernelVersion           string `json:"kernelVersion"`
+			OSImage                 string `json:"osImage"`
+			Architecture            string `json:"architecture"`
+		} `json:"nodeInfo"`
+	} `json:"status"`
+}
+
+// NodeList is a list of nodes.
+type NodeList struct {
+	Items []Node `json:"items"`
+}
+
+// CertificateSigningRequest is a request for a certificate signed by a
+// signer of the cluster.
+type CertificateSigningRequest struct {
+	APIVersion string     `json:"apiVersion,omitempty"`
+	Kind       string     `json:"kind,omitempty"`
+	Metadata   ObjectMeta `json:"metadata"`
+	Spec       struct {
+		// Request is the PEM-encoded PKCS#10 request.
+		Request    []byte   `json:"request"`
+		SignerName string   `json:"signerName"`
+		Usages     []string `json:"usages,omitempty"`
+		Username   string   `json:"username,omitempty"`
+		Groups     []string `json:"groups,omitempty"`
+	} `json:"spec"`
+	Status struct {
+		Conditions  []Condition `json:"conditions,omitempty"`
+		Certificate []byte      `json:"certificate,omitempty"`
+	} `json:"status"`
+}
+
+// CertificateSigningRequestList is a list of certificate signing requests.
+type CertificateSigningRequestList struct {
+	Items []CertificateSigningRequest `json:"items"`
+}
+
+// Pod is a pod.
+type Pod struct {
+	Metadata ObjectMeta `json:"metadata"`
+	Spec     struct {
+		NodeName string `json:"nodeName,omitempty"`
+	} `json:"spec"`
+	Status struct {
+		Phase      string      `json:"phase,omitempty"`
+		Conditions []Condition `json:"conditions,omitempty"`
+	} `json:"status"`
+}
+
+// PodList is a list of pods.
+type PodList struct {
+	Items []Pod `json:"items"`
+}
+
+// Pod phases.
+const (
+	PodPending   = "Pending"
+	PodRunning   = "Running"
+	PodSucceeded = "Succeeded"
+	PodFailed    = "Failed"
+)
+
+// ConditionStatus returns the status of the condition of type t, or "Unknown".
+func ConditionStatus(conds []Condition, t string) string {
+	for _, c := range conds {
+		if c.Type == t {
+			return c.Status
+		}
+	}
+	return "Unknown"
+}
+
+// NodePath returns the API path of a node.
+func NodePath(name string) string {
+	return "/api/v1/nodes/" + url.PathEscape(name)
+}
+
+// CSRsPath is the API path of the certificate signing requests.
+const CSRsPath = "/apis/certificates.k8s.io/v1/certificatesigningrequests"
+
+// CSRPath returns the API path of a certificate signing request.
+func CSRPath(name string) string {
+	return CSRsPath + "/" + url.PathEscape(name)
+}
@@ -0,0 +1,122 @@
+package logger
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/mensylisir/xmcores/common"
+)
+
+// componentLevels holds the default level and the per-component overrides
+// shared by an XMLog and the component views derived from it.
+type componentLevels struct {
+	mu        sync.RWMutex
+	def       logrus.Level
+	overrides map[string]logrus.Level
+}
+
+// ParseLevelOverrides parses a comma-separated list of component=level pairs,
+// e.g. "connector=debug,pipeline=trace". Component names are case-insensitive.
+func ParseLevelOverrides(s string) (map[string]logrus.Level, error) {
+	overrides := make(map[string]logrus.Level)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		component, levelStr, ok := strings.Cut(pair, "=")
+		component = strings.TrimSpace(component)
+		if !ok || component == "" {
+			return nil, fmt.Errorf("invalid log level override %q, expected component=level", pair)
+		}
+		level, err := logrus.ParseLevel(strings.TrimSpace(levelStr))
+		if err != nil {
+			return nil, fmt.Errorf("invalid log level override %q: %w", pair, err)
+		}
+		overrides[strings.ToLower(component)] = level
+	}
+	return overrides, nil
+}
+
+// SetComponentLevels sets the default level and the per-component overrides.
+// The underlying logger is opened up to the most verbose of them; entries are
+// then filtered by the level of their component before they are emitted.
+func (xl *XMLog) SetComponentLevels(def logrus.Level, overrides map[string]logrus.Level) {
+	if xl.levels == nil {
+		xl.levels = &componentLevels{}
+	}
+	copied := make(map[string]logrus.Level, len(overrides))
+	maxLevel := def
+	for component, level := range overrides {
+		copied[strings.ToLower(component)] = level
+		if level > maxLevel {
+			maxLevel = level
+		}
+	}
+	xl.levels.mu.Lock()
+	xl.levels.def, xl.levels.overrides = def, copied
+	xl.levels.mu.Unlock()
+	xl.Logger.SetLevel(maxLevel)
+}
+
+// Component returns a view of the logger whose entries carry the Component
+// field and are filtered with the level configured for name.
+func (xl *XMLog) Component(name string) *XMLog {
+	return &XMLog{Logger: xl.Logger, levels: xl.levels, component: name, ring: xl.ring, sinks: xl.sinks, file: xl.file}
+}
+
+// componentKeys are the standard fields whose name selects an override, e.g.
+// "pipeline=trace" for every entry logged with a Pipeline field.
+var componentKeys = []string{common.PipelineName, common.ModuleName, common.TaskName, common.StepName, common.NodeName}
+
+// enabled reports whether an entry of level with fields passes the component
+// filter. The Component field is consulted first, then the Module name, then
+// the names of the standard fields.
+func (xl *XMLog) enabled(level logrus.Level, fields logrus.Fields) bool {
+	if level <= logrus.FatalLevel {
+		return true // never swallow Fatal and Panic, they end the process
+	}
+	if !xl.Logger.IsLevelEnabled(level) {
+		return false
+	}
+	if xl.levels == nil {
+		return true
+	}
+	xl.levels.mu.RLock()
+	defer xl.levels.mu.RUnlock()
+	if len(xl.levels.overrides) == 0 {
+		return true // the logger level alone decides, as set by SetLevel
+	}
+	candidates := make([]string, 0, 2+len(componentKeys))
+	if xl.component != "" {
+		candidates = append(candidates, xl.component)
+	}
+	if v, ok := fields[common.ComponentName].(string); ok {
+		candidates = append(candidates, v)
+	}
+	if v, ok := fields[common.ModuleName].(string); ok {
+		candidates = append(candidates, v)
+	}
+	for _, key := range componentKeys {
+		if _, ok := fields[key]; ok {
+			candidates = append(candidates, key)
+		}
+	}
+	for _, c := range candidates {
+		if override, ok := xl.levels.overrides[strings.ToLower(c)]; ok {
+			return level <= override
+		}
+	}
+	return level <= xl.levels.def
+}
+
+// entry returns the entry to log on, carrying the Component field of a view.
+func (xl *XMLog) entry() *logrus.Entry {
+	if xl.component != "" {
+		return xl.Logger.WithField(common.ComponentName, xl.component)
+	}
+	return logrus.NewEntry(xl.Logger)
+}
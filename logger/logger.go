@@ -8,7 +8,6 @@ import (
 	"runtime"
 	"time"
 
-	rotatelogs "github.com/lestrrat-go/file-rotatelogs"
 	"github.com/rifflock/lfshook"
 	"github.com/sirupsen/logrus"
 
@@ -19,6 +18,12 @@ var Log *XMLog
 
 type XMLog struct {
 	*logrus.Logger
+
+	levels    *componentLevels
+	component string
+	ring      *RingBuffer
+	sinks     *sinkSet
+	file      *fileOutput
 }
 
 func init() {
@@ -85,20 +90,17 @@ func initializeGlobalLogger(outputPath string, verbose bool, defaultLevel logrus
 	logger.SetFormatter(consoleFormatter)
 	logger.SetOutput(os.Stdout)
 
+	var writer *fileOutput
 	if outputPath != "" {
 		if err := os.MkdirAll(outputPath, 0755); err != nil {
 			return fmt.Errorf("failed to create log output directory %s: %w", outputPath, err)
 		}
 		logFilePath := filepath.Join(outputPath, "app.log")
 
-		writer, err := rotatelogs.New(
-			logFilePath+".%Y%m%d",
-			rotatelogs.WithLinkName(logFilePath),
-			rotatelogs.WithMaxAge(7*24*time.Hour),
-			rotatelogs.WithRotationTime(24*time.Hour),
-		)
+		var err error
+		writer, err = newFileOutput(logFilePath, Rotation{})
 		if err != nil {
-			return fmt.Errorf("failed to initialize rotatelogs for %s: %w", logFilePath, err)
+			return err
 		}
 
 		fileFormatter := &Formatter{
@@ -130,6 +132,9 @@ func initializeGlobalLogger(outputPath string, verbose bool, defaultLevel logrus
 
 	Log = &XMLog{
 		Logger: logger,
+		levels: &componentLevels{def: currentLogLevel},
+		sinks:  &sinkSet{},
+		file:   writer,
 	}
 	return nil
 }
@@ -167,19 +172,16 @@ func NewXMLog(outputPath string, verbose bool, defaultLevel logrus.Level) (*XMLo
 	logger.SetFormatter(consoleFormatter)
 	logger.SetOutput(os.Stdout)
 
+	var writer *fileOutput
 	if outputPath != "" {
 		if err := os.MkdirAll(outputPath, 0755); err != nil {
 			return nil, fmt.Errorf("failed to create log output directory %s: %w", outputPath, err)
 		}
 		logFilePath := filepath.Join(outputPath, "instance.log") // 给实例日志一个不同的名字
-		writer, err := rotatelogs.New(
-			logFilePath+".%Y%m%d",
-			rotatelogs.WithLinkName(logFilePath),
-			rotatelogs.WithRotationTime(24*time.Hour),
-			rotatelogs.WithMaxAge(3*24*time.Hour), // 实例日志可以设置不同的保留时间
-		)
+		var err error
+		writer, err = newFileOutput(logFilePath, Rotation{MaxAge: 3 * 24 * time.Hour}) // 实例日志可以设置不同的保留时间
 		if err != nil {
-			return nil, fmt.Errorf("failed to initialize rotatelogs for instance: %w", err)
+			return nil, err
 		}
 		fileFormatter := &Formatter{
 			TimestampFormat:        "2006-01-02 15:04:05.000 MST",
@@ -206,14 +208,48 @@ func NewXMLog(outputPath string, verbose bool, defaultLevel logrus.Level) (*XMLo
 		}
 	}
 
-	return &XMLog{Logger: logger}, nil
+	return &XMLog{Logger: logger, levels: &componentLevels{def: currentLogLevel}, sinks: &sinkSet{}, file: writer}, nil
+}
+
+// emit logs the message built by msg at level, or only buffers it when the
+// level filters drop it.
+func (xl *XMLog) emit(level logrus.Level, fields logrus.Fields, msg func() string) {
+	entry := xl.entry().WithFields(fields)
+	if xl.enabled(level, entry.Data) {
+		entry.Log(level, msg())
+		return
+	}
+	xl.buffer(level, entry.Data, msg)
+}
+
+// buffer records a filtered-out entry in the ring buffer, if there is one,
+// and hands it to the sinks whose level is more verbose than the console's.
+func (xl *XMLog) buffer(level logrus.Level, fields logrus.Fields, msg func() string) {
+	toSinks := xl.sinks != nil && xl.sinks.accepts(level)
+	if xl.ring == nil && !toSinks {
+		return
+	}
+	now, message := time.Now(), msg()
+	if xl.ring != nil {
+		xl.ring.Add(newRecord(now, level, message, fields))
+	}
+	if toSinks {
+		entry := &logrus.Entry{Logger: xl.Logger, Data: fields, Time: now, Level: level, Message: message}
+		if err := xl.sinks.Fire(entry); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to fire hook: %v\n", err)
+		}
+	}
 }
 
 func (xl *XMLog) logWithStandardFields(level logrus.Level, fixedFields logrus.Fields, message string, dynamicFields ...logrus.Fields) {
-	entry := xl.Logger.WithFields(fixedFields)
+	entry := xl.entry().WithFields(fixedFields)
 	if len(dynamicFields) > 0 && dynamicFields[0] != nil {
 		entry = entry.WithFields(dynamicFields[0])
 	}
+	if !xl.enabled(level, entry.Data) {
+		xl.buffer(level, entry.Data, func() string { return message })
+		return
+	}
 	switch level {
 	case logrus.TraceLevel:
 		entry.Trace(message)
@@ -235,10 +271,14 @@ func (xl *XMLog) logWithStandardFields(level logrus.Level, fixedFields logrus.Fi
 }
 
 func (xl *XMLog) logfWithStandardFields(level logrus.Level, fixedFields logrus.Fields, format string, args []interface{}, dynamicFields ...logrus.Fields) {
-	entry := xl.Logger.WithFields(fixedFields)
+	entry := xl.entry().WithFields(fixedFields)
 	if len(dynamicFields) > 0 && dynamicFields[0] != nil {
 		entry = entry.WithFields(dynamicFields[0])
 	}
+	if !xl.enabled(level, entry.Data) {
+		xl.buffer(level, entry.Data, func() string { return fmt.Sprintf(format, args...) })
+		return
+	}
 	switch level {
 	case logrus.TraceLevel:
 		entry.Tracef(format, args...)
@@ -596,80 +636,80 @@ func (xl *XMLog) PanicfNode(nodeName string, err error, format string, args ...i
 }
 
 func (xl *XMLog) Debug(args ...interface{}) {
-	xl.Logger.Debug(args...)
+	xl.emit(logrus.DebugLevel, nil, func() string { return fmt.Sprint(args...) })
 }
 
 func (xl *XMLog) Debugf(format string, args ...interface{}) {
-	xl.Logger.Debugf(format, args...)
+	xl.emit(logrus.DebugLevel, nil, func() string { return fmt.Sprintf(format, args...) })
 }
 
 func (xl *XMLog) Info(args ...interface{}) {
-	xl.Logger.Info(args...)
+	xl.emit(logrus.InfoLevel, nil, func() string { return fmt.Sprint(args...) })
 }
 
 func (xl *XMLog) Infof(format string, args ...interface{}) {
-	xl.Logger.Infof(format, args...)
+	xl.emit(logrus.InfoLevel, nil, func() string { return fmt.Sprintf(format, args...) })
 }
 
 func (xl *XMLog) Warn(args ...interface{}) {
-	xl.Logger.Warn(args...)
+	xl.emit(logrus.WarnLevel, nil, func() string { return fmt.Sprint(args...) })
 }
 
 func (xl *XMLog) Warnf(format string, args ...interface{}) {
-	xl.Logger.Warnf(format, args...)
+	xl.emit(logrus.WarnLevel, nil, func() string { return fmt.Sprintf(format, args...) })
 }
 
 func (xl *XMLog) Error(args ...interface{}) {
-	xl.Logger.Error(args...)
+	xl.emit(logrus.ErrorLevel, nil, func() string { return fmt.Sprint(args...) })
 }
 
 func (xl *XMLog) Errorf(format string, args ...interface{}) {
-	xl.Logger.Errorf(format, args...)
+	xl.emit(logrus.ErrorLevel, nil, func() string { return fmt.Sprintf(format, args...) })
 }
 
 // Fatal logs a message at level Fatal on the standard logger then the process will exit.
 func (xl *XMLog) Fatal(args ...interface{}) {
-	xl.Logger.Fatal(args...)
+	xl.entry().Fatal(args...)
 }
 
 func (xl *XMLog) Fatalf(format string, args ...interface{}) {
-	xl.Logger.Fatalf(format, args...)
+	xl.entry().Fatalf(format, args...)
 }
 
 func (xl *XMLog) Panic(args ...interface{}) {
-	xl.Logger.Panic(args...)
+	xl.entry().Panic(args...)
 }
 
 func (xl *XMLog) Panicf(format string, args ...interface{}) {
-	xl.Logger.Panicf(format, args...)
+	xl.entry().Panicf(format, args...)
 }
 
 func (xl *XMLog) Trace(args ...interface{}) {
-	xl.Logger.Trace(args...)
+	xl.emit(logrus.TraceLevel, nil, func() string { return fmt.Sprint(args...) })
 }
 
 func (xl *XMLog) Tracef(format string, args ...interface{}) {
-	xl.Logger.Tracef(format, args...)
+	xl.emit(logrus.TraceLevel, nil, func() string { return fmt.Sprintf(format, args...) })
 }
 
 func (xl *XMLog) Print(args ...interface{}) {
-	xl.Logger.Print(args...)
+	xl.entry().Print(args...)
 }
 
 func (xl *XMLog) Printf(format string, args ...interface{}) {
-	xl.Logger.Printf(format, args...)
+	xl.entry().Printf(format, args...)
 }
 
 func (xl *XMLog) Println(args ...interface{}) {
-	xl.Logger.Println(args...)
+	xl.entry().Println(args...)
 }
 
 func (xl *XMLog) LogAtLevel(level logrus.Level, message string, fields logrus.Fields) {
-	xl.WithFields(fields).Log(level, message)
+	xl.emit(level, fields, func() string { return message })
 }
 
 func (xl *XMLog) LogfAtLevel(level logrus.Level, fields logrus.Fields, format string, args ...interface{}) {
-	xl.WithFields(fields).Logf(level, format, args...)
+	xl.emit(level, fields, func() string { return fmt.Sprintf(format, args...) })
 }
 
 func (xl *XMLog) Message(node, str string) {
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io"
 	"io/fs"
+	"net"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -679,3 +680,235 @@ func (xl *XMLog) DebugfWithFields(fields logrus.Fields, format string, args ...i
 func (xl *XMLog) ErrorfWithFields(fields logrus.Fields, format string, args ...interface{}) {
 	xl.WithFields(fields).Errorf(format, args...)
 }
+
+func TestComponentLevels(t *testing.T) {
+	xl, err := NewXMLog("", false, logrus.InfoLevel)
+	require.NoError(t, err)
+	xl.SetOutput(io.Discard)
+	hook := &testHook{}
+	xl.ReplaceHooks(make(logrus.LevelHooks))
+	xl.AddHook(hook)
+
+	overrides, err := ParseLevelOverrides("Connector=debug, pipeline=trace,k8sops=warn")
+	require.NoError(t, err)
+	xl.SetComponentLevels(logrus.InfoLevel, overrides)
+
+	xl.Debugf("plain debug")
+	assert.Nil(t, hook.LastEntry(), "entries without a component use the default level")
+
+	xl.Component("connector").Debugf("dialing %s", "node1")
+	entry := hook.LastEntry()
+	require.NotNil(t, entry)
+	assert.Equal(t, "dialing node1", entry.Message)
+	assert.Equal(t, "connector", entry.Data[common.ComponentName])
+
+	hook.Reset()
+	xl.Component("connector").Tracef("too verbose")
+	assert.Nil(t, hook.LastEntry())
+
+	xl.TracefPipeline("install", "trace via the Pipeline field")
+	require.NotNil(t, hook.LastEntry())
+
+	hook.Reset()
+	xl.InfofModule("K8sOps", "module name overrides are case-insensitive")
+	assert.Nil(t, hook.LastEntry())
+	xl.InfofModule("Storage", "other modules use the default level")
+	require.NotNil(t, hook.LastEntry())
+
+	_, err = ParseLevelOverrides("connector")
+	assert.ErrorContains(t, err, "expected component=level")
+	_, err = ParseLevelOverrides("connector=loud")
+	assert.Error(t, err)
+}
+
+func TestRingBuffer(t *testing.T) {
+	xl, err := NewXMLog("", false, logrus.InfoLevel)
+	require.NoError(t, err)
+	xl.SetOutput(io.Discard)
+	ring := NewRingBuffer(4)
+	xl.SetRingBuffer(ring)
+
+	xl.Debugf("hidden %d", 1)
+	xl.Info("shown")
+	xl.DebugfNode("node1", "node1 detail")
+	xl.DebugfNode("node2", "node2 detail")
+	xl.TracefStep("Pull", "pull detail")
+
+	var msgs []string
+	for _, rec := range ring.Records() {
+		msgs = append(msgs, rec.Message)
+	}
+	assert.Equal(t, []string{"shown", "node1 detail", "node2 detail", "pull detail"}, msgs, "oldest entry evicted")
+
+	msgs = nil
+	for _, rec := range ring.Context("node2", "Pull") {
+		msgs = append(msgs, rec.Message)
+	}
+	assert.Equal(t, []string{"shown", "node2 detail", "pull detail"}, msgs)
+
+	rec := ring.Records()[1]
+	assert.Equal(t, logrus.DebugLevel, rec.Level)
+	assert.Contains(t, rec.String(), "DEBUG Node=node1 node1 detail")
+
+	xl.Component("connector").Tracef("via component view")
+	last := ring.Records()[3]
+	assert.Equal(t, "via component view", last.Message)
+	assert.Equal(t, "connector", last.Fields[common.ComponentName])
+}
+
+func TestParseSink(t *testing.T) {
+	s, err := ParseSink("syslog:address=tcp://logs:601,level=debug,format=json,facility=local0,tag=xm-ci")
+	require.NoError(t, err)
+	assert.Equal(t, Sink{Type: SinkSyslog, Address: "tcp://logs:601", Level: "debug", Format: FormatJSON, Facility: "local0", Tag: "xm-ci"}, s)
+
+	s, err = ParseSink("journald")
+	require.NoError(t, err)
+	assert.Equal(t, Sink{Type: SinkJournald}, s)
+
+	for _, spec := range []string{
+		"console",
+		"file",
+		"file:path=/tmp/xm.log,maxAge=forever",
+		"network:address=logs:514",
+		"network:address=udp://logs",
+		"syslog:facility=kernel",
+		"syslog:level=loud",
+		"syslog:format=xml",
+		"syslog:address",
+		"syslog:color=red",
+	} {
+		_, err := ParseSink(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestSinks(t *testing.T) {
+	xl, err := NewXMLog("", false, logrus.InfoLevel)
+	require.NoError(t, err)
+	xl.SetOutput(io.Discard)
+	defer xl.CloseSinks()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "xm.log")
+	require.NoError(t, xl.AddSink(Sink{Type: SinkFile, Path: path, Level: "debug", Format: FormatJSON}))
+
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer udp.Close()
+	require.NoError(t, xl.AddSink(Sink{Type: SinkSyslog, Address: "udp://" + udp.LocalAddr().String(), Facility: "local0", Tag: "xm-test"}))
+
+	journal, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: filepath.Join(dir, "journal.sock"), Net: "unixgram"})
+	require.NoError(t, err)
+	defer journal.Close()
+	require.NoError(t, xl.AddSink(Sink{Type: SinkJournald, Path: filepath.Join(dir, "journal.sock"), Level: "warn"}))
+
+	xl.DebugfNode("node1", "only in the file")
+	xl.WarnfStep("Pull", "everywhere\nover two lines")
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	require.Len(t, lines, 2, "the file sink is more verbose than the console")
+	assert.Contains(t, lines[0], `"msg":"only in the file"`)
+	assert.Contains(t, lines[0], `"Node":"node1"`)
+	assert.Contains(t, lines[1], `"level":"warning"`)
+
+	buf := make([]byte, 4096)
+	require.NoError(t, udp.SetReadDeadline(time.Now().Add(5*time.Second)))
+	n, _, err := udp.ReadFrom(buf)
+	require.NoError(t, err)
+	msg := string(buf[:n])
+	assert.True(t, strings.HasPrefix(msg, "<132>1 "), "local0.warning: %s", msg)
+	assert.Contains(t, msg, fmt.Sprintf(" xm-test %d - - [WARN] [Step:Pull] everywhere", os.Getpid()))
+
+	require.NoError(t, journal.SetReadDeadline(time.Now().Add(5*time.Second)))
+	n, err = journal.Read(buf)
+	require.NoError(t, err)
+	fields := string(buf[:n])
+	assert.Contains(t, fields, "PRIORITY=4\nSYSLOG_IDENTIFIER=xm\nXM_STEP=Pull\n")
+	assert.Contains(t, fields, "MESSAGE\n", "multi-line values are sent with their length")
+
+	require.NoError(t, xl.CloseSinks())
+	xl.Warn("after close")
+}
+
+func TestRotation(t *testing.T) {
+	assert.Error(t, Rotation{Every: time.Second}.Validate())
+	assert.Error(t, Rotation{MaxSize: -1}.Validate())
+	assert.Equal(t, Rotation{Every: time.Hour, MaxSize: 10, MaxBackups: 3, Compress: true},
+		Rotation{Every: time.Hour, MaxBackups: 5}.Merge(Rotation{MaxSize: 10, MaxBackups: 3, Compress: true}))
+
+	path := filepath.Join(t.TempDir(), "xm.log")
+	f, err := openRotating(path, Rotation{MaxSize: 1, MaxBackups: 2, Compress: true})
+	require.NoError(t, err)
+	chunk := bytes.Repeat([]byte("x"), 600*1024)
+	for i := 0; i < 8; i++ {
+		_, err := f.Write(chunk)
+		require.NoError(t, err)
+	}
+	require.NoError(t, f.Close())
+
+	// Close waits for the rotated files to be compressed and pruned.
+	matches, err := filepath.Glob(path + ".*")
+	require.NoError(t, err)
+	var plain, compressed int
+	for _, m := range matches {
+		switch {
+		case strings.HasSuffix(m, ".gz"):
+			compressed++
+		case !strings.HasSuffix(m, ".tmp"):
+			plain++
+		}
+	}
+	assert.Equal(t, 1, plain, "the current file")
+	assert.Equal(t, 2, compressed, "two compressed backups")
+
+	xl, err := NewXMLog(t.TempDir(), false, logrus.InfoLevel)
+	require.NoError(t, err)
+	xl.SetOutput(io.Discard)
+	require.NoError(t, xl.SetRotation(Rotation{MaxSize: 5, Compress: true}))
+	xl.Info("after changing the rotation")
+	data, err := os.ReadFile(xl.file.path)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "after changing the rotation")
+	assert.Error(t, xl.SetRotation(Rotation{Every: time.Second}))
+}
+
+func TestRotationClose(t *testing.T) {
+	for i := 0; i < 10; i++ {
+		path := filepath.Join(t.TempDir(), "xm.log")
+		f, err := openRotating(path, Rotation{MaxBackups: 2, Compress: true})
+		require.NoError(t, err)
+
+		// Rotate on several goroutines until Close has returned.
+		closed := make(chan struct{})
+		var wg sync.WaitGroup
+		for j := 0; j < 4; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					select {
+					case <-closed:
+						return
+					default:
+					}
+					_, _ = f.Write([]byte("line\n"))
+					_ = f.Rotate()
+				}
+			}()
+		}
+		time.Sleep(5 * time.Millisecond)
+		require.NoError(t, f.Close())
+		close(closed)
+		wg.Wait()
+		// Writes after Close reopen a file of rotatelogs; release it.
+		_ = f.RotateLogs.Close()
+
+		// Rotations handled before Close returned are done and later ones are
+		// not handled at all, so no compression is left half-way.
+		tmp, err := filepath.Glob(path + ".*.tmp")
+		require.NoError(t, err)
+		assert.Empty(t, tmp)
+	}
+}
@@ -0,0 +1,133 @@
+package logger
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/mensylisir/xmcores/common"
+)
+
+// DefaultRingSize is the number of entries a ring buffer keeps by default.
+const DefaultRingSize = 1000
+
+// Record is a log entry retained by a RingBuffer.
+type Record struct {
+	Time    time.Time
+	Level   logrus.Level
+	Message string
+	Fields  logrus.Fields
+}
+
+// String formats the record on one line, fields sorted by name.
+func (r Record) String() string {
+	var b strings.Builder
+	b.WriteString(r.Time.Format("15:04:05.000"))
+	b.WriteString(" " + strings.ToUpper(r.Level.String()))
+	keys := make([]string, 0, len(r.Fields))
+	for k := range r.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(&b, " %s=%v", k, r.Fields[k])
+	}
+	b.WriteString(" " + r.Message)
+	return b.String()
+}
+
+// RingBuffer keeps the last entries logged through an XMLog, including the
+// debug and trace entries that the console level filters out, so a failure
+// can be reported with its context without re-running verbosely. It is safe
+// for concurrent use.
+type RingBuffer struct {
+	mu      sync.Mutex
+	records []Record
+	next    int
+	full    bool
+}
+
+// NewRingBuffer creates a buffer holding the last size entries.
+func NewRingBuffer(size int) *RingBuffer {
+	if size <= 0 {
+		size = DefaultRingSize
+	}
+	return &RingBuffer{records: make([]Record, size)}
+}
+
+// Add appends a record, evicting the oldest one when the buffer is full.
+func (r *RingBuffer) Add(rec Record) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.records[r.next] = rec
+	r.next = (r.next + 1) % len(r.records)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// Records returns the buffered entries, oldest first.
+func (r *RingBuffer) Records() []Record {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.full {
+		return append([]Record(nil), r.records[:r.next]...)
+	}
+	return append(append([]Record(nil), r.records[r.next:]...), r.records[:r.next]...)
+}
+
+// Context returns the buffered entries relevant to a failure on host in step:
+// those logged for that host and step and those not scoped to any. Empty host
+// or step match everything.
+func (r *RingBuffer) Context(host, step string) []Record {
+	var out []Record
+	for _, rec := range r.Records() {
+		if matchField(rec.Fields, common.NodeName, host) && matchField(rec.Fields, common.StepName, step) {
+			out = append(out, rec)
+		}
+	}
+	return out
+}
+
+func matchField(fields logrus.Fields, key, want string) bool {
+	if want == "" {
+		return true
+	}
+	v, ok := fields[key]
+	return !ok || fmt.Sprint(v) == want
+}
+
+// Levels implements logrus.Hook.
+func (r *RingBuffer) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire implements logrus.Hook, recording entries that were emitted.
+func (r *RingBuffer) Fire(entry *logrus.Entry) error {
+	r.Add(newRecord(entry.Time, entry.Level, entry.Message, entry.Data))
+	return nil
+}
+
+func newRecord(t time.Time, level logrus.Level, msg string, fields logrus.Fields) Record {
+	copied := make(logrus.Fields, len(fields))
+	for k, v := range fields {
+		copied[k] = v
+	}
+	return Record{Time: t, Level: level, Message: msg, Fields: copied}
+}
+
+// SetRingBuffer makes xl retain its entries in r, including those filtered out
+// by the logger or component levels. Call it once per logger.
+func (xl *XMLog) SetRingBuffer(r *RingBuffer) {
+	xl.ring = r
+	xl.Logger.AddHook(r)
+}
+
+// RingBuffer returns the buffer set with SetRingBuffer, or nil.
+func (xl *XMLog) RingBuffer() *RingBuffer {
+	return xl.ring
+}
@@ -0,0 +1,310 @@
+package logger
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	rotatelogs "github.com/lestrrat-go/file-rotatelogs"
+)
+
+const (
+	// DefaultRotationEvery is the time between rotations by default.
+	DefaultRotationEvery = 24 * time.Hour
+	// DefaultRotationMaxAge is how long rotated files are kept when neither
+	// MaxAge nor MaxBackups is set.
+	DefaultRotationMaxAge = 7 * 24 * time.Hour
+)
+
+// Rotation configures how a log file is rotated and how many rotated files
+// are kept. Rotated files are named after the file with the time of the
+// rotation, e.g. xm.log.20240102, and a generation when the size limit
+// rotates a file more often, e.g. xm.log.20240102.1; the file itself is a
+// link to the current one.
+type Rotation struct {
+	// Every is the time between rotations, default DefaultRotationEvery.
+	// Periods shorter than a day name the files after the minute.
+	Every time.Duration `yaml:"every,omitempty" json:"every,omitempty"`
+	// MaxSize rotates the file when it grows past this many megabytes; 0
+	// rotates by time only.
+	MaxSize int `yaml:"maxSize,omitempty" json:"maxSize,omitempty"`
+	// MaxAge removes rotated files older than this.
+	MaxAge time.Duration `yaml:"maxAge,omitempty" json:"maxAge,omitempty"`
+	// MaxBackups is how many rotated files are kept. When neither MaxAge nor
+	// MaxBackups is set, files are kept for DefaultRotationMaxAge.
+	MaxBackups int `yaml:"maxBackups,omitempty" json:"maxBackups,omitempty"`
+	// Compress gzips rotated files.
+	Compress bool `yaml:"compress,omitempty" json:"compress,omitempty"`
+}
+
+// Validate checks the rotation settings.
+func (r Rotation) Validate() error {
+	var errList []error
+	if r.Every < 0 || (r.Every > 0 && r.Every < time.Minute) {
+		errList = append(errList, fmt.Errorf("every must be at least a minute, got %s", r.Every))
+	}
+	if r.MaxSize < 0 {
+		errList = append(errList, fmt.Errorf("maxSize must not be negative, got %d", r.MaxSize))
+	}
+	if r.MaxAge < 0 {
+		errList = append(errList, fmt.Errorf("maxAge must not be negative, got %s", r.MaxAge))
+	}
+	if r.MaxBackups < 0 {
+		errList = append(errList, fmt.Errorf("maxBackups must not be negative, got %d", r.MaxBackups))
+	}
+	return errors.Join(errList...)
+}
+
+// Merge returns r with the fields set in o overriding it.
+func (r Rotation) Merge(o Rotation) Rotation {
+	if o.Every != 0 {
+		r.Every = o.Every
+	}
+	if o.MaxSize != 0 {
+		r.MaxSize = o.MaxSize
+	}
+	if o.MaxAge != 0 {
+		r.MaxAge = o.MaxAge
+	}
+	if o.MaxBackups != 0 {
+		r.MaxBackups = o.MaxBackups
+	}
+	if o.Compress {
+		r.Compress = true
+	}
+	return r
+}
+
+// rotatingFile is a log file rotated as configured by a Rotation.
+type rotatingFile struct {
+	*rotatelogs.RotateLogs
+	path       string
+	compress   bool
+	maxAge     time.Duration
+	maxBackups int
+	// pending tracks the handling of rotated files, which Close waits for.
+	pending sync.WaitGroup
+	// dispatch guards closed and the start of the handling of a rotation,
+	// so that Close never waits while pending is being added to.
+	dispatch sync.Mutex
+	closed   bool
+	// mu serializes the handling of rotations that follow each other closely.
+	mu sync.Mutex
+}
+
+// openRotating opens the log file path, rotated as configured by r.
+func openRotating(path string, r Rotation) (*rotatingFile, error) {
+	if err := r.Validate(); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create log directory: %w", err)
+	}
+	every := r.Every
+	if every == 0 {
+		every = DefaultRotationEvery
+	}
+	pattern := path + ".%Y%m%d"
+	if every < 24*time.Hour {
+		pattern = path + ".%Y%m%d%H%M"
+	}
+	f := &rotatingFile{path: path, compress: r.Compress}
+	opts := []rotatelogs.Option{
+		rotatelogs.WithLinkName(path),
+		rotatelogs.WithRotationTime(every),
+	}
+	if r.MaxSize > 0 {
+		opts = append(opts, rotatelogs.WithRotationSize(int64(r.MaxSize)*1024*1024))
+	}
+	switch {
+	case r.MaxBackups > 0:
+		// rotatelogs prunes either by count or by age, and counts in the
+		// order of the file names, which compression and generations past 9
+		// break; both limits are applied after each rotation instead.
+		opts = append(opts, rotatelogs.WithRotationCount(math.MaxUint32))
+		f.maxAge, f.maxBackups = r.MaxAge, r.MaxBackups
+	case r.MaxAge > 0:
+		opts = append(opts, rotatelogs.WithMaxAge(r.MaxAge))
+	default:
+		opts = append(opts, rotatelogs.WithMaxAge(DefaultRotationMaxAge))
+	}
+	rl, err := rotatelogs.New(pattern, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize rotatelogs for %s: %w", path, err)
+	}
+	f.RotateLogs = rl
+	return f, nil
+}
+
+// Write writes p to the current file, rotating it first when it is due.
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	var n int
+	err := f.track(func() error {
+		var err error
+		n, err = f.RotateLogs.Write(p)
+		return err
+	})
+	return n, err
+}
+
+// Rotate switches to a new file now.
+func (f *rotatingFile) Rotate() error {
+	return f.track(f.RotateLogs.Rotate)
+}
+
+// track runs do, which may rotate the file, and hands the file it rotated
+// away from to rotated on a goroutine of its own. Rotations after Close are
+// not handled.
+func (f *rotatingFile) track(do func() error) error {
+	f.dispatch.Lock()
+	defer f.dispatch.Unlock()
+	previous := f.CurrentFileName()
+	err := do()
+	if current := f.CurrentFileName(); previous != "" && current != previous && !f.closed {
+		f.pending.Add(1)
+		go f.rotated(previous, current)
+	}
+	return err
+}
+
+// rotated compresses the rotated file previous and prunes the backups.
+func (f *rotatingFile) rotated(previous, current string) {
+	defer f.pending.Done()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.compress {
+		if err := gzipFile(previous); err != nil && !errors.Is(err, os.ErrNotExist) {
+			fmt.Fprintf(os.Stderr, "Failed to compress rotated log %s: %v\n", previous, err)
+		}
+	}
+	if f.maxBackups > 0 {
+		f.prune(current)
+	}
+}
+
+// prune removes the rotated files beyond maxBackups, oldest first, and those
+// last written more than maxAge ago. Handlers may run late, so the file the
+// link points to is spared as well as current.
+func (f *rotatingFile) prune(current string) {
+	matches, err := filepath.Glob(f.path + ".*")
+	if err != nil {
+		return
+	}
+	linked, _ := filepath.EvalSymlinks(f.path)
+	type backup struct {
+		path    string
+		modTime time.Time
+	}
+	var backups []backup
+	for _, m := range matches {
+		fi, err := os.Lstat(m)
+		if err != nil || m == current || m == linked || fi.Mode()&os.ModeSymlink != 0 || strings.HasSuffix(m, ".tmp") {
+			continue
+		}
+		backups = append(backups, backup{m, fi.ModTime()})
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].modTime.After(backups[j].modTime) })
+	cutoff := time.Now().Add(-f.maxAge)
+	for i, b := range backups {
+		if i >= f.maxBackups || (f.maxAge > 0 && b.modTime.Before(cutoff)) {
+			_ = os.Remove(b.path)
+		}
+	}
+}
+
+// Close closes the current file and waits for rotated files to be compressed.
+func (f *rotatingFile) Close() error {
+	f.dispatch.Lock()
+	f.closed = true
+	err := f.RotateLogs.Close()
+	f.dispatch.Unlock()
+	f.pending.Wait()
+	return err
+}
+
+// gzipFile replaces path by path.gz, or path.N.gz when a file of an earlier
+// run took that name.
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp := path + ".gz.tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, in)
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		dst := path + ".gz"
+		for i := 1; fileExists(dst); i++ {
+			dst = fmt.Sprintf("%s.%d.gz", path, i)
+		}
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return os.Remove(path)
+}
+
+func fileExists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+// fileOutput is the file an XMLog writes to besides the console, whose
+// rotation can be changed while logging.
+type fileOutput struct {
+	mu   sync.Mutex
+	path string
+	file *rotatingFile
+}
+
+func newFileOutput(path string, r Rotation) (*fileOutput, error) {
+	f, err := openRotating(path, r)
+	if err != nil {
+		return nil, err
+	}
+	return &fileOutput{path: path, file: f}, nil
+}
+
+func (o *fileOutput) Write(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.file.Write(p)
+}
+
+// SetRotation changes the rotation of the log file written next to the
+// console (see XM_LOG_OUTPUT_PATH). It does nothing when there is none.
+func (xl *XMLog) SetRotation(r Rotation) error {
+	if xl.file == nil {
+		return nil
+	}
+	f, err := openRotating(xl.file.path, r)
+	if err != nil {
+		return err
+	}
+	xl.file.mu.Lock()
+	old := xl.file.file
+	xl.file.file = f
+	xl.file.mu.Unlock()
+	return old.Close()
+}
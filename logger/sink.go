@@ -0,0 +1,553 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/mensylisir/xmcores/common"
+)
+
+// Sink types.
+const (
+	// SinkFile writes to a file rotated as configured by its Rotation.
+	SinkFile = "file"
+	// SinkSyslog sends RFC 5424 messages to a syslog daemon.
+	SinkSyslog = "syslog"
+	// SinkJournald sends entries to the systemd journal, their fields as
+	// journal fields.
+	SinkJournald = "journald"
+	// SinkNetwork writes one formatted entry per line to a TCP or UDP endpoint.
+	SinkNetwork = "network"
+)
+
+// Sink formats.
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+const (
+	// DefaultSyslogAddress is the local syslog socket.
+	DefaultSyslogAddress = "unix:///dev/log"
+	// DefaultJournalSocket is the socket of the native journal protocol.
+	DefaultJournalSocket = "/run/systemd/journal/socket"
+	// DefaultSinkTag names the program in syslog and the journal.
+	DefaultSinkTag = "xm"
+)
+
+// Sink is a log destination in addition to the console. Sinks have their own
+// level, so a sink can record the debug entries the console hides.
+type Sink struct {
+	Type string `yaml:"type" json:"type"`
+	// Level is the most verbose level the sink receives; empty means info.
+	Level string `yaml:"level,omitempty" json:"level,omitempty"`
+	// Format is FormatText (the default) or FormatJSON. For syslog and
+	// journald it formats the message, without a timestamp.
+	Format string `yaml:"format,omitempty" json:"format,omitempty"`
+
+	// Path is the file of a file sink, or the socket of a journald sink
+	// (default DefaultJournalSocket).
+	Path string `yaml:"path,omitempty" json:"path,omitempty"`
+	// Rotation configures the rotation of a file sink.
+	Rotation Rotation `yaml:"rotation,omitempty" json:"rotation,omitempty"`
+
+	// Address is the endpoint of a syslog or network sink as a URL:
+	// udp://host:port, tcp://host:port or unix:///path. Syslog defaults to
+	// DefaultSyslogAddress.
+	Address string `yaml:"address,omitempty" json:"address,omitempty"`
+	// Facility is the syslog facility, e.g. daemon or local0; default user.
+	Facility string `yaml:"facility,omitempty" json:"facility,omitempty"`
+	// Tag is the syslog APP-NAME and journal SYSLOG_IDENTIFIER, default DefaultSinkTag.
+	Tag string `yaml:"tag,omitempty" json:"tag,omitempty"`
+}
+
+// syslogFacilities maps facility names to their RFC 5424 codes.
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19, "local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// Validate checks the sink definition.
+func (s Sink) Validate() error {
+	var errList []error
+	switch s.Type {
+	case SinkFile:
+		if s.Path == "" {
+			errList = append(errList, errors.New("path must be set"))
+		}
+		if err := s.Rotation.Validate(); err != nil {
+			errList = append(errList, fmt.Errorf("rotation: %w", err))
+		}
+	case SinkSyslog:
+		if s.Facility != "" {
+			if _, ok := syslogFacilities[s.Facility]; !ok {
+				errList = append(errList, fmt.Errorf("unknown syslog facility %q", s.Facility))
+			}
+		}
+	case SinkJournald:
+	case SinkNetwork:
+		if s.Address == "" {
+			errList = append(errList, errors.New("address must be set"))
+		}
+	default:
+		errList = append(errList, fmt.Errorf("unknown sink type %q (use %s, %s, %s or %s)", s.Type, SinkFile, SinkSyslog, SinkJournald, SinkNetwork))
+	}
+	if s.Address != "" {
+		if _, _, err := parseSinkAddress(s.Address); err != nil {
+			errList = append(errList, err)
+		}
+	}
+	if s.Level != "" {
+		if _, err := logrus.ParseLevel(s.Level); err != nil {
+			errList = append(errList, err)
+		}
+	}
+	switch s.Format {
+	case "", FormatText, FormatJSON:
+	default:
+		errList = append(errList, fmt.Errorf("unknown format %q (use %s or %s)", s.Format, FormatText, FormatJSON))
+	}
+	if err := errors.Join(errList...); err != nil {
+		return fmt.Errorf("%s log sink: %w", s.Type, err)
+	}
+	return nil
+}
+
+// ParseSink parses the command-line form of a sink: the type, optionally
+// followed by a colon and comma-separated key=value settings named like the
+// YAML fields, e.g. "syslog:address=udp://logs:514,level=debug,format=json"
+// or "file:path=/var/log/xm.log,maxSize=100,compress=true" with the rotation
+// settings inline.
+func ParseSink(spec string) (Sink, error) {
+	typ, settings, _ := strings.Cut(spec, ":")
+	s := Sink{Type: strings.TrimSpace(typ)}
+	for _, field := range strings.Split(settings, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return s, fmt.Errorf("log sink setting %q should be key=value", field)
+		}
+		switch key {
+		case "level":
+			s.Level = value
+		case "format":
+			s.Format = value
+		case "path":
+			s.Path = value
+		case "every", "maxAge":
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return s, fmt.Errorf("log sink setting %s: %w", key, err)
+			}
+			if key == "every" {
+				s.Rotation.Every = d
+			} else {
+				s.Rotation.MaxAge = d
+			}
+		case "maxSize", "maxBackups":
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return s, fmt.Errorf("log sink setting %s: %w", key, err)
+			}
+			if key == "maxSize" {
+				s.Rotation.MaxSize = n
+			} else {
+				s.Rotation.MaxBackups = n
+			}
+		case "compress":
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return s, fmt.Errorf("log sink setting compress: %w", err)
+			}
+			s.Rotation.Compress = b
+		case "address":
+			s.Address = value
+		case "facility":
+			s.Facility = value
+		case "tag":
+			s.Tag = value
+		default:
+			return s, fmt.Errorf("unknown log sink setting %q", key)
+		}
+	}
+	return s, s.Validate()
+}
+
+// parseSinkAddress splits a sink address into a network and an address for net.Dial.
+func parseSinkAddress(address string) (network, addr string, err error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid address %q: %w", address, err)
+	}
+	switch u.Scheme {
+	case "udp", "tcp":
+		if u.Host == "" || u.Port() == "" {
+			return "", "", fmt.Errorf("address %q needs a host and a port", address)
+		}
+		return u.Scheme, u.Host, nil
+	case "unix":
+		if u.Path == "" {
+			return "", "", fmt.Errorf("address %q needs a socket path", address)
+		}
+		return "unixgram", u.Path, nil
+	}
+	return "", "", fmt.Errorf("address %q should start with udp://, tcp:// or unix://", address)
+}
+
+// sinkSet dispatches entries to the sinks and subscribers of a logger and its
+// component views. It is a logrus hook for the entries the logger emits;
+// XMLog.buffer hands it those the console level filters out.
+type sinkSet struct {
+	mu     sync.RWMutex
+	sinks  []*sinkWriter
+	subs   []*subscriber
+	hooked bool
+}
+
+// subscriber receives entries in-process (see XMLog.Subscribe).
+type subscriber struct {
+	level logrus.Level
+	fn    func(Record)
+}
+
+// Levels implements logrus.Hook.
+func (ss *sinkSet) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire implements logrus.Hook.
+func (ss *sinkSet) Fire(entry *logrus.Entry) error {
+	ss.mu.RLock()
+	defer ss.mu.RUnlock()
+	var errList []error
+	for _, s := range ss.sinks {
+		if entry.Level <= s.level {
+			if err := s.write(entry); err != nil {
+				errList = append(errList, err)
+			}
+		}
+	}
+	for _, sub := range ss.subs {
+		if entry.Level <= sub.level {
+			sub.fn(newRecord(entry.Time, entry.Level, entry.Message, entry.Data))
+		}
+	}
+	return errors.Join(errList...)
+}
+
+// accepts reports whether a sink receives entries of level.
+func (ss *sinkSet) accepts(level logrus.Level) bool {
+	ss.mu.RLock()
+	defer ss.mu.RUnlock()
+	for _, s := range ss.sinks {
+		if level <= s.level {
+			return true
+		}
+	}
+	for _, sub := range ss.subs {
+		if level <= sub.level {
+			return true
+		}
+	}
+	return false
+}
+
+// AddSink opens s and sends it the entries logged through xl and its
+// component views from now on, including those the console level filters out
+// when the sink's level is more verbose.
+func (xl *XMLog) AddSink(s Sink) error {
+	if err := s.Validate(); err != nil {
+		return err
+	}
+	w, err := openSink(s)
+	if err != nil {
+		return fmt.Errorf("%s log sink: %w", s.Type, err)
+	}
+	ss := xl.sinkSet()
+	ss.mu.Lock()
+	ss.sinks = append(ss.sinks, w)
+	ss.mu.Unlock()
+	return nil
+}
+
+// Subscribe calls fn with the entries of level or more severe logged through
+// xl and its component views from now on, including those the console level
+// filters out, until the returned function is called. fn runs on the logging
+// goroutine and must not block or log.
+func (xl *XMLog) Subscribe(level logrus.Level, fn func(Record)) (unsubscribe func()) {
+	ss := xl.sinkSet()
+	sub := &subscriber{level: level, fn: fn}
+	ss.mu.Lock()
+	ss.subs = append(ss.subs, sub)
+	ss.mu.Unlock()
+	return func() {
+		ss.mu.Lock()
+		defer ss.mu.Unlock()
+		for i, s := range ss.subs {
+			if s == sub {
+				ss.subs = append(ss.subs[:i:i], ss.subs[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// sinkSet returns the sink set of xl, hooked into its logger.
+func (xl *XMLog) sinkSet() *sinkSet {
+	if xl.sinks == nil {
+		xl.sinks = &sinkSet{}
+	}
+	xl.sinks.mu.Lock()
+	defer xl.sinks.mu.Unlock()
+	if !xl.sinks.hooked {
+		xl.Logger.AddHook(xl.sinks)
+		xl.sinks.hooked = true
+	}
+	return xl.sinks
+}
+
+// CloseSinks flushes and closes the sinks added with AddSink.
+func (xl *XMLog) CloseSinks() error {
+	if xl.sinks == nil {
+		return nil
+	}
+	xl.sinks.mu.Lock()
+	defer xl.sinks.mu.Unlock()
+	var errList []error
+	for _, s := range xl.sinks.sinks {
+		if err := s.close(); err != nil {
+			errList = append(errList, err)
+		}
+	}
+	xl.sinks.sinks = nil
+	return errors.Join(errList...)
+}
+
+// sinkWriter formats entries for one sink and writes them to its destination.
+type sinkWriter struct {
+	mu        sync.Mutex
+	sink      Sink
+	level     logrus.Level
+	formatter logrus.Formatter
+	// frame turns a formatted entry into what is written, e.g. a syslog message.
+	frame func(entry *logrus.Entry, body []byte) ([]byte, error)
+	out   io.WriteCloser
+	// dial reopens out after a failed write on a stream connection; nil for
+	// files and datagram sockets.
+	dial func() (io.WriteCloser, error)
+}
+
+func openSink(s Sink) (*sinkWriter, error) {
+	w := &sinkWriter{sink: s, level: logrus.InfoLevel}
+	if s.Level != "" {
+		w.level, _ = logrus.ParseLevel(s.Level) // checked by Validate
+	}
+	header := s.Type == SinkFile || s.Type == SinkNetwork
+	if s.Format == FormatJSON {
+		w.formatter = &logrus.JSONFormatter{TimestampFormat: time.RFC3339Nano, DisableTimestamp: !header}
+	} else {
+		w.formatter = &Formatter{
+			TimestampFormat:        "2006-01-02 15:04:05.000 MST",
+			DisableTimestamp:       !header,
+			NoColors:               true,
+			DisplayLevelName:       ShowAll,
+			FieldsDisplayWithOrder: []string{common.PipelineName, common.ModuleName, common.TaskName, common.StepName, common.NodeName},
+			FieldSeparator:         defaultFieldSeparator,
+			DisableCaller:          true,
+		}
+	}
+	tag := s.Tag
+	if tag == "" {
+		tag = DefaultSinkTag
+	}
+
+	var err error
+	switch s.Type {
+	case SinkFile:
+		w.out, err = openRotating(s.Path, s.Rotation)
+		w.frame = func(_ *logrus.Entry, body []byte) ([]byte, error) { return body, nil }
+	case SinkSyslog:
+		address := s.Address
+		if address == "" {
+			address = DefaultSyslogAddress
+		}
+		network, addr, _ := parseSinkAddress(address)
+		facility := syslogFacilities["user"]
+		if s.Facility != "" {
+			facility = syslogFacilities[s.Facility]
+		}
+		hostname, _ := os.Hostname()
+		w.frame = func(entry *logrus.Entry, body []byte) ([]byte, error) {
+			msg := syslogMessage(entry, body, facility, hostname, tag)
+			if network == "tcp" {
+				// Octet counting framing (RFC 6587).
+				msg = append([]byte(strconv.Itoa(len(msg))+" "), msg...)
+			}
+			return msg, nil
+		}
+		w.out, w.dial, err = dialSink(network, addr)
+	case SinkJournald:
+		path := s.Path
+		if path == "" {
+			path = DefaultJournalSocket
+		}
+		w.frame = func(entry *logrus.Entry, body []byte) ([]byte, error) {
+			return journalMessage(entry, body, tag), nil
+		}
+		w.out, w.dial, err = dialSink("unixgram", path)
+	case SinkNetwork:
+		network, addr, _ := parseSinkAddress(s.Address)
+		w.frame = func(_ *logrus.Entry, body []byte) ([]byte, error) { return body, nil }
+		w.out, w.dial, err = dialSink(network, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// dialSink connects to a socket. Stream connections come with a function to
+// reconnect, since the peer may restart while xm runs.
+func dialSink(network, addr string) (io.WriteCloser, func() (io.WriteCloser, error), error) {
+	dial := func() (io.WriteCloser, error) {
+		return net.DialTimeout(network, addr, 5*time.Second)
+	}
+	conn, err := dial()
+	if err != nil {
+		return nil, nil, err
+	}
+	if network != "tcp" {
+		dial = nil
+	}
+	return conn, dial, nil
+}
+
+func (w *sinkWriter) write(entry *logrus.Entry) error {
+	body, err := w.formatter.Format(entry)
+	if err != nil {
+		return err
+	}
+	msg, err := w.frame(entry, body)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.out == nil {
+		return fmt.Errorf("%s log sink is closed", w.sink.Type)
+	}
+	_, err = w.out.Write(msg)
+	if err != nil && w.dial != nil {
+		_ = w.out.Close()
+		out, derr := w.dial()
+		if derr != nil {
+			return fmt.Errorf("%s log sink: %w", w.sink.Type, errors.Join(err, derr))
+		}
+		w.out = out
+		_, err = w.out.Write(msg)
+	}
+	if err != nil {
+		return fmt.Errorf("%s log sink: %w", w.sink.Type, err)
+	}
+	return nil
+}
+
+func (w *sinkWriter) close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.out == nil {
+		return nil
+	}
+	err := w.out.Close()
+	w.out = nil
+	return err
+}
+
+// syslogSeverity maps logrus levels to syslog severities.
+func syslogSeverity(level logrus.Level) int {
+	switch level {
+	case logrus.PanicLevel, logrus.FatalLevel:
+		return 2 // crit
+	case logrus.ErrorLevel:
+		return 3
+	case logrus.WarnLevel:
+		return 4
+	case logrus.InfoLevel:
+		return 6
+	}
+	return 7 // debug
+}
+
+// syslogMessage formats an RFC 5424 message; the entry's fields are part of
+// body, so no structured data is sent.
+func syslogMessage(entry *logrus.Entry, body []byte, facility int, hostname, tag string) []byte {
+	if hostname == "" {
+		hostname = "-"
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "<%d>1 %s %s %s %d - - ", facility*8+syslogSeverity(entry.Level),
+		entry.Time.Format(time.RFC3339Nano), hostname, tag, os.Getpid())
+	b.Write(bytes.TrimRight(body, "\n"))
+	return b.Bytes()
+}
+
+// journalMessage encodes an entry in the native journal protocol: the
+// message, priority and identifier, and the entry's fields prefixed with XM_.
+func journalMessage(entry *logrus.Entry, body []byte, tag string) []byte {
+	var b bytes.Buffer
+	writeJournalField(&b, "MESSAGE", string(bytes.TrimRight(body, "\n")))
+	writeJournalField(&b, "PRIORITY", strconv.Itoa(syslogSeverity(entry.Level)))
+	writeJournalField(&b, "SYSLOG_IDENTIFIER", tag)
+	keys := make([]string, 0, len(entry.Data))
+	for k := range entry.Data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		writeJournalField(&b, "XM_"+journalFieldName(k), fmt.Sprint(entry.Data[k]))
+	}
+	return b.Bytes()
+}
+
+// writeJournalField writes a field; values spanning lines are written with
+// their length, as the protocol requires.
+func writeJournalField(b *bytes.Buffer, name, value string) {
+	if !strings.Contains(value, "\n") {
+		b.WriteString(name + "=" + value + "\n")
+		return
+	}
+	b.WriteString(name + "\n")
+	_ = binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.WriteString(value + "\n")
+}
+
+// journalFieldName turns a field name into a journal field name: upper-case
+// letters, digits and underscores.
+func journalFieldName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, name)
+}
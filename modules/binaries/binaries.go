@@ -0,0 +1,370 @@
+// Package binaries installs the kubeadm, kubelet and kubectl binaries of the
+// cluster's Kubernetes version on nodes, each node getting the build for its
+// own architecture, so that clusters mixing amd64 and arm64 hosts work.
+package binaries
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/mensylisir/xmcores/catalog"
+	"github.com/mensylisir/xmcores/common"
+	"github.com/mensylisir/xmcores/download"
+	"github.com/mensylisir/xmcores/errs"
+	"github.com/mensylisir/xmcores/facts"
+	"github.com/mensylisir/xmcores/file"
+	"github.com/mensylisir/xmcores/logger"
+	"github.com/mensylisir/xmcores/modules"
+	"github.com/mensylisir/xmcores/shellquote"
+)
+
+const moduleName = "Binaries"
+
+// DefaultInstallDir is where the binaries are installed on the nodes.
+const DefaultInstallDir = "/usr/local/bin"
+
+// Components are the catalog components installed on the nodes.
+var Components = []catalog.Component{catalog.Kubeadm, catalog.Kubelet, catalog.Kubectl}
+
+// Paths of the kubelet unit and of its kubeadm drop-in.
+const (
+	UnitPath   = "/etc/systemd/system/kubelet.service"
+	DropInPath = "/etc/systemd/system/kubelet.service.d/10-kubeadm.conf"
+)
+
+// Config selects where the binaries come from and where they go.
+type Config struct {
+	// LocalPath is the directory on the controller holding the binaries,
+	// laid out as <component>/<version>/<arch>/<file> like
+	// catalog.Bundle.DownloadItems places them.
+	LocalPath string `yaml:"localPath,omitempty" json:"localPath,omitempty"`
+	// Download fetches the binaries missing from LocalPath from their
+	// release URLs, verified against the published checksums, so LocalPath
+	// need not exist yet.
+	Download bool `yaml:"download,omitempty" json:"download,omitempty"`
+	// InstallDir is where the binaries are installed on the nodes;
+	// DefaultInstallDir by default.
+	InstallDir string `yaml:"installDir,omitempty" json:"installDir,omitempty"`
+	// Distribution is how the binaries reach the nodes: direct (the default)
+	// or p2p, see modules.Distribute.
+	Distribution string `yaml:"distribution,omitempty" json:"distribution,omitempty"`
+}
+
+// SetDefaults fills unset fields.
+func (c *Config) SetDefaults() {
+	if c.InstallDir == "" {
+		c.InstallDir = DefaultInstallDir
+	}
+}
+
+// Validate checks the configuration.
+func (c *Config) Validate() error {
+	if c.LocalPath == "" {
+		return fmt.Errorf("binaries local path must be set")
+	}
+	exists, err := file.PathExists(c.LocalPath)
+	if err != nil {
+		return fmt.Errorf("binaries local path %s is not a directory: %w", c.LocalPath, err)
+	}
+	if isDir, _ := file.IsDir(c.LocalPath); !isDir && (exists || !c.Download) {
+		return fmt.Errorf("binaries local path %s is not a directory", c.LocalPath)
+	}
+	if !path.IsAbs(c.InstallDir) {
+		return fmt.Errorf("binaries install dir %s must be absolute", c.InstallDir)
+	}
+	return modules.ValidateDistribution(c.Distribution)
+}
+
+// Binary is a binary to install, found at LocalPath on the controller.
+type Binary struct {
+	catalog.Binary
+	LocalPath string
+}
+
+// installed returns the part of bundle installed on the nodes, the binaries
+// of Components.
+func installed(bundle *catalog.Bundle) *catalog.Bundle {
+	out := &catalog.Bundle{KubernetesVersion: bundle.KubernetesVersion, Arch: bundle.Arch, Binaries: map[catalog.Component]catalog.Binary{}}
+	for _, comp := range Components {
+		if bin, ok := bundle.Binaries[comp]; ok {
+			out.Binaries[comp] = bin
+		}
+	}
+	return out
+}
+
+// Binaries returns the binaries of Components in bundle, found under dir.
+func Binaries(bundle *catalog.Bundle, dir string) []Binary {
+	dests := make(map[string]string, len(bundle.Binaries))
+	for _, item := range bundle.DownloadItems(dir) {
+		dests[item.URL] = item.Dest
+	}
+	out := make([]Binary, 0, len(Components))
+	for _, comp := range Components {
+		if bin, ok := bundle.Binaries[comp]; ok {
+			out = append(out, Binary{Binary: bin, LocalPath: dests[bin.URL]})
+		}
+	}
+	return out
+}
+
+// Arches gathers the architecture of every node (see facts.GatherArch) and
+// groups the nodes by it.
+func Arches(ctx context.Context, nodes []modules.Node) (map[string][]modules.Node, error) {
+	var mu sync.Mutex
+	byArch := map[string][]modules.Node{}
+	err := modules.ForEach(ctx, nodes, func(ctx context.Context, node modules.Node) error {
+		arch, err := facts.GatherArch(ctx, node.Host, node.Conn)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		byArch[string(arch)] = append(byArch[string(arch)], node)
+		return nil
+	})
+	return byArch, err
+}
+
+// Deploy installs the binaries of kubernetesVersion on nodes, from the
+// catalog bundle of each node's architecture. Nodes that have them already
+// are left alone. With cfg.Download, the binaries missing from cfg.LocalPath
+// are downloaded first by a download.Downloader configured with opts, e.g.
+// download.WithCacheDir. The kubelet gets a systemd unit with the kubeadm drop-in
+// and is enabled; kubeadm starts it.
+func Deploy(ctx context.Context, nodes []modules.Node, kubernetesVersion string, cfg Config, opts ...download.Option) error {
+	cfg.SetDefaults()
+	if err := cfg.Validate(); err != nil {
+		return errs.Wrap(errs.Config, err)
+	}
+	arches, byArch, bundles, err := resolve(ctx, nodes, kubernetesVersion)
+	if err != nil {
+		return err
+	}
+	var d *download.Downloader
+	if cfg.Download {
+		d = download.NewDownloader(opts...)
+	}
+	for _, arch := range arches {
+		bundle := bundles[arch]
+		if d != nil {
+			if err := fetch(ctx, d, nil, bundle, cfg.LocalPath); err != nil {
+				return err
+			}
+		}
+		if err := install(ctx, byArch[arch], Binaries(bundle, cfg.LocalPath), cfg); err != nil {
+			return err
+		}
+	}
+	return modules.ForEach(ctx, nodes, func(ctx context.Context, node modules.Node) error {
+		return installUnit(ctx, node, cfg.InstallDir)
+	})
+}
+
+// Checksums fetches the checksums of the binaries Deploy downloads for nodes,
+// if any. With a cache store in ctx (see cache.WithStore) they are kept, so
+// checking them while planning fails early on a release that cannot be
+// verified, and the Deploy after it fetches none again.
+func Checksums(ctx context.Context, nodes []modules.Node, kubernetesVersion string, cfg Config) error {
+	if !cfg.Download {
+		return nil
+	}
+	arches, _, bundles, err := resolve(ctx, nodes, kubernetesVersion)
+	if err != nil {
+		return err
+	}
+	for _, arch := range arches {
+		if err := bundles[arch].FetchChecksums(ctx, nil); err != nil {
+			return errs.Wrap(errs.Execution, err)
+		}
+	}
+	return nil
+}
+
+// resolve groups nodes by architecture and returns the architectures,
+// sorted, the nodes of each and the binaries of kubernetesVersion installed
+// on them, see installed.
+func resolve(ctx context.Context, nodes []modules.Node, kubernetesVersion string) ([]string, map[string][]modules.Node, map[string]*catalog.Bundle, error) {
+	byArch, err := Arches(ctx, nodes)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	arches := make([]string, 0, len(byArch))
+	for arch := range byArch {
+		arches = append(arches, arch)
+	}
+	sort.Strings(arches)
+	resolved, err := catalog.NewCatalog().ResolveArches(kubernetesVersion, arches, nil)
+	if err != nil {
+		return nil, nil, nil, errs.Wrap(errs.Config, err)
+	}
+	bundles := make(map[string]*catalog.Bundle, len(arches))
+	for _, arch := range arches {
+		bundles[arch] = installed(resolved[catalog.NormalizeArch(arch)])
+	}
+	return arches, byArch, bundles, nil
+}
+
+// fetch downloads with d the binaries of bundle missing from dir, after
+// fetching their checksums with client (http.DefaultClient when nil). Nothing
+// is fetched when none is missing, so an offline run works once they are
+// all there.
+func fetch(ctx context.Context, d *download.Downloader, client *http.Client, bundle *catalog.Bundle, dir string) error {
+	missing := map[string]bool{}
+	for _, bin := range Binaries(bundle, dir) {
+		if exists, err := file.PathExists(bin.LocalPath); err != nil || !exists {
+			missing[bin.LocalPath] = true
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	if err := bundle.FetchChecksums(ctx, client); err != nil {
+		return errs.Wrap(errs.Execution, err)
+	}
+	for _, item := range bundle.DownloadItems(dir) {
+		if !missing[item.Dest] {
+			continue
+		}
+		logger.Log.InfofModule(moduleName, "downloading %s", item.Name)
+		if err := d.Download(ctx, item); err != nil {
+			return errs.Wrap(errs.Execution, err)
+		}
+	}
+	return nil
+}
+
+// install copies each of bins to the nodes whose installed copy differs.
+func install(ctx context.Context, nodes []modules.Node, bins []Binary, cfg Config) error {
+	sums := make(map[string]string, len(bins))
+	for _, bin := range bins {
+		sum, err := file.FileSHA256(bin.LocalPath)
+		if err != nil {
+			return errs.Wrap(errs.Preflight, fmt.Errorf("%s %s for %s is missing from %s: %w", bin.Component, bin.Version, bin.Arch, cfg.LocalPath, err))
+		}
+		sums[bin.LocalPath] = sum
+	}
+	var mu sync.Mutex
+	pending := map[string][]modules.Node{}
+	if err := modules.ForEach(ctx, nodes, func(ctx context.Context, node modules.Node) error {
+		installed, err := installedSums(ctx, node, cfg.InstallDir)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, bin := range bins {
+			if installed[string(bin.Component)] != sums[bin.LocalPath] {
+				pending[bin.LocalPath] = append(pending[bin.LocalPath], node)
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	for _, bin := range bins {
+		targets := pending[bin.LocalPath]
+		if len(targets) == 0 {
+			continue
+		}
+		logger.Log.InfofModule(moduleName, "installing %s %s (%s) on %d nodes", bin.Component, bin.Version, bin.Arch, len(targets))
+		tmp := path.Join(common.GetTmpDir(), bin.FileName()+"-"+bin.Arch)
+		for _, node := range targets {
+			modules.TrackTemp(ctx, node, tmp)
+		}
+		if err := modules.Distribute(ctx, targets, bin.LocalPath, tmp, cfg.Distribution); err != nil {
+			return fmt.Errorf("failed to upload %s: %w", bin.Component, err)
+		}
+		dst := path.Join(cfg.InstallDir, string(bin.Component))
+		if err := modules.ForEach(ctx, targets, func(ctx context.Context, node modules.Node) error {
+			if _, err := modules.Run(ctx, node.Conn, shellquote.Join("install", "-m", "0755", tmp, dst)+" && "+shellquote.Join("rm", "-f", tmp)); err != nil {
+				return err
+			}
+			modules.UntrackTemp(ctx, node, tmp)
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// installedSums returns the SHA-256 of the installed binaries of Components,
+// keyed by component; missing ones are left out.
+func installedSums(ctx context.Context, node modules.Node, dir string) (map[string]string, error) {
+	cmd := []string{"sha256sum"}
+	for _, comp := range Components {
+		cmd = append(cmd, path.Join(dir, string(comp)))
+	}
+	// sha256sum fails for the missing files but still prints the others.
+	out, err := modules.Run(ctx, node.Conn, shellquote.Join(cmd...)+" 2>/dev/null || true")
+	if err != nil {
+		return nil, err
+	}
+	sums := map[string]string{}
+	for _, line := range strings.Split(out, "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 {
+			sums[path.Base(fields[1])] = fields[0]
+		}
+	}
+	return sums, nil
+}
+
+// Unit returns the systemd unit of the kubelet installed in dir.
+func Unit(dir string) string {
+	return fmt.Sprintf(`[Unit]
+Description=kubelet: The Kubernetes Node Agent
+Documentation=https://kubernetes.io/docs/
+Wants=network-online.target
+After=network-online.target
+
+[Service]
+ExecStart=%s
+Restart=always
+StartLimitInterval=0
+RestartSec=10
+
+[Install]
+WantedBy=multi-user.target
+`, path.Join(dir, "kubelet"))
+}
+
+// DropIn returns the drop-in passing the kubelet in dir the flags kubeadm
+// writes.
+func DropIn(dir string) string {
+	return fmt.Sprintf(`[Service]
+Environment="KUBELET_KUBECONFIG_ARGS=--bootstrap-kubeconfig=/etc/kubernetes/bootstrap-kubelet.conf --kubeconfig=/etc/kubernetes/kubelet.conf"
+Environment="KUBELET_CONFIG_ARGS=--config=/var/lib/kubelet/config.yaml"
+EnvironmentFile=-/var/lib/kubelet/kubeadm-flags.env
+EnvironmentFile=-/etc/default/kubelet
+ExecStart=
+ExecStart=%s $KUBELET_KUBECONFIG_ARGS $KUBELET_CONFIG_ARGS $KUBELET_KUBEADM_ARGS $KUBELET_EXTRA_ARGS
+`, path.Join(dir, "kubelet"))
+}
+
+// installUnit writes the kubelet unit and drop-in and enables the kubelet.
+func installUnit(ctx context.Context, node modules.Node, dir string) error {
+	if err := node.Conn.MkDirAll(ctx, path.Dir(DropInPath), common.FileMode0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", path.Dir(DropInPath), err)
+	}
+	changed := false
+	for _, f := range []struct{ path, content string }{{UnitPath, Unit(dir)}, {DropInPath, DropIn(dir)}} {
+		written, err := modules.WriteFileWith(ctx, node, []byte(f.content), f.path, common.FileMode0644, modules.WriteOptions{Atomic: true})
+		if err != nil {
+			return err
+		}
+		changed = changed || written
+	}
+	if changed {
+		if _, err := modules.Run(ctx, node.Conn, "systemctl daemon-reload"); err != nil {
+			return err
+		}
+	}
+	_, err := modules.Run(ctx, node.Conn, "systemctl enable kubelet")
+	return err
+}
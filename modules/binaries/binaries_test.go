@@ -0,0 +1,163 @@
+package binaries
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mensylisir/xmcores/cache"
+	"github.com/mensylisir/xmcores/catalog"
+	"github.com/mensylisir/xmcores/connector"
+	"github.com/mensylisir/xmcores/connector/connectortest"
+	"github.com/mensylisir/xmcores/download"
+	"github.com/mensylisir/xmcores/errs"
+	"github.com/mensylisir/xmcores/modules"
+)
+
+const version = "v1.31.2"
+
+// writeBinaries lays out fake binaries of version for arches under dir, each
+// holding its own path.
+func writeBinaries(t *testing.T, dir string, arches ...string) {
+	bundles, err := catalog.NewCatalog().ResolveArches(version, arches, nil)
+	require.NoError(t, err)
+	for _, bundle := range bundles {
+		for _, bin := range Binaries(bundle, dir) {
+			require.NoError(t, os.MkdirAll(filepath.Dir(bin.LocalPath), 0o755))
+			require.NoError(t, os.WriteFile(bin.LocalPath, []byte(bin.LocalPath), 0o755))
+		}
+	}
+}
+
+func testNode(name, uname string) (modules.Node, *connectortest.Fake) {
+	h := connector.NewHost()
+	h.SetName(name)
+	fake := connectortest.NewFake().On(`^uname -m$`, connectortest.Result{Stdout: uname + "\n"})
+	return modules.Node{Host: h, Conn: fake}, fake
+}
+
+func TestDeploy(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	writeBinaries(t, dir, "amd64", "arm64")
+	kubeadm := filepath.Join(dir, "kubeadm", version, "arm64", "kubeadm")
+	sum := sha256.Sum256([]byte(kubeadm))
+
+	amd, amdFake := testNode("worker1", "x86_64")
+	arm, armFake := testNode("worker2", "aarch64")
+	armFake.On(`sha256sum /usr/local/bin/kubeadm`, connectortest.Result{Stdout: hex.EncodeToString(sum[:]) + "  /usr/local/bin/kubeadm\n"})
+
+	require.NoError(t, Deploy(ctx, []modules.Node{amd, arm}, version, Config{LocalPath: dir}))
+	for _, comp := range []string{"kubeadm", "kubelet", "kubectl"} {
+		assert.True(t, amdFake.Ran(`install -m 0755 /tmp/.*/`+comp+`-amd64 /usr/local/bin/`+comp), comp)
+		assert.False(t, amdFake.Ran(`-arm64`), "worker1 gets the amd64 builds only")
+	}
+	assert.False(t, armFake.Ran(`install -m 0755 .* /usr/local/bin/kubeadm`), "the installed kubeadm is up to date")
+	assert.True(t, armFake.Ran(`install -m 0755 /tmp/.*/kubelet-arm64 /usr/local/bin/kubelet`))
+	assert.True(t, armFake.Ran(`mv -f /etc/systemd/system/kubelet\.service\.d/\.10-kubeadm\.conf\.[0-9a-f]{8}\.tmp `+DropInPath))
+	assert.True(t, armFake.Ran(`systemctl daemon-reload`))
+	assert.True(t, armFake.Ran(`systemctl enable kubelet`))
+
+	arm, _ = testNode("worker2", "aarch64")
+	err := Deploy(ctx, []modules.Node{arm}, version, Config{LocalPath: t.TempDir()})
+	assert.Equal(t, errs.Preflight, errs.KindOf(err))
+	assert.ErrorContains(t, err, "kubeadm "+version+" for arm64 is missing from")
+
+	err = Deploy(ctx, []modules.Node{arm}, "v1.22.4", Config{LocalPath: dir})
+	assert.Equal(t, errs.Config, errs.KindOf(err))
+}
+
+func TestFetch(t *testing.T) {
+	ctx := context.Background()
+	var requests []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Path)
+		name := filepath.Base(r.URL.Path)
+		if ext := filepath.Ext(name); ext == ".sha256" {
+			sum := sha256.Sum256([]byte(name[:len(name)-len(ext)]))
+			fmt.Fprintln(w, hex.EncodeToString(sum[:]))
+			return
+		}
+		fmt.Fprint(w, name)
+	}))
+	defer srv.Close()
+
+	bundle, err := catalog.NewCatalog().Resolve(version, "arm64", nil)
+	require.NoError(t, err)
+	bundle = installed(bundle)
+	for comp, bin := range bundle.Binaries {
+		bin.URL = srv.URL + "/" + string(comp)
+		bin.ChecksumURL = bin.URL + ".sha256"
+		bin.SHA256 = ""
+		bundle.Binaries[comp] = bin
+	}
+	assert.Len(t, bundle.Binaries, len(Components), "only the installed binaries are fetched")
+	dir := filepath.Join(t.TempDir(), "binaries")
+	kubectl := filepath.Join(dir, "kubectl", bundle.Binaries[catalog.Kubectl].Version, "arm64", "kubectl")
+	require.NoError(t, os.MkdirAll(filepath.Dir(kubectl), 0o755))
+	require.NoError(t, os.WriteFile(kubectl, []byte("kubectl"), 0o755))
+
+	d := download.NewDownloader(download.WithHTTPClient(srv.Client()), download.WithCacheDir(t.TempDir()))
+	require.NoError(t, fetch(ctx, d, srv.Client(), bundle, dir))
+	for _, bin := range Binaries(bundle, dir) {
+		data, err := os.ReadFile(bin.LocalPath)
+		require.NoError(t, err)
+		assert.Equal(t, string(bin.Component), string(data))
+	}
+	assert.NotContains(t, requests, "/kubectl", "present binaries are not downloaded again")
+
+	requests = nil
+	require.NoError(t, fetch(ctx, d, srv.Client(), bundle, dir))
+	assert.Empty(t, requests, "nothing is fetched once every binary is there")
+
+	requests = nil
+	require.NoError(t, fetch(ctx, d, srv.Client(), bundle, filepath.Join(t.TempDir(), "binaries")))
+	assert.NotContains(t, requests, "/kubeadm", "the binaries come from the download cache")
+}
+
+func TestChecksums(t *testing.T) {
+	ctx := cache.WithStore(context.Background(), cache.NewStore(t.TempDir()))
+	bundle, err := catalog.NewCatalog().Resolve(version, "arm64", nil)
+	require.NoError(t, err)
+	sum := hex.EncodeToString(make([]byte, sha256.Size))
+	for _, bin := range installed(bundle).Binaries {
+		// What an earlier run, e.g. the dry run, fetched.
+		_, err := cache.Memo(ctx, "checksum", []interface{}{bin.ChecksumURL, bin.FileName()}, func() (string, error) { return sum, nil })
+		require.NoError(t, err)
+	}
+	arm, fake := testNode("worker2", "aarch64")
+
+	require.NoError(t, Checksums(ctx, []modules.Node{arm}, version, Config{LocalPath: t.TempDir(), Download: true}), "the checksums come from the store")
+	assert.True(t, fake.Ran(`^uname -m$`))
+	arm, fake = testNode("worker2", "aarch64")
+	require.NoError(t, Checksums(ctx, []modules.Node{arm}, version, Config{LocalPath: t.TempDir()}))
+	assert.Empty(t, fake.Commands(), "nothing is downloaded, so nothing is resolved")
+}
+
+func TestDropIn(t *testing.T) {
+	assert.Contains(t, DropIn("/opt/bin"), "ExecStart=/opt/bin/kubelet $KUBELET_KUBECONFIG_ARGS")
+	assert.Contains(t, Unit("/opt/bin"), "ExecStart=/opt/bin/kubelet\n")
+}
+
+func TestValidate(t *testing.T) {
+	cfg := Config{LocalPath: t.TempDir()}
+	cfg.SetDefaults()
+	assert.NoError(t, cfg.Validate())
+	assert.Equal(t, DefaultInstallDir, cfg.InstallDir)
+
+	cfg.InstallDir = "bin"
+	assert.ErrorContains(t, cfg.Validate(), "binaries install dir bin must be absolute")
+	cfg = Config{LocalPath: filepath.Join(t.TempDir(), "missing"), InstallDir: DefaultInstallDir}
+	assert.ErrorContains(t, cfg.Validate(), "is not a directory")
+	cfg.Download = true
+	assert.NoError(t, cfg.Validate(), "the downloaded binaries create it")
+}
@@ -0,0 +1,330 @@
+// Package certrotate renews the control-plane certificates of a kubeadm
+// cluster without taking the API down. Control-plane hosts are handled one at
+// a time: their certificates are backed up and renewed with kubeadm, then the
+// static pods are restarted in dependency order, each one healthy again before
+// the next is touched. The API is probed throughout, so a rotation that did
+// cause an outage is reported rather than passing silently.
+package certrotate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mensylisir/xmcores/errs"
+	"github.com/mensylisir/xmcores/logger"
+	"github.com/mensylisir/xmcores/modules"
+	"github.com/mensylisir/xmcores/modules/etcdops"
+	"github.com/mensylisir/xmcores/pipeline"
+	"github.com/mensylisir/xmcores/shellquote"
+	"github.com/mensylisir/xmcores/wait"
+)
+
+const moduleName = "CertRotate"
+
+const (
+	DefaultAPIServerPort    = 6443
+	DefaultComponentTimeout = 3 * time.Minute
+	DefaultProbeInterval    = 2 * time.Second
+	// DefaultMaxOutage tolerates the requests a load balancer sends to an
+	// apiserver while it restarts, before its health check notices.
+	DefaultMaxOutage = 10 * time.Second
+
+	// BackupRoot holds a copy of the PKI and kubeconfigs per rotation.
+	BackupRoot = "/etc/kubernetes/backup"
+	// KubeletPKIDir holds the kubelet's self-signed serving certificate.
+	KubeletPKIDir = "/var/lib/kubelet/pki"
+)
+
+// Component is a control-plane static pod and its health check.
+type Component struct {
+	Name string
+	// Port and Path locate the HTTPS health endpoint on 127.0.0.1; etcd is
+	// checked through etcdops instead.
+	Port int
+	Path string
+}
+
+// Components returns the static pods in the order they are restarted: etcd
+// first, so that the apiserver reconnects to it once, then the apiserver,
+// which the controller-manager and scheduler talk to.
+func Components(apiServerPort int) []Component {
+	return []Component{
+		{Name: "etcd"},
+		{Name: "kube-apiserver", Port: apiServerPort, Path: "/livez"},
+		{Name: "kube-controller-manager", Port: 10257, Path: "/healthz"},
+		{Name: "kube-scheduler", Port: 10259, Path: "/healthz"},
+	}
+}
+
+// Options control Rotate.
+type Options struct {
+	// APIServerPort defaults to DefaultAPIServerPort.
+	APIServerPort int
+	// ComponentTimeout bounds the wait for a restarted component to be
+	// healthy; defaults to DefaultComponentTimeout.
+	ComponentTimeout time.Duration
+	// Probe checks the API is available; nil disables the monitoring.
+	Probe func(ctx context.Context) error
+	// ProbeInterval defaults to DefaultProbeInterval.
+	ProbeInterval time.Duration
+	// MaxOutage is the longest the API may be unavailable before the
+	// rotation is reported as failed; defaults to DefaultMaxOutage.
+	MaxOutage time.Duration
+}
+
+func (o *Options) setDefaults() {
+	if o.APIServerPort == 0 {
+		o.APIServerPort = DefaultAPIServerPort
+	}
+	if o.ComponentTimeout == 0 {
+		o.ComponentTimeout = DefaultComponentTimeout
+	}
+	if o.ProbeInterval == 0 {
+		o.ProbeInterval = DefaultProbeInterval
+	}
+	if o.MaxOutage == 0 {
+		o.MaxOutage = DefaultMaxOutage
+	}
+}
+
+// ControlPlanePipeline renews the certificates of the control-plane hosts
+// one after the other. Backups go to BackupRoot/certs-<stamp>.
+func ControlPlanePipeline(opts Options, stamp string) *pipeline.Pipeline {
+	opts.setDefaults()
+	backup := fmt.Sprintf("%s/certs-%s", BackupRoot, stamp)
+	steps := []pipeline.Step{
+		{Name: "backup-pki", Command: fmt.Sprintf("mkdir -p %[1]s && cp -a /etc/kubernetes/pki %[1]s/ && cp -a /etc/kubernetes/*.conf %[1]s/", backup)},
+		{Name: "renew-certs", Command: "kubeadm certs renew all"},
+	}
+	for _, c := range Components(opts.APIServerPort) {
+		steps = append(steps, pipeline.Step{Name: "restart-" + c.Name, Run: func(ctx context.Context, node modules.Node) error {
+			return Restart(ctx, node, c, opts.ComponentTimeout)
+		}})
+	}
+	steps = append(steps, pipeline.Step{Name: "check-expiration", Command: "kubeadm certs check-expiration"})
+	return &pipeline.Pipeline{Name: "control-plane", Tasks: []pipeline.Task{{Name: moduleName, Strategy: pipeline.StrategySerial, Steps: steps}}}
+}
+
+// KubeletPipeline replaces the self-signed kubelet serving certificates,
+// one node at a time. Nodes whose kubelet gets its serving certificate
+// through a CSR (serverTLSBootstrap) rotate it themselves and are left alone.
+func KubeletPipeline(opts Options, stamp string) *pipeline.Pipeline {
+	opts.setDefaults()
+	return &pipeline.Pipeline{Name: "kubelet", Tasks: []pipeline.Task{{Name: moduleName, Strategy: pipeline.StrategySerial, Steps: []pipeline.Step{
+		{Name: "rotate-kubelet-serving", Run: func(ctx context.Context, node modules.Node) error {
+			return rotateKubeletServing(ctx, node, stamp, opts.ComponentTimeout)
+		}},
+	}}}}
+}
+
+func init() {
+	pipeline.Define(pipeline.Definition{
+		Name:         "certs-rotate",
+		Description:  "Renew the control-plane certificates host by host, restarting the static pods in dependency order, then the self-signed kubelet serving certificates",
+		Command:      "xm certs rotate",
+		Kinds:        []string{"Cluster"},
+		Capabilities: []pipeline.Capability{pipeline.CapabilitySSH, pipeline.CapabilityRoot, pipeline.CapabilityKubeadm, pipeline.CapabilityKubeAPI},
+		Parameters: []pipeline.Parameter{
+			{Name: "max-outage", Description: "longest API unavailability tolerated during the rotation", Default: DefaultMaxOutage.String()},
+			{Name: "component-timeout", Description: "maximum wait for a restarted component to become healthy", Default: DefaultComponentTimeout.String()},
+		},
+		Pipelines: func() []*pipeline.Pipeline {
+			return []*pipeline.Pipeline{ControlPlanePipeline(Options{}, ""), KubeletPipeline(Options{}, "")}
+		},
+	})
+}
+
+// Rotate renews the certificates of controlPlanes, then the kubelet serving
+// certificates of nodes, probing the API meanwhile with opts.Probe. The
+// availability observed is returned even when the rotation fails.
+func Rotate(ctx context.Context, controlPlanes, nodes []modules.Node, opts Options) (Availability, error) {
+	opts.setDefaults()
+	stamp := time.Now().Format(modules.BackupTimeFormat)
+	var stop func() Availability
+	if opts.Probe != nil {
+		stop = Monitor(ctx, opts.Probe, opts.ProbeInterval)
+	}
+	err := ControlPlanePipeline(opts, stamp).Run(ctx, controlPlanes)
+	if err == nil {
+		err = KubeletPipeline(opts, stamp).Run(ctx, nodes)
+	}
+	if stop == nil {
+		return Availability{}, err
+	}
+	a := stop()
+	logger.Log.InfofModule(moduleName, "API availability during the rotation: %s", a)
+	if err == nil && a.LongestOutage > opts.MaxOutage {
+		err = errs.Wrap(errs.Verification, fmt.Errorf("the API was unavailable for %s, more than the %s allowed: %s",
+			a.LongestOutage.Round(time.Millisecond), opts.MaxOutage, a.LastError))
+	}
+	return a, err
+}
+
+// containerID returns the ID of the running container of the component, or
+// "" if there is none.
+func containerID(ctx context.Context, node modules.Node, name string) (string, error) {
+	out, err := modules.Run(ctx, node.Conn, "crictl ps -q --state running --name "+shellquote.Quote("^"+name+"$"))
+	if err != nil {
+		return "", err
+	}
+	id, _, _ := strings.Cut(out, "\n")
+	return strings.TrimSpace(id), nil
+}
+
+// Restart stops the container of c so that the kubelet starts it again with
+// the renewed certificates, and waits until the new container is healthy.
+// Components not running on the node, such as an external etcd, are skipped.
+func Restart(ctx context.Context, node modules.Node, c Component, timeout time.Duration) error {
+	old, err := containerID(ctx, node, c.Name)
+	if err != nil {
+		return err
+	}
+	if old == "" {
+		logger.Log.InfofModule(moduleName, "%s: %s does not run here, skipped", node.Name(), c.Name)
+		return nil
+	}
+	if _, err := modules.Run(ctx, node.Conn, "crictl stop --timeout 30 "+shellquote.Quote(old)); err != nil {
+		return err
+	}
+	return wait.Poll(ctx, wait.Options{Timeout: timeout}, c.Name+" on "+node.Name(), func(ctx context.Context) (bool, error) {
+		id, err := containerID(ctx, node, c.Name)
+		if err != nil {
+			return false, err
+		}
+		if id == "" || id == old {
+			return false, fmt.Errorf("%s has not been started again yet", c.Name)
+		}
+		return true, healthy(ctx, node, c)
+	})
+}
+
+// healthy returns why c is not healthy on node, or nil.
+func healthy(ctx context.Context, node modules.Node, c Component) error {
+	if c.Port == 0 {
+		s := etcdops.GetStatus(ctx, node, etcdops.DefaultPKI)
+		switch {
+		case s.Err != nil:
+			return s.Err
+		case len(s.Errors) > 0:
+			return errors.New(strings.Join(s.Errors, "; "))
+		case s.Leader == 0:
+			return errors.New("the etcd member has no leader")
+		}
+		return nil
+	}
+	ok, err := modules.Succeeds(ctx, node.Conn, "curl -fsSk -m 5 "+shellquote.Quote(fmt.Sprintf("https://127.0.0.1:%d%s", c.Port, c.Path)))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%s does not answer on port %d yet", c.Name, c.Port)
+	}
+	return nil
+}
+
+// rotateKubeletServing moves the self-signed serving certificate aside and
+// restarts the kubelet, which generates a new one on start.
+func rotateKubeletServing(ctx context.Context, node modules.Node, stamp string, timeout time.Duration) error {
+	crt, key := KubeletPKIDir+"/kubelet.crt", KubeletPKIDir+"/kubelet.key"
+	ok, err := modules.Succeeds(ctx, node.Conn, "test -f "+crt)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		logger.Log.InfofModule(moduleName, "%s: the kubelet has no self-signed serving certificate, skipped", node.Name())
+		return nil
+	}
+	if err := modules.RunAll(ctx, node.Conn,
+		fmt.Sprintf("mv -f %s %s && mv -f %s %s",
+			shellquote.Quote(crt), shellquote.Quote(crt+"."+stamp+".bak"), shellquote.Quote(key), shellquote.Quote(key+"."+stamp+".bak")),
+		"systemctl restart kubelet",
+	); err != nil {
+		return err
+	}
+	return wait.Poll(ctx, wait.Options{Timeout: timeout}, "kubelet on "+node.Name(), func(ctx context.Context) (bool, error) {
+		ok, err := modules.Succeeds(ctx, node.Conn, "curl -fsS -m 5 http://127.0.0.1:10248/healthz && test -f "+crt)
+		if err != nil || !ok {
+			return false, err
+		}
+		return true, nil
+	})
+}
+
+// Availability is what Monitor observed.
+type Availability struct {
+	Probes   int
+	Failures int
+	// LongestOutage is the longest time from a failed probe to the next
+	// successful one.
+	LongestOutage time.Duration
+	// LastError is the error of the last failed probe.
+	LastError string
+}
+
+func (a Availability) String() string {
+	if a.Failures == 0 {
+		return fmt.Sprintf("%d probes, all successful", a.Probes)
+	}
+	return fmt.Sprintf("%d of %d probes failed, longest outage %s, last error: %s",
+		a.Failures, a.Probes, a.LongestOutage.Round(time.Millisecond), a.LastError)
+}
+
+// Monitor calls probe every interval until the returned function is called,
+// which returns what was observed.
+func Monitor(ctx context.Context, probe func(ctx context.Context) error, interval time.Duration) func() Availability {
+	ctx, cancel := context.WithCancel(ctx)
+	var (
+		mu        sync.Mutex
+		a         Availability
+		downSince time.Time
+	)
+	outage := func(now time.Time) {
+		if !downSince.IsZero() && now.Sub(downSince) > a.LongestOutage {
+			a.LongestOutage = now.Sub(downSince)
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			err := probe(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+			now := time.Now()
+			mu.Lock()
+			a.Probes++
+			if err != nil {
+				a.Failures++
+				a.LastError = err.Error()
+				if downSince.IsZero() {
+					downSince = now
+				}
+				outage(now)
+			} else {
+				outage(now)
+				downSince = time.Time{}
+			}
+			mu.Unlock()
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+		}
+	}()
+	return func() Availability {
+		cancel()
+		<-done
+		mu.Lock()
+		defer mu.Unlock()
+		outage(time.Now())
+		return a
+	}
+}
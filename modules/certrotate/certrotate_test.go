@@ -0,0 +1,126 @@
+package certrotate
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mensylisir/xmcores/connector"
+	"github.com/mensylisir/xmcores/connector/connectortest"
+	"github.com/mensylisir/xmcores/modules"
+)
+
+// controlPlane fakes a control-plane host whose containers get a new ID each
+// time they are stopped.
+func controlPlane(t *testing.T, fakes *connectortest.Connector, name string) modules.Node {
+	t.Helper()
+	fake := fakes.Host(name)
+	var mu sync.Mutex
+	generation := map[string]int{}
+	fake.OnFunc(func(cmd string) bool { return strings.Contains(cmd, "crictl ps") }, func(cmd string) connectortest.Result {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, c := range Components(DefaultAPIServerPort) {
+			if strings.Contains(cmd, "'^"+c.Name+"$'") {
+				return connectortest.Result{Stdout: c.Name + "-" + string(rune('0'+generation[c.Name])) + "\n"}
+			}
+		}
+		return connectortest.Result{}
+	})
+	fake.OnFunc(func(cmd string) bool { return strings.Contains(cmd, "crictl stop") }, func(cmd string) connectortest.Result {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, c := range Components(DefaultAPIServerPort) {
+			if strings.Contains(cmd, " "+c.Name+"-") {
+				generation[c.Name]++
+			}
+		}
+		return connectortest.Result{}
+	})
+	fake.On(`/v3/maintenance/status`, connectortest.Result{Stdout: `{"header":{"member_id":"1"},"leader":"1","dbSize":"1024"}`})
+	fake.On(`/v3/maintenance/alarm`, connectortest.Result{Stdout: `{"header":{}}`})
+	fake.On(`test -f /var/lib/kubelet/pki/kubelet\.crt'`, connectortest.Result{ExitCode: 1})
+	h := connector.NewHost()
+	h.SetName(name)
+	return modules.Node{Host: h, Conn: fake}
+}
+
+func TestRotate(t *testing.T) {
+	ctx := context.Background()
+	fakes := connectortest.NewConnector()
+	nodes := []modules.Node{controlPlane(t, fakes, "master1"), controlPlane(t, fakes, "master2")}
+	var probes atomic.Int32
+
+	a, err := Rotate(ctx, nodes, nodes, Options{
+		Probe:         func(context.Context) error { probes.Add(1); return nil },
+		ProbeInterval: time.Millisecond,
+	})
+	require.NoError(t, err)
+	assert.Positive(t, a.Probes)
+	assert.Zero(t, a.Failures)
+
+	for _, name := range []string{"master1", "master2"} {
+		var restarted []string
+		for _, cmd := range fakes.Host(name).Commands() {
+			if strings.Contains(cmd, "kubeadm certs renew all") {
+				restarted = append(restarted, "renew")
+			}
+			if _, id, ok := strings.Cut(cmd, "crictl stop --timeout 30 "); ok {
+				restarted = append(restarted, strings.TrimRight(id, "'"))
+			}
+		}
+		assert.Equal(t, []string{"renew", "etcd-0", "kube-apiserver-0", "kube-controller-manager-0", "kube-scheduler-0"}, restarted, name)
+		assert.True(t, fakes.Host(name).Ran(`mkdir -p /etc/kubernetes/backup/certs-\d{8}-\d{6} && cp -a /etc/kubernetes/pki`))
+		assert.True(t, fakes.Host(name).Ran(`curl -fsSk -m 5 https://127\.0\.0\.1:6443/livez`))
+		assert.False(t, fakes.Host(name).Ran(`systemctl restart kubelet`), "kubelets without a self-signed certificate are left alone")
+	}
+	// The renewal is checked by kubeadm at the end.
+	assert.True(t, fakes.Host("master1").Ran(`check-expiration`))
+}
+
+func TestRestartSkipsMissingComponent(t *testing.T) {
+	fake := connectortest.NewFake()
+	h := connector.NewHost()
+	h.SetName("master1")
+	require.NoError(t, Restart(context.Background(), modules.Node{Host: h, Conn: fake}, Component{Name: "etcd"}, time.Second))
+	assert.False(t, fake.Ran(`crictl stop`), "an external etcd is not restarted")
+}
+
+func TestRotateKubeletServing(t *testing.T) {
+	fake := connectortest.NewFake()
+	h := connector.NewHost()
+	h.SetName("worker1")
+	require.NoError(t, rotateKubeletServing(context.Background(), modules.Node{Host: h, Conn: fake}, "20261016-010203", time.Second))
+	assert.True(t, fake.Ran(`mv -f /var/lib/kubelet/pki/kubelet\.crt /var/lib/kubelet/pki/kubelet\.crt\.20261016-010203\.bak && mv -f /var/lib/kubelet/pki/kubelet\.key`))
+	assert.True(t, fake.Ran(`systemctl restart kubelet`))
+	assert.True(t, fake.Ran(`curl -fsS -m 5 http://127\.0\.0\.1:10248/healthz`))
+}
+
+func TestMonitor(t *testing.T) {
+	var down atomic.Bool
+	stop := Monitor(context.Background(), func(context.Context) error {
+		if down.Load() {
+			return errors.New("connection refused")
+		}
+		return nil
+	}, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	down.Store(true)
+	time.Sleep(30 * time.Millisecond)
+	down.Store(false)
+	time.Sleep(10 * time.Millisecond)
+	a := stop()
+
+	assert.Positive(t, a.Failures)
+	assert.Greater(t, a.Probes, a.Failures)
+	assert.GreaterOrEqual(t, a.LongestOutage, 20*time.Millisecond)
+	assert.Equal(t, "connection refused", a.LastError)
+	assert.Contains(t, a.String(), "probes failed, longest outage")
+}
@@ -0,0 +1,177 @@
+// Package cgroups keeps the kubelet and containerd on the same cgroup driver.
+// When the two disagree, pods fail to start or the node turns unstable under
+// pressure, and the default configuration of containerd uses cgroupfs while
+// kubeadm runs the kubelet with systemd. The cgroup version and the drivers
+// are detected on the node and the containerd configuration is written to
+// match the kubelet; a host that would need a change xm cannot make, such as
+// another init system, fails preflight with what to change.
+package cgroups
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/mensylisir/xmcores/errs"
+	"github.com/mensylisir/xmcores/facts"
+	"github.com/mensylisir/xmcores/logger"
+	"github.com/mensylisir/xmcores/modules"
+	"github.com/mensylisir/xmcores/modules/trustca"
+	"github.com/mensylisir/xmcores/shellquote"
+)
+
+const moduleName = "Cgroups"
+
+// Cgroup drivers.
+const (
+	DriverSystemd  = "systemd"
+	DriverCgroupfs = "cgroupfs"
+)
+
+// Cgroup versions.
+const (
+	V1 = "v1"
+	// V2 is the unified hierarchy.
+	V2 = "v2"
+)
+
+// versionCommand prints the file system type of the cgroup hierarchy, see
+// ParseVersion.
+const versionCommand = "stat -fc %T /sys/fs/cgroup/"
+
+// systemdCgroupPattern matches the SystemdCgroup option of a runtime in the
+// containerd configuration.
+const systemdCgroupPattern = `^[[:space:]]*SystemdCgroup[[:space:]]*=`
+
+// runcOptionsPattern matches the options section of the runc runtime, in the
+// configuration of containerd 1.x (version 2) and 2.x (version 3).
+const runcOptionsPattern = `^[[:space:]]*\[plugins\..*\.runtimes\.runc\.options\]`
+
+// State is the cgroup setup of a node.
+type State struct {
+	// Version is V1 or V2.
+	Version    string
+	InitSystem string
+	// RuntimeConfig reports whether containerd has a configuration file.
+	RuntimeConfig bool
+	// RuntimeDriver is the driver containerd runs runc with: systemd when its
+	// configuration sets SystemdCgroup = true, else cgroupfs.
+	RuntimeDriver string
+}
+
+// ParseVersion returns the cgroup version of the output of versionCommand.
+func ParseVersion(out string) (string, error) {
+	switch strings.TrimSpace(out) {
+	case "cgroup2fs":
+		return V2, nil
+	case "tmpfs":
+		return V1, nil
+	default:
+		return "", fmt.Errorf("unexpected cgroup file system %q", strings.TrimSpace(out))
+	}
+}
+
+// ParseRuntimeDriver returns the driver of the SystemdCgroup lines of a
+// containerd configuration.
+func ParseRuntimeDriver(lines string) string {
+	for _, line := range strings.Split(lines, "\n") {
+		if _, value, ok := strings.Cut(line, "="); ok && strings.TrimSpace(value) == "true" {
+			return DriverSystemd
+		}
+	}
+	return DriverCgroupfs
+}
+
+// Detect returns the cgroup setup of node.
+func Detect(ctx context.Context, node modules.Node) (State, error) {
+	var s State
+	out, err := modules.RunUnprivileged(ctx, node.Conn, versionCommand)
+	if err != nil {
+		return s, err
+	}
+	if s.Version, err = ParseVersion(out); err != nil {
+		return s, errs.Wrap(errs.Preflight, err)
+	}
+	rel, err := facts.DetectOSRelease(ctx, node.Conn)
+	if err != nil {
+		return s, err
+	}
+	s.InitSystem = rel.InitSystem()
+	if s.RuntimeConfig, err = modules.Succeeds(ctx, node.Conn, "test -f "+trustca.ContainerdConfig); err != nil {
+		return s, err
+	}
+	s.RuntimeDriver = DriverCgroupfs
+	if s.RuntimeConfig {
+		out, err := modules.Run(ctx, node.Conn, "grep -E '"+systemdCgroupPattern+"' "+trustca.ContainerdConfig+" || true")
+		if err != nil {
+			return s, err
+		}
+		s.RuntimeDriver = ParseRuntimeDriver(out)
+	}
+	return s, nil
+}
+
+// Check returns a preflight error when the node cannot run the kubelet and
+// containerd with driver.
+func (s State) Check(driver string) error {
+	switch driver {
+	case DriverSystemd:
+		if s.InitSystem != facts.InitSystemd {
+			return errs.Wrap(errs.Preflight, fmt.Errorf("the %s cgroup driver needs systemd as init system, the host runs %s; set spec.kubeadmExtra.kubeletConfiguration.cgroupDriver to %s",
+				DriverSystemd, s.InitSystem, DriverCgroupfs))
+		}
+	case DriverCgroupfs:
+	default:
+		return errs.Wrap(errs.Config, fmt.Errorf("unsupported cgroup driver %q (want %s or %s)", driver, DriverSystemd, DriverCgroupfs))
+	}
+	return nil
+}
+
+// Apply makes containerd on node use driver, that of the kubelet: it writes
+// the default containerd configuration when there is none, sets its
+// SystemdCgroup option and restarts containerd. A configuration without
+// options for the runc runtime is left to the operator.
+func Apply(ctx context.Context, node modules.Node, driver string) error {
+	s, err := Detect(ctx, node)
+	if err != nil {
+		return err
+	}
+	if err := s.Check(driver); err != nil {
+		return err
+	}
+	if driver == DriverCgroupfs && s.InitSystem == facts.InitSystemd {
+		logger.Log.WarnfModule(moduleName, "%s: the %s cgroup driver beside systemd leaves two managers of the cgroups, which is unstable under resource pressure", node.Name(), DriverCgroupfs)
+	}
+	if s.Version == V1 {
+		logger.Log.WarnfModule(moduleName, "%s: cgroup v1 is in maintenance mode since Kubernetes 1.31, boot the host with the unified hierarchy", node.Name())
+	}
+	if s.RuntimeConfig && s.RuntimeDriver == driver {
+		return nil
+	}
+	config := shellquote.Quote(trustca.ContainerdConfig)
+	if !s.RuntimeConfig {
+		if _, err := modules.Run(ctx, node.Conn, "mkdir -p /etc/containerd && containerd config default > "+config); err != nil {
+			return err
+		}
+	}
+	value := "false"
+	if driver == DriverSystemd {
+		value = "true"
+	}
+	// Replace the option, else add it to the runc options, else exit 3.
+	edit := "if grep -qE '" + systemdCgroupPattern + "' " + config + "; then " +
+		"sed -ri 's/(" + systemdCgroupPattern + `).*/\1 ` + value + "/' " + config + "; " +
+		"elif grep -qE '" + runcOptionsPattern + "' " + config + "; then " +
+		"sed -ri '/" + runcOptionsPattern + `/a\            SystemdCgroup = ` + value + "' " + config + "; " +
+		"else exit 3; fi"
+	if r := modules.Exec(ctx, node, edit); r.Err == nil && r.ExitCode == 3 {
+		return errs.Wrap(errs.Preflight, fmt.Errorf("%s has no options section for the runc runtime; set SystemdCgroup = %s in it", trustca.ContainerdConfig, value))
+	} else if err := modules.ResultError(r, edit); err != nil {
+		return err
+	}
+	if err := modules.Service(ctx, node, s.InitSystem, modules.ServiceRestart, "containerd"); err != nil {
+		return err
+	}
+	logger.Log.InfofModule(moduleName, "%s: containerd switched to the %s cgroup driver (cgroup %s)", node.Name(), driver, s.Version)
+	return nil
+}
@@ -0,0 +1,82 @@
+package cgroups
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mensylisir/xmcores/connector"
+	"github.com/mensylisir/xmcores/connector/connectortest"
+	"github.com/mensylisir/xmcores/errs"
+	"github.com/mensylisir/xmcores/modules"
+)
+
+func node(fake *connectortest.Fake) modules.Node {
+	h := connector.NewHost()
+	h.SetName("worker1")
+	return modules.Node{Host: h, Conn: fake}
+}
+
+func TestParse(t *testing.T) {
+	v, err := ParseVersion("cgroup2fs\n")
+	require.NoError(t, err)
+	assert.Equal(t, V2, v)
+	v, err = ParseVersion("tmpfs")
+	require.NoError(t, err)
+	assert.Equal(t, V1, v)
+	_, err = ParseVersion("ext4")
+	assert.ErrorContains(t, err, `unexpected cgroup file system "ext4"`)
+
+	assert.Equal(t, DriverSystemd, ParseRuntimeDriver("            SystemdCgroup = true\n"))
+	assert.Equal(t, DriverCgroupfs, ParseRuntimeDriver("            SystemdCgroup = false\n"))
+	assert.Equal(t, DriverCgroupfs, ParseRuntimeDriver(""))
+}
+
+func TestApply(t *testing.T) {
+	ctx := context.Background()
+
+	fake := connectortest.NewFake().
+		On(`stat -fc`, connectortest.Result{Stdout: "cgroup2fs\n"}).
+		On(`cat /etc/os-release`, connectortest.Result{Stdout: "ID=ubuntu\n"}).
+		On(`grep -E .*\^\[\[:space:\]\]\*SystemdCgroup`, connectortest.Result{Stdout: "            SystemdCgroup = true\n"})
+	require.NoError(t, Apply(ctx, node(fake), DriverSystemd))
+	assert.False(t, fake.Ran(`sed -ri`), "a matching configuration is left alone")
+	assert.False(t, fake.Ran(`restart containerd`))
+
+	fake = connectortest.NewFake().
+		On(`stat -fc`, connectortest.Result{Stdout: "cgroup2fs\n"}).
+		On(`cat /etc/os-release`, connectortest.Result{Stdout: "ID=ubuntu\n"}).
+		On(`grep -E .*\^\[\[:space:\]\]\*SystemdCgroup`, connectortest.Result{Stdout: "            SystemdCgroup = false\n"})
+	require.NoError(t, Apply(ctx, node(fake), DriverSystemd))
+	assert.True(t, fake.Ran(`then sed -ri .*s/.*SystemdCgroup.*1 true/.* /etc/containerd/config\.toml;`))
+	assert.True(t, fake.Ran(`systemctl restart containerd`))
+	assert.False(t, fake.Ran(`containerd config default`), "an existing configuration is kept")
+
+	fake = connectortest.NewFake().
+		On(`stat -fc`, connectortest.Result{Stdout: "cgroup2fs\n"}).
+		On(`cat /etc/os-release`, connectortest.Result{Stdout: "ID=ubuntu\n"}).
+		On(`test -f /etc/containerd/config.toml`, connectortest.Result{ExitCode: 1})
+	require.NoError(t, Apply(ctx, node(fake), DriverSystemd))
+	assert.True(t, fake.Ran(`containerd config default > /etc/containerd/config.toml`), "the default configuration is written")
+	assert.True(t, fake.Ran(`systemctl restart containerd`))
+
+	fake = connectortest.NewFake().
+		On(`stat -fc`, connectortest.Result{Stdout: "cgroup2fs\n"}).
+		On(`cat /etc/os-release`, connectortest.Result{Stdout: "ID=ubuntu\n"}).
+		On(`else exit 3`, connectortest.Result{ExitCode: 3})
+	err := Apply(ctx, node(fake), DriverSystemd)
+	assert.Equal(t, errs.Preflight, errs.KindOf(err))
+	assert.ErrorContains(t, err, "no options section for the runc runtime; set SystemdCgroup = true")
+	assert.False(t, fake.Ran(`restart containerd`))
+}
+
+func TestCheck(t *testing.T) {
+	err := State{Version: V2, InitSystem: "openrc"}.Check(DriverSystemd)
+	assert.Equal(t, errs.Preflight, errs.KindOf(err))
+	assert.ErrorContains(t, err, "set spec.kubeadmExtra.kubeletConfiguration.cgroupDriver to cgroupfs")
+	assert.NoError(t, State{Version: V2, InitSystem: "openrc"}.Check(DriverCgroupfs))
+	assert.NoError(t, State{Version: V1, InitSystem: "systemd"}.Check(DriverSystemd))
+	assert.Equal(t, errs.Config, errs.KindOf(State{InitSystem: "systemd"}.Check("docker")))
+}
@@ -0,0 +1,83 @@
+package modules
+
+import (
+	"context"
+	"sync"
+
+	"github.com/mensylisir/xmcores/connector"
+)
+
+// ConnectionConfig returns the SSH settings of host.
+func ConnectionConfig(host connector.Host) connector.Config {
+	return connector.Config{
+		Username:   host.GetUser(),
+		Password:   host.GetPassword(),
+		Address:    host.GetAddress(),
+		Port:       host.GetPort(),
+		PrivateKey: host.GetPrivateKey(),
+		KeyFile:    host.GetPrivateKeyPath(),
+		Timeout:    host.GetTimeout(),
+	}
+}
+
+// Dialer opens a connection to host.
+type Dialer func(host connector.Host) (connector.Connection, error)
+
+// DialSSH connects to host over SSH.
+func DialSSH(host connector.Host) (connector.Connection, error) {
+	return connector.NewConnection(ConnectionConfig(host))
+}
+
+// Connect opens an SSH connection to every host, see ConnectWith.
+func Connect(ctx context.Context, hosts []connector.Host) ([]Node, error) {
+	return ConnectWith(ctx, hosts, DialSSH)
+}
+
+// ConnectWith opens a connection to every host concurrently with dial. If any
+// host cannot be reached the connections already opened are closed and the
+// joined errors are returned. When connector.EnvChaos is set, the connections
+// inject the failures it configures. When ctx carries a ConnStats, the
+// connections are recorded in it.
+func ConnectWith(ctx context.Context, hosts []connector.Host, dial Dialer) ([]Node, error) {
+	chaos, err := connector.ChaosFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	nodes := make([]Node, len(hosts))
+	for i, h := range hosts {
+		nodes[i].Host = h
+	}
+	var mu sync.Mutex
+	err = ForEach(ctx, nodes, func(ctx context.Context, node Node) error {
+		conn, err := dial(node.Host)
+		if err != nil {
+			return err
+		}
+		conn = chaos.Wrap(conn, node.Name())
+		if stats, ok := ConnStatsFrom(ctx); ok {
+			stats.Add(node.Name(), conn)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for i := range nodes {
+			if nodes[i].Host == node.Host {
+				nodes[i].Conn = conn
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		Close(nodes)
+		return nil, err
+	}
+	return nodes, nil
+}
+
+// Close closes the connections of nodes, skipping nodes without one.
+func Close(nodes []Node) {
+	for _, n := range nodes {
+		if n.Conn != nil {
+			_ = n.Conn.Close()
+		}
+	}
+}
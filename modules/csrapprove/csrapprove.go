@@ -0,0 +1,270 @@
+// Package csrapprove approves the certificate signing requests of kubelet
+// serving certificates. Kubelets running with rotate-server-certificates
+// (serverTLSBootstrap) request their serving certificate from the cluster
+// instead of signing their own, and no controller of a kubeadm cluster
+// approves these requests: until someone does, kubectl logs and exec fail
+// against the node. The matching is strict, as an approved request lets its
+// holder serve as the node: only requests made by the kubelet of an expected
+// node, for that node alone, its configured addresses and the serving usages
+// are approved. Others are left pending for the operator.
+package csrapprove
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/mensylisir/xmcores/connector"
+	"github.com/mensylisir/xmcores/kube"
+	"github.com/mensylisir/xmcores/logger"
+	"github.com/mensylisir/xmcores/wait"
+)
+
+const moduleName = "CSRApprove"
+
+const (
+	// SignerKubeletServing signs the serving certificates of kubelets.
+	SignerKubeletServing = "kubernetes.io/kubelet-serving"
+	// Reason is the reason of the Approved condition set on the requests.
+	Reason = "XmcoresApproved"
+	// DefaultTimeout bounds the wait for the request of a node in Wait.
+	DefaultTimeout = 5 * time.Minute
+)
+
+const (
+	nodeUserPrefix = "system:node:"
+	nodesGroup     = "system:nodes"
+	usageServer    = "server auth"
+)
+
+// allowedUsages are the key usages a kubelet serving certificate may have.
+var allowedUsages = map[string]bool{
+	"digital signature": true,
+	"key encipherment":  true,
+	usageServer:         true,
+}
+
+// Node is a node whose kubelet serving requests may be approved.
+type Node struct {
+	Name string
+	// Addresses are the IP addresses and DNS names the certificate may name
+	// besides Name.
+	Addresses []string
+}
+
+// NodeOf returns the node of host, whose certificate may name its address
+// and internal addresses.
+func NodeOf(host connector.Host) Node {
+	n := Node{Name: host.GetName()}
+	seen := map[string]bool{}
+	for _, a := range []string{host.GetAddress(), host.GetInternalIPv4Address(), host.GetInternalIPv6Address()} {
+		if a != "" && !seen[a] {
+			seen[a] = true
+			n.Addresses = append(n.Addresses, a)
+		}
+	}
+	return n
+}
+
+// NodeName returns the node whose kubelet made csr, empty when it was not
+// made by a kubelet.
+func NodeName(csr kube.CertificateSigningRequest) string {
+	if !strings.HasPrefix(csr.Spec.Username, nodeUserPrefix) {
+		return ""
+	}
+	return strings.TrimPrefix(csr.Spec.Username, nodeUserPrefix)
+}
+
+// Status returns Approved, Denied or Failed when csr was decided, else "".
+func Status(csr kube.CertificateSigningRequest) string {
+	for _, c := range csr.Status.Conditions {
+		switch c.Type {
+		case "Approved", "Denied", "Failed":
+			if c.Status == "True" {
+				return c.Type
+			}
+		}
+	}
+	return ""
+}
+
+// Check returns nil when csr is a kubelet serving request of one of nodes
+// that may be approved, else why it may not.
+func Check(csr kube.CertificateSigningRequest, nodes []Node) error {
+	if csr.Spec.SignerName != SignerKubeletServing {
+		return fmt.Errorf("signer is %q, not %s", csr.Spec.SignerName, SignerKubeletServing)
+	}
+	name := NodeName(csr)
+	if name == "" {
+		return fmt.Errorf("requested by %q, not a node", csr.Spec.Username)
+	}
+	var node *Node
+	for i := range nodes {
+		if nodes[i].Name == name {
+			node = &nodes[i]
+		}
+	}
+	if node == nil {
+		return fmt.Errorf("node %s is not expected", name)
+	}
+	if !contains(csr.Spec.Groups, nodesGroup) {
+		return fmt.Errorf("requester is not in the %s group", nodesGroup)
+	}
+	if !contains(csr.Spec.Usages, usageServer) {
+		return fmt.Errorf("usages %v lack %s", csr.Spec.Usages, usageServer)
+	}
+	for _, u := range csr.Spec.Usages {
+		if !allowedUsages[u] {
+			return fmt.Errorf("usage %q is not one of a serving certificate", u)
+		}
+	}
+	block, _ := pem.Decode(csr.Spec.Request)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return errors.New("request is not a PEM-encoded certificate request")
+	}
+	req, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("failed to parse the request: %w", err)
+	}
+	if err := req.CheckSignature(); err != nil {
+		return fmt.Errorf("invalid request signature: %w", err)
+	}
+	if req.Subject.CommonName != csr.Spec.Username {
+		return fmt.Errorf("subject common name %q differs from the requester", req.Subject.CommonName)
+	}
+	if len(req.Subject.Organization) != 1 || req.Subject.Organization[0] != nodesGroup {
+		return fmt.Errorf("subject organization %v is not [%s]", req.Subject.Organization, nodesGroup)
+	}
+	if len(req.EmailAddresses) > 0 || len(req.URIs) > 0 {
+		return errors.New("request names email addresses or URIs")
+	}
+	if len(req.DNSNames) == 0 && len(req.IPAddresses) == 0 {
+		return errors.New("request names no DNS name or IP address")
+	}
+	dnsNames, ips := map[string]bool{name: true}, map[string]bool{}
+	for _, a := range node.Addresses {
+		if ip := net.ParseIP(a); ip != nil {
+			ips[ip.String()] = true
+		} else {
+			dnsNames[a] = true
+		}
+	}
+	for _, d := range req.DNSNames {
+		if !dnsNames[d] {
+			return fmt.Errorf("DNS name %q is not one of node %s", d, name)
+		}
+	}
+	for _, ip := range req.IPAddresses {
+		if !ips[ip.String()] {
+			return fmt.Errorf("IP address %s is not one of node %s", ip, name)
+		}
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Approve approves csr.
+func Approve(ctx context.Context, kc *kube.Client, csr kube.CertificateSigningRequest) error {
+	csr.APIVersion, csr.Kind = "certificates.k8s.io/v1", "CertificateSigningRequest"
+	csr.Status.Conditions = append(csr.Status.Conditions, kube.Condition{
+		Type:    "Approved",
+		Status:  "True",
+		Reason:  Reason,
+		Message: "kubelet serving certificate of a node in the configuration",
+	})
+	if err := kc.Put(ctx, kube.CSRPath(csr.Metadata.Name)+"/approval", csr, nil); err != nil {
+		return fmt.Errorf("failed to approve %s: %w", csr.Metadata.Name, err)
+	}
+	return nil
+}
+
+// servingCSRs lists the kubelet serving requests.
+func servingCSRs(ctx context.Context, kc *kube.Client) ([]kube.CertificateSigningRequest, error) {
+	var list kube.CertificateSigningRequestList
+	if err := kc.Get(ctx, kube.CSRsPath, &list); err != nil {
+		return nil, err
+	}
+	var csrs []kube.CertificateSigningRequest
+	for _, csr := range list.Items {
+		if csr.Spec.SignerName == SignerKubeletServing {
+			csrs = append(csrs, csr)
+		}
+	}
+	return csrs, nil
+}
+
+// ApprovePending approves the pending kubelet serving requests of nodes that
+// pass Check and returns the names of the requests approved. The others are
+// logged and left pending.
+func ApprovePending(ctx context.Context, kc *kube.Client, nodes []Node) ([]string, error) {
+	csrs, err := servingCSRs(ctx, kc)
+	if err != nil {
+		return nil, err
+	}
+	var approved []string
+	for _, csr := range csrs {
+		if Status(csr) != "" {
+			continue
+		}
+		if err := Check(csr, nodes); err != nil {
+			logger.Log.Warnf("Left certificate signing request %s pending: %v", csr.Metadata.Name, err)
+			continue
+		}
+		if err := Approve(ctx, kc, csr); err != nil {
+			return approved, err
+		}
+		logger.Log.InfofModule(moduleName, "%s: approved serving certificate request %s", NodeName(csr), csr.Metadata.Name)
+		approved = append(approved, csr.Metadata.Name)
+	}
+	return approved, nil
+}
+
+// Wait approves the kubelet serving request of node once the kubelet made
+// one, e.g. after the node joined, and returns when a request of the node is
+// approved. A request failing Check is not approved and the wait times out
+// after timeout, DefaultTimeout when zero, naming why.
+func Wait(ctx context.Context, kc *kube.Client, node Node, timeout time.Duration) error {
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	return wait.Poll(ctx, wait.Options{Timeout: timeout}, "the serving certificate request of "+node.Name, func(ctx context.Context) (bool, error) {
+		csrs, err := servingCSRs(ctx, kc)
+		if err != nil {
+			return false, err
+		}
+		reason := errors.New("no request from the kubelet yet")
+		for _, csr := range csrs {
+			if NodeName(csr) != node.Name {
+				continue
+			}
+			switch Status(csr) {
+			case "Approved":
+				return true, nil
+			case "":
+				if err := Check(csr, []Node{node}); err != nil {
+					reason = fmt.Errorf("request %s not approved: %w", csr.Metadata.Name, err)
+					continue
+				}
+				if err := Approve(ctx, kc, csr); err != nil {
+					return false, err
+				}
+				logger.Log.InfofModule(moduleName, "%s: approved serving certificate request %s", node.Name, csr.Metadata.Name)
+				return true, nil
+			}
+		}
+		return false, reason
+	})
+}
@@ -0,0 +1,186 @@
+package csrapprove
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mensylisir/xmcores/kube"
+)
+
+// servingCSR returns a kubelet serving request of node naming dnsNames and
+// ips, as the kubelet makes it, changed by mutate.
+func servingCSR(t *testing.T, name, node string, dnsNames []string, ips []string, mutate func(*x509.CertificateRequest, *kube.CertificateSigningRequest)) kube.CertificateSigningRequest {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: "system:node:" + node, Organization: []string{"system:nodes"}},
+		DNSNames: dnsNames,
+	}
+	for _, ip := range ips {
+		tmpl.IPAddresses = append(tmpl.IPAddresses, net.ParseIP(ip))
+	}
+	csr := kube.CertificateSigningRequest{}
+	csr.Metadata.Name = name
+	csr.Spec.SignerName = SignerKubeletServing
+	csr.Spec.Username = "system:node:" + node
+	csr.Spec.Groups = []string{"system:nodes", "system:authenticated"}
+	csr.Spec.Usages = []string{"digital signature", "server auth"}
+	if mutate != nil {
+		mutate(tmpl, &csr)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, tmpl, key)
+	require.NoError(t, err)
+	csr.Spec.Request = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})
+	return csr
+}
+
+var worker1 = Node{Name: "worker1", Addresses: []string{"10.0.0.2", "fd00::2"}}
+
+func TestCheck(t *testing.T) {
+	ok := servingCSR(t, "csr-ok", "worker1", []string{"worker1"}, []string{"10.0.0.2", "fd00::2"}, nil)
+	assert.NoError(t, Check(ok, []Node{worker1}))
+
+	for _, tc := range []struct {
+		name   string
+		csr    kube.CertificateSigningRequest
+		reason string
+	}{
+		{"other signer", servingCSR(t, "a", "worker1", []string{"worker1"}, nil, func(_ *x509.CertificateRequest, c *kube.CertificateSigningRequest) {
+			c.Spec.SignerName = "kubernetes.io/kube-apiserver-client-kubelet"
+		}), "signer is"},
+		{"not a node", servingCSR(t, "a", "worker1", []string{"worker1"}, nil, func(_ *x509.CertificateRequest, c *kube.CertificateSigningRequest) {
+			c.Spec.Username = "alice"
+		}), "not a node"},
+		{"unexpected node", servingCSR(t, "a", "worker9", []string{"worker9"}, nil, nil), "node worker9 is not expected"},
+		{"not in nodes group", servingCSR(t, "a", "worker1", []string{"worker1"}, nil, func(_ *x509.CertificateRequest, c *kube.CertificateSigningRequest) {
+			c.Spec.Groups = []string{"system:authenticated"}
+		}), "group"},
+		{"client usage", servingCSR(t, "a", "worker1", []string{"worker1"}, nil, func(_ *x509.CertificateRequest, c *kube.CertificateSigningRequest) {
+			c.Spec.Usages = append(c.Spec.Usages, "client auth")
+		}), `usage "client auth"`},
+		{"no server usage", servingCSR(t, "a", "worker1", []string{"worker1"}, nil, func(_ *x509.CertificateRequest, c *kube.CertificateSigningRequest) {
+			c.Spec.Usages = []string{"digital signature"}
+		}), "lack server auth"},
+		{"subject of another node", servingCSR(t, "a", "worker1", []string{"worker1"}, nil, func(r *x509.CertificateRequest, _ *kube.CertificateSigningRequest) {
+			r.Subject.CommonName = "system:node:master1"
+		}), "common name"},
+		{"extra organization", servingCSR(t, "a", "worker1", []string{"worker1"}, nil, func(r *x509.CertificateRequest, _ *kube.CertificateSigningRequest) {
+			r.Subject.Organization = append(r.Subject.Organization, "system:masters")
+		}), "organization"},
+		{"foreign DNS name", servingCSR(t, "a", "worker1", []string{"worker1", "api.example.com"}, nil, nil), `DNS name "api.example.com"`},
+		{"foreign IP", servingCSR(t, "a", "worker1", []string{"worker1"}, []string{"10.0.0.1"}, nil), "IP address 10.0.0.1"},
+		{"email", servingCSR(t, "a", "worker1", []string{"worker1"}, nil, func(r *x509.CertificateRequest, _ *kube.CertificateSigningRequest) {
+			r.EmailAddresses = []string{"root@worker1"}
+		}), "email"},
+		{"no names", servingCSR(t, "a", "worker1", nil, nil, nil), "no DNS name"},
+		{"garbage", func() kube.CertificateSigningRequest {
+			c := servingCSR(t, "a", "worker1", []string{"worker1"}, nil, nil)
+			c.Spec.Request = []byte("not a request")
+			return c
+		}(), "PEM"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.ErrorContains(t, Check(tc.csr, []Node{worker1}), tc.reason)
+		})
+	}
+}
+
+// fakeAPIServer serves CSRs and records the approvals.
+type fakeAPIServer struct {
+	mu       sync.Mutex
+	csrs     map[string]kube.CertificateSigningRequest
+	approved []string
+}
+
+func (f *fakeAPIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == kube.CSRsPath:
+		list := kube.CertificateSigningRequestList{}
+		for _, c := range f.csrs {
+			list.Items = append(list.Items, c)
+		}
+		_ = json.NewEncoder(w).Encode(list)
+	case r.Method == http.MethodPut && strings.HasSuffix(r.URL.Path, "/approval"):
+		var c kube.CertificateSigningRequest
+		if err := json.NewDecoder(r.Body).Decode(&c); err != nil || kube.CSRPath(c.Metadata.Name)+"/approval" != r.URL.Path {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.csrs[c.Metadata.Name] = c
+		f.approved = append(f.approved, c.Metadata.Name)
+		_ = json.NewEncoder(w).Encode(c)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func newFake(t *testing.T, csrs ...kube.CertificateSigningRequest) (*fakeAPIServer, *kube.Client) {
+	f := &fakeAPIServer{csrs: map[string]kube.CertificateSigningRequest{}}
+	for _, c := range csrs {
+		f.csrs[c.Metadata.Name] = c
+	}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	kc, err := kube.NewClient(kube.RESTConfig{Server: srv.URL})
+	require.NoError(t, err)
+	return f, kc
+}
+
+func TestApprovePending(t *testing.T) {
+	denied := servingCSR(t, "csr-denied", "worker1", []string{"worker1"}, nil, nil)
+	denied.Status.Conditions = []kube.Condition{{Type: "Denied", Status: "True"}}
+	f, kc := newFake(t,
+		servingCSR(t, "csr-ok", "worker1", []string{"worker1"}, []string{"10.0.0.2"}, nil),
+		servingCSR(t, "csr-foreign-ip", "worker1", []string{"worker1"}, []string{"192.168.1.1"}, nil),
+		servingCSR(t, "csr-unknown", "worker9", []string{"worker9"}, nil, nil),
+		denied,
+	)
+
+	approved, err := ApprovePending(context.Background(), kc, []Node{worker1})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"csr-ok"}, approved)
+	assert.Equal(t, []string{"csr-ok"}, f.approved)
+	assert.Equal(t, "Approved", Status(f.csrs["csr-ok"]))
+	assert.Equal(t, Reason, f.csrs["csr-ok"].Status.Conditions[0].Reason)
+	assert.Equal(t, "", Status(f.csrs["csr-foreign-ip"]), "mismatching requests stay pending")
+
+	approved, err = ApprovePending(context.Background(), kc, []Node{worker1})
+	require.NoError(t, err)
+	assert.Empty(t, approved, "approved requests are not approved again")
+}
+
+func TestWait(t *testing.T) {
+	f, kc := newFake(t,
+		servingCSR(t, "csr-master", "master1", []string{"master1"}, nil, nil),
+		servingCSR(t, "csr-worker", "worker1", []string{"worker1"}, []string{"10.0.0.2"}, nil),
+	)
+	require.NoError(t, Wait(context.Background(), kc, worker1, time.Second))
+	assert.Equal(t, []string{"csr-worker"}, f.approved, "only the request of the node is approved")
+
+	require.NoError(t, Wait(context.Background(), kc, worker1, time.Second), "an approved request satisfies the wait")
+	assert.Len(t, f.approved, 1)
+
+	_, kc = newFake(t, servingCSR(t, "csr-bad", "worker1", []string{"worker1", "evil.example.com"}, nil, nil))
+	err := Wait(context.Background(), kc, worker1, 100*time.Millisecond)
+	require.Error(t, err)
+	assert.ErrorContains(t, err, `request csr-bad not approved: DNS name "evil.example.com"`)
+}
@@ -0,0 +1,183 @@
+// Package diag collects troubleshooting data from cluster nodes into a single
+// tarball for support escalation. Every command is best effort: a failure is
+// recorded in the bundle instead of aborting the collection, and all output is
+// sanitized before it is written.
+package diag
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/mensylisir/xmcores/common"
+	"github.com/mensylisir/xmcores/connector"
+	"github.com/mensylisir/xmcores/file"
+	"github.com/mensylisir/xmcores/logger"
+	"github.com/mensylisir/xmcores/modules"
+)
+
+const moduleName = "Diag"
+
+const (
+	DefaultSince    = 2 * time.Hour
+	DefaultMaxLines = 2000
+)
+
+// DefaultUnits are the systemd units whose journal is collected by default.
+var DefaultUnits = []string{"kubelet", "containerd"}
+
+// Config controls what is collected.
+type Config struct {
+	// Since limits journal entries and pod logs to this window.
+	Since time.Duration `yaml:"since,omitempty" json:"since,omitempty"`
+	// MaxLines caps the lines taken from each journal and log file.
+	MaxLines int `yaml:"maxLines,omitempty" json:"maxLines,omitempty"`
+	// Units whose journal is collected.
+	Units []string `yaml:"units,omitempty" json:"units,omitempty"`
+}
+
+// SetDefaults fills unset fields.
+func (c *Config) SetDefaults() {
+	if c.Since == 0 {
+		c.Since = DefaultSince
+	}
+	if c.MaxLines == 0 {
+		c.MaxLines = DefaultMaxLines
+	}
+	if len(c.Units) == 0 {
+		c.Units = DefaultUnits
+	}
+}
+
+var unitPattern = regexp.MustCompile(`^[A-Za-z0-9@._-]+$`)
+
+// Validate checks the configuration.
+func (c *Config) Validate() error {
+	var errs []error
+	if c.Since < 0 {
+		errs = append(errs, errors.New("since must not be negative"))
+	}
+	if c.MaxLines < 0 {
+		errs = append(errs, errors.New("maxLines must not be negative"))
+	}
+	for _, u := range c.Units {
+		if !unitPattern.MatchString(u) {
+			errs = append(errs, fmt.Errorf("invalid unit name %q", u))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Command is one piece of collected data: the output of Cmd is stored as File.
+type Command struct {
+	File string
+	Cmd  string
+}
+
+// Commands returns the commands run on every node.
+func Commands(cfg Config) []Command {
+	since := int(cfg.Since / time.Second)
+	minutes := int(cfg.Since / time.Minute)
+	if minutes < 1 {
+		minutes = 1
+	}
+	var cmds []Command
+	for _, u := range cfg.Units {
+		cmds = append(cmds, Command{
+			File: "journal-" + u + ".log",
+			Cmd:  fmt.Sprintf("journalctl -u %s --since=-%ds --no-pager -n %d 2>&1", u, since, cfg.MaxLines),
+		})
+	}
+	return append(cmds,
+		Command{File: "system.txt", Cmd: "uname -a; cat /etc/os-release; uptime 2>&1"},
+		Command{File: "kubeadm.txt", Cmd: fmt.Sprintf("ls -l /etc/kubernetes /etc/kubernetes/manifests 2>&1; "+
+			"cat /var/lib/kubelet/kubeadm-flags.env 2>&1; "+
+			"find /var/log -maxdepth 1 -name 'kubeadm*' -type f -exec tail -n %d {} + 2>&1", cfg.MaxLines)},
+		Command{File: "pods.log", Cmd: fmt.Sprintf("find /var/log/pods -name '*.log' -mmin -%d -exec tail -n 200 {} + 2>&1 | tail -n %d", minutes, cfg.MaxLines)},
+		Command{File: "network.txt", Cmd: fmt.Sprintf("ip addr show 2>&1; ip route show 2>&1; cat /etc/resolv.conf 2>&1; "+
+			"ss -lntup 2>&1; iptables-save 2>&1 | head -n %d", cfg.MaxLines)},
+		Command{File: "resources.txt", Cmd: "df -h 2>&1; df -i 2>&1; free -m 2>&1"},
+	)
+}
+
+var redactions = []struct {
+	re   *regexp.Regexp
+	repl string
+}{
+	{regexp.MustCompile(`(?s)-----BEGIN [A-Z ]*PRIVATE KEY-----.*?-----END [A-Z ]*PRIVATE KEY-----`), "<redacted private key>"},
+	{regexp.MustCompile(`(?i)(authorization:\s*bearer\s+)\S+`), "${1}<redacted>"},
+	{regexp.MustCompile(`(?i)(--(?:token|password|discovery-token-ca-cert-hash|certificate-key)[= ])\S+`), "${1}<redacted>"},
+	{regexp.MustCompile(`(?i)((?:client-key-data|token|password|passwd|secret)"?\s*[:=]\s*"?)[^\s",]+`), "${1}<redacted>"},
+}
+
+// Sanitize removes private keys, tokens and passwords from collected output.
+func Sanitize(data []byte) []byte {
+	for _, r := range redactions {
+		data = r.re.ReplaceAll(data, []byte(r.repl))
+	}
+	return data
+}
+
+// run executes cmd and returns its sanitized output, noting a non-zero exit
+// code or a transport error in the output instead of failing.
+func run(ctx context.Context, exec connector.Executor, cmd string) []byte {
+	stdout, stderr, exitCode, err := exec.Exec(ctx, connector.SudoCommand(ctx, exec, cmd))
+	out := append(stdout, stderr...)
+	if err != nil {
+		out = append(out, fmt.Sprintf("\n# collection failed: %v\n", err)...)
+	} else if exitCode != 0 {
+		out = append(out, fmt.Sprintf("\n# exit code %d\n", exitCode)...)
+	}
+	return Sanitize(out)
+}
+
+// Collect gathers the diagnostics of nodes into a gzipped tarball in dir and
+// returns its path. Remote failures are recorded in the collected files; only
+// local I/O errors and cancellation abort the collection.
+func Collect(ctx context.Context, nodes []modules.Node, cfg Config, dir string) (string, error) {
+	cfg.SetDefaults()
+	if err := cfg.Validate(); err != nil {
+		return "", err
+	}
+	name := "diag-" + time.Now().UTC().Format("20060102T150405Z")
+	staging := filepath.Join(dir, name)
+	if err := os.MkdirAll(staging, common.FileMode0700); err != nil {
+		return "", fmt.Errorf("failed to create %s: %w", staging, err)
+	}
+	defer os.RemoveAll(staging)
+
+	logger.Log.InfofModule(moduleName, "collecting diagnostics from %d nodes", len(nodes))
+	cmds := Commands(cfg)
+	err := modules.ForEach(ctx, nodes, func(ctx context.Context, node modules.Node) error {
+		nodeDir := filepath.Join(staging, node.Name())
+		if err := os.MkdirAll(nodeDir, common.FileMode0700); err != nil {
+			return err
+		}
+		for _, c := range cmds {
+			if err := os.WriteFile(filepath.Join(nodeDir, c.File), run(ctx, node.Conn, c.Cmd), common.FileMode0600); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to write diagnostics: %w", err)
+	}
+	if ctx.Err() != nil {
+		return "", ctx.Err()
+	}
+
+	bundle := staging + ".tar.gz"
+	if err := file.Tar(staging, bundle, dir); err != nil {
+		return "", err
+	}
+	if err := os.Chmod(bundle, common.FileMode0600); err != nil {
+		return "", err
+	}
+	logger.Log.InfofModule(moduleName, "diagnostics written to %s", bundle)
+	return bundle, nil
+}
@@ -0,0 +1,216 @@
+package modules
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/mensylisir/xmcores/common"
+	"github.com/mensylisir/xmcores/logger"
+	"github.com/mensylisir/xmcores/shellquote"
+)
+
+// Ways Distribute copies an artifact to the nodes.
+const (
+	// DistributeDirect uploads the artifact from the controller to every node.
+	DistributeDirect = "direct"
+	// DistributePeer uploads it to one seed node only; every node holding a
+	// copy then passes it on to one that does not, doubling the holders each
+	// round, so the controller's uplink carries it once.
+	DistributePeer = "p2p"
+)
+
+// ValidateDistribution checks a distribution strategy name; empty means
+// DistributeDirect.
+func ValidateDistribution(strategy string) error {
+	switch strategy {
+	case "", DistributeDirect, DistributePeer:
+		return nil
+	}
+	return fmt.Errorf("unsupported distribution %q (use %q or %q)", strategy, DistributeDirect, DistributePeer)
+}
+
+// Distribute copies the local file localPath to remotePath on every node,
+// creating the parent directory, with the given strategy.
+//
+// Peer copies run scp on the sending node, as root, authenticated with a key
+// pair generated for this call: the private key is written to the senders and
+// the public key authorized for the connecting user on the receivers, and
+// both are removed again at the end. Nodes must reach each other's SSH port
+// on their internal address. A node a peer copy fails for gets the file from
+// the controller instead.
+func Distribute(ctx context.Context, nodes []Node, localPath, remotePath, strategy string) error {
+	if err := ValidateDistribution(strategy); err != nil {
+		return err
+	}
+	upload := func(ctx context.Context, node Node) error {
+		if err := node.Conn.MkDirAll(ctx, path.Dir(remotePath), common.FileMode0755); err != nil {
+			return fmt.Errorf("failed to create %s: %w", path.Dir(remotePath), err)
+		}
+		if err := node.Conn.UploadFile(ctx, localPath, remotePath); err != nil {
+			return fmt.Errorf("failed to upload %s: %w", localPath, err)
+		}
+		return nil
+	}
+	if strategy != DistributePeer || len(nodes) < 2 {
+		return ForEach(ctx, nodes, upload)
+	}
+
+	d, err := newPeerDistribution(remotePath)
+	if err != nil {
+		return err
+	}
+	defer d.cleanup(ctx)
+
+	seed := nodes[0]
+	if err := ForEach(ctx, nodes[:1], func(ctx context.Context, node Node) error {
+		if err := upload(ctx, node); err != nil {
+			return err
+		}
+		return d.addSender(ctx, node)
+	}); err != nil {
+		return err
+	}
+	holders, pending := []Node{seed}, nodes[1:]
+	var failed []error
+	for len(pending) > 0 {
+		n := min(len(holders), len(pending))
+		round := pending[:n]
+		pending = pending[n:]
+		senders := make(map[string]Node, n)
+		for i, node := range round {
+			senders[node.Name()] = holders[i]
+		}
+		var mu sync.Mutex
+		if err := ForEach(ctx, round, func(ctx context.Context, node Node) error {
+			from := senders[node.Name()]
+			err := d.copy(ctx, from, node)
+			if err != nil {
+				logger.Log.WarnfModule(distributeModule, "copying %s from %s to %s failed, uploading it from the controller: %v", remotePath, from.Name(), node.Name(), err)
+				if err := upload(ctx, node); err != nil {
+					return err
+				}
+			}
+			if err := d.addSender(ctx, node); err != nil {
+				return err
+			}
+			mu.Lock()
+			holders = append(holders, node)
+			mu.Unlock()
+			return nil
+		}); err != nil {
+			failed = append(failed, err)
+		}
+	}
+	return errors.Join(failed...)
+}
+
+const distributeModule = "Distribute"
+
+// peerDistribution holds the state of one peer-to-peer Distribute call.
+type peerDistribution struct {
+	id         string
+	remotePath string
+	privateKey []byte
+	authorized string
+
+	mu         sync.Mutex
+	senders    []Node
+	authorizes []Node
+}
+
+func newPeerDistribution(remotePath string) (*peerDistribution, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate distribution key: %w", err)
+	}
+	id := "xm-distribute-" + uuid.New().String()[:8]
+	block, err := ssh.MarshalPrivateKey(priv, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode distribution key: %w", err)
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode distribution key: %w", err)
+	}
+	return &peerDistribution{
+		id:         id,
+		remotePath: remotePath,
+		privateKey: pem.EncodeToMemory(block),
+		authorized: strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPub))) + " " + id,
+	}, nil
+}
+
+func (d *peerDistribution) keyPath() string {
+	return path.Join(common.GetTmpDir(), d.id+".key")
+}
+
+// addSender gives node the private key, so that it can pass the file on.
+func (d *peerDistribution) addSender(ctx context.Context, node Node) error {
+	if err := node.Conn.MkDirAll(ctx, common.GetTmpDir(), common.FileMode0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", common.GetTmpDir(), err)
+	}
+	TrackTemp(ctx, node, d.keyPath())
+	d.mu.Lock()
+	d.senders = append(d.senders, node)
+	d.mu.Unlock()
+	return WriteFile(ctx, node.Conn, d.privateKey, d.keyPath(), common.FileMode0600)
+}
+
+// copy sends the file from one node to another through a temporary file,
+// since the receiving user may not be allowed to write remotePath.
+func (d *peerDistribution) copy(ctx context.Context, from, to Node) error {
+	d.mu.Lock()
+	d.authorizes = append(d.authorizes, to)
+	d.mu.Unlock()
+	if _, err := RunUnprivileged(ctx, to.Conn, fmt.Sprintf(
+		"mkdir -p ~/.ssh && chmod 700 ~/.ssh && echo %s >> ~/.ssh/authorized_keys && chmod 600 ~/.ssh/authorized_keys", shellquote.Quote(d.authorized))); err != nil {
+		return err
+	}
+	addr := to.Host.GetInternalIPv4Address()
+	if addr == "" {
+		addr = to.Host.GetAddress()
+	}
+	if strings.Contains(addr, ":") {
+		addr = "[" + addr + "]"
+	}
+	tmp := path.Join("/tmp", d.id+"-"+path.Base(d.remotePath))
+	TrackTemp(ctx, to, tmp)
+	if _, err := Run(ctx, from.Conn, fmt.Sprintf(
+		"scp -q -B -i %s -P %d -o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null %s %s",
+		shellquote.Quote(d.keyPath()), to.Host.GetPort(), shellquote.Quote(d.remotePath), shellquote.Quote(to.Host.GetUser()+"@"+addr+":"+tmp))); err != nil {
+		return err
+	}
+	if _, err := Run(ctx, to.Conn, fmt.Sprintf("mkdir -p %s && mv -f %s %s",
+		shellquote.Quote(path.Dir(d.remotePath)), shellquote.Quote(tmp), shellquote.Quote(d.remotePath))); err != nil {
+		return err
+	}
+	UntrackTemp(ctx, to, tmp)
+	return nil
+}
+
+// cleanup removes the private keys and the authorizations. Failures are only
+// logged; the keys stay tracked for the end-of-run cleanup.
+func (d *peerDistribution) cleanup(ctx context.Context) {
+	for _, node := range d.senders {
+		if _, err := Run(ctx, node.Conn, "rm -f "+shellquote.Quote(d.keyPath())); err != nil {
+			logger.Log.WarnfModule(distributeModule, "%s: failed to remove %s: %v", node.Name(), d.keyPath(), err)
+			continue
+		}
+		UntrackTemp(ctx, node, d.keyPath())
+	}
+	for _, node := range d.authorizes {
+		if _, err := RunUnprivileged(ctx, node.Conn, "sed -i "+shellquote.Quote("/ "+d.id+"$/d")+" ~/.ssh/authorized_keys"); err != nil {
+			logger.Log.WarnfModule(distributeModule, "%s: failed to remove the distribution key from authorized_keys: %v", node.Name(), err)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package modules_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mensylisir/xmcores/connector"
+	"github.com/mensylisir/xmcores/connector/connectortest"
+	"github.com/mensylisir/xmcores/modules"
+)
+
+func TestDistribute(t *testing.T) {
+	ctx := context.Background()
+	local := filepath.Join(t.TempDir(), "bundle.tar.gz")
+	require.NoError(t, os.WriteFile(local, []byte("bundle"), 0644))
+	const remote = "/opt/xm/bundle.tar.gz"
+
+	fakes := connectortest.NewConnector()
+	var nodes []modules.Node
+	for i := 1; i <= 5; i++ {
+		host := connector.NewHost()
+		host.SetName(fmt.Sprintf("node%d", i))
+		host.SetAddress(fmt.Sprintf("10.0.0.%d", i))
+		host.SetUser("xm")
+		host.SetPort(22)
+		fake := fakes.Host(host.GetName())
+		// Copies to node4 fail and fall back to the controller.
+		fake.On(`scp .*@10\.0\.0\.4:`, connectortest.Result{ExitCode: 1, Stderr: "Connection refused"})
+		nodes = append(nodes, modules.Node{Host: host, Conn: fake})
+	}
+	temps := modules.NewTempFiles()
+	ctx = modules.WithTempFiles(ctx, temps)
+	require.NoError(t, modules.Distribute(ctx, nodes, local, remote, modules.DistributePeer))
+
+	uploaded := func(name string) bool {
+		_, ok := fakes.Host(name).ReadFile(remote)
+		return ok
+	}
+	assert.True(t, uploaded("node1"), "the seed gets the file from the controller")
+	assert.True(t, uploaded("node4"), "the fallback uploads from the controller")
+	for _, name := range []string{"node2", "node3", "node5"} {
+		assert.False(t, uploaded(name), name)
+		assert.True(t, fakes.Host(name).Ran(`authorized_keys`), name)
+		assert.True(t, fakes.Host(name).Ran(`mv -f /tmp/xm-distribute-[0-9a-f]{8}-bundle\.tar\.gz `+remote), name)
+		assert.True(t, fakes.Host(name).Ran(`sed -i '/ xm-distribute-[0-9a-f]{8}\$/d' ~/.ssh/authorized_keys`), name)
+	}
+	// Holders double every round: node1 -> node2, then node1 -> node3 and node2 -> node4, then node1 -> node5.
+	assert.True(t, fakes.Host("node1").Ran(`scp -q -B -i /tmp/xmcores/xm-distribute-[0-9a-f]{8}\.key -P 22 .* `+remote+` xm@10\.0\.0\.2:`))
+	assert.True(t, fakes.Host("node1").Ran(`xm@10\.0\.0\.3:`))
+	assert.True(t, fakes.Host("node2").Ran(`xm@10\.0\.0\.4:`))
+	assert.True(t, fakes.Host("node1").Ran(`xm@10\.0\.0\.5:`))
+	for _, node := range nodes {
+		assert.True(t, fakes.Host(node.Name()).Ran(`rm -f /tmp/xmcores/xm-distribute-[0-9a-f]{8}\.key`), node.Name())
+		if node.Name() != "node4" {
+			assert.Empty(t, temps.Pending(node.Name()), node.Name())
+		}
+	}
+	// A partial copy from the failed scp is left for the end-of-run cleanup.
+	assert.Len(t, temps.Pending("node4"), 1)
+
+	direct := connectortest.NewConnector()
+	for i := range nodes {
+		nodes[i].Conn = direct.Host(nodes[i].Name())
+	}
+	require.NoError(t, modules.Distribute(ctx, nodes, local, remote, modules.DistributeDirect))
+	for _, node := range nodes {
+		_, ok := direct.Host(node.Name()).ReadFile(remote)
+		assert.True(t, ok, node.Name())
+		assert.Empty(t, direct.Host(node.Name()).Commands(), node.Name())
+	}
+	assert.Error(t, modules.Distribute(ctx, nodes, local, remote, "torrent"))
+}
@@ -0,0 +1,424 @@
+// Package endpointmigrate moves a kubeadm cluster to a new
+// controlPlaneEndpoint, e.g. from the address of the first control-plane node
+// to a VIP or a DNS name. The apiserver certificates are reissued with the new
+// name first, while the old one keeps working, then the kubeconfigs of the
+// nodes are switched one node at a time, and finally the objects the cluster
+// keeps the endpoint in: the kubeadm-config and cluster-info ConfigMaps and the
+// kube-proxy kubeconfig.
+package endpointmigrate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/mensylisir/xmcores/common"
+	"github.com/mensylisir/xmcores/errs"
+	"github.com/mensylisir/xmcores/kube"
+	"github.com/mensylisir/xmcores/logger"
+	"github.com/mensylisir/xmcores/modules"
+	"github.com/mensylisir/xmcores/modules/certrotate"
+	"github.com/mensylisir/xmcores/modules/kubeadm"
+	"github.com/mensylisir/xmcores/pipeline"
+	"github.com/mensylisir/xmcores/shellquote"
+	"github.com/mensylisir/xmcores/wait"
+)
+
+const moduleName = "EndpointMigrate"
+
+const (
+	DefaultRolloutTimeout = 5 * time.Minute
+	DefaultReachTimeout   = time.Minute
+
+	// ConfigPath is the kubeadm configuration the apiserver certificate is
+	// reissued from on each control-plane node.
+	ConfigPath = "/etc/kubernetes/kubeadm-endpoint.yaml"
+
+	kubeadmConfigPath = "/api/v1/namespaces/kube-system/configmaps/kubeadm-config"
+	clusterInfoPath   = "/api/v1/namespaces/kube-public/configmaps/cluster-info"
+	kubeProxyPath     = "/api/v1/namespaces/kube-system/configmaps/kube-proxy"
+	kubeProxyDSPath   = "/apis/apps/v1/namespaces/kube-system/daemonsets/kube-proxy"
+)
+
+// Kubeconfigs pointing at the endpoint. The kubeconfigs of the
+// controller-manager and the scheduler use the local apiserver and are only
+// switched when they point at the old endpoint, as in old kubeadm versions.
+var (
+	controlPlaneKubeconfigs = []string{"/etc/kubernetes/admin.conf", "/etc/kubernetes/super-admin.conf", "/etc/kubernetes/kubelet.conf"}
+	nodeKubeconfigs         = []string{"/etc/kubernetes/kubelet.conf"}
+	localKubeconfigs        = map[string]string{
+		"kube-controller-manager": "/etc/kubernetes/controller-manager.conf",
+		"kube-scheduler":          "/etc/kubernetes/scheduler.conf",
+	}
+)
+
+// Options control Migrate.
+type Options struct {
+	// Endpoint is the new controlPlaneEndpoint, host[:port].
+	Endpoint string
+	// APIServerPort is the port of Endpoint when it has none; defaults to
+	// certrotate.DefaultAPIServerPort.
+	APIServerPort int
+	// ComponentTimeout bounds the wait for a restarted component to be
+	// healthy; defaults to certrotate.DefaultComponentTimeout.
+	ComponentTimeout time.Duration
+	// RolloutTimeout bounds the restart of kube-proxy; defaults to
+	// DefaultRolloutTimeout.
+	RolloutTimeout time.Duration
+}
+
+func (o *Options) setDefaults() {
+	if o.APIServerPort == 0 {
+		o.APIServerPort = certrotate.DefaultAPIServerPort
+	}
+	if o.ComponentTimeout == 0 {
+		o.ComponentTimeout = certrotate.DefaultComponentTimeout
+	}
+	if o.RolloutTimeout == 0 {
+		o.RolloutTimeout = DefaultRolloutTimeout
+	}
+}
+
+// withPort returns endpoint with port appended when it has none.
+func withPort(endpoint string, port int) string {
+	if _, _, err := net.SplitHostPort(endpoint); err == nil {
+		return endpoint
+	}
+	return net.JoinHostPort(endpoint, strconv.Itoa(port))
+}
+
+// host returns the host part of an endpoint.
+func host(endpoint string) string {
+	if h, _, err := net.SplitHostPort(endpoint); err == nil {
+		return h
+	}
+	return endpoint
+}
+
+// LoadClusterConfiguration returns the ClusterConfiguration kubeadm stored in
+// the cluster.
+func LoadClusterConfiguration(ctx context.Context, client *kube.Client) (map[string]interface{}, error) {
+	var cm struct {
+		Data map[string]string `json:"data"`
+	}
+	if err := client.Get(ctx, kubeadmConfigPath, &cm); err != nil {
+		return nil, fmt.Errorf("failed to get kubeadm-config: %w", err)
+	}
+	cc := map[string]interface{}{}
+	if err := yaml.Unmarshal([]byte(cm.Data["ClusterConfiguration"]), &cc); err != nil {
+		return nil, fmt.Errorf("failed to parse kubeadm ClusterConfiguration: %w", err)
+	}
+	return cc, nil
+}
+
+// Endpoint returns the controlPlaneEndpoint of a ClusterConfiguration.
+func Endpoint(cc map[string]interface{}) string {
+	s, _ := cc["controlPlaneEndpoint"].(string)
+	return s
+}
+
+// Update returns a copy of cc with endpoint as controlPlaneEndpoint. The
+// hosts of both the new and the old endpoint are added to the apiserver
+// certSANs, so clients still using the old one keep working.
+func Update(cc map[string]interface{}, endpoint string) map[string]interface{} {
+	var sans []interface{}
+	seen := map[string]bool{}
+	apiServer, _ := cc["apiServer"].(map[string]interface{})
+	if list, ok := apiServer["certSANs"].([]interface{}); ok {
+		for _, v := range list {
+			seen[fmt.Sprint(v)] = true
+			sans = append(sans, v)
+		}
+	}
+	for _, e := range []string{Endpoint(cc), endpoint} {
+		if h := host(e); h != "" && !seen[h] {
+			seen[h] = true
+			sans = append(sans, h)
+		}
+	}
+	return kubeadm.DeepMerge(cc, map[string]interface{}{
+		"controlPlaneEndpoint": endpoint,
+		"apiServer":            map[string]interface{}{"certSANs": sans},
+	})
+}
+
+var serverLine = regexp.MustCompile(`(?m)^(\s*server:\s*).*$`)
+
+// SetServer returns kubeconfig with the server of every cluster replaced.
+func SetServer(kubeconfig, server string) string {
+	return serverLine.ReplaceAllString(kubeconfig, "${1}"+server)
+}
+
+func init() {
+	pipeline.Define(pipeline.Definition{
+		Name:         "endpoint-migrate",
+		Description:  "Move the cluster to a new controlPlaneEndpoint: reissue the apiserver certificates, switch the kubeconfigs node by node, then update the cluster objects",
+		Command:      "xm endpoint migrate",
+		Kinds:        []string{"Cluster"},
+		Capabilities: []pipeline.Capability{pipeline.CapabilitySSH, pipeline.CapabilityRoot, pipeline.CapabilityKubeadm, pipeline.CapabilityKubeAPI},
+		Parameters: []pipeline.Parameter{
+			{Name: "spec.kubernetes.controlPlaneEndpoint", Description: "the new endpoint, host[:port], set in the configuration", Required: true},
+			{Name: "component-timeout", Description: "maximum wait for a restarted component to become healthy", Default: certrotate.DefaultComponentTimeout.String()},
+			{Name: "rollout-timeout", Description: "maximum wait for the restart of kube-proxy", Default: DefaultRolloutTimeout.String()},
+		},
+		Pipelines: func() []*pipeline.Pipeline {
+			return []*pipeline.Pipeline{
+				CertificatesPipeline(nil, Options{}, ""),
+				KubeconfigsPipeline("", "", Options{}, ""),
+				ClusterPipeline(nil, nil, "", Options{}),
+			}
+		},
+	})
+}
+
+// Migrate moves the cluster to opts.Endpoint. client must reach the API
+// through an address that keeps working during the migration, e.g. the old
+// endpoint. The control-plane nodes of nodes are recognized by their role.
+func Migrate(ctx context.Context, client *kube.Client, nodes []modules.Node, opts Options) error {
+	opts.setDefaults()
+	if opts.Endpoint == "" {
+		return errs.Wrap(errs.Config, errors.New("the new control-plane endpoint is empty"))
+	}
+	var controlPlanes, workers []modules.Node
+	for _, n := range nodes {
+		if n.Host.IsRole(common.RoleControlPlane) {
+			controlPlanes = append(controlPlanes, n)
+		} else {
+			workers = append(workers, n)
+		}
+	}
+	if len(controlPlanes) == 0 {
+		return errs.Wrap(errs.Config, errors.New("no host has the control-plane role"))
+	}
+
+	cc, err := LoadClusterConfiguration(ctx, client)
+	if err != nil {
+		return err
+	}
+	old := Endpoint(cc)
+	if old != "" && withPort(old, opts.APIServerPort) == withPort(opts.Endpoint, opts.APIServerPort) {
+		logger.Log.InfofModule(moduleName, "the control-plane endpoint is already %s", old)
+		return nil
+	}
+	cc = Update(cc, opts.Endpoint)
+	server := "https://" + withPort(opts.Endpoint, opts.APIServerPort)
+	logger.Log.InfofModule(moduleName, "moving the control-plane endpoint from %q to %q", old, opts.Endpoint)
+
+	stamp := time.Now().Format(modules.BackupTimeFormat)
+	if err := CertificatesPipeline(cc, opts, stamp).Run(ctx, controlPlanes); err != nil {
+		return err
+	}
+	if err := KubeconfigsPipeline(server, old, opts, stamp).Run(ctx, append(controlPlanes, workers...)); err != nil {
+		return err
+	}
+	return ClusterPipeline(client, cc, server, opts).Run(ctx, controlPlanes[:1])
+}
+
+// CertificatesPipeline reissues the apiserver certificate of the
+// control-plane nodes from cc, one node after the other, and restarts the
+// apiserver. The previous PKI is copied to certrotate.BackupRoot/endpoint-<stamp>.
+func CertificatesPipeline(cc map[string]interface{}, opts Options, stamp string) *pipeline.Pipeline {
+	opts.setDefaults()
+	backup := fmt.Sprintf("%s/endpoint-%s", certrotate.BackupRoot, stamp)
+	apiserver := certrotate.Components(opts.APIServerPort)[1]
+	server := "https://" + withPort(Endpoint(cc), opts.APIServerPort)
+	return &pipeline.Pipeline{Name: "certificates", Tasks: []pipeline.Task{{Name: moduleName, Strategy: pipeline.StrategySerial, Steps: []pipeline.Step{
+		// The new endpoint must lead to the apiservers before anything
+		// changes; its name is not in their certificates yet.
+		{Name: "check-endpoint", Run: func(ctx context.Context, node modules.Node) error {
+			if err := reachable(ctx, node, server, false); err != nil {
+				return errs.Wrap(errs.Preflight, err)
+			}
+			return nil
+		}},
+		{Name: "backup-pki", Command: fmt.Sprintf("mkdir -p %[1]s && cp -a /etc/kubernetes/pki %[1]s/ && cp -a /etc/kubernetes/*.conf %[1]s/", backup)},
+		{Name: "write-config", Run: func(ctx context.Context, node modules.Node) error {
+			data, err := nodeConfig(node, cc, opts.APIServerPort)
+			if err != nil {
+				return err
+			}
+			return modules.WriteFile(ctx, node.Conn, data, ConfigPath, common.FileMode0644)
+		}},
+		{Name: "reissue-apiserver-cert", Command: "rm -f /etc/kubernetes/pki/apiserver.crt /etc/kubernetes/pki/apiserver.key && kubeadm init phase certs apiserver --config " + ConfigPath},
+		{Name: "restart-apiserver", Run: func(ctx context.Context, node modules.Node) error {
+			return certrotate.Restart(ctx, node, apiserver, opts.ComponentTimeout)
+		}},
+	}}}}
+}
+
+// nodeConfig renders cc with the InitConfiguration of node, so that the
+// certificate keeps the node name and address.
+func nodeConfig(node modules.Node, cc map[string]interface{}, port int) ([]byte, error) {
+	apiVersion, _ := cc["apiVersion"].(string)
+	init := map[string]interface{}{
+		"apiVersion":       apiVersion,
+		"kind":             "InitConfiguration",
+		"nodeRegistration": map[string]interface{}{"name": node.Name()},
+		"localAPIEndpoint": map[string]interface{}{
+			"advertiseAddress": node.Host.GetInternalIPv4Address(),
+			"bindPort":         port,
+		},
+	}
+	return kubeadm.Marshal(init, cc)
+}
+
+// KubeconfigsPipeline points the kubeconfigs of the nodes at server, one
+// node at a time, after checking the node reaches it, and restarts what uses
+// them. old is the previous controlPlaneEndpoint, empty if there was none.
+func KubeconfigsPipeline(server, old string, opts Options, stamp string) *pipeline.Pipeline {
+	opts.setDefaults()
+	backup := fmt.Sprintf("%s/endpoint-%s", certrotate.BackupRoot, stamp)
+	return &pipeline.Pipeline{Name: "kubeconfigs", Tasks: []pipeline.Task{{Name: moduleName, Strategy: pipeline.StrategySerial, Steps: []pipeline.Step{
+		{Name: "check-endpoint", Run: func(ctx context.Context, node modules.Node) error {
+			if err := reachable(ctx, node, server, true); err != nil {
+				return errs.Wrap(errs.Preflight, err)
+			}
+			return nil
+		}},
+		{Name: "switch-kubeconfigs", Run: func(ctx context.Context, node modules.Node) error {
+			return switchNode(ctx, node, server, old, backup, opts)
+		}},
+	}}}}
+}
+
+// switchNode rewrites the kubeconfigs of node and restarts the kubelet and,
+// when their kubeconfig changed, the controller-manager and the scheduler.
+func switchNode(ctx context.Context, node modules.Node, server, old, backup string, opts Options) error {
+	files := nodeKubeconfigs
+	controlPlane := node.Host.IsRole(common.RoleControlPlane)
+	if controlPlane {
+		files = controlPlaneKubeconfigs
+	}
+	cmds := []string{fmt.Sprintf("mkdir -p %[1]s && cp -a /etc/kubernetes/*.conf %[1]s/", shellquote.Quote(backup))}
+	for _, f := range files {
+		cmds = append(cmds, setServerCmd(f, server))
+	}
+	if err := modules.RunAll(ctx, node.Conn, cmds...); err != nil {
+		return err
+	}
+
+	var restart []certrotate.Component
+	if controlPlane && old != "" {
+		oldServer := "https://" + withPort(old, opts.APIServerPort)
+		for _, c := range certrotate.Components(opts.APIServerPort) {
+			f, ok := localKubeconfigs[c.Name]
+			if !ok {
+				continue
+			}
+			ok, err := modules.Succeeds(ctx, node.Conn, shellquote.Join("grep", "-q", "server: "+oldServer+"$", f))
+			if err != nil {
+				return err
+			}
+			if ok {
+				if _, err := modules.Run(ctx, node.Conn, setServerCmd(f, server)); err != nil {
+					return err
+				}
+				restart = append(restart, c)
+			}
+		}
+	}
+
+	if _, err := modules.Run(ctx, node.Conn, "systemctl restart kubelet"); err != nil {
+		return err
+	}
+	if err := wait.Poll(ctx, wait.Options{Timeout: opts.ComponentTimeout}, "kubelet on "+node.Name(), func(ctx context.Context) (bool, error) {
+		ok, err := modules.Succeeds(ctx, node.Conn, "curl -fsS -m 5 http://127.0.0.1:10248/healthz")
+		if err != nil || !ok {
+			return false, err
+		}
+		return true, nil
+	}); err != nil {
+		return err
+	}
+	for _, c := range restart {
+		if err := certrotate.Restart(ctx, node, c, opts.ComponentTimeout); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setServerCmd points the kubeconfig f at server, if it exists.
+func setServerCmd(f, server string) string {
+	return fmt.Sprintf("if [ -f %[1]s ]; then sed -i -E 's#^( *server:).*#\\1 %[2]s#' %[1]s; fi", f, server)
+}
+
+// ClusterPipeline stores server in the cluster objects that hold the
+// endpoint (see updateCluster). It is meant to run on a single node.
+func ClusterPipeline(client *kube.Client, cc map[string]interface{}, server string, opts Options) *pipeline.Pipeline {
+	opts.setDefaults()
+	return &pipeline.Pipeline{Name: "cluster", Tasks: []pipeline.Task{{Name: moduleName, Steps: []pipeline.Step{
+		{Name: "update-cluster-objects", Run: func(ctx context.Context, _ modules.Node) error {
+			return updateCluster(ctx, client, cc, server, opts)
+		}},
+	}}}}
+}
+
+// reachable waits until node reaches the apiserver through server. With
+// verify, the certificate must be valid for the name of server.
+func reachable(ctx context.Context, node modules.Node, server string, verify bool) error {
+	url := shellquote.Quote(server + "/livez")
+	cmd := "curl -fsS -m 5 -k " + url
+	if verify {
+		cmd = "curl -fsS -m 5 --cacert /etc/kubernetes/pki/ca.crt " + url
+	}
+	return wait.Poll(ctx, wait.Options{Timeout: DefaultReachTimeout}, node.Name()+" reaching "+server, func(ctx context.Context) (bool, error) {
+		_, err := modules.Run(ctx, node.Conn, cmd)
+		return err == nil, err
+	})
+}
+
+// updateCluster stores the new endpoint in kubeadm-config, cluster-info,
+// which the controller-manager signs again for the bootstrap tokens, and the
+// kube-proxy kubeconfig, then restarts kube-proxy.
+func updateCluster(ctx context.Context, client *kube.Client, cc map[string]interface{}, server string, opts Options) error {
+	data, err := yaml.Marshal(cc)
+	if err != nil {
+		return fmt.Errorf("failed to render kubeadm ClusterConfiguration: %w", err)
+	}
+	if err := patchData(ctx, client, kubeadmConfigPath, "ClusterConfiguration", func(string) string { return string(data) }); err != nil {
+		return err
+	}
+	setServer := func(kubeconfig string) string { return SetServer(kubeconfig, server) }
+	if err := patchData(ctx, client, clusterInfoPath, "kubeconfig", setServer); err != nil && !kube.IsNotFound(err) {
+		return err
+	}
+	err = patchData(ctx, client, kubeProxyPath, "kubeconfig.conf", setServer)
+	if kube.IsNotFound(err) {
+		logger.Log.InfofModule(moduleName, "kube-proxy is not deployed, skipped")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	restart := fmt.Sprintf(`{"spec":{"template":{"metadata":{"annotations":{"kubectl.kubernetes.io/restartedAt":%q}}}}}`, time.Now().Format(time.RFC3339))
+	if err := client.Patch(ctx, kubeProxyDSPath, kube.StrategicMergePatch, []byte(restart), nil); err != nil {
+		return fmt.Errorf("failed to restart kube-proxy: %w", err)
+	}
+	return client.WaitForRollout(ctx, kube.KindDaemonSet, "kube-system", "kube-proxy", opts.RolloutTimeout)
+}
+
+// patchData replaces the key of the ConfigMap at path with edit of its value.
+func patchData(ctx context.Context, client *kube.Client, path, key string, edit func(string) string) error {
+	var cm struct {
+		Data map[string]string `json:"data"`
+	}
+	if err := client.Get(ctx, path, &cm); err != nil {
+		return err
+	}
+	patch, err := json.Marshal(map[string]interface{}{"data": map[string]string{key: edit(cm.Data[key])}})
+	if err != nil {
+		return err
+	}
+	if err := client.Patch(ctx, path, kube.MergePatch, patch, nil); err != nil {
+		return fmt.Errorf("failed to update %s: %w", path, err)
+	}
+	return nil
+}
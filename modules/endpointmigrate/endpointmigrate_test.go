@@ -0,0 +1,162 @@
+package endpointmigrate
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+
+	"github.com/mensylisir/xmcores/common"
+	"github.com/mensylisir/xmcores/connector"
+	"github.com/mensylisir/xmcores/connector/connectortest"
+	"github.com/mensylisir/xmcores/kube"
+	"github.com/mensylisir/xmcores/modules"
+)
+
+func TestUpdate(t *testing.T) {
+	cc := map[string]interface{}{
+		"kind":                 "ClusterConfiguration",
+		"controlPlaneEndpoint": "10.0.0.11:6443",
+		"apiServer":            map[string]interface{}{"certSANs": []interface{}{"10.0.0.11"}, "extraArgs": map[string]interface{}{"v": "2"}},
+	}
+	got := Update(cc, "api.lab:6443")
+	assert.Equal(t, "api.lab:6443", Endpoint(got))
+	assert.Equal(t, map[string]interface{}{"certSANs": []interface{}{"10.0.0.11", "api.lab"}, "extraArgs": map[string]interface{}{"v": "2"}}, got["apiServer"])
+	assert.Equal(t, "10.0.0.11:6443", Endpoint(cc), "the original is left alone")
+
+	got = Update(map[string]interface{}{}, "10.0.0.100")
+	assert.Equal(t, map[string]interface{}{"certSANs": []interface{}{"10.0.0.100"}}, got["apiServer"])
+}
+
+func TestSetServer(t *testing.T) {
+	kubeconfig := "apiVersion: v1\nclusters:\n- cluster:\n    certificate-authority-data: LS0t\n    server: https://10.0.0.11:6443\n  name: kubernetes\n"
+	assert.Equal(t, "apiVersion: v1\nclusters:\n- cluster:\n    certificate-authority-data: LS0t\n    server: https://api.lab:6443\n  name: kubernetes\n",
+		SetServer(kubeconfig, "https://api.lab:6443"))
+}
+
+// node fakes a host whose kube-apiserver container gets a new ID each time it
+// is stopped.
+func node(fakes *connectortest.Connector, name, address string, roles ...string) modules.Node {
+	fake := fakes.Host(name)
+	var (
+		mu         sync.Mutex
+		generation int
+	)
+	fake.OnFunc(func(cmd string) bool { return strings.Contains(cmd, "crictl ps") }, func(cmd string) connectortest.Result {
+		mu.Lock()
+		defer mu.Unlock()
+		if strings.Contains(cmd, "'^kube-apiserver$'") {
+			return connectortest.Result{Stdout: "apiserver-" + string(rune('0'+generation)) + "\n"}
+		}
+		return connectortest.Result{}
+	})
+	fake.OnFunc(func(cmd string) bool { return strings.Contains(cmd, "crictl stop") }, func(string) connectortest.Result {
+		mu.Lock()
+		defer mu.Unlock()
+		generation++
+		return connectortest.Result{}
+	})
+	h := connector.NewHost()
+	h.SetName(name)
+	h.SetInternalAddress(address)
+	h.SetRoles(roles)
+	return modules.Node{Host: h, Conn: fake}
+}
+
+func TestMigrate(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		patches = map[string]string{}
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Method == http.MethodPatch {
+			body, _ := io.ReadAll(r.Body)
+			patches[r.URL.Path] = string(body)
+			_, _ = w.Write([]byte(`{}`))
+			return
+		}
+		switch r.URL.Path {
+		case kubeadmConfigPath:
+			_, _ = w.Write([]byte(`{"data":{"ClusterConfiguration":"apiVersion: kubeadm.k8s.io/v1beta3\nkind: ClusterConfiguration\ncontrolPlaneEndpoint: 10.0.0.7:6443\n"}}`))
+		case clusterInfoPath:
+			_, _ = w.Write([]byte(`{"data":{"kubeconfig":"clusters:\n- cluster:\n    server: https://10.0.0.7:6443\n"}}`))
+		case kubeProxyDSPath:
+			_, _ = w.Write([]byte(`{"status":{"desiredNumberScheduled":2,"updatedNumberScheduled":2,"numberAvailable":2}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	client, err := kube.NewClient(kube.RESTConfig{Server: srv.URL})
+	require.NoError(t, err)
+
+	fakes := connectortest.NewConnector()
+	master := node(fakes, "master1", "10.0.0.7", common.RoleControlPlane)
+	fakes.Host("master1").On(`grep -q .*server: https://10\.0\.0\.7:6443\$.* /etc/kubernetes/scheduler\.conf`, connectortest.Result{ExitCode: 1})
+	nodes := []modules.Node{node(fakes, "worker1", "10.0.0.8", common.RoleWorker), master}
+
+	require.NoError(t, Migrate(context.Background(), client, nodes, Options{Endpoint: "api.lab"}))
+
+	m := fakes.Host("master1")
+	assert.True(t, m.Ran(`curl -fsS -m 5 -k https://api\.lab:6443/livez`), "the endpoint is checked before anything changes")
+	assert.True(t, m.Ran(`rm -f /etc/kubernetes/pki/apiserver\.crt /etc/kubernetes/pki/apiserver\.key && kubeadm init phase certs apiserver --config /etc/kubernetes/kubeadm-endpoint\.yaml`))
+	assert.True(t, m.Ran(`crictl stop --timeout 30 apiserver-0`))
+	data, ok := m.ReadFile(ConfigPath)
+	require.True(t, ok)
+	var docs []map[string]interface{}
+	dec := yaml.NewDecoder(strings.NewReader(string(data)))
+	for {
+		var doc map[string]interface{}
+		if dec.Decode(&doc) != nil {
+			break
+		}
+		docs = append(docs, doc)
+	}
+	require.Len(t, docs, 2)
+	assert.Equal(t, map[string]interface{}{"advertiseAddress": "10.0.0.7", "bindPort": 6443}, docs[0]["localAPIEndpoint"])
+	assert.Equal(t, "kubeadm.k8s.io/v1beta3", docs[0]["apiVersion"])
+	assert.Equal(t, "api.lab", docs[1]["controlPlaneEndpoint"])
+	assert.Equal(t, map[string]interface{}{"certSANs": []interface{}{"10.0.0.7", "api.lab"}}, docs[1]["apiServer"])
+
+	assert.True(t, m.Ran(`sed -i -E .*s#\^\( \*server:\)\.\*#\\1 https://api\.lab:6443#.* /etc/kubernetes/admin\.conf`))
+	assert.True(t, m.Ran(`sed .* /etc/kubernetes/controller-manager\.conf`), "a kubeconfig on the old endpoint is switched")
+	assert.False(t, m.Ran(`sed .* /etc/kubernetes/scheduler\.conf`))
+	assert.Equal(t, 1, strings.Count(strings.Join(m.Commands(), "\n"), "crictl stop"), "only the apiserver is restarted, the fake controller-manager does not run")
+
+	w := fakes.Host("worker1")
+	assert.True(t, w.Ran(`curl -fsS -m 5 --cacert /etc/kubernetes/pki/ca\.crt https://api\.lab:6443/livez`))
+	assert.True(t, w.Ran(`sed .* /etc/kubernetes/kubelet\.conf`))
+	assert.False(t, w.Ran(`admin\.conf|kubeadm`))
+	assert.True(t, w.Ran(`systemctl restart kubelet`))
+
+	var cm struct {
+		Data map[string]string `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(patches[kubeadmConfigPath]), &cm))
+	assert.Contains(t, cm.Data["ClusterConfiguration"], "controlPlaneEndpoint: api.lab\n")
+	require.NoError(t, json.Unmarshal([]byte(patches[clusterInfoPath]), &cm))
+	assert.Equal(t, "clusters:\n- cluster:\n    server: https://api.lab:6443\n", cm.Data["kubeconfig"])
+	assert.NotContains(t, patches, kubeProxyDSPath, "kube-proxy is not deployed")
+}
+
+func TestMigrateSameEndpoint(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"data":{"ClusterConfiguration":"controlPlaneEndpoint: api.lab:6443\n"}}`))
+	}))
+	defer srv.Close()
+	client, err := kube.NewClient(kube.RESTConfig{Server: srv.URL})
+	require.NoError(t, err)
+	fakes := connectortest.NewConnector()
+	require.NoError(t, Migrate(context.Background(), client, []modules.Node{node(fakes, "master1", "10.0.0.7", common.RoleControlPlane)}, Options{Endpoint: "api.lab"}))
+	assert.Empty(t, fakes.Host("master1").Commands())
+}
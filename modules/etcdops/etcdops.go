@@ -0,0 +1,342 @@
+// Package etcdops reports the health of the etcd members and defragments
+// them. Requests go to the etcd v3 JSON gateway through curl on each member
+// itself, authenticated with the client certificate kubeadm generates for
+// health checks, so neither the certificates nor etcdctl are needed on the
+// controller and etcd does not have to be reachable from it.
+package etcdops
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mensylisir/xmcores/logger"
+	"github.com/mensylisir/xmcores/modules"
+	"github.com/mensylisir/xmcores/wait"
+)
+
+const moduleName = "EtcdOps"
+
+const (
+	// ClientPort is the port etcd serves clients on.
+	ClientPort = 2379
+
+	DefaultRequestTimeout = 10 * time.Second
+	DefaultDefragTimeout  = 5 * time.Minute
+	DefaultHealthTimeout  = 2 * time.Minute
+)
+
+// Alarms etcd raises.
+const (
+	AlarmNoSpace = "NOSPACE"
+	AlarmCorrupt = "CORRUPT"
+)
+
+// PKI locates the certificates on the members used to reach etcd.
+type PKI struct {
+	CAFile   string
+	CertFile string
+	KeyFile  string
+}
+
+// DefaultPKI is the layout of kubeadm's stacked etcd.
+var DefaultPKI = PKI{
+	CAFile:   "/etc/kubernetes/pki/etcd/ca.crt",
+	CertFile: "/etc/kubernetes/pki/etcd/healthcheck-client.crt",
+	KeyFile:  "/etc/kubernetes/pki/etcd/healthcheck-client.key",
+}
+
+// Status is the state of one member.
+type Status struct {
+	// Node is the name of the host the member runs on.
+	Node     string `json:"node"`
+	MemberID uint64 `json:"memberID,omitempty"`
+	Version  string `json:"version,omitempty"`
+	// DBSize is the size of the database file, DBSizeInUse the part of it
+	// holding data; the rest is reclaimed by defragmentation.
+	DBSize           int64    `json:"dbSize,omitempty"`
+	DBSizeInUse      int64    `json:"dbSizeInUse,omitempty"`
+	Leader           uint64   `json:"leader,omitempty"`
+	RaftTerm         uint64   `json:"raftTerm,omitempty"`
+	RaftIndex        uint64   `json:"raftIndex,omitempty"`
+	RaftAppliedIndex uint64   `json:"raftAppliedIndex,omitempty"`
+	IsLearner        bool     `json:"isLearner,omitempty"`
+	Errors           []string `json:"errors,omitempty"`
+	// Alarms are the alarms raised for this member.
+	Alarms []string `json:"alarms,omitempty"`
+	// Err is set when the member could not be queried.
+	Err error `json:"-"`
+}
+
+// MarshalJSON renders Err as the error field.
+func (s Status) MarshalJSON() ([]byte, error) {
+	type status Status
+	out := struct {
+		status
+		Error string `json:"error,omitempty"`
+	}{status: status(s)}
+	if s.Err != nil {
+		out.Error = s.Err.Error()
+	}
+	return json.Marshal(out)
+}
+
+// IsLeader reports whether the member leads the cluster.
+func (s Status) IsLeader() bool {
+	return s.MemberID != 0 && s.MemberID == s.Leader
+}
+
+// Fragmentation is the share of the database file not in use.
+func (s Status) Fragmentation() float64 {
+	if s.DBSize <= 0 || s.DBSizeInUse > s.DBSize {
+		return 0
+	}
+	return float64(s.DBSize-s.DBSizeInUse) / float64(s.DBSize)
+}
+
+// number decodes the 64-bit integers of the gateway, which proto3 JSON
+// renders as strings.
+type number uint64
+
+func (n *number) UnmarshalJSON(b []byte) error {
+	v, err := strconv.ParseUint(strings.Trim(string(b), `"`), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid number %s", b)
+	}
+	*n = number(v)
+	return nil
+}
+
+type statusResponse struct {
+	Header struct {
+		MemberID number `json:"member_id"`
+	} `json:"header"`
+	Version          string   `json:"version"`
+	DBSize           number   `json:"dbSize"`
+	DBSizeInUse      number   `json:"dbSizeInUse"`
+	Leader           number   `json:"leader"`
+	RaftIndex        number   `json:"raftIndex"`
+	RaftTerm         number   `json:"raftTerm"`
+	RaftAppliedIndex number   `json:"raftAppliedIndex"`
+	Errors           []string `json:"errors"`
+	IsLearner        bool     `json:"isLearner"`
+}
+
+type alarmResponse struct {
+	Alarms []struct {
+		MemberID number `json:"memberID"`
+		Alarm    string `json:"alarm"`
+	} `json:"alarms"`
+}
+
+// gatewayError is the body of a failed gateway request.
+type gatewayError struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+}
+
+// RequestCommand returns the curl command posting body to the gateway path
+// of the member on the local host.
+func RequestCommand(pki PKI, path, body string, timeout time.Duration) string {
+	return fmt.Sprintf("curl -sS -m %d --cacert %s --cert %s --key %s -X POST https://127.0.0.1:%d%s -d '%s'",
+		int(timeout.Seconds()), pki.CAFile, pki.CertFile, pki.KeyFile, ClientPort, path, body)
+}
+
+// request posts body to path on the member of node and decodes the answer
+// into out.
+func request(ctx context.Context, node modules.Node, pki PKI, path, body string, timeout time.Duration, out interface{}) error {
+	res, err := modules.Run(ctx, node.Conn, RequestCommand(pki, path, body, timeout))
+	if err != nil {
+		return err
+	}
+	var gwErr gatewayError
+	if json.Unmarshal([]byte(res), &gwErr) == nil && (gwErr.Error != "" || gwErr.Message != "") {
+		msg := gwErr.Message
+		if msg == "" {
+			msg = gwErr.Error
+		}
+		return fmt.Errorf("etcd %s: %s", path, msg)
+	}
+	if err := json.Unmarshal([]byte(res), out); err != nil {
+		return fmt.Errorf("etcd %s: unexpected response %q", path, res)
+	}
+	return nil
+}
+
+// GetStatus queries the member on node. Failures are reported in Status.Err.
+func GetStatus(ctx context.Context, node modules.Node, pki PKI) Status {
+	s := Status{Node: node.Name()}
+	var st statusResponse
+	if err := request(ctx, node, pki, "/v3/maintenance/status", "{}", DefaultRequestTimeout, &st); err != nil {
+		s.Err = err
+		return s
+	}
+	s.MemberID = uint64(st.Header.MemberID)
+	s.Version = st.Version
+	s.DBSize, s.DBSizeInUse = int64(st.DBSize), int64(st.DBSizeInUse)
+	s.Leader = uint64(st.Leader)
+	s.RaftTerm, s.RaftIndex, s.RaftAppliedIndex = uint64(st.RaftTerm), uint64(st.RaftIndex), uint64(st.RaftAppliedIndex)
+	s.IsLearner = st.IsLearner
+	s.Errors = st.Errors
+
+	var alarms alarmResponse
+	if err := request(ctx, node, pki, "/v3/maintenance/alarm", `{"action":"GET"}`, DefaultRequestTimeout, &alarms); err != nil {
+		s.Err = err
+		return s
+	}
+	for _, a := range alarms.Alarms {
+		if uint64(a.MemberID) == s.MemberID {
+			s.Alarms = append(s.Alarms, a.Alarm)
+		}
+	}
+	return s
+}
+
+// StatusAll queries the members on nodes concurrently, in the order of nodes.
+func StatusAll(ctx context.Context, nodes []modules.Node, pki PKI) []Status {
+	statuses := make([]Status, len(nodes))
+	index := make(map[string]int, len(nodes))
+	for i, node := range nodes {
+		index[node.Name()] = i
+	}
+	// GetStatus reports its errors in the status, so ForEach never fails.
+	_ = modules.ForEach(ctx, nodes, func(ctx context.Context, node modules.Node) error {
+		statuses[index[node.Name()]] = GetStatus(ctx, node, pki)
+		return nil
+	})
+	return statuses
+}
+
+// CheckCluster fails unless every member answered without errors, they agree
+// on one leader and no data corruption was detected. NOSPACE alarms are
+// allowed, since defragmentation frees the space they are raised for.
+func CheckCluster(statuses []Status) error {
+	var errList []error
+	leaders := map[uint64]bool{}
+	for _, s := range statuses {
+		switch {
+		case s.Err != nil:
+			errList = append(errList, fmt.Errorf("%s: %w", s.Node, s.Err))
+			continue
+		case len(s.Errors) > 0:
+			errList = append(errList, fmt.Errorf("%s: %s", s.Node, strings.Join(s.Errors, "; ")))
+		case s.Leader == 0:
+			errList = append(errList, fmt.Errorf("%s: the member has no leader", s.Node))
+		}
+		for _, a := range s.Alarms {
+			if a != AlarmNoSpace {
+				errList = append(errList, fmt.Errorf("%s: alarm %s is raised", s.Node, a))
+			}
+		}
+		leaders[s.Leader] = true
+	}
+	if len(errList) == 0 && len(leaders) > 1 {
+		errList = append(errList, errors.New("the members disagree on the leader"))
+	}
+	return errors.Join(errList...)
+}
+
+// DefragOptions control Defrag.
+type DefragOptions struct {
+	PKI PKI
+	// MinFragmentation skips members whose Fragmentation is lower.
+	MinFragmentation float64
+	// Timeout bounds the defragmentation of one member; defaults to
+	// DefaultDefragTimeout.
+	Timeout time.Duration
+	// HealthTimeout bounds the wait for a member to be healthy again before
+	// the next one is defragmented; defaults to DefaultHealthTimeout.
+	HealthTimeout time.Duration
+}
+
+func (o *DefragOptions) setDefaults() {
+	if o.PKI == (PKI{}) {
+		o.PKI = DefaultPKI
+	}
+	if o.Timeout == 0 {
+		o.Timeout = DefaultDefragTimeout
+	}
+	if o.HealthTimeout == 0 {
+		o.HealthTimeout = DefaultHealthTimeout
+	}
+}
+
+// Order returns the members to defragment: those above the threshold, the
+// followers first and the leader last, so that the leader is blocked once,
+// when all followers are done.
+func Order(statuses []Status, minFragmentation float64) []Status {
+	var order []Status
+	for _, s := range statuses {
+		if s.Fragmentation() >= minFragmentation {
+			order = append(order, s)
+		}
+	}
+	sort.SliceStable(order, func(i, j int) bool { return !order[i].IsLeader() && order[j].IsLeader() })
+	return order
+}
+
+// Defrag defragments the members on nodes one at a time. A member blocks
+// its reads and writes while it is defragmented, so the cluster must be
+// healthy before, and each member healthy again before the next one is
+// started; the first failure stops the run. NOSPACE alarms are disarmed
+// once all members are done. It returns the status of the members after
+// their defragmentation.
+func Defrag(ctx context.Context, nodes []modules.Node, opts DefragOptions) ([]Status, error) {
+	opts.setDefaults()
+	statuses := StatusAll(ctx, nodes, opts.PKI)
+	if err := CheckCluster(statuses); err != nil {
+		return nil, fmt.Errorf("etcd is not healthy, not defragmenting: %w", err)
+	}
+	byName := make(map[string]modules.Node, len(nodes))
+	for _, node := range nodes {
+		byName[node.Name()] = node
+	}
+
+	var done []Status
+	for _, s := range Order(statuses, opts.MinFragmentation) {
+		node := byName[s.Node]
+		logger.Log.InfofModule(moduleName, "defragmenting %s (%s, %.0f%% unused)", s.Node, modules.FormatSize(s.DBSize), 100*s.Fragmentation())
+		var resp struct{}
+		if err := request(ctx, node, opts.PKI, "/v3/maintenance/defragment", "{}", opts.Timeout, &resp); err != nil {
+			return done, fmt.Errorf("%s: %w", s.Node, err)
+		}
+		var after Status
+		err := wait.Poll(ctx, wait.Options{Timeout: opts.HealthTimeout}, "etcd on "+s.Node, func(ctx context.Context) (bool, error) {
+			after = GetStatus(ctx, node, opts.PKI)
+			switch {
+			case after.Err != nil:
+				return false, after.Err
+			case len(after.Errors) > 0:
+				return false, errors.New(strings.Join(after.Errors, "; "))
+			case after.Leader == 0:
+				return false, errors.New("the member has no leader")
+			}
+			return true, nil
+		})
+		if err != nil {
+			return done, fmt.Errorf("%s: the member is not healthy after defragmentation: %w", s.Node, err)
+		}
+		logger.Log.InfofModule(moduleName, "%s: %s -> %s", s.Node, modules.FormatSize(s.DBSize), modules.FormatSize(after.DBSize))
+		done = append(done, after)
+	}
+
+	for _, s := range statuses {
+		for _, a := range s.Alarms {
+			if a != AlarmNoSpace {
+				continue
+			}
+			body := fmt.Sprintf(`{"action":"DEACTIVATE","memberID":"%d","alarm":"%s"}`, s.MemberID, AlarmNoSpace)
+			var resp struct{}
+			if err := request(ctx, byName[s.Node], opts.PKI, "/v3/maintenance/alarm", body, DefaultRequestTimeout, &resp); err != nil {
+				return done, fmt.Errorf("%s: failed to disarm the %s alarm: %w", s.Node, AlarmNoSpace, err)
+			}
+			logger.Log.InfofModule(moduleName, "%s: disarmed the %s alarm", s.Node, AlarmNoSpace)
+		}
+	}
+	return done, nil
+}
@@ -0,0 +1,121 @@
+package etcdops
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mensylisir/xmcores/connector"
+	"github.com/mensylisir/xmcores/connector/connectortest"
+	"github.com/mensylisir/xmcores/modules"
+)
+
+// statusJSON renders a gateway status response of member id.
+func statusJSON(id, leader uint64, dbSize, inUse int64) string {
+	return fmt.Sprintf(`{"header":{"cluster_id":"14841639068965178418","member_id":"%d","revision":"8","raft_term":"3"},`+
+		`"version":"3.5.15","dbSize":"%d","leader":"%d","raftIndex":"1042","raftTerm":"3","raftAppliedIndex":"1042","dbSizeInUse":"%d"}`,
+		id, dbSize, leader, inUse)
+}
+
+// member fakes the etcd member id on a node.
+func member(fakes *connectortest.Connector, name string, id, leader uint64, dbSize, inUse int64, alarms string) modules.Node {
+	h := connector.NewHost()
+	h.SetName(name)
+	fake := fakes.Host(name)
+	fake.On(`/v3/maintenance/status`, connectortest.Result{Stdout: statusJSON(id, leader, dbSize, inUse)})
+	fake.On(`/v3/maintenance/alarm .*GET`, connectortest.Result{Stdout: `{"header":{},"alarms":[` + alarms + `]}`})
+	fake.On(`/v3/maintenance/(defragment|alarm)`, connectortest.Result{Stdout: `{"header":{}}`})
+	return modules.Node{Host: h, Conn: fake}
+}
+
+func TestGetStatus(t *testing.T) {
+	ctx := context.Background()
+	fakes := connectortest.NewConnector()
+	node := member(fakes, "master1", 1, 1, 100<<20, 40<<20, `{"memberID":"1","alarm":"NOSPACE"},{"memberID":"2","alarm":"CORRUPT"}`)
+
+	s := GetStatus(ctx, node, DefaultPKI)
+	require.NoError(t, s.Err)
+	assert.Equal(t, Status{
+		Node: "master1", MemberID: 1, Version: "3.5.15", DBSize: 100 << 20, DBSizeInUse: 40 << 20, Leader: 1,
+		RaftTerm: 3, RaftIndex: 1042, RaftAppliedIndex: 1042, Alarms: []string{AlarmNoSpace},
+	}, s)
+	assert.True(t, s.IsLeader())
+	assert.InDelta(t, 0.6, s.Fragmentation(), 1e-9)
+	assert.True(t, fakes.Host("master1").Ran(`curl -sS -m 10 --cacert /etc/kubernetes/pki/etcd/ca\.crt --cert /etc/kubernetes/pki/etcd/healthcheck-client\.crt --key /etc/kubernetes/pki/etcd/healthcheck-client\.key -X POST https://127\.0\.0\.1:2379/v3/maintenance/status`))
+
+	fake := connectortest.NewFake()
+	fake.On(`/v3/maintenance/status`, connectortest.Result{Stdout: `{"error":"etcdserver: request timed out","code":14,"message":"etcdserver: request timed out"}`})
+	s = GetStatus(ctx, modules.Node{Host: node.Host, Conn: fake}, DefaultPKI)
+	assert.EqualError(t, s.Err, "etcd /v3/maintenance/status: etcdserver: request timed out")
+	data, err := json.Marshal(s)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"node":"master1","error":"etcd /v3/maintenance/status: etcdserver: request timed out"}`, string(data))
+}
+
+func TestCheckCluster(t *testing.T) {
+	healthy := []Status{{Node: "a", MemberID: 1, Leader: 1}, {Node: "b", MemberID: 2, Leader: 1, Alarms: []string{AlarmNoSpace}}}
+	require.NoError(t, CheckCluster(healthy))
+
+	err := CheckCluster([]Status{
+		{Node: "a", Err: errors.New("connection refused")},
+		{Node: "b", MemberID: 2, Leader: 1, Alarms: []string{AlarmCorrupt}},
+		{Node: "c", MemberID: 3},
+	})
+	assert.ErrorContains(t, err, "a: connection refused")
+	assert.ErrorContains(t, err, "b: alarm CORRUPT is raised")
+	assert.ErrorContains(t, err, "c: the member has no leader")
+
+	assert.EqualError(t, CheckCluster([]Status{{Node: "a", MemberID: 1, Leader: 1}, {Node: "b", MemberID: 2, Leader: 2}}), "the members disagree on the leader")
+}
+
+func TestOrder(t *testing.T) {
+	statuses := []Status{
+		{Node: "a", MemberID: 1, Leader: 1, DBSize: 100, DBSizeInUse: 10},
+		{Node: "b", MemberID: 2, Leader: 1, DBSize: 100, DBSizeInUse: 90},
+		{Node: "c", MemberID: 3, Leader: 1, DBSize: 100, DBSizeInUse: 50},
+	}
+	var names []string
+	for _, s := range Order(statuses, 0) {
+		names = append(names, s.Node)
+	}
+	assert.Equal(t, []string{"b", "c", "a"}, names, "the leader goes last")
+	names = nil
+	for _, s := range Order(statuses, 0.5) {
+		names = append(names, s.Node)
+	}
+	assert.Equal(t, []string{"c", "a"}, names)
+}
+
+func TestDefrag(t *testing.T) {
+	ctx := context.Background()
+	fakes := connectortest.NewConnector()
+	nodes := []modules.Node{
+		member(fakes, "master1", 1, 2, 100<<20, 20<<20, `{"memberID":"1","alarm":"NOSPACE"}`),
+		member(fakes, "master2", 2, 2, 100<<20, 20<<20, ``),
+		member(fakes, "master3", 3, 2, 100<<20, 95<<20, ``),
+	}
+
+	done, err := Defrag(ctx, nodes, DefragOptions{MinFragmentation: 0.5})
+	require.NoError(t, err)
+	require.Len(t, done, 2)
+	assert.Equal(t, "master1", done[0].Node)
+	assert.Equal(t, "master2", done[1].Node, "the leader is defragmented last")
+	assert.True(t, fakes.Host("master1").Ran(`-m 300 .*/v3/maintenance/defragment`))
+	assert.False(t, fakes.Host("master3").Ran(`defragment`), "members below the threshold are skipped")
+	assert.True(t, fakes.Host("master1").Ran(`/v3/maintenance/alarm .*DEACTIVATE.*memberID":"1".*NOSPACE`))
+
+	// A member that cannot be queried stops the run before anything is done.
+	fakes = connectortest.NewConnector()
+	nodes = []modules.Node{
+		member(fakes, "master1", 1, 1, 100<<20, 20<<20, ``),
+		{Host: nodes[2].Host, Conn: connectortest.NewFake().On(`/v3/maintenance/status`, connectortest.Result{Stdout: "curl: (7) Failed to connect", ExitCode: 7})},
+	}
+	_, err = Defrag(ctx, nodes, DefragOptions{})
+	assert.ErrorContains(t, err, "etcd is not healthy, not defragmenting")
+	assert.False(t, fakes.Host("master1").Ran(`defragment`))
+}
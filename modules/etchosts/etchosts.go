@@ -0,0 +1,154 @@
+// Package etchosts keeps a block of entries in /etc/hosts of every node, so
+// that host, control-plane and registry names resolve the same everywhere
+// without a DNS server. Lines outside the block are left alone.
+package etchosts
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mensylisir/xmcores/common"
+	"github.com/mensylisir/xmcores/logger"
+	"github.com/mensylisir/xmcores/modules"
+	"github.com/mensylisir/xmcores/shellquote"
+)
+
+const moduleName = "EtcHosts"
+
+// Path is the file the block is kept in.
+const Path = "/etc/hosts"
+
+// Markers delimit the managed block.
+const (
+	BeginMarker = "# BEGIN xmcores managed hosts"
+	EndMarker   = "# END xmcores managed hosts"
+)
+
+// Entry maps names to an address.
+type Entry struct {
+	Address string   `yaml:"address" json:"address"`
+	Names   []string `yaml:"names" json:"names"`
+}
+
+// Validate checks the entries: every address is an IP and no name maps to two addresses.
+func Validate(entries []Entry) error {
+	seen := map[string]string{}
+	for _, e := range entries {
+		if net.ParseIP(e.Address) == nil {
+			return fmt.Errorf("%q is not an IP address", e.Address)
+		}
+		if len(e.Names) == 0 {
+			return fmt.Errorf("entry %s has no names", e.Address)
+		}
+		for _, n := range e.Names {
+			if prev, ok := seen[n]; ok && prev != e.Address {
+				return fmt.Errorf("%s maps to both %s and %s", n, prev, e.Address)
+			}
+			seen[n] = e.Address
+		}
+	}
+	return nil
+}
+
+// Normalize merges the entries of the same address, drops duplicate names
+// and sorts both, so that every node gets byte-identical blocks.
+func Normalize(entries []Entry) []Entry {
+	names := map[string]map[string]bool{}
+	for _, e := range entries {
+		if names[e.Address] == nil {
+			names[e.Address] = map[string]bool{}
+		}
+		for _, n := range e.Names {
+			names[e.Address][n] = true
+		}
+	}
+	out := make([]Entry, 0, len(names))
+	for addr, set := range names {
+		e := Entry{Address: addr}
+		for n := range set {
+			e.Names = append(e.Names, n)
+		}
+		sort.Strings(e.Names)
+		out = append(out, e)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Address < out[j].Address })
+	return out
+}
+
+// Render returns current with the managed block replaced by entries, or
+// appended if there is none. No entries remove the block.
+func Render(current string, entries []Entry) string {
+	var kept []string
+	inBlock := false
+	for _, line := range strings.Split(strings.TrimRight(current, "\n"), "\n") {
+		switch {
+		case strings.TrimSpace(line) == BeginMarker:
+			inBlock = true
+		case strings.TrimSpace(line) == EndMarker:
+			inBlock = false
+		case !inBlock:
+			kept = append(kept, line)
+		}
+	}
+	for len(kept) > 0 && strings.TrimSpace(kept[len(kept)-1]) == "" {
+		kept = kept[:len(kept)-1]
+	}
+	var b strings.Builder
+	for _, line := range kept {
+		b.WriteString(line + "\n")
+	}
+	if len(entries) == 0 {
+		return b.String()
+	}
+	if b.Len() > 0 {
+		b.WriteString("\n")
+	}
+	b.WriteString(BeginMarker + "\n")
+	for _, e := range Normalize(entries) {
+		b.WriteString(e.Address + " " + strings.Join(e.Names, " ") + "\n")
+	}
+	b.WriteString(EndMarker + "\n")
+	return b.String()
+}
+
+// Apply writes entries into the managed block of the node's /etc/hosts and
+// reports whether the file changed. The file is rewritten in place rather
+// than replaced, since container runtimes bind-mount it; a backup of the
+// previous version is kept next to it.
+func Apply(ctx context.Context, node modules.Node, entries []Entry) (bool, error) {
+	current, err := modules.Run(ctx, node.Conn, "cat "+Path)
+	if err != nil {
+		return false, fmt.Errorf("failed to read %s: %w", Path, err)
+	}
+	content := Render(current, entries)
+	if strings.TrimSpace(content) == current {
+		return false, nil
+	}
+	backup := fmt.Sprintf("%s.%s.bak", Path, time.Now().Format(modules.BackupTimeFormat))
+	if _, err := modules.Run(ctx, node.Conn, fmt.Sprintf("cp -p %s %s", Path, shellquote.Quote(backup))); err != nil {
+		return false, err
+	}
+	if err := modules.WriteFile(ctx, node.Conn, []byte(content), Path, common.FileMode0644); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Deploy writes the same block of entries on all nodes.
+func Deploy(ctx context.Context, nodes []modules.Node, entries []Entry) error {
+	if err := Validate(entries); err != nil {
+		return err
+	}
+	logger.Log.InfofModule(moduleName, "writing %d entries to %s on %d nodes", len(Normalize(entries)), Path, len(nodes))
+	return modules.ForEach(ctx, nodes, func(ctx context.Context, node modules.Node) error {
+		changed, err := Apply(ctx, node, entries)
+		if err == nil && changed {
+			logger.Log.InfofModule(moduleName, "%s: updated %s", node.Name(), Path)
+		}
+		return err
+	})
+}
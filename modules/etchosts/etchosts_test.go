@@ -0,0 +1,64 @@
+package etchosts
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mensylisir/xmcores/connector"
+	"github.com/mensylisir/xmcores/connector/connectortest"
+	"github.com/mensylisir/xmcores/modules"
+)
+
+func TestRender(t *testing.T) {
+	entries := []Entry{
+		{Address: "10.0.0.2", Names: []string{"worker1"}},
+		{Address: "10.0.0.1", Names: []string{"master1", "api.lab"}},
+		{Address: "10.0.0.1", Names: []string{"master1"}},
+	}
+	const system = "127.0.0.1 localhost\n::1 localhost\n"
+	want := system + "\n" + BeginMarker + "\n10.0.0.1 api.lab master1\n10.0.0.2 worker1\n" + EndMarker + "\n"
+
+	assert.Equal(t, want, Render(system, entries))
+	assert.Equal(t, want, Render(want, entries), "rendering is idempotent")
+	assert.Equal(t, want, Render(Render(system, entries[:1]), entries), "the block is replaced")
+	assert.Equal(t, system, Render(want, nil), "no entries remove the block")
+	assert.Equal(t, BeginMarker+"\n10.0.0.2 worker1\n"+EndMarker+"\n", Render("", entries[:1]))
+}
+
+func TestValidate(t *testing.T) {
+	require.NoError(t, Validate([]Entry{{Address: "10.0.0.1", Names: []string{"a"}}, {Address: "10.0.0.1", Names: []string{"a", "b"}}}))
+	assert.ErrorContains(t, Validate([]Entry{{Address: "lb", Names: []string{"a"}}}), `"lb" is not an IP address`)
+	assert.ErrorContains(t, Validate([]Entry{{Address: "10.0.0.1"}}), "no names")
+	assert.ErrorContains(t, Validate([]Entry{{Address: "10.0.0.1", Names: []string{"a"}}, {Address: "10.0.0.2", Names: []string{"a"}}}), "a maps to both 10.0.0.1 and 10.0.0.2")
+}
+
+func TestDeploy(t *testing.T) {
+	ctx := context.Background()
+	entries := []Entry{{Address: "10.0.0.1", Names: []string{"master1"}}}
+	current := map[string]string{
+		"node1": "127.0.0.1 localhost\n",
+		"node2": Render("127.0.0.1 localhost\n", entries),
+	}
+	fakes := connectortest.NewConnector()
+	var nodes []modules.Node
+	for _, name := range []string{"node1", "node2"} {
+		h := connector.NewHost()
+		h.SetName(name)
+		fakes.Host(name).On(`cat /etc/hosts`, connectortest.Result{Stdout: current[name]})
+		nodes = append(nodes, modules.Node{Host: h, Conn: fakes.Host(name)})
+	}
+
+	require.NoError(t, Deploy(ctx, nodes, entries))
+	assert.True(t, fakes.Host("node1").Ran(`cp -p /etc/hosts /etc/hosts\.\d{8}-\d{6}\.bak`))
+	written, ok := fakes.Host("node1").ReadFile(Path)
+	require.True(t, ok)
+	assert.Equal(t, current["node2"], string(written))
+	assert.False(t, fakes.Host("node2").Ran(`cp -p`), "an up-to-date file is left alone")
+	_, ok = fakes.Host("node2").ReadFile(Path)
+	assert.False(t, ok)
+
+	assert.Error(t, Deploy(ctx, nodes, []Entry{{Address: "lb", Names: []string{"api"}}}))
+}
@@ -0,0 +1,192 @@
+// Package existing handles the cluster components found already installed on
+// a node, by a failed previous attempt or set up by hand, rather than letting
+// them conflict with the installation. Depending on the policy, the
+// components whose version suits the cluster are adopted as they are and the
+// others removed cleanly: service disabled, package or binary and
+// configuration files deleted.
+package existing
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/mensylisir/xmcores/catalog"
+	"github.com/mensylisir/xmcores/errs"
+	"github.com/mensylisir/xmcores/facts"
+	"github.com/mensylisir/xmcores/logger"
+	"github.com/mensylisir/xmcores/modules"
+	"github.com/mensylisir/xmcores/shellquote"
+)
+
+const moduleName = "ExistingComponents"
+
+// Policies.
+const (
+	// PolicyAdopt keeps the components whose version suits the cluster and
+	// removes the others.
+	PolicyAdopt = "adopt"
+	// PolicyRemove removes every component found, for a clean slate.
+	PolicyRemove = "remove"
+	// PolicyFail refuses nodes with components installed, leaving them to
+	// the operator.
+	PolicyFail = "fail"
+)
+
+// Actions taken on a component.
+const (
+	ActionAdopt  = "adopt"
+	ActionRemove = "remove"
+)
+
+// unitDir holds the units of the components installed without a package.
+const unitDir = "/etc/systemd/system"
+
+// Config holds the policy applied to the components found on nodes.
+type Config struct {
+	Policy string `yaml:"policy,omitempty" json:"policy,omitempty"`
+}
+
+// SetDefaults fills unset fields.
+func (c *Config) SetDefaults() {
+	if c.Policy == "" {
+		c.Policy = PolicyAdopt
+	}
+}
+
+// Validate checks the configuration.
+func (c Config) Validate() error {
+	switch c.Policy {
+	case PolicyAdopt, PolicyRemove, PolicyFail:
+		return nil
+	default:
+		return fmt.Errorf("unsupported policy %q (want %s, %s or %s)", c.Policy, PolicyAdopt, PolicyRemove, PolicyFail)
+	}
+}
+
+// Decision is what is done with a component found on a node.
+type Decision struct {
+	Component facts.Component
+	Action    string
+	Reason    string
+}
+
+// Decide returns what policy does with each of components on a node of a
+// cluster of kubernetesVersion. The fail policy returns a preflight error
+// when there are any.
+func Decide(cat *catalog.Catalog, kubernetesVersion, policy string, components []facts.Component) ([]Decision, error) {
+	if policy == PolicyFail && len(components) > 0 {
+		found := make([]string, 0, len(components))
+		for _, c := range components {
+			found = append(found, describe(c))
+		}
+		return nil, errs.Wrap(errs.Preflight, fmt.Errorf("found %s already installed; remove them or set spec.existingComponents.policy to %s or %s", strings.Join(found, ", "), PolicyAdopt, PolicyRemove))
+	}
+	decisions := make([]Decision, 0, len(components))
+	for _, c := range components {
+		d := Decision{Component: c, Action: ActionRemove}
+		switch {
+		case policy == PolicyRemove:
+			d.Reason = "policy " + PolicyRemove
+		case c.Path == "":
+			d.Reason = "configuration left without the binary"
+		case c.Version == "":
+			d.Reason = "version unknown"
+		default:
+			if err := cat.CheckInstalled(kubernetesVersion, catalog.Component(c.Name), c.Version); err != nil {
+				d.Reason = err.Error()
+			} else {
+				d.Action, d.Reason = ActionAdopt, "suits Kubernetes "+kubernetesVersion
+			}
+		}
+		decisions = append(decisions, d)
+	}
+	return decisions, nil
+}
+
+// describe names c with its version, if any.
+func describe(c facts.Component) string {
+	if c.Version == "" {
+		return c.Name
+	}
+	return c.Name + " " + c.Version
+}
+
+// RemoveCommands returns the commands removing c from a node with the package
+// manager pm and the init system init.
+func RemoveCommands(pm, init string, c facts.Component) ([]string, error) {
+	disable, err := modules.ServiceCmd(init, modules.ServiceDisable, c.Name)
+	if err != nil {
+		return nil, err
+	}
+	cmds := []string{"{ " + disable + "; } >/dev/null 2>&1 || true"}
+	files := append([]string(nil), c.Configs...)
+	if c.Package != "" {
+		remove, err := modules.RemoveCmd(pm, shellquote.Quote(c.Package))
+		if err != nil {
+			return nil, err
+		}
+		cmds = append(cmds, remove)
+	} else if c.Path != "" {
+		files = append(files, c.Path)
+		if init == facts.InitSystemd {
+			files = append(files, path.Join(unitDir, c.Name+".service"), path.Join(unitDir, c.Name+".service.d"))
+		}
+	}
+	if len(files) > 0 {
+		cmds = append(cmds, shellquote.Join(append([]string{"rm", "-rf"}, files...)...))
+	}
+	if init == facts.InitSystemd {
+		cmds = append(cmds, "systemctl daemon-reload")
+	}
+	return cmds, nil
+}
+
+// Apply detects the components installed on node and adopts or removes them
+// according to cfg, for a cluster of kubernetesVersion. It returns what was
+// done with each.
+func Apply(ctx context.Context, node modules.Node, cfg Config, cat *catalog.Catalog, kubernetesVersion string) ([]Decision, error) {
+	cfg.SetDefaults()
+	if err := cfg.Validate(); err != nil {
+		return nil, errs.Wrap(errs.Config, err)
+	}
+	out, err := modules.Run(ctx, node.Conn, facts.ComponentsCommand)
+	if err != nil {
+		return nil, err
+	}
+	decisions, err := Decide(cat, kubernetesVersion, cfg.Policy, facts.ParseComponents(out))
+	if err != nil || len(decisions) == 0 {
+		return decisions, err
+	}
+	rel, err := facts.DetectOSRelease(ctx, node.Conn)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range decisions {
+		if d.Action == ActionAdopt {
+			logger.Log.InfofModule(moduleName, "%s: adopting %s, %s", node.Name(), describe(d.Component), d.Reason)
+			continue
+		}
+		cmds, err := RemoveCommands(rel.PackageManager(), rel.InitSystem(), d.Component)
+		if err != nil {
+			return nil, err
+		}
+		if err := modules.RunAll(ctx, node.Conn, cmds...); err != nil {
+			return nil, fmt.Errorf("failed to remove %s: %w", describe(d.Component), err)
+		}
+		logger.Log.InfofModule(moduleName, "%s: removed %s, %s", node.Name(), describe(d.Component), d.Reason)
+	}
+	return decisions, nil
+}
+
+// Removed returns the names of the components decisions removed.
+func Removed(decisions []Decision) []string {
+	var names []string
+	for _, d := range decisions {
+		if d.Action == ActionRemove {
+			names = append(names, d.Component.Name)
+		}
+	}
+	return names
+}
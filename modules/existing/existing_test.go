@@ -0,0 +1,101 @@
+package existing
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mensylisir/xmcores/catalog"
+	"github.com/mensylisir/xmcores/connector"
+	"github.com/mensylisir/xmcores/connector/connectortest"
+	"github.com/mensylisir/xmcores/errs"
+	"github.com/mensylisir/xmcores/facts"
+	"github.com/mensylisir/xmcores/modules"
+)
+
+var (
+	containerd = facts.Component{Name: "containerd", Path: "/usr/local/bin/containerd", Version: "v1.7.13", Active: true,
+		Configs: []string{"/etc/containerd/config.toml"}}
+	oldKubelet = facts.Component{Name: "kubelet", Path: "/usr/bin/kubelet", Version: "v1.28.4", Package: "kubelet"}
+)
+
+func TestConfig(t *testing.T) {
+	cfg := Config{}
+	cfg.SetDefaults()
+	assert.Equal(t, PolicyAdopt, cfg.Policy)
+	require.NoError(t, cfg.Validate())
+	assert.Error(t, Config{Policy: "keep"}.Validate())
+}
+
+func TestDecide(t *testing.T) {
+	cat := catalog.NewCatalog()
+	leftover := facts.Component{Name: "kubelet", Configs: []string{"/etc/kubernetes/kubelet.conf"}}
+	unknown := facts.Component{Name: "containerd", Path: "/usr/bin/containerd"}
+
+	decisions, err := Decide(cat, "v1.30.2", PolicyAdopt, []facts.Component{containerd, oldKubelet, leftover, unknown})
+	require.NoError(t, err)
+	var actions []string
+	for _, d := range decisions {
+		actions = append(actions, d.Action)
+	}
+	assert.Equal(t, []string{ActionAdopt, ActionRemove, ActionRemove, ActionRemove}, actions)
+	assert.Contains(t, decisions[1].Reason, "incompatible component version")
+	assert.Equal(t, "configuration left without the binary", decisions[2].Reason)
+	assert.Equal(t, "version unknown", decisions[3].Reason)
+	assert.Equal(t, []string{"kubelet", "kubelet", "containerd"}, Removed(decisions))
+
+	decisions, err = Decide(cat, "v1.30.2", PolicyRemove, []facts.Component{containerd})
+	require.NoError(t, err)
+	assert.Equal(t, ActionRemove, decisions[0].Action)
+
+	_, err = Decide(cat, "v1.30.2", PolicyFail, []facts.Component{containerd, oldKubelet})
+	assert.Equal(t, errs.Preflight, errs.KindOf(err))
+	assert.ErrorContains(t, err, "found containerd v1.7.13, kubelet v1.28.4 already installed")
+	decisions, err = Decide(cat, "v1.30.2", PolicyFail, nil)
+	require.NoError(t, err)
+	assert.Empty(t, decisions)
+}
+
+func TestRemoveCommands(t *testing.T) {
+	cmds, err := RemoveCommands(facts.PackageManagerApt, facts.InitSystemd, oldKubelet)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"{ systemctl disable --now kubelet; } >/dev/null 2>&1 || true",
+		"DEBIAN_FRONTEND=noninteractive apt-get remove -y kubelet",
+		"systemctl daemon-reload",
+	}, cmds)
+
+	cmds, err = RemoveCommands(facts.PackageManagerApk, facts.InitOpenRC, containerd)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"{ rc-service containerd stop; rc-update del containerd default 2>/dev/null || true; } >/dev/null 2>&1 || true",
+		"rm -rf /etc/containerd/config.toml /usr/local/bin/containerd",
+	}, cmds)
+}
+
+func TestApply(t *testing.T) {
+	ctx := context.Background()
+	fake := connectortest.NewFake().
+		On(`command -v \$c`, connectortest.Result{Stdout: "binary\tcontainerd\t/usr/local/bin/containerd\tactive\t\tcontainerd github.com/containerd/containerd v1.7.13 7c3aca7\n" +
+			"binary\tkubelet\t/usr/bin/kubelet\tinactive\tkubelet\tKubernetes v1.28.4\n" +
+			"config\t/etc/containerd/config.toml\n"}).
+		On(`cat /etc/os-release`, connectortest.Result{Stdout: "ID=ubuntu\nID_LIKE=debian\nVERSION_ID=\"22.04\"\n"})
+	h := connector.NewHost()
+	h.SetName("node1")
+	node := modules.Node{Host: h, Conn: fake}
+
+	decisions, err := Apply(ctx, node, Config{}, catalog.NewCatalog(), "v1.30.2")
+	require.NoError(t, err)
+	require.Len(t, decisions, 2)
+	assert.Equal(t, ActionAdopt, decisions[0].Action)
+	assert.Equal(t, []string{"kubelet"}, Removed(decisions))
+	assert.True(t, fake.Ran(`apt-get remove -y kubelet`))
+	assert.False(t, fake.Ran(`disable --now containerd`), "the adopted containerd is left alone")
+
+	_, err = Apply(ctx, node, Config{Policy: PolicyFail}, catalog.NewCatalog(), "v1.30.2")
+	assert.Equal(t, errs.Preflight, errs.KindOf(err))
+	_, err = Apply(ctx, node, Config{Policy: "keep"}, catalog.NewCatalog(), "v1.30.2")
+	assert.Equal(t, errs.Config, errs.KindOf(err))
+}
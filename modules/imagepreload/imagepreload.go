@@ -0,0 +1,304 @@
+// Package imagepreload imports container images into containerd on every
+// node from an OCI image layout shipped with the installation, so that
+// kubeadm and the add-ons find their images without pulling them. Every
+// imported image is checked against the digest recorded in the layout.
+package imagepreload
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/mensylisir/xmcores/common"
+	"github.com/mensylisir/xmcores/file"
+	"github.com/mensylisir/xmcores/logger"
+	"github.com/mensylisir/xmcores/modules"
+)
+
+const moduleName = "ImagePreload"
+
+// DefaultNamespace is the containerd namespace the kubelet uses.
+const DefaultNamespace = "k8s.io"
+
+// Annotations naming the images of an OCI image layout. ctr and nerdctl set
+// the first, skopeo and buildkit the second.
+const (
+	AnnotationImageName = "io.containerd.image.name"
+	AnnotationRefName   = "org.opencontainers.image.ref.name"
+)
+
+// containerdRoot holds the content and snapshots of imported images.
+const containerdRoot = "/var/lib/containerd"
+
+// Config selects the images to preload.
+type Config struct {
+	// Path is an OCI image layout on the controller: a directory with
+	// index.json, or a tar archive of one, optionally gzip-compressed.
+	Path string `yaml:"path,omitempty" json:"path,omitempty"`
+	// Namespace is the containerd namespace images are imported into.
+	// Defaults to DefaultNamespace.
+	Namespace string `yaml:"namespace,omitempty" json:"namespace,omitempty"`
+	// Distribution is how the archive reaches the nodes: direct (the
+	// default) or p2p, see modules.Distribute.
+	Distribution string `yaml:"distribution,omitempty" json:"distribution,omitempty"`
+}
+
+// SetDefaults fills unset fields.
+func (c *Config) SetDefaults() {
+	if c.Namespace == "" {
+		c.Namespace = DefaultNamespace
+	}
+}
+
+// Validate checks the configuration.
+func (c *Config) Validate() error {
+	if c.Path == "" {
+		return errors.New("image layout path must be set")
+	}
+	if _, err := os.Stat(c.Path); err != nil {
+		return fmt.Errorf("image layout %s: %w", c.Path, err)
+	}
+	if c.Namespace == "" || strings.ContainsAny(c.Namespace, " \t/'\"") {
+		return fmt.Errorf("invalid containerd namespace %q", c.Namespace)
+	}
+	return modules.ValidateDistribution(c.Distribution)
+}
+
+// Image is an image of the layout.
+type Image struct {
+	// Name is the reference the image is imported as.
+	Name string
+	// Digest is the digest of its manifest or index, which containerd
+	// reports as the image's digest.
+	Digest string
+}
+
+// index is the part of an OCI index.json Images reads.
+type index struct {
+	Manifests []struct {
+		Digest      string            `json:"digest"`
+		Annotations map[string]string `json:"annotations"`
+	} `json:"manifests"`
+}
+
+// Images lists the images of the layout at p, sorted by name. Images named
+// only by a tag, without repository, are rejected since ctr would import
+// them under a generated name.
+func Images(p string) ([]Image, error) {
+	data, err := readIndex(p)
+	if err != nil {
+		return nil, err
+	}
+	var idx index
+	if err := json.Unmarshal(data, &idx); err != nil {
+		return nil, fmt.Errorf("%s: invalid index.json: %w", p, err)
+	}
+	var images []Image
+	for _, m := range idx.Manifests {
+		name := m.Annotations[AnnotationImageName]
+		if name == "" {
+			name = m.Annotations[AnnotationRefName]
+		}
+		if !strings.Contains(name, "/") {
+			return nil, fmt.Errorf("%s: manifest %s has no full image name (annotation %s)", p, m.Digest, AnnotationImageName)
+		}
+		if !strings.HasPrefix(m.Digest, "sha256:") {
+			return nil, fmt.Errorf("%s: image %s has unsupported digest %q", p, name, m.Digest)
+		}
+		images = append(images, Image{Name: name, Digest: m.Digest})
+	}
+	if len(images) == 0 {
+		return nil, fmt.Errorf("%s: the layout has no images", p)
+	}
+	sort.Slice(images, func(i, j int) bool { return images[i].Name < images[j].Name })
+	return images, nil
+}
+
+// readIndex returns index.json of the layout directory or archive p.
+func readIndex(p string) ([]byte, error) {
+	if isDir, err := file.IsDir(p); err == nil && isDir {
+		data, err := os.ReadFile(filepath.Join(p, "index.json"))
+		if err != nil {
+			return nil, fmt.Errorf("%s is not an OCI image layout: %w", p, err)
+		}
+		return data, nil
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var r io.Reader = bufio.NewReader(f)
+	if magic, _ := r.(*bufio.Reader).Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", p, err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("%s is not an OCI image layout: no index.json", p)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", p, err)
+		}
+		if path.Clean(hdr.Name) == "index.json" {
+			return io.ReadAll(tr)
+		}
+	}
+}
+
+// ctr returns the ctr command line for args in the namespace of cfg.
+func ctr(cfg Config, args string) string {
+	return fmt.Sprintf("ctr -n %s %s", cfg.Namespace, args)
+}
+
+// ImportCommand returns the command importing the archive at remotePath.
+// The archive is decompressed by gzip so that ctr versions without support
+// for compressed archives can import it too.
+func ImportCommand(cfg Config, remotePath string) string {
+	return fmt.Sprintf("set -o pipefail; gzip -dcf %s | %s", remotePath, ctr(cfg, "images import -"))
+}
+
+// Present returns the digests of the images of namespace on node by name.
+func Present(ctx context.Context, node modules.Node, cfg Config) (map[string]string, error) {
+	out, err := modules.Run(ctx, node.Conn, ctr(cfg, "images ls"))
+	if err != nil {
+		return nil, err
+	}
+	return parseImageList(out), nil
+}
+
+// parseImageList reads the output of ctr images ls: a header line, then
+// REF TYPE DIGEST SIZE PLATFORMS LABELS.
+func parseImageList(out string) map[string]string {
+	images := map[string]string{}
+	for i, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		fields := strings.Fields(line)
+		if i == 0 || len(fields) < 3 {
+			continue
+		}
+		images[fields[0]] = fields[2]
+	}
+	return images
+}
+
+// Missing returns the images that are absent from present or have another
+// digest.
+func Missing(images []Image, present map[string]string) []Image {
+	var missing []Image
+	for _, img := range images {
+		if present[img.Name] != img.Digest {
+			missing = append(missing, img)
+		}
+	}
+	return missing
+}
+
+// Verify fails unless every image is present on node with its digest.
+func Verify(ctx context.Context, node modules.Node, cfg Config, images []Image) error {
+	present, err := Present(ctx, node, cfg)
+	if err != nil {
+		return err
+	}
+	var errList []error
+	for _, img := range Missing(images, present) {
+		if digest := present[img.Name]; digest != "" {
+			errList = append(errList, fmt.Errorf("image %s has digest %s, want %s", img.Name, digest, img.Digest))
+		} else {
+			errList = append(errList, fmt.Errorf("image %s was not imported", img.Name))
+		}
+	}
+	return errors.Join(errList...)
+}
+
+// Deploy imports the images of the layout into containerd on all nodes that
+// miss any of them and verifies their digests. containerd must be running.
+func Deploy(ctx context.Context, nodes []modules.Node, cfg Config) error {
+	cfg.SetDefaults()
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	images, err := Images(cfg.Path)
+	if err != nil {
+		return err
+	}
+
+	var pending []modules.Node
+	var errList []error
+	for _, node := range nodes {
+		present, err := Present(ctx, node, cfg)
+		if err != nil {
+			errList = append(errList, fmt.Errorf("%s: %w", node.Name(), err))
+			continue
+		}
+		if len(Missing(images, present)) > 0 {
+			pending = append(pending, node)
+		}
+	}
+	if err := errors.Join(errList...); err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		logger.Log.InfofModule(moduleName, "all %d images are present on every node", len(images))
+		return nil
+	}
+
+	archive := cfg.Path
+	if isDir, err := file.IsDir(cfg.Path); err == nil && isDir {
+		tmpDir, err := os.MkdirTemp("", "xmcores-images-")
+		if err != nil {
+			return fmt.Errorf("failed to create temp dir: %w", err)
+		}
+		defer os.RemoveAll(tmpDir)
+		archive = filepath.Join(tmpDir, "images.tar.gz")
+		if err := file.Tar(cfg.Path, archive, cfg.Path); err != nil {
+			return fmt.Errorf("failed to pack image layout %s: %w", cfg.Path, err)
+		}
+	}
+	info, err := os.Stat(archive)
+	if err != nil {
+		return err
+	}
+	remoteArchive := path.Join(common.GetTmpDir(), "images.tar")
+	if err := modules.ForEach(ctx, pending, func(ctx context.Context, node modules.Node) error {
+		if err := modules.CheckSpace(ctx, node, path.Dir(remoteArchive), info.Size(), 1); err != nil {
+			return err
+		}
+		// The content store keeps the compressed layers and the snapshotter
+		// their unpacked files.
+		if err := modules.CheckSpace(ctx, node, containerdRoot, 3*info.Size(), 0); err != nil {
+			return err
+		}
+		modules.TrackTemp(ctx, node, remoteArchive)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	logger.Log.InfofModule(moduleName, "importing %d images into %d nodes", len(images), len(pending))
+	if err := modules.Distribute(ctx, pending, archive, remoteArchive, cfg.Distribution); err != nil {
+		return fmt.Errorf("failed to upload images: %w", err)
+	}
+	return modules.ForEach(ctx, pending, func(ctx context.Context, node modules.Node) error {
+		if err := modules.RunAll(ctx, node.Conn, ImportCommand(cfg, remoteArchive), "rm -f "+remoteArchive); err != nil {
+			return err
+		}
+		modules.UntrackTemp(ctx, node, remoteArchive)
+		return Verify(ctx, node, cfg, images)
+	})
+}
@@ -0,0 +1,113 @@
+package imagepreload
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mensylisir/xmcores/connector"
+	"github.com/mensylisir/xmcores/connector/connectortest"
+	"github.com/mensylisir/xmcores/file"
+	"github.com/mensylisir/xmcores/modules"
+)
+
+const (
+	pauseDigest   = "sha256:7031c1b283388d2c2e09b57badb803c05ebed362dc88d84b480cc47f72a21097"
+	corednsDigest = "sha256:9caabbf6238b189a65d0d6e6ac138de60d6a1c419e5a341fbbb7c78382559c6e"
+)
+
+// writeLayout writes an OCI layout index naming pause and coredns.
+func writeLayout(t *testing.T) string {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "oci-layout"), []byte(`{"imageLayoutVersion":"1.0.0"}`), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "index.json"), []byte(`{"schemaVersion":2,"manifests":[
+{"mediaType":"application/vnd.oci.image.index.v1+json","digest":"`+pauseDigest+`","size":2,
+ "annotations":{"io.containerd.image.name":"registry.k8s.io/pause:3.10","org.opencontainers.image.ref.name":"3.10"}},
+{"mediaType":"application/vnd.oci.image.manifest.v1+json","digest":"`+corednsDigest+`","size":2,
+ "annotations":{"org.opencontainers.image.ref.name":"registry.k8s.io/coredns/coredns:v1.11.3"}}]}`), 0o644))
+	return dir
+}
+
+func TestImages(t *testing.T) {
+	dir := writeLayout(t)
+	want := []Image{
+		{Name: "registry.k8s.io/coredns/coredns:v1.11.3", Digest: corednsDigest},
+		{Name: "registry.k8s.io/pause:3.10", Digest: pauseDigest},
+	}
+	images, err := Images(dir)
+	require.NoError(t, err)
+	assert.Equal(t, want, images)
+
+	archive := filepath.Join(t.TempDir(), "images.tar.gz")
+	require.NoError(t, file.Tar(dir, archive, dir))
+	images, err = Images(archive)
+	require.NoError(t, err)
+	assert.Equal(t, want, images, "archives are read like directories")
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "index.json"), []byte(`{"manifests":[{"digest":"`+pauseDigest+`","annotations":{"org.opencontainers.image.ref.name":"3.10"}}]}`), 0o644))
+	_, err = Images(dir)
+	assert.ErrorContains(t, err, "has no full image name")
+	_, err = Images(t.TempDir())
+	assert.ErrorContains(t, err, "is not an OCI image layout")
+}
+
+func TestMissing(t *testing.T) {
+	present := parseImageList(`REF                             TYPE                                      DIGEST        SIZE    PLATFORMS   LABELS
+registry.k8s.io/pause:3.10      application/vnd.oci.image.index.v1+json   ` + pauseDigest + ` 311.5 KiB linux/amd64 io.cri-containerd.pinned=pinned
+registry.k8s.io/coredns/coredns:v1.11.3 application/vnd.oci.image.manifest.v1+json sha256:0000 18.2 MiB linux/amd64 -
+`)
+	assert.Equal(t, map[string]string{"registry.k8s.io/pause:3.10": pauseDigest, "registry.k8s.io/coredns/coredns:v1.11.3": "sha256:0000"}, present)
+	images := []Image{{Name: "registry.k8s.io/coredns/coredns:v1.11.3", Digest: corednsDigest}, {Name: "registry.k8s.io/pause:3.10", Digest: pauseDigest}}
+	assert.Equal(t, images[:1], Missing(images, present))
+}
+
+func TestDeploy(t *testing.T) {
+	ctx := context.Background()
+	cfg := Config{Path: writeLayout(t)}
+	const df = "/dev/sda1 51474912 40000000 10240000 80% /\n/dev/sda1 3276800 0 3276800 0% /\n"
+	header := "REF TYPE DIGEST SIZE PLATFORMS LABELS\n"
+	complete := header +
+		"registry.k8s.io/coredns/coredns:v1.11.3 manifest " + corednsDigest + " 18.2 MiB linux/amd64 -\n" +
+		"registry.k8s.io/pause:3.10 index " + pauseDigest + " 311.5 KiB linux/amd64 -\n"
+
+	fakes := connectortest.NewConnector()
+	var nodes []modules.Node
+	var imported atomic.Bool
+	for _, name := range []string{"node1", "node2"} {
+		h := connector.NewHost()
+		h.SetName(name)
+		nodes = append(nodes, modules.Node{Host: h, Conn: fakes.Host(name)})
+		fakes.Host(name).On(`df -P`, connectortest.Result{Stdout: df})
+	}
+	// node2 has the images already, node1 gets them on import.
+	fakes.Host("node2").On(`ctr -n k8s.io images ls`, connectortest.Result{Stdout: complete})
+	fakes.Host("node1").OnFunc(func(cmd string) bool { return strings.Contains(cmd, "images ls") }, func(string) connectortest.Result {
+		if imported.Load() {
+			return connectortest.Result{Stdout: complete}
+		}
+		return connectortest.Result{Stdout: header}
+	})
+	fakes.Host("node1").OnFunc(func(cmd string) bool { return strings.Contains(cmd, "images import") }, func(string) connectortest.Result {
+		imported.Store(true)
+		return connectortest.Result{}
+	})
+
+	require.NoError(t, Deploy(ctx, nodes, cfg))
+	assert.True(t, fakes.Host("node1").Ran(`set -o pipefail; gzip -dcf /tmp/xmcores/images\.tar \| ctr -n k8s\.io images import -`))
+	assert.True(t, fakes.Host("node1").Ran(`rm -f /tmp/xmcores/images\.tar`))
+	assert.False(t, fakes.Host("node2").Ran(`images import`), "nodes with every image are skipped")
+
+	// An import that leaves images behind fails the verification.
+	fake := connectortest.NewFake()
+	fake.On(`df -P`, connectortest.Result{Stdout: df})
+	fake.On(`images ls`, connectortest.Result{Stdout: header + "registry.k8s.io/pause:3.10 index sha256:0000 311.5 KiB linux/amd64 -\n"})
+	err := Deploy(ctx, []modules.Node{{Host: nodes[0].Host, Conn: fake}}, cfg)
+	assert.ErrorContains(t, err, "image registry.k8s.io/coredns/coredns:v1.11.3 was not imported")
+	assert.ErrorContains(t, err, "image registry.k8s.io/pause:3.10 has digest sha256:0000, want "+pauseDigest)
+}
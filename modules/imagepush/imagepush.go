@@ -0,0 +1,366 @@
+// Package imagepush pushes the images of an OCI image layout, the one
+// imagepreload imports, to the private registry of the cluster. Pushes are
+// incremental: images whose manifest the registry already has are skipped,
+// and of the others only the blobs the registry lacks are uploaded.
+package imagepush
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/mensylisir/xmcores/file"
+	"github.com/mensylisir/xmcores/logger"
+	"github.com/mensylisir/xmcores/modules"
+	"github.com/mensylisir/xmcores/modules/imagepreload"
+	"github.com/mensylisir/xmcores/registry"
+)
+
+const moduleName = "ImagePush"
+
+// DefaultConcurrency is the number of images pushed at once.
+const DefaultConcurrency = 4
+
+// Options tune Push.
+type Options struct {
+	// Concurrency is the number of images pushed at once. Defaults to
+	// DefaultConcurrency.
+	Concurrency int
+}
+
+// ImageResult is the outcome of pushing an image.
+type ImageResult struct {
+	Name   string `json:"name"`
+	Target string `json:"target"`
+	// Skipped is true when the registry already had the image.
+	Skipped      bool   `json:"skipped"`
+	BlobsPushed  int    `json:"blobsPushed"`
+	BlobsSkipped int    `json:"blobsSkipped"`
+	BytesPushed  int64  `json:"bytesPushed"`
+	BytesSkipped int64  `json:"bytesSkipped"`
+	Error        string `json:"error,omitempty"`
+}
+
+// Report sums up a push.
+type Report struct {
+	Images        []ImageResult `json:"images"`
+	ImagesPushed  int           `json:"imagesPushed"`
+	ImagesSkipped int           `json:"imagesSkipped"`
+	BlobsPushed   int           `json:"blobsPushed"`
+	BlobsSkipped  int           `json:"blobsSkipped"`
+	BytesPushed   int64         `json:"bytesPushed"`
+	BytesSkipped  int64         `json:"bytesSkipped"`
+}
+
+func (r *Report) add(img ImageResult) {
+	r.Images = append(r.Images, img)
+	if img.Error != "" {
+		return
+	}
+	if img.Skipped {
+		r.ImagesSkipped++
+	} else {
+		r.ImagesPushed++
+	}
+	r.BlobsPushed += img.BlobsPushed
+	r.BlobsSkipped += img.BlobsSkipped
+	r.BytesPushed += img.BytesPushed
+	r.BytesSkipped += img.BytesSkipped
+}
+
+// descriptor is the part of an OCI descriptor Push reads.
+type descriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+}
+
+// manifest is the part of an image manifest or index Push reads.
+type manifest struct {
+	MediaType string       `json:"mediaType"`
+	Config    *descriptor  `json:"config"`
+	Layers    []descriptor `json:"layers"`
+	Manifests []descriptor `json:"manifests"`
+}
+
+// layout reads the blobs of an OCI image layout directory.
+type layout string
+
+func (l layout) blobPath(digest string) (string, error) {
+	alg, hex, ok := strings.Cut(digest, ":")
+	if !ok || alg == "" || hex == "" || strings.ContainsAny(digest, "/\\") {
+		return "", fmt.Errorf("invalid digest %q", digest)
+	}
+	return filepath.Join(string(l), "blobs", alg, hex), nil
+}
+
+func (l layout) read(digest string) ([]byte, error) {
+	p, err := l.blobPath(digest)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return nil, fmt.Errorf("the layout lacks %s: %w", digest, err)
+	}
+	return data, nil
+}
+
+// mediaType returns the media type a manifest declares, or guesses it from
+// its fields.
+func (m *manifest) mediaType() string {
+	switch {
+	case m.MediaType != "":
+		return m.MediaType
+	case m.Manifests != nil:
+		return registry.MediaTypeOCIIndex
+	}
+	return registry.MediaTypeOCIManifest
+}
+
+// node is a manifest of an image with its raw content.
+type node struct {
+	digest    string
+	mediaType string
+	data      []byte
+}
+
+// tree returns the manifests of the image digest, children first, and the
+// blobs they reference.
+func (l layout) tree(digest string) ([]node, []descriptor, error) {
+	data, err := l.read(digest)
+	if err != nil {
+		return nil, nil, err
+	}
+	var m manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, nil, fmt.Errorf("invalid manifest %s: %w", digest, err)
+	}
+	top := node{digest: digest, mediaType: m.mediaType(), data: data}
+	var nodes []node
+	var blobs []descriptor
+	seen := map[string]bool{}
+	addBlob := func(d descriptor) {
+		if !seen[d.Digest] {
+			seen[d.Digest] = true
+			blobs = append(blobs, d)
+		}
+	}
+	if len(m.Manifests) > 0 {
+		for _, child := range m.Manifests {
+			n, b, err := l.tree(child.Digest)
+			if err != nil {
+				return nil, nil, err
+			}
+			nodes = append(nodes, n...)
+			for _, d := range b {
+				addBlob(d)
+			}
+		}
+	} else {
+		if m.Config != nil {
+			addBlob(*m.Config)
+		}
+		for _, d := range m.Layers {
+			addBlob(d)
+		}
+	}
+	return append(nodes, top), blobs, nil
+}
+
+// uploads makes images of the same repository pushed at the same time upload
+// a shared blob once.
+type uploads struct {
+	mu      sync.Mutex
+	pending map[string]chan struct{}
+}
+
+// start returns true if the caller is to upload the blob key, and a function
+// to call when done. Otherwise it waits for the upload in flight and returns
+// false.
+func (u *uploads) start(ctx context.Context, key string) (bool, func(), error) {
+	u.mu.Lock()
+	done, busy := u.pending[key]
+	if !busy {
+		done = make(chan struct{})
+		u.pending[key] = done
+	}
+	u.mu.Unlock()
+	if !busy {
+		return true, func() {
+			u.mu.Lock()
+			delete(u.pending, key)
+			u.mu.Unlock()
+			close(done)
+		}, nil
+	}
+	select {
+	case <-done:
+		return false, nil, nil
+	case <-ctx.Done():
+		return false, nil, ctx.Err()
+	}
+}
+
+// Target returns the reference image is pushed as to the registry of cfg.
+func Target(cfg registry.Config, image string) (repo, ref, target string) {
+	repo, ref = registry.Ref(image)
+	if cfg.Namespace != "" {
+		repo = cfg.Namespace + "/" + repo
+	}
+	return repo, ref, registry.FormatRef(cfg.Address, repo, ref)
+}
+
+// Push pushes the images of the layout at layoutPath, a directory or a
+// gzip-compressed archive of one, to the registry of cfg through client. The
+// report lists every image, also when some of them failed.
+func Push(ctx context.Context, client *registry.Client, cfg registry.Config, layoutPath string, opts Options) (Report, error) {
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = DefaultConcurrency
+	}
+	images, err := imagepreload.Images(layoutPath)
+	if err != nil {
+		return Report{}, err
+	}
+	dir := layoutPath
+	if isDir, err := file.IsDir(layoutPath); err != nil || !isDir {
+		tmpDir, err := os.MkdirTemp("", "xmcores-images-")
+		if err != nil {
+			return Report{}, fmt.Errorf("failed to create temp dir: %w", err)
+		}
+		defer os.RemoveAll(tmpDir)
+		// Image bundles exceed the default size limit; the archive is the
+		// user's own, so only unsafe entries are refused.
+		if err := file.UntarWithOptions(layoutPath, tmpDir, file.UntarOptions{Strict: true}); err != nil {
+			return Report{}, fmt.Errorf("failed to unpack image layout %s: %w", layoutPath, err)
+		}
+		dir = tmpDir
+	}
+
+	logger.Log.InfofModule(moduleName, "pushing %d images to %s, %d at a time", len(images), cfg.Address, opts.Concurrency)
+	p := &pusher{client: client, layout: layout(dir), uploads: &uploads{pending: map[string]chan struct{}{}}}
+	results := make([]ImageResult, len(images))
+	sem := make(chan struct{}, opts.Concurrency)
+	var wg sync.WaitGroup
+	for i, img := range images {
+		wg.Add(1)
+		go func(i int, img imagepreload.Image) {
+			defer wg.Done()
+			repo, ref, target := Target(cfg, img.Name)
+			results[i] = ImageResult{Name: img.Name, Target: target}
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				results[i].Error = ctx.Err().Error()
+				return
+			}
+			defer func() { <-sem }()
+			if err := p.push(ctx, img, repo, ref, &results[i]); err != nil {
+				results[i].Error = err.Error()
+			}
+		}(i, img)
+	}
+	wg.Wait()
+
+	var report Report
+	var errList []error
+	for _, r := range results {
+		report.add(r)
+		if r.Error != "" {
+			errList = append(errList, fmt.Errorf("%s: %s", r.Name, r.Error))
+		}
+	}
+	logger.Log.InfofModule(moduleName, "pushed %d images (%d blobs, %s), skipped %d images and %d blobs (%s) the registry had",
+		report.ImagesPushed, report.BlobsPushed, modules.FormatSize(report.BytesPushed),
+		report.ImagesSkipped, report.BlobsSkipped, modules.FormatSize(report.BytesSkipped))
+	return report, errors.Join(errList...)
+}
+
+type pusher struct {
+	client  *registry.Client
+	layout  layout
+	uploads *uploads
+}
+
+// push pushes img as repo:ref, recording what it transferred in res.
+func (p *pusher) push(ctx context.Context, img imagepreload.Image, repo, ref string, res *ImageResult) error {
+	nodes, blobs, err := p.layout.tree(img.Digest)
+	if err != nil {
+		return err
+	}
+	current, err := p.client.ManifestDigest(ctx, repo, ref)
+	if err != nil {
+		return err
+	}
+	if current == img.Digest {
+		res.Skipped = true
+		for _, b := range blobs {
+			res.BlobsSkipped++
+			res.BytesSkipped += b.Size
+		}
+		logger.Log.DebugfModule(moduleName, "%s is up to date", res.Target)
+		return nil
+	}
+
+	for _, b := range blobs {
+		pushed, err := p.pushBlob(ctx, repo, b)
+		if err != nil {
+			return err
+		}
+		if pushed {
+			res.BlobsPushed++
+			res.BytesPushed += b.Size
+		} else {
+			res.BlobsSkipped++
+			res.BytesSkipped += b.Size
+		}
+	}
+	// Children are referenced by the index, so they go first, by digest.
+	for i, n := range nodes {
+		target := n.digest
+		if i == len(nodes)-1 {
+			target = ref
+		}
+		if err := p.client.PushManifest(ctx, repo, target, n.mediaType, n.data); err != nil {
+			return err
+		}
+	}
+	logger.Log.InfofModule(moduleName, "pushed %s: %d blobs (%s) uploaded, %d (%s) already present",
+		res.Target, res.BlobsPushed, modules.FormatSize(res.BytesPushed), res.BlobsSkipped, modules.FormatSize(res.BytesSkipped))
+	return nil
+}
+
+// pushBlob uploads the blob d to repo unless the registry has it, and
+// reports whether it did.
+func (p *pusher) pushBlob(ctx context.Context, repo string, d descriptor) (bool, error) {
+	mine, done, err := p.uploads.start(ctx, repo+"@"+d.Digest)
+	if err != nil || !mine {
+		return false, err
+	}
+	defer done()
+	ok, err := p.client.BlobExists(ctx, repo, d.Digest)
+	if err != nil || ok {
+		return false, err
+	}
+	path, err := p.layout.blobPath(d.Digest)
+	if err != nil {
+		return false, err
+	}
+	open := func() (io.ReadCloser, error) {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("the layout lacks %s: %w", d.Digest, err)
+		}
+		return f, nil
+	}
+	if err := p.client.PushBlob(ctx, repo, d.Digest, d.Size, open); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,141 @@
+package imagepush
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mensylisir/xmcores/file"
+	"github.com/mensylisir/xmcores/registry"
+)
+
+// memRegistry is an in-memory registry serving the requests Push sends.
+type memRegistry struct {
+	mu        sync.Mutex
+	blobs     map[string]bool
+	manifests map[string]string
+	uploads   int
+}
+
+func (m *memRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p := strings.TrimPrefix(r.URL.Path, "/v2/")
+	switch {
+	case r.Method == http.MethodHead && strings.Contains(p, "/blobs/"):
+		if !m.blobs[p] {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	case r.Method == http.MethodPost && strings.HasSuffix(p, "/blobs/uploads/"):
+		w.Header().Set("Location", "/v2/"+strings.TrimSuffix(p, "uploads/")+"upload-1?state=x")
+		w.WriteHeader(http.StatusAccepted)
+	case r.Method == http.MethodPut && strings.HasSuffix(p, "/blobs/upload-1"):
+		data, _ := io.ReadAll(r.Body)
+		digest := r.URL.Query().Get("digest")
+		if r.URL.Query().Get("state") != "x" || digestOf(data) != digest {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		m.blobs[strings.TrimSuffix(p, "upload-1")+digest] = true
+		m.uploads++
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodHead && strings.Contains(p, "/manifests/"):
+		digest, ok := m.manifests[p]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Docker-Content-Digest", digest)
+	case r.Method == http.MethodPut && strings.Contains(p, "/manifests/"):
+		data, _ := io.ReadAll(r.Body)
+		m.manifests[p] = digestOf(data)
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func digestOf(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// writeBlob stores data in the layout dir and returns its digest.
+func writeBlob(t *testing.T, dir string, data []byte) string {
+	digest := digestOf(data)
+	p := filepath.Join(dir, "blobs", "sha256", strings.TrimPrefix(digest, "sha256:"))
+	require.NoError(t, os.MkdirAll(filepath.Dir(p), 0o755))
+	require.NoError(t, os.WriteFile(p, data, 0o644))
+	return digest
+}
+
+// writeLayout writes a layout with pause as an index of one manifest and
+// coredns as a manifest, both sharing their base layer.
+func writeLayout(t *testing.T) string {
+	dir := t.TempDir()
+	base := writeBlob(t, dir, []byte("base layer"))
+	manifest := func(config string) string {
+		cfg := writeBlob(t, dir, []byte(config))
+		return writeBlob(t, dir, []byte(fmt.Sprintf(`{"schemaVersion":2,"mediaType":"%s",`+
+			`"config":{"digest":"%s","size":%d},"layers":[{"digest":"%s","size":10}]}`,
+			registry.MediaTypeOCIManifest, cfg, len(config), base)))
+	}
+	pause := manifest(`{"pause":true}`)
+	pauseIndex := writeBlob(t, dir, []byte(`{"schemaVersion":2,"mediaType":"`+registry.MediaTypeOCIIndex+`",`+
+		`"manifests":[{"digest":"`+pause+`","size":1,"platform":{"architecture":"amd64","os":"linux"}}]}`))
+	coredns := manifest(`{"coredns":true}`)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "index.json"), []byte(`{"schemaVersion":2,"manifests":[
+{"digest":"`+pauseIndex+`","annotations":{"io.containerd.image.name":"registry.k8s.io/pause:3.10"}},
+{"digest":"`+coredns+`","annotations":{"io.containerd.image.name":"registry.k8s.io/coredns/coredns:v1.11.3"}}]}`), 0o644))
+	return dir
+}
+
+func TestPush(t *testing.T) {
+	mem := &memRegistry{blobs: map[string]bool{}, manifests: map[string]string{}}
+	srv := httptest.NewServer(mem)
+	defer srv.Close()
+	cfg := registry.Config{Address: strings.TrimPrefix(srv.URL, "http://"), Namespace: "k8s", PlainHTTP: true}
+	client, err := registry.NewClient(cfg)
+	require.NoError(t, err)
+	ctx := context.Background()
+	dir := writeLayout(t)
+
+	report, err := Push(ctx, client, cfg, dir, Options{Concurrency: 2})
+	require.NoError(t, err)
+	assert.Equal(t, 2, report.ImagesPushed)
+	assert.Equal(t, 4, report.BlobsPushed, "two configs and one layer per repository")
+	assert.Equal(t, int64(10+16+10+14), report.BytesPushed)
+	assert.Equal(t, cfg.Address+"/k8s/coredns/coredns:v1.11.3", report.Images[0].Target)
+	assert.Contains(t, mem.manifests, "k8s/pause/manifests/3.10")
+	assert.Len(t, mem.manifests, 3, "the pause index by tag and its child by digest, coredns by tag")
+
+	report, err = Push(ctx, client, cfg, dir, Options{})
+	require.NoError(t, err)
+	assert.Equal(t, 2, report.ImagesSkipped)
+	assert.Zero(t, report.BlobsPushed)
+	assert.Equal(t, report.BytesSkipped, int64(10+16+10+14))
+	assert.Equal(t, 4, mem.uploads, "nothing is uploaded twice")
+
+	// A tag the registry lost only needs its manifest pushed again.
+	delete(mem.manifests, "k8s/coredns/coredns/manifests/v1.11.3")
+	archive := filepath.Join(t.TempDir(), "images.tar.gz")
+	require.NoError(t, file.Tar(dir, archive, dir))
+	report, err = Push(ctx, client, cfg, archive, Options{})
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.ImagesPushed)
+	assert.Equal(t, 4, report.BlobsSkipped)
+	assert.Zero(t, report.BlobsPushed, "the blobs are present")
+	assert.Equal(t, 4, mem.uploads)
+}
@@ -0,0 +1,312 @@
+// Package ingress deploys an ingress controller (ingress-nginx or HAProxy) with
+// host-network or NodePort exposure and a default TLS certificate.
+package ingress
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"time"
+
+	"github.com/mensylisir/xmcores/logger"
+	"github.com/mensylisir/xmcores/modules"
+	"github.com/mensylisir/xmcores/shellquote"
+	"github.com/mensylisir/xmcores/util"
+)
+
+const moduleName = "Ingress"
+
+// Controllers.
+const (
+	ControllerNginx   = "nginx"
+	ControllerHAProxy = "haproxy"
+)
+
+// Exposure modes.
+const (
+	ModeHostNetwork = "hostNetwork"
+	ModeNodePort    = "nodePort"
+)
+
+const (
+	DefaultTLSSecret    = "ingress-default-tls"
+	DefaultReadyTimeout = 5 * time.Minute
+)
+
+// TLSConfig provides the default certificate. When both files are empty a
+// self-signed certificate is generated.
+type TLSConfig struct {
+	CertFile string `yaml:"certFile,omitempty" json:"certFile,omitempty"`
+	KeyFile  string `yaml:"keyFile,omitempty" json:"keyFile,omitempty"`
+	// Hosts are the DNS names of the generated certificate.
+	Hosts []string `yaml:"hosts,omitempty" json:"hosts,omitempty"`
+}
+
+// Config is the ingress section of the cluster configuration.
+type Config struct {
+	Controller    string        `yaml:"controller,omitempty" json:"controller,omitempty"`
+	Version       string        `yaml:"version,omitempty" json:"version,omitempty"`
+	Mode          string        `yaml:"mode,omitempty" json:"mode,omitempty"`
+	HTTPNodePort  int           `yaml:"httpNodePort,omitempty" json:"httpNodePort,omitempty"`
+	HTTPSNodePort int           `yaml:"httpsNodePort,omitempty" json:"httpsNodePort,omitempty"`
+	DefaultTLS    *TLSConfig    `yaml:"defaultTLS,omitempty" json:"defaultTLS,omitempty"`
+	ReadyTimeout  time.Duration `yaml:"readyTimeout,omitempty" json:"readyTimeout,omitempty"`
+}
+
+type controller struct {
+	version    string
+	manifest   string
+	namespace  string
+	deployment string
+	service    string
+}
+
+var controllers = map[string]controller{
+	ControllerNginx: {
+		version:    "v1.10.1",
+		manifest:   "https://raw.githubusercontent.com/kubernetes/ingress-nginx/controller-{{.Version}}/deploy/static/provider/baremetal/deploy.yaml",
+		namespace:  "ingress-nginx",
+		deployment: "ingress-nginx-controller",
+		service:    "ingress-nginx-controller",
+	},
+	ControllerHAProxy: {
+		version:    "v1.11.4",
+		manifest:   "https://raw.githubusercontent.com/haproxytech/kubernetes-ingress/{{.Version}}/deploy/haproxy-ingress.yaml",
+		namespace:  "haproxy-controller",
+		deployment: "haproxy-kubernetes-ingress",
+		service:    "haproxy-kubernetes-ingress",
+	},
+}
+
+// Workload returns the namespace and name of the controller Deployment.
+func (c *Config) Workload() (namespace, deployment string) {
+	ctrl := controllers[c.Controller]
+	return ctrl.namespace, ctrl.deployment
+}
+
+// SetDefaults fills unset fields.
+func (c *Config) SetDefaults() {
+	if c.Controller == "" {
+		c.Controller = ControllerNginx
+	}
+	if ctrl, ok := controllers[c.Controller]; ok && c.Version == "" {
+		c.Version = ctrl.version
+	}
+	if c.Mode == "" {
+		c.Mode = ModeNodePort
+	}
+	if c.ReadyTimeout == 0 {
+		c.ReadyTimeout = DefaultReadyTimeout
+	}
+}
+
+// Validate checks the configuration.
+func (c *Config) Validate() error {
+	if _, ok := controllers[c.Controller]; !ok {
+		return fmt.Errorf("unsupported ingress controller %q (want %s or %s)", c.Controller, ControllerNginx, ControllerHAProxy)
+	}
+	switch c.Mode {
+	case ModeHostNetwork:
+		if c.HTTPNodePort != 0 || c.HTTPSNodePort != 0 {
+			return fmt.Errorf("node ports cannot be set in %s mode", ModeHostNetwork)
+		}
+	case ModeNodePort:
+		for _, p := range []int{c.HTTPNodePort, c.HTTPSNodePort} {
+			if p != 0 && (p < 30000 || p > 32767) {
+				return fmt.Errorf("node port %d is outside the default range 30000-32767", p)
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported ingress mode %q (want %s or %s)", c.Mode, ModeHostNetwork, ModeNodePort)
+	}
+	if t := c.DefaultTLS; t != nil && (t.CertFile == "") != (t.KeyFile == "") {
+		return fmt.Errorf("defaultTLS requires both certFile and keyFile, or neither to generate a self-signed certificate")
+	}
+	return nil
+}
+
+// ManifestURL returns the upstream manifest of the configured controller version.
+func (c *Config) ManifestURL() (string, error) {
+	return util.RenderString(controllers[c.Controller].manifest, util.Data{"Version": c.Version})
+}
+
+type jsonPatchOp struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// DeploymentPatch returns the JSON patch applied to the controller deployment,
+// or an empty string when no change is needed.
+func (c *Config) DeploymentPatch() (string, error) {
+	var ops []jsonPatchOp
+	if c.Mode == ModeHostNetwork {
+		ops = append(ops,
+			jsonPatchOp{Op: "add", Path: "/spec/template/spec/hostNetwork", Value: true},
+			jsonPatchOp{Op: "add", Path: "/spec/template/spec/dnsPolicy", Value: "ClusterFirstWithHostNet"},
+		)
+	}
+	if c.DefaultTLS != nil {
+		ops = append(ops, jsonPatchOp{
+			Op:    "add",
+			Path:  "/spec/template/spec/containers/0/args/-",
+			Value: fmt.Sprintf("--default-ssl-certificate=%s/%s", controllers[c.Controller].namespace, DefaultTLSSecret),
+		})
+	}
+	return marshalPatch(ops)
+}
+
+// ServicePatch returns the JSON patch pinning the node ports, or an empty string.
+func (c *Config) ServicePatch() (string, error) {
+	var ops []jsonPatchOp
+	if c.Mode == ModeNodePort {
+		if c.HTTPNodePort != 0 {
+			ops = append(ops, jsonPatchOp{Op: "replace", Path: "/spec/ports/0/nodePort", Value: c.HTTPNodePort})
+		}
+		if c.HTTPSNodePort != 0 {
+			ops = append(ops, jsonPatchOp{Op: "replace", Path: "/spec/ports/1/nodePort", Value: c.HTTPSNodePort})
+		}
+	}
+	return marshalPatch(ops)
+}
+
+func marshalPatch(ops []jsonPatchOp) (string, error) {
+	if len(ops) == 0 {
+		return "", nil
+	}
+	b, err := json.Marshal(ops)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal patch: %w", err)
+	}
+	return string(b), nil
+}
+
+// GenerateSelfSigned returns a PEM-encoded self-signed certificate and key for hosts.
+func GenerateSelfSigned(hosts []string, validity time.Duration) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate serial number: %w", err)
+	}
+	cn := "ingress.local"
+	if len(hosts) > 0 {
+		cn = hosts[0]
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: cn},
+		DNSNames:              append([]string{}, hosts...),
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	if len(tmpl.DNSNames) == 0 {
+		tmpl.DNSNames = []string{cn}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create certificate: %w", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to marshal key: %w", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), nil
+}
+
+// TLSSecretManifest renders a kubernetes.io/tls secret.
+func TLSSecretManifest(namespace, name string, cert, key []byte) []byte {
+	return []byte(fmt.Sprintf(`apiVersion: v1
+kind: Secret
+metadata:
+  name: %s
+  namespace: %s
+type: kubernetes.io/tls
+data:
+  tls.crt: %s
+  tls.key: %s
+`, name, namespace, base64.StdEncoding.EncodeToString(cert), base64.StdEncoding.EncodeToString(key)))
+}
+
+func (c *Config) tlsMaterial() ([]byte, []byte, error) {
+	t := c.DefaultTLS
+	if t.CertFile == "" {
+		return GenerateSelfSigned(t.Hosts, 365*24*time.Hour)
+	}
+	cert, err := os.ReadFile(t.CertFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read default TLS certificate: %w", err)
+	}
+	key, err := os.ReadFile(t.KeyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read default TLS key: %w", err)
+	}
+	return cert, key, nil
+}
+
+// Deploy installs the ingress controller from a control-plane node and waits until it is ready.
+func Deploy(ctx context.Context, controlPlane modules.Node, cfg Config) error {
+	cfg.SetDefaults()
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	ctrl := controllers[cfg.Controller]
+	logger.Log.InfofModule(moduleName, "deploying %s ingress controller %s in %s mode", cfg.Controller, cfg.Version, cfg.Mode)
+
+	url, err := cfg.ManifestURL()
+	if err != nil {
+		return err
+	}
+	if _, err := modules.Kubectl(ctx, controlPlane.Conn, "apply -f "+shellquote.Quote(url)); err != nil {
+		return err
+	}
+
+	if cfg.DefaultTLS != nil {
+		cert, key, err := cfg.tlsMaterial()
+		if err != nil {
+			return err
+		}
+		if err := modules.KubectlApply(ctx, controlPlane.Conn, "ingress-default-tls", TLSSecretManifest(ctrl.namespace, DefaultTLSSecret, cert, key)); err != nil {
+			return err
+		}
+	}
+
+	if patch, err := cfg.DeploymentPatch(); err != nil {
+		return err
+	} else if patch != "" {
+		// shellquote:ok: the names come from the controllers table.
+		if _, err := modules.Kubectl(ctx, controlPlane.Conn, fmt.Sprintf("-n %s patch deployment %s --type=json -p %s", ctrl.namespace, ctrl.deployment, shellquote.Quote(patch))); err != nil {
+			return err
+		}
+	}
+	if patch, err := cfg.ServicePatch(); err != nil {
+		return err
+	} else if patch != "" {
+		// shellquote:ok: the names come from the controllers table.
+		if _, err := modules.Kubectl(ctx, controlPlane.Conn, fmt.Sprintf("-n %s patch service %s --type=json -p %s", ctrl.namespace, ctrl.service, shellquote.Quote(patch))); err != nil {
+			return err
+		}
+	}
+
+	// shellquote:ok: the names come from the controllers table.
+	if _, err := modules.Kubectl(ctx, controlPlane.Conn, fmt.Sprintf("-n %s rollout status deployment/%s --timeout=%s", ctrl.namespace, ctrl.deployment, shellquote.Quote(cfg.ReadyTimeout.String()))); err != nil {
+		return fmt.Errorf("ingress controller did not become ready: %w", err)
+	}
+	return nil
+}
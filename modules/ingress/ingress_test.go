@@ -0,0 +1,83 @@
+package ingress
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigValidate(t *testing.T) {
+	cfg := Config{}
+	cfg.SetDefaults()
+	require.NoError(t, cfg.Validate())
+	assert.Equal(t, ControllerNginx, cfg.Controller)
+	assert.Equal(t, ModeNodePort, cfg.Mode)
+	assert.Equal(t, "v1.10.1", cfg.Version)
+
+	for _, bad := range []Config{
+		{Controller: "traefik", Mode: ModeNodePort},
+		{Controller: ControllerNginx, Mode: "loadBalancer"},
+		{Controller: ControllerNginx, Mode: ModeHostNetwork, HTTPNodePort: 30080},
+		{Controller: ControllerNginx, Mode: ModeNodePort, HTTPSNodePort: 443},
+		{Controller: ControllerNginx, Mode: ModeNodePort, DefaultTLS: &TLSConfig{CertFile: "tls.crt"}},
+	} {
+		assert.Error(t, bad.Validate(), "%+v", bad)
+	}
+}
+
+func TestManifestURL(t *testing.T) {
+	cfg := Config{Controller: ControllerHAProxy}
+	cfg.SetDefaults()
+	url, err := cfg.ManifestURL()
+	require.NoError(t, err)
+	assert.Equal(t, "https://raw.githubusercontent.com/haproxytech/kubernetes-ingress/v1.11.4/deploy/haproxy-ingress.yaml", url)
+}
+
+func TestPatches(t *testing.T) {
+	cfg := Config{Controller: ControllerNginx, Mode: ModeHostNetwork, DefaultTLS: &TLSConfig{}}
+	patch, err := cfg.DeploymentPatch()
+	require.NoError(t, err)
+	assert.JSONEq(t, `[
+		{"op":"add","path":"/spec/template/spec/hostNetwork","value":true},
+		{"op":"add","path":"/spec/template/spec/dnsPolicy","value":"ClusterFirstWithHostNet"},
+		{"op":"add","path":"/spec/template/spec/containers/0/args/-","value":"--default-ssl-certificate=ingress-nginx/ingress-default-tls"}
+	]`, patch)
+	patch, err = cfg.ServicePatch()
+	require.NoError(t, err)
+	assert.Empty(t, patch)
+
+	cfg = Config{Controller: ControllerNginx, Mode: ModeNodePort, HTTPNodePort: 30080, HTTPSNodePort: 30443}
+	patch, err = cfg.DeploymentPatch()
+	require.NoError(t, err)
+	assert.Empty(t, patch)
+	patch, err = cfg.ServicePatch()
+	require.NoError(t, err)
+	assert.JSONEq(t, `[
+		{"op":"replace","path":"/spec/ports/0/nodePort","value":30080},
+		{"op":"replace","path":"/spec/ports/1/nodePort","value":30443}
+	]`, patch)
+}
+
+func TestGenerateSelfSigned(t *testing.T) {
+	certPEM, keyPEM, err := GenerateSelfSigned([]string{"apps.example.com", "*.apps.example.com"}, time.Hour)
+	require.NoError(t, err)
+	block, _ := pem.Decode(certPEM)
+	require.NotNil(t, block)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	require.NoError(t, err)
+	assert.Equal(t, "apps.example.com", cert.Subject.CommonName)
+	assert.NoError(t, cert.VerifyHostname("foo.apps.example.com"))
+
+	keyBlock, _ := pem.Decode(keyPEM)
+	require.NotNil(t, keyBlock)
+	_, err = x509.ParseECPrivateKey(keyBlock.Bytes)
+	assert.NoError(t, err)
+
+	secret := string(TLSSecretManifest("ingress-nginx", DefaultTLSSecret, certPEM, keyPEM))
+	assert.Contains(t, secret, "type: kubernetes.io/tls")
+	assert.Contains(t, secret, "namespace: ingress-nginx")
+}
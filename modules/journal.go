@@ -0,0 +1,396 @@
+package modules
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mensylisir/xmcores/errs"
+	"github.com/mensylisir/xmcores/shellquote"
+)
+
+// DefaultJournalBackupDir is where the hosts keep the prior content of the
+// files a journaled run replaced.
+const DefaultJournalBackupDir = "/var/lib/xm/backups"
+
+// JournalConfig makes the commands that change the cluster record what they
+// change on the hosts: the files written with WriteFileWith and
+// UploadFileWith, the packages installed with InstallPackages and the
+// services changed with Service. The changes can be listed and reverted
+// later, see Revert.
+type JournalConfig struct {
+	// BackupDir is the directory on the hosts the files are copied to before
+	// they are replaced, named after the SHA-256 of their content;
+	// DefaultJournalBackupDir by default.
+	BackupDir string `yaml:"backupDir,omitempty" json:"backupDir,omitempty"`
+}
+
+// SetDefaults fills unset fields.
+func (c *JournalConfig) SetDefaults() {
+	if c.BackupDir == "" {
+		c.BackupDir = DefaultJournalBackupDir
+	}
+}
+
+// Validate checks the configuration.
+func (c JournalConfig) Validate() error {
+	if !path.IsAbs(c.BackupDir) || path.Clean(c.BackupDir) == "/" {
+		return fmt.Errorf("backupDir: %q must be an absolute path below /", c.BackupDir)
+	}
+	return nil
+}
+
+// Kinds of Change.
+const (
+	ChangeFile    = "file"
+	ChangePackage = "package"
+	ChangeService = "service"
+)
+
+// Package actions of a Change.
+const (
+	PackageInstall = "install"
+	PackageRemove  = "remove"
+)
+
+// ErrNotRevertible is returned (wrapped) by Revert for a change that cannot
+// be undone, such as a service restart.
+var ErrNotRevertible = errors.New("change cannot be reverted")
+
+// Change is a change a run made to a host.
+type Change struct {
+	// ID identifies the change: the ID of the run and a sequence number.
+	ID   string    `json:"id"`
+	Run  string    `json:"run"`
+	Host string    `json:"host"`
+	Time time.Time `json:"time"`
+	Kind string    `json:"kind"`
+
+	// Path is the file written. Sum and PriorSum are the SHA-256 of its
+	// content after and before, empty when there was no file, and Backup the
+	// copy of the prior content on the host.
+	Path     string `json:"path,omitempty"`
+	Sum      string `json:"sum,omitempty"`
+	PriorSum string `json:"priorSum,omitempty"`
+	Backup   string `json:"backup,omitempty"`
+
+	// Action is the package action or the service action (see ServiceCmd).
+	Action string `json:"action,omitempty"`
+	// PackageManager and Packages are the packages installed or removed,
+	// those that were already installed left out.
+	PackageManager string   `json:"packageManager,omitempty"`
+	Packages       []string `json:"packages,omitempty"`
+	// InitSystem and Service are the service changed; PriorActive and
+	// PriorEnabled whether it was running and started at boot before.
+	InitSystem   string `json:"initSystem,omitempty"`
+	Service      string `json:"service,omitempty"`
+	PriorActive  bool   `json:"priorActive,omitempty"`
+	PriorEnabled bool   `json:"priorEnabled,omitempty"`
+
+	// Reverts is the ID of the change this one reverted.
+	Reverts string `json:"reverts,omitempty"`
+}
+
+// Describe summarizes the change, e.g. "replaced /etc/chrony.conf".
+func (c Change) Describe() string {
+	switch c.Kind {
+	case ChangeFile:
+		switch {
+		case c.Sum == "":
+			return "removed " + c.Path
+		case c.PriorSum == "":
+			return "created " + c.Path
+		}
+		return "replaced " + c.Path
+	case ChangePackage:
+		verb := "installed"
+		if c.Action == PackageRemove {
+			verb = "removed"
+		}
+		return fmt.Sprintf("%s %s with %s", verb, strings.Join(c.Packages, " "), c.PackageManager)
+	case ChangeService:
+		return fmt.Sprintf("%s %s (was %s, %s)", c.Action, c.Service, state(c.PriorActive, "running", "stopped"), state(c.PriorEnabled, "enabled", "disabled"))
+	}
+	return c.Kind
+}
+
+func state(b bool, yes, no string) string {
+	if b {
+		return yes
+	}
+	return no
+}
+
+// Journal collects the changes of a run. It is safe for concurrent use.
+type Journal struct {
+	run       string
+	backupDir string
+
+	mu      sync.Mutex
+	changes []Change
+}
+
+// NewJournal returns an empty journal of the run with the ID run.
+func NewJournal(run string, cfg JournalConfig) *Journal {
+	cfg.SetDefaults()
+	return &Journal{run: run, backupDir: cfg.BackupDir}
+}
+
+// Record adds c, giving it its ID, run and time.
+func (j *Journal) Record(c Change) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	c.ID, c.Run = fmt.Sprintf("%s.%d", j.run, len(j.changes)+1), j.run
+	if c.Time.IsZero() {
+		c.Time = time.Now()
+	}
+	j.changes = append(j.changes, c)
+}
+
+// Changes returns the recorded changes in the order they were made.
+func (j *Journal) Changes() []Change {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return append([]Change(nil), j.changes...)
+}
+
+// backup copies the file p of node, whose content has the SHA-256 sum, to the
+// backup directory and returns the copy. Files with the same content share
+// a copy.
+func (j *Journal) backup(ctx context.Context, node Node, p, sum string) (string, error) {
+	dst := path.Join(j.backupDir, sum)
+	// The backups may hold secrets, like the files they are taken of.
+	if _, err := Run(ctx, node.Conn, fmt.Sprintf("install -d -m 0700 %s && cp -p %s %s",
+		shellquote.Quote(j.backupDir), shellquote.Quote(p), shellquote.Quote(dst))); err != nil {
+		return "", fmt.Errorf("failed to back up %s: %w", p, err)
+	}
+	return dst, nil
+}
+
+// Reverted maps the IDs of the changes of journal that were reverted to
+// the ID of the change reverting them.
+func Reverted(journal []Change) map[string]string {
+	out := map[string]string{}
+	for _, c := range journal {
+		if c.Reverts != "" {
+			out[c.Reverts] = c.ID
+		}
+	}
+	return out
+}
+
+type journalKey struct{}
+
+// WithJournal returns a context carrying j, where the file, package and
+// service helpers record their changes.
+func WithJournal(ctx context.Context, j *Journal) context.Context {
+	return context.WithValue(ctx, journalKey{}, j)
+}
+
+// JournalFrom returns the journal carried by ctx, if any.
+func JournalFrom(ctx context.Context) (*Journal, bool) {
+	j, ok := ctx.Value(journalKey{}).(*Journal)
+	return j, ok
+}
+
+// InstallPackages installs pkgs on node with the package manager family
+// packageManager (see InstallCmd). With a Journal in ctx, the packages that
+// were not installed yet are recorded, so that reverting the change removes
+// only those.
+func InstallPackages(ctx context.Context, node Node, packageManager string, pkgs ...string) error {
+	install, err := InstallCmd(packageManager, pkgs...)
+	if err != nil {
+		return err
+	}
+	j, journaled := JournalFrom(ctx)
+	var missing []string
+	if journaled {
+		for _, p := range pkgs {
+			query, err := InstalledCmd(packageManager, p)
+			if err != nil {
+				return err
+			}
+			installed, err := Succeeds(ctx, node.Conn, query)
+			if err != nil {
+				return err
+			}
+			if !installed {
+				missing = append(missing, p)
+			}
+		}
+	}
+	if _, err := Run(ctx, node.Conn, install); err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		j.Record(Change{Host: node.Name(), Kind: ChangePackage, Action: PackageInstall, PackageManager: packageManager, Packages: missing})
+	}
+	return nil
+}
+
+// Service applies action, one changing the service, to service on node with
+// the init system initSystem (see ServiceCmd). With a Journal in ctx, the
+// change is recorded with whether the service was running and enabled.
+func Service(ctx context.Context, node Node, initSystem, action, service string) error {
+	cmd, err := ServiceCmd(initSystem, action, service)
+	if err != nil {
+		return err
+	}
+	j, journaled := JournalFrom(ctx)
+	c := Change{Host: node.Name(), Kind: ChangeService, Action: action, InitSystem: initSystem, Service: service}
+	if journaled {
+		if c.PriorActive, c.PriorEnabled, err = serviceState(ctx, node, initSystem, service); err != nil {
+			return err
+		}
+	}
+	if _, err := Run(ctx, node.Conn, cmd); err != nil {
+		return err
+	}
+	if journaled {
+		j.Record(c)
+	}
+	return nil
+}
+
+// serviceState reports whether service runs and starts at boot on node.
+func serviceState(ctx context.Context, node Node, initSystem, service string) (active, enabled bool, err error) {
+	isActive, err := ServiceCmd(initSystem, ServiceIsActive, service)
+	if err != nil {
+		return false, false, err
+	}
+	isEnabled, err := ServiceCmd(initSystem, ServiceIsEnabled, service)
+	if err != nil {
+		return false, false, err
+	}
+	if active, err = Succeeds(ctx, node.Conn, isActive); err != nil {
+		return false, false, err
+	}
+	enabled, err = Succeeds(ctx, node.Conn, isEnabled)
+	return active, enabled, err
+}
+
+// Revert undoes c, a change recorded on node, and records the reverse change
+// in the Journal of ctx, if any. A file is only put back while it still has
+// the content the change wrote, so that later edits are not lost; a service
+// is returned to whether it was running and enabled. Restarts cannot be
+// undone and return ErrNotRevertible.
+func Revert(ctx context.Context, node Node, c Change) error {
+	var (
+		reverse Change
+		err     error
+	)
+	switch c.Kind {
+	case ChangeFile:
+		reverse, err = revertFile(ctx, node, c)
+	case ChangePackage:
+		reverse, err = revertPackages(ctx, node, c)
+	case ChangeService:
+		reverse, err = revertService(ctx, node, c)
+	default:
+		err = errs.Wrap(errs.Config, fmt.Errorf("%w: unknown kind %q", ErrNotRevertible, c.Kind))
+	}
+	if err != nil {
+		return err
+	}
+	if j, ok := JournalFrom(ctx); ok {
+		reverse.Host, reverse.Reverts = node.Name(), c.ID
+		j.Record(reverse)
+	}
+	return nil
+}
+
+func revertFile(ctx context.Context, node Node, c Change) (Change, error) {
+	current, err := Run(ctx, node.Conn, fmt.Sprintf("test ! -f %[1]s || sha256sum %[1]s", shellquote.Quote(c.Path)))
+	if err != nil {
+		return Change{}, err
+	}
+	sum := ""
+	if fields := strings.Fields(current); len(fields) > 0 {
+		sum = fields[0]
+	}
+	if sum != c.Sum {
+		return Change{}, errs.Wrap(errs.Preflight, fmt.Errorf("%s has changed since it was written, not reverting", c.Path))
+	}
+	if c.PriorSum != "" && c.Backup == "" {
+		return Change{}, fmt.Errorf("%w: no backup of the prior content of %s", ErrNotRevertible, c.Path)
+	}
+	if c.PriorSum != "" {
+		if ok, err := Succeeds(ctx, node.Conn, "test -f "+shellquote.Quote(c.Backup)); err != nil {
+			return Change{}, err
+		} else if !ok {
+			return Change{}, errs.Wrap(errs.Preflight, fmt.Errorf("backup %s of %s is gone", c.Backup, c.Path))
+		}
+	}
+	reverse := Change{Kind: ChangeFile, Path: c.Path, Sum: c.PriorSum, PriorSum: sum}
+	if j, ok := JournalFrom(ctx); ok && sum != "" {
+		if reverse.Backup, err = j.backup(ctx, node, c.Path, sum); err != nil {
+			return Change{}, err
+		}
+	}
+	if c.PriorSum == "" {
+		_, err = Run(ctx, node.Conn, "rm -f "+shellquote.Quote(c.Path))
+	} else {
+		_, err = Run(ctx, node.Conn, fmt.Sprintf("cp -p %s %s", shellquote.Quote(c.Backup), shellquote.Quote(c.Path)))
+	}
+	return reverse, err
+}
+
+func revertPackages(ctx context.Context, node Node, c Change) (Change, error) {
+	quoted := make([]string, 0, len(c.Packages))
+	for _, p := range c.Packages {
+		quoted = append(quoted, shellquote.Quote(p))
+	}
+	reverse := Change{Kind: ChangePackage, PackageManager: c.PackageManager, Packages: c.Packages}
+	var (
+		cmd string
+		err error
+	)
+	if c.Action == PackageRemove {
+		reverse.Action = PackageInstall
+		cmd, err = InstallCmd(c.PackageManager, quoted...)
+	} else {
+		reverse.Action = PackageRemove
+		cmd, err = RemoveCmd(c.PackageManager, quoted...)
+	}
+	if err != nil {
+		return Change{}, err
+	}
+	_, err = Run(ctx, node.Conn, cmd)
+	return reverse, err
+}
+
+func revertService(ctx context.Context, node Node, c Change) (Change, error) {
+	if c.Action == ServiceRestart {
+		return Change{}, fmt.Errorf("%w: %s of %s", ErrNotRevertible, c.Action, c.Service)
+	}
+	reverse := Change{Kind: ChangeService, InitSystem: c.InitSystem, Service: c.Service}
+	var err error
+	if reverse.PriorActive, reverse.PriorEnabled, err = serviceState(ctx, node, c.InitSystem, c.Service); err != nil {
+		return Change{}, err
+	}
+	// Enabling and disabling also start and stop the service.
+	actions := []string{ServiceDisable}
+	switch {
+	case c.PriorEnabled && c.PriorActive:
+		actions = []string{ServiceEnable}
+	case c.PriorEnabled:
+		actions = []string{ServiceEnable, ServiceStop}
+	case c.PriorActive:
+		actions = []string{ServiceDisable, ServiceStart}
+	}
+	reverse.Action = actions[0]
+	for _, a := range actions {
+		cmd, err := ServiceCmd(c.InitSystem, a, c.Service)
+		if err != nil {
+			return Change{}, err
+		}
+		if _, err := Run(ctx, node.Conn, cmd); err != nil {
+			return Change{}, err
+		}
+	}
+	return reverse, nil
+}
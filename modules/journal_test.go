@@ -0,0 +1,125 @@
+package modules_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mensylisir/xmcores/connector"
+	"github.com/mensylisir/xmcores/connector/connectortest"
+	"github.com/mensylisir/xmcores/errs"
+	"github.com/mensylisir/xmcores/modules"
+)
+
+func journaledNode(fake *connectortest.Fake) modules.Node {
+	host := connector.NewHost()
+	host.SetName("node1")
+	return modules.Node{Host: host, Conn: fake}
+}
+
+func sha(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestJournalFiles(t *testing.T) {
+	j := modules.NewJournal("ab12cd34", modules.JournalConfig{})
+	ctx := modules.WithJournal(context.Background(), j)
+	fake := connectortest.NewFake().
+		On(`sha256sum /etc/chrony\.conf`, connectortest.Result{Stdout: sha("server old\n") + "  /etc/chrony.conf\n"}).
+		On(`sha256sum /etc/same\.conf`, connectortest.Result{Stdout: sha("same\n") + "  /etc/same.conf\n"})
+	node := journaledNode(fake)
+
+	_, err := modules.WriteFileWith(ctx, node, []byte("server new\n"), "/etc/chrony.conf", 0644, modules.WriteOptions{Atomic: true})
+	require.NoError(t, err)
+	_, err = modules.WriteFileWith(ctx, node, []byte("created\n"), "/etc/new.conf", 0644, modules.WriteOptions{})
+	require.NoError(t, err)
+	_, err = modules.WriteFileWith(ctx, node, []byte("same\n"), "/etc/same.conf", 0644, modules.WriteOptions{})
+	require.NoError(t, err)
+
+	assert.True(t, fake.Ran(`install -d -m 0700 /var/lib/xm/backups && cp -p /etc/chrony\.conf /var/lib/xm/backups/`+sha("server old\n")))
+	changes := j.Changes()
+	require.Len(t, changes, 2, "unchanged files are not journaled")
+	assert.Equal(t, modules.Change{
+		ID: "ab12cd34.1", Run: "ab12cd34", Host: "node1", Time: changes[0].Time, Kind: modules.ChangeFile,
+		Path: "/etc/chrony.conf", Sum: sha("server new\n"), PriorSum: sha("server old\n"), Backup: "/var/lib/xm/backups/" + sha("server old\n"),
+	}, changes[0])
+	assert.Equal(t, "replaced /etc/chrony.conf", changes[0].Describe())
+	assert.Equal(t, "created /etc/new.conf", changes[1].Describe())
+	assert.Empty(t, changes[1].Backup)
+}
+
+func TestJournalPackagesAndServices(t *testing.T) {
+	j := modules.NewJournal("ab12cd34", modules.JournalConfig{})
+	ctx := modules.WithJournal(context.Background(), j)
+	fake := connectortest.NewFake().
+		On(`rpm -q nfs-utils`, connectortest.Result{ExitCode: 1}).
+		On(`systemctl is-active --quiet chronyd`, connectortest.Result{ExitCode: 3}).
+		On(`systemctl is-enabled --quiet chronyd`, connectortest.Result{ExitCode: 1})
+	node := journaledNode(fake)
+
+	require.NoError(t, modules.InstallPackages(ctx, node, "dnf", "nfs-utils", "rpcbind"))
+	assert.True(t, fake.Ran(`dnf install -y nfs-utils rpcbind`))
+	require.NoError(t, modules.Service(ctx, node, "systemd", modules.ServiceEnable, "chronyd"))
+	assert.True(t, fake.Ran(`systemctl enable --now chronyd`))
+
+	changes := j.Changes()
+	require.Len(t, changes, 2)
+	assert.Equal(t, []string{"nfs-utils"}, changes[0].Packages, "packages installed before are left out")
+	assert.Equal(t, "installed nfs-utils with dnf", changes[0].Describe())
+	assert.Equal(t, "enable chronyd (was stopped, disabled)", changes[1].Describe())
+
+	fake = connectortest.NewFake()
+	require.NoError(t, modules.InstallPackages(context.Background(), journaledNode(fake), "apt", "nfs-common"))
+	assert.False(t, fake.Ran(`dpkg -s`), "nothing is queried without a journal")
+}
+
+func TestRevert(t *testing.T) {
+	written := modules.Change{ID: "ab12cd34.1", Host: "node1", Kind: modules.ChangeFile, Path: "/etc/chrony.conf",
+		Sum: sha("server new\n"), PriorSum: sha("server old\n"), Backup: "/var/lib/xm/backups/" + sha("server old\n")}
+
+	j := modules.NewJournal("ff00ee11", modules.JournalConfig{})
+	ctx := modules.WithJournal(context.Background(), j)
+	fake := connectortest.NewFake().
+		On(`sha256sum /etc/chrony\.conf`, connectortest.Result{Stdout: sha("edited\n") + "  /etc/chrony.conf\n"})
+	err := modules.Revert(ctx, journaledNode(fake), written)
+	assert.Equal(t, errs.Preflight, errs.KindOf(err))
+	assert.ErrorContains(t, err, "has changed since it was written")
+	assert.False(t, fake.Ran(`cp -p /var/lib/xm/backups`))
+
+	fake = connectortest.NewFake().
+		On(`sha256sum /etc/chrony\.conf`, connectortest.Result{Stdout: sha("server new\n") + "  /etc/chrony.conf\n"})
+	require.NoError(t, modules.Revert(ctx, journaledNode(fake), written))
+	assert.True(t, fake.Ran(`cp -p /var/lib/xm/backups/`+sha("server old\n")+` /etc/chrony\.conf`))
+	changes := j.Changes()
+	require.Len(t, changes, 1)
+	assert.Equal(t, "ab12cd34.1", changes[0].Reverts)
+	assert.Equal(t, sha("server old\n"), changes[0].Sum)
+	assert.Equal(t, "/var/lib/xm/backups/"+sha("server new\n"), changes[0].Backup, "the revert can be reverted in turn")
+	assert.Equal(t, map[string]string{"ab12cd34.1": "ff00ee11.1"}, modules.Reverted(changes))
+
+	created := modules.Change{ID: "ab12cd34.2", Kind: modules.ChangeFile, Path: "/etc/new.conf", Sum: sha("created\n")}
+	fake = connectortest.NewFake().
+		On(`sha256sum /etc/new\.conf`, connectortest.Result{Stdout: sha("created\n") + "  /etc/new.conf\n"})
+	require.NoError(t, modules.Revert(context.Background(), journaledNode(fake), created))
+	assert.True(t, fake.Ran(`rm -f /etc/new\.conf`))
+
+	fake = connectortest.NewFake()
+	require.NoError(t, modules.Revert(context.Background(), journaledNode(fake),
+		modules.Change{Kind: modules.ChangePackage, Action: modules.PackageInstall, PackageManager: "apt", Packages: []string{"nfs-common"}}))
+	assert.True(t, fake.Ran(`apt-get remove -y nfs-common`))
+
+	fake = connectortest.NewFake()
+	require.NoError(t, modules.Revert(context.Background(), journaledNode(fake),
+		modules.Change{Kind: modules.ChangeService, Action: modules.ServiceEnable, InitSystem: "systemd", Service: "chronyd", PriorEnabled: true}))
+	assert.True(t, fake.Ran(`systemctl enable --now chronyd`))
+	assert.True(t, fake.Ran(`systemctl stop chronyd`), "an enabled but stopped service is stopped again")
+
+	err = modules.Revert(context.Background(), journaledNode(fake),
+		modules.Change{Kind: modules.ChangeService, Action: modules.ServiceRestart, InitSystem: "systemd", Service: "containerd"})
+	assert.ErrorIs(t, err, modules.ErrNotRevertible)
+}
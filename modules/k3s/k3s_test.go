@@ -0,0 +1,94 @@
+package k3s
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+
+	"github.com/mensylisir/xmcores/common"
+	"github.com/mensylisir/xmcores/connector"
+	"github.com/mensylisir/xmcores/connector/connectortest"
+	"github.com/mensylisir/xmcores/modules"
+)
+
+func node(fakes *connectortest.Connector, name, address string, roles ...string) modules.Node {
+	fake := fakes.Host(name).
+		On(`cat /etc/os-release`, connectortest.Result{Stdout: "ID=alpine\nVERSION_ID=3.20.1\n"}).
+		On(`cat /var/lib/rancher/k3s/server/token`, connectortest.Result{Stdout: "K10abc::server:secret\n"})
+	h := connector.NewHost()
+	h.SetName(name)
+	h.SetInternalAddress(address)
+	h.SetRoles(roles)
+	return modules.Node{Host: h, Conn: fake}
+}
+
+func TestConfigValidate(t *testing.T) {
+	cfg := Config{}
+	cfg.SetDefaults("v1.30.2")
+	assert.Equal(t, "v1.30.2+k3s1", cfg.Version)
+	assert.Equal(t, DatastoreEtcd, cfg.Datastore)
+	require.NoError(t, cfg.Validate(3))
+
+	cfg.Datastore = DatastoreSQLite
+	assert.EqualError(t, cfg.Validate(3), "the sqlite datastore supports a single server, not 3")
+	cfg.Datastore = DatastoreExternal
+	assert.EqualError(t, cfg.Validate(1), "datastoreEndpoint must be set with the external datastore")
+	cfg.DatastoreEndpoint = "postgres://k3s:pw@db:5432/k3s"
+	require.NoError(t, cfg.Validate(2))
+	cfg.Agent = map[string]interface{}{"token": "x"}
+	assert.EqualError(t, cfg.Validate(2), "agent must not set token, which is managed by xm")
+}
+
+func TestInstall(t *testing.T) {
+	fakes := connectortest.NewConnector()
+	servers := []modules.Node{
+		node(fakes, "master1", "10.0.0.1", common.RoleControlPlane),
+		node(fakes, "master2", "10.0.0.2", common.RoleControlPlane),
+	}
+	agents := []modules.Node{node(fakes, "worker1", "10.0.0.3", common.RoleWorker)}
+	cfg := Config{Server: map[string]interface{}{"disable": []string{"traefik"}}}
+	cfg.SetDefaults("v1.30.2")
+
+	require.NoError(t, Install(context.Background(), servers, agents, cfg, "api.lab", Params{}))
+
+	config := func(name string) map[string]interface{} {
+		data, ok := fakes.Host(name).ReadFile(ConfigPath)
+		require.True(t, ok, name)
+		out := map[string]interface{}{}
+		require.NoError(t, yaml.Unmarshal(data, &out))
+		return out
+	}
+	first := config("master1")
+	assert.Equal(t, true, first["cluster-init"])
+	assert.Nil(t, first["token"], "the first server generates the token")
+	assert.Equal(t, []interface{}{"api.lab"}, first["tls-san"])
+	assert.Equal(t, []interface{}{"traefik"}, first["disable"])
+
+	second := config("master2")
+	assert.Equal(t, "https://api.lab:6443", second["server"])
+	assert.Equal(t, "K10abc::server:secret", second["token"])
+	assert.Nil(t, second["cluster-init"])
+
+	agent := config("worker1")
+	assert.Equal(t, "https://api.lab:6443", agent["server"])
+	assert.Equal(t, "10.0.0.3", agent["node-ip"])
+	assert.Nil(t, agent["disable"], "server settings stay on the servers")
+
+	assert.True(t, fakes.Host("master1").Ran(`INSTALL_K3S_VERSION=v1\.30\.2\+k3s1 INSTALL_K3S_EXEC=server`))
+	assert.True(t, fakes.Host("worker1").Ran(`INSTALL_K3S_EXEC=agent`))
+	assert.True(t, fakes.Host("worker1").Ran(`rc-service k3s-agent status`), "the service is checked with the node's init system")
+	assert.False(t, fakes.Host("worker1").Ran(`K10abc`), "the token stays out of the command lines")
+}
+
+func TestNodeConfigExternalDatastore(t *testing.T) {
+	fakes := connectortest.NewConnector()
+	cfg := Config{Datastore: DatastoreExternal, DatastoreEndpoint: "mysql://k3s:pw@tcp(db:3306)/k3s"}
+	out := NodeConfig(cfg, Params{URL: "https://10.0.0.1:6443", Token: "t"}, node(fakes, "master2", "10.0.0.2"), false)
+	assert.Equal(t, "mysql://k3s:pw@tcp(db:3306)/k3s", out["datastore-endpoint"])
+	assert.NotContains(t, out, "server", "servers share the datastore rather than join each other")
+	assert.Equal(t, "https://10.0.0.1:6443", URL("", "10.0.0.1"))
+	assert.Equal(t, "https://api.lab:8443", URL("api.lab:8443", "10.0.0.1"))
+}
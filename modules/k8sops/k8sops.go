@@ -0,0 +1,221 @@
+// Package k8sops cordons, drains and uncordons nodes through the Kubernetes
+// API. Pods are removed with the Eviction API so PodDisruptionBudgets are
+// honoured, the same way kubectl drain does it.
+package k8sops
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/mensylisir/xmcores/logger"
+	"github.com/mensylisir/xmcores/wait"
+)
+
+const moduleName = "K8sOps"
+
+const (
+	DefaultDrainTimeout  = 5 * time.Minute
+	DefaultEvictInterval = 5 * time.Second
+
+	mirrorPodAnnotation = "kubernetes.io/config.mirror"
+)
+
+// ErrDrainTimeout is returned (wrapped) when pods are still on the node when
+// the drain timeout expires, usually because a PodDisruptionBudget blocks them.
+var ErrDrainTimeout = errors.New("drain timed out")
+
+// DrainOptions control which pods may be removed and how long to wait.
+type DrainOptions struct {
+	// Timeout bounds the whole drain, including waiting for PDBs to allow evictions.
+	Timeout time.Duration
+	// EvictInterval is the delay between eviction attempts blocked by a PDB.
+	EvictInterval time.Duration
+	// GracePeriod overrides the termination grace period of evicted pods when positive.
+	GracePeriod time.Duration
+	// IgnoreDaemonSets leaves DaemonSet pods in place instead of failing.
+	IgnoreDaemonSets bool
+	// DeleteEmptyDirData allows evicting pods whose emptyDir data is lost.
+	DeleteEmptyDirData bool
+	// Force allows evicting pods that are not managed by a controller.
+	Force bool
+}
+
+func (o *DrainOptions) setDefaults() {
+	if o.Timeout == 0 {
+		o.Timeout = DefaultDrainTimeout
+	}
+	if o.EvictInterval == 0 {
+		o.EvictInterval = DefaultEvictInterval
+	}
+}
+
+// Cordon marks node unschedulable.
+func Cordon(ctx context.Context, client kubernetes.Interface, node string) error {
+	return setUnschedulable(ctx, client, node, true)
+}
+
+// Uncordon marks node schedulable again.
+func Uncordon(ctx context.Context, client kubernetes.Interface, node string) error {
+	return setUnschedulable(ctx, client, node, false)
+}
+
+func setUnschedulable(ctx context.Context, client kubernetes.Interface, node string, unschedulable bool) error {
+	patch := fmt.Sprintf(`{"spec":{"unschedulable":%t}}`, unschedulable)
+	if _, err := client.CoreV1().Nodes().Patch(ctx, node, types.StrategicMergePatchType, []byte(patch), metav1.PatchOptions{}); err != nil {
+		return fmt.Errorf("failed to set node %s unschedulable=%t: %w", node, unschedulable, err)
+	}
+	return nil
+}
+
+// PodsToEvict returns the pods of a node that a drain has to evict, and an
+// error listing the pods that block the drain under opts. Mirror pods, DaemonSet
+// pods (with IgnoreDaemonSets) and pods already being deleted are skipped.
+func PodsToEvict(pods []corev1.Pod, opts DrainOptions) ([]corev1.Pod, error) {
+	var (
+		evict    []corev1.Pod
+		blocking []string
+	)
+	for _, pod := range pods {
+		id := pod.Namespace + "/" + pod.Name
+		if _, ok := pod.Annotations[mirrorPodAnnotation]; ok {
+			continue
+		}
+		if pod.DeletionTimestamp != nil {
+			continue
+		}
+		finished := pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed
+		ctrl := metav1.GetControllerOf(&pod)
+		managed := ctrl != nil
+		if managed && ctrl.Kind == "DaemonSet" {
+			if !opts.IgnoreDaemonSets {
+				blocking = append(blocking, id+" (DaemonSet-managed, use IgnoreDaemonSets)")
+			}
+			continue
+		}
+		if !managed && !finished && !opts.Force {
+			blocking = append(blocking, id+" (not managed by a controller, use Force)")
+			continue
+		}
+		if !finished && !opts.DeleteEmptyDirData && hasEmptyDir(pod) {
+			blocking = append(blocking, id+" (uses emptyDir, use DeleteEmptyDirData)")
+			continue
+		}
+		evict = append(evict, pod)
+	}
+	if len(blocking) > 0 {
+		return evict, fmt.Errorf("cannot drain pods: %s", strings.Join(blocking, ", "))
+	}
+	return evict, nil
+}
+
+func hasEmptyDir(pod corev1.Pod) bool {
+	for _, v := range pod.Spec.Volumes {
+		if v.EmptyDir != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Evict requests the eviction of pod. It returns an error satisfying
+// apierrors.IsTooManyRequests when a PodDisruptionBudget forbids it right now.
+func Evict(ctx context.Context, client kubernetes.Interface, pod corev1.Pod, gracePeriod time.Duration) error {
+	ev := &policyv1.Eviction{
+		ObjectMeta: metav1.ObjectMeta{Name: pod.Name, Namespace: pod.Namespace},
+	}
+	if gracePeriod > 0 {
+		seconds := int64(gracePeriod / time.Second)
+		ev.DeleteOptions = &metav1.DeleteOptions{GracePeriodSeconds: &seconds}
+	}
+	err := client.PolicyV1().Evictions(pod.Namespace).Evict(ctx, ev)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// gone reports whether pod no longer exists. A pod with the same name but a
+// different UID is a replacement and counts as gone.
+func gone(ctx context.Context, client kubernetes.Interface, pod corev1.Pod) (bool, error) {
+	current, err := client.CoreV1().Pods(pod.Namespace).Get(ctx, pod.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return current.UID != pod.UID, nil
+}
+
+// Drain cordons node and evicts its pods, retrying evictions that a
+// PodDisruptionBudget rejects until opts.Timeout, then waits for the evicted
+// pods to terminate. The node stays cordoned afterwards.
+func Drain(ctx context.Context, client kubernetes.Interface, node string, opts DrainOptions) error {
+	opts.setDefaults()
+	ctx, cancel := context.WithTimeout(ctx, opts.Timeout)
+	defer cancel()
+
+	if err := Cordon(ctx, client, node); err != nil {
+		return err
+	}
+	list, err := client.CoreV1().Pods(metav1.NamespaceAll).List(ctx, metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("spec.nodeName", node).String(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list pods on node %s: %w", node, err)
+	}
+	pods, err := PodsToEvict(list.Items, opts)
+	if err != nil {
+		return fmt.Errorf("node %s: %w", node, err)
+	}
+	logger.Log.InfofModule(moduleName, "draining node %s: evicting %d pods", node, len(pods))
+
+	pending := pods
+	for len(pending) > 0 {
+		var blocked []corev1.Pod
+		for _, pod := range pending {
+			err := Evict(ctx, client, pod, opts.GracePeriod)
+			switch {
+			case err == nil:
+			case apierrors.IsTooManyRequests(err):
+				blocked = append(blocked, pod)
+			case ctx.Err() != nil:
+				return fmt.Errorf("node %s: %w evicting pod %s/%s", node, ErrDrainTimeout, pod.Namespace, pod.Name)
+			default:
+				return fmt.Errorf("failed to evict pod %s/%s: %w", pod.Namespace, pod.Name, err)
+			}
+		}
+		if len(blocked) == 0 {
+			break
+		}
+		logger.Log.DebugfModule(moduleName, "node %s: %d evictions blocked by disruption budgets, retrying in %s", node, len(blocked), opts.EvictInterval)
+		if err := wait.Sleep(ctx, opts.EvictInterval); err != nil {
+			return fmt.Errorf("node %s: %w: %d pods blocked by disruption budgets, first %s/%s",
+				node, ErrDrainTimeout, len(blocked), blocked[0].Namespace, blocked[0].Name)
+		}
+		pending = blocked
+	}
+
+	for _, pod := range pods {
+		id := pod.Namespace + "/" + pod.Name
+		err := wait.Poll(ctx, wait.Options{Timeout: opts.Timeout, Interval: time.Second}, "pod "+id+" to terminate", func(ctx context.Context) (bool, error) {
+			return gone(ctx, client, pod)
+		})
+		if err != nil {
+			return fmt.Errorf("node %s: %w: %v", node, ErrDrainTimeout, err)
+		}
+	}
+	logger.Log.InfofModule(moduleName, "node %s drained", node)
+	return nil
+}
@@ -0,0 +1,128 @@
+package k8sops
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func pod(name string, mutate func(*corev1.Pod)) corev1.Pod {
+	yes := true
+	p := corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", UID: types.UID(name + "-uid"),
+			OwnerReferences: []metav1.OwnerReference{{Kind: "ReplicaSet", Name: "rs", Controller: &yes}}},
+		Spec:   corev1.PodSpec{NodeName: "node1"},
+		Status: corev1.PodStatus{Phase: corev1.PodRunning},
+	}
+	if mutate != nil {
+		mutate(&p)
+	}
+	return p
+}
+
+func TestPodsToEvict(t *testing.T) {
+	pods := []corev1.Pod{
+		pod("web", nil),
+		pod("mirror", func(p *corev1.Pod) { p.Annotations = map[string]string{mirrorPodAnnotation: "x"} }),
+		pod("ds", func(p *corev1.Pod) { p.OwnerReferences[0].Kind = "DaemonSet" }),
+		pod("bare", func(p *corev1.Pod) { p.OwnerReferences = nil }),
+		pod("cache", func(p *corev1.Pod) {
+			p.Spec.Volumes = []corev1.Volume{{Name: "tmp", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}}}
+		}),
+		pod("job-done", func(p *corev1.Pod) { p.OwnerReferences = nil; p.Status.Phase = corev1.PodSucceeded }),
+	}
+
+	_, err := PodsToEvict(pods, DrainOptions{})
+	require.Error(t, err)
+	assert.ErrorContains(t, err, "default/ds (DaemonSet-managed")
+	assert.ErrorContains(t, err, "default/bare (not managed")
+	assert.ErrorContains(t, err, "default/cache (uses emptyDir")
+
+	evict, err := PodsToEvict(pods, DrainOptions{IgnoreDaemonSets: true, DeleteEmptyDirData: true, Force: true})
+	require.NoError(t, err)
+	var names []string
+	for _, p := range evict {
+		names = append(names, p.Name)
+	}
+	assert.Equal(t, []string{"web", "bare", "cache", "job-done"}, names)
+}
+
+// newFake returns a clientset serving node1 with the given pods. Evictions of
+// pods listed in blocked are rejected that many times before they succeed,
+// and a successful eviction deletes the pod.
+func newFake(t *testing.T, blocked map[string]int, pods ...corev1.Pod) *fake.Clientset {
+	objects := []runtime.Object{&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}}}
+	for i := range pods {
+		objects = append(objects, &pods[i])
+	}
+	client := fake.NewClientset(objects...)
+	client.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "eviction" {
+			return false, nil, nil
+		}
+		ev := action.(k8stesting.CreateAction).GetObject().(*policyv1.Eviction)
+		if blocked[ev.Name] > 0 {
+			blocked[ev.Name]--
+			return true, nil, apierrors.NewTooManyRequests("Cannot evict pod as it would violate the pod's disruption budget.", 0)
+		}
+		err := client.Tracker().Delete(corev1.SchemeGroupVersion.WithResource("pods"), ev.Namespace, ev.Name)
+		return true, nil, err
+	})
+	return client
+}
+
+func unschedulable(t *testing.T, client *fake.Clientset) bool {
+	node, err := client.CoreV1().Nodes().Get(context.Background(), "node1", metav1.GetOptions{})
+	require.NoError(t, err)
+	return node.Spec.Unschedulable
+}
+
+func remaining(t *testing.T, client *fake.Clientset) []corev1.Pod {
+	list, err := client.CoreV1().Pods(metav1.NamespaceAll).List(context.Background(), metav1.ListOptions{})
+	require.NoError(t, err)
+	return list.Items
+}
+
+func TestDrain(t *testing.T) {
+	client := newFake(t, map[string]int{"db": 2}, pod("web", nil), pod("db", nil))
+	err := Drain(context.Background(), client, "node1", DrainOptions{EvictInterval: time.Millisecond, Timeout: 5 * time.Second, GracePeriod: 30 * time.Second})
+	require.NoError(t, err)
+	assert.True(t, unschedulable(t, client))
+	assert.Empty(t, remaining(t, client))
+
+	var evictions int
+	for _, action := range client.Actions() {
+		if action.GetSubresource() != "eviction" {
+			continue
+		}
+		evictions++
+		ev := action.(k8stesting.CreateAction).GetObject().(*policyv1.Eviction)
+		require.NotNil(t, ev.DeleteOptions)
+		assert.Equal(t, int64(30), *ev.DeleteOptions.GracePeriodSeconds)
+	}
+	assert.Equal(t, 4, evictions, "web once, db twice blocked and once admitted")
+
+	require.NoError(t, Uncordon(context.Background(), client, "node1"))
+	assert.False(t, unschedulable(t, client))
+}
+
+func TestDrainBlockedByBudget(t *testing.T) {
+	client := newFake(t, map[string]int{"db": 1 << 20}, pod("db", nil))
+	err := Drain(context.Background(), client, "node1", DrainOptions{EvictInterval: time.Millisecond, Timeout: 50 * time.Millisecond})
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, ErrDrainTimeout))
+	assert.ErrorContains(t, err, "default/db")
+	assert.Len(t, remaining(t, client), 1)
+}
@@ -0,0 +1,427 @@
+// Package kubeadm renders the kubeadm configuration files. The generated
+// documents can be extended with free-form sections that are deep-merged on
+// top, so any kubeadm or kubelet setting can be used without explicit support.
+package kubeadm
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	kubeadmAPIVersion = "kubeadm.k8s.io/v1beta3"
+	kubeletAPIVersion = "kubelet.config.k8s.io/v1beta1"
+
+	DefaultPodSubnet     = "10.233.64.0/18"
+	DefaultServiceSubnet = "10.233.0.0/18"
+	DefaultDNSDomain     = "cluster.local"
+	DefaultCRISocket     = "unix:///run/containerd/containerd.sock"
+	DefaultCgroupDriver  = "systemd"
+)
+
+// Extra holds user-supplied fragments merged into the generated documents.
+type Extra struct {
+	InitConfiguration    map[string]interface{} `yaml:"initConfiguration,omitempty" json:"initConfiguration,omitempty"`
+	ClusterConfiguration map[string]interface{} `yaml:"clusterConfiguration,omitempty" json:"clusterConfiguration,omitempty"`
+	JoinConfiguration    map[string]interface{} `yaml:"joinConfiguration,omitempty" json:"joinConfiguration,omitempty"`
+	KubeletConfiguration map[string]interface{} `yaml:"kubeletConfiguration,omitempty" json:"kubeletConfiguration,omitempty"`
+}
+
+// Validate rejects fragments that would change the document identity.
+func (e Extra) Validate() error {
+	for name, doc := range map[string]map[string]interface{}{
+		"initConfiguration":    e.InitConfiguration,
+		"clusterConfiguration": e.ClusterConfiguration,
+		"joinConfiguration":    e.JoinConfiguration,
+		"kubeletConfiguration": e.KubeletConfiguration,
+	} {
+		for _, key := range []string{"apiVersion", "kind"} {
+			if _, ok := doc[key]; ok {
+				return fmt.Errorf("kubeadmExtra.%s must not set %s", name, key)
+			}
+		}
+	}
+	return nil
+}
+
+// Volume is an extra host path mounted into a control-plane static pod.
+type Volume struct {
+	Name      string
+	HostPath  string
+	MountPath string
+	ReadOnly  bool
+}
+
+// Taint is a taint the node registers with.
+type Taint struct {
+	Key    string
+	Value  string
+	Effect string
+}
+
+// Params are the values the generated configuration is built from.
+type Params struct {
+	KubernetesVersion    string
+	ClusterName          string
+	ControlPlaneEndpoint string
+	PodSubnet            string
+	ServiceSubnet        string
+	DNSDomain            string
+	ImageRepository      string
+	CertSANs             []string
+
+	NodeName         string
+	AdvertiseAddress string
+	BindPort         int
+	CRISocket        string
+	CgroupDriver     string
+	// Taints replace kubeadm's default control-plane taint when set.
+	Taints []Taint
+	// KubeletArgs are extra kubelet flags of the node, without the leading --.
+	KubeletArgs map[string]string
+	// EtcdEndpoints are the client URLs of an etcd on dedicated hosts (see
+	// EtcdDocuments); empty for an etcd stacked on the control-plane hosts.
+	EtcdEndpoints []string
+
+	APIServerArgs    map[string]string
+	APIServerVolumes []Volume
+	// PatchesDir, if set, is the directory of the patches kubeadm applies
+	// on the node, see ExtraArgs.Patches.
+	PatchesDir string
+}
+
+func (p *Params) setDefaults() {
+	if p.PodSubnet == "" {
+		p.PodSubnet = DefaultPodSubnet
+	}
+	if p.ServiceSubnet == "" {
+		p.ServiceSubnet = DefaultServiceSubnet
+	}
+	if p.DNSDomain == "" {
+		p.DNSDomain = DefaultDNSDomain
+	}
+	if p.CRISocket == "" {
+		p.CRISocket = DefaultCRISocket
+	}
+	if p.CgroupDriver == "" {
+		p.CgroupDriver = DefaultCgroupDriver
+	}
+	if p.BindPort == 0 {
+		p.BindPort = 6443
+	}
+}
+
+// JoinParams are the values of a JoinConfiguration.
+type JoinParams struct {
+	NodeName          string
+	CRISocket         string
+	APIServerEndpoint string
+	Token             string
+	CACertHashes      []string
+	// ControlPlane makes the node join as a control-plane member.
+	ControlPlane     bool
+	AdvertiseAddress string
+	BindPort         int
+	CertificateKey   string
+	Taints           []Taint
+	KubeletArgs      map[string]string
+	// PatchesDir is as in Params, for a control-plane node.
+	PatchesDir string
+}
+
+func nodeRegistration(name, criSocket string, taints []Taint, kubeletArgs map[string]string) map[string]interface{} {
+	nr := map[string]interface{}{"criSocket": criSocket}
+	if name != "" {
+		nr["name"] = name
+	}
+	if len(kubeletArgs) > 0 {
+		args := make(map[string]interface{}, len(kubeletArgs))
+		for k, v := range kubeletArgs {
+			args[k] = v
+		}
+		nr["kubeletExtraArgs"] = args
+	}
+	if len(taints) > 0 {
+		list := make([]interface{}, 0, len(taints))
+		for _, t := range taints {
+			taint := map[string]interface{}{"key": t.Key, "effect": t.Effect}
+			if t.Value != "" {
+				taint["value"] = t.Value
+			}
+			list = append(list, taint)
+		}
+		nr["taints"] = list
+	}
+	return nr
+}
+
+// InitDocuments returns the InitConfiguration, ClusterConfiguration and
+// KubeletConfiguration for the first control-plane node, with extra merged in.
+func InitDocuments(p Params, extra Extra) ([]map[string]interface{}, error) {
+	p.setDefaults()
+	if p.KubernetesVersion == "" {
+		return nil, fmt.Errorf("kubernetes version must be set")
+	}
+
+	init := map[string]interface{}{
+		"apiVersion":       kubeadmAPIVersion,
+		"kind":             "InitConfiguration",
+		"nodeRegistration": nodeRegistration(p.NodeName, p.CRISocket, p.Taints, p.KubeletArgs),
+		"localAPIEndpoint": map[string]interface{}{
+			"advertiseAddress": p.AdvertiseAddress,
+			"bindPort":         p.BindPort,
+		},
+	}
+	if p.PatchesDir != "" {
+		init["patches"] = map[string]interface{}{"directory": p.PatchesDir}
+	}
+
+	apiServer := map[string]interface{}{}
+	if len(p.CertSANs) > 0 {
+		apiServer["certSANs"] = toInterfaces(p.CertSANs)
+	}
+	if len(p.APIServerArgs) > 0 {
+		args := make(map[string]interface{}, len(p.APIServerArgs))
+		for k, v := range p.APIServerArgs {
+			args[k] = v
+		}
+		apiServer["extraArgs"] = args
+	}
+	if len(p.APIServerVolumes) > 0 {
+		volumes := make([]interface{}, 0, len(p.APIServerVolumes))
+		for _, v := range p.APIServerVolumes {
+			volumes = append(volumes, map[string]interface{}{
+				"name":      v.Name,
+				"hostPath":  v.HostPath,
+				"mountPath": v.MountPath,
+				"readOnly":  v.ReadOnly,
+				"pathType":  "DirectoryOrCreate",
+			})
+		}
+		apiServer["extraVolumes"] = volumes
+	}
+
+	cluster := map[string]interface{}{
+		"apiVersion":        kubeadmAPIVersion,
+		"kind":              "ClusterConfiguration",
+		"kubernetesVersion": p.KubernetesVersion,
+		"networking": map[string]interface{}{
+			"podSubnet":     p.PodSubnet,
+			"serviceSubnet": p.ServiceSubnet,
+			"dnsDomain":     p.DNSDomain,
+		},
+		"apiServer": apiServer,
+	}
+	if p.ClusterName != "" {
+		cluster["clusterName"] = p.ClusterName
+	}
+	if p.ControlPlaneEndpoint != "" {
+		cluster["controlPlaneEndpoint"] = p.ControlPlaneEndpoint
+	}
+	if p.ImageRepository != "" {
+		cluster["imageRepository"] = p.ImageRepository
+	}
+	if len(p.EtcdEndpoints) > 0 {
+		cluster["etcd"] = map[string]interface{}{"external": map[string]interface{}{
+			"endpoints": toInterfaces(p.EtcdEndpoints),
+			"caFile":    EtcdCAFile,
+			"certFile":  EtcdClientCertFile,
+			"keyFile":   EtcdClientKeyFile,
+		}}
+	}
+
+	kubelet := map[string]interface{}{
+		"apiVersion":   kubeletAPIVersion,
+		"kind":         "KubeletConfiguration",
+		"cgroupDriver": p.CgroupDriver,
+	}
+
+	return []map[string]interface{}{
+		DeepMerge(init, extra.InitConfiguration),
+		DeepMerge(cluster, extra.ClusterConfiguration),
+		DeepMerge(kubelet, extra.KubeletConfiguration),
+	}, nil
+}
+
+// The etcd CA and the client certificate of the apiserver, which kubeadm
+// expects on the control-plane hosts when etcd runs on dedicated hosts.
+const (
+	EtcdCAFile         = "/etc/kubernetes/pki/etcd/ca.crt"
+	EtcdClientCertFile = "/etc/kubernetes/pki/apiserver-etcd-client.crt"
+	EtcdClientKeyFile  = "/etc/kubernetes/pki/apiserver-etcd-client.key"
+)
+
+// EtcdMember is a member of an etcd running on dedicated hosts.
+type EtcdMember struct {
+	Name    string
+	Address string
+}
+
+// EtcdDocuments returns the InitConfiguration and ClusterConfiguration with
+// which `kubeadm init phase etcd local` runs member as a static pod on a
+// dedicated etcd host, in a new cluster of members.
+func EtcdDocuments(p Params, member EtcdMember, members []EtcdMember) ([]map[string]interface{}, error) {
+	p.setDefaults()
+	if p.KubernetesVersion == "" {
+		return nil, fmt.Errorf("kubernetes version must be set")
+	}
+	if member.Name == "" || member.Address == "" {
+		return nil, fmt.Errorf("etcd member requires a name and an address")
+	}
+	initial := make([]string, 0, len(members))
+	for _, m := range members {
+		initial = append(initial, fmt.Sprintf("%s=%s", m.Name, etcdURL(m.Address, 2380)))
+	}
+	init := map[string]interface{}{
+		"apiVersion":       kubeadmAPIVersion,
+		"kind":             "InitConfiguration",
+		"nodeRegistration": map[string]interface{}{"name": member.Name, "criSocket": p.CRISocket},
+		"localAPIEndpoint": map[string]interface{}{"advertiseAddress": member.Address},
+	}
+	cluster := map[string]interface{}{
+		"apiVersion":        kubeadmAPIVersion,
+		"kind":              "ClusterConfiguration",
+		"kubernetesVersion": p.KubernetesVersion,
+		"etcd": map[string]interface{}{"local": map[string]interface{}{
+			"serverCertSANs": []interface{}{member.Address},
+			"peerCertSANs":   []interface{}{member.Address},
+			"extraArgs": map[string]interface{}{
+				"name":                        member.Name,
+				"initial-cluster":             strings.Join(initial, ","),
+				"initial-cluster-state":       "new",
+				"initial-advertise-peer-urls": etcdURL(member.Address, 2380),
+				"listen-peer-urls":            etcdURL(member.Address, 2380),
+				"advertise-client-urls":       etcdURL(member.Address, 2379),
+				"listen-client-urls":          etcdURL(member.Address, 2379),
+			},
+		}},
+	}
+	if p.ImageRepository != "" {
+		cluster["imageRepository"] = p.ImageRepository
+	}
+	return []map[string]interface{}{init, cluster}, nil
+}
+
+// EtcdEndpoint returns the client URL of the etcd member at address.
+func EtcdEndpoint(address string) string {
+	return etcdURL(address, 2379)
+}
+
+func etcdURL(address string, port int) string {
+	return "https://" + net.JoinHostPort(address, strconv.Itoa(port))
+}
+
+// JoinDocument returns the JoinConfiguration for a joining node, with extra merged in.
+func JoinDocument(p JoinParams, extra Extra) (map[string]interface{}, error) {
+	if p.APIServerEndpoint == "" || p.Token == "" {
+		return nil, fmt.Errorf("join requires an apiserver endpoint and a bootstrap token")
+	}
+	if p.CRISocket == "" {
+		p.CRISocket = DefaultCRISocket
+	}
+	discovery := map[string]interface{}{
+		"apiServerEndpoint": p.APIServerEndpoint,
+		"token":             p.Token,
+	}
+	if len(p.CACertHashes) > 0 {
+		discovery["caCertHashes"] = toInterfaces(p.CACertHashes)
+	} else {
+		discovery["unsafeSkipCAVerification"] = true
+	}
+	join := map[string]interface{}{
+		"apiVersion":       kubeadmAPIVersion,
+		"kind":             "JoinConfiguration",
+		"nodeRegistration": nodeRegistration(p.NodeName, p.CRISocket, p.Taints, p.KubeletArgs),
+		"discovery":        map[string]interface{}{"bootstrapToken": discovery},
+	}
+	if p.ControlPlane {
+		bindPort := p.BindPort
+		if bindPort == 0 {
+			bindPort = 6443
+		}
+		cp := map[string]interface{}{
+			"localAPIEndpoint": map[string]interface{}{
+				"advertiseAddress": p.AdvertiseAddress,
+				"bindPort":         bindPort,
+			},
+		}
+		if p.CertificateKey != "" {
+			cp["certificateKey"] = p.CertificateKey
+		}
+		join["controlPlane"] = cp
+		if p.PatchesDir != "" {
+			join["patches"] = map[string]interface{}{"directory": p.PatchesDir}
+		}
+	}
+	return DeepMerge(join, extra.JoinConfiguration), nil
+}
+
+// Marshal renders documents as a multi-document YAML stream.
+func Marshal(docs ...map[string]interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	for _, doc := range docs {
+		if err := enc.Encode(doc); err != nil {
+			return nil, fmt.Errorf("failed to render kubeadm configuration: %w", err)
+		}
+	}
+	if err := enc.Close(); err != nil {
+		return nil, fmt.Errorf("failed to render kubeadm configuration: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// DeepMerge returns a copy of dst with src merged in. Nested maps are merged
+// recursively; any other value in src, including lists, replaces the one in dst.
+func DeepMerge(dst, src map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(dst)+len(src))
+	for k, v := range dst {
+		out[k] = v
+	}
+	keys := make([]string, 0, len(src))
+	for k := range src {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		srcMap, srcIsMap := toMap(src[k])
+		dstMap, dstIsMap := toMap(out[k])
+		if srcIsMap && dstIsMap {
+			out[k] = DeepMerge(dstMap, srcMap)
+			continue
+		}
+		out[k] = src[k]
+	}
+	return out
+}
+
+// toMap accepts both decoded YAML maps and the maps built by this package.
+func toMap(v interface{}) (map[string]interface{}, bool) {
+	switch m := v.(type) {
+	case map[string]interface{}:
+		return m, true
+	case map[string]string:
+		out := make(map[string]interface{}, len(m))
+		for k, v := range m {
+			out[k] = v
+		}
+		return out, true
+	default:
+		return nil, false
+	}
+}
+
+func toInterfaces(s []string) []interface{} {
+	out := make([]interface{}, len(s))
+	for i, v := range s {
+		out[i] = v
+	}
+	return out
+}
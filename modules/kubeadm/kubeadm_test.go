@@ -0,0 +1,187 @@
+package kubeadm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func TestDeepMerge(t *testing.T) {
+	dst := map[string]interface{}{
+		"apiServer": map[string]interface{}{
+			"extraArgs": map[string]interface{}{"audit-log-path": "/var/log/audit.log"},
+			"certSANs":  []interface{}{"a"},
+		},
+		"kubernetesVersion": "v1.30.2",
+	}
+	src := map[string]interface{}{
+		"apiServer": map[string]interface{}{
+			"extraArgs": map[string]interface{}{"max-requests-inflight": "800"},
+			"certSANs":  []interface{}{"b", "c"},
+		},
+		"controllerManager": map[string]interface{}{"extraArgs": map[string]interface{}{"node-cidr-mask-size": "25"}},
+	}
+	out := DeepMerge(dst, src)
+	assert.Equal(t, map[string]interface{}{
+		"apiServer": map[string]interface{}{
+			"extraArgs": map[string]interface{}{"audit-log-path": "/var/log/audit.log", "max-requests-inflight": "800"},
+			"certSANs":  []interface{}{"b", "c"},
+		},
+		"controllerManager": map[string]interface{}{"extraArgs": map[string]interface{}{"node-cidr-mask-size": "25"}},
+		"kubernetesVersion": "v1.30.2",
+	}, out)
+	// dst is left untouched.
+	assert.NotContains(t, dst, "controllerManager")
+}
+
+func TestInitDocuments(t *testing.T) {
+	var extra Extra
+	require.NoError(t, yaml.Unmarshal([]byte(`
+clusterConfiguration:
+  apiServer:
+    extraArgs:
+      max-requests-inflight: "800"
+  networking:
+    podSubnet: 10.244.0.0/16
+kubeletConfiguration:
+  maxPods: 200
+initConfiguration:
+  skipPhases: [addon/kube-proxy]
+`), &extra))
+
+	docs, err := InitDocuments(Params{
+		KubernetesVersion: "v1.30.2",
+		NodeName:          "master1",
+		AdvertiseAddress:  "10.0.0.10",
+		APIServerArgs:     map[string]string{"audit-log-path": "/var/log/audit.log"},
+		APIServerVolumes:  []Volume{{Name: "audit-log", HostPath: "/var/log/kubernetes/audit", MountPath: "/var/log/kubernetes/audit"}},
+	}, extra)
+	require.NoError(t, err)
+	require.Len(t, docs, 3)
+
+	init, cluster, kubelet := docs[0], docs[1], docs[2]
+	assert.Equal(t, "InitConfiguration", init["kind"])
+	assert.Equal(t, []interface{}{"addon/kube-proxy"}, init["skipPhases"])
+	assert.Equal(t, "master1", init["nodeRegistration"].(map[string]interface{})["name"])
+
+	assert.Equal(t, map[string]interface{}{
+		"audit-log-path":        "/var/log/audit.log",
+		"max-requests-inflight": "800",
+	}, cluster["apiServer"].(map[string]interface{})["extraArgs"])
+	networking := cluster["networking"].(map[string]interface{})
+	assert.Equal(t, "10.244.0.0/16", networking["podSubnet"])
+	assert.Equal(t, DefaultServiceSubnet, networking["serviceSubnet"])
+
+	assert.Equal(t, 200, kubelet["maxPods"])
+	assert.Equal(t, DefaultCgroupDriver, kubelet["cgroupDriver"])
+
+	out, err := Marshal(docs...)
+	require.NoError(t, err)
+	assert.Contains(t, string(out), "---\n")
+	assert.Contains(t, string(out), "kind: ClusterConfiguration")
+
+	_, err = InitDocuments(Params{}, Extra{})
+	assert.Error(t, err)
+}
+
+func TestEtcdDocuments(t *testing.T) {
+	members := []EtcdMember{{Name: "etcd1", Address: "10.0.1.1"}, {Name: "etcd2", Address: "10.0.1.2"}, {Name: "etcd3", Address: "10.0.1.3"}}
+	docs, err := EtcdDocuments(Params{KubernetesVersion: "v1.30.2"}, members[1], members)
+	require.NoError(t, err)
+	require.Len(t, docs, 2)
+	assert.Equal(t, "10.0.1.2", docs[0]["localAPIEndpoint"].(map[string]interface{})["advertiseAddress"])
+	local := docs[1]["etcd"].(map[string]interface{})["local"].(map[string]interface{})
+	assert.Equal(t, []interface{}{"10.0.1.2"}, local["serverCertSANs"])
+	args := local["extraArgs"].(map[string]interface{})
+	assert.Equal(t, "etcd1=https://10.0.1.1:2380,etcd2=https://10.0.1.2:2380,etcd3=https://10.0.1.3:2380", args["initial-cluster"])
+	assert.Equal(t, "https://10.0.1.2:2379", args["advertise-client-urls"])
+
+	init, err := InitDocuments(Params{KubernetesVersion: "v1.30.2", EtcdEndpoints: []string{EtcdEndpoint("10.0.1.1")}}, Extra{})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"external": map[string]interface{}{
+		"endpoints": []interface{}{"https://10.0.1.1:2379"},
+		"caFile":    EtcdCAFile,
+		"certFile":  EtcdClientCertFile,
+		"keyFile":   EtcdClientKeyFile,
+	}}, init[1]["etcd"])
+
+	_, err = EtcdDocuments(Params{KubernetesVersion: "v1.30.2"}, EtcdMember{Name: "etcd1"}, members)
+	assert.Error(t, err)
+}
+
+func TestJoinDocument(t *testing.T) {
+	doc, err := JoinDocument(JoinParams{
+		NodeName:          "master2",
+		APIServerEndpoint: "lb.example.com:6443",
+		Token:             "abcdef.0123456789abcdef",
+		CACertHashes:      []string{"sha256:1234"},
+		ControlPlane:      true,
+		AdvertiseAddress:  "10.0.0.11",
+		CertificateKey:    "key",
+	}, Extra{JoinConfiguration: map[string]interface{}{
+		"nodeRegistration": map[string]interface{}{"taints": []interface{}{}},
+	}})
+	require.NoError(t, err)
+	nr := doc["nodeRegistration"].(map[string]interface{})
+	assert.Equal(t, "master2", nr["name"])
+	assert.Equal(t, []interface{}{}, nr["taints"])
+	assert.Equal(t, DefaultCRISocket, nr["criSocket"])
+	cp := doc["controlPlane"].(map[string]interface{})
+	assert.Equal(t, "key", cp["certificateKey"])
+
+	doc, err = JoinDocument(JoinParams{
+		APIServerEndpoint: "lb.example.com:6443",
+		Token:             "abcdef.0123456789abcdef",
+		Taints:            []Taint{{Key: "dedicated", Value: "gpu", Effect: "NoSchedule"}, {Key: "spot", Effect: "PreferNoSchedule"}},
+	}, Extra{})
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"key": "dedicated", "value": "gpu", "effect": "NoSchedule"},
+		map[string]interface{}{"key": "spot", "effect": "PreferNoSchedule"},
+	}, doc["nodeRegistration"].(map[string]interface{})["taints"])
+
+	_, err = JoinDocument(JoinParams{Token: "x"}, Extra{})
+	assert.Error(t, err)
+}
+
+func TestExtraValidate(t *testing.T) {
+	assert.NoError(t, Extra{ClusterConfiguration: map[string]interface{}{"apiServer": nil}}.Validate())
+	assert.Error(t, Extra{KubeletConfiguration: map[string]interface{}{"kind": "Other"}}.Validate())
+}
+
+func TestExtraArgs(t *testing.T) {
+	global := ExtraArgs{Kubelet: map[string]string{"max-pods": "110"}, APIServer: map[string]string{"v": "2", "audit-log-maxage": "7"}}
+	merged := global.Merge(ExtraArgs{APIServer: map[string]string{"v": "4"}, Scheduler: map[string]string{"bind-address": "0.0.0.0"}})
+	assert.Equal(t, ExtraArgs{
+		Kubelet:   map[string]string{"max-pods": "110"},
+		APIServer: map[string]string{"v": "4", "audit-log-maxage": "7"},
+		Scheduler: map[string]string{"bind-address": "0.0.0.0"},
+	}, merged)
+	assert.Equal(t, map[string]string{"v": "2", "audit-log-maxage": "7"}, global.APIServer, "merging copies")
+	assert.True(t, merged.ControlPlane())
+	assert.False(t, ExtraArgs{Kubelet: global.Kubelet}.ControlPlane())
+
+	patches, err := merged.Patches()
+	require.NoError(t, err)
+	require.Len(t, patches, 2)
+	var ops []map[string]string
+	require.NoError(t, yaml.Unmarshal(patches["kube-apiserver+json.yaml"], &ops))
+	assert.Equal(t, []map[string]string{
+		{"op": "add", "path": "/spec/containers/0/command/-", "value": "--audit-log-maxage=7"},
+		{"op": "add", "path": "/spec/containers/0/command/-", "value": "--v=4"},
+	}, ops)
+	assert.Contains(t, PatchFiles(), "kube-scheduler+json.yaml")
+
+	assert.NoError(t, merged.Validate())
+	assert.ErrorContains(t, ExtraArgs{ControllerManager: map[string]string{"--v": "2"}}.Validate(), "controllerManagerExtraArgs: invalid flag name \"--v\"")
+	assert.ErrorContains(t, ExtraArgs{Kubelet: map[string]string{"a=b": ""}}.Validate(), "kubeletExtraArgs")
+
+	docs, err := InitDocuments(Params{KubernetesVersion: "v1.30.2", PatchesDir: PatchesDir}, Extra{})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"directory": PatchesDir}, docs[0]["patches"])
+	doc, err := JoinDocument(JoinParams{APIServerEndpoint: "lb:6443", Token: "t", ControlPlane: true, PatchesDir: PatchesDir}, Extra{})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"directory": PatchesDir}, doc["patches"])
+}
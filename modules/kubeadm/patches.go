@@ -0,0 +1,129 @@
+package kubeadm
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// PatchesDir is where the patches of a node are written; kubeadm applies
+// them to the static pod manifests it generates on the node.
+const PatchesDir = "/etc/kubernetes/patches"
+
+// ExtraArgs are extra flags, without the leading --, of the kubelet and the
+// control-plane components.
+type ExtraArgs struct {
+	Kubelet           map[string]string `yaml:"kubeletExtraArgs,omitempty" json:"kubeletExtraArgs,omitempty"`
+	APIServer         map[string]string `yaml:"apiServerExtraArgs,omitempty" json:"apiServerExtraArgs,omitempty"`
+	ControllerManager map[string]string `yaml:"controllerManagerExtraArgs,omitempty" json:"controllerManagerExtraArgs,omitempty"`
+	Scheduler         map[string]string `yaml:"schedulerExtraArgs,omitempty" json:"schedulerExtraArgs,omitempty"`
+}
+
+// component is a flag set of ExtraArgs with the kubeadm patch target of
+// its static pod, if any.
+type component struct {
+	field, target string
+	args          map[string]string
+}
+
+// components returns the control-plane flag sets of a.
+func (a ExtraArgs) components() []component {
+	return []component{
+		{"apiServerExtraArgs", "kube-apiserver", a.APIServer},
+		{"controllerManagerExtraArgs", "kube-controller-manager", a.ControllerManager},
+		{"schedulerExtraArgs", "kube-scheduler", a.Scheduler},
+	}
+}
+
+// Validate rejects flag names kubeadm could not render.
+func (a ExtraArgs) Validate() error {
+	for _, f := range append(a.components(), component{"kubeletExtraArgs", "", a.Kubelet}) {
+		for _, name := range sortedKeys(f.args) {
+			if name == "" || strings.HasPrefix(name, "-") || strings.ContainsAny(name, "= \t\n") {
+				return fmt.Errorf("%s: invalid flag name %q, use the name without the leading --", f.field, name)
+			}
+		}
+	}
+	return nil
+}
+
+// Merge returns a with the flags of o added, o winning for the flags both
+// set.
+func (a ExtraArgs) Merge(o ExtraArgs) ExtraArgs {
+	return ExtraArgs{
+		Kubelet:           mergeArgs(a.Kubelet, o.Kubelet),
+		APIServer:         mergeArgs(a.APIServer, o.APIServer),
+		ControllerManager: mergeArgs(a.ControllerManager, o.ControllerManager),
+		Scheduler:         mergeArgs(a.Scheduler, o.Scheduler),
+	}
+}
+
+// ControlPlane reports whether a sets flags of a control-plane component.
+func (a ExtraArgs) ControlPlane() bool {
+	return len(a.APIServer)+len(a.ControllerManager)+len(a.Scheduler) > 0
+}
+
+// Patches returns the kubeadm patches, by file name in PatchesDir, adding
+// the control-plane flags of a to the commands of the static pods. The flags
+// are appended, so they take precedence over those kubeadm generates.
+func (a ExtraArgs) Patches() (map[string][]byte, error) {
+	patches := map[string][]byte{}
+	for _, c := range a.components() {
+		if len(c.args) == 0 {
+			continue
+		}
+		ops := make([]interface{}, 0, len(c.args))
+		for _, name := range sortedKeys(c.args) {
+			ops = append(ops, map[string]interface{}{
+				"op":    "add",
+				"path":  "/spec/containers/0/command/-",
+				"value": fmt.Sprintf("--%s=%s", name, c.args[name]),
+			})
+		}
+		data, err := yaml.Marshal(ops)
+		if err != nil {
+			return nil, fmt.Errorf("failed to render the %s patch: %w", c.target, err)
+		}
+		patches[patchFile(c.target)] = data
+	}
+	return patches, nil
+}
+
+// PatchFiles returns the names of all the files Patches can return, so that
+// stale patches are removed without touching those of the user.
+func PatchFiles() []string {
+	var names []string
+	for _, c := range (ExtraArgs{}).components() {
+		names = append(names, patchFile(c.target))
+	}
+	return names
+}
+
+func patchFile(target string) string {
+	return target + "+json.yaml"
+}
+
+func mergeArgs(dst, src map[string]string) map[string]string {
+	if len(dst)+len(src) == 0 {
+		return nil
+	}
+	out := make(map[string]string, len(dst)+len(src))
+	for k, v := range dst {
+		out[k] = v
+	}
+	for k, v := range src {
+		out[k] = v
+	}
+	return out
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
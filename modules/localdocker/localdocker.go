@@ -0,0 +1,221 @@
+// Package localdocker provisions cluster nodes as privileged containers on
+// the local Docker daemon, the way kind does, so pipelines can be exercised
+// end to end without virtual machines. Nodes are reached through
+// `docker exec` (see connector.NewDockerConnection) instead of SSH.
+package localdocker
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/mensylisir/xmcores/connector"
+	"github.com/mensylisir/xmcores/logger"
+	"github.com/mensylisir/xmcores/modules"
+	"github.com/mensylisir/xmcores/wait"
+)
+
+const moduleName = "LocalDocker"
+
+const (
+	// DefaultImageRepository publishes node images with systemd, containerd,
+	// kubeadm and kubelet preinstalled, tagged by Kubernetes version.
+	DefaultImageRepository = "docker.io/kindest/node"
+	DefaultNetwork         = "xmcores"
+	DefaultSubnet          = "172.30.0.0/16"
+
+	// ClusterLabel marks the containers and networks created for a cluster.
+	ClusterLabel = "io.xmcores.cluster"
+
+	bootTimeout = 2 * time.Minute
+)
+
+// sudoShim lets the sudo-wrapped commands of the modules run in node images
+// that ship without sudo; the containers already run as root.
+const sudoShim = `#!/bin/sh
+while [ "${1#-}" != "$1" ]; do shift; done
+exec "$@"
+`
+
+// Config selects the node image and the Docker network the nodes attach to.
+type Config struct {
+	// Image defaults to DefaultImageRepository tagged with the Kubernetes version.
+	Image   string `yaml:"image,omitempty" json:"image,omitempty"`
+	Network string `yaml:"network,omitempty" json:"network,omitempty"`
+	// Subnet of the network; host addresses are assigned to the containers
+	// and must lie inside it.
+	Subnet string `yaml:"subnet,omitempty" json:"subnet,omitempty"`
+	// Docker is the docker CLI, connector.DefaultDockerBinary when empty.
+	Docker string `yaml:"docker,omitempty" json:"docker,omitempty"`
+}
+
+// SetDefaults fills unset fields. The image needs the Kubernetes version and
+// is resolved by Image.
+func (c *Config) SetDefaults() {
+	if c.Network == "" {
+		c.Network = DefaultNetwork
+	}
+	if c.Subnet == "" {
+		c.Subnet = DefaultSubnet
+	}
+	if c.Docker == "" {
+		c.Docker = connector.DefaultDockerBinary
+	}
+}
+
+// Validate checks the settings and that every address lies in the subnet.
+func (c *Config) Validate(addresses []string) error {
+	_, subnet, err := net.ParseCIDR(c.Subnet)
+	if err != nil {
+		return fmt.Errorf("invalid subnet %q: %w", c.Subnet, err)
+	}
+	var errs []error
+	for _, addr := range addresses {
+		if ip := net.ParseIP(addr); ip == nil || !subnet.Contains(ip) {
+			errs = append(errs, fmt.Errorf("address %s is not in subnet %s", addr, c.Subnet))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ImageFor returns the node image for kubernetesVersion.
+func (c *Config) ImageFor(kubernetesVersion string) string {
+	if c.Image != "" {
+		return c.Image
+	}
+	return DefaultImageRepository + ":" + kubernetesVersion
+}
+
+// ContainerName returns the container of host in cluster.
+func ContainerName(cluster, host string) string {
+	return cluster + "-" + host
+}
+
+// RunArgs returns the `docker run` arguments starting the node container of
+// host. The flags are those systemd and kubelet need inside a container.
+func RunArgs(cfg Config, cluster string, host connector.Host, image string) []string {
+	name := ContainerName(cluster, host.GetName())
+	return []string{
+		"run", "--detach",
+		"--name", name,
+		"--hostname", host.GetName(),
+		"--label", ClusterLabel + "=" + cluster,
+		"--network", cfg.Network,
+		"--ip", host.GetInternalIPv4Address(),
+		"--privileged",
+		"--security-opt", "seccomp=unconfined",
+		"--security-opt", "apparmor=unconfined",
+		"--cgroupns", "private",
+		"--tmpfs", "/tmp",
+		"--tmpfs", "/run",
+		"--volume", "/var",
+		"--volume", "/lib/modules:/lib/modules:ro",
+		"--restart", "on-failure:1",
+		image,
+	}
+}
+
+func docker(ctx context.Context, cfg Config, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, cfg.Docker, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("docker %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// Dial returns the connection factory for the nodes of cluster, for
+// modules.ConnectWith.
+func Dial(cfg Config, cluster string) modules.Dialer {
+	return func(host connector.Host) (connector.Connection, error) {
+		return connector.NewDockerConnection(connector.DockerConfig{
+			Container: ContainerName(cluster, host.GetName()),
+			Binary:    cfg.Docker,
+		})
+	}
+}
+
+// Provision creates the network and starts a node container for every host
+// that does not have a running one yet, then waits for systemd to boot.
+func Provision(ctx context.Context, cluster string, hosts []connector.Host, cfg Config, kubernetesVersion string) error {
+	cfg.SetDefaults()
+	image := cfg.ImageFor(kubernetesVersion)
+	if _, err := docker(ctx, cfg, "network", "inspect", cfg.Network); err != nil {
+		logger.Log.InfofModule(moduleName, "creating network %s (%s)", cfg.Network, cfg.Subnet)
+		if _, err := docker(ctx, cfg, "network", "create", "--subnet", cfg.Subnet, "--label", ClusterLabel+"="+cluster, cfg.Network); err != nil {
+			return err
+		}
+	}
+
+	for _, h := range hosts {
+		name := ContainerName(cluster, h.GetName())
+		state, err := docker(ctx, cfg, "inspect", "-f", "{{.State.Running}}", name)
+		switch {
+		case err == nil && state == "true":
+			logger.Log.InfofModule(moduleName, "node %s already running", name)
+			continue
+		case err == nil:
+			if _, err := docker(ctx, cfg, "start", name); err != nil {
+				return err
+			}
+		default:
+			logger.Log.InfofModule(moduleName, "starting node %s from %s", name, image)
+			if _, err := docker(ctx, cfg, RunArgs(cfg, cluster, h, image)...); err != nil {
+				return err
+			}
+		}
+	}
+
+	nodes := make([]modules.Node, 0, len(hosts))
+	for _, h := range hosts {
+		nodes = append(nodes, modules.Node{Host: h})
+	}
+	return modules.ForEach(ctx, nodes, func(ctx context.Context, node modules.Node) error {
+		name := ContainerName(cluster, node.Name())
+		if _, err := docker(ctx, cfg, "exec", name, "sh", "-c",
+			"command -v sudo >/dev/null || { printf '%s' '"+sudoShim+"' > /usr/local/bin/sudo && chmod 0755 /usr/local/bin/sudo; }"); err != nil {
+			return err
+		}
+		return wait.Poll(ctx, wait.Options{Timeout: bootTimeout, Interval: time.Second}, "systemd in "+name, func(ctx context.Context) (bool, error) {
+			state, _ := docker(ctx, cfg, "exec", name, "systemctl", "is-system-running")
+			if state != "running" && state != "degraded" {
+				return false, fmt.Errorf("system state %q", state)
+			}
+			return true, nil
+		})
+	})
+}
+
+// Delete removes the node containers and the network created for cluster.
+func Delete(ctx context.Context, cluster string, cfg Config) error {
+	cfg.SetDefaults()
+	filter := "label=" + ClusterLabel + "=" + cluster
+	ids, err := docker(ctx, cfg, "ps", "-aq", "--filter", filter)
+	if err != nil {
+		return err
+	}
+	if ids != "" {
+		logger.Log.InfofModule(moduleName, "removing the node containers of %s", cluster)
+		if _, err := docker(ctx, cfg, append([]string{"rm", "-f", "-v"}, strings.Fields(ids)...)...); err != nil {
+			return err
+		}
+	}
+	networks, err := docker(ctx, cfg, "network", "ls", "-q", "--filter", filter)
+	if err != nil {
+		return err
+	}
+	if networks != "" {
+		// The network may be shared with another cluster's nodes.
+		if _, err := docker(ctx, cfg, append([]string{"network", "rm"}, strings.Fields(networks)...)...); err != nil {
+			logger.Log.WarnfModule(moduleName, "network of %s kept: %v", cluster, err)
+		}
+	}
+	return nil
+}
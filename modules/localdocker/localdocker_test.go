@@ -0,0 +1,28 @@
+package localdocker
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mensylisir/xmcores/connector"
+)
+
+func TestRunArgs(t *testing.T) {
+	cfg := Config{}
+	cfg.SetDefaults()
+	assert.Equal(t, DefaultImageRepository+":v1.31.2", cfg.ImageFor("v1.31.2"))
+
+	host := &connector.BaseHost{Name: "master1", InternalAddress: "172.30.0.10"}
+	args := strings.Join(RunArgs(cfg, "demo", host, "img:1"), " ")
+	assert.Contains(t, args, "--name demo-master1 --hostname master1")
+	assert.Contains(t, args, "--network xmcores --ip 172.30.0.10")
+	assert.Contains(t, args, "--label "+ClusterLabel+"=demo")
+	assert.True(t, strings.HasSuffix(args, " img:1"))
+
+	assert.NoError(t, cfg.Validate([]string{"172.30.0.10", "172.30.1.1"}))
+	assert.ErrorContains(t, cfg.Validate([]string{"10.0.0.1"}), "10.0.0.1 is not in subnet 172.30.0.0/16")
+	cfg.Subnet = "bad"
+	assert.ErrorContains(t, cfg.Validate(nil), "invalid subnet")
+}
@@ -0,0 +1,210 @@
+// Package logs streams the journal of a systemd unit or a log file from
+// nodes, following it like tail -f if asked. The commands run with sudo over
+// the connections of the nodes, so no separate SSH session is needed to
+// watch a node join; the lines of several nodes are merged, each prefixed
+// with the name of its node.
+package logs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mensylisir/xmcores/connector"
+	"github.com/mensylisir/xmcores/errs"
+	"github.com/mensylisir/xmcores/modules"
+	"github.com/mensylisir/xmcores/shellquote"
+)
+
+// DefaultLines is the number of lines shown before following.
+const DefaultLines = 100
+
+// beginMarker precedes the output of the command. What comes before, like
+// the sudo password prompt, is not shown.
+const beginMarker = "__XM_LOGS_BEGIN__"
+
+// maxNoise bounds the output kept from before beginMarker, only used in
+// errors.
+const maxNoise = 4096
+
+var unitPattern = regexp.MustCompile(`^[A-Za-z0-9@._:-]+$`)
+
+// Target is what is streamed: the journal of Unit or the file Path.
+type Target struct {
+	Unit string
+	Path string
+}
+
+// ParseTarget returns the target s designates: an absolute path for a file,
+// a systemd unit name otherwise, e.g. kubelet or containerd.service.
+func ParseTarget(s string) (Target, error) {
+	switch {
+	case strings.HasPrefix(s, "/"):
+		return Target{Path: s}, nil
+	case unitPattern.MatchString(s):
+		return Target{Unit: s}, nil
+	}
+	return Target{}, fmt.Errorf("%q is neither a systemd unit nor an absolute file path", s)
+}
+
+// String returns the target as given to ParseTarget.
+func (t Target) String() string {
+	if t.Path != "" {
+		return t.Path
+	}
+	return t.Unit
+}
+
+// Options control what is streamed.
+type Options struct {
+	// Follow keeps streaming new lines until the context is done.
+	Follow bool
+	// Lines is the number of past lines shown, DefaultLines by default.
+	Lines int
+	// Since limits the past lines of a journal to this window; 0 applies no
+	// limit.
+	Since time.Duration
+}
+
+// SetDefaults fills unset fields.
+func (o *Options) SetDefaults() {
+	if o.Lines == 0 {
+		o.Lines = DefaultLines
+	}
+}
+
+// Validate checks the options for t.
+func (o Options) Validate(t Target) error {
+	if o.Lines < 0 {
+		return errors.New("lines must not be negative")
+	}
+	if o.Since < 0 {
+		return errors.New("since must not be negative")
+	}
+	if o.Since > 0 && t.Path != "" {
+		return fmt.Errorf("since only applies to the journal of a unit, not to %s", t.Path)
+	}
+	return nil
+}
+
+// Command returns the command printing t, run with sudo.
+func Command(t Target, o Options) string {
+	var cmd string
+	if t.Path != "" {
+		cmd = fmt.Sprintf("tail -n %d", o.Lines)
+		if o.Follow {
+			// -F keeps following the file across rotations.
+			cmd += " -F"
+		}
+		cmd += " " + shellquote.Quote(t.Path)
+	} else {
+		cmd = fmt.Sprintf("journalctl -u %s --no-pager -n %d", shellquote.Quote(t.Unit), o.Lines)
+		if o.Since > 0 {
+			cmd += fmt.Sprintf(" --since=-%ds", int(o.Since/time.Second))
+		}
+		if o.Follow {
+			cmd += " -f"
+		}
+	}
+	return "echo " + beginMarker + " && exec " + cmd
+}
+
+// Stream writes the lines of t on nodes to w as they come, prefixed with the
+// name of their node when there are several nodes. With Follow it returns
+// once ctx is done; otherwise when every node printed its lines. Failures of
+// a node do not stop the others.
+func Stream(ctx context.Context, nodes []modules.Node, t Target, o Options, w io.Writer) error {
+	o.SetDefaults()
+	if err := o.Validate(t); err != nil {
+		return errs.Wrap(errs.Config, err)
+	}
+	width := 0
+	for _, n := range nodes {
+		if len(n.Name()) > width {
+			width = len(n.Name())
+		}
+	}
+	var mu sync.Mutex
+	cmd := Command(t, o)
+	return modules.ForEach(ctx, nodes, func(ctx context.Context, node modules.Node) error {
+		prefix := ""
+		if len(nodes) > 1 {
+			prefix = fmt.Sprintf("%-*s | ", width, node.Name())
+		}
+		stdout := &lineWriter{mu: &mu, dst: w, prefix: prefix}
+		stderr := &lineWriter{mu: &mu, dst: w, prefix: prefix, started: true}
+		code, err := node.Conn.PExec(ctx, connector.SudoCommand(ctx, node.Conn, cmd), nil, stdout, stderr)
+		stdout.flush()
+		stderr.flush()
+		switch {
+		case ctx.Err() != nil && o.Follow:
+			// Interrupted, the way following ends.
+			return nil
+		case err != nil:
+			return errs.Wrap(errs.Connectivity, fmt.Errorf("failed to stream %s: %w", t, err))
+		case code != 0:
+			if noise := strings.TrimSpace(stdout.noise.String()); noise != "" {
+				return errs.Wrap(errs.Execution, fmt.Errorf("failed to stream %s: exit code %d: %s", t, code, noise))
+			}
+			return errs.Wrap(errs.Execution, fmt.Errorf("failed to stream %s: exit code %d", t, code))
+		}
+		return nil
+	})
+}
+
+// lineWriter writes the complete lines written to it to dst, each prefixed,
+// holding mu so that the lines of several nodes do not mix. Until started,
+// lines are kept as noise instead, up to the begin marker.
+type lineWriter struct {
+	mu      *sync.Mutex
+	dst     io.Writer
+	prefix  string
+	started bool
+	line    []byte
+	noise   bytes.Buffer
+}
+
+func (l *lineWriter) Write(p []byte) (int, error) {
+	for _, b := range p {
+		if b != '\n' {
+			l.line = append(l.line, b)
+			continue
+		}
+		if err := l.emit(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// emit handles the buffered line, without its carriage return: the session
+// of an SSH connection runs on a terminal.
+func (l *lineWriter) emit() error {
+	line := strings.TrimRight(string(l.line), "\r")
+	l.line = l.line[:0]
+	if !l.started {
+		if line == beginMarker {
+			l.started = true
+		} else if l.noise.Len() < maxNoise {
+			l.noise.WriteString(line + "\n")
+		}
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err := io.WriteString(l.dst, l.prefix+line+"\n")
+	return err
+}
+
+// flush emits the last line if it has no newline.
+func (l *lineWriter) flush() {
+	if len(l.line) > 0 {
+		_ = l.emit()
+	}
+}
@@ -0,0 +1,67 @@
+package logs
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mensylisir/xmcores/connector"
+	"github.com/mensylisir/xmcores/connector/connectortest"
+	"github.com/mensylisir/xmcores/errs"
+	"github.com/mensylisir/xmcores/modules"
+)
+
+func TestCommand(t *testing.T) {
+	unit, err := ParseTarget("kubelet")
+	require.NoError(t, err)
+	assert.Equal(t, Target{Unit: "kubelet"}, unit)
+	file, err := ParseTarget("/var/log/kube audit.log")
+	require.NoError(t, err)
+	_, err = ParseTarget("kubelet; reboot")
+	assert.ErrorContains(t, err, "neither a systemd unit")
+
+	o := Options{Follow: true, Since: 10 * time.Minute}
+	o.SetDefaults()
+	require.NoError(t, o.Validate(unit))
+	assert.Equal(t, "echo __XM_LOGS_BEGIN__ && exec journalctl -u kubelet --no-pager -n 100 --since=-600s -f", Command(unit, o))
+	assert.ErrorContains(t, o.Validate(file), "since only applies")
+
+	assert.Equal(t, "echo __XM_LOGS_BEGIN__ && exec tail -n 5 -F '/var/log/kube audit.log'", Command(file, Options{Follow: true, Lines: 5}))
+}
+
+func node(name string, fake *connectortest.Fake) modules.Node {
+	h := connector.NewHost()
+	h.SetName(name)
+	return modules.Node{Host: h, Conn: fake}
+}
+
+func TestStream(t *testing.T) {
+	prompt := "[sudo] password for xm: \r\n" + beginMarker + "\r\n"
+	master := connectortest.NewFake().On(`journalctl -u kubelet`, connectortest.Result{Stdout: prompt + "started\r\nready"})
+	worker := connectortest.NewFake().On(`journalctl -u kubelet`, connectortest.Result{Stdout: beginMarker + "\njoining\n"})
+	broken := connectortest.NewFake().On(`journalctl`, connectortest.Result{Stdout: "sudo: a password is required\n", ExitCode: 1})
+
+	var out bytes.Buffer
+	err := Stream(context.Background(), []modules.Node{node("master1", master), node("w1", worker)}, Target{Unit: "kubelet"}, Options{}, &out)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	sort.Strings(lines)
+	assert.Equal(t, []string{"master1 | ready", "master1 | started", "w1      | joining"}, lines)
+
+	out.Reset()
+	require.NoError(t, Stream(context.Background(), []modules.Node{node("master1", master)}, Target{Unit: "kubelet"}, Options{}, &out))
+	assert.Equal(t, "started\nready\n", out.String(), "a single node has no prefix")
+
+	err = Stream(context.Background(), []modules.Node{node("w2", broken)}, Target{Unit: "kubelet"}, Options{}, &out)
+	assert.Equal(t, errs.Execution, errs.KindOf(err))
+	assert.ErrorContains(t, err, "exit code 1: sudo: a password is required")
+
+	err = Stream(context.Background(), nil, Target{Path: "/var/log/syslog"}, Options{Since: time.Hour}, &out)
+	assert.Equal(t, errs.Config, errs.KindOf(err))
+}
@@ -0,0 +1,213 @@
+// Package modules holds the building blocks shared by installation modules.
+// Each module lives in its own sub-package and operates on Nodes: a host from
+// the inventory paired with an open connection to it.
+package modules
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/mensylisir/xmcores/common"
+	"github.com/mensylisir/xmcores/connector"
+	"github.com/mensylisir/xmcores/errs"
+	"github.com/mensylisir/xmcores/shellquote"
+)
+
+// Node is an inventory host together with its connection.
+type Node struct {
+	Host connector.Host
+	Conn connector.Connection
+}
+
+// Name returns the host name used in logs and errors.
+func (n Node) Name() string {
+	if n.Host == nil {
+		return ""
+	}
+	return n.Host.GetName()
+}
+
+// Run executes cmd with sudo and returns its trimmed stdout. A non-zero exit
+// code is reported as an execution error carrying stderr, a transport failure
+// as a connectivity error.
+func Run(ctx context.Context, exec connector.Executor, cmd string) (string, error) {
+	return run(ctx, exec, connector.SudoCommand(ctx, exec, cmd), cmd)
+}
+
+// RunUnprivileged is Run without sudo, for commands that must run as the
+// connecting user.
+func RunUnprivileged(ctx context.Context, exec connector.Executor, cmd string) (string, error) {
+	return run(ctx, exec, cmd, cmd)
+}
+
+func run(ctx context.Context, exec connector.Executor, wrapped, cmd string) (string, error) {
+	return resultErr(connector.Execute(ctx, exec, "", wrapped), cmd)
+}
+
+// Exec runs cmd with sudo on node and returns the full result, for callers
+// that need the exit code, stderr or timing rather than just stdout. The
+// result's error (see ResultError) is the one Run would return.
+func Exec(ctx context.Context, node Node, cmd string) *connector.CmdResult {
+	return connector.Execute(ctx, node.Conn, node.Name(), connector.SudoCommand(ctx, node.Conn, cmd))
+}
+
+// RunWith runs cmd on node as opts select (see connector.ExecOptions), e.g.
+// with a timeout, environment or stdin, and returns its trimmed stdout. Errors
+// are reported as by Run; invalid options are a configuration error.
+func RunWith(ctx context.Context, node Node, cmd string, opts connector.ExecOptions) (string, error) {
+	if _, err := opts.Command(cmd); err != nil {
+		return "", errs.Wrap(errs.Config, err)
+	}
+	return resultErr(connector.ExecWith(ctx, node.Conn, node.Name(), cmd, opts), cmd)
+}
+
+// ResultError returns the error Run reports for r: a connectivity error for
+// a transport failure, an execution error carrying stderr for a non-zero
+// exit, else nil. cmd names the command as the caller wrote it, without the
+// sudo wrapping.
+func ResultError(r *connector.CmdResult, cmd string) error {
+	_, err := resultErr(r, cmd)
+	return err
+}
+
+func resultErr(r *connector.CmdResult, cmd string) (string, error) {
+	switch {
+	case r.Err != nil:
+		return r.StdoutString(), errs.Wrap(errs.Connectivity, fmt.Errorf("failed to run %q: %w", cmd, r.Err))
+	case r.ExitCode != 0:
+		return r.StdoutString(), errs.Wrap(errs.Execution, fmt.Errorf("command %q exited with code %d: %s", cmd, r.ExitCode, r.StderrString()))
+	}
+	return r.StdoutString(), nil
+}
+
+// RunAll runs each command in order and stops at the first failure.
+func RunAll(ctx context.Context, exec connector.Executor, cmds ...string) error {
+	for _, cmd := range cmds {
+		if _, err := Run(ctx, exec, cmd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Succeeds reports whether cmd exits with code 0. Only transport errors are returned.
+func Succeeds(ctx context.Context, exec connector.Executor, cmd string) (bool, error) {
+	_, _, exitCode, err := exec.Exec(ctx, connector.SudoCommand(ctx, exec, cmd))
+	if err != nil {
+		return false, errs.Wrap(errs.Connectivity, fmt.Errorf("failed to run %q: %w", cmd, err))
+	}
+	return exitCode == 0, nil
+}
+
+// WriteFile writes content to remotePath with the given mode, creating parent directories.
+func WriteFile(ctx context.Context, fo connector.FileOperator, content []byte, remotePath string, mode os.FileMode) error {
+	if err := fo.Scp(ctx, bytes.NewReader(content), remotePath, int64(len(content)), mode); err != nil {
+		return fmt.Errorf("failed to write %s: %w", remotePath, err)
+	}
+	return nil
+}
+
+// ForEach calls fn for every node concurrently and returns the joined errors,
+// each annotated with the node name (see errs.WithHost).
+func ForEach(ctx context.Context, nodes []Node, fn func(ctx context.Context, node Node) error) error {
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		failed []error
+	)
+	for _, node := range nodes {
+		wg.Add(1)
+		go func(node Node) {
+			defer wg.Done()
+			if err := fn(ctx, node); err != nil {
+				mu.Lock()
+				failed = append(failed, errs.WithHost(err, node.Name()))
+				mu.Unlock()
+			}
+		}(node)
+	}
+	wg.Wait()
+	return errors.Join(failed...)
+}
+
+// InstallCmd returns the non-interactive command installing pkgs with the given
+// package manager family (see the facts.PackageManager* constants).
+func InstallCmd(packageManager string, pkgs ...string) (string, error) {
+	list := strings.Join(pkgs, " ")
+	switch packageManager {
+	case "apt":
+		return "DEBIAN_FRONTEND=noninteractive apt-get install -y " + list, nil
+	case "yum", "dnf":
+		return packageManager + " install -y " + list, nil
+	case "apk":
+		return "apk add --no-cache " + list, nil
+	default:
+		return "", fmt.Errorf("unsupported package manager %q", packageManager)
+	}
+}
+
+// RemoveCmd returns the non-interactive command removing pkgs with the given
+// package manager family, see InstallCmd.
+func RemoveCmd(packageManager string, pkgs ...string) (string, error) {
+	list := strings.Join(pkgs, " ")
+	switch packageManager {
+	case "apt":
+		return "DEBIAN_FRONTEND=noninteractive apt-get remove -y " + list, nil
+	case "yum", "dnf":
+		return packageManager + " remove -y " + list, nil
+	case "apk":
+		return "apk del " + list, nil
+	default:
+		return "", fmt.Errorf("unsupported package manager %q", packageManager)
+	}
+}
+
+// InstalledCmd returns the command exiting with code 0 when pkg is installed
+// with the given package manager family, see InstallCmd.
+func InstalledCmd(packageManager, pkg string) (string, error) {
+	switch packageManager {
+	case "apt":
+		return "dpkg -s " + shellquote.Quote(pkg) + " >/dev/null 2>&1", nil
+	case "yum", "dnf":
+		return "rpm -q " + shellquote.Quote(pkg) + " >/dev/null 2>&1", nil
+	case "apk":
+		return "apk info -e " + shellquote.Quote(pkg) + " >/dev/null 2>&1", nil
+	default:
+		return "", fmt.Errorf("unsupported package manager %q", packageManager)
+	}
+}
+
+// AdminKubeconfig is the kubeconfig kubectl uses on control-plane nodes.
+const AdminKubeconfig = "/etc/kubernetes/admin.conf"
+
+// Kubectl runs kubectl with the admin kubeconfig on a control-plane node.
+func Kubectl(ctx context.Context, exec connector.Executor, args string) (string, error) {
+	// shellquote:ok: args is checked where Kubectl is called.
+	return Run(ctx, exec, "kubectl --kubeconfig "+AdminKubeconfig+" "+args)
+}
+
+// KubectlApply uploads manifest to a temporary file on a control-plane node,
+// applies it and removes the file.
+func KubectlApply(ctx context.Context, conn connector.Connection, name string, manifest []byte) error {
+	remote := path.Join(common.GetTmpDir(), "manifests", name+".yaml")
+	if err := conn.MkDirAll(ctx, path.Dir(remote), common.FileMode0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", path.Dir(remote), err)
+	}
+	// Manifests may hold secrets, so they are not left behind.
+	defer func() {
+		_, _ = Run(ctx, conn, "rm -f "+remote)
+	}()
+	if err := WriteFile(ctx, conn, manifest, remote, common.FileMode0600); err != nil {
+		return err
+	}
+	if _, err := Kubectl(ctx, conn, "apply -f "+remote); err != nil {
+		return fmt.Errorf("failed to apply %s: %w", name, err)
+	}
+	return nil
+}
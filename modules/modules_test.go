@@ -0,0 +1,79 @@
+package modules_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mensylisir/xmcores/connector"
+	"github.com/mensylisir/xmcores/connector/connectortest"
+	"github.com/mensylisir/xmcores/errs"
+	"github.com/mensylisir/xmcores/modules"
+)
+
+func TestExec(t *testing.T) {
+	ctx := context.Background()
+	fake := connectortest.NewFake().
+		On(`systemctl is-active kubelet`, connectortest.Result{Stdout: "inactive\n", Stderr: "unit not running\n", ExitCode: 3}).
+		On(`uptime`, connectortest.Result{Err: errors.New("connection reset")})
+	host := connector.NewHost()
+	host.SetName("node1")
+	node := modules.Node{Host: host, Conn: fake}
+
+	r := modules.Exec(ctx, node, "systemctl is-active kubelet")
+	assert.Equal(t, "node1", r.Host)
+	assert.Equal(t, connector.SudoPrefix("systemctl is-active kubelet"), r.Command)
+	assert.Equal(t, 3, r.ExitCode)
+	assert.Equal(t, "inactive", r.StdoutString())
+	err := modules.ResultError(r, "systemctl is-active kubelet")
+	assert.Equal(t, errs.Execution, errs.KindOf(err))
+	assert.EqualError(t, err, `command "systemctl is-active kubelet" exited with code 3: unit not running`)
+
+	_, runErr := modules.Run(ctx, fake, "systemctl is-active kubelet")
+	assert.Equal(t, err.Error(), runErr.Error(), "Run reports the same error")
+
+	err = modules.ResultError(modules.Exec(ctx, node, "uptime"), "uptime")
+	assert.Equal(t, errs.Connectivity, errs.KindOf(err))
+}
+
+func TestRunWith(t *testing.T) {
+	ctx := context.Background()
+	fake := connectortest.NewFake().On(`export KUBECONFIG=.* kubectl version`, connectortest.Result{Stdout: "v1.30.2\n"})
+	host := connector.NewHost()
+	host.SetName("node1")
+	node := modules.Node{Host: host, Conn: fake}
+
+	out, err := modules.RunWith(ctx, node, "kubectl version", connector.ExecOptions{Env: map[string]string{"KUBECONFIG": "/etc/kubernetes/admin.conf"}})
+	require.NoError(t, err)
+	assert.Equal(t, "v1.30.2", out)
+
+	_, err = modules.RunWith(ctx, node, "kubectl version", connector.ExecOptions{Env: map[string]string{"BAD NAME": ""}})
+	assert.Equal(t, errs.Config, errs.KindOf(err))
+}
+
+func TestServiceCmd(t *testing.T) {
+	for _, tc := range []struct {
+		init, action, want string
+	}{
+		{"systemd", modules.ServiceEnable, "systemctl enable --now chronyd"},
+		{"systemd", modules.ServiceRestart, "systemctl restart chronyd"},
+		{"systemd", modules.ServiceIsActive, "systemctl is-active --quiet chronyd"},
+		{"openrc", modules.ServiceEnable, "rc-update add chronyd default && rc-service chronyd start"},
+		{"openrc", modules.ServiceRestart, "rc-service chronyd restart"},
+		{"openrc", modules.ServiceDisable, "rc-service chronyd stop; rc-update del chronyd default 2>/dev/null || true"},
+		{"openrc", modules.ServiceIsActive, "rc-service chronyd status >/dev/null 2>&1"},
+		{"systemd", modules.ServiceIsEnabled, "systemctl is-enabled --quiet chronyd"},
+		{"openrc", modules.ServiceIsEnabled, "rc-update show default | grep -q '^ *chronyd |'"},
+	} {
+		cmd, err := modules.ServiceCmd(tc.init, tc.action, "chronyd")
+		require.NoError(t, err)
+		assert.Equal(t, tc.want, cmd)
+	}
+	_, err := modules.ServiceCmd("sysvinit", modules.ServiceStart, "chronyd")
+	assert.EqualError(t, err, `unsupported init system "sysvinit"`)
+	_, err = modules.ServiceCmd("openrc", "reload", "chronyd")
+	assert.EqualError(t, err, `unsupported service action "reload"`)
+}
@@ -0,0 +1,192 @@
+// Package nodemeta applies the labels, annotations and taints declared for each
+// host in the cluster configuration to the corresponding Kubernetes node.
+package nodemeta
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/mensylisir/xmcores/logger"
+	"github.com/mensylisir/xmcores/modules"
+)
+
+const moduleName = "NodeMeta"
+
+// Taint effects.
+const (
+	EffectNoSchedule       = "NoSchedule"
+	EffectPreferNoSchedule = "PreferNoSchedule"
+	EffectNoExecute        = "NoExecute"
+)
+
+// Taint is a node taint.
+type Taint struct {
+	Key    string `yaml:"key" json:"key"`
+	Value  string `yaml:"value,omitempty" json:"value,omitempty"`
+	Effect string `yaml:"effect" json:"effect"`
+}
+
+// String renders the taint in kubectl syntax: key[=value]:effect.
+func (t Taint) String() string {
+	if t.Value == "" {
+		return t.Key + ":" + t.Effect
+	}
+	return t.Key + "=" + t.Value + ":" + t.Effect
+}
+
+// Metadata is the desired metadata of one node.
+type Metadata struct {
+	Node        string
+	Labels      map[string]string
+	Annotations map[string]string
+	Taints      []Taint
+}
+
+// Empty reports whether there is nothing to apply.
+func (m Metadata) Empty() bool {
+	return len(m.Labels) == 0 && len(m.Annotations) == 0 && len(m.Taints) == 0
+}
+
+var (
+	qualifiedName = regexp.MustCompile(`^([A-Za-z0-9][-A-Za-z0-9_.]{0,61})?[A-Za-z0-9]$`)
+	dnsSubdomain  = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`)
+	labelValue    = regexp.MustCompile(`^(([A-Za-z0-9][-A-Za-z0-9_.]{0,61})?[A-Za-z0-9])?$`)
+)
+
+// ValidateKey checks a label, annotation or taint key: an optional DNS
+// subdomain prefix followed by a qualified name of at most 63 characters.
+func ValidateKey(key string) error {
+	name := key
+	if prefix, rest, ok := strings.Cut(key, "/"); ok {
+		if len(prefix) > 253 || !dnsSubdomain.MatchString(prefix) {
+			return fmt.Errorf("invalid key %q: prefix must be a DNS subdomain", key)
+		}
+		name = rest
+	}
+	if !qualifiedName.MatchString(name) {
+		return fmt.Errorf("invalid key %q: name must be at most 63 alphanumeric characters, '-', '_' or '.'", key)
+	}
+	return nil
+}
+
+// ValidateLabels checks label keys and values.
+func ValidateLabels(labels map[string]string) error {
+	for k, v := range labels {
+		if err := ValidateKey(k); err != nil {
+			return fmt.Errorf("label: %w", err)
+		}
+		if !labelValue.MatchString(v) {
+			return fmt.Errorf("label %s: invalid value %q", k, v)
+		}
+	}
+	return nil
+}
+
+// ValidateAnnotations checks annotation keys. Values are free-form.
+func ValidateAnnotations(annotations map[string]string) error {
+	for k := range annotations {
+		if err := ValidateKey(k); err != nil {
+			return fmt.Errorf("annotation: %w", err)
+		}
+	}
+	return nil
+}
+
+// ValidateTaints checks taint keys, values and effects.
+func ValidateTaints(taints []Taint) error {
+	seen := make(map[string]bool, len(taints))
+	for _, t := range taints {
+		if err := ValidateKey(t.Key); err != nil {
+			return fmt.Errorf("taint: %w", err)
+		}
+		if !labelValue.MatchString(t.Value) {
+			return fmt.Errorf("taint %s: invalid value %q", t.Key, t.Value)
+		}
+		switch t.Effect {
+		case EffectNoSchedule, EffectPreferNoSchedule, EffectNoExecute:
+		default:
+			return fmt.Errorf("taint %s: unsupported effect %q", t.Key, t.Effect)
+		}
+		id := t.Key + ":" + t.Effect
+		if seen[id] {
+			return fmt.Errorf("duplicate taint %s", id)
+		}
+		seen[id] = true
+	}
+	return nil
+}
+
+// Validate checks all metadata of the node.
+func (m Metadata) Validate() error {
+	if err := ValidateLabels(m.Labels); err != nil {
+		return err
+	}
+	if err := ValidateAnnotations(m.Annotations); err != nil {
+		return err
+	}
+	return ValidateTaints(m.Taints)
+}
+
+// quote single-quotes s for the remote shell.
+func quote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func pairs(m map[string]string) string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, quote(k+"="+m[k]))
+	}
+	return strings.Join(parts, " ")
+}
+
+// KubectlArgs returns the kubectl invocations that apply m. Existing values
+// are overwritten; labels, annotations and taints not listed are left alone.
+func KubectlArgs(m Metadata) []string {
+	var args []string
+	node := quote(m.Node)
+	if len(m.Labels) > 0 {
+		args = append(args, "label node "+node+" --overwrite "+pairs(m.Labels))
+	}
+	if len(m.Annotations) > 0 {
+		args = append(args, "annotate node "+node+" --overwrite "+pairs(m.Annotations))
+	}
+	if len(m.Taints) > 0 {
+		taints := make([]string, 0, len(m.Taints))
+		for _, t := range m.Taints {
+			taints = append(taints, quote(t.String()))
+		}
+		args = append(args, "taint node "+node+" --overwrite "+strings.Join(taints, " "))
+	}
+	return args
+}
+
+// Apply labels, annotates and taints the nodes through kubectl on controlPlane.
+func Apply(ctx context.Context, controlPlane modules.Node, metas []Metadata) error {
+	for _, m := range metas {
+		if err := m.Validate(); err != nil {
+			return fmt.Errorf("node %s: %w", m.Node, err)
+		}
+	}
+	for _, m := range metas {
+		if m.Empty() {
+			continue
+		}
+		for _, args := range KubectlArgs(m) {
+			if _, err := modules.Kubectl(ctx, controlPlane.Conn, args); err != nil {
+				return fmt.Errorf("node %s: %w", m.Node, err)
+			}
+		}
+		logger.Log.InfofModule(moduleName, "applied %d labels, %d annotations and %d taints to node %s",
+			len(m.Labels), len(m.Annotations), len(m.Taints), m.Node)
+	}
+	return nil
+}
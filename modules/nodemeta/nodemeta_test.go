@@ -0,0 +1,37 @@
+package nodemeta
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidate(t *testing.T) {
+	assert.NoError(t, Metadata{
+		Labels:      map[string]string{"node.example.com/gpu": "true", "zone": ""},
+		Annotations: map[string]string{"example.com/owner": "team a"},
+		Taints:      []Taint{{Key: "dedicated", Value: "gpu", Effect: EffectNoSchedule}},
+	}.Validate())
+
+	assert.ErrorContains(t, ValidateLabels(map[string]string{"Bad_Prefix/x": "1"}), "prefix")
+	assert.ErrorContains(t, ValidateLabels(map[string]string{"a": "has space"}), "invalid value")
+	assert.ErrorContains(t, ValidateAnnotations(map[string]string{"-x": ""}), "annotation")
+	assert.ErrorContains(t, ValidateTaints([]Taint{{Key: "a", Effect: "Never"}}), "unsupported effect")
+	assert.ErrorContains(t, ValidateTaints([]Taint{{Key: "a", Effect: EffectNoExecute}, {Key: "a", Value: "b", Effect: EffectNoExecute}}), "duplicate taint")
+}
+
+func TestKubectlArgs(t *testing.T) {
+	args := KubectlArgs(Metadata{
+		Node:        "worker1",
+		Labels:      map[string]string{"b": "2", "a": "1"},
+		Annotations: map[string]string{"note": "it's fine"},
+		Taints:      []Taint{{Key: "dedicated", Value: "gpu", Effect: EffectNoSchedule}, {Key: "spot", Effect: EffectPreferNoSchedule}},
+	})
+	assert.Equal(t, []string{
+		"label node 'worker1' --overwrite 'a=1' 'b=2'",
+		`annotate node 'worker1' --overwrite 'note=it'\''s fine'`,
+		"taint node 'worker1' --overwrite 'dedicated=gpu:NoSchedule' 'spot:PreferNoSchedule'",
+	}, args)
+
+	assert.Empty(t, KubectlArgs(Metadata{Node: "worker1"}))
+}
@@ -0,0 +1,283 @@
+// Package nodeprep applies explicit swap, SELinux and firewall policies during
+// node preparation instead of assuming a particular host setup.
+package nodeprep
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/mensylisir/xmcores/common"
+	"github.com/mensylisir/xmcores/connector"
+	"github.com/mensylisir/xmcores/logger"
+	"github.com/mensylisir/xmcores/modules"
+)
+
+const moduleName = "NodePrepare"
+
+// Swap policies.
+const (
+	SwapDisable = "disable"
+	// SwapKeep leaves swap on; kubelet must then run with failSwapOn=false.
+	SwapKeep = "keep"
+)
+
+// SELinux policies. SELinuxKeep leaves the current mode untouched.
+const (
+	SELinuxPermissive = "permissive"
+	SELinuxEnforcing  = "enforcing"
+	SELinuxKeep       = "keep"
+)
+
+// Firewall policies.
+const (
+	FirewallDisable = "disable"
+	// FirewallRules keeps the firewall running and opens only the ports the node's roles need.
+	FirewallRules = "rules"
+	FirewallKeep  = "keep"
+)
+
+// Directories relabelled for containers when SELinux is enforcing.
+var selinuxContainerDirs = []string{"/etc/kubernetes", "/var/lib/etcd", "/var/lib/kubelet", "/etc/cni/net.d", "/opt/cni/bin"}
+
+// Config holds the node preparation policies.
+type Config struct {
+	Swap     string `yaml:"swap,omitempty" json:"swap,omitempty"`
+	SELinux  string `yaml:"selinux,omitempty" json:"selinux,omitempty"`
+	Firewall string `yaml:"firewall,omitempty" json:"firewall,omitempty"`
+	// ExtraPorts are opened on every node in FirewallRules mode, e.g. "179/tcp" for BGP or "4789/udp" for VXLAN.
+	ExtraPorts []string `yaml:"extraPorts,omitempty" json:"extraPorts,omitempty"`
+}
+
+// SetDefaults fills unset policies with the conservative defaults kubeadm expects.
+func (c *Config) SetDefaults() {
+	if c.Swap == "" {
+		c.Swap = SwapDisable
+	}
+	if c.SELinux == "" {
+		c.SELinux = SELinuxPermissive
+	}
+	if c.Firewall == "" {
+		c.Firewall = FirewallRules
+	}
+}
+
+// Validate checks the policies.
+func (c *Config) Validate() error {
+	if c.Swap != SwapDisable && c.Swap != SwapKeep {
+		return fmt.Errorf("unsupported swap policy %q", c.Swap)
+	}
+	switch c.SELinux {
+	case SELinuxPermissive, SELinuxEnforcing, SELinuxKeep:
+	default:
+		return fmt.Errorf("unsupported SELinux policy %q", c.SELinux)
+	}
+	switch c.Firewall {
+	case FirewallDisable, FirewallRules, FirewallKeep:
+	default:
+		return fmt.Errorf("unsupported firewall policy %q", c.Firewall)
+	}
+	for _, p := range c.ExtraPorts {
+		if err := validatePort(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validatePort(p string) error {
+	ports, proto, ok := strings.Cut(p, "/")
+	if !ok || (proto != "tcp" && proto != "udp") || ports == "" || strings.Trim(ports, "0123456789-") != "" {
+		return fmt.Errorf("invalid port %q (want <port>[-<port>]/tcp|udp)", p)
+	}
+	return nil
+}
+
+// RequiredPorts returns the ports a host with the given roles must accept.
+func RequiredPorts(host connector.Host, extra []string) []string {
+	set := map[string]bool{"10250/tcp": true}
+	if host.IsRole(common.RoleControlPlane) {
+		for _, p := range []string{"6443/tcp", "10257/tcp", "10259/tcp"} {
+			set[p] = true
+		}
+	}
+	if host.IsRole(common.RoleEtcd) {
+		set["2379-2380/tcp"] = true
+	}
+	if host.IsRole(common.RoleWorker) {
+		set["30000-32767/tcp"] = true
+	}
+	for _, p := range extra {
+		set[p] = true
+	}
+	ports := make([]string, 0, len(set))
+	for p := range set {
+		ports = append(ports, p)
+	}
+	sort.Strings(ports)
+	return ports
+}
+
+// SwapCommands returns the commands enforcing the swap policy.
+func SwapCommands(policy string) []string {
+	if policy != SwapDisable {
+		return nil
+	}
+	return []string{
+		"swapoff -a",
+		`sed -ri '/^[^#].*\sswap\s/s/^/#/' /etc/fstab`,
+	}
+}
+
+// SELinuxCommands returns the commands enforcing the SELinux policy on a host
+// where SELinux is present.
+func SELinuxCommands(policy string) []string {
+	switch policy {
+	case SELinuxPermissive:
+		return []string{
+			"setenforce 0 || true",
+			"sed -ri 's/^SELINUX=.*/SELINUX=permissive/' /etc/selinux/config",
+		}
+	case SELinuxEnforcing:
+		cmds := []string{
+			"setenforce 1",
+			"sed -ri 's/^SELINUX=.*/SELINUX=enforcing/' /etc/selinux/config",
+		}
+		for _, dir := range selinuxContainerDirs {
+			cmds = append(cmds,
+				fmt.Sprintf("mkdir -p %s", dir),
+				fmt.Sprintf("semanage fcontext -a -t container_file_t '%s(/.*)?' 2>/dev/null || semanage fcontext -m -t container_file_t '%s(/.*)?'", dir, dir),
+				fmt.Sprintf("restorecon -R %s", dir),
+			)
+		}
+		return cmds
+	default:
+		return nil
+	}
+}
+
+// Firewall tools.
+const (
+	firewalld = "firewalld"
+	ufw       = "ufw"
+)
+
+// FirewallCommands returns the commands enforcing the firewall policy for the given tool.
+func FirewallCommands(policy, tool string, ports []string) []string {
+	switch policy {
+	case FirewallDisable:
+		if tool == firewalld {
+			return []string{"systemctl disable --now firewalld"}
+		}
+		return []string{"ufw disable"}
+	case FirewallRules:
+		var cmds []string
+		for _, p := range ports {
+			if tool == firewalld {
+				cmds = append(cmds, "firewall-cmd --permanent --add-port="+p)
+			} else {
+				cmds = append(cmds, "ufw allow "+strings.Replace(p, "-", ":", 1))
+			}
+		}
+		if tool == firewalld {
+			cmds = append(cmds, "firewall-cmd --permanent --add-masquerade", "firewall-cmd --reload")
+		}
+		return cmds
+	default:
+		return nil
+	}
+}
+
+// Result reports what was done on one node for each policy.
+type Result struct {
+	Node     string
+	Swap     string
+	SELinux  string
+	Firewall string
+	Err      error
+}
+
+// Apply enforces the policies on node.
+func Apply(ctx context.Context, node modules.Node, cfg Config) Result {
+	res := Result{Node: node.Name(), Swap: "unchanged", SELinux: "unchanged", Firewall: "unchanged"}
+
+	if cmds := SwapCommands(cfg.Swap); len(cmds) > 0 {
+		if res.Err = modules.RunAll(ctx, node.Conn, cmds...); res.Err != nil {
+			return res
+		}
+		res.Swap = "disabled"
+	}
+
+	if cfg.SELinux != SELinuxKeep {
+		present, err := modules.Succeeds(ctx, node.Conn, "command -v getenforce && test -f /etc/selinux/config")
+		if err != nil {
+			res.Err = err
+			return res
+		}
+		if !present {
+			res.SELinux = "not present"
+		} else {
+			if res.Err = modules.RunAll(ctx, node.Conn, SELinuxCommands(cfg.SELinux)...); res.Err != nil {
+				return res
+			}
+			res.SELinux = cfg.SELinux
+		}
+	}
+
+	if cfg.Firewall != FirewallKeep {
+		tool, err := activeFirewall(ctx, node)
+		if err != nil {
+			res.Err = err
+			return res
+		}
+		if tool == "" {
+			res.Firewall = "not active"
+			return res
+		}
+		ports := RequiredPorts(node.Host, cfg.ExtraPorts)
+		if res.Err = modules.RunAll(ctx, node.Conn, FirewallCommands(cfg.Firewall, tool, ports)...); res.Err != nil {
+			return res
+		}
+		if cfg.Firewall == FirewallDisable {
+			res.Firewall = tool + " disabled"
+		} else {
+			res.Firewall = fmt.Sprintf("%s: opened %s", tool, strings.Join(ports, ", "))
+		}
+	}
+	return res
+}
+
+func activeFirewall(ctx context.Context, node modules.Node) (string, error) {
+	if ok, err := modules.Succeeds(ctx, node.Conn, "systemctl is-active --quiet firewalld"); err != nil || ok {
+		return firewalld, err
+	}
+	if ok, err := modules.Succeeds(ctx, node.Conn, "ufw status | grep -q 'Status: active'"); err != nil || ok {
+		return ufw, err
+	}
+	return "", nil
+}
+
+// Deploy applies the policies on all nodes and returns one result per node,
+// sorted by node name, together with the joined errors.
+func Deploy(ctx context.Context, nodes []modules.Node, cfg Config) ([]Result, error) {
+	cfg.SetDefaults()
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	var mu sync.Mutex
+	results := make([]Result, 0, len(nodes))
+	err := modules.ForEach(ctx, nodes, func(ctx context.Context, node modules.Node) error {
+		res := Apply(ctx, node, cfg)
+		mu.Lock()
+		results = append(results, res)
+		mu.Unlock()
+		if res.Err == nil {
+			logger.Log.InfofModule(moduleName, "%s: swap %s, selinux %s, firewall %s", res.Node, res.Swap, res.SELinux, res.Firewall)
+		}
+		return res.Err
+	})
+	sort.Slice(results, func(i, j int) bool { return results[i].Node < results[j].Node })
+	return results, err
+}
@@ -0,0 +1,61 @@
+package nodeprep
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mensylisir/xmcores/common"
+	"github.com/mensylisir/xmcores/connector"
+)
+
+func TestConfigValidate(t *testing.T) {
+	cfg := Config{}
+	cfg.SetDefaults()
+	require.NoError(t, cfg.Validate())
+	assert.Equal(t, SwapDisable, cfg.Swap)
+	assert.Equal(t, SELinuxPermissive, cfg.SELinux)
+	assert.Equal(t, FirewallRules, cfg.Firewall)
+
+	for _, bad := range []Config{
+		{Swap: "off", SELinux: SELinuxKeep, Firewall: FirewallKeep},
+		{Swap: SwapKeep, SELinux: "disabled", Firewall: FirewallKeep},
+		{Swap: SwapKeep, SELinux: SELinuxKeep, Firewall: "iptables"},
+		{Swap: SwapKeep, SELinux: SELinuxKeep, Firewall: FirewallRules, ExtraPorts: []string{"179"}},
+		{Swap: SwapKeep, SELinux: SELinuxKeep, Firewall: FirewallRules, ExtraPorts: []string{"179/sctp"}},
+	} {
+		assert.Error(t, bad.Validate(), "%+v", bad)
+	}
+}
+
+func TestRequiredPorts(t *testing.T) {
+	h := connector.NewHost()
+	h.SetRoles([]string{common.RoleControlPlane, common.RoleEtcd})
+	assert.Equal(t, []string{"10250/tcp", "10257/tcp", "10259/tcp", "2379-2380/tcp", "6443/tcp"}, RequiredPorts(h, nil))
+
+	w := connector.NewHost()
+	w.SetRoles([]string{common.RoleWorker})
+	assert.Equal(t, []string{"10250/tcp", "30000-32767/tcp", "4789/udp"}, RequiredPorts(w, []string{"4789/udp"}))
+}
+
+func TestCommands(t *testing.T) {
+	assert.Len(t, SwapCommands(SwapDisable), 2)
+	assert.Empty(t, SwapCommands(SwapKeep))
+
+	assert.Contains(t, SELinuxCommands(SELinuxPermissive), "setenforce 0 || true")
+	enforcing := SELinuxCommands(SELinuxEnforcing)
+	assert.Contains(t, enforcing, "restorecon -R /var/lib/etcd")
+	assert.Empty(t, SELinuxCommands(SELinuxKeep))
+
+	ports := []string{"10250/tcp", "30000-32767/tcp"}
+	assert.Equal(t, []string{
+		"firewall-cmd --permanent --add-port=10250/tcp",
+		"firewall-cmd --permanent --add-port=30000-32767/tcp",
+		"firewall-cmd --permanent --add-masquerade",
+		"firewall-cmd --reload",
+	}, FirewallCommands(FirewallRules, firewalld, ports))
+	assert.Equal(t, []string{"ufw allow 10250/tcp", "ufw allow 30000:32767/tcp"}, FirewallCommands(FirewallRules, ufw, ports))
+	assert.Equal(t, []string{"ufw disable"}, FirewallCommands(FirewallDisable, ufw, ports))
+	assert.Empty(t, FirewallCommands(FirewallKeep, ufw, ports))
+}
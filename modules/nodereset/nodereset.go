@@ -0,0 +1,104 @@
+// Package nodereset cleans a node of everything Kubernetes left on it, so that
+// a botched node can be added again without reimaging: kubeadm reset, the
+// mounts of the kubelet, the network interfaces of the CNI plugins, the
+// iptables rules and IPVS services of kube-proxy and the CNI plugins, and the
+// state directories. The containerd and kubelet installations are kept unless
+// asked otherwise. The Node object, if the node was registered, is left in
+// the cluster.
+package nodereset
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/mensylisir/xmcores/facts"
+	"github.com/mensylisir/xmcores/logger"
+	"github.com/mensylisir/xmcores/modules"
+	"github.com/mensylisir/xmcores/modules/existing"
+	"github.com/mensylisir/xmcores/shellquote"
+)
+
+const moduleName = "NodeReset"
+
+// StateDirs are the directories deleted from the node.
+var StateDirs = []string{
+	"/etc/kubernetes",
+	"/var/lib/etcd",
+	"/var/lib/kubelet",
+	"/var/lib/cni",
+	"/etc/cni/net.d",
+	"/run/flannel",
+	"/run/calico",
+	"/var/run/kubernetes",
+}
+
+// interfacePattern matches the network interfaces the CNI plugins and
+// kube-proxy in IPVS mode create.
+const interfacePattern = `^(cni0|flannel\.|cali|vxlan\.calico|tunl0|cilium_|lxc|kube-ipvs0|kube-bridge|nodelocaldns|weave|vxlan-)`
+
+// rulePattern matches the iptables rules and chains of kube-proxy and the CNI
+// plugins.
+const rulePattern = `KUBE-|CNI-|cali-|cali:|FLANNEL|CILIUM|WEAVE`
+
+// Commands run in order on the node, each failing the reset.
+var Commands = []string{
+	"if command -v kubeadm >/dev/null 2>&1; then kubeadm reset -f; fi",
+	"{ systemctl stop kubelet || rc-service kubelet stop; } >/dev/null 2>&1 || true",
+	// kubeadm reset leaves the volumes of pods the kubelet could not clean.
+	`awk '$2 ~ "^/var/lib/kubelet/" {print $2}' /proc/mounts | sort -r | while read -r m; do umount -l "$m"; done`,
+	`ip -o link show | awk -F': ' '{print $2}' | cut -d@ -f1 | grep -E '` + interfacePattern + `' | while read -r i; do ip link delete "$i" 2>/dev/null || true; done`,
+	`for t in iptables ip6tables; do if command -v $t-save >/dev/null 2>&1; then $t-save | grep -v -E '` + rulePattern + `' | $t-restore; fi; done`,
+	"if command -v ipvsadm >/dev/null 2>&1; then ipvsadm --clear; fi",
+}
+
+// Options control what is cleaned.
+type Options struct {
+	// Uninstall also removes the containerd and kubelet installations, see
+	// existing.RemoveCommands.
+	Uninstall bool
+}
+
+// Node resets node.
+func Node(ctx context.Context, node modules.Node, opts Options) error {
+	logger.Log.InfofModule(moduleName, "%s: resetting", node.Name())
+	if err := modules.RunAll(ctx, node.Conn, Commands...); err != nil {
+		return err
+	}
+	if _, err := modules.Run(ctx, node.Conn, shellquote.Join(append([]string{"rm", "-rf"}, StateDirs...)...)); err != nil {
+		return err
+	}
+	if opts.Uninstall {
+		if err := uninstall(ctx, node); err != nil {
+			return err
+		}
+	}
+	logger.Log.InfofModule(moduleName, "%s: reset", node.Name())
+	return nil
+}
+
+// uninstall removes the components installed on node.
+func uninstall(ctx context.Context, node modules.Node) error {
+	out, err := modules.Run(ctx, node.Conn, facts.ComponentsCommand)
+	if err != nil {
+		return err
+	}
+	components := facts.ParseComponents(out)
+	if len(components) == 0 {
+		return nil
+	}
+	rel, err := facts.DetectOSRelease(ctx, node.Conn)
+	if err != nil {
+		return err
+	}
+	for _, c := range components {
+		cmds, err := existing.RemoveCommands(rel.PackageManager(), rel.InitSystem(), c)
+		if err != nil {
+			return err
+		}
+		if err := modules.RunAll(ctx, node.Conn, cmds...); err != nil {
+			return fmt.Errorf("failed to uninstall %s: %w", c.Name, err)
+		}
+		logger.Log.InfofModule(moduleName, "%s: uninstalled %s", node.Name(), c.Name)
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package nodereset
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mensylisir/xmcores/connector"
+	"github.com/mensylisir/xmcores/connector/connectortest"
+	"github.com/mensylisir/xmcores/errs"
+	"github.com/mensylisir/xmcores/modules"
+)
+
+func node(fake *connectortest.Fake) modules.Node {
+	h := connector.NewHost()
+	h.SetName("worker1")
+	return modules.Node{Host: h, Conn: fake}
+}
+
+func TestNode(t *testing.T) {
+	ctx := context.Background()
+	fake := connectortest.NewFake()
+	require.NoError(t, Node(ctx, node(fake), Options{}))
+	assert.True(t, fake.Ran(`kubeadm reset -f`))
+	assert.True(t, fake.Ran(`ip link delete`))
+	assert.True(t, fake.Ran(`for t in iptables ip6tables; .*-save \| grep -v -E .*KUBE-`))
+	assert.True(t, fake.Ran(`ipvsadm --clear`))
+	assert.True(t, fake.Ran(`rm -rf /etc/kubernetes /var/lib/etcd /var/lib/kubelet `))
+	assert.False(t, fake.Ran(`command -v \$c`), "the installations are kept")
+
+	fake = connectortest.NewFake().
+		On(`command -v \$c`, connectortest.Result{Stdout: "binary\tcontainerd\t/usr/local/bin/containerd\tactive\t\tcontainerd github.com/containerd/containerd v1.7.13 7c3aca7\n" +
+			"binary\tkubelet\t/usr/bin/kubelet\tinactive\tkubelet\tKubernetes v1.30.2\n"}).
+		On(`cat /etc/os-release`, connectortest.Result{Stdout: "ID=rocky\nID_LIKE=\"rhel centos fedora\"\nVERSION_ID=\"9.3\"\n"})
+	require.NoError(t, Node(ctx, node(fake), Options{Uninstall: true}))
+	assert.True(t, fake.Ran(`dnf remove -y kubelet`))
+	assert.True(t, fake.Ran(`rm -rf /usr/local/bin/containerd /etc/systemd/system/containerd\.service`))
+
+	fake = connectortest.NewFake().On(`kubeadm reset`, connectortest.Result{Stderr: "unable to reset", ExitCode: 1})
+	err := Node(ctx, node(fake), Options{})
+	assert.Equal(t, errs.Execution, errs.KindOf(err))
+	assert.False(t, fake.Ran(`rm -rf /etc/kubernetes`), "nothing is deleted after a failure")
+}
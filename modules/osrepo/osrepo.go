@@ -0,0 +1,349 @@
+// Package osrepo hosts an offline OS package repository on one node and points
+// every node's package manager at it, so package installation works without
+// internet access.
+package osrepo
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/mensylisir/xmcores/common"
+	"github.com/mensylisir/xmcores/facts"
+	"github.com/mensylisir/xmcores/file"
+	"github.com/mensylisir/xmcores/logger"
+	"github.com/mensylisir/xmcores/modules"
+	"github.com/mensylisir/xmcores/shellquote"
+)
+
+const moduleName = "OSRepository"
+
+// Repository formats.
+const (
+	TypeDeb = "deb"
+	TypeRPM = "rpm"
+)
+
+// Ways of serving the repository.
+const (
+	ServeNginx = "nginx"
+	ServeHTTPD = "httpd"
+	// ServeFile skips the web server: every node receives its own copy and uses a file:// repo.
+	ServeFile = "file"
+)
+
+const (
+	DefaultRemoteDir = "/opt/xmcores/repo"
+	DefaultPort      = 8080
+	repoName         = "xmcores-offline"
+)
+
+// Config describes the offline repository.
+type Config struct {
+	// LocalPath is a directory on the controller containing the repository mirror
+	// (a flat deb repo with Packages.gz, or an rpm repo with repodata/).
+	LocalPath string `yaml:"localPath,omitempty" json:"localPath,omitempty"`
+	// Type is deb or rpm. When empty it is derived from the node's package manager.
+	Type string `yaml:"type,omitempty" json:"type,omitempty"`
+	// Serve is nginx, httpd or file. Defaults to nginx.
+	Serve string `yaml:"serve,omitempty" json:"serve,omitempty"`
+	// Port the web server listens on. Defaults to DefaultPort.
+	Port int `yaml:"port,omitempty" json:"port,omitempty"`
+	// RemoteDir is where the repository is unpacked on the serving node(s).
+	RemoteDir string `yaml:"remoteDir,omitempty" json:"remoteDir,omitempty"`
+	// DisableOtherRepos moves existing repo definitions aside so only the offline repo is used.
+	DisableOtherRepos bool `yaml:"disableOtherRepos,omitempty" json:"disableOtherRepos,omitempty"`
+	// Distribution is how the repository reaches every node in file mode:
+	// direct (the default) or p2p, see modules.Distribute.
+	Distribution string `yaml:"distribution,omitempty" json:"distribution,omitempty"`
+}
+
+// SetDefaults fills unset fields.
+func (c *Config) SetDefaults() {
+	if c.Serve == "" {
+		c.Serve = ServeNginx
+	}
+	if c.Port == 0 {
+		c.Port = DefaultPort
+	}
+	if c.RemoteDir == "" {
+		c.RemoteDir = DefaultRemoteDir
+	}
+}
+
+// Validate checks the configuration.
+func (c *Config) Validate() error {
+	if c.LocalPath == "" {
+		return fmt.Errorf("repository local path must be set")
+	}
+	if isDir, err := file.IsDir(c.LocalPath); err != nil || !isDir {
+		return fmt.Errorf("repository local path %s is not a directory", c.LocalPath)
+	}
+	switch c.Type {
+	case "", TypeDeb, TypeRPM:
+	default:
+		return fmt.Errorf("unsupported repository type %q (want %s or %s)", c.Type, TypeDeb, TypeRPM)
+	}
+	switch c.Serve {
+	case ServeNginx, ServeHTTPD, ServeFile:
+	default:
+		return fmt.Errorf("unsupported serve mode %q (want %s, %s or %s)", c.Serve, ServeNginx, ServeHTTPD, ServeFile)
+	}
+	if c.Port <= 0 || c.Port > 65535 {
+		return fmt.Errorf("invalid repository port %d", c.Port)
+	}
+	if !path.IsAbs(c.RemoteDir) {
+		return fmt.Errorf("repository remote dir %s must be absolute", c.RemoteDir)
+	}
+	return modules.ValidateDistribution(c.Distribution)
+}
+
+// BaseURL returns the URL nodes use to reach the repository served by server.
+func (c *Config) BaseURL(server modules.Node) string {
+	if c.Serve == ServeFile {
+		return "file://" + c.RemoteDir
+	}
+	addr := server.Host.GetInternalIPv4Address()
+	if addr == "" {
+		addr = server.Host.GetAddress()
+	}
+	return "http://" + net.JoinHostPort(addr, strconv.Itoa(c.Port))
+}
+
+// RepoFile returns the path and content of the package manager repo definition
+// pointing at baseURL.
+func RepoFile(repoType, baseURL string) (string, string, error) {
+	switch repoType {
+	case TypeDeb:
+		return "/etc/apt/sources.list.d/" + repoName + ".list",
+			fmt.Sprintf("deb [trusted=yes] %s ./\n", baseURL), nil
+	case TypeRPM:
+		return "/etc/yum.repos.d/" + repoName + ".repo",
+			fmt.Sprintf("[%s]\nname=xmcores offline repository\nbaseurl=%s\nenabled=1\ngpgcheck=0\n", repoName, baseURL), nil
+	default:
+		return "", "", fmt.Errorf("unsupported repository type %q", repoType)
+	}
+}
+
+// ServerConfig returns the path and content of the web server site serving dir on port.
+func ServerConfig(serve, dir string, port int) (string, string, error) {
+	switch serve {
+	case ServeNginx:
+		return "/etc/nginx/conf.d/" + repoName + ".conf", fmt.Sprintf(`server {
+    listen %d;
+    root %s;
+    autoindex on;
+    location / {
+        try_files $uri $uri/ =404;
+    }
+}
+`, port, dir), nil
+	case ServeHTTPD:
+		return "/etc/httpd/conf.d/" + repoName + ".conf", fmt.Sprintf(`Listen %d
+<VirtualHost *:%d>
+    DocumentRoot "%s"
+    <Directory "%s">
+        Options +Indexes
+        Require all granted
+    </Directory>
+</VirtualHost>
+`, port, port, dir, dir), nil
+	default:
+		return "", "", fmt.Errorf("serve mode %q has no server configuration", serve)
+	}
+}
+
+// repoType returns the configured type or derives it from the node's OS.
+func (c *Config) repoType(ctx context.Context, node modules.Node) (string, error) {
+	if c.Type != "" {
+		return c.Type, nil
+	}
+	rel, err := facts.DetectOSRelease(ctx, node.Conn)
+	if err != nil {
+		return "", err
+	}
+	switch rel.PackageManager() {
+	case facts.PackageManagerApt:
+		return TypeDeb, nil
+	case facts.PackageManagerYum, facts.PackageManagerDnf:
+		return TypeRPM, nil
+	default:
+		return "", fmt.Errorf("no offline repository support for %s", rel.Pretty)
+	}
+}
+
+// Upload packs the local repository, copies it to node and unpacks it under RemoteDir.
+func Upload(ctx context.Context, node modules.Node, cfg Config) error {
+	return upload(ctx, []modules.Node{node}, cfg)
+}
+
+// upload is Upload for several nodes, which share one tarball distributed as
+// cfg.Distribution selects.
+func upload(ctx context.Context, nodes []modules.Node, cfg Config) error {
+	tmpDir, err := os.MkdirTemp("", "xmcores-repo-")
+	if err != nil {
+		return fmt.Errorf("failed to create temp dir: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	tarball := filepath.Join(tmpDir, "repo.tar.gz")
+	if err := file.Tar(cfg.LocalPath, tarball, cfg.LocalPath); err != nil {
+		return fmt.Errorf("failed to pack repository %s: %w", cfg.LocalPath, err)
+	}
+	remoteTarball := path.Join(common.GetTmpDir(), "repo.tar.gz")
+	if err := modules.ForEach(ctx, nodes, func(ctx context.Context, node modules.Node) error {
+		if err := checkSpace(ctx, node, cfg, tarball, remoteTarball); err != nil {
+			return err
+		}
+		modules.TrackTemp(ctx, node, remoteTarball)
+		return nil
+	}); err != nil {
+		return err
+	}
+	if err := modules.Distribute(ctx, nodes, tarball, remoteTarball, cfg.Distribution); err != nil {
+		return fmt.Errorf("failed to upload repository: %w", err)
+	}
+	return modules.ForEach(ctx, nodes, func(ctx context.Context, node modules.Node) error {
+		if err := modules.RunAll(ctx, node.Conn,
+			fmt.Sprintf(common.MkdirCmdTpl, cfg.RemoteDir),
+			fmt.Sprintf(common.UntarCmdTpl, remoteTarball, cfg.RemoteDir),
+			"rm -f "+remoteTarball,
+		); err != nil {
+			return err
+		}
+		modules.UntrackTemp(ctx, node, remoteTarball)
+		return nil
+	})
+}
+
+// checkSpace makes sure node has room for the tarball and for its extracted
+// content, before anything is copied.
+func checkSpace(ctx context.Context, node modules.Node, cfg Config, tarball, remoteTarball string) error {
+	info, err := os.Stat(tarball)
+	if err != nil {
+		return err
+	}
+	var size, files int64
+	if err := filepath.WalkDir(cfg.LocalPath, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		files++
+		if d.Type().IsRegular() {
+			fi, err := d.Info()
+			if err != nil {
+				return err
+			}
+			size += fi.Size()
+		}
+		return nil
+	}); err != nil {
+		return fmt.Errorf("failed to measure repository %s: %w", cfg.LocalPath, err)
+	}
+	if err := modules.CheckSpace(ctx, node, path.Dir(remoteTarball), info.Size(), 1); err != nil {
+		return err
+	}
+	// Both usually share a file system, where the tarball is still present
+	// while it is extracted.
+	return modules.CheckSpace(ctx, node, cfg.RemoteDir, size+info.Size(), files+1)
+}
+
+// Serve uploads the repository to server and exposes it over HTTP. The web server
+// must already be installed on server; use ServeFile when no node has one.
+func Serve(ctx context.Context, server modules.Node, cfg Config) error {
+	if ok, err := modules.Succeeds(ctx, server.Conn, "command -v "+shellquote.Quote(cfg.Serve)); err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("%s is not installed on %s; install it or use serve mode %q", cfg.Serve, server.Name(), ServeFile)
+	}
+	logger.Log.InfofModule(moduleName, "uploading repository to %s", server.Name())
+	if err := Upload(ctx, server, cfg); err != nil {
+		return err
+	}
+	confPath, conf, err := ServerConfig(cfg.Serve, cfg.RemoteDir, cfg.Port)
+	if err != nil {
+		return err
+	}
+	if err := modules.WriteFile(ctx, server.Conn, []byte(conf), confPath, common.FileMode0644); err != nil {
+		return err
+	}
+	return modules.RunAll(ctx, server.Conn,
+		fmt.Sprintf("systemctl enable %[1]s && systemctl restart %[1]s", shellquote.Quote(cfg.Serve)),
+		fmt.Sprintf("curl -fsS -o /dev/null http://127.0.0.1:%d/", cfg.Port),
+	)
+}
+
+// Configure points the package manager of node at baseURL and refreshes its metadata.
+func Configure(ctx context.Context, node modules.Node, cfg Config, baseURL string) error {
+	repoType, err := cfg.repoType(ctx, node)
+	if err != nil {
+		return err
+	}
+	repoPath, content, err := RepoFile(repoType, baseURL)
+	if err != nil {
+		return err
+	}
+
+	var cmds []string
+	if cfg.DisableOtherRepos {
+		cmds = append(cmds, disableReposCmd(repoType))
+	}
+	if err := modules.RunAll(ctx, node.Conn, cmds...); err != nil {
+		return err
+	}
+	if err := modules.WriteFile(ctx, node.Conn, []byte(content), repoPath, common.FileMode0644); err != nil {
+		return err
+	}
+	if repoType == TypeDeb {
+		return modules.RunAll(ctx, node.Conn, "apt-get update")
+	}
+	return modules.RunAll(ctx, node.Conn, "yum clean all && yum makecache")
+}
+
+func disableReposCmd(repoType string) string {
+	backup := "/etc/xmcores/repo-backup"
+	if repoType == TypeDeb {
+		return strings.Join([]string{
+			"mkdir -p " + backup,
+			"if [ -f /etc/apt/sources.list ]; then mv -f /etc/apt/sources.list " + backup + "/; fi",
+			"find /etc/apt/sources.list.d -maxdepth 1 -type f ! -name '" + repoName + ".list' -exec mv -f -t " + backup + " {} +",
+		}, " && ")
+	}
+	return strings.Join([]string{
+		"mkdir -p " + backup,
+		"find /etc/yum.repos.d -maxdepth 1 -name '*.repo' ! -name '" + repoName + ".repo' -exec mv -f -t " + backup + " {} +",
+	}, " && ")
+}
+
+// Deploy serves the repository from server (or copies it to every node in file
+// mode) and configures all nodes to use it. It must run before any package
+// installation step.
+func Deploy(ctx context.Context, server modules.Node, nodes []modules.Node, cfg Config) error {
+	cfg.SetDefaults()
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	if cfg.Serve == ServeFile {
+		if err := upload(ctx, nodes, cfg); err != nil {
+			return err
+		}
+		return modules.ForEach(ctx, nodes, func(ctx context.Context, node modules.Node) error {
+			return Configure(ctx, node, cfg, cfg.BaseURL(node))
+		})
+	}
+
+	if err := Serve(ctx, server, cfg); err != nil {
+		return fmt.Errorf("%s: %w", server.Name(), err)
+	}
+	baseURL := cfg.BaseURL(server)
+	logger.Log.InfofModule(moduleName, "configuring %d nodes to use %s", len(nodes), baseURL)
+	return modules.ForEach(ctx, nodes, func(ctx context.Context, node modules.Node) error {
+		return Configure(ctx, node, cfg, baseURL)
+	})
+}
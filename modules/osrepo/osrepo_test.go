@@ -0,0 +1,83 @@
+package osrepo
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mensylisir/xmcores/connector"
+	"github.com/mensylisir/xmcores/modules"
+)
+
+func TestConfigValidate(t *testing.T) {
+	dir := t.TempDir()
+	cfg := Config{LocalPath: dir}
+	cfg.SetDefaults()
+	require.NoError(t, cfg.Validate())
+	assert.Equal(t, ServeNginx, cfg.Serve)
+	assert.Equal(t, DefaultPort, cfg.Port)
+
+	bad := cfg
+	bad.Type = "apk"
+	assert.Error(t, bad.Validate())
+
+	bad = cfg
+	bad.Serve = "caddy"
+	assert.Error(t, bad.Validate())
+
+	bad = cfg
+	bad.RemoteDir = "relative/repo"
+	assert.Error(t, bad.Validate())
+
+	bad = cfg
+	bad.LocalPath = dir + "/missing"
+	assert.Error(t, bad.Validate())
+}
+
+func TestBaseURL(t *testing.T) {
+	host := connector.NewHost()
+	host.SetAddress("203.0.113.10")
+	server := modules.Node{Host: host}
+
+	cfg := Config{Serve: ServeNginx, Port: 8080, RemoteDir: DefaultRemoteDir}
+	assert.Equal(t, "http://203.0.113.10:8080", cfg.BaseURL(server))
+
+	host.SetInternalAddresses("10.0.0.5", "fd00::5")
+	assert.Equal(t, "http://10.0.0.5:8080", cfg.BaseURL(server))
+
+	cfg.Serve = ServeFile
+	assert.Equal(t, "file:///opt/xmcores/repo", cfg.BaseURL(server))
+}
+
+func TestRepoFile(t *testing.T) {
+	path, content, err := RepoFile(TypeDeb, "http://10.0.0.5:8080")
+	require.NoError(t, err)
+	assert.Equal(t, "/etc/apt/sources.list.d/xmcores-offline.list", path)
+	assert.Equal(t, "deb [trusted=yes] http://10.0.0.5:8080 ./\n", content)
+
+	path, content, err = RepoFile(TypeRPM, "file:///opt/xmcores/repo")
+	require.NoError(t, err)
+	assert.Equal(t, "/etc/yum.repos.d/xmcores-offline.repo", path)
+	assert.Contains(t, content, "baseurl=file:///opt/xmcores/repo\n")
+	assert.Contains(t, content, "gpgcheck=0")
+
+	_, _, err = RepoFile("apk", "")
+	assert.Error(t, err)
+}
+
+func TestServerConfig(t *testing.T) {
+	path, conf, err := ServerConfig(ServeNginx, "/opt/repo", 8081)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(path, "/etc/nginx/conf.d/"))
+	assert.Contains(t, conf, "listen 8081;")
+	assert.Contains(t, conf, "root /opt/repo;")
+
+	_, conf, err = ServerConfig(ServeHTTPD, "/opt/repo", 8081)
+	require.NoError(t, err)
+	assert.Contains(t, conf, "Listen 8081")
+
+	_, _, err = ServerConfig(ServeFile, "/opt/repo", 8081)
+	assert.Error(t, err)
+}
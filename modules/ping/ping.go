@@ -0,0 +1,140 @@
+// Package ping checks that the hosts of a configuration can be worked on
+// before a long run: that each accepts the SSH login, which authentication
+// method it took, whether the user may use sudo and which OS it runs. Unlike
+// modules.ConnectWith, every host is probed and reported, reachable or not.
+package ping
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mensylisir/xmcores/connector"
+	"github.com/mensylisir/xmcores/facts"
+	"github.com/mensylisir/xmcores/modules"
+)
+
+// Sudo capabilities, see Status.Sudo.
+const (
+	// SudoNoPassword means sudo runs without a password (NOPASSWD).
+	SudoNoPassword = "nopasswd"
+	// SudoPassword means sudo asks for the password, which xm answers with
+	// the login password of the host.
+	SudoPassword = "password"
+	// SudoUnavailable means the user cannot run commands with sudo.
+	SudoUnavailable = "unavailable"
+)
+
+// Status is the outcome of probing a host.
+type Status struct {
+	Node    string `json:"node"`
+	Address string `json:"address"`
+	// Reachable is true once the login succeeded.
+	Reachable bool `json:"reachable"`
+	// Latency is how long connecting and logging in took.
+	Latency time.Duration `json:"latency"`
+	// Auth is the authentication method the login took (see the
+	// connector.Auth* constants), empty when the connection does not tell.
+	Auth string `json:"auth,omitempty"`
+	Sudo string `json:"sudo,omitempty"`
+	// OS is the pretty name of the distribution, or its ID and version.
+	OS     string   `json:"os,omitempty"`
+	Errors []string `json:"errors,omitempty"`
+}
+
+// OK reports whether the host can be worked on.
+func (s Status) OK() bool {
+	return s.Reachable && s.Sudo != SudoUnavailable && len(s.Errors) == 0
+}
+
+// Probe connects to host with dial and inspects it.
+func Probe(ctx context.Context, host connector.Host, dial modules.Dialer) Status {
+	s := Status{Node: host.GetName(), Address: host.GetAddress()}
+	start := time.Now()
+	conn, err := dial(host)
+	s.Latency = time.Since(start).Round(time.Millisecond)
+	if err != nil {
+		s.Errors = append(s.Errors, err.Error())
+		return s
+	}
+	defer conn.Close()
+	s.Reachable = true
+	if r, ok := conn.(connector.AuthReporter); ok {
+		s.Auth = r.AuthMethod()
+	}
+
+	if s.Sudo, err = sudo(ctx, conn); err != nil {
+		s.Errors = append(s.Errors, err.Error())
+	}
+	rel, err := facts.DetectOSRelease(ctx, conn)
+	if err != nil {
+		s.Errors = append(s.Errors, err.Error())
+	} else if s.OS = rel.Pretty; s.OS == "" {
+		s.OS = strings.TrimSpace(rel.ID + " " + rel.VersionID)
+	}
+	return s
+}
+
+// sudo finds out whether, and how, the user of conn may use sudo.
+func sudo(ctx context.Context, conn connector.Connection) (string, error) {
+	p, prober := conn.(connector.SudoProber)
+	if prober {
+		nopass, err := p.SudoNoPassword(ctx)
+		if err != nil {
+			return "", err
+		}
+		if nopass {
+			return SudoNoPassword, nil
+		}
+	}
+	// Run through sudo, answering the password prompt when the host has a
+	// password.
+	ok, err := modules.Succeeds(ctx, conn, "true")
+	switch {
+	case errors.Is(err, connector.ErrSudoPasswordRequired):
+		return SudoUnavailable, nil
+	case err != nil:
+		return "", err
+	case !ok:
+		return SudoUnavailable, nil
+	case prober:
+		return SudoPassword, nil
+	}
+	return SudoNoPassword, nil
+}
+
+// ProbeAll probes hosts concurrently and returns their statuses in the
+// order of hosts.
+func ProbeAll(ctx context.Context, hosts []connector.Host, dial modules.Dialer) []Status {
+	statuses := make([]Status, len(hosts))
+	nodes := make([]modules.Node, len(hosts))
+	index := make(map[string]int, len(hosts))
+	for i, h := range hosts {
+		nodes[i].Host = h
+		index[h.GetName()] = i
+	}
+	// Probe reports its errors in the status, so ForEach never fails.
+	_ = modules.ForEach(ctx, nodes, func(ctx context.Context, node modules.Node) error {
+		statuses[index[node.Name()]] = Probe(ctx, node.Host, dial)
+		return nil
+	})
+	return statuses
+}
+
+// Check fails unless every host can be worked on.
+func Check(statuses []Status) error {
+	var errList []error
+	for _, s := range statuses {
+		switch {
+		case !s.Reachable:
+			errList = append(errList, fmt.Errorf("%s: unreachable: %s", s.Node, strings.Join(s.Errors, "; ")))
+		case len(s.Errors) > 0:
+			errList = append(errList, fmt.Errorf("%s: %s", s.Node, strings.Join(s.Errors, "; ")))
+		case s.Sudo == SudoUnavailable:
+			errList = append(errList, fmt.Errorf("%s: user cannot run commands with sudo", s.Node))
+		}
+	}
+	return errors.Join(errList...)
+}
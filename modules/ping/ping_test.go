@@ -0,0 +1,64 @@
+package ping
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mensylisir/xmcores/connector"
+	"github.com/mensylisir/xmcores/connector/connectortest"
+)
+
+func host(name string) connector.Host {
+	h := connector.NewHost()
+	h.SetName(name)
+	h.SetAddress("10.0.0.1")
+	return h
+}
+
+func TestProbeAll(t *testing.T) {
+	fakes := connectortest.NewConnector()
+	fakes.Host("ok").On(`cat /etc/os-release`, connectortest.Result{Stdout: "ID=alpine\nVERSION_ID=3.20.1\n"})
+	fakes.Host("nosudo").
+		On(`cat /etc/os-release`, connectortest.Result{Stdout: "ID=ubuntu\nPRETTY_NAME=\"Ubuntu 22.04.4 LTS\"\n"}).
+		On(`sudo`, connectortest.Result{ExitCode: 1, Stderr: "ops is not in the sudoers file"})
+	fakes.FailHost("down", errors.New("connection refused"))
+
+	statuses := ProbeAll(context.Background(), []connector.Host{host("ok"), host("nosudo"), host("down")}, fakes.Dial)
+	require.Len(t, statuses, 3)
+
+	assert.True(t, statuses[0].OK())
+	assert.Equal(t, "alpine 3.20.1", statuses[0].OS)
+	assert.Equal(t, SudoNoPassword, statuses[0].Sudo)
+
+	assert.True(t, statuses[1].Reachable)
+	assert.Equal(t, "Ubuntu 22.04.4 LTS", statuses[1].OS)
+	assert.Equal(t, SudoUnavailable, statuses[1].Sudo)
+
+	assert.False(t, statuses[2].Reachable)
+	assert.True(t, fakes.Host("ok").Closed(), "the connections are closed after probing")
+
+	err := Check(statuses)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "nosudo: user cannot run commands with sudo")
+	assert.Contains(t, err.Error(), "down: unreachable: ")
+	assert.NotContains(t, err.Error(), "ok:")
+}
+
+func TestProbeSSH(t *testing.T) {
+	fake := connectortest.NewFake().
+		On(`cat /etc/os-release`, connectortest.Result{Stdout: "ID=rocky\nVERSION_ID=9.4\n"}).
+		On(`sudo -n true`, connectortest.Result{ExitCode: 1})
+	srv := connectortest.NewSSHServer(t, fake.Run)
+
+	s := Probe(context.Background(), srv.NewHost("node1"), func(h connector.Host) (connector.Connection, error) {
+		return connector.NewConnection(srv.Config())
+	})
+	assert.True(t, s.OK(), s.Errors)
+	assert.Equal(t, connector.AuthPassword, s.Auth)
+	assert.Equal(t, SudoPassword, s.Sudo, "sudo asks for the login password")
+	assert.Equal(t, "rocky 9.4", s.OS)
+}
@@ -0,0 +1,216 @@
+// Package proxy makes every node use an HTTP proxy: containerd and kubelet
+// through systemd drop-ins, the package manager through its own
+// configuration, and login shells through a profile script. NO_PROXY must
+// cover everything reached inside the cluster, or image pulls from a local
+// registry and calls to the API server go through the proxy; see Effective.
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/mensylisir/xmcores/common"
+	"github.com/mensylisir/xmcores/facts"
+	"github.com/mensylisir/xmcores/logger"
+	"github.com/mensylisir/xmcores/modules"
+)
+
+const moduleName = "Proxy"
+
+// Files written on the nodes.
+const (
+	ContainerdDropIn = "/etc/systemd/system/containerd.service.d/http-proxy.conf"
+	KubeletDropIn    = "/etc/systemd/system/kubelet.service.d/http-proxy.conf"
+	ProfileScript    = "/etc/profile.d/xmcores-proxy.sh"
+	AptConfig        = "/etc/apt/apt.conf.d/95xmcores-proxy"
+)
+
+// DefaultNoProxy are always excluded from the proxy.
+var DefaultNoProxy = []string{"localhost", "127.0.0.1", "::1"}
+
+// Config holds the proxy settings.
+type Config struct {
+	HTTPProxy  string `yaml:"httpProxy,omitempty" json:"httpProxy,omitempty"`
+	HTTPSProxy string `yaml:"httpsProxy,omitempty" json:"httpsProxy,omitempty"`
+	// NoProxy lists extra hosts, domains (".example.com") and CIDRs that
+	// bypass the proxy, on top of those Effective adds.
+	NoProxy []string `yaml:"noProxy,omitempty" json:"noProxy,omitempty"`
+}
+
+// Validate checks the configuration.
+func (c Config) Validate() error {
+	if c.HTTPProxy == "" && c.HTTPSProxy == "" {
+		return errors.New("httpProxy or httpsProxy must be set")
+	}
+	for _, p := range []struct{ field, value string }{{"httpProxy", c.HTTPProxy}, {"httpsProxy", c.HTTPSProxy}} {
+		if p.value == "" {
+			continue
+		}
+		u, err := url.Parse(p.value)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("%s: %q is not a URL such as http://proxy.example.com:3128", p.field, p.value)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("%s: unsupported scheme %q (want http or https)", p.field, u.Scheme)
+		}
+	}
+	for _, n := range c.NoProxy {
+		if n == "" || strings.ContainsAny(n, ", \t") {
+			return fmt.Errorf("noProxy: invalid entry %q", n)
+		}
+	}
+	return nil
+}
+
+// Effective returns c with DefaultNoProxy and exclude added to NoProxy,
+// without duplicates. Callers exclude the node addresses and names, the pod
+// and service CIDRs, the cluster domain and the control-plane endpoint.
+func (c Config) Effective(exclude ...string) Config {
+	seen := map[string]bool{}
+	var noProxy []string
+	for _, list := range [][]string{DefaultNoProxy, c.NoProxy, exclude} {
+		for _, n := range list {
+			if n != "" && !seen[n] {
+				seen[n] = true
+				noProxy = append(noProxy, n)
+			}
+		}
+	}
+	c.NoProxy = noProxy
+	return c
+}
+
+// env returns the proxy variables in upper case, as systemd units read them.
+func (c Config) env() [][2]string {
+	var vars [][2]string
+	if c.HTTPProxy != "" {
+		vars = append(vars, [2]string{"HTTP_PROXY", c.HTTPProxy})
+	}
+	if c.HTTPSProxy != "" {
+		vars = append(vars, [2]string{"HTTPS_PROXY", c.HTTPSProxy})
+	}
+	if len(c.NoProxy) > 0 {
+		vars = append(vars, [2]string{"NO_PROXY", strings.Join(c.NoProxy, ",")})
+	}
+	return vars
+}
+
+// SystemdDropIn renders the drop-in setting the proxy for a service.
+func SystemdDropIn(c Config) string {
+	var b strings.Builder
+	b.WriteString("# Managed by xmcores\n[Service]\n")
+	for _, v := range c.env() {
+		fmt.Fprintf(&b, "Environment=\"%s=%s\"\n", v[0], v[1])
+	}
+	return b.String()
+}
+
+// Profile renders the login shell script exporting the proxy, in both cases
+// since tools disagree on which one they read.
+func Profile(c Config) string {
+	var b strings.Builder
+	b.WriteString("# Managed by xmcores\n")
+	for _, v := range c.env() {
+		fmt.Fprintf(&b, "export %s=%s\n", v[0], shellQuote(v[1]))
+		fmt.Fprintf(&b, "export %s=%s\n", strings.ToLower(v[0]), shellQuote(v[1]))
+	}
+	return b.String()
+}
+
+// Apt renders the apt configuration. apt has no NO_PROXY; the host names and
+// IPv4 addresses among NoProxy, such as a local mirror, are listed as DIRECT
+// instead.
+func Apt(c Config) string {
+	var b strings.Builder
+	b.WriteString("// Managed by xmcores\n")
+	for _, p := range []struct{ scheme, proxy string }{{"http", c.HTTPProxy}, {"https", c.HTTPSProxy}} {
+		if p.proxy == "" {
+			continue
+		}
+		fmt.Fprintf(&b, "Acquire::%s::Proxy \"%s\";\n", p.scheme, p.proxy)
+		for _, n := range c.NoProxy {
+			if !strings.HasPrefix(n, ".") && !strings.ContainsAny(n, "/:") {
+				fmt.Fprintf(&b, "Acquire::%s::Proxy::%s \"DIRECT\";\n", p.scheme, n)
+			}
+		}
+	}
+	return b.String()
+}
+
+// yumProxyCommand sets the proxy in the [main] section of conf, replacing
+// an earlier setting. yum and dnf only support one proxy for both schemes.
+func yumProxyCommand(c Config, conf string) string {
+	p := c.HTTPSProxy
+	if p == "" {
+		p = c.HTTPProxy
+	}
+	return fmt.Sprintf("sed -i '/^proxy=/d' %[1]s && sed -i '/^\\[main\\]/a proxy=%[2]s' %[1]s", conf, p)
+}
+
+// Apply configures the proxy on node and restarts containerd and kubelet if
+// their settings changed and they run. cfg should be the Effective config.
+func Apply(ctx context.Context, node modules.Node, cfg Config) error {
+	restart := false
+	for _, f := range []struct {
+		path    string
+		content string
+		service bool
+	}{
+		{ContainerdDropIn, SystemdDropIn(cfg), true},
+		{KubeletDropIn, SystemdDropIn(cfg), true},
+		{ProfileScript, Profile(cfg), false},
+	} {
+		if _, err := modules.Run(ctx, node.Conn, fmt.Sprintf(common.MkdirCmdTpl, path.Dir(f.path))); err != nil {
+			return err
+		}
+		changed, err := modules.WriteFileWith(ctx, node, []byte(f.content), f.path, common.FileMode0644, modules.WriteOptions{})
+		if err != nil {
+			return err
+		}
+		restart = restart || changed && f.service
+	}
+
+	rel, err := facts.DetectOSRelease(ctx, node.Conn)
+	if err != nil {
+		return err
+	}
+	switch rel.PackageManager() {
+	case facts.PackageManagerApt:
+		if _, err := modules.WriteFileWith(ctx, node, []byte(Apt(cfg)), AptConfig, common.FileMode0644, modules.WriteOptions{}); err != nil {
+			return err
+		}
+	case facts.PackageManagerYum:
+		if _, err := modules.Run(ctx, node.Conn, yumProxyCommand(cfg, "/etc/yum.conf")); err != nil {
+			return err
+		}
+	case facts.PackageManagerDnf:
+		if _, err := modules.Run(ctx, node.Conn, yumProxyCommand(cfg, "/etc/dnf/dnf.conf")); err != nil {
+			return err
+		}
+	}
+	// apk reads the variables of the profile script.
+
+	if !restart {
+		return nil
+	}
+	return modules.RunAll(ctx, node.Conn, "systemctl daemon-reload", "systemctl try-restart containerd kubelet")
+}
+
+// Deploy configures the proxy on all nodes.
+func Deploy(ctx context.Context, nodes []modules.Node, cfg Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	logger.Log.InfofModule(moduleName, "configuring the proxy on %d nodes, bypassed for %s", len(nodes), strings.Join(cfg.NoProxy, ","))
+	return modules.ForEach(ctx, nodes, func(ctx context.Context, node modules.Node) error {
+		return Apply(ctx, node, cfg)
+	})
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mensylisir/xmcores/connector"
+	"github.com/mensylisir/xmcores/connector/connectortest"
+	"github.com/mensylisir/xmcores/modules"
+)
+
+func TestValidate(t *testing.T) {
+	require.NoError(t, Config{HTTPProxy: "http://proxy:3128"}.Validate())
+	assert.ErrorContains(t, Config{}.Validate(), "httpProxy or httpsProxy must be set")
+	assert.ErrorContains(t, Config{HTTPSProxy: "proxy:3128"}.Validate(), "httpsProxy")
+	assert.ErrorContains(t, Config{HTTPProxy: "socks5://proxy:1080"}.Validate(), `unsupported scheme "socks5"`)
+	assert.ErrorContains(t, Config{HTTPProxy: "http://proxy", NoProxy: []string{"a,b"}}.Validate(), `invalid entry "a,b"`)
+}
+
+func TestRender(t *testing.T) {
+	cfg := Config{HTTPProxy: "http://proxy:3128", NoProxy: []string{"mirror.lab"}}.Effective("10.233.0.0/18", ".cluster.local", "mirror.lab")
+	assert.Equal(t, []string{"localhost", "127.0.0.1", "::1", "mirror.lab", "10.233.0.0/18", ".cluster.local"}, cfg.NoProxy)
+
+	const noProxy = "localhost,127.0.0.1,::1,mirror.lab,10.233.0.0/18,.cluster.local"
+	assert.Equal(t, "# Managed by xmcores\n[Service]\n"+
+		`Environment="HTTP_PROXY=http://proxy:3128"`+"\n"+
+		`Environment="NO_PROXY=`+noProxy+`"`+"\n", SystemdDropIn(cfg))
+	assert.Equal(t, "# Managed by xmcores\n"+
+		"export HTTP_PROXY='http://proxy:3128'\nexport http_proxy='http://proxy:3128'\n"+
+		"export NO_PROXY='"+noProxy+"'\nexport no_proxy='"+noProxy+"'\n", Profile(cfg))
+	assert.Equal(t, "// Managed by xmcores\n"+
+		"Acquire::http::Proxy \"http://proxy:3128\";\n"+
+		"Acquire::http::Proxy::localhost \"DIRECT\";\n"+
+		"Acquire::http::Proxy::127.0.0.1 \"DIRECT\";\n"+
+		"Acquire::http::Proxy::mirror.lab \"DIRECT\";\n", Apt(cfg))
+}
+
+func TestApply(t *testing.T) {
+	ctx := context.Background()
+	cfg := Config{HTTPSProxy: "http://proxy:3128"}.Effective()
+	for _, tc := range []struct {
+		osRelease string
+		check     func(t *testing.T, fake *connectortest.Fake)
+	}{
+		{"ID=ubuntu\n", func(t *testing.T, fake *connectortest.Fake) {
+			apt, ok := fake.ReadFile(AptConfig)
+			require.True(t, ok)
+			assert.Contains(t, string(apt), `Acquire::https::Proxy "http://proxy:3128";`)
+		}},
+		{"ID=rocky\nID_LIKE=\"rhel centos fedora\"\nVERSION_ID=\"9.3\"\n", func(t *testing.T, fake *connectortest.Fake) {
+			assert.True(t, fake.Ran(`a proxy=http://proxy:3128.* /etc/dnf/dnf\.conf`))
+		}},
+	} {
+		fake := connectortest.NewFake()
+		fake.On(`cat /etc/os-release`, connectortest.Result{Stdout: tc.osRelease})
+		h := connector.NewHost()
+		h.SetName("node1")
+		node := modules.Node{Host: h, Conn: fake}
+
+		require.NoError(t, Apply(ctx, node, cfg))
+		for _, path := range []string{ContainerdDropIn, KubeletDropIn, ProfileScript} {
+			_, ok := fake.ReadFile(path)
+			assert.True(t, ok, path)
+		}
+		assert.True(t, fake.Ran(`systemctl try-restart containerd kubelet`))
+		tc.check(t, fake)
+	}
+}
+
+func TestApplyUnchanged(t *testing.T) {
+	ctx := context.Background()
+	cfg := Config{HTTPProxy: "http://proxy:3128"}.Effective()
+	fake := connectortest.NewFake()
+	fake.On(`cat /etc/os-release`, connectortest.Result{Stdout: "ID=alpine\n"})
+	fake.On(`sha256sum /etc/systemd/system/(containerd|kubelet)\.service\.d/http-proxy\.conf`,
+		connectortest.Result{Stdout: sha256Hex(SystemdDropIn(cfg)) + "  http-proxy.conf\n"})
+	h := connector.NewHost()
+	h.SetName("node1")
+
+	require.NoError(t, Apply(ctx, modules.Node{Host: h, Conn: fake}, cfg))
+	assert.False(t, fake.Ran(`systemctl`), "services are not restarted when their settings did not change")
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,128 @@
+// Package reboot restarts nodes, for kernel or boot parameter changes that
+// only apply after a reboot. It triggers the reboot in the background so the
+// command returns before the connection drops, reconnects with exponential
+// backoff until the node answers again and checks that its uptime went down,
+// so a node that never went away is not taken for a rebooted one.
+package reboot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mensylisir/xmcores/connector"
+	"github.com/mensylisir/xmcores/errs"
+	"github.com/mensylisir/xmcores/logger"
+	"github.com/mensylisir/xmcores/modules"
+	"github.com/mensylisir/xmcores/wait"
+)
+
+const moduleName = "Reboot"
+
+const (
+	// DefaultTimeout bounds the wait for a node to come back.
+	DefaultTimeout = 10 * time.Minute
+	// DefaultInterval is the delay before the second reconnection attempt.
+	DefaultInterval = 5 * time.Second
+	// MaxInterval caps the delay between attempts as it doubles.
+	MaxInterval = time.Minute
+)
+
+// Command reboots the node a moment after it returns, leaving time for the
+// session to end cleanly.
+const Command = "nohup sh -c 'sleep 2; systemctl reboot || reboot' </dev/null >/dev/null 2>&1 &"
+
+// Options control how long a reboot is waited for.
+type Options struct {
+	// Timeout bounds the wait for the node to come back, DefaultTimeout by
+	// default.
+	Timeout time.Duration
+	// Interval is the delay before the second reconnection attempt,
+	// DefaultInterval by default. It doubles after every failed attempt, up
+	// to MaxInterval.
+	Interval time.Duration
+}
+
+// SetDefaults fills unset fields.
+func (o *Options) SetDefaults() {
+	if o.Timeout == 0 {
+		o.Timeout = DefaultTimeout
+	}
+	if o.Interval == 0 {
+		o.Interval = DefaultInterval
+	}
+}
+
+// Validate checks the options.
+func (o Options) Validate() error {
+	var errList []error
+	if o.Timeout < 0 {
+		errList = append(errList, fmt.Errorf("timeout must not be negative, got %s", o.Timeout))
+	}
+	if o.Interval < 0 {
+		errList = append(errList, fmt.Errorf("interval must not be negative, got %s", o.Interval))
+	}
+	return errors.Join(errList...)
+}
+
+// Uptime returns how long the host behind exec has been up.
+func Uptime(ctx context.Context, exec connector.Executor) (time.Duration, error) {
+	out, err := modules.RunUnprivileged(ctx, exec, "cat /proc/uptime")
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(out)
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("unexpected /proc/uptime content %q", out)
+	}
+	secs, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected /proc/uptime content %q", out)
+	}
+	return time.Duration(secs * float64(time.Second)), nil
+}
+
+// Node reboots node and waits until it is back: its connection reconnected
+// and its uptime lower than before the reboot. The connection of node must
+// implement connector.Reconnector; it is usable again once Node returns nil.
+func Node(ctx context.Context, node modules.Node, o Options) error {
+	o.SetDefaults()
+	if err := o.Validate(); err != nil {
+		return errs.Wrap(errs.Config, err)
+	}
+	r, ok := node.Conn.(connector.Reconnector)
+	if !ok {
+		return errs.Wrap(errs.Config, fmt.Errorf("the connection to %s cannot reconnect after a reboot", node.Name()))
+	}
+	before, err := Uptime(ctx, node.Conn)
+	if err != nil {
+		return err
+	}
+	logger.Log.InfofModule(moduleName, "%s: rebooting, up for %s", node.Name(), before.Round(time.Second))
+	start := time.Now()
+	if _, err := modules.Run(ctx, node.Conn, Command); err != nil {
+		return fmt.Errorf("failed to reboot: %w", err)
+	}
+	opts := wait.Options{Timeout: o.Timeout, Interval: o.Interval, Factor: 2, MaxInterval: MaxInterval}
+	err = wait.Poll(ctx, opts, node.Name()+" to come back from the reboot", func(ctx context.Context) (bool, error) {
+		if err := r.Reconnect(ctx); err != nil {
+			return false, err
+		}
+		up, err := Uptime(ctx, node.Conn)
+		if err != nil {
+			return false, err
+		}
+		if up >= before {
+			return false, fmt.Errorf("up for %s, not rebooted yet", up.Round(time.Second))
+		}
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+	logger.Log.InfofModule(moduleName, "%s: back after %s", node.Name(), time.Since(start).Round(time.Second))
+	return nil
+}
@@ -0,0 +1,68 @@
+package reboot
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mensylisir/xmcores/connector"
+	"github.com/mensylisir/xmcores/connector/connectortest"
+	"github.com/mensylisir/xmcores/errs"
+	"github.com/mensylisir/xmcores/modules"
+	"github.com/mensylisir/xmcores/wait"
+)
+
+func node(fake *connectortest.Fake) modules.Node {
+	h := connector.NewHost()
+	h.SetName("node1")
+	return modules.Node{Host: h, Conn: fake}
+}
+
+func TestNode(t *testing.T) {
+	ctx := context.Background()
+	fake := connectortest.NewFake()
+	// The node goes down on the second attempt and answers again on the
+	// fourth, freshly booted.
+	fake.OnFunc(func(cmd string) bool { return strings.Contains(cmd, "/proc/uptime") }, func(string) connectortest.Result {
+		if fake.Reconnects() >= 4 {
+			return connectortest.Result{Stdout: "12.50 20.00\n"}
+		}
+		return connectortest.Result{Stdout: "5000.00 9000.00\n"}
+	}).OnReconnect(func() error {
+		if n := fake.Reconnects(); n == 2 || n == 3 {
+			return errors.New("connection refused")
+		}
+		return nil
+	})
+
+	start := time.Now()
+	require.NoError(t, Node(ctx, node(fake), Options{Interval: 10 * time.Millisecond}))
+	assert.Equal(t, 4, fake.Reconnects())
+	assert.GreaterOrEqual(t, time.Since(start), 70*time.Millisecond, "the delay doubles: 10ms, 20ms, 40ms")
+	assert.True(t, fake.Ran(`sudo .*nohup sh -c .*sleep 2; systemctl reboot \|\| reboot`))
+
+	up, err := Uptime(ctx, fake)
+	require.NoError(t, err)
+	assert.Equal(t, 12500*time.Millisecond, up)
+}
+
+func TestNodeTimeout(t *testing.T) {
+	ctx := context.Background()
+	fake := connectortest.NewFake().On(`/proc/uptime`, connectortest.Result{Stdout: "5000.00 9000.00\n"})
+	err := Node(ctx, node(fake), Options{Timeout: 50 * time.Millisecond, Interval: 10 * time.Millisecond})
+	assert.ErrorIs(t, err, wait.ErrTimeout)
+	assert.Equal(t, errs.Verification, errs.KindOf(err))
+	assert.ErrorContains(t, err, "not rebooted yet", "a node whose uptime did not go down did not reboot")
+
+	err = Node(ctx, node(fake), Options{Timeout: -time.Second})
+	assert.Equal(t, errs.Config, errs.KindOf(err))
+
+	failing := connectortest.NewFake().On(`/proc/uptime`, connectortest.Result{Stdout: "bogus"})
+	_, err = Uptime(ctx, failing)
+	assert.ErrorContains(t, err, "unexpected /proc/uptime content")
+}
@@ -0,0 +1,171 @@
+// Package registrycheck validates the private registry of the cluster before
+// images are pushed to it or pulled from it: that the controller and the
+// nodes reach it, trust its certificate and that it accepts the configured
+// credentials. Failures name the configuration field to fix.
+package registrycheck
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/mensylisir/xmcores/common"
+	"github.com/mensylisir/xmcores/errs"
+	"github.com/mensylisir/xmcores/logger"
+	"github.com/mensylisir/xmcores/modules"
+	"github.com/mensylisir/xmcores/registry"
+	"github.com/mensylisir/xmcores/shellquote"
+)
+
+const moduleName = "RegistryCheck"
+
+// CertsDir holds the per-registry configuration of containerd, see
+// CAPath.
+const CertsDir = "/etc/containerd/certs.d"
+
+// NodeTimeout bounds the request a node sends to the registry.
+const NodeTimeout = 10 * time.Second
+
+// CAPath is where the CA of spec.registry.caFile is installed on the nodes,
+// next to the hosts.toml containerd reads for the registry at address.
+func CAPath(address string) string {
+	return path.Join(CertsDir, address, "ca.crt")
+}
+
+// CheckController checks from the controller that the registry of cfg
+// answers the API, with a certificate it trusts, and accepts the
+// credentials.
+func CheckController(ctx context.Context, cfg registry.Config) error {
+	client, err := registry.NewClient(cfg)
+	if err != nil {
+		return errs.Wrap(errs.Config, fmt.Errorf("spec.registry: %w", err))
+	}
+	if err := client.Check(ctx); err != nil {
+		return errs.Wrap(errs.Preflight, fmt.Errorf("registry %s from the controller: %w%s", cfg.Address, err, hint(cfg, err)))
+	}
+	return nil
+}
+
+// hint returns advice for the failure err of a request to the registry of
+// cfg, starting with "; ", or "".
+func hint(cfg registry.Config, err error) string {
+	var (
+		unknownCA x509.UnknownAuthorityError
+		hostname  x509.HostnameError
+		invalid   x509.CertificateInvalidError
+		dnsErr    *net.DNSError
+		opErr     *net.OpError
+	)
+	switch {
+	case registry.IsUnauthorized(err) && cfg.Username == "":
+		return "; set spec.registry.username and password"
+	case registry.IsUnauthorized(err):
+		return "; check spec.registry.username and password, and that the user may push"
+	case errors.As(err, &unknownCA):
+		if cfg.CAFile != "" {
+			return "; spec.registry.caFile does not hold the CA that signed the registry certificate"
+		}
+		return "; set spec.registry.caFile to the CA of the registry, or insecureSkipVerify to accept any certificate"
+	case errors.As(err, &hostname):
+		return fmt.Sprintf("; the certificate is not valid for %s, use a name it lists in spec.registry.address", hostname.Host)
+	case errors.As(err, &invalid):
+		return "; the registry certificate is expired or not valid yet"
+	case strings.Contains(err.Error(), "server gave HTTP response to HTTPS client"):
+		return "; the registry does not speak HTTPS, set spec.registry.plainHTTP"
+	case errors.As(err, &dnsErr):
+		return "; the name of spec.registry.address does not resolve"
+	case errors.As(err, &opErr):
+		return "; check spec.registry.address and that no firewall blocks the port"
+	}
+	return ""
+}
+
+// curl exit codes CheckNode explains.
+const (
+	curlResolve    = 6
+	curlConnect    = 7
+	curlTimeout    = 28
+	curlTLS        = 35
+	curlPeerVerify = 60
+)
+
+// CheckNode checks from node that the registry of cfg answers the API with
+// a certificate the node trusts. The CA of cfg.CAFile is installed to
+// CAPath first, since containerd needs it there to pull. Credentials are
+// checked by CheckController only: an answer asking for them suffices.
+func CheckNode(ctx context.Context, node modules.Node, cfg registry.Config) error {
+	scheme := "https"
+	if cfg.PlainHTTP {
+		scheme = "http"
+	}
+	args := []string{"curl", "-sS", "-o", "/dev/null", "-w", "%{http_code}", "-m", fmt.Sprint(int(NodeTimeout.Seconds()))}
+	switch {
+	case cfg.PlainHTTP:
+	case cfg.InsecureSkipVerify:
+		args = append(args, "-k")
+	case cfg.CAFile != "":
+		ca, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return errs.Wrap(errs.Config, fmt.Errorf("spec.registry.caFile: %w", err))
+		}
+		caPath := CAPath(cfg.Address)
+		if _, err := modules.Run(ctx, node.Conn, fmt.Sprintf(common.MkdirCmdTpl, shellquote.Quote(path.Dir(caPath)))); err != nil {
+			return err
+		}
+		if err := modules.WriteFile(ctx, node.Conn, ca, caPath, common.FileMode0644); err != nil {
+			return fmt.Errorf("failed to install the registry CA: %w", err)
+		}
+		args = append(args, "--cacert", caPath)
+	}
+	args = append(args, scheme+"://"+cfg.Address+"/v2/")
+	r := modules.Exec(ctx, node, shellquote.Join(args...))
+	if r.Err != nil {
+		return errs.Wrap(errs.Connectivity, r.Err)
+	}
+	code := strings.TrimSpace(r.StdoutString())
+	if r.ExitCode == 0 && (code == "200" || code == "401") {
+		return nil
+	}
+	var advice string
+	switch r.ExitCode {
+	case 0:
+		advice = fmt.Sprintf("the registry answered %s to /v2/, check spec.registry.address", code)
+	case curlResolve:
+		advice = "the name of spec.registry.address does not resolve on the node, see spec.resolution"
+	case curlConnect, curlTimeout:
+		advice = "the node cannot connect, check the route and firewall between the node and the registry"
+	case curlTLS:
+		advice = "the TLS handshake failed; if the registry speaks HTTP, set spec.registry.plainHTTP"
+	case curlPeerVerify:
+		advice = "the node does not trust the registry certificate, set spec.registry.caFile to its CA"
+	case 127:
+		advice = "curl is not installed on the node"
+	default:
+		advice = strings.TrimSpace(r.StderrString())
+	}
+	return errs.Wrap(errs.Preflight, fmt.Errorf("registry %s from %s: %s", cfg.Address, node.Name(), advice))
+}
+
+// Preflight runs CheckController, then CheckNode on a sample node: the
+// first of nodes, if any. Nodes share their network setup more often than
+// not, so one of them is enough to fail fast.
+func Preflight(ctx context.Context, cfg registry.Config, nodes []modules.Node) error {
+	logger.Log.InfofModule(moduleName, "checking registry %s", cfg.Address)
+	if err := CheckController(ctx, cfg); err != nil {
+		return err
+	}
+	if len(nodes) == 0 {
+		return nil
+	}
+	if err := CheckNode(ctx, nodes[0], cfg); err != nil {
+		return errs.WithHost(err, nodes[0].Name())
+	}
+	logger.Log.InfofModule(moduleName, "registry %s is reachable from the controller and %s", cfg.Address, nodes[0].Name())
+	return nil
+}
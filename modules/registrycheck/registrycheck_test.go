@@ -0,0 +1,78 @@
+package registrycheck
+
+import (
+	"context"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mensylisir/xmcores/connector"
+	"github.com/mensylisir/xmcores/connector/connectortest"
+	"github.com/mensylisir/xmcores/errs"
+	"github.com/mensylisir/xmcores/modules"
+	"github.com/mensylisir/xmcores/registry"
+)
+
+func TestCheckController(t *testing.T) {
+	ctx := context.Background()
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, _ := r.BasicAuth(); user != "admin" || pass != "secret" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="registry"`)
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	})
+	srv := httptest.NewTLSServer(handler)
+	defer srv.Close()
+	addr := strings.TrimPrefix(srv.URL, "https://")
+	caFile := filepath.Join(t.TempDir(), "ca.crt")
+	require.NoError(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0o644))
+
+	assert.NoError(t, CheckController(ctx, registry.Config{Address: addr, CAFile: caFile, Username: "admin", Password: "secret"}))
+
+	err := CheckController(ctx, registry.Config{Address: addr, Username: "admin", Password: "secret"})
+	assert.Equal(t, errs.Preflight, errs.KindOf(err))
+	assert.ErrorContains(t, err, "set spec.registry.caFile")
+
+	err = CheckController(ctx, registry.Config{Address: addr, CAFile: caFile})
+	assert.ErrorContains(t, err, "set spec.registry.username and password")
+	err = CheckController(ctx, registry.Config{Address: addr, CAFile: caFile, Username: "admin", Password: "wrong"})
+	assert.ErrorContains(t, err, "check spec.registry.username and password")
+
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+	err = CheckController(ctx, registry.Config{Address: strings.TrimPrefix(plain.URL, "http://")})
+	assert.ErrorContains(t, err, "set spec.registry.plainHTTP")
+}
+
+func TestCheckNode(t *testing.T) {
+	ctx := context.Background()
+	caFile := filepath.Join(t.TempDir(), "ca.crt")
+	require.NoError(t, os.WriteFile(caFile, []byte("CA"), 0o644))
+	cfg := registry.Config{Address: "registry.lab:5000", CAFile: caFile}
+	host := connector.NewHost()
+	host.SetName("node1")
+
+	fake := connectortest.NewFake().On(`curl .* --cacert /etc/containerd/certs\.d/registry\.lab:5000/ca\.crt https://registry\.lab:5000/v2/`,
+		connectortest.Result{Stdout: "401"})
+	require.NoError(t, CheckNode(ctx, modules.Node{Host: host, Conn: fake}, cfg))
+	data, ok := fake.ReadFile("/etc/containerd/certs.d/registry.lab:5000/ca.crt")
+	assert.True(t, ok)
+	assert.Equal(t, "CA", string(data), "the CA is installed where containerd reads it")
+
+	fake = connectortest.NewFake().On(`curl `, connectortest.Result{ExitCode: 60, Stderr: "curl: (60) SSL certificate problem"})
+	err := CheckNode(ctx, modules.Node{Host: host, Conn: fake}, cfg)
+	assert.Equal(t, errs.Preflight, errs.KindOf(err))
+	assert.ErrorContains(t, err, "node1: the node does not trust the registry certificate")
+
+	fake = connectortest.NewFake().On(`curl `, connectortest.Result{Stdout: "404"})
+	err = CheckNode(ctx, modules.Node{Host: host, Conn: fake}, registry.Config{Address: "registry.lab", PlainHTTP: true})
+	assert.ErrorContains(t, err, "answered 404")
+	assert.True(t, fake.Ran(`http://registry\.lab/v2/`))
+}
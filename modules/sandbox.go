@@ -0,0 +1,260 @@
+package modules
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+
+	"github.com/mensylisir/xmcores/errs"
+	"github.com/mensylisir/xmcores/shellquote"
+)
+
+// DefaultSandboxUser is the account unprivileged steps run as when the
+// sandbox names none.
+const DefaultSandboxUser = "xm-runner"
+
+// SudoersDir holds the sudoers file of the sandbox user.
+const SudoersDir = "/etc/sudoers.d"
+
+// SandboxConfig makes the unprivileged commands of steps run as a dedicated
+// low-privilege account instead of the connecting user, who is often root.
+// xm creates the account on the nodes and lets it run with sudo only the
+// commands the modules declared with NeedSudo, and those of Sudo.
+type SandboxConfig struct {
+	// User is the account, DefaultSandboxUser by default.
+	User string `yaml:"user,omitempty" json:"user,omitempty"`
+	// Sudo lists further commands the account may run as root: absolute
+	// paths, optionally followed by the only arguments allowed, e.g.
+	// "/usr/bin/systemctl restart myapp".
+	Sudo []string `yaml:"sudo,omitempty" json:"sudo,omitempty"`
+}
+
+var (
+	sandboxUserPattern = regexp.MustCompile(`^[a-z_][a-z0-9_-]{0,30}$`)
+	aliasUnsafe        = regexp.MustCompile(`[^A-Z0-9]+`)
+)
+
+// SetDefaults fills unset fields.
+func (c *SandboxConfig) SetDefaults() {
+	if c.User == "" {
+		c.User = DefaultSandboxUser
+	}
+}
+
+// Validate checks the configuration.
+func (c SandboxConfig) Validate() error {
+	var errList []error
+	if !sandboxUserPattern.MatchString(c.User) || c.User == "root" {
+		errList = append(errList, fmt.Errorf("user: invalid account name %q", c.User))
+	}
+	for i, cmd := range c.Sudo {
+		if err := ValidateSudoCommand(cmd); err != nil {
+			errList = append(errList, fmt.Errorf("sudo[%d]: %w", i, err))
+		}
+	}
+	return errors.Join(errList...)
+}
+
+// ValidateSudoCommand rejects what sudoers would not read as a single
+// command, an absolute path optionally followed by arguments: relative paths
+// and its special characters.
+func ValidateSudoCommand(cmd string) error {
+	if !strings.HasPrefix(cmd, "/") {
+		return fmt.Errorf("%q must start with the absolute path of the command", cmd)
+	}
+	if strings.ContainsAny(cmd, ",:=\\#\n\r") {
+		return fmt.Errorf("%q must not contain any of , : = \\ # or a newline", cmd)
+	}
+	return nil
+}
+
+var sudoNeeds = struct {
+	mu    sync.RWMutex
+	needs map[string][]string
+}{needs: map[string][]string{}}
+
+// NeedSudo declares that the sandboxed commands of module run commands with
+// sudo, each an absolute path optionally followed by its arguments. It is
+// meant to be called from the init function of the module's package, and
+// panics on an invalid command.
+func NeedSudo(module string, commands ...string) {
+	for _, cmd := range commands {
+		if err := ValidateSudoCommand(cmd); err != nil {
+			panic(fmt.Sprintf("modules: %s: %v", module, err))
+		}
+	}
+	sudoNeeds.mu.Lock()
+	defer sudoNeeds.mu.Unlock()
+	sudoNeeds.needs[module] = append(sudoNeeds.needs[module], commands...)
+}
+
+// SudoNeeds returns the commands declared with NeedSudo, by module.
+func SudoNeeds() map[string][]string {
+	sudoNeeds.mu.RLock()
+	defer sudoNeeds.mu.RUnlock()
+	out := make(map[string][]string, len(sudoNeeds.needs))
+	for m, cmds := range sudoNeeds.needs {
+		out[m] = append([]string(nil), cmds...)
+	}
+	return out
+}
+
+// SudoersFile is the path of the sudoers file of the sandbox user.
+func (c SandboxConfig) SudoersFile() string {
+	return path.Join(SudoersDir, "xmcores-"+c.User)
+}
+
+// Sudoers renders the sudoers file granting the user the commands of needs,
+// by module, and of c.Sudo.
+func (c SandboxConfig) Sudoers(needs map[string][]string) string {
+	modules := make([]string, 0, len(needs))
+	for m := range needs {
+		modules = append(modules, m)
+	}
+	sort.Strings(modules)
+	grants := make([]SudoGrant, 0, len(modules)+1)
+	for _, m := range modules {
+		grants = append(grants, SudoGrant{Name: m, Commands: needs[m]})
+	}
+	return RenderSudoers(c.User, append(grants, SudoGrant{Name: "config", Commands: c.Sudo}))
+}
+
+// SudoGrant is a named group of commands granted in a sudoers file.
+type SudoGrant struct {
+	Name     string
+	Commands []string
+}
+
+// RenderSudoers renders a sudoers file letting user run the commands of
+// grants as root without a password, one command alias per grant with
+// commands.
+func RenderSudoers(user string, grants []SudoGrant) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Managed by xmcores: the commands %s may run as root.\n", user)
+	var aliases []string
+	for _, g := range grants {
+		if len(g.Commands) == 0 {
+			continue
+		}
+		alias := "XM_" + strings.Trim(aliasUnsafe.ReplaceAllString(strings.ToUpper(g.Name), "_"), "_")
+		fmt.Fprintf(&b, "Cmnd_Alias %s = %s\n", alias, strings.Join(g.Commands, ", "))
+		aliases = append(aliases, alias)
+	}
+	if len(aliases) > 0 {
+		fmt.Fprintf(&b, "%s ALL=(root) NOPASSWD: %s\n", user, strings.Join(aliases, ", "))
+	}
+	return b.String()
+}
+
+// InstallSudoers replaces the sudoers file at file on node with content,
+// checked with visudo first so that a mistake cannot lock sudo.
+func InstallSudoers(ctx context.Context, node Node, file, content string) error {
+	// sudo ignores the files of SudoersDir with a dot in their name.
+	tmp := path.Join(path.Dir(file), fmt.Sprintf(".%s.%s.tmp", path.Base(file), uuid.New().String()[:8]))
+	TrackTemp(ctx, node, tmp)
+	if err := WriteFile(ctx, node.Conn, []byte(content), tmp, 0440); err != nil {
+		return err
+	}
+	if _, err := Run(ctx, node.Conn, fmt.Sprintf("visudo -cf %[1]s >/dev/null && chown root:root %[1]s && mv -f %[1]s %[2]s || { rm -f %[1]s; exit 1; }", shellquote.Quote(tmp), shellquote.Quote(file))); err != nil {
+		return fmt.Errorf("failed to install %s: %w", file, err)
+	}
+	UntrackTemp(ctx, node, tmp)
+	return nil
+}
+
+// Sandbox runs commands as the user of its configuration, preparing each
+// node on first use. It is safe for concurrent use.
+type Sandbox struct {
+	cfg   SandboxConfig
+	mu    sync.Mutex
+	nodes map[string]*sandboxNode
+}
+
+// sandboxNode is the preparation state of a node.
+type sandboxNode struct {
+	mu    sync.Mutex
+	ready bool
+}
+
+// NewSandbox returns the sandbox of cfg.
+func NewSandbox(cfg SandboxConfig) *Sandbox {
+	cfg.SetDefaults()
+	return &Sandbox{cfg: cfg, nodes: map[string]*sandboxNode{}}
+}
+
+func (s *Sandbox) node(name string) *sandboxNode {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := s.nodes[name]
+	if n == nil {
+		n = &sandboxNode{}
+		s.nodes[name] = n
+	}
+	return n
+}
+
+// User returns the account the sandbox runs commands as.
+func (s *Sandbox) User() string {
+	return s.cfg.User
+}
+
+// Command returns cmd wrapped to run as the sandbox user, from its home
+// directory.
+func (s *Sandbox) Command(cmd string) string {
+	return "sudo -u " + shellquote.Quote(s.cfg.User) + " -H /bin/sh -c " + shellquote.Quote("cd; "+cmd)
+}
+
+// Prepare creates the sandbox user on node if missing and replaces its
+// sudoers file, checked with visudo first. It runs once per node, or until
+// it succeeds.
+func (s *Sandbox) Prepare(ctx context.Context, node Node) error {
+	state := s.node(node.Name())
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if state.ready {
+		return nil
+	}
+	if _, err := Run(ctx, node.Conn, fmt.Sprintf("id -u %[1]s >/dev/null 2>&1 || useradd --system --create-home --shell /bin/sh %[1]s || adduser -S -D -s /bin/sh %[1]s", shellquote.Quote(s.cfg.User))); err != nil {
+		return fmt.Errorf("failed to create the sandbox user: %w", err)
+	}
+	if err := InstallSudoers(ctx, node, s.cfg.SudoersFile(), s.cfg.Sudoers(SudoNeeds())); err != nil {
+		return err
+	}
+	state.ready = true
+	return nil
+}
+
+type sandboxKey struct{}
+
+// WithSandbox returns a context carrying s, where RunSandboxed runs commands
+// as its user.
+func WithSandbox(ctx context.Context, s *Sandbox) context.Context {
+	return context.WithValue(ctx, sandboxKey{}, s)
+}
+
+// SandboxFrom returns the sandbox carried by ctx, if any.
+func SandboxFrom(ctx context.Context) (*Sandbox, bool) {
+	s, ok := ctx.Value(sandboxKey{}).(*Sandbox)
+	return s, ok
+}
+
+// RunSandboxed runs a command that needs no privilege on node as the user of
+// the sandbox ctx carries, preparing it first, and as the connecting user
+// (see RunUnprivileged) without a sandbox. Errors are reported as by Run.
+func RunSandboxed(ctx context.Context, node Node, cmd string) (string, error) {
+	s, ok := SandboxFrom(ctx)
+	if !ok {
+		return RunUnprivileged(ctx, node.Conn, cmd)
+	}
+	if err := s.Prepare(ctx, node); err != nil {
+		return "", errs.Wrap(errs.Preflight, fmt.Errorf("sandbox %s: %w", s.User(), err))
+	}
+	return run(ctx, node.Conn, s.Command(cmd), cmd)
+}
@@ -0,0 +1,72 @@
+package modules_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mensylisir/xmcores/connector"
+	"github.com/mensylisir/xmcores/connector/connectortest"
+	"github.com/mensylisir/xmcores/errs"
+	"github.com/mensylisir/xmcores/modules"
+)
+
+func TestSandboxConfig(t *testing.T) {
+	cfg := modules.SandboxConfig{Sudo: []string{"/usr/bin/systemctl restart myapp"}}
+	cfg.SetDefaults()
+	require.NoError(t, cfg.Validate())
+	assert.Equal(t, "/etc/sudoers.d/xmcores-xm-runner", cfg.SudoersFile())
+
+	assert.Equal(t, `# Managed by xmcores: the commands xm-runner may run as root.
+Cmnd_Alias XM_IMAGE_PRELOAD = /usr/bin/crictl images, /usr/bin/ctr -n k8s.io images ls
+Cmnd_Alias XM_CONFIG = /usr/bin/systemctl restart myapp
+xm-runner ALL=(root) NOPASSWD: XM_IMAGE_PRELOAD, XM_CONFIG
+`, cfg.Sudoers(map[string][]string{"Image-Preload": {"/usr/bin/crictl images", "/usr/bin/ctr -n k8s.io images ls"}}))
+	assert.NotContains(t, modules.SandboxConfig{User: "ops"}.Sudoers(nil), "NOPASSWD", "nothing is granted without needs")
+
+	bad := modules.SandboxConfig{User: "root", Sudo: []string{"systemctl", "/bin/sh -c a,b"}}
+	err := bad.Validate()
+	assert.ErrorContains(t, err, `user: invalid account name "root"`)
+	assert.ErrorContains(t, err, "sudo[0]")
+	assert.ErrorContains(t, err, "sudo[1]")
+	assert.Panics(t, func() { modules.NeedSudo("Bad", "crictl") })
+}
+
+func TestRunSandboxed(t *testing.T) {
+	ctx := context.Background()
+	fake := connectortest.NewFake().On(`whoami`, connectortest.Result{Stdout: "me\n"})
+	host := connector.NewHost()
+	host.SetName("node1")
+	node := modules.Node{Host: host, Conn: fake}
+
+	out, err := modules.RunSandboxed(ctx, node, "whoami")
+	require.NoError(t, err)
+	assert.Equal(t, "me", out)
+	assert.Equal(t, []string{"whoami"}, fake.Commands(), "without a sandbox the connecting user runs the command")
+
+	ctx = modules.WithSandbox(ctx, modules.NewSandbox(modules.SandboxConfig{}))
+	for i := 0; i < 2; i++ {
+		_, err = modules.RunSandboxed(ctx, node, "whoami")
+		require.NoError(t, err)
+	}
+	assert.True(t, fake.Ran(`useradd --system --create-home --shell /bin/sh xm-runner`))
+	assert.True(t, fake.Ran(`visudo -cf /etc/sudoers\.d/\.xmcores-xm-runner\.[0-9a-f]+\.tmp .* mv -f .* /etc/sudoers\.d/xmcores-xm-runner `))
+	created := 0
+	for _, cmd := range fake.Commands() {
+		if strings.Contains(cmd, "useradd") {
+			created++
+		}
+	}
+	assert.Equal(t, 1, created, "the node is prepared once")
+	assert.True(t, fake.Ran(`^sudo -u xm-runner -H /bin/sh -c 'cd; whoami'$`))
+
+	failing := connectortest.NewFake().On(`visudo`, connectortest.Result{Stderr: "syntax error", ExitCode: 1})
+	other := connector.NewHost()
+	other.SetName("node2")
+	_, err = modules.RunSandboxed(ctx, modules.Node{Host: other, Conn: failing}, "whoami")
+	assert.Equal(t, errs.Preflight, errs.KindOf(err))
+	assert.False(t, failing.Ran(`cd; whoami`), "nothing runs without the sandbox")
+}
@@ -0,0 +1,325 @@
+// Package security configures kube-apiserver audit logging and encryption of
+// resources at rest. It writes the audit policy and the EncryptionConfiguration
+// to every control-plane node and returns the apiserver flags and mounts that
+// reference them.
+package security
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/mensylisir/xmcores/common"
+	"github.com/mensylisir/xmcores/logger"
+	"github.com/mensylisir/xmcores/modules"
+)
+
+const moduleName = "Security"
+
+const (
+	AuditPolicyPath      = "/etc/kubernetes/audit/policy.yaml"
+	DefaultAuditLogPath  = "/var/log/kubernetes/audit/audit.log"
+	EncryptionConfigPath = "/etc/kubernetes/pki/encryption-config.yaml"
+)
+
+// Encryption providers.
+const (
+	ProviderAESCBC    = "aescbc"
+	ProviderAESGCM    = "aesgcm"
+	ProviderSecretbox = "secretbox"
+)
+
+// DefaultAuditPolicy logs metadata for everything, skips noisy read-only system
+// traffic and never records secret payloads.
+const DefaultAuditPolicy = `apiVersion: audit.k8s.io/v1
+kind: Policy
+omitStages:
+  - RequestReceived
+rules:
+  - level: None
+    users: ["system:kube-proxy"]
+    verbs: ["watch"]
+  - level: None
+    nonResourceURLs: ["/healthz*", "/livez*", "/readyz*", "/version"]
+  - level: None
+    userGroups: ["system:nodes"]
+    verbs: ["get", "list", "watch"]
+  - level: Metadata
+    resources:
+      - group: ""
+        resources: ["secrets", "configmaps", "serviceaccounts/token"]
+      - group: "authentication.k8s.io"
+        resources: ["tokenreviews"]
+  - level: RequestResponse
+    verbs: ["create", "update", "patch", "delete", "deletecollection"]
+  - level: Metadata
+`
+
+// AuditConfig enables apiserver audit logging.
+type AuditConfig struct {
+	// PolicyFile is a local audit policy replacing DefaultAuditPolicy.
+	PolicyFile string `yaml:"policyFile,omitempty" json:"policyFile,omitempty"`
+	LogPath    string `yaml:"logPath,omitempty" json:"logPath,omitempty"`
+	// MaxAge, MaxBackup and MaxSize (MB) control log rotation by the apiserver.
+	MaxAge    int `yaml:"maxAge,omitempty" json:"maxAge,omitempty"`
+	MaxBackup int `yaml:"maxBackup,omitempty" json:"maxBackup,omitempty"`
+	MaxSize   int `yaml:"maxSize,omitempty" json:"maxSize,omitempty"`
+}
+
+// EncryptionConfig enables encryption at rest.
+type EncryptionConfig struct {
+	Provider string `yaml:"provider,omitempty" json:"provider,omitempty"`
+	// Resources to encrypt; defaults to secrets.
+	Resources []string `yaml:"resources,omitempty" json:"resources,omitempty"`
+}
+
+// Config is the security section of the cluster configuration.
+type Config struct {
+	Audit      *AuditConfig      `yaml:"audit,omitempty" json:"audit,omitempty"`
+	Encryption *EncryptionConfig `yaml:"encryption,omitempty" json:"encryption,omitempty"`
+}
+
+// SetDefaults fills unset fields.
+func (c *Config) SetDefaults() {
+	if a := c.Audit; a != nil {
+		if a.LogPath == "" {
+			a.LogPath = DefaultAuditLogPath
+		}
+		if a.MaxAge == 0 {
+			a.MaxAge = 30
+		}
+		if a.MaxBackup == 0 {
+			a.MaxBackup = 10
+		}
+		if a.MaxSize == 0 {
+			a.MaxSize = 100
+		}
+	}
+	if e := c.Encryption; e != nil {
+		if e.Provider == "" {
+			e.Provider = ProviderSecretbox
+		}
+		if len(e.Resources) == 0 {
+			e.Resources = []string{"secrets"}
+		}
+	}
+}
+
+// Validate checks the configuration.
+func (c *Config) Validate() error {
+	if a := c.Audit; a != nil {
+		if !path.IsAbs(a.LogPath) {
+			return fmt.Errorf("audit log path %q must be absolute", a.LogPath)
+		}
+		if a.MaxAge < 0 || a.MaxBackup < 0 || a.MaxSize < 0 {
+			return fmt.Errorf("audit log rotation settings must not be negative")
+		}
+	}
+	if e := c.Encryption; e != nil {
+		switch e.Provider {
+		case ProviderAESCBC, ProviderAESGCM, ProviderSecretbox:
+		default:
+			return fmt.Errorf("unsupported encryption provider %q", e.Provider)
+		}
+	}
+	return nil
+}
+
+// Mount is a host path the apiserver static pod needs.
+type Mount struct {
+	Name      string
+	HostPath  string
+	MountPath string
+	ReadOnly  bool
+}
+
+// APIServerArgs returns the kube-apiserver flags for the enabled features.
+func (c *Config) APIServerArgs() map[string]string {
+	args := make(map[string]string)
+	if a := c.Audit; a != nil {
+		args["audit-policy-file"] = AuditPolicyPath
+		args["audit-log-path"] = a.LogPath
+		args["audit-log-maxage"] = strconv.Itoa(a.MaxAge)
+		args["audit-log-maxbackup"] = strconv.Itoa(a.MaxBackup)
+		args["audit-log-maxsize"] = strconv.Itoa(a.MaxSize)
+	}
+	if c.Encryption != nil {
+		args["encryption-provider-config"] = EncryptionConfigPath
+	}
+	return args
+}
+
+// APIServerMounts returns the extra volumes the apiserver needs. The encryption
+// config lives under /etc/kubernetes/pki, which kubeadm already mounts.
+func (c *Config) APIServerMounts() []Mount {
+	if c.Audit == nil {
+		return nil
+	}
+	return []Mount{
+		{Name: "audit-policy", HostPath: path.Dir(AuditPolicyPath), MountPath: path.Dir(AuditPolicyPath), ReadOnly: true},
+		{Name: "audit-log", HostPath: path.Dir(c.Audit.LogPath), MountPath: path.Dir(c.Audit.LogPath)},
+	}
+}
+
+// GenerateKey returns a random base64-encoded 32-byte key.
+func GenerateKey() (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", fmt.Errorf("failed to generate encryption key: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// Key is a named encryption key.
+type Key struct {
+	Name   string `yaml:"name"`
+	Secret string `yaml:"secret"`
+}
+
+type encryptionConfiguration struct {
+	APIVersion string               `yaml:"apiVersion"`
+	Kind       string               `yaml:"kind"`
+	Resources  []encryptionResource `yaml:"resources"`
+}
+
+type encryptionResource struct {
+	Resources []string                 `yaml:"resources"`
+	Providers []map[string]interface{} `yaml:"providers"`
+}
+
+// EncryptionConfiguration renders the apiserver EncryptionConfiguration. The
+// first key encrypts new writes; later keys still decrypt existing data, and
+// the identity provider keeps unencrypted data readable.
+func EncryptionConfiguration(provider string, resources []string, keys []Key) ([]byte, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("at least one encryption key is required")
+	}
+	cfg := encryptionConfiguration{
+		APIVersion: "apiserver.config.k8s.io/v1",
+		Kind:       "EncryptionConfiguration",
+		Resources: []encryptionResource{{
+			Resources: resources,
+			Providers: []map[string]interface{}{
+				{provider: map[string]interface{}{"keys": keys}},
+				{"identity": map[string]interface{}{}},
+			},
+		}},
+	}
+	out, err := yaml.Marshal(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to render encryption configuration: %w", err)
+	}
+	return out, nil
+}
+
+// ParseKeys extracts the keys of provider from an existing EncryptionConfiguration.
+func ParseKeys(data []byte, provider string) ([]Key, error) {
+	var cfg struct {
+		Resources []struct {
+			Providers []map[string]struct {
+				Keys []Key `yaml:"keys"`
+			} `yaml:"providers"`
+		} `yaml:"resources"`
+	}
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse encryption configuration: %w", err)
+	}
+	for _, r := range cfg.Resources {
+		for _, p := range r.Providers {
+			if entry, ok := p[provider]; ok {
+				return entry.Keys, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// existingKeys reads the keys already deployed on node so re-running the module
+// never replaces the key data was encrypted with.
+func existingKeys(ctx context.Context, node modules.Node, provider string) ([]Key, error) {
+	exists, err := modules.Succeeds(ctx, node.Conn, "test -f "+EncryptionConfigPath)
+	if err != nil || !exists {
+		return nil, err
+	}
+	out, err := modules.Run(ctx, node.Conn, "cat "+EncryptionConfigPath)
+	if err != nil {
+		return nil, err
+	}
+	return ParseKeys([]byte(out), provider)
+}
+
+// Deploy writes the audit policy and encryption configuration to all
+// control-plane nodes. An existing encryption key on the first node is reused;
+// otherwise a new key is generated and the same key is distributed everywhere.
+func Deploy(ctx context.Context, controlPlanes []modules.Node, cfg Config) error {
+	cfg.SetDefaults()
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	if len(controlPlanes) == 0 {
+		return fmt.Errorf("no control-plane nodes")
+	}
+
+	var policy []byte
+	if a := cfg.Audit; a != nil {
+		policy = []byte(DefaultAuditPolicy)
+		if a.PolicyFile != "" {
+			var err error
+			if policy, err = os.ReadFile(a.PolicyFile); err != nil {
+				return fmt.Errorf("failed to read audit policy: %w", err)
+			}
+		}
+	}
+
+	var encryption []byte
+	if e := cfg.Encryption; e != nil {
+		keys, err := existingKeys(ctx, controlPlanes[0], e.Provider)
+		if err != nil {
+			return fmt.Errorf("%s: %w", controlPlanes[0].Name(), err)
+		}
+		if len(keys) == 0 {
+			secret, err := GenerateKey()
+			if err != nil {
+				return err
+			}
+			keys = []Key{{Name: "key1", Secret: secret}}
+			logger.Log.InfofModule(moduleName, "generated new %s encryption key", e.Provider)
+		}
+		if encryption, err = EncryptionConfiguration(e.Provider, e.Resources, keys); err != nil {
+			return err
+		}
+	}
+
+	// The API server reads both files, so replace them atomically and keep the
+	// previous versions for rolling back by hand.
+	liveConfig := modules.WriteOptions{Backup: true}
+	return modules.ForEach(ctx, controlPlanes, func(ctx context.Context, node modules.Node) error {
+		if policy != nil {
+			if _, err := modules.Run(ctx, node.Conn, strings.Join([]string{
+				fmt.Sprintf(common.MkdirCmdTpl, path.Dir(AuditPolicyPath)),
+				fmt.Sprintf(common.MkdirCmdTpl, path.Dir(cfg.Audit.LogPath)),
+			}, " && ")); err != nil {
+				return err
+			}
+			if _, err := modules.WriteFileWith(ctx, node, policy, AuditPolicyPath, common.FileMode0600, liveConfig); err != nil {
+				return err
+			}
+		}
+		if encryption != nil {
+			if _, err := modules.Run(ctx, node.Conn, fmt.Sprintf(common.MkdirCmdTpl, path.Dir(EncryptionConfigPath))); err != nil {
+				return err
+			}
+			if _, err := modules.WriteFileWith(ctx, node, encryption, EncryptionConfigPath, common.FileMode0600, liveConfig); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,64 @@
+package security
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigDefaults(t *testing.T) {
+	cfg := Config{Audit: &AuditConfig{}, Encryption: &EncryptionConfig{}}
+	cfg.SetDefaults()
+	require.NoError(t, cfg.Validate())
+	assert.Equal(t, DefaultAuditLogPath, cfg.Audit.LogPath)
+	assert.Equal(t, ProviderSecretbox, cfg.Encryption.Provider)
+	assert.Equal(t, []string{"secrets"}, cfg.Encryption.Resources)
+
+	assert.Error(t, (&Config{Audit: &AuditConfig{LogPath: "audit.log"}}).Validate())
+	assert.Error(t, (&Config{Encryption: &EncryptionConfig{Provider: "kms"}}).Validate())
+}
+
+func TestAPIServerArgs(t *testing.T) {
+	cfg := Config{Audit: &AuditConfig{LogPath: "/data/audit/audit.log"}, Encryption: &EncryptionConfig{}}
+	cfg.SetDefaults()
+	args := cfg.APIServerArgs()
+	assert.Equal(t, AuditPolicyPath, args["audit-policy-file"])
+	assert.Equal(t, "/data/audit/audit.log", args["audit-log-path"])
+	assert.Equal(t, "30", args["audit-log-maxage"])
+	assert.Equal(t, EncryptionConfigPath, args["encryption-provider-config"])
+
+	mounts := cfg.APIServerMounts()
+	require.Len(t, mounts, 2)
+	assert.Equal(t, "/data/audit", mounts[1].HostPath)
+	assert.False(t, mounts[1].ReadOnly)
+
+	assert.Empty(t, (&Config{}).APIServerArgs())
+	assert.Empty(t, (&Config{Encryption: &EncryptionConfig{}}).APIServerMounts())
+}
+
+func TestEncryptionConfigurationRoundTrip(t *testing.T) {
+	secret, err := GenerateKey()
+	require.NoError(t, err)
+	raw, err := base64.StdEncoding.DecodeString(secret)
+	require.NoError(t, err)
+	assert.Len(t, raw, 32)
+
+	keys := []Key{{Name: "key2", Secret: secret}, {Name: "key1", Secret: "b2xk"}}
+	data, err := EncryptionConfiguration(ProviderAESCBC, []string{"secrets", "configmaps"}, keys)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "kind: EncryptionConfiguration")
+	assert.Contains(t, string(data), "identity: {}")
+
+	parsed, err := ParseKeys(data, ProviderAESCBC)
+	require.NoError(t, err)
+	assert.Equal(t, keys, parsed)
+
+	parsed, err = ParseKeys(data, ProviderSecretbox)
+	require.NoError(t, err)
+	assert.Empty(t, parsed)
+
+	_, err = EncryptionConfiguration(ProviderAESCBC, []string{"secrets"}, nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,55 @@
+package modules
+
+import (
+	"fmt"
+)
+
+// Service actions, see ServiceCmd.
+const (
+	ServiceStart   = "start"
+	ServiceStop    = "stop"
+	ServiceRestart = "restart"
+	// ServiceEnable starts the service at boot and now.
+	ServiceEnable = "enable"
+	// ServiceDisable stops the service and no longer starts it at boot.
+	ServiceDisable = "disable"
+	// ServiceIsActive exits with code 0 when the service is running.
+	ServiceIsActive = "is-active"
+	// ServiceIsEnabled exits with code 0 when the service starts at boot.
+	ServiceIsEnabled = "is-enabled"
+)
+
+// ServiceCmd returns the command applying action to service with the given
+// init system (see the facts.Init* constants).
+func ServiceCmd(initSystem, action, service string) (string, error) {
+	switch initSystem {
+	case "systemd":
+		switch action {
+		case ServiceStart, ServiceStop, ServiceRestart:
+			return fmt.Sprintf("systemctl %s %s", action, service), nil
+		case ServiceEnable, ServiceDisable:
+			return fmt.Sprintf("systemctl %s --now %s", action, service), nil
+		case ServiceIsActive:
+			return "systemctl is-active --quiet " + service, nil
+		case ServiceIsEnabled:
+			return "systemctl is-enabled --quiet " + service, nil
+		}
+	case "openrc":
+		switch action {
+		case ServiceStart, ServiceStop, ServiceRestart:
+			return fmt.Sprintf("rc-service %s %s", service, action), nil
+		case ServiceEnable:
+			return fmt.Sprintf("rc-update add %s default && rc-service %s start", service, service), nil
+		case ServiceDisable:
+			// Like systemctl disable, this succeeds for a service already stopped and disabled.
+			return fmt.Sprintf("rc-service %s stop; rc-update del %s default 2>/dev/null || true", service, service), nil
+		case ServiceIsActive:
+			return fmt.Sprintf("rc-service %s status >/dev/null 2>&1", service), nil
+		case ServiceIsEnabled:
+			return fmt.Sprintf("rc-update show default | grep -q '^ *%s |'", service), nil
+		}
+	default:
+		return "", fmt.Errorf("unsupported init system %q", initSystem)
+	}
+	return "", fmt.Errorf("unsupported service action %q", action)
+}
@@ -0,0 +1,91 @@
+package modules
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/mensylisir/xmcores/errs"
+	"github.com/mensylisir/xmcores/shellquote"
+)
+
+// Space is the free space of the file system holding a directory, as df
+// reports it.
+type Space struct {
+	// Filesystem and MountPoint identify the file system.
+	Filesystem string
+	MountPoint string
+	// Bytes is the space available to unprivileged users.
+	Bytes int64
+	// Inodes is the number of free inodes; -1 when the file system has no
+	// fixed inode table (btrfs, some network file systems).
+	Inodes int64
+}
+
+// FreeSpace returns the free space of the file system that dir is on, or
+// would be on once created.
+func FreeSpace(ctx context.Context, node Node, dir string) (Space, error) {
+	// df fails for paths that do not exist yet, so ask for the closest ancestor.
+	out, err := Run(ctx, node.Conn, fmt.Sprintf(`d=%s; while [ ! -e "$d" ]; do d=$(dirname "$d"); done; df -P -k "$d" | tail -n 1; df -P -i "$d" | tail -n 1`, shellquote.Quote(dir)))
+	if err != nil {
+		return Space{}, err
+	}
+	return parseDF(out)
+}
+
+// parseDF reads the last lines of df -P -k and df -P -i.
+func parseDF(out string) (Space, error) {
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 2 {
+		return Space{}, fmt.Errorf("unexpected df output %q", out)
+	}
+	blocks, inodes := strings.Fields(lines[0]), strings.Fields(lines[1])
+	if len(blocks) < 6 || len(inodes) < 6 {
+		return Space{}, fmt.Errorf("unexpected df output %q", out)
+	}
+	kb, err := strconv.ParseInt(blocks[3], 10, 64)
+	if err != nil {
+		return Space{}, fmt.Errorf("unexpected df output %q", out)
+	}
+	s := Space{Filesystem: blocks[0], MountPoint: blocks[len(blocks)-1], Bytes: kb * 1024, Inodes: -1}
+	if total, err := strconv.ParseInt(inodes[1], 10, 64); err == nil && total > 0 {
+		if s.Inodes, err = strconv.ParseInt(inodes[3], 10, 64); err != nil {
+			return Space{}, fmt.Errorf("unexpected df output %q", out)
+		}
+	}
+	return s, nil
+}
+
+// CheckSpace fails with a preflight error unless the file system dir is on
+// has bytes of space and inodes free inodes available, so that a transfer or
+// extraction fails before it starts rather than halfway through.
+func CheckSpace(ctx context.Context, node Node, dir string, bytes, inodes int64) error {
+	s, err := FreeSpace(ctx, node, dir)
+	if err != nil {
+		return err
+	}
+	if s.Bytes < bytes {
+		return errs.Wrap(errs.Preflight, fmt.Errorf("not enough disk space for %s: %s needed, %s available on %s (mounted on %s)",
+			dir, FormatSize(bytes), FormatSize(s.Bytes), s.Filesystem, s.MountPoint))
+	}
+	if s.Inodes >= 0 && s.Inodes < inodes {
+		return errs.Wrap(errs.Preflight, fmt.Errorf("not enough inodes for %s: %d needed, %d available on %s (mounted on %s)",
+			dir, inodes, s.Inodes, s.Filesystem, s.MountPoint))
+	}
+	return nil
+}
+
+// FormatSize formats a byte count with a binary unit, e.g. 1.5 GiB.
+func FormatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit && exp < 5; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
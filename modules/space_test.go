@@ -0,0 +1,48 @@
+package modules_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mensylisir/xmcores/connector"
+	"github.com/mensylisir/xmcores/connector/connectortest"
+	"github.com/mensylisir/xmcores/errs"
+	"github.com/mensylisir/xmcores/modules"
+)
+
+func TestCheckSpace(t *testing.T) {
+	ctx := context.Background()
+	fake := connectortest.NewFake()
+	fake.On(`/var/lib/xm`, connectortest.Result{Stdout: "/dev/sda1 51474912 40000000 10240000 80% /var\n" +
+		"/dev/sda1 3276800 3276700 100 100% /var\n"})
+	fake.On(`/data`, connectortest.Result{Stdout: "/dev/sdb1 1048576 0 1048576 0% /data\n" +
+		"/dev/sdb1 0 0 0 - /data\n"})
+	host := connector.NewHost()
+	host.SetName("node1")
+	node := modules.Node{Host: host, Conn: fake}
+
+	s, err := modules.FreeSpace(ctx, node, "/var/lib/xm")
+	require.NoError(t, err)
+	assert.Equal(t, modules.Space{Filesystem: "/dev/sda1", MountPoint: "/var", Bytes: 10240000 * 1024, Inodes: 100}, s)
+	assert.True(t, fake.Ran(`d=/var/lib/xm; while .*df -P -i`))
+
+	require.NoError(t, modules.CheckSpace(ctx, node, "/var/lib/xm", 1<<30, 100))
+	err = modules.CheckSpace(ctx, node, "/var/lib/xm", 20<<30, 1)
+	assert.Equal(t, errs.Preflight, errs.KindOf(err))
+	assert.EqualError(t, err, "not enough disk space for /var/lib/xm: 20.0 GiB needed, 9.8 GiB available on /dev/sda1 (mounted on /var)")
+	err = modules.CheckSpace(ctx, node, "/var/lib/xm", 1, 101)
+	assert.EqualError(t, err, "not enough inodes for /var/lib/xm: 101 needed, 100 available on /dev/sda1 (mounted on /var)")
+
+	require.NoError(t, modules.CheckSpace(ctx, node, "/data", 1<<30, 1<<20), "file systems without an inode table have no inode limit")
+	assert.Error(t, modules.CheckSpace(ctx, node, "/data", 1<<30+1, 0))
+}
+
+func TestFormatSize(t *testing.T) {
+	assert.Equal(t, "512 B", modules.FormatSize(512))
+	assert.Equal(t, "1.5 KiB", modules.FormatSize(1536))
+	assert.Equal(t, "3.0 MiB", modules.FormatSize(3<<20))
+	assert.Equal(t, "2.0 TiB", modules.FormatSize(2<<40))
+}
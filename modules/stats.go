@@ -0,0 +1,63 @@
+package modules
+
+import (
+	"context"
+	"sync"
+
+	"github.com/mensylisir/xmcores/connector"
+)
+
+// ConnStats collects the transfer and execution statistics of the
+// connections opened during a run, summed per host, so that slow or flaky
+// nodes stand out. It is safe for concurrent use.
+type ConnStats struct {
+	mu    sync.Mutex
+	conns map[string][]connector.StatsReporter
+}
+
+// NewConnStats returns an empty collector.
+func NewConnStats() *ConnStats {
+	return &ConnStats{conns: map[string][]connector.StatsReporter{}}
+}
+
+// Add records conn as a connection to host. Connections that do not report
+// statistics are ignored.
+func (s *ConnStats) Add(host string, conn connector.Connection) {
+	r, ok := conn.(connector.StatsReporter)
+	if !ok {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conns[host] = append(s.conns[host], r)
+}
+
+// Hosts returns the statistics of the connections of each host, closed ones
+// included.
+func (s *ConnStats) Hosts() map[string]connector.Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string]connector.Stats, len(s.conns))
+	for host, conns := range s.conns {
+		var total connector.Stats
+		for _, c := range conns {
+			total = total.Add(c.Stats())
+		}
+		out[host] = total
+	}
+	return out
+}
+
+type connStatsKey struct{}
+
+// WithConnStats returns a context carrying s, where ConnectWith records the
+// connections it opens.
+func WithConnStats(ctx context.Context, s *ConnStats) context.Context {
+	return context.WithValue(ctx, connStatsKey{}, s)
+}
+
+// ConnStatsFrom returns the collector carried by ctx, if any.
+func ConnStatsFrom(ctx context.Context) (*ConnStats, bool) {
+	s, ok := ctx.Value(connStatsKey{}).(*ConnStats)
+	return s, ok
+}
@@ -0,0 +1,387 @@
+// Package storage deploys a dynamic volume provisioner. Several backends are
+// supported; each declares the packages its nodes need and the manifests that
+// install it.
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/mensylisir/xmcores/errs"
+	"github.com/mensylisir/xmcores/facts"
+	"github.com/mensylisir/xmcores/kube"
+	"github.com/mensylisir/xmcores/logger"
+	"github.com/mensylisir/xmcores/modules"
+	"github.com/mensylisir/xmcores/shellquote"
+	"github.com/mensylisir/xmcores/util"
+)
+
+const moduleName = "Storage"
+
+// Backends.
+const (
+	BackendOpenEBS  = "openebs"
+	BackendLonghorn = "longhorn"
+	BackendNFS      = "nfs"
+	BackendRookCeph = "rook-ceph"
+)
+
+// NFSConfig points the NFS provisioner at an existing export.
+type NFSConfig struct {
+	Server       string   `yaml:"server,omitempty" json:"server,omitempty"`
+	Path         string   `yaml:"path,omitempty" json:"path,omitempty"`
+	MountOptions []string `yaml:"mountOptions,omitempty" json:"mountOptions,omitempty"`
+}
+
+// Config is the storage section of the cluster configuration.
+type Config struct {
+	// Backend selects the provisioner: openebs, longhorn, nfs or rook-ceph.
+	Backend string `yaml:"backend,omitempty" json:"backend,omitempty"`
+	// Version of the backend; defaults to the version tested with this release.
+	Version string `yaml:"version,omitempty" json:"version,omitempty"`
+	// DefaultClass marks the backend's storage class as the cluster default.
+	DefaultClass bool `yaml:"defaultClass,omitempty" json:"defaultClass,omitempty"`
+	// NFS is required by the nfs backend.
+	NFS NFSConfig `yaml:"nfs,omitempty" json:"nfs,omitempty"`
+	// Manifests replaces the built-in manifests; entries are URLs or paths on the controller.
+	Manifests []string `yaml:"manifests,omitempty" json:"manifests,omitempty"`
+}
+
+type backend struct {
+	version      string
+	storageClass string
+	manifests    []string
+	// packages maps a package manager family to the node packages the backend needs.
+	packages map[string][]string
+	services []string
+}
+
+var backends = map[string]backend{
+	BackendOpenEBS: {
+		storageClass: "openebs-hostpath",
+		manifests: []string{
+			"https://openebs.github.io/charts/openebs-operator-lite.yaml",
+			"https://openebs.github.io/charts/openebs-lite-sc.yaml",
+		},
+	},
+	BackendLonghorn: {
+		version:      "v1.6.2",
+		storageClass: "longhorn",
+		manifests:    []string{"https://raw.githubusercontent.com/longhorn/longhorn/{{.Version}}/deploy/longhorn.yaml"},
+		packages: map[string][]string{
+			facts.PackageManagerApt: {"open-iscsi", "nfs-common"},
+			facts.PackageManagerYum: {"iscsi-initiator-utils", "nfs-utils"},
+			facts.PackageManagerDnf: {"iscsi-initiator-utils", "nfs-utils"},
+		},
+		services: []string{"iscsid"},
+	},
+	BackendNFS: {
+		version:      "v4.0.2",
+		storageClass: "nfs-client",
+		packages: map[string][]string{
+			facts.PackageManagerApt: {"nfs-common"},
+			facts.PackageManagerYum: {"nfs-utils"},
+			facts.PackageManagerDnf: {"nfs-utils"},
+		},
+	},
+	BackendRookCeph: {
+		version:      "v1.14.9",
+		storageClass: "rook-ceph-block",
+		manifests: []string{
+			"https://raw.githubusercontent.com/rook/rook/{{.Version}}/deploy/examples/crds.yaml",
+			"https://raw.githubusercontent.com/rook/rook/{{.Version}}/deploy/examples/common.yaml",
+			"https://raw.githubusercontent.com/rook/rook/{{.Version}}/deploy/examples/operator.yaml",
+			"https://raw.githubusercontent.com/rook/rook/{{.Version}}/deploy/examples/cluster-test.yaml",
+			"https://raw.githubusercontent.com/rook/rook/{{.Version}}/deploy/examples/csi/rbd/storageclass-test.yaml",
+		},
+		packages: map[string][]string{
+			facts.PackageManagerApt: {"lvm2"},
+			facts.PackageManagerYum: {"lvm2"},
+			facts.PackageManagerDnf: {"lvm2"},
+		},
+	},
+}
+
+// SetDefaults fills the backend version.
+func (c *Config) SetDefaults() {
+	if b, ok := backends[c.Backend]; ok && c.Version == "" {
+		c.Version = b.version
+	}
+}
+
+// Validate checks the configuration.
+func (c *Config) Validate() error {
+	if _, ok := backends[c.Backend]; !ok {
+		return fmt.Errorf("unsupported storage backend %q (supported: %s, %s, %s, %s)",
+			c.Backend, BackendOpenEBS, BackendLonghorn, BackendNFS, BackendRookCeph)
+	}
+	if c.Backend == BackendNFS && (c.NFS.Server == "" || !strings.HasPrefix(c.NFS.Path, "/")) {
+		return fmt.Errorf("nfs backend requires nfs.server and an absolute nfs.path")
+	}
+	return nil
+}
+
+// StorageClass returns the name of the storage class the backend creates.
+func (c *Config) StorageClass() string {
+	return backends[c.Backend].storageClass
+}
+
+// Packages returns the node packages the backend needs for a package manager family.
+func (c *Config) Packages(packageManager string) []string {
+	return backends[c.Backend].packages[packageManager]
+}
+
+// ManifestSources returns the URLs or local paths of the manifests to apply.
+func (c *Config) ManifestSources() ([]string, error) {
+	if len(c.Manifests) > 0 {
+		return c.Manifests, nil
+	}
+	var sources []string
+	for _, tmpl := range backends[c.Backend].manifests {
+		src, err := util.RenderString(tmpl, util.Data{"Version": c.Version})
+		if err != nil {
+			return nil, fmt.Errorf("failed to render manifest URL %s: %w", tmpl, err)
+		}
+		sources = append(sources, src)
+	}
+	return sources, nil
+}
+
+var nfsManifest = template.Must(template.New("nfs").Parse(`apiVersion: v1
+kind: Namespace
+metadata:
+  name: nfs-provisioner
+---
+apiVersion: v1
+kind: ServiceAccount
+metadata:
+  name: nfs-client-provisioner
+  namespace: nfs-provisioner
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRole
+metadata:
+  name: nfs-client-provisioner-runner
+rules:
+  - apiGroups: [""]
+    resources: ["nodes"]
+    verbs: ["get", "list", "watch"]
+  - apiGroups: [""]
+    resources: ["persistentvolumes"]
+    verbs: ["get", "list", "watch", "create", "delete"]
+  - apiGroups: [""]
+    resources: ["persistentvolumeclaims"]
+    verbs: ["get", "list", "watch", "update"]
+  - apiGroups: ["storage.k8s.io"]
+    resources: ["storageclasses"]
+    verbs: ["get", "list", "watch"]
+  - apiGroups: [""]
+    resources: ["events"]
+    verbs: ["create", "update", "patch"]
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRoleBinding
+metadata:
+  name: run-nfs-client-provisioner
+subjects:
+  - kind: ServiceAccount
+    name: nfs-client-provisioner
+    namespace: nfs-provisioner
+roleRef:
+  kind: ClusterRole
+  name: nfs-client-provisioner-runner
+  apiGroup: rbac.authorization.k8s.io
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: Role
+metadata:
+  name: leader-locking-nfs-client-provisioner
+  namespace: nfs-provisioner
+rules:
+  - apiGroups: [""]
+    resources: ["endpoints"]
+    verbs: ["get", "list", "watch", "create", "update", "patch"]
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: RoleBinding
+metadata:
+  name: leader-locking-nfs-client-provisioner
+  namespace: nfs-provisioner
+subjects:
+  - kind: ServiceAccount
+    name: nfs-client-provisioner
+    namespace: nfs-provisioner
+roleRef:
+  kind: Role
+  name: leader-locking-nfs-client-provisioner
+  apiGroup: rbac.authorization.k8s.io
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: nfs-client-provisioner
+  namespace: nfs-provisioner
+spec:
+  replicas: 1
+  strategy:
+    type: Recreate
+  selector:
+    matchLabels:
+      app: nfs-client-provisioner
+  template:
+    metadata:
+      labels:
+        app: nfs-client-provisioner
+    spec:
+      serviceAccountName: nfs-client-provisioner
+      containers:
+        - name: nfs-client-provisioner
+          image: registry.k8s.io/sig-storage/nfs-subdir-external-provisioner:{{.Version}}
+          volumeMounts:
+            - name: nfs-client-root
+              mountPath: /persistentvolumes
+          env:
+            - name: PROVISIONER_NAME
+              value: k8s-sigs.io/nfs-subdir-external-provisioner
+            - name: NFS_SERVER
+              value: {{.NFS.Server}}
+            - name: NFS_PATH
+              value: {{.NFS.Path}}
+      volumes:
+        - name: nfs-client-root
+          nfs:
+            server: {{.NFS.Server}}
+            path: {{.NFS.Path}}
+---
+apiVersion: storage.k8s.io/v1
+kind: StorageClass
+metadata:
+  name: nfs-client
+provisioner: k8s-sigs.io/nfs-subdir-external-provisioner
+parameters:
+  archiveOnDelete: "false"
+{{- if .NFS.MountOptions}}
+mountOptions:
+{{- range .NFS.MountOptions}}
+  - {{.}}
+{{- end}}
+{{- end}}
+`))
+
+// NFSManifest renders the NFS subdir provisioner manifest.
+func NFSManifest(cfg Config) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := nfsManifest.Execute(&buf, cfg); err != nil {
+		return nil, fmt.Errorf("failed to render nfs provisioner manifest: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// PrepareNode installs the packages and enables the services the backend needs on node.
+func PrepareNode(ctx context.Context, node modules.Node, cfg Config) error {
+	b := backends[cfg.Backend]
+	if len(b.packages) == 0 {
+		return nil
+	}
+	rel, err := facts.DetectOSRelease(ctx, node.Conn)
+	if err != nil {
+		return err
+	}
+	pkgs := cfg.Packages(rel.PackageManager())
+	if len(pkgs) == 0 {
+		return fmt.Errorf("storage backend %s has no package list for %s", cfg.Backend, rel.Pretty)
+	}
+	if err := modules.InstallPackages(ctx, node, rel.PackageManager(), pkgs...); err != nil {
+		return err
+	}
+	for _, svc := range b.services {
+		if err := modules.Service(ctx, node, rel.InitSystem(), modules.ServiceEnable, svc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Install applies the backend manifests from a control-plane node. The
+// manifests that are not fetched from URLs are first checked against the APIs
+// of kubernetesVersion (see kube.CheckManifest).
+func Install(ctx context.Context, controlPlane modules.Node, cfg Config, kubernetesVersion string) error {
+	if cfg.Backend == BackendNFS && len(cfg.Manifests) == 0 {
+		manifest, err := NFSManifest(cfg)
+		if err != nil {
+			return err
+		}
+		if err := checkManifest("storage-nfs", manifest, kubernetesVersion); err != nil {
+			return err
+		}
+		if err := modules.KubectlApply(ctx, controlPlane.Conn, "storage-nfs", manifest); err != nil {
+			return err
+		}
+	} else {
+		sources, err := cfg.ManifestSources()
+		if err != nil {
+			return err
+		}
+		for i, src := range sources {
+			if strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://") {
+				if _, err := modules.Kubectl(ctx, controlPlane.Conn, "apply -f "+shellquote.Quote(src)); err != nil {
+					return err
+				}
+				continue
+			}
+			manifest, err := os.ReadFile(src)
+			if err != nil {
+				return fmt.Errorf("failed to read manifest %s: %w", src, err)
+			}
+			name := fmt.Sprintf("storage-%s-%d-%s", cfg.Backend, i, strings.TrimSuffix(filepath.Base(src), filepath.Ext(src)))
+			if err := checkManifest(src, manifest, kubernetesVersion); err != nil {
+				return err
+			}
+			if err := modules.KubectlApply(ctx, controlPlane.Conn, name, manifest); err != nil {
+				return err
+			}
+		}
+	}
+
+	if cfg.DefaultClass {
+		patch := `{"metadata":{"annotations":{"storageclass.kubernetes.io/is-default-class":"true"}}}`
+		if _, err := modules.Kubectl(ctx, controlPlane.Conn, fmt.Sprintf("patch storageclass %s -p %s", shellquote.Quote(cfg.StorageClass()), shellquote.Quote(patch))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkManifest fails when kubernetesVersion does not serve an object of
+// manifest and warns about the deprecated APIs it uses.
+func checkManifest(name string, manifest []byte, kubernetesVersion string) error {
+	warnings, err := kube.CheckManifest(manifest, kubernetesVersion)
+	if err != nil {
+		return errs.Wrap(errs.Preflight, fmt.Errorf("%s: %w", name, err))
+	}
+	for _, w := range warnings {
+		logger.Log.WarnfModule(moduleName, "%s: %s", name, w)
+	}
+	return nil
+}
+
+// Deploy prepares all nodes and installs the storage backend on a cluster
+// running kubernetesVersion.
+func Deploy(ctx context.Context, controlPlane modules.Node, nodes []modules.Node, cfg Config, kubernetesVersion string) error {
+	cfg.SetDefaults()
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	logger.Log.InfofModule(moduleName, "deploying %s %s", cfg.Backend, cfg.Version)
+	if err := modules.ForEach(ctx, nodes, func(ctx context.Context, node modules.Node) error {
+		return PrepareNode(ctx, node, cfg)
+	}); err != nil {
+		return err
+	}
+	return Install(ctx, controlPlane, cfg, kubernetesVersion)
+}
@@ -0,0 +1,54 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mensylisir/xmcores/facts"
+)
+
+func TestConfigValidate(t *testing.T) {
+	cfg := Config{Backend: BackendLonghorn}
+	cfg.SetDefaults()
+	require.NoError(t, cfg.Validate())
+	assert.Equal(t, "v1.6.2", cfg.Version)
+	assert.Equal(t, "longhorn", cfg.StorageClass())
+
+	assert.Error(t, (&Config{Backend: "ceph"}).Validate())
+	assert.Error(t, (&Config{Backend: BackendNFS, NFS: NFSConfig{Server: "10.0.0.9"}}).Validate())
+	assert.NoError(t, (&Config{Backend: BackendNFS, NFS: NFSConfig{Server: "10.0.0.9", Path: "/exports/k8s"}}).Validate())
+}
+
+func TestManifestSources(t *testing.T) {
+	cfg := Config{Backend: BackendRookCeph, Version: "v1.14.0"}
+	sources, err := cfg.ManifestSources()
+	require.NoError(t, err)
+	require.Len(t, sources, 5)
+	assert.Equal(t, "https://raw.githubusercontent.com/rook/rook/v1.14.0/deploy/examples/crds.yaml", sources[0])
+
+	cfg.Manifests = []string{"/srv/rook/all.yaml"}
+	sources, err = cfg.ManifestSources()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/srv/rook/all.yaml"}, sources)
+}
+
+func TestPackages(t *testing.T) {
+	cfg := Config{Backend: BackendLonghorn}
+	assert.Equal(t, []string{"open-iscsi", "nfs-common"}, cfg.Packages(facts.PackageManagerApt))
+	assert.Equal(t, []string{"iscsi-initiator-utils", "nfs-utils"}, cfg.Packages(facts.PackageManagerDnf))
+	assert.Empty(t, (&Config{Backend: BackendOpenEBS}).Packages(facts.PackageManagerApt))
+}
+
+func TestNFSManifest(t *testing.T) {
+	cfg := Config{Backend: BackendNFS, NFS: NFSConfig{Server: "10.0.0.9", Path: "/exports/k8s", MountOptions: []string{"nfsvers=4.1"}}}
+	cfg.SetDefaults()
+	manifest, err := NFSManifest(cfg)
+	require.NoError(t, err)
+	out := string(manifest)
+	assert.Contains(t, out, "nfs-subdir-external-provisioner:v4.0.2")
+	assert.Contains(t, out, "server: 10.0.0.9")
+	assert.Contains(t, out, "path: /exports/k8s")
+	assert.Contains(t, out, "mountOptions:\n  - nfsvers=4.1\n")
+}
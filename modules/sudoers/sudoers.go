@@ -0,0 +1,212 @@
+// Package sudoers installs on nodes a sudoers file letting a restricted user
+// run as root exactly the commands the configured pipelines need: managing
+// their services, installing their packages and writing their files. It
+// complements the sandbox of modules.SandboxConfig for setups where xm, or an
+// operator, connects without full sudo, and keeps the grants in one file per
+// user that can be audited and removed.
+package sudoers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/mensylisir/xmcores/facts"
+	"github.com/mensylisir/xmcores/logger"
+	"github.com/mensylisir/xmcores/modules"
+	"github.com/mensylisir/xmcores/shellquote"
+)
+
+const moduleName = "Sudoers"
+
+// FilePrefix prefixes the name of the sudoers files of this module, apart
+// from the file of the sandbox user.
+const FilePrefix = "xmcores-grants-"
+
+// DefaultServices are the services granted when none are configured.
+var DefaultServices = []string{"containerd", "kubelet"}
+
+var (
+	userPattern    = regexp.MustCompile(`^[a-z_][a-z0-9_-]{0,30}$`)
+	unitPattern    = regexp.MustCompile(`^[A-Za-z0-9@._-]+$`)
+	packagePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9.+_~-]*$`)
+)
+
+// Config lists what the user may do as root.
+type Config struct {
+	// User is the account granted the commands. It defaults to the sandbox
+	// user when spec.sandbox is set.
+	User string `yaml:"user,omitempty" json:"user,omitempty"`
+	// Services may be started, stopped, restarted, enabled and disabled,
+	// DefaultServices by default.
+	Services []string `yaml:"services,omitempty" json:"services,omitempty"`
+	// Packages may be installed with the package manager of the node.
+	Packages []string `yaml:"packages,omitempty" json:"packages,omitempty"`
+	// Paths may be written with tee.
+	Paths []string `yaml:"paths,omitempty" json:"paths,omitempty"`
+	// Commands are further commands: absolute paths, optionally followed by
+	// the only arguments allowed.
+	Commands []string `yaml:"commands,omitempty" json:"commands,omitempty"`
+}
+
+// SetDefaults fills unset fields.
+func (c *Config) SetDefaults() {
+	if c.Services == nil {
+		c.Services = append([]string(nil), DefaultServices...)
+	}
+}
+
+// Validate checks the configuration.
+func (c Config) Validate() error {
+	var errList []error
+	if c.User == "" {
+		errList = append(errList, errors.New("user is required unless spec.sandbox is set"))
+	} else if !userPattern.MatchString(c.User) || c.User == "root" {
+		errList = append(errList, fmt.Errorf("user: invalid account name %q", c.User))
+	}
+	for i, s := range c.Services {
+		if !unitPattern.MatchString(s) {
+			errList = append(errList, fmt.Errorf("services[%d]: invalid unit name %q", i, s))
+		}
+	}
+	for i, p := range c.Packages {
+		if !packagePattern.MatchString(p) {
+			errList = append(errList, fmt.Errorf("packages[%d]: invalid package name %q", i, p))
+		}
+	}
+	for i, p := range c.Paths {
+		if err := modules.ValidateSudoCommand(p); err != nil {
+			errList = append(errList, fmt.Errorf("paths[%d]: %w", i, err))
+		} else if strings.ContainsAny(p, " \t") {
+			errList = append(errList, fmt.Errorf("paths[%d]: %q must not contain spaces", i, p))
+		}
+	}
+	for i, cmd := range c.Commands {
+		if err := modules.ValidateSudoCommand(cmd); err != nil {
+			errList = append(errList, fmt.Errorf("commands[%d]: %w", i, err))
+		}
+	}
+	return errors.Join(errList...)
+}
+
+// File is the path of the sudoers file of the user.
+func (c Config) File() string {
+	return path.Join(modules.SudoersDir, FilePrefix+c.User)
+}
+
+// Programs are the absolute paths of the programs granted, by name, as found
+// on a node.
+type Programs map[string]string
+
+// packageManagerPrograms are the programs installing packages, by package
+// manager family.
+var packageManagerPrograms = map[string]string{
+	facts.PackageManagerApt: "apt-get",
+	facts.PackageManagerYum: "yum",
+	facts.PackageManagerDnf: "dnf",
+	facts.PackageManagerApk: "apk",
+}
+
+// Grants returns the commands of c for a node with the package manager pm and
+// the init system init, using the programs found on it. A grant whose
+// program is missing is left out.
+func (c Config) Grants(pm, init string, programs Programs) []modules.SudoGrant {
+	var services, packages, files []string
+	if init == facts.InitOpenRC {
+		if rc := programs["rc-service"]; rc != "" {
+			for _, s := range c.Services {
+				for _, action := range []string{"start", "stop", "restart"} {
+					services = append(services, rc+" "+s+" "+action)
+				}
+			}
+		}
+	} else if systemctl := programs["systemctl"]; systemctl != "" && len(c.Services) > 0 {
+		services = append(services, systemctl+" daemon-reload")
+		for _, s := range c.Services {
+			for _, action := range []string{"start", "stop", "restart", "enable", "disable"} {
+				services = append(services, systemctl+" "+action+" "+s)
+			}
+		}
+	}
+	if prog := programs[packageManagerPrograms[pm]]; prog != "" {
+		for _, p := range c.Packages {
+			switch pm {
+			case facts.PackageManagerApk:
+				packages = append(packages, prog+" add --no-cache "+p)
+			default:
+				packages = append(packages, prog+" install -y "+p)
+			}
+		}
+	}
+	if tee := programs["tee"]; tee != "" {
+		for _, p := range c.Paths {
+			files = append(files, tee+" "+p)
+		}
+	}
+	return []modules.SudoGrant{
+		{Name: "services", Commands: services},
+		{Name: "packages", Commands: packages},
+		{Name: "files", Commands: files},
+		{Name: "config", Commands: c.Commands},
+	}
+}
+
+// findPrograms returns the absolute paths of the programs that may be granted
+// on node.
+func findPrograms(ctx context.Context, node modules.Node) (Programs, error) {
+	out, err := modules.Run(ctx, node.Conn, "for p in systemctl rc-service apt-get yum dnf apk tee; do command -v $p; done; true")
+	if err != nil {
+		return nil, err
+	}
+	programs := Programs{}
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		// Builtins and aliases are not programs sudo can run.
+		if strings.HasPrefix(line, "/") {
+			programs[path.Base(line)] = line
+		}
+	}
+	return programs, nil
+}
+
+// Apply installs the sudoers file of cfg on node, checked with visudo first.
+func Apply(ctx context.Context, node modules.Node, cfg Config) error {
+	rel, err := facts.DetectOSRelease(ctx, node.Conn)
+	if err != nil {
+		return err
+	}
+	programs, err := findPrograms(ctx, node)
+	if err != nil {
+		return err
+	}
+	content := modules.RenderSudoers(cfg.User, cfg.Grants(rel.PackageManager(), rel.InitSystem(), programs))
+	if err := modules.InstallSudoers(ctx, node, cfg.File(), content); err != nil {
+		return err
+	}
+	logger.Log.InfofModule(moduleName, "%s: installed %s", node.Name(), cfg.File())
+	return nil
+}
+
+// Install runs Apply on every node concurrently.
+func Install(ctx context.Context, nodes []modules.Node, cfg Config) error {
+	logger.Log.InfofModule(moduleName, "granting %s its commands on %d nodes", cfg.User, len(nodes))
+	return modules.ForEach(ctx, nodes, func(ctx context.Context, node modules.Node) error {
+		return Apply(ctx, node, cfg)
+	})
+}
+
+// Remove deletes the sudoers file of cfg from every node, revoking the
+// grants.
+func Remove(ctx context.Context, nodes []modules.Node, cfg Config) error {
+	logger.Log.InfofModule(moduleName, "revoking the commands of %s on %d nodes", cfg.User, len(nodes))
+	return modules.ForEach(ctx, nodes, func(ctx context.Context, node modules.Node) error {
+		if _, err := modules.Run(ctx, node.Conn, "rm -f "+shellquote.Quote(cfg.File())); err != nil {
+			return err
+		}
+		logger.Log.InfofModule(moduleName, "%s: removed %s", node.Name(), cfg.File())
+		return nil
+	})
+}
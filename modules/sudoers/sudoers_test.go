@@ -0,0 +1,87 @@
+package sudoers
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mensylisir/xmcores/connector"
+	"github.com/mensylisir/xmcores/connector/connectortest"
+	"github.com/mensylisir/xmcores/facts"
+	"github.com/mensylisir/xmcores/modules"
+)
+
+func TestValidate(t *testing.T) {
+	cfg := Config{User: "deploy", Packages: []string{"socat"}, Paths: []string{"/etc/sysctl.d/99-k8s.conf"}}
+	cfg.SetDefaults()
+	require.NoError(t, cfg.Validate())
+	assert.Equal(t, DefaultServices, cfg.Services)
+	assert.Equal(t, "/etc/sudoers.d/xmcores-grants-deploy", cfg.File())
+
+	err := Config{Services: []string{"kubelet; reboot"}, Packages: []string{"-y"}, Paths: []string{"etc/hosts", "/etc/a b"}, Commands: []string{"/bin/sh -c a,b"}}.Validate()
+	assert.ErrorContains(t, err, "user is required")
+	assert.ErrorContains(t, err, "services[0]")
+	assert.ErrorContains(t, err, "packages[0]")
+	assert.ErrorContains(t, err, "paths[0]")
+	assert.ErrorContains(t, err, "paths[1]")
+	assert.ErrorContains(t, err, "commands[0]")
+	assert.ErrorContains(t, Config{User: "root"}.Validate(), `invalid account name "root"`)
+}
+
+func TestGrants(t *testing.T) {
+	cfg := Config{User: "deploy", Services: []string{"kubelet"}, Packages: []string{"socat"}, Paths: []string{"/etc/hosts"}, Commands: []string{"/usr/bin/crictl ps"}}
+	programs := Programs{"systemctl": "/usr/bin/systemctl", "apt-get": "/usr/bin/apt-get", "apk": "/sbin/apk", "rc-service": "/sbin/rc-service", "tee": "/usr/bin/tee"}
+
+	assert.Equal(t, `# Managed by xmcores: the commands deploy may run as root.
+Cmnd_Alias XM_SERVICES = /usr/bin/systemctl daemon-reload, /usr/bin/systemctl start kubelet, /usr/bin/systemctl stop kubelet, /usr/bin/systemctl restart kubelet, /usr/bin/systemctl enable kubelet, /usr/bin/systemctl disable kubelet
+Cmnd_Alias XM_PACKAGES = /usr/bin/apt-get install -y socat
+Cmnd_Alias XM_FILES = /usr/bin/tee /etc/hosts
+Cmnd_Alias XM_CONFIG = /usr/bin/crictl ps
+deploy ALL=(root) NOPASSWD: XM_SERVICES, XM_PACKAGES, XM_FILES, XM_CONFIG
+`, modules.RenderSudoers(cfg.User, cfg.Grants(facts.PackageManagerApt, facts.InitSystemd, programs)))
+
+	alpine := cfg.Grants(facts.PackageManagerApk, facts.InitOpenRC, programs)
+	assert.Equal(t, []string{"/sbin/rc-service kubelet start", "/sbin/rc-service kubelet stop", "/sbin/rc-service kubelet restart"}, alpine[0].Commands)
+	assert.Equal(t, []string{"/sbin/apk add --no-cache socat"}, alpine[1].Commands)
+
+	missing := cfg.Grants(facts.PackageManagerDnf, facts.InitSystemd, Programs{})
+	assert.Empty(t, missing[0].Commands, "programs missing on the node are not granted")
+	assert.Empty(t, missing[1].Commands)
+	assert.Empty(t, missing[2].Commands)
+}
+
+func TestInstallAndRemove(t *testing.T) {
+	ctx := context.Background()
+	fake := connectortest.NewFake().
+		On(`cat /etc/os-release`, connectortest.Result{Stdout: "ID=rocky\nID_LIKE=\"rhel centos fedora\"\nVERSION_ID=9.4\n"}).
+		On(`command -v`, connectortest.Result{Stdout: "/usr/bin/systemctl\n/usr/bin/dnf\n/usr/bin/tee\n"})
+	host := connector.NewHost()
+	host.SetName("node1")
+	nodes := []modules.Node{{Host: host, Conn: fake}}
+	cfg := Config{User: "deploy", Services: []string{"containerd"}, Packages: []string{"conntrack-tools"}}
+
+	require.NoError(t, Install(ctx, nodes, cfg))
+	assert.True(t, fake.Ran(`visudo -cf /etc/sudoers\.d/\.xmcores-grants-deploy\.[0-9a-f]+\.tmp .* mv -f .* /etc/sudoers\.d/xmcores-grants-deploy `))
+	var content string
+	for _, name := range fake.Files() {
+		if strings.Contains(name, ".xmcores-grants-deploy.") {
+			data, _ := fake.ReadFile(name)
+			content = string(data)
+		}
+	}
+	assert.Contains(t, content, "Cmnd_Alias XM_SERVICES = /usr/bin/systemctl daemon-reload, /usr/bin/systemctl start containerd,")
+	assert.Contains(t, content, "Cmnd_Alias XM_PACKAGES = /usr/bin/dnf install -y conntrack-tools\n")
+	assert.Contains(t, content, "deploy ALL=(root) NOPASSWD: XM_SERVICES, XM_PACKAGES\n")
+
+	require.NoError(t, Remove(ctx, nodes, cfg))
+	assert.True(t, fake.Ran(`rm -f /etc/sudoers\.d/xmcores-grants-deploy`))
+
+	failing := connectortest.NewFake().
+		On(`cat /etc/os-release`, connectortest.Result{Stdout: "ID=ubuntu\n"}).
+		On(`visudo`, connectortest.Result{Stderr: "parse error", ExitCode: 1})
+	err := Install(ctx, []modules.Node{{Host: host, Conn: failing}}, cfg)
+	assert.ErrorContains(t, err, "failed to install /etc/sudoers.d/xmcores-grants-deploy")
+}
@@ -0,0 +1,202 @@
+// Package systune loads the kernel modules and applies the sysctls Kubernetes
+// networking needs, persists them across reboots and reports values that were
+// previously set to something else.
+package systune
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/mensylisir/xmcores/common"
+	"github.com/mensylisir/xmcores/logger"
+	"github.com/mensylisir/xmcores/modules"
+	"github.com/mensylisir/xmcores/shellquote"
+)
+
+const moduleName = "SysTune"
+
+const (
+	ModulesLoadPath = "/etc/modules-load.d/xmcores.conf"
+	SysctlPath      = "/etc/sysctl.d/99-xmcores.conf"
+)
+
+// DefaultKernelModules are loaded on every node.
+var DefaultKernelModules = []string{"overlay", "br_netfilter"}
+
+// DefaultSysctls are applied on every node.
+var DefaultSysctls = map[string]string{
+	"net.ipv4.ip_forward":                 "1",
+	"net.bridge.bridge-nf-call-iptables":  "1",
+	"net.bridge.bridge-nf-call-ip6tables": "1",
+}
+
+// Config holds overrides on top of the defaults.
+type Config struct {
+	// KernelModules are loaded in addition to DefaultKernelModules.
+	KernelModules []string `yaml:"kernelModules,omitempty" json:"kernelModules,omitempty"`
+	// Sysctls override or extend DefaultSysctls. An empty value drops a default.
+	Sysctls map[string]string `yaml:"sysctls,omitempty" json:"sysctls,omitempty"`
+}
+
+// Effective returns the kernel modules and sysctls after merging overrides into the defaults.
+func (c Config) Effective() ([]string, map[string]string) {
+	mods := append(append([]string{}, DefaultKernelModules...), c.KernelModules...)
+	sort.Strings(mods)
+	uniq := mods[:0]
+	for i, m := range mods {
+		if m != "" && (i == 0 || m != mods[i-1]) {
+			uniq = append(uniq, m)
+		}
+	}
+
+	sysctls := make(map[string]string, len(DefaultSysctls)+len(c.Sysctls))
+	for k, v := range DefaultSysctls {
+		sysctls[k] = v
+	}
+	for k, v := range c.Sysctls {
+		if v == "" {
+			delete(sysctls, k)
+			continue
+		}
+		sysctls[k] = v
+	}
+	return uniq, sysctls
+}
+
+// Validate checks the overrides.
+func (c Config) Validate() error {
+	for _, m := range c.KernelModules {
+		if strings.ContainsAny(m, " \t/;&|$`") {
+			return fmt.Errorf("invalid kernel module name %q", m)
+		}
+	}
+	for k, v := range c.Sysctls {
+		if k == "" || strings.ContainsAny(k, " \t=;&|$`") {
+			return fmt.Errorf("invalid sysctl key %q", k)
+		}
+		if strings.ContainsAny(v, "\n;&|$`") {
+			return fmt.Errorf("invalid value %q for sysctl %s", v, k)
+		}
+	}
+	return nil
+}
+
+// ModulesLoadFile renders the modules-load.d file.
+func ModulesLoadFile(mods []string) string {
+	return "# Managed by xmcores\n" + strings.Join(mods, "\n") + "\n"
+}
+
+// SysctlFile renders the sysctl.d file with keys in sorted order.
+func SysctlFile(sysctls map[string]string) string {
+	var b strings.Builder
+	b.WriteString("# Managed by xmcores\n")
+	for _, k := range sortedKeys(sysctls) {
+		fmt.Fprintf(&b, "%s = %s\n", k, sysctls[k])
+	}
+	return b.String()
+}
+
+// Drift is a sysctl that was set to a different value before it was applied.
+type Drift struct {
+	Key      string
+	Expected string
+	Actual   string
+}
+
+func (d Drift) String() string {
+	return fmt.Sprintf("%s: expected %q, found %q", d.Key, d.Expected, d.Actual)
+}
+
+// Report is the outcome of tuning one node.
+type Report struct {
+	Node  string
+	Drift []Drift
+}
+
+// normalizeValue collapses whitespace so "4096 87380" and "4096\t87380" compare equal.
+func normalizeValue(v string) string {
+	return strings.Join(strings.Fields(v), " ")
+}
+
+// DetectDrift returns the sysctls whose current value on node differs from the expected one.
+// Keys that do not exist yet (e.g. bridge sysctls before br_netfilter is loaded) are not drift.
+func DetectDrift(ctx context.Context, node modules.Node, sysctls map[string]string) ([]Drift, error) {
+	var drift []Drift
+	for _, k := range sortedKeys(sysctls) {
+		stdout, _, exitCode, err := node.Conn.Exec(ctx, "sysctl -n "+shellquote.Quote(k))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read sysctl %s: %w", k, err)
+		}
+		if exitCode != 0 {
+			continue
+		}
+		got := normalizeValue(string(stdout))
+		if want := normalizeValue(sysctls[k]); got != want {
+			drift = append(drift, Drift{Key: k, Expected: want, Actual: got})
+		}
+	}
+	return drift, nil
+}
+
+// Apply loads the kernel modules and applies the sysctls on node, persisting both.
+// The returned report lists values that differed before they were applied.
+func Apply(ctx context.Context, node modules.Node, cfg Config) (Report, error) {
+	report := Report{Node: node.Name()}
+	mods, sysctls := cfg.Effective()
+
+	for _, m := range mods {
+		if _, err := modules.Run(ctx, node.Conn, "modprobe "+shellquote.Quote(m)); err != nil {
+			return report, err
+		}
+	}
+	drift, err := DetectDrift(ctx, node, sysctls)
+	if err != nil {
+		return report, err
+	}
+	report.Drift = drift
+
+	if err := modules.WriteFile(ctx, node.Conn, []byte(ModulesLoadFile(mods)), ModulesLoadPath, common.FileMode0644); err != nil {
+		return report, err
+	}
+	if err := modules.WriteFile(ctx, node.Conn, []byte(SysctlFile(sysctls)), SysctlPath, common.FileMode0644); err != nil {
+		return report, err
+	}
+	if _, err := modules.Run(ctx, node.Conn, "sysctl -p "+SysctlPath); err != nil {
+		return report, err
+	}
+	return report, nil
+}
+
+// Deploy tunes all nodes and returns one report per node. Drift is logged as a
+// warning; it is not an error because the values are corrected.
+func Deploy(ctx context.Context, nodes []modules.Node, cfg Config) ([]Report, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	var mu sync.Mutex
+	reports := make([]Report, 0, len(nodes))
+	err := modules.ForEach(ctx, nodes, func(ctx context.Context, node modules.Node) error {
+		report, err := Apply(ctx, node, cfg)
+		mu.Lock()
+		reports = append(reports, report)
+		mu.Unlock()
+		for _, d := range report.Drift {
+			logger.Log.WarnfModule(moduleName, "%s: sysctl drift corrected: %s", node.Name(), d)
+		}
+		return err
+	})
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Node < reports[j].Node })
+	return reports, err
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
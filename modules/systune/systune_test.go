@@ -0,0 +1,79 @@
+package systune
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mensylisir/xmcores/connector"
+	"github.com/mensylisir/xmcores/connector/connectortest"
+	"github.com/mensylisir/xmcores/errs"
+	"github.com/mensylisir/xmcores/modules"
+)
+
+func TestEffective(t *testing.T) {
+	cfg := Config{
+		KernelModules: []string{"ip_vs", "overlay"},
+		Sysctls: map[string]string{
+			"net.ipv4.ip_forward":                 "1",
+			"net.bridge.bridge-nf-call-ip6tables": "",
+			"vm.max_map_count":                    "262144",
+		},
+	}
+	mods, sysctls := cfg.Effective()
+	assert.Equal(t, []string{"br_netfilter", "ip_vs", "overlay"}, mods)
+	assert.Equal(t, map[string]string{
+		"net.ipv4.ip_forward":                "1",
+		"net.bridge.bridge-nf-call-iptables": "1",
+		"vm.max_map_count":                   "262144",
+	}, sysctls)
+
+	// Defaults must not be modified by merging.
+	assert.Equal(t, "1", DefaultSysctls["net.bridge.bridge-nf-call-ip6tables"])
+	assert.Equal(t, []string{"overlay", "br_netfilter"}, DefaultKernelModules)
+}
+
+func TestValidate(t *testing.T) {
+	assert.NoError(t, Config{Sysctls: map[string]string{"net.ipv4.tcp_rmem": "4096 87380 6291456"}}.Validate())
+	assert.Error(t, Config{KernelModules: []string{"overlay; reboot"}}.Validate())
+	assert.Error(t, Config{Sysctls: map[string]string{"a=b": "1"}}.Validate())
+	assert.Error(t, Config{Sysctls: map[string]string{"vm.swappiness": "1 && reboot"}}.Validate())
+}
+
+func TestRender(t *testing.T) {
+	assert.Equal(t, "# Managed by xmcores\noverlay\nbr_netfilter\n", ModulesLoadFile([]string{"overlay", "br_netfilter"}))
+	assert.Equal(t, "# Managed by xmcores\na.b = 1\nc.d = 0\n", SysctlFile(map[string]string{"c.d": "0", "a.b": "1"}))
+	assert.Equal(t, "4096 87380", normalizeValue("4096\t87380\n"))
+}
+
+func TestDeploy(t *testing.T) {
+	fakes := connectortest.NewConnector()
+	fakes.Host("node1").
+		On(`sysctl -n net.ipv4.ip_forward`, connectortest.Result{Stdout: "0\n"}).
+		On(`sysctl -n net.bridge`, connectortest.Result{Stdout: "1\n"})
+	fakes.Host("node2").On(`modprobe br_netfilter`, connectortest.Result{Stderr: "module not found", ExitCode: 1})
+
+	var hosts []connector.Host
+	for _, name := range []string{"node1", "node2"} {
+		h := connector.NewHost()
+		h.SetName(name)
+		hosts = append(hosts, h)
+	}
+	nodes, err := modules.ConnectWith(context.Background(), hosts, fakes.Dial)
+	require.NoError(t, err)
+
+	reports, err := Deploy(context.Background(), nodes, Config{})
+	require.Error(t, err)
+	assert.Equal(t, errs.Execution, errs.KindOf(err))
+	assert.Contains(t, err.Error(), "node2")
+
+	require.Len(t, reports, 2)
+	assert.Equal(t, []Drift{{Key: "net.ipv4.ip_forward", Expected: "1", Actual: "0"}}, reports[0].Drift)
+	conf, ok := fakes.Host("node1").ReadFile(SysctlPath)
+	require.True(t, ok)
+	assert.Contains(t, string(conf), "net.ipv4.ip_forward = 1")
+	assert.True(t, fakes.Host("node1").Ran(`sysctl -p `+SysctlPath))
+	assert.False(t, fakes.Host("node2").Ran(`sysctl -p`), "node2 stops at the failed modprobe")
+}
@@ -0,0 +1,244 @@
+// Package timesync installs and configures chrony or systemd-timesyncd on all
+// nodes. It must run before certificates are generated: a node whose clock is
+// off rejects certificates that are not yet valid.
+package timesync
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mensylisir/xmcores/common"
+	"github.com/mensylisir/xmcores/facts"
+	"github.com/mensylisir/xmcores/logger"
+	"github.com/mensylisir/xmcores/modules"
+	"github.com/mensylisir/xmcores/wait"
+)
+
+const moduleName = "TimeSync"
+
+// Providers.
+const (
+	ProviderChrony    = "chrony"
+	ProviderTimesyncd = "timesyncd"
+)
+
+const (
+	DefaultMaxOffset   = 500 * time.Millisecond
+	DefaultSyncTimeout = 2 * time.Minute
+)
+
+// Config describes the time synchronization setup.
+type Config struct {
+	// Servers are NTP servers or pools. Required.
+	Servers []string `yaml:"servers,omitempty" json:"servers,omitempty"`
+	// Provider is chrony (default) or timesyncd.
+	Provider string `yaml:"provider,omitempty" json:"provider,omitempty"`
+	// AllowCIDRs lets chrony serve time to these networks, e.g. when only one node reaches the upstream servers.
+	AllowCIDRs []string `yaml:"allowCIDRs,omitempty" json:"allowCIDRs,omitempty"`
+	// MaxOffset is the largest tolerated clock offset once synchronized.
+	MaxOffset time.Duration `yaml:"maxOffset,omitempty" json:"maxOffset,omitempty"`
+	// SyncTimeout bounds how long to wait for synchronization.
+	SyncTimeout time.Duration `yaml:"syncTimeout,omitempty" json:"syncTimeout,omitempty"`
+}
+
+// SetDefaults fills unset fields.
+func (c *Config) SetDefaults() {
+	if c.Provider == "" {
+		c.Provider = ProviderChrony
+	}
+	if c.MaxOffset == 0 {
+		c.MaxOffset = DefaultMaxOffset
+	}
+	if c.SyncTimeout == 0 {
+		c.SyncTimeout = DefaultSyncTimeout
+	}
+}
+
+// Validate checks the configuration.
+func (c *Config) Validate() error {
+	if len(c.Servers) == 0 {
+		return fmt.Errorf("at least one NTP server must be configured")
+	}
+	switch c.Provider {
+	case ProviderChrony:
+	case ProviderTimesyncd:
+		if len(c.AllowCIDRs) > 0 {
+			return fmt.Errorf("allowCIDRs requires provider %s", ProviderChrony)
+		}
+	default:
+		return fmt.Errorf("unsupported time sync provider %q", c.Provider)
+	}
+	return nil
+}
+
+// ChronyConfig renders chrony.conf.
+func ChronyConfig(cfg Config) string {
+	var b strings.Builder
+	b.WriteString("# Managed by xmcores\n")
+	for _, s := range cfg.Servers {
+		directive := "server"
+		if strings.Contains(s, "pool") {
+			directive = "pool"
+		}
+		fmt.Fprintf(&b, "%s %s iburst\n", directive, s)
+	}
+	b.WriteString("driftfile /var/lib/chrony/drift\n")
+	b.WriteString("makestep 1.0 3\n")
+	b.WriteString("rtcsync\n")
+	for _, cidr := range cfg.AllowCIDRs {
+		fmt.Fprintf(&b, "allow %s\n", cidr)
+	}
+	b.WriteString("logdir /var/log/chrony\n")
+	return b.String()
+}
+
+// TimesyncdConfig renders the systemd-timesyncd drop-in.
+func TimesyncdConfig(cfg Config) string {
+	return fmt.Sprintf("# Managed by xmcores\n[Time]\nNTP=%s\n", strings.Join(cfg.Servers, " "))
+}
+
+// Status is the synchronization state reported by a node.
+type Status struct {
+	Synchronized bool
+	Offset       time.Duration
+}
+
+// ParseChronyTracking parses `chronyc tracking` output.
+func ParseChronyTracking(out string) (Status, error) {
+	var st Status
+	var sawTime bool
+	for _, line := range strings.Split(out, "\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.TrimSpace(key) {
+		case "Leap status":
+			st.Synchronized = value != "Not synchronised"
+		case "System time":
+			fields := strings.Fields(value)
+			if len(fields) < 2 {
+				return st, fmt.Errorf("unexpected system time %q", value)
+			}
+			secs, err := strconv.ParseFloat(fields[0], 64)
+			if err != nil {
+				return st, fmt.Errorf("unexpected system time %q: %w", value, err)
+			}
+			st.Offset = time.Duration(math.Abs(secs) * float64(time.Second))
+			sawTime = true
+		}
+	}
+	if !sawTime {
+		return st, fmt.Errorf("chronyc tracking output has no system time")
+	}
+	return st, nil
+}
+
+// ParseTimedatectl parses `timedatectl show -p NTPSynchronized --value` output.
+func ParseTimedatectl(out string) Status {
+	return Status{Synchronized: strings.TrimSpace(out) == "yes"}
+}
+
+// Apply installs and configures the provider on node and restarts it.
+func Apply(ctx context.Context, node modules.Node, cfg Config) error {
+	if cfg.Provider == ProviderTimesyncd {
+		if _, err := modules.Run(ctx, node.Conn, fmt.Sprintf(common.MkdirCmdTpl, "/etc/systemd/timesyncd.conf.d")); err != nil {
+			return err
+		}
+		if _, err := modules.WriteFileWith(ctx, node, []byte(TimesyncdConfig(cfg)), "/etc/systemd/timesyncd.conf.d/xmcores.conf", common.FileMode0644, modules.WriteOptions{}); err != nil {
+			return err
+		}
+		return modules.RunAll(ctx, node.Conn, "timedatectl set-ntp true", "systemctl restart systemd-timesyncd")
+	}
+
+	rel, err := facts.DetectOSRelease(ctx, node.Conn)
+	if err != nil {
+		return err
+	}
+	installed, err := modules.Succeeds(ctx, node.Conn, "command -v chronyd")
+	if err != nil {
+		return err
+	}
+	if !installed {
+		if err := modules.InstallPackages(ctx, node, rel.PackageManager(), "chrony"); err != nil {
+			return err
+		}
+	}
+
+	// Debian-based systems name the unit and the config path differently,
+	// Alpine only the config path.
+	confPath, service := "/etc/chrony.conf", "chronyd"
+	switch rel.PackageManager() {
+	case facts.PackageManagerApt:
+		confPath, service = "/etc/chrony/chrony.conf", "chrony"
+	case facts.PackageManagerApk:
+		confPath = "/etc/chrony/chrony.conf"
+	}
+	if _, err := modules.WriteFileWith(ctx, node, []byte(ChronyConfig(cfg)), confPath, common.FileMode0644, modules.WriteOptions{}); err != nil {
+		return err
+	}
+	if rel.InitSystem() == facts.InitSystemd {
+		if _, err := modules.Run(ctx, node.Conn, "systemctl disable --now systemd-timesyncd 2>/dev/null || true"); err != nil {
+			return err
+		}
+	}
+	for _, action := range []string{modules.ServiceEnable, modules.ServiceRestart} {
+		if err := modules.Service(ctx, node, rel.InitSystem(), action, service); err != nil {
+			return err
+		}
+	}
+	_, err = modules.Run(ctx, node.Conn, "chronyc -a makestep || true")
+	return err
+}
+
+// Check returns the current synchronization status of node.
+func Check(ctx context.Context, node modules.Node, cfg Config) (Status, error) {
+	if cfg.Provider == ProviderTimesyncd {
+		out, err := modules.Run(ctx, node.Conn, "timedatectl show -p NTPSynchronized --value")
+		if err != nil {
+			return Status{}, err
+		}
+		return ParseTimedatectl(out), nil
+	}
+	out, err := modules.Run(ctx, node.Conn, "chronyc tracking")
+	if err != nil {
+		return Status{}, err
+	}
+	return ParseChronyTracking(out)
+}
+
+// WaitSynchronized polls node until it is synchronized within MaxOffset or SyncTimeout expires.
+func WaitSynchronized(ctx context.Context, node modules.Node, cfg Config) error {
+	opts := wait.Options{Timeout: cfg.SyncTimeout, Interval: 5 * time.Second}
+	return wait.Poll(ctx, opts, "clock synchronization", func(ctx context.Context) (bool, error) {
+		st, err := Check(ctx, node, cfg)
+		if err != nil {
+			return false, err
+		}
+		if !st.Synchronized || st.Offset > cfg.MaxOffset {
+			return false, fmt.Errorf("synchronized=%t, offset=%s, max %s", st.Synchronized, st.Offset, cfg.MaxOffset)
+		}
+		return true, nil
+	})
+}
+
+// Deploy configures time synchronization on all nodes and waits until every
+// clock is synchronized. Call it before generating PKI.
+func Deploy(ctx context.Context, nodes []modules.Node, cfg Config) error {
+	cfg.SetDefaults()
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	logger.Log.InfofModule(moduleName, "configuring %s on %d nodes", cfg.Provider, len(nodes))
+	return modules.ForEach(ctx, nodes, func(ctx context.Context, node modules.Node) error {
+		if err := Apply(ctx, node, cfg); err != nil {
+			return err
+		}
+		return WaitSynchronized(ctx, node, cfg)
+	})
+}
@@ -0,0 +1,56 @@
+package timesync
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigValidate(t *testing.T) {
+	cfg := Config{Servers: []string{"ntp.example.com"}}
+	cfg.SetDefaults()
+	require.NoError(t, cfg.Validate())
+	assert.Equal(t, ProviderChrony, cfg.Provider)
+
+	assert.Error(t, (&Config{Provider: ProviderChrony}).Validate())
+	assert.Error(t, (&Config{Servers: []string{"a"}, Provider: "ntpd"}).Validate())
+	assert.Error(t, (&Config{Servers: []string{"a"}, Provider: ProviderTimesyncd, AllowCIDRs: []string{"10.0.0.0/8"}}).Validate())
+}
+
+func TestChronyConfig(t *testing.T) {
+	conf := ChronyConfig(Config{
+		Servers:    []string{"10.0.0.1", "pool.ntp.org"},
+		AllowCIDRs: []string{"10.0.0.0/24"},
+	})
+	assert.Contains(t, conf, "server 10.0.0.1 iburst\n")
+	assert.Contains(t, conf, "pool pool.ntp.org iburst\n")
+	assert.Contains(t, conf, "allow 10.0.0.0/24\n")
+	assert.Contains(t, conf, "makestep 1.0 3\n")
+
+	assert.Equal(t, "# Managed by xmcores\n[Time]\nNTP=a b\n", TimesyncdConfig(Config{Servers: []string{"a", "b"}}))
+}
+
+func TestParseChronyTracking(t *testing.T) {
+	st, err := ParseChronyTracking(`Reference ID    : C0A80101 (192.168.1.1)
+Stratum         : 3
+System time     : 0.000123000 seconds slow of NTP time
+Last offset     : -0.000010 seconds
+Leap status     : Normal
+`)
+	require.NoError(t, err)
+	assert.True(t, st.Synchronized)
+	assert.Equal(t, 123*time.Microsecond, st.Offset)
+
+	st, err = ParseChronyTracking("System time     : 12.5 seconds fast of NTP time\nLeap status     : Not synchronised\n")
+	require.NoError(t, err)
+	assert.False(t, st.Synchronized)
+	assert.Equal(t, 12500*time.Millisecond, st.Offset)
+
+	_, err = ParseChronyTracking("506 Cannot talk to daemon")
+	assert.Error(t, err)
+
+	assert.True(t, ParseTimedatectl("yes\n").Synchronized)
+	assert.False(t, ParseTimedatectl("no").Synchronized)
+}
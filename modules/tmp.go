@@ -0,0 +1,119 @@
+package modules
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mensylisir/xmcores/common"
+	"github.com/mensylisir/xmcores/errs"
+	"github.com/mensylisir/xmcores/shellquote"
+)
+
+// TempFiles tracks the remote temporary paths created during a run, so that
+// those left behind by a failed step can be removed at the end. It is safe
+// for concurrent use.
+type TempFiles struct {
+	mu    sync.Mutex
+	paths map[string]map[string]bool
+}
+
+// NewTempFiles returns an empty registry.
+func NewTempFiles() *TempFiles {
+	return &TempFiles{paths: map[string]map[string]bool{}}
+}
+
+// Add records path as created on host.
+func (t *TempFiles) Add(host, p string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.paths[host] == nil {
+		t.paths[host] = map[string]bool{}
+	}
+	t.paths[host][p] = true
+}
+
+// Done records that path on host has been removed.
+func (t *TempFiles) Done(host, p string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.paths[host], p)
+}
+
+// Pending returns the paths not removed yet, sorted, by host.
+func (t *TempFiles) Pending(host string) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make([]string, 0, len(t.paths[host]))
+	for p := range t.paths[host] {
+		out = append(out, p)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Clean removes the pending paths of every node.
+func (t *TempFiles) Clean(ctx context.Context, nodes []Node) error {
+	return ForEach(ctx, nodes, func(ctx context.Context, node Node) error {
+		pending := t.Pending(node.Name())
+		if len(pending) == 0 {
+			return nil
+		}
+		if _, err := Run(ctx, node.Conn, "rm -rf "+shellquote.Join(pending...)); err != nil {
+			return fmt.Errorf("failed to remove temporary files: %w", err)
+		}
+		for _, p := range pending {
+			t.Done(node.Name(), p)
+		}
+		return nil
+	})
+}
+
+type tempFilesKey struct{}
+
+// WithTempFiles returns a context carrying t, where TrackTemp records paths.
+func WithTempFiles(ctx context.Context, t *TempFiles) context.Context {
+	return context.WithValue(ctx, tempFilesKey{}, t)
+}
+
+// TempFilesFrom returns the registry carried by ctx, if any.
+func TempFilesFrom(ctx context.Context) (*TempFiles, bool) {
+	t, ok := ctx.Value(tempFilesKey{}).(*TempFiles)
+	return t, ok
+}
+
+// TrackTemp records that path was created on node, if ctx carries a
+// registry. Call UntrackTemp once the path is removed.
+func TrackTemp(ctx context.Context, node Node, p string) {
+	if t, ok := TempFilesFrom(ctx); ok {
+		t.Add(node.Name(), p)
+	}
+}
+
+// UntrackTemp records that path was removed from node.
+func UntrackTemp(ctx context.Context, node Node, p string) {
+	if t, ok := TempFilesFrom(ctx); ok {
+		t.Done(node.Name(), p)
+	}
+}
+
+// CleanTmpDir removes the entries of the xmcores temporary directory on node
+// (see common.GetTmpDir) that were last modified more than olderThan ago;
+// zero removes all of them. Only call it while no other run uses the node.
+func CleanTmpDir(ctx context.Context, node Node, olderThan time.Duration) error {
+	dir := path.Clean(common.GetTmpDir())
+	if dir == "/" || dir == "." || !strings.HasPrefix(dir, "/") {
+		return errs.Wrap(errs.Config, errors.New("refusing to clean temporary directory "+dir))
+	}
+	cmd := fmt.Sprintf("test ! -d %[1]s || find %[1]s -mindepth 1 -maxdepth 1", shellquote.Quote(dir))
+	if minutes := int(olderThan / time.Minute); minutes > 0 {
+		cmd += fmt.Sprintf(" -mmin +%d", minutes)
+	}
+	_, err := Run(ctx, node.Conn, cmd+" -exec rm -rf {} +")
+	return err
+}
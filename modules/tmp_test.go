@@ -0,0 +1,38 @@
+package modules_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mensylisir/xmcores/connector"
+	"github.com/mensylisir/xmcores/connector/connectortest"
+	"github.com/mensylisir/xmcores/modules"
+)
+
+func TestTempFiles(t *testing.T) {
+	ctx := context.Background()
+	fake := connectortest.NewFake()
+	host := connector.NewHost()
+	host.SetName("node1")
+	node := modules.Node{Host: host, Conn: fake}
+
+	modules.TrackTemp(ctx, node, "/tmp/xmcores/ignored")
+	temps := modules.NewTempFiles()
+	ctx = modules.WithTempFiles(ctx, temps)
+	modules.TrackTemp(ctx, node, "/tmp/xmcores/b")
+	modules.TrackTemp(ctx, node, "/tmp/xmcores/a")
+	modules.TrackTemp(ctx, node, "/tmp/xmcores/done")
+	modules.UntrackTemp(ctx, node, "/tmp/xmcores/done")
+	assert.Equal(t, []string{"/tmp/xmcores/a", "/tmp/xmcores/b"}, temps.Pending("node1"))
+
+	require.NoError(t, temps.Clean(ctx, []modules.Node{node}))
+	assert.True(t, fake.Ran(`rm -rf /tmp/xmcores/a /tmp/xmcores/b`))
+	assert.Empty(t, temps.Pending("node1"))
+
+	require.NoError(t, modules.CleanTmpDir(ctx, node, 2*time.Hour))
+	assert.True(t, fake.Ran(`find /tmp/xmcores -mindepth 1 -maxdepth 1 -mmin \+120 -exec rm -rf \{\} \+`))
+}
@@ -0,0 +1,227 @@
+// Package trustca installs CA certificates the user provides into the system
+// trust store of every node, so that curl, package managers and the kubelet
+// trust services signed by them, and into the registry configuration of
+// containerd for the registries they sign.
+package trustca
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/mensylisir/xmcores/common"
+	"github.com/mensylisir/xmcores/facts"
+	"github.com/mensylisir/xmcores/logger"
+	"github.com/mensylisir/xmcores/modules"
+	"github.com/mensylisir/xmcores/modules/registrycheck"
+	"github.com/mensylisir/xmcores/shellquote"
+)
+
+const moduleName = "TrustCA"
+
+// FilePrefix starts the names of the certificates installed in the trust
+// store, so that they are told apart from those of the distribution.
+const FilePrefix = "xmcores-"
+
+var (
+	nameRE     = regexp.MustCompile(`^[a-z0-9]([a-z0-9._-]*[a-z0-9])?$`)
+	registryRE = regexp.MustCompile(`^[A-Za-z0-9.-]+(:[0-9]+)?$`)
+)
+
+// CA is a certificate authority to trust.
+type CA struct {
+	// Name names the installed file, e.g. corp-root. Required.
+	Name string `yaml:"name" json:"name"`
+	// File is the PEM file on the controller holding the certificates.
+	// Required.
+	File string `yaml:"file" json:"file"`
+	// Registries are the registries, host[:port], containerd trusts the CA
+	// for.
+	Registries []string `yaml:"registries,omitempty" json:"registries,omitempty"`
+}
+
+// Validate checks the entry and that File holds certificates.
+func (c *CA) Validate() error {
+	var errList []error
+	if !nameRE.MatchString(c.Name) {
+		errList = append(errList, fmt.Errorf("invalid name %q: use lower case letters, digits, '.', '_' and '-'", c.Name))
+	}
+	if c.File == "" {
+		errList = append(errList, errors.New("file must be set"))
+	} else if _, err := Load(c.File); err != nil {
+		errList = append(errList, err)
+	}
+	for i, r := range c.Registries {
+		if !registryRE.MatchString(r) {
+			errList = append(errList, fmt.Errorf("registries[%d]: %q is not a host[:port]", i, r))
+		}
+	}
+	return errors.Join(errList...)
+}
+
+// Load reads the PEM file path and checks that it holds certificates only.
+func Load(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	rest, n := data, 0
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			return nil, fmt.Errorf("%s: unexpected %s block, only certificates are trusted", path, block.Type)
+		}
+		if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		n++
+	}
+	if n == 0 {
+		return nil, fmt.Errorf("%s holds no PEM certificate", path)
+	}
+	return data, nil
+}
+
+// Store is the trust store of a distribution family.
+type Store struct {
+	// Dir holds the certificates added by the administrator.
+	Dir string
+	// Update rebuilds the bundle from Dir.
+	Update string
+}
+
+// Stores per package manager family.
+var (
+	storeDebian = Store{Dir: "/usr/local/share/ca-certificates", Update: "update-ca-certificates"}
+	storeRHEL   = Store{Dir: "/etc/pki/ca-trust/source/anchors", Update: "update-ca-trust extract"}
+)
+
+// StoreFor returns the trust store of the distribution rel.
+func StoreFor(rel facts.OSRelease) (Store, error) {
+	switch rel.PackageManager() {
+	case facts.PackageManagerApt, facts.PackageManagerApk:
+		return storeDebian, nil
+	case facts.PackageManagerYum, facts.PackageManagerDnf:
+		return storeRHEL, nil
+	}
+	return Store{}, fmt.Errorf("no known trust store on %s", rel.Pretty)
+}
+
+// HostsTOML renders the containerd hosts.toml of registry, trusting the CA at
+// caPath.
+func HostsTOML(registry, caPath string) string {
+	return fmt.Sprintf("# Managed by xmcores\nserver = \"https://%[1]s\"\n\n[host.\"https://%[1]s\"]\n  ca = \"%[2]s\"\n", registry, caPath)
+}
+
+// Apply installs cas on node: in the system trust store, rebuilt when a
+// certificate changed, and as the CA of each of their registries in
+// containerd. A hosts.toml the node already has, e.g. with mirrors, is left
+// alone.
+func Apply(ctx context.Context, node modules.Node, cas []CA) error {
+	if len(cas) == 0 {
+		return nil
+	}
+	rel, err := facts.DetectOSRelease(ctx, node.Conn)
+	if err != nil {
+		return err
+	}
+	store, err := StoreFor(rel)
+	if err != nil {
+		return err
+	}
+	if _, err := modules.Run(ctx, node.Conn, fmt.Sprintf(common.MkdirCmdTpl, shellquote.Quote(store.Dir))); err != nil {
+		return err
+	}
+	changed, registries := false, false
+	for _, ca := range cas {
+		data, err := Load(ca.File)
+		if err != nil {
+			return err
+		}
+		written, err := modules.WriteFileWith(ctx, node, data, path.Join(store.Dir, FilePrefix+ca.Name+".crt"), common.FileMode0644, modules.WriteOptions{})
+		if err != nil {
+			return err
+		}
+		changed = changed || written
+		for _, r := range ca.Registries {
+			registries = true
+			if err := applyRegistry(ctx, node, r, data); err != nil {
+				return fmt.Errorf("registry %s: %w", r, err)
+			}
+		}
+	}
+	if registries {
+		if err := checkConfigPath(ctx, node); err != nil {
+			return err
+		}
+	}
+	if !changed {
+		logger.Log.DebugfModule(moduleName, "%s: trust store up to date", node.Name())
+		return nil
+	}
+	if _, err := modules.Run(ctx, node.Conn, store.Update); err != nil {
+		return err
+	}
+	logger.Log.InfofModule(moduleName, "%s: trust store updated", node.Name())
+	return nil
+}
+
+func applyRegistry(ctx context.Context, node modules.Node, registry string, ca []byte) error {
+	caPath := registrycheck.CAPath(registry)
+	dir := path.Dir(caPath)
+	if _, err := modules.Run(ctx, node.Conn, fmt.Sprintf(common.MkdirCmdTpl, shellquote.Quote(dir))); err != nil {
+		return err
+	}
+	if _, err := modules.WriteFileWith(ctx, node, ca, caPath, common.FileMode0644, modules.WriteOptions{}); err != nil {
+		return err
+	}
+	hostsPath := path.Join(dir, "hosts.toml")
+	exists, err := modules.Succeeds(ctx, node.Conn, "test -f "+shellquote.Quote(hostsPath))
+	if err != nil {
+		return err
+	}
+	if exists {
+		current, err := modules.Run(ctx, node.Conn, "cat "+shellquote.Quote(hostsPath))
+		if err != nil {
+			return err
+		}
+		if !strings.Contains(current, caPath) {
+			logger.Log.WarnfModule(moduleName, "%s: %s does not reference %s, add it as the ca of the host", node.Name(), hostsPath, caPath)
+		}
+		return nil
+	}
+	return modules.WriteFile(ctx, node.Conn, []byte(HostsTOML(registry, caPath)), hostsPath, common.FileMode0644)
+}
+
+// ContainerdConfig is the configuration of containerd, which reads the
+// hosts.toml files only when its registry config_path is set.
+const ContainerdConfig = "/etc/containerd/config.toml"
+
+// checkConfigPath warns when containerd on node would ignore the registry
+// configuration.
+func checkConfigPath(ctx context.Context, node modules.Node) error {
+	ok, err := modules.Succeeds(ctx, node.Conn, fmt.Sprintf("grep -qs 'config_path *= *\"%s\"' %s", registrycheck.CertsDir, ContainerdConfig))
+	if err != nil || ok {
+		return err
+	}
+	logger.Log.WarnfModule(moduleName, "%s: %s does not set config_path = %q, containerd ignores the registry CAs", node.Name(), ContainerdConfig, registrycheck.CertsDir)
+	return nil
+}
+
+// Deploy runs Apply on every node concurrently.
+func Deploy(ctx context.Context, nodes []modules.Node, cas []CA) error {
+	logger.Log.InfofModule(moduleName, "installing %d CAs on %d nodes", len(cas), len(nodes))
+	return modules.ForEach(ctx, nodes, func(ctx context.Context, node modules.Node) error {
+		return Apply(ctx, node, cas)
+	})
+}
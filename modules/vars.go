@@ -0,0 +1,101 @@
+package modules
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/mensylisir/xmcores/connector"
+)
+
+// TemplateData returns what a per-host template can reference:
+//
+//	.Host.Name, .Host.Address, .Host.InternalAddress, .Host.Roles
+//	.Vars.<key>   the host's merged variables (see config.Cluster.HostVars)
+func TemplateData(host connector.Host) map[string]interface{} {
+	vars := host.GetVars()
+	if vars == nil {
+		vars = map[string]interface{}{}
+	}
+	return map[string]interface{}{
+		"Host": map[string]interface{}{
+			"Name":            host.GetName(),
+			"Address":         host.GetAddress(),
+			"InternalAddress": host.GetInternalIPv4Address(),
+			"Roles":           host.GetRoles(),
+		},
+		"Vars": vars,
+	}
+}
+
+// Render executes text as a template for host. Referencing a variable the
+// host does not define is an error rather than an empty string.
+func Render(host connector.Host, text string) (string, error) {
+	return RenderData(host, text, TemplateData(host))
+}
+
+// RenderData executes text as a template for host with data, which callers
+// build from TemplateData when they have more to offer than the host.
+func RenderData(host connector.Host, text string, data map[string]interface{}) (string, error) {
+	if !strings.Contains(text, "{{") {
+		return text, nil
+	}
+	tmpl, err := template.New(host.GetName()).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("invalid template %q: %w", text, err)
+	}
+	var buf strings.Builder
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("failed to render %q for host %s: %w", text, host.GetName(), err)
+	}
+	return buf.String(), nil
+}
+
+// RenderValues returns a copy of values with every string, at any depth,
+// rendered for host by Render.
+func RenderValues(host connector.Host, values map[string]interface{}) (map[string]interface{}, error) {
+	if values == nil {
+		return nil, nil
+	}
+	out, err := renderValue(host, values)
+	if err != nil {
+		return nil, err
+	}
+	return out.(map[string]interface{}), nil
+}
+
+func renderValue(host connector.Host, v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case string:
+		return Render(host, v)
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		// Keys are visited in order so the first error reported is stable.
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			r, err := renderValue(host, v[k])
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", k, err)
+			}
+			out[k] = r
+		}
+		return out, nil
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			r, err := renderValue(host, item)
+			if err != nil {
+				return nil, fmt.Errorf("[%d]: %w", i, err)
+			}
+			out[i] = r
+		}
+		return out, nil
+	default:
+		return v, nil
+	}
+}
@@ -0,0 +1,66 @@
+package modules
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/mensylisir/xmcores/connector"
+)
+
+// BackupTimeFormat is the timestamp in the names of backups kept by
+// WriteOptions.Backup, e.g. kubelet.env.20240131-150405.bak.
+const BackupTimeFormat = connector.BackupTimeFormat
+
+// WriteOptions controls how WriteFileWith and UploadFileWith replace a file,
+// see connector.WriteOptions.
+type WriteOptions = connector.WriteOptions
+
+// WriteFileWith writes content to remotePath like WriteFile, but leaves the
+// file alone when it already has that content and replaces it as selected by
+// opts. It reports whether the content changed.
+func WriteFileWith(ctx context.Context, node Node, content []byte, remotePath string, mode os.FileMode, opts WriteOptions) (bool, error) {
+	return replace(ctx, node, bytes.NewReader(content), remotePath, mode, opts)
+}
+
+// UploadFileWith is WriteFileWith for the content of the local file localPath,
+// which is streamed rather than read into memory.
+func UploadFileWith(ctx context.Context, node Node, localPath, remotePath string, mode os.FileMode, opts WriteOptions) (bool, error) {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return false, fmt.Errorf("failed to open %s: %w", localPath, err)
+	}
+	defer f.Close()
+	return replace(ctx, node, f, remotePath, mode, opts)
+}
+
+// replace writes remotePath with connector.ReplaceFile, tracking its
+// temporary file. With a Journal in ctx, the file replaced is backed up
+// first and the change recorded.
+func replace(ctx context.Context, node Node, src io.ReadSeeker, remotePath string, mode os.FileMode, opts WriteOptions) (bool, error) {
+	j, journaled := JournalFrom(ctx)
+	change := Change{Host: node.Name(), Kind: ChangeFile, Path: remotePath}
+	hooks := connector.ReplaceHooks{
+		Before: func(ctx context.Context, sum, prior string) error {
+			change.Sum, change.PriorSum = sum, prior
+			if !journaled || prior == "" {
+				return nil
+			}
+			var err error
+			change.Backup, err = j.backup(ctx, node, remotePath, prior)
+			return err
+		},
+		Temp:   func(tmp string) { TrackTemp(ctx, node, tmp) },
+		Placed: func(tmp string) { UntrackTemp(ctx, node, tmp) },
+	}
+	changed, err := connector.ReplaceFile(ctx, node.Conn, src, remotePath, mode, opts, hooks)
+	if err != nil || !changed {
+		return false, err
+	}
+	if journaled {
+		j.Record(change)
+	}
+	return true, nil
+}
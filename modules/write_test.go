@@ -0,0 +1,93 @@
+package modules_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mensylisir/xmcores/connector"
+	"github.com/mensylisir/xmcores/connector/connectortest"
+	"github.com/mensylisir/xmcores/modules"
+)
+
+func TestWriteFileWith(t *testing.T) {
+	ctx := context.Background()
+	content := []byte("KUBELET_EXTRA_ARGS=--max-pods=200\n")
+	sum := sha256.Sum256(content)
+
+	fake := connectortest.NewFake()
+	fake.On(`sha256sum /etc/default/kubelet`, connectortest.Result{Stdout: hex.EncodeToString(sum[:]) + "  /etc/default/kubelet\n"})
+	host := connector.NewHost()
+	host.SetName("node1")
+	node := modules.Node{Host: host, Conn: fake}
+
+	changed, err := modules.WriteFileWith(ctx, node, content, "/etc/default/kubelet", 0644, modules.WriteOptions{Backup: true})
+	require.NoError(t, err)
+	assert.False(t, changed)
+	assert.False(t, fake.Ran(`mv -f`), "an unchanged file is not replaced")
+
+	temps := modules.NewTempFiles()
+	ctx = modules.WithTempFiles(ctx, temps)
+	changed, err = modules.WriteFileWith(ctx, node, []byte("KUBELET_EXTRA_ARGS=\n"), "/etc/default/kubelet", 0644, modules.WriteOptions{Backup: true})
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.True(t, fake.Ran(`cp -p /etc/default/kubelet /etc/default/kubelet\.\d{8}-\d{6}\.bak; fi && mv -f /etc/default/\.kubelet\.[0-9a-f]{8}\.tmp /etc/default/kubelet`))
+	assert.Empty(t, temps.Pending("node1"))
+
+	var tmp string
+	for _, name := range fake.Files() {
+		if strings.HasPrefix(name, "/etc/default/.kubelet.") {
+			tmp = name
+		}
+	}
+	written, ok := fake.ReadFile(tmp)
+	require.True(t, ok, "the new content goes to a temporary file next to the target")
+	assert.Equal(t, "KUBELET_EXTRA_ARGS=\n", string(written))
+
+	changed, err = modules.WriteFileWith(ctx, node, content, "/etc/sysctl.d/xm.conf", 0644, modules.WriteOptions{})
+	require.NoError(t, err)
+	assert.True(t, changed)
+	written, ok = fake.ReadFile("/etc/sysctl.d/xm.conf")
+	require.True(t, ok, "without options the file is written in place")
+	assert.Equal(t, content, written)
+}
+
+func TestWriteOwnership(t *testing.T) {
+	ctx := context.Background()
+	fake := connectortest.NewFake()
+	host := connector.NewHost()
+	host.SetName("node1")
+	node := modules.Node{Host: host, Conn: fake}
+
+	_, err := modules.WriteFileWith(ctx, node, []byte("name: etcd\n"), "/etc/etcd/etcd.yaml", 0600, modules.WriteOptions{Atomic: true, Owner: "etcd", Group: "etcd"})
+	require.NoError(t, err)
+	assert.True(t, fake.Ran(`chown etcd:etcd /etc/etcd/\.etcd\.yaml\.[0-9a-f]{8}\.tmp && mv -f`), "ownership is set before the file is moved into place")
+
+	_, err = modules.WriteFileWith(ctx, node, []byte("x"), "/etc/kubernetes/x.conf", 0600, modules.WriteOptions{Owner: "kube"})
+	require.NoError(t, err)
+	assert.True(t, fake.Ran(`^sudo .*chown kube /etc/kubernetes/x\.conf'$`))
+
+	local := filepath.Join(t.TempDir(), "kube.conf")
+	require.NoError(t, os.WriteFile(local, []byte("local"), 0600))
+	owner, err := user.Current()
+	require.NoError(t, err)
+	group, err := user.LookupGroupId(owner.Gid)
+	require.NoError(t, err)
+	changed, err := modules.UploadFileWith(ctx, node, local, "/etc/kubernetes/kube.conf", 0600, modules.WriteOptions{PreserveOwner: true})
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.True(t, fake.Ran(regexp.QuoteMeta(fmt.Sprintf("chown %s:%s /etc/kubernetes/kube.conf", owner.Username, group.Name))))
+	written, ok := fake.ReadFile("/etc/kubernetes/kube.conf")
+	require.True(t, ok)
+	assert.Equal(t, "local", string(written))
+}
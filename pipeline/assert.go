@@ -0,0 +1,84 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/mensylisir/xmcores/errs"
+	"github.com/mensylisir/xmcores/modules"
+)
+
+// Kinds of assertion failures.
+const (
+	AssertPreflight    = "preflight"
+	AssertVerification = "verification"
+)
+
+// Assert is a step body that fails the node unless all its expressions hold,
+// for requirements such as
+//
+//	that: ["memory_mb >= 4096", "cpus >= 2"]
+//	message: "{{ .Host.Name }} has {{ .Facts.memory_mb }} MiB of memory, control-plane nodes need 4096"
+type Assert struct {
+	// That lists expressions (see Expr) that must all be true.
+	That []string `yaml:"that" json:"that" doc:"expressions that must all be true"`
+	// Message is a template (see Step.Command) explaining the failure and how
+	// to fix it; it can also reference .Facts.<key>. Empty means a generic
+	// message naming the failed expression.
+	Message string `yaml:"message,omitempty" json:"message,omitempty" doc:"template explaining the failure and how to fix it"`
+	// Kind classifies failures: AssertPreflight (the default) or AssertVerification.
+	Kind string `yaml:"kind,omitempty" json:"kind,omitempty" doc:"failure kind: preflight (the default) or verification"`
+}
+
+// Validate checks the assertion definition; expressions are compiled by Pipeline.
+func (a *Assert) Validate() error {
+	var errList []error
+	if len(a.That) == 0 {
+		errList = append(errList, errors.New("assert: that must list at least one expression"))
+	}
+	switch a.Kind {
+	case "", AssertPreflight, AssertVerification:
+	default:
+		errList = append(errList, fmt.Errorf("assert: unsupported kind %q (use %q or %q)", a.Kind, AssertPreflight, AssertVerification))
+	}
+	return errors.Join(errList...)
+}
+
+func (a *Assert) kind() errs.Kind {
+	if a.Kind == AssertVerification {
+		return errs.Verification
+	}
+	return errs.Preflight
+}
+
+// check evaluates the assertion on the node behind st.
+func (a *Assert) check(ctx context.Context, st *nodeState, exprs map[string]*Expr) error {
+	for _, src := range a.That {
+		e := exprs[src]
+		env, err := st.env(ctx, e)
+		if err != nil {
+			return err
+		}
+		ok, err := e.EvalBool(env)
+		if err != nil {
+			return errs.Wrap(errs.Config, err)
+		}
+		if ok {
+			continue
+		}
+		if a.Message == "" {
+			return errs.Wrap(a.kind(), fmt.Errorf("assertion %q failed", src))
+		}
+		data := modules.TemplateData(st.node.Host)
+		data["Outputs"] = env["outputs"]
+		data["Facts"] = st.facts
+		data["Config"] = st.p.Config
+		msg, err := modules.RenderData(st.node.Host, a.Message, data)
+		if err != nil {
+			return errs.Wrap(errs.Config, fmt.Errorf("assertion %q failed, rendering its message: %w", src, err))
+		}
+		return errs.Wrap(a.kind(), fmt.Errorf("%s (assertion %q failed)", msg, src))
+	}
+	return nil
+}
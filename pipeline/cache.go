@@ -0,0 +1,138 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Cache holds values the nodes of a run share, such as a token generated once
+// and used by every node, under a namespace per module (task) so modules
+// cannot clobber each other's keys. Unlike Outputs, which expressions and
+// templates see, it is for Run functions only and holds values of any type.
+// It is safe for concurrent use.
+type Cache struct {
+	mu      sync.RWMutex
+	entries map[cacheKey]*cacheEntry
+}
+
+type cacheKey struct {
+	module, key string
+}
+
+// cacheEntry is ready once done is closed; until then the value is being
+// computed by GetOrCompute.
+type cacheEntry struct {
+	done  chan struct{}
+	value interface{}
+	err   error
+}
+
+// NewCache returns an empty cache.
+func NewCache() *Cache {
+	return &Cache{entries: map[cacheKey]*cacheEntry{}}
+}
+
+// Namespace returns the view of the cache for module.
+func (c *Cache) Namespace(module string) Namespace {
+	return Namespace{cache: c, module: module}
+}
+
+// Namespace is the part of a Cache belonging to one module. The zero value
+// has no cache: Get finds nothing, Set does nothing and GetOrCompute always
+// computes.
+type Namespace struct {
+	cache  *Cache
+	module string
+}
+
+// Get returns the value stored under key. A value still being computed by
+// GetOrCompute is waited for.
+func (n Namespace) Get(key string) (interface{}, bool) {
+	if n.cache == nil {
+		return nil, false
+	}
+	n.cache.mu.RLock()
+	e, ok := n.cache.entries[cacheKey{n.module, key}]
+	n.cache.mu.RUnlock()
+	if !ok {
+		return nil, false
+	}
+	<-e.done
+	return e.value, e.err == nil
+}
+
+// Set stores value under key, replacing any earlier value.
+func (n Namespace) Set(key string, value interface{}) {
+	if n.cache == nil {
+		return
+	}
+	e := &cacheEntry{done: make(chan struct{}), value: value}
+	close(e.done)
+	n.cache.mu.Lock()
+	n.cache.entries[cacheKey{n.module, key}] = e
+	n.cache.mu.Unlock()
+}
+
+// GetOrCompute returns the value stored under key, computing and storing it
+// first if there is none. When several nodes ask at once, compute runs once
+// and the others wait for its result. An error is returned to every waiting
+// caller but not stored, so a later call computes again.
+func (n Namespace) GetOrCompute(key string, compute func() (interface{}, error)) (interface{}, error) {
+	if n.cache == nil {
+		return compute()
+	}
+	k := cacheKey{n.module, key}
+	n.cache.mu.Lock()
+	e, ok := n.cache.entries[k]
+	if !ok {
+		e = &cacheEntry{done: make(chan struct{})}
+		n.cache.entries[k] = e
+	}
+	n.cache.mu.Unlock()
+	if ok {
+		<-e.done
+		return e.value, e.err
+	}
+
+	// Waiters get this error if compute panics.
+	e.err = fmt.Errorf("computing %s/%s did not finish", n.module, key)
+	defer func() {
+		if e.err != nil {
+			n.cache.mu.Lock()
+			if n.cache.entries[k] == e {
+				delete(n.cache.entries, k)
+			}
+			n.cache.mu.Unlock()
+		}
+		close(e.done)
+	}()
+	v, err := compute()
+	e.value, e.err = v, err
+	return v, err
+}
+
+// Get is Namespace.Get for a value of type T; a value of another type is
+// reported as missing.
+func Get[T any](n Namespace, key string) (T, bool) {
+	v, ok := n.Get(key)
+	t, isT := v.(T)
+	return t, ok && isT
+}
+
+// GetOrCompute is Namespace.GetOrCompute for a value of type T.
+func GetOrCompute[T any](n Namespace, key string, compute func() (T, error)) (T, error) {
+	v, err := n.GetOrCompute(key, func() (interface{}, error) { return compute() })
+	t, _ := v.(T)
+	return t, err
+}
+
+// Shared returns the namespace of the running task in the pipeline's Cache,
+// for the Run function of a step. Outside a pipeline run it returns the zero
+// Namespace.
+func Shared(ctx context.Context) Namespace {
+	if r, ok := ctx.Value(registryKey{}).(registry); ok {
+		return r.cache.Namespace(r.module)
+	}
+	return Namespace{}
+}
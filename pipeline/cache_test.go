@@ -0,0 +1,114 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mensylisir/xmcores/modules"
+)
+
+func TestCache(t *testing.T) {
+	c := NewCache()
+	certs, etcd := c.Namespace("certs"), c.Namespace("etcd")
+	certs.Set("ca", "cert CA")
+	etcd.Set("ca", "etcd CA")
+	v, ok := Get[string](certs, "ca")
+	assert.True(t, ok)
+	assert.Equal(t, "cert CA", v)
+	v, _ = Get[string](etcd, "ca")
+	assert.Equal(t, "etcd CA", v, "modules have their own keys")
+	_, ok = Get[int](certs, "ca")
+	assert.False(t, ok, "a value of another type is missing")
+	_, ok = certs.Get("missing")
+	assert.False(t, ok)
+
+	var calls atomic.Int32
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+	results := make([]string, 20)
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], _ = GetOrCompute(certs, "token", func() (string, error) {
+				calls.Add(1)
+				<-release
+				return "abc.def", nil
+			})
+			if i%2 == 0 {
+				certs.Set(fmt.Sprintf("node%d", i), i)
+			}
+		}()
+	}
+	close(release)
+	wg.Wait()
+	assert.Equal(t, int32(1), calls.Load(), "concurrent callers share one computation")
+	for _, r := range results {
+		assert.Equal(t, "abc.def", r)
+	}
+	n, ok := Get[int](certs, "node4")
+	assert.True(t, ok)
+	assert.Equal(t, 4, n)
+
+	failing := errors.New("apiserver not ready")
+	_, err := GetOrCompute(etcd, "members", func() ([]string, error) { return nil, failing })
+	assert.ErrorIs(t, err, failing)
+	_, ok = etcd.Get("members")
+	assert.False(t, ok, "errors are not stored")
+	members, err := GetOrCompute(etcd, "members", func() ([]string, error) { return []string{"etcd1"}, nil })
+	require.NoError(t, err)
+	assert.Equal(t, []string{"etcd1"}, members)
+
+	assert.Panics(t, func() {
+		_, _ = etcd.GetOrCompute("panics", func() (interface{}, error) { panic("boom") })
+	})
+	_, ok = etcd.Get("panics")
+	assert.False(t, ok, "a panicking computation does not leave waiters hanging")
+
+	var zero Namespace
+	zero.Set("x", 1)
+	_, ok = zero.Get("x")
+	assert.False(t, ok)
+	x, err := GetOrCompute(zero, "x", func() (int, error) { return 2, nil })
+	require.NoError(t, err)
+	assert.Equal(t, 2, x)
+}
+
+func TestShared(t *testing.T) {
+	var generated atomic.Int32
+	step := func(ctx context.Context, node modules.Node) error {
+		token, err := GetOrCompute(Shared(ctx), "token", func() (string, error) {
+			return fmt.Sprintf("token-%d", generated.Add(1)), nil
+		})
+		if err != nil {
+			return err
+		}
+		Register(ctx, "token", token)
+		return nil
+	}
+	p := &Pipeline{Tasks: []Task{
+		{Name: "Bootstrap", Steps: []Step{{Name: "Token", Run: step}}},
+		{Name: "Join", Steps: []Step{{Name: "JoinToken", Run: step}}},
+	}}
+	nodes := testNodes("node1", "node2", "node3")
+	require.NoError(t, p.Run(context.Background(), nodes))
+
+	assert.Equal(t, int32(2), generated.Load(), "one token per task")
+	for _, n := range nodes {
+		v, _ := p.Outputs.Get(n.Name(), "token")
+		assert.Equal(t, "token-2", v)
+	}
+	v, ok := Get[string](p.Cache.Namespace("Bootstrap"), "token")
+	assert.True(t, ok)
+	assert.Equal(t, "token-1", v)
+
+	_, ok = Shared(context.Background()).Get("token")
+	assert.False(t, ok, "there is nothing shared outside a run")
+}
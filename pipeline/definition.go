@@ -0,0 +1,114 @@
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Capability is something a pipeline needs from the hosts or the cluster
+// before it can run.
+type Capability string
+
+const (
+	// CapabilitySSH: the hosts are reachable with the connection settings
+	// of the configuration.
+	CapabilitySSH Capability = "ssh"
+	// CapabilityRoot: commands run as root on the hosts.
+	CapabilityRoot Capability = "root"
+	// CapabilityKubeadm: the cluster was created with kubeadm.
+	CapabilityKubeadm Capability = "kubeadm"
+	// CapabilityKubeAPI: the apiserver answers with the admin kubeconfig
+	// of the first control-plane host.
+	CapabilityKubeAPI Capability = "kube-api"
+)
+
+// Parameter is a setting of a defined pipeline.
+type Parameter struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// Default is the value used when the parameter is not set, if any.
+	Default  string `json:"default,omitempty"`
+	Required bool   `json:"required,omitempty"`
+}
+
+// Definition describes a pipeline, or a sequence of pipelines run as one
+// operation, so users can discover what operations exist.
+type Definition struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// Command is the xm command running the pipeline, if any.
+	Command string `json:"command,omitempty"`
+	// Kinds are the configuration kinds the pipeline works on.
+	Kinds        []string     `json:"kinds"`
+	Capabilities []Capability `json:"capabilities,omitempty"`
+	Parameters   []Parameter  `json:"parameters,omitempty"`
+	// Pipelines builds the pipelines run, with the default parameters, to
+	// list their steps; nil when they depend on the live cluster.
+	Pipelines func() []*Pipeline `json:"-"`
+}
+
+// Validate checks that the definition can be defined.
+func (d Definition) Validate() error {
+	var errList []error
+	if d.Name == "" {
+		errList = append(errList, errors.New("name is required"))
+	}
+	if d.Description == "" {
+		errList = append(errList, errors.New("description is required"))
+	}
+	if len(d.Kinds) == 0 {
+		errList = append(errList, errors.New("at least one configuration kind is required"))
+	}
+	seen := map[string]bool{}
+	for i, p := range d.Parameters {
+		if p.Name == "" {
+			errList = append(errList, fmt.Errorf("parameters[%d]: name is required", i))
+		} else if seen[p.Name] {
+			errList = append(errList, fmt.Errorf("parameters[%d]: duplicate parameter %s", i, p.Name))
+		}
+		seen[p.Name] = true
+	}
+	return errors.Join(errList...)
+}
+
+var definitions = struct {
+	mu   sync.RWMutex
+	defs map[string]Definition
+}{defs: map[string]Definition{}}
+
+// Define makes a pipeline definition discoverable (see Definitions). It is meant to be
+// called from the init function of the package defining the pipeline, and
+// panics when the definition is invalid or its name already defined.
+func Define(d Definition) {
+	if err := d.Validate(); err != nil {
+		panic(fmt.Sprintf("pipeline: invalid definition %q: %v", d.Name, err))
+	}
+	definitions.mu.Lock()
+	defer definitions.mu.Unlock()
+	if _, ok := definitions.defs[d.Name]; ok {
+		panic(fmt.Sprintf("pipeline: %s defined twice", d.Name))
+	}
+	definitions.defs[d.Name] = d
+}
+
+// Lookup returns the definition named name.
+func Lookup(name string) (Definition, bool) {
+	definitions.mu.RLock()
+	defer definitions.mu.RUnlock()
+	d, ok := definitions.defs[name]
+	return d, ok
+}
+
+// Definitions returns the definitions sorted by name.
+func Definitions() []Definition {
+	definitions.mu.RLock()
+	defer definitions.mu.RUnlock()
+	out := make([]Definition, 0, len(definitions.defs))
+	for _, d := range definitions.defs {
+		out = append(out, d)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
@@ -0,0 +1,67 @@
+package pipeline
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefine(t *testing.T) {
+	d := Definition{
+		Name:        "test-define",
+		Description: "A pipeline defined by the tests",
+		Kinds:       []string{"Cluster"},
+		Parameters:  []Parameter{{Name: "timeout", Default: "1m"}},
+	}
+	Define(d)
+	got, ok := Lookup("test-define")
+	assert.True(t, ok)
+	assert.Equal(t, d.Description, got.Description)
+	_, ok = Lookup("missing")
+	assert.False(t, ok)
+
+	defs := Definitions()
+	for i := 1; i < len(defs); i++ {
+		assert.Less(t, defs[i-1].Name, defs[i].Name)
+	}
+
+	assert.Panics(t, func() { Define(d) }, "names are unique")
+	assert.Panics(t, func() { Define(Definition{Name: "no-kind", Description: "x"}) })
+	assert.Error(t, Definition{Name: "dup", Description: "x", Kinds: []string{"Cluster"},
+		Parameters: []Parameter{{Name: "a"}, {Name: "a"}}}.Validate())
+}
+
+func TestStepTypes(t *testing.T) {
+	var names []string
+	for _, st := range StepTypes() {
+		names = append(names, st.Name)
+	}
+	assert.Equal(t, []string{"assert", "command", "reboot", "script"}, names)
+
+	common := CommonStepParameters()
+	assert.Equal(t, StepParameter{Name: "name", Type: "string", Description: "name of the step, unique within its task", Required: true}, common[0])
+	for _, p := range common {
+		assert.NotContains(t, []string{"command", "register", "script.path"}, p.Name, "type parameters are not common")
+	}
+
+	params := map[string]StepParameter{}
+	for _, st := range StepTypes() {
+		for _, p := range st.Parameters {
+			params[st.Name+" "+p.Name] = p
+		}
+	}
+	assert.True(t, params["command command"].Required)
+	assert.Equal(t, "list of string", params["assert assert.that"].Type)
+	assert.True(t, params["assert assert.that"].Required)
+	assert.False(t, params["script script.path"].Required)
+	assert.Contains(t, params, "script register")
+	assert.Equal(t, "duration", params["reboot reboot.timeout"].Type)
+
+	assert.Equal(t, []StepParameter{{Name: "timeout", Type: "duration", Description: "how long to wait"}},
+		StepParametersOf(&struct {
+			Timeout time.Duration `yaml:"timeout,omitempty" doc:"how long to wait"`
+			Hidden  string        `yaml:"hidden"`
+		}{}))
+	assert.Panics(t, func() { DefineStepType(StepType{Name: "command"}) })
+}
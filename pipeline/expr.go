@@ -0,0 +1,433 @@
+package pipeline
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Expr is a compiled condition such as
+//
+//	facts.os_family == "debian" && !config.airgapped
+//
+// Operands are string, number and boolean literals and dotted names looked up
+// in nested maps; a numeric element indexes a list, e.g. nodes.0.name. Operators, loosest binding first, are ||, &&, the
+// comparisons == != < <= > >=, and !; parentheses group. && and || short
+// circuit and need booleans. Numbers of any Go type compare numerically,
+// strings lexically. Naming an undefined value is an error, so a typo does not
+// silently turn a condition off.
+type Expr struct {
+	src  string
+	root node
+}
+
+// ParseExpr compiles src.
+func ParseExpr(src string) (*Expr, error) {
+	toks, err := lex(src)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expression %q: %w", src, err)
+	}
+	p := &parser{toks: toks}
+	root, err := p.or()
+	if err == nil && p.peek().kind != tokEOF {
+		err = fmt.Errorf("unexpected %q", p.peek().text)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid expression %q: %w", src, err)
+	}
+	return &Expr{src: src, root: root}, nil
+}
+
+// String returns the source of the expression.
+func (e *Expr) String() string {
+	return e.src
+}
+
+// Eval evaluates the expression against env.
+func (e *Expr) Eval(env map[string]interface{}) (interface{}, error) {
+	v, err := e.root.eval(env)
+	if err != nil {
+		return nil, fmt.Errorf("evaluating %q: %w", e.src, err)
+	}
+	return v, nil
+}
+
+// EvalBool evaluates the expression and requires a boolean result.
+func (e *Expr) EvalBool(env map[string]interface{}) (bool, error) {
+	v, err := e.Eval(env)
+	if err != nil {
+		return false, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("evaluating %q: result %v is not a boolean", e.src, v)
+	}
+	return b, nil
+}
+
+type tokKind int
+
+const (
+	tokEOF tokKind = iota
+	tokIdent
+	tokString
+	tokNumber
+	tokOp
+)
+
+type token struct {
+	kind tokKind
+	text string
+}
+
+func lex(src string) ([]token, error) {
+	var toks []token
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '"' || c == '\'':
+			j := i + 1
+			var b strings.Builder
+			for ; j < len(src) && src[j] != c; j++ {
+				if src[j] == '\\' && j+1 < len(src) {
+					j++
+				}
+				b.WriteByte(src[j])
+			}
+			if j >= len(src) {
+				return nil, fmt.Errorf("unterminated string at offset %d", i)
+			}
+			toks = append(toks, token{tokString, b.String()})
+			i = j + 1
+		case c >= '0' && c <= '9':
+			j := i
+			for j < len(src) && (src[j] >= '0' && src[j] <= '9' || src[j] == '.') {
+				j++
+			}
+			toks = append(toks, token{tokNumber, src[i:j]})
+			i = j
+		case c == '_' || unicode.IsLetter(rune(c)):
+			j := i
+			for j < len(src) && (src[j] == '_' || src[j] == '.' || src[j] == '-' || unicode.IsLetter(rune(src[j])) || unicode.IsDigit(rune(src[j]))) {
+				j++
+			}
+			toks = append(toks, token{tokIdent, src[i:j]})
+			i = j
+		default:
+			op := ""
+			for _, candidate := range []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "(", ")"} {
+				if strings.HasPrefix(src[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected %q at offset %d", c, i)
+			}
+			toks = append(toks, token{tokOp, op})
+			i += len(op)
+		}
+	}
+	return append(toks, token{kind: tokEOF}), nil
+}
+
+type parser struct {
+	toks []token
+	pos  int
+}
+
+func (p *parser) peek() token {
+	return p.toks[p.pos]
+}
+
+func (p *parser) accept(ops ...string) (string, bool) {
+	t := p.peek()
+	if t.kind != tokOp {
+		return "", false
+	}
+	for _, op := range ops {
+		if t.text == op {
+			p.pos++
+			return op, true
+		}
+	}
+	return "", false
+}
+
+func (p *parser) or() (node, error) {
+	left, err := p.and()
+	for err == nil {
+		if _, ok := p.accept("||"); !ok {
+			break
+		}
+		var right node
+		if right, err = p.and(); err == nil {
+			left = logical{op: "||", left: left, right: right}
+		}
+	}
+	return left, err
+}
+
+func (p *parser) and() (node, error) {
+	left, err := p.comparison()
+	for err == nil {
+		if _, ok := p.accept("&&"); !ok {
+			break
+		}
+		var right node
+		if right, err = p.comparison(); err == nil {
+			left = logical{op: "&&", left: left, right: right}
+		}
+	}
+	return left, err
+}
+
+func (p *parser) comparison() (node, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	if op, ok := p.accept("==", "!=", "<=", ">=", "<", ">"); ok {
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return compare{op: op, left: left, right: right}, nil
+	}
+	return left, nil
+}
+
+func (p *parser) unary() (node, error) {
+	if _, ok := p.accept("!"); ok {
+		operand, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return not{operand}, nil
+	}
+	return p.primary()
+}
+
+func (p *parser) primary() (node, error) {
+	t := p.peek()
+	switch t.kind {
+	case tokEOF:
+		return nil, fmt.Errorf("unexpected end of expression")
+	case tokString:
+		p.pos++
+		return literal{t.text}, nil
+	case tokNumber:
+		p.pos++
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", t.text)
+		}
+		return literal{f}, nil
+	case tokIdent:
+		p.pos++
+		switch t.text {
+		case "true":
+			return literal{true}, nil
+		case "false":
+			return literal{false}, nil
+		}
+		return ident(strings.Split(t.text, ".")), nil
+	}
+	if _, ok := p.accept("("); ok {
+		inner, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := p.accept(")"); !ok {
+			return nil, fmt.Errorf("missing )")
+		}
+		return inner, nil
+	}
+	return nil, fmt.Errorf("unexpected %q", t.text)
+}
+
+type node interface {
+	eval(env map[string]interface{}) (interface{}, error)
+}
+
+type literal struct {
+	v interface{}
+}
+
+func (l literal) eval(map[string]interface{}) (interface{}, error) {
+	return l.v, nil
+}
+
+type ident []string
+
+func (id ident) eval(env map[string]interface{}) (interface{}, error) {
+	var cur interface{} = env
+	for i, key := range id {
+		switch c := cur.(type) {
+		case map[string]interface{}:
+			v, ok := c[key]
+			if !ok {
+				return nil, fmt.Errorf("%s is not defined", strings.Join(id[:i+1], "."))
+			}
+			cur = v
+		case []interface{}:
+			n, err := strconv.Atoi(key)
+			if err != nil || n < 0 || n >= len(c) {
+				return nil, fmt.Errorf("%s is not defined (%s has %d items)", strings.Join(id[:i+1], "."), strings.Join(id[:i], "."), len(c))
+			}
+			cur = c[n]
+		default:
+			return nil, fmt.Errorf("%s is not a map or list", strings.Join(id[:i], "."))
+		}
+	}
+	return cur, nil
+}
+
+type not struct {
+	operand node
+}
+
+func (n not) eval(env map[string]interface{}) (interface{}, error) {
+	v, err := n.operand.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return nil, fmt.Errorf("! needs a boolean, got %v", v)
+	}
+	return !b, nil
+}
+
+type logical struct {
+	op          string
+	left, right node
+}
+
+func (l logical) eval(env map[string]interface{}) (interface{}, error) {
+	left, err := l.operand(env, l.left)
+	if err != nil {
+		return nil, err
+	}
+	if left == (l.op == "||") {
+		return left, nil
+	}
+	return l.operand(env, l.right)
+}
+
+func (l logical) operand(env map[string]interface{}, n node) (bool, error) {
+	v, err := n.eval(env)
+	if err != nil {
+		return false, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("%s needs booleans, got %v", l.op, v)
+	}
+	return b, nil
+}
+
+type compare struct {
+	op          string
+	left, right node
+}
+
+func (c compare) eval(env map[string]interface{}) (interface{}, error) {
+	a, err := c.left.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	b, err := c.right.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	if x, ok := toFloat(a); ok {
+		if y, ok := toFloat(b); ok {
+			return order(c.op, cmpFloat(x, y))
+		}
+	}
+	if x, ok := a.(string); ok {
+		if y, ok := b.(string); ok {
+			return order(c.op, strings.Compare(x, y))
+		}
+	}
+	switch c.op {
+	case "==":
+		return fmt.Sprint(a) == fmt.Sprint(b) && fmt.Sprintf("%T", a) == fmt.Sprintf("%T", b), nil
+	case "!=":
+		return fmt.Sprint(a) != fmt.Sprint(b) || fmt.Sprintf("%T", a) != fmt.Sprintf("%T", b), nil
+	}
+	return nil, fmt.Errorf("cannot compare %v %s %v", a, c.op, b)
+}
+
+func cmpFloat(x, y float64) int {
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+func order(op string, c int) (interface{}, error) {
+	switch op {
+	case "==":
+		return c == 0, nil
+	case "!=":
+		return c != 0, nil
+	case "<":
+		return c < 0, nil
+	case "<=":
+		return c <= 0, nil
+	case ">":
+		return c > 0, nil
+	default:
+		return c >= 0, nil
+	}
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case float32:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+// refers reports whether the expression names a value whose first path
+// element satisfies match.
+func (e *Expr) refers(match func(root string) bool) bool {
+	var walk func(n node) bool
+	walk = func(n node) bool {
+		switch n := n.(type) {
+		case ident:
+			return match(n[0])
+		case not:
+			return walk(n.operand)
+		case logical:
+			return walk(n.left) || walk(n.right)
+		case compare:
+			return walk(n.left) || walk(n.right)
+		}
+		return false
+	}
+	return walk(e.root)
+}
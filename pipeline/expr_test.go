@@ -0,0 +1,59 @@
+package pipeline
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpr(t *testing.T) {
+	env := map[string]interface{}{
+		"facts":  map[string]interface{}{"os_family": "debian", "memory_mb": 8192, "cpus": int64(4)},
+		"config": map[string]interface{}{"airgapped": false, "version": "v1.30.2"},
+		"steps":  map[string]interface{}{"Install": map[string]interface{}{"ok": true}},
+		"nodes":  []interface{}{map[string]interface{}{"name": "node1"}},
+	}
+	for src, want := range map[string]bool{
+		`facts.os_family == "debian" && !config.airgapped`: true,
+		`facts.os_family == 'rhel' || config.airgapped`:    false,
+		`facts.memory_mb >= 4096 && facts.cpus > 2`:        true,
+		`!(facts.memory_mb < 4096)`:                        true,
+		`config.version != "v1.29.0"`:                      true,
+		`config.version < "v1.31"`:                         true,
+		`steps.Install.ok`:                                 true,
+		`true && false || true`:                            true,
+		`facts.cpus == 4.0`:                                true,
+		`config.airgapped == false`:                        true,
+		`facts.cpus == "4"`:                                false,
+		`nodes.0.name == "node1"`:                          true,
+		// The right operand is not evaluated, so it may be undefined.
+		`config.airgapped && config.mirror == "x"`: false,
+	} {
+		e, err := ParseExpr(src)
+		require.NoError(t, err, src)
+		got, err := e.EvalBool(env)
+		require.NoError(t, err, src)
+		assert.Equal(t, want, got, src)
+	}
+
+	for _, src := range []string{`facts.os_family ==`, `(true`, `"open`, `a $ b`, `true true`} {
+		_, err := ParseExpr(src)
+		assert.Error(t, err, src)
+	}
+
+	for src, msg := range map[string]string{
+		`config.mirror == "x"`:        "config.mirror is not defined",
+		`facts.os_family.name == "x"`: "facts.os_family is not a map or list",
+		`!facts.os_family`:            "needs a boolean",
+		`nodes.1.name == "x"`:         "nodes.1 is not defined (nodes has 1 items)",
+		`facts.memory_mb && true`:     "needs booleans",
+		`facts.memory_mb < "x"`:       "cannot compare",
+		`facts.os_family`:             "not a boolean",
+	} {
+		e, err := ParseExpr(src)
+		require.NoError(t, err, src)
+		_, err = e.EvalBool(env)
+		assert.ErrorContains(t, err, msg, src)
+	}
+}
@@ -0,0 +1,132 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Ways a command step's stdout is parsed before it is registered.
+const (
+	// ParseText registers the trimmed stdout as a string.
+	ParseText = ""
+	// ParseJSON registers the decoded JSON document, so expressions and
+	// templates can reach its fields, e.g. outputs.node.status.phase.
+	ParseJSON = "json"
+	// ParseLines registers the non-empty trimmed lines as a list.
+	ParseLines = "lines"
+)
+
+// Outputs holds the values steps registered during a run: per host, and
+// pipeline-wide for values every host needs, such as the join command printed
+// on the first control-plane node. It is safe for concurrent use.
+type Outputs struct {
+	mu     sync.Mutex
+	global map[string]interface{}
+	hosts  map[string]map[string]interface{}
+}
+
+// NewOutputs returns an empty store.
+func NewOutputs() *Outputs {
+	return &Outputs{global: map[string]interface{}{}, hosts: map[string]map[string]interface{}{}}
+}
+
+// Set records value under key for host, or pipeline-wide when host is empty.
+func (o *Outputs) Set(host, key string, value interface{}) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if host == "" {
+		o.global[key] = value
+		return
+	}
+	if o.hosts[host] == nil {
+		o.hosts[host] = map[string]interface{}{}
+	}
+	o.hosts[host][key] = value
+}
+
+// Get returns the value of key as host sees it: its own value if it has one,
+// else the pipeline-wide value.
+func (o *Outputs) Get(host, key string) (interface{}, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if v, ok := o.hosts[host][key]; ok {
+		return v, true
+	}
+	v, ok := o.global[key]
+	return v, ok
+}
+
+// For returns a copy of the values host sees: the pipeline-wide values
+// overridden by the host's own.
+func (o *Outputs) For(host string) map[string]interface{} {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	out := make(map[string]interface{}, len(o.global)+len(o.hosts[host]))
+	for k, v := range o.global {
+		out[k] = v
+	}
+	for k, v := range o.hosts[host] {
+		out[k] = v
+	}
+	return out
+}
+
+// parseOutput converts stdout as selected by mode (see the Parse* constants).
+func parseOutput(mode, stdout string) (interface{}, error) {
+	switch mode {
+	case ParseText:
+		return strings.TrimSpace(stdout), nil
+	case ParseJSON:
+		var v interface{}
+		if err := json.Unmarshal([]byte(stdout), &v); err != nil {
+			return nil, fmt.Errorf("output is not valid JSON: %w", err)
+		}
+		return v, nil
+	case ParseLines:
+		var lines []interface{}
+		for _, l := range strings.Split(stdout, "\n") {
+			if l = strings.TrimSpace(l); l != "" {
+				lines = append(lines, l)
+			}
+		}
+		return lines, nil
+	default:
+		return nil, fmt.Errorf("unsupported parse mode %q (use %q or %q)", mode, ParseJSON, ParseLines)
+	}
+}
+
+type registryKey struct{}
+
+type registry struct {
+	outputs *Outputs
+	host    string
+	cache   *Cache
+	module  string
+}
+
+// Register records value under key for the node a Run function works on, so
+// that later steps can use it. It does nothing outside a pipeline run.
+func Register(ctx context.Context, key string, value interface{}) {
+	if r, ok := ctx.Value(registryKey{}).(registry); ok {
+		r.outputs.Set(r.host, key, value)
+	}
+}
+
+// RegisterGlobal is Register for a value every node sees.
+func RegisterGlobal(ctx context.Context, key string, value interface{}) {
+	if r, ok := ctx.Value(registryKey{}).(registry); ok {
+		r.outputs.Set("", key, value)
+	}
+}
+
+// Output returns a registered value as the node a Run function works on sees it.
+func Output(ctx context.Context, key string) (interface{}, bool) {
+	r, ok := ctx.Value(registryKey{}).(registry)
+	if !ok {
+		return nil, false
+	}
+	return r.outputs.Get(r.host, key)
+}
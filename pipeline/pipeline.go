@@ -0,0 +1,777 @@
+// Package pipeline runs a sequence of steps on a set of nodes. Each step runs
+// on every node concurrently; the next step starts once the previous one has
+// finished everywhere. A step that fails on a node is retried as configured
+// when the failure looks transient (see Retryable), so a flaky network or a
+// package manager lock held by a background job does not abort the run.
+// Tasks group steps; tasks and steps can carry a when-condition so one
+// pipeline serves every OS instead of one copy per distribution.
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mensylisir/xmcores/connector"
+	"github.com/mensylisir/xmcores/errs"
+	"github.com/mensylisir/xmcores/facts"
+	"github.com/mensylisir/xmcores/logger"
+	"github.com/mensylisir/xmcores/modules"
+	"github.com/mensylisir/xmcores/wait"
+	"github.com/mensylisir/xmcores/workspace"
+)
+
+const (
+	// DefaultRetryDelay is the delay before the first retry when a step sets
+	// Retries but no RetryDelay.
+	DefaultRetryDelay = 2 * time.Second
+	// MaxRetryDelay caps the delay between retries as it doubles.
+	MaxRetryDelay = time.Minute
+)
+
+// Step is a unit of work run on every node.
+type Step struct {
+	Name string `yaml:"name" json:"name" doc:"name of the step, unique within its task"`
+	// Retries is how many times a transient failure is retried on a node.
+	Retries int `yaml:"retries,omitempty" json:"retries,omitempty" doc:"times a transient failure is retried on a node"`
+	// RetryDelay is the delay before the first retry. It doubles with every
+	// further attempt, up to MaxRetryDelay, and is jittered so that nodes
+	// failing together do not retry in lockstep.
+	RetryDelay time.Duration `yaml:"retryDelay,omitempty" json:"retryDelay,omitempty" doc:"delay before the first retry, doubled for each further one"`
+	// When is an expression (see Expr) evaluated per node before the step;
+	// nodes where it is false skip the step.
+	When string `yaml:"when,omitempty" json:"when,omitempty" doc:"expression evaluated per node; nodes where it is false skip the step"`
+	// ContinueOnError lets nodes where the step fails go on with the next
+	// steps, which see the failure as steps.<name>.ok.
+	ContinueOnError bool `yaml:"continueOnError,omitempty" json:"continueOnError,omitempty" doc:"let the nodes where the step fails go on with the next steps"`
+
+	// Command is run with sudo on the node when the step has no Run function.
+	// It is a template (see modules.RenderData) that can also reference
+	// registered values as .Outputs.<key>.
+	Command string `yaml:"command,omitempty" json:"command,omitempty" step:"command" doc:"shell command run with sudo, a template that can reference .Outputs.<key>"`
+	// Script is uploaded to the node and run when the step has neither a Run
+	// function nor a Command.
+	Script *Script `yaml:"script,omitempty" json:"script,omitempty" step:"script"`
+	// Assert checks expressions instead of running anything on the node.
+	Assert *Assert `yaml:"assert,omitempty" json:"assert,omitempty" step:"assert"`
+	// Reboot reboots the node and waits until it is back.
+	Reboot *Reboot `yaml:"reboot,omitempty" json:"reboot,omitempty" step:"reboot"`
+	// Register stores the stdout of Command or Script, parsed as selected by Parse,
+	// under this key in the pipeline's Outputs, for the node or, with Global,
+	// for every node.
+	Register string `yaml:"register,omitempty" json:"register,omitempty" step:"command,script" doc:"key the stdout is stored under in the outputs"`
+	Parse    string `yaml:"parse,omitempty" json:"parse,omitempty" step:"command,script" doc:"how the registered stdout is parsed: text (the default), json or lines"`
+	Global   bool   `yaml:"global,omitempty" json:"global,omitempty" step:"command,script" doc:"register the value for every node rather than this one"`
+
+	// Run does the work of the step. It can exchange values with other steps
+	// through Register, RegisterGlobal and Output, and share values with the
+	// other nodes through Shared.
+	Run func(ctx context.Context, node modules.Node) error `yaml:"-" json:"-"`
+}
+
+// Validate checks the step definition.
+func (s Step) Validate() error {
+	var errList []error
+	if s.Name == "" {
+		errList = append(errList, errors.New("name must be set"))
+	}
+	if s.Retries < 0 {
+		errList = append(errList, fmt.Errorf("retries must not be negative, got %d", s.Retries))
+	}
+	if s.RetryDelay < 0 {
+		errList = append(errList, fmt.Errorf("retryDelay must not be negative, got %s", s.RetryDelay))
+	}
+	bodies := 0
+	for _, set := range []bool{s.Run != nil, s.Command != "", s.Script != nil, s.Assert != nil, s.Reboot != nil} {
+		if set {
+			bodies++
+		}
+	}
+	switch {
+	case bodies == 0:
+		errList = append(errList, errors.New("one of run, command, script, assert or reboot must be set"))
+	case bodies > 1:
+		errList = append(errList, errors.New("run, command, script, assert and reboot are mutually exclusive"))
+	}
+	if s.Assert != nil {
+		if err := s.Assert.Validate(); err != nil {
+			errList = append(errList, err)
+		}
+	}
+	if s.Script != nil {
+		if err := s.Script.Validate(); err != nil {
+			errList = append(errList, err)
+		}
+	}
+	if s.Reboot != nil {
+		if err := s.Reboot.Validate(); err != nil {
+			errList = append(errList, err)
+		}
+	}
+	if s.Register != "" && (s.Run != nil || s.Assert != nil || s.Reboot != nil) {
+		errList = append(errList, errors.New("register needs a command or script; Run functions register with pipeline.Register"))
+	}
+	switch s.Parse {
+	case ParseText, ParseJSON, ParseLines:
+	default:
+		errList = append(errList, fmt.Errorf("unsupported parse mode %q (use %q or %q)", s.Parse, ParseJSON, ParseLines))
+	}
+	if err := errors.Join(errList...); err != nil {
+		return errs.Wrap(errs.Config, fmt.Errorf("step %q: %w", s.Name, err))
+	}
+	return nil
+}
+
+// Task groups steps under a common condition.
+type Task struct {
+	Name string `yaml:"name" json:"name"`
+	// When is an expression (see Expr) evaluated per node before the task;
+	// nodes where it is false skip every step of the task.
+	When string `yaml:"when,omitempty" json:"when,omitempty"`
+	// Strategy is StrategyParallel (the default), StrategySerial or
+	// "rolling(N)". With the latter two the whole task runs on one batch of
+	// nodes before the next batch starts, and stops at the first failed batch.
+	Strategy string `yaml:"strategy,omitempty" json:"strategy,omitempty"`
+	// MaxFailPercentage is the share of the task's nodes that may fail
+	// without stopping the run: the nodes that fail skip the rest of the
+	// pipeline, the others carry on, and Run reports the failures once it is
+	// done. Zero stops the run at the first failed step, as does a failure
+	// on every node.
+	MaxFailPercentage int    `yaml:"maxFailPercentage,omitempty" json:"maxFailPercentage,omitempty"`
+	Steps             []Step `yaml:"steps" json:"steps"`
+}
+
+// FactsFunc gathers the facts of a node, which when-expressions see as facts.<key>.
+type FactsFunc func(ctx context.Context, node modules.Node) (map[string]interface{}, error)
+
+// Pipeline runs tasks in order on a set of nodes.
+//
+// When-expressions of tasks and steps are evaluated per node against:
+//
+//	facts.<key>          the node's facts, gathered on first use (see DefaultFacts)
+//	config.<key>         Config
+//	vars.<key>           the host's merged variables
+//	host.name            the host name
+//	steps.<name>.ok      whether an earlier step succeeded on the node
+//	steps.<name>.skipped whether an earlier step was skipped on the node
+//	outputs.<key>        values registered by earlier steps (see Outputs)
+//
+// Facts and outputs can also be named without their prefix, e.g. memory_mb;
+// an output shadows a fact of the same name.
+type Pipeline struct {
+	// Name is the first part of the step IDs (see StepID); the pipelines a
+	// command runs one after the other should have distinct names.
+	Name   string
+	Config map[string]interface{}
+	// Outputs receives the values steps register; nil means a new store, which
+	// Run leaves in the field for the caller to read.
+	Outputs *Outputs
+	// Cache holds what Run functions share (see Shared); nil means a new
+	// cache, which Run leaves in the field.
+	Cache *Cache
+	// Facts gathers node facts; nil means DefaultFacts.
+	Facts FactsFunc
+	Tasks []Task
+	// Budget bounds the wall-clock time of Run; zero means no limit. Run warns
+	// as soon as the estimated total exceeds it.
+	Budget time.Duration
+	// AnyErrorsFatal stops the run at the first failure on any node,
+	// cancelling the step on the other nodes rather than letting it finish,
+	// whatever the MaxFailPercentage of the task.
+	AnyErrorsFatal bool
+	// Report is set by Run to where the run spent its time.
+	Report Report
+}
+
+// Validate checks the tasks and steps and compiles their expressions.
+func (p *Pipeline) Validate() error {
+	_, err := p.compile()
+	return err
+}
+
+// compile validates the pipeline and returns its expressions by source.
+func (p *Pipeline) compile() (map[string]*Expr, error) {
+	exprs := map[string]*Expr{}
+	names := map[string]bool{}
+	var errList []error
+	add := func(what, src string) {
+		if src == "" || exprs[src] != nil {
+			return
+		}
+		e, err := ParseExpr(src)
+		if err != nil {
+			errList = append(errList, errs.Wrap(errs.Config, fmt.Errorf("%s: %w", what, err)))
+			return
+		}
+		exprs[src] = e
+	}
+	for i, t := range p.Tasks {
+		add(fmt.Sprintf("tasks[%d] %q: when", i, t.Name), t.When)
+		if _, err := batchSize(t.Strategy); err != nil {
+			errList = append(errList, errs.Wrap(errs.Config, fmt.Errorf("tasks[%d] %q: %w", i, t.Name, err)))
+		}
+		if t.MaxFailPercentage < 0 || t.MaxFailPercentage > 100 {
+			errList = append(errList, errs.Wrap(errs.Config, fmt.Errorf("tasks[%d] %q: maxFailPercentage must be between 0 and 100, got %d", i, t.Name, t.MaxFailPercentage)))
+		}
+		size, _ := batchSize(t.Strategy)
+		for _, s := range t.Steps {
+			if err := s.Validate(); err != nil {
+				errList = append(errList, err)
+				continue
+			}
+			if s.Reboot != nil && size == 0 && !s.Reboot.Parallel {
+				errList = append(errList, errs.Wrap(errs.Config, fmt.Errorf("step %q: a reboot step in task %q, whose strategy is parallel, would reboot every node at once; use %q or %q, or set reboot.parallel", s.Name, t.Name, StrategySerial, StrategyRolling+"(N)")))
+			}
+			if names[s.Name] {
+				errList = append(errList, errs.Wrap(errs.Config, fmt.Errorf("step %q: duplicate name", s.Name)))
+			}
+			names[s.Name] = true
+			add(fmt.Sprintf("step %q: when", s.Name), s.When)
+			if s.Assert != nil {
+				for _, src := range s.Assert.That {
+					add(fmt.Sprintf("step %q: assert", s.Name), src)
+				}
+			}
+		}
+	}
+	return exprs, errors.Join(errList...)
+}
+
+// Run validates steps and runs them in order on nodes. It stops after the
+// first step that fails on any node; errors carry the host and step names.
+func Run(ctx context.Context, nodes []modules.Node, steps ...Step) error {
+	return (&Pipeline{Tasks: []Task{{Steps: steps}}}).Run(ctx, nodes)
+}
+
+// Run validates the pipeline and runs its tasks in order on nodes. It stops
+// after the first step that fails on any node, unless the task tolerates the
+// failure (see Task.MaxFailPercentage); errors carry the host and the step
+// ID. Only the steps selected by the Selection ctx carries, if any, run.
+// Temporary files steps leave behind are removed at the end, unless ctx
+// carries a registry (see modules.WithTempFiles), whose owner cleans it.
+func (p *Pipeline) Run(ctx context.Context, nodes []modules.Node) error {
+	exprs, err := p.compile()
+	if err != nil {
+		return err
+	}
+	if q, ok := QuarantineFrom(ctx); ok {
+		if err := q.Validate(); err != nil {
+			return err
+		}
+	}
+	if p.Outputs == nil {
+		p.Outputs = NewOutputs()
+	}
+	if p.Cache == nil {
+		p.Cache = NewCache()
+	}
+	states := make(map[string]*nodeState, len(nodes))
+	for _, n := range nodes {
+		states[n.Name()] = &nodeState{p: p, node: n, steps: map[string]interface{}{}}
+	}
+	sel, _ := SelectionFrom(ctx)
+	selected := sel.selects(p.StepIDs())
+	units := 0
+	for ti, t := range p.Tasks {
+		size, _ := batchSize(t.Strategy)
+		for si, s := range t.Steps {
+			if selected[p.stepID(ti, si, t, s)] {
+				units += len(batches(nodes, size))
+			}
+		}
+	}
+	c := newClock(p.Budget, units)
+	defer func() {
+		p.Report = c.report()
+		logger.Log.Infof("Time spent:\n%s", p.Report)
+		if tl, ok := TimelineFrom(ctx); ok {
+			tl.Add(p.Name, p.Report)
+		}
+	}()
+
+	temps, ok := modules.TempFilesFrom(ctx)
+	if !ok {
+		temps = modules.NewTempFiles()
+		ctx = modules.WithTempFiles(ctx, temps)
+		defer func() {
+			// Cleanup runs even when the budget is spent or the run cancelled.
+			cleanCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Minute)
+			defer cancel()
+			if err := temps.Clean(cleanCtx, nodes); err != nil {
+				logger.Log.Warnf("Failed to remove temporary files: %v", err)
+			}
+		}()
+	}
+
+	runCtx := ctx
+	if p.Budget > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(ctx, p.Budget)
+		defer cancel()
+	}
+	err = p.runTasks(runCtx, nodes, states, exprs, selected, c)
+	if err != nil && ctx.Err() == nil && errors.Is(runCtx.Err(), context.DeadlineExceeded) {
+		return errs.Wrap(errs.Execution, fmt.Errorf("budget of %s exceeded: %w", p.Budget, err))
+	}
+	if err == nil {
+		// The run went on without the nodes that failed within the
+		// tolerance of their task, but did not succeed on them.
+		var failed []error
+		for _, n := range nodes {
+			if st := states[n.Name()]; st.failed != nil {
+				failed = append(failed, st.failed)
+			}
+		}
+		err = errors.Join(failed...)
+	}
+	return err
+}
+
+// stepID returns the ID of step si of task ti.
+func (p *Pipeline) stepID(ti, si int, t Task, s Step) StepID {
+	return StepID{Pipeline: p.Name, Task: ti + 1, Step: si + 1, TaskName: t.Name, StepName: s.Name}
+}
+
+func (p *Pipeline) runTasks(ctx context.Context, nodes []modules.Node, states map[string]*nodeState, exprs map[string]*Expr, selected map[StepID]bool, c *clock) error {
+	for ti, t := range p.Tasks {
+		any := false
+		for si, s := range t.Steps {
+			any = any || selected[p.stepID(ti, si, t, s)]
+		}
+		if !any {
+			for _, s := range t.Steps {
+				for _, st := range states {
+					st.record(s.Name, false, true)
+				}
+			}
+			if t.Name != "" {
+				logger.Log.InfofModule(t.Name, "Skipped, no step selected")
+			}
+			continue
+		}
+		if t.Name != "" {
+			logger.Log.InfofModule(t.Name, "Running %d step(s)", len(t.Steps))
+		}
+		var active []modules.Node
+		for _, n := range nodes {
+			if states[n.Name()].failed == nil {
+				active = append(active, n)
+			}
+		}
+		if t.When != "" {
+			candidates := active
+			var mu sync.Mutex
+			active = nil
+			err := modules.ForEach(ctx, candidates, func(ctx context.Context, node modules.Node) error {
+				ok, err := states[node.Name()].when(ctx, exprs[t.When])
+				if err != nil {
+					return errs.Wrap(errs.Config, fmt.Errorf("task %q: %w", t.Name, err))
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				if ok {
+					active = append(active, node)
+				} else {
+					logger.Log.InfofModule(t.Name, "%s: skipped, %s is false", node.Name(), t.When)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			// Keep the inventory order, ForEach appends in completion order.
+			active = inOrder(nodes, active)
+		}
+		tol := &tolerance{max: t.MaxFailPercentage, nodes: len(active)}
+		size, _ := batchSize(t.Strategy)
+		groups := batches(active, size)
+		for i, batch := range groups {
+			if len(groups) > 1 {
+				logger.Log.InfofModule(t.Name, "Batch %d/%d: %s", i+1, len(groups), nodeNames(batch))
+			}
+			if err := p.runSteps(ctx, ti, t, batch, nodes, states, exprs, selected, c, tol); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// tolerance tracks the failures a task tolerates (see Task.MaxFailPercentage).
+type tolerance struct {
+	max, nodes, failed int
+}
+
+// allow reports whether n more failed nodes are tolerated, and counts them if so.
+func (t *tolerance) allow(n int) bool {
+	failed := t.failed + n
+	if failed >= t.nodes || failed*100 > t.max*t.nodes {
+		return false
+	}
+	t.failed = failed
+	return true
+}
+
+// runSteps runs the selected steps of task ti in order on nodes, each step on
+// all nodes at once. all are the nodes of the pipeline, which the quorum of a
+// quarantine is checked against.
+func (p *Pipeline) runSteps(ctx context.Context, ti int, t Task, nodes, all []modules.Node, states map[string]*nodeState, exprs map[string]*Expr, selected map[StepID]bool, c *clock, tol *tolerance) error {
+	for si, s := range t.Steps {
+		id := p.stepID(ti, si, t, s).String()
+		if !selected[p.stepID(ti, si, t, s)] {
+			logger.Log.InfofStep(id, "Skipped, not selected")
+			for _, n := range nodes {
+				states[n.Name()].record(s.Name, false, true)
+			}
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return errs.WithStep(err, id)
+		}
+		q, _ := QuarantineFrom(ctx)
+		var healthy []modules.Node
+		for _, n := range nodes {
+			switch {
+			case states[n.Name()].failed != nil:
+				logger.Log.InfofStep(id, "%s: skipped, failed earlier", n.Name())
+				states[n.Name()].record(s.Name, false, true)
+			case q != nil && q.Quarantined(n.Name()):
+				logger.Log.InfofStep(id, "%s: skipped, quarantined", n.Name())
+				states[n.Name()].record(s.Name, false, true)
+			default:
+				healthy = append(healthy, n)
+			}
+		}
+		nodes = healthy
+		logger.Log.InfofStep(id, "Running on %d node(s)", len(nodes))
+		start := time.Now()
+		runOn := func(ctx context.Context, node modules.Node) error {
+			st := states[node.Name()]
+			if s.When != "" {
+				ok, err := st.when(ctx, exprs[s.When])
+				if err != nil {
+					return errs.WithStep(errs.Wrap(errs.Config, err), id)
+				}
+				if !ok {
+					logger.Log.InfofStep(id, "%s: skipped, %s is false", node.Name(), s.When)
+					st.record(s.Name, false, true)
+					return nil
+				}
+			}
+			ctx = context.WithValue(ctx, registryKey{}, registry{outputs: p.Outputs, host: node.Name(), cache: p.Cache, module: t.Name})
+			nodeStart := time.Now()
+			var err error
+			if s.Assert != nil {
+				err = s.Assert.check(ctx, st, exprs)
+			} else {
+				err = runStep(ctx, id, s, node)
+			}
+			c.cost(t.Name, id, node.Name(), nodeStart)
+			if err != nil {
+				st.record(s.Name, false, false)
+				if s.ContinueOnError {
+					logger.Log.WarnfStep(id, "%s: failed, continuing: %v", node.Name(), err)
+					return nil
+				}
+				if q != nil {
+					ok, qerr := q.admit(node, all, id, err)
+					if ok {
+						logger.Log.WarnfStep(id, "%s: quarantined, later steps skip it: %v", node.Name(), err)
+						c.quarantined(node.Name())
+						return nil
+					}
+					if qerr != nil {
+						err = fmt.Errorf("%w (%v)", err, qerr)
+					}
+				}
+				return errs.WithStep(err, id)
+			}
+			st.record(s.Name, true, false)
+			return nil
+		}
+		stepCtx, cancel := context.WithCancel(ctx)
+		var (
+			mu     sync.Mutex
+			failed []error
+		)
+		err := modules.ForEach(stepCtx, nodes, func(ctx context.Context, node modules.Node) error {
+			err := runOn(ctx, node)
+			if err != nil {
+				mu.Lock()
+				defer mu.Unlock()
+				if p.AnyErrorsFatal && len(failed) == 0 {
+					cancel()
+				}
+				failed = append(failed, errs.WithHost(err, node.Name()))
+			}
+			return err
+		})
+		cancel()
+		c.stepDone(t.Name, id, time.Since(start))
+		switch {
+		case err == nil:
+		case p.AnyErrorsFatal && ctx.Err() == nil && len(failed) > 0:
+			// The other nodes failed because the first failure cancelled them.
+			return failed[0]
+		case ctx.Err() != nil || !tol.allow(len(failed)):
+			return err
+		default:
+			for _, ferr := range failed {
+				host := errs.HostOf(ferr)
+				logger.Log.WarnfStep(id, "%s: failed, skipping the rest of the pipeline (%d%% of the task's nodes may fail)", host, tol.max)
+				states[host].failed = ferr
+				c.failed(host)
+			}
+		}
+	}
+	return nil
+}
+
+func nodeNames(nodes []modules.Node) string {
+	names := make([]string, 0, len(nodes))
+	for _, n := range nodes {
+		names = append(names, n.Name())
+	}
+	return strings.Join(names, ", ")
+}
+
+func inOrder(all, subset []modules.Node) []modules.Node {
+	keep := make(map[string]bool, len(subset))
+	for _, n := range subset {
+		keep[n.Name()] = true
+	}
+	var out []modules.Node
+	for _, n := range all {
+		if keep[n.Name()] {
+			out = append(out, n)
+		}
+	}
+	return out
+}
+
+// nodeState is what the pipeline knows about one node. It is only accessed
+// from the goroutine working on the node.
+type nodeState struct {
+	p     *Pipeline
+	node  modules.Node
+	facts map[string]interface{}
+	steps map[string]interface{}
+	// failed is the failure that took the node out of the run, within the
+	// tolerance of its task.
+	failed error
+}
+
+func (st *nodeState) record(step string, ok, skipped bool) {
+	st.steps[step] = map[string]interface{}{"ok": ok, "skipped": skipped}
+}
+
+// when evaluates e for the node.
+func (st *nodeState) when(ctx context.Context, e *Expr) (bool, error) {
+	env, err := st.env(ctx, e)
+	if err != nil {
+		return false, err
+	}
+	return e.EvalBool(env)
+}
+
+// scopes are the top-level names of the expression environment. Other names
+// refer to facts and registered outputs directly.
+var scopes = map[string]bool{"config": true, "facts": true, "vars": true, "host": true, "steps": true, "outputs": true}
+
+// env returns the environment e is evaluated in, gathering the node's facts
+// first if e refers to them.
+func (st *nodeState) env(ctx context.Context, e *Expr) (map[string]interface{}, error) {
+	if st.facts == nil && e.refers(func(root string) bool { return root == "facts" || !scopes[root] }) {
+		gather := st.p.Facts
+		if gather == nil {
+			gather = DefaultFacts
+		}
+		f, err := gather(ctx, st.node)
+		if err != nil {
+			return nil, fmt.Errorf("gathering facts: %w", err)
+		}
+		st.facts = f
+	}
+	outputs := st.p.Outputs.For(st.node.Name())
+	env := make(map[string]interface{}, len(st.facts)+len(outputs)+len(scopes))
+	for k, v := range st.facts {
+		env[k] = v
+	}
+	for k, v := range outputs {
+		env[k] = v
+	}
+	env["config"] = st.p.Config
+	env["facts"] = st.facts
+	env["steps"] = st.steps
+	env["outputs"] = outputs
+	if h := st.node.Host; h != nil {
+		env["vars"] = h.GetVars()
+		env["host"] = map[string]interface{}{"name": h.GetName()}
+	}
+	return env, nil
+}
+
+// DefaultFacts gathers os_id, os_family (the first ID_LIKE entry, else the
+// ID), os_version, package_manager, init_system (see facts.InitSystemd),
+// arch, cpus, memory_mb and sudo_nopasswd (whether sudo needs no password,
+// see facts.DetectSudoNoPassword).
+func DefaultFacts(ctx context.Context, node modules.Node) (map[string]interface{}, error) {
+	rel, err := facts.DetectOSRelease(ctx, node.Conn)
+	if err != nil {
+		return nil, err
+	}
+	arch, err := facts.GatherArch(ctx, node.Host, node.Conn)
+	if err != nil {
+		return nil, err
+	}
+	family := rel.ID
+	if len(rel.IDLike) > 0 {
+		family = rel.IDLike[0]
+	}
+	out, err := modules.RunUnprivileged(ctx, node.Conn, `nproc && awk '/^MemTotal:/ {print int($2 / 1024)}' /proc/meminfo`)
+	if err != nil {
+		return nil, err
+	}
+	var cpus, memoryMB int
+	if _, err := fmt.Sscan(out, &cpus, &memoryMB); err != nil {
+		return nil, fmt.Errorf("unexpected cpu and memory output %q", out)
+	}
+	nopasswd, err := facts.DetectSudoNoPassword(ctx, node.Conn)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"os_id":           rel.ID,
+		"os_family":       family,
+		"os_version":      rel.VersionID,
+		"package_manager": rel.PackageManager(),
+		"init_system":     rel.InitSystem(),
+		"arch":            string(arch),
+		"cpus":            cpus,
+		"memory_mb":       memoryMB,
+		"sudo_nopasswd":   nopasswd,
+	}, nil
+}
+
+// runStep runs s, whose ID is id, on node, retrying retryable failures up to
+// s.Retries times. Failed attempts count towards the quarantine ctx carries.
+func runStep(ctx context.Context, id string, s Step, node modules.Node) error {
+	run := s.Run
+	switch {
+	case run != nil:
+	case s.Reboot != nil:
+		run = s.Reboot.run
+	default:
+		run = s.runCommand
+	}
+	q, _ := QuarantineFrom(ctx)
+	for attempt := 0; ; attempt++ {
+		err := run(ctx, node)
+		if err == nil {
+			return nil
+		}
+		if q != nil && q.fail(ctx, node.Name(), err) {
+			// No point retrying on a host about to be quarantined.
+			return err
+		}
+		if attempt >= s.Retries || !Retryable(err) {
+			return err
+		}
+		delay := backoff(s.RetryDelay, attempt)
+		logger.Log.WarnfStep(id, "%s: attempt %d/%d failed, retrying in %s: %v",
+			node.Name(), attempt+1, s.Retries+1, delay.Round(time.Millisecond), err)
+		if sleepErr := wait.Sleep(ctx, delay); sleepErr != nil {
+			return fmt.Errorf("%w (retry cancelled: %v)", err, sleepErr)
+		}
+	}
+}
+
+// runCommand renders and runs s.Command or s.Script on node and registers
+// its output.
+func (s Step) runCommand(ctx context.Context, node modules.Node) error {
+	r, _ := ctx.Value(registryKey{}).(registry)
+	data := modules.TemplateData(node.Host)
+	outputs := map[string]interface{}{}
+	if r.outputs != nil {
+		outputs = r.outputs.For(r.host)
+	}
+	data["Outputs"] = outputs
+	var stdout string
+	if s.Script != nil {
+		out, err := s.Script.run(ctx, node, s.Name, data)
+		if err != nil {
+			return err
+		}
+		stdout = out
+	} else {
+		cmd, err := modules.RenderData(node.Host, s.Command, data)
+		if err != nil {
+			return errs.Wrap(errs.Config, err)
+		}
+		if stdout, err = modules.Run(ctx, node.Conn, cmd); err != nil {
+			return err
+		}
+	}
+	if s.Register == "" {
+		return nil
+	}
+	v, err := parseOutput(s.Parse, stdout)
+	if err != nil {
+		return errs.Wrap(errs.Execution, fmt.Errorf("register %s: %w", s.Register, err))
+	}
+	if s.Global {
+		RegisterGlobal(ctx, s.Register, v)
+	} else {
+		Register(ctx, s.Register, v)
+	}
+	return nil
+}
+
+// backoff returns the delay before retry attempt+1: base doubled attempt
+// times, capped at MaxRetryDelay, then jittered into [d/2, d].
+func backoff(base time.Duration, attempt int) time.Duration {
+	if base == 0 {
+		base = DefaultRetryDelay
+	}
+	d := base
+	for i := 0; i < attempt && d < MaxRetryDelay; i++ {
+		d *= 2
+	}
+	if d > MaxRetryDelay {
+		d = MaxRetryDelay
+	}
+	half := d / 2
+	return half + rand.N(d-half+1)
+}
+
+// lockContention matches messages of remote tools failing because another
+// process holds a lock they need.
+var lockContention = regexp.MustCompile(`(?i)could not get lock|unable to acquire the dpkg|another app is currently holding the yum lock|waiting for process with pid \d+ to finish|resource temporarily unavailable|text file busy`)
+
+// Retryable reports whether err is worth retrying: connectivity failures,
+// errors marked with errs.Transient, the local cluster lock and remote lock
+// contention are; configuration, preflight and verification failures, other
+// failed commands, rejected credentials and cancellation are fatal.
+func Retryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if errors.Is(err, connector.ErrAuthFailed) || errors.Is(err, connector.ErrSudoPasswordRequired) || errors.Is(err, connector.ErrPermissionDenied) {
+		return false
+	}
+	if errs.IsTransient(err) || errors.Is(err, workspace.ErrLocked) {
+		return true
+	}
+	switch errs.KindOf(err) {
+	case errs.Connectivity:
+		return true
+	case errs.Config, errs.Preflight, errs.Verification:
+		return false
+	}
+	return lockContention.MatchString(err.Error())
+}
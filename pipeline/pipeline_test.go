@@ -0,0 +1,671 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+
+	"github.com/mensylisir/xmcores/common"
+	"github.com/mensylisir/xmcores/connector"
+	"github.com/mensylisir/xmcores/connector/connectortest"
+	"github.com/mensylisir/xmcores/errs"
+	"github.com/mensylisir/xmcores/modules"
+	"github.com/mensylisir/xmcores/wait"
+	"github.com/mensylisir/xmcores/workspace"
+)
+
+func testNodes(names ...string) []modules.Node {
+	var nodes []modules.Node
+	for _, name := range names {
+		h := connector.NewHost()
+		h.SetName(name)
+		nodes = append(nodes, modules.Node{Host: h})
+	}
+	return nodes
+}
+
+func TestRetryable(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{errs.Wrap(errs.Connectivity, errors.New("connection reset by peer")), true},
+		{errs.Wrap(errs.Execution, errors.New(`command "apt-get install -y socat" exited with code 100: E: Could not get lock /var/lib/dpkg/lock-frontend`)), true},
+		{errs.Wrap(errs.Execution, errs.Transient(errors.New("etcd leader changed"))), true},
+		{fmt.Errorf("prepare: %w", workspace.ErrLocked), true},
+		{errs.Wrap(errs.Execution, errors.New("command \"false\" exited with code 1")), false},
+		{errs.Wrap(errs.Preflight, errors.New("could not get lock")), false},
+		{errs.Wrap(errs.Config, errors.New("invalid")), false},
+		{errs.Wrap(errs.Connectivity, context.Canceled), false},
+		{errs.Wrap(errs.Connectivity, fmt.Errorf("dial: %w", connector.ErrHostUnreachable)), true},
+		{errs.Wrap(errs.Connectivity, fmt.Errorf("dial: %w", connector.ErrAuthFailed)), false},
+		{errs.Wrap(errs.Connectivity, fmt.Errorf(`failed to run "id": %w`, connector.ErrSudoPasswordRequired)), false},
+	} {
+		assert.Equal(t, tc.want, Retryable(tc.err), "%v", tc.err)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for attempt, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+		d := backoff(time.Second, attempt)
+		assert.GreaterOrEqual(t, d, want/2)
+		assert.LessOrEqual(t, d, want)
+	}
+	assert.LessOrEqual(t, backoff(time.Second, 30), MaxRetryDelay)
+	assert.GreaterOrEqual(t, backoff(0, 0), DefaultRetryDelay/2)
+}
+
+func TestRunRetries(t *testing.T) {
+	ctx := context.Background()
+	var calls atomic.Int32
+	flaky := Step{
+		Name:       "InstallPackages",
+		Retries:    3,
+		RetryDelay: time.Millisecond,
+		Run: func(ctx context.Context, node modules.Node) error {
+			if calls.Add(1) < 3 {
+				return errs.Wrap(errs.Connectivity, errors.New("i/o timeout"))
+			}
+			return nil
+		},
+	}
+	require.NoError(t, Run(ctx, testNodes("node1"), flaky))
+	assert.Equal(t, int32(3), calls.Load())
+
+	calls.Store(0)
+	flaky.Retries = 1
+	err := Run(ctx, testNodes("node1"), flaky)
+	require.Error(t, err)
+	assert.Equal(t, int32(2), calls.Load(), "gives up after the configured retries")
+	assert.Equal(t, "node1", errs.HostOf(err))
+	assert.Equal(t, "1.1 InstallPackages", errs.StepOf(err))
+
+	var fatalCalls, nextCalls atomic.Int32
+	fatal := Step{Name: "Init", Retries: 5, RetryDelay: time.Millisecond, Run: func(ctx context.Context, node modules.Node) error {
+		fatalCalls.Add(1)
+		return errs.Wrap(errs.Execution, errors.New("command \"kubeadm init\" exited with code 1"))
+	}}
+	next := Step{Name: "Next", Run: func(ctx context.Context, node modules.Node) error {
+		nextCalls.Add(1)
+		return nil
+	}}
+	err = Run(ctx, testNodes("node1", "node2"), fatal, next)
+	assert.Equal(t, errs.Execution, errs.KindOf(err))
+	assert.Equal(t, int32(2), fatalCalls.Load(), "fatal errors are not retried")
+	assert.Zero(t, nextCalls.Load(), "later steps do not run after a failure")
+}
+
+func TestRunCancelledDuringRetry(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := Step{Name: "Flaky", Retries: 3, RetryDelay: time.Hour, Run: func(ctx context.Context, node modules.Node) error {
+		cancel()
+		return errs.Wrap(errs.Connectivity, errors.New("connection refused"))
+	}}
+	err := Run(ctx, testNodes("node1"), s)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "retry cancelled")
+}
+
+func TestStepValidate(t *testing.T) {
+	err := Run(context.Background(), nil, Step{Retries: -1, RetryDelay: -time.Second})
+	assert.Equal(t, errs.Config, errs.KindOf(err))
+	assert.ErrorContains(t, err, "retries must not be negative")
+	assert.ErrorContains(t, err, "one of run, command, script, assert or reboot must be set")
+
+	var s Step
+	require.NoError(t, yaml.Unmarshal([]byte("name: Pull\nretries: 4\nretryDelay: 5s\n"), &s))
+	assert.Equal(t, Step{Name: "Pull", Retries: 4, RetryDelay: 5 * time.Second}, s)
+}
+
+func TestWhen(t *testing.T) {
+	ctx := context.Background()
+	nodes := testNodes("deb1", "rhel1")
+	var mu sync.Mutex
+	ran := map[string][]string{}
+	step := func(name, when string) Step {
+		return Step{Name: name, When: when, Run: func(ctx context.Context, node modules.Node) error {
+			mu.Lock()
+			defer mu.Unlock()
+			ran[name] = append(ran[name], node.Name())
+			return nil
+		}}
+	}
+	p := &Pipeline{
+		Config: map[string]interface{}{"airgapped": true},
+		Facts: func(ctx context.Context, node modules.Node) (map[string]interface{}, error) {
+			if node.Name() == "deb1" {
+				return map[string]interface{}{"os_family": "debian"}, nil
+			}
+			return map[string]interface{}{"os_family": "rhel"}, nil
+		},
+		Tasks: []Task{
+			{Name: "Repos", When: `!config.airgapped`, Steps: []Step{step("AddRepo", "")}},
+			{Name: "Packages", Steps: []Step{
+				step("AptInstall", `facts.os_family == "debian"`),
+				step("DnfInstall", `facts.os_family == "rhel"`),
+				step("After", `steps.AptInstall.ok || steps.DnfInstall.ok`),
+				step("Deb1Only", `host.name == "deb1"`),
+			}},
+		},
+	}
+	require.NoError(t, p.Run(ctx, nodes))
+	assert.Equal(t, map[string][]string{
+		"AptInstall": {"deb1"},
+		"DnfInstall": {"rhel1"},
+		"After":      {"deb1", "rhel1"},
+		"Deb1Only":   {"deb1"},
+	}, sortedValues(ran))
+
+	p.Tasks = []Task{{Name: "Bad", Steps: []Step{step("Typo", `config.airgaped`)}}}
+	err := p.Run(ctx, nodes)
+	assert.Equal(t, errs.Config, errs.KindOf(err))
+	assert.ErrorContains(t, err, "config.airgaped is not defined")
+
+	p.Tasks = []Task{{Steps: []Step{step("Syntax", `facts.os_family ==`)}}}
+	assert.Equal(t, errs.Config, errs.KindOf(p.Validate()))
+
+	p.Tasks = []Task{{Steps: []Step{step("Same", ""), step("Same", "")}}}
+	assert.ErrorContains(t, p.Validate(), "duplicate name")
+}
+
+func sortedValues(m map[string][]string) map[string][]string {
+	for _, v := range m {
+		sort.Strings(v)
+	}
+	return m
+}
+
+func TestOutputs(t *testing.T) {
+	ctx := context.Background()
+	fakes := connectortest.NewConnector()
+	fakes.Host("master1").On(`kubeadm token create`, connectortest.Result{Stdout: "kubeadm join 10.0.0.1:6443 --token abc.def\n"})
+	fakes.Host("master1").On(`crictl info`, connectortest.Result{Stdout: `{"status":{"conditions":[{"type":"RuntimeReady"}]},"config":{"sandboxImage":"pause:3.9"}}`})
+	var nodes []modules.Node
+	for _, n := range testNodes("master1", "worker1") {
+		n.Conn = fakes.Host(n.Name())
+		nodes = append(nodes, n)
+	}
+	master := `host.name == "master1"`
+
+	p := &Pipeline{Tasks: []Task{{Name: "Join", Steps: []Step{
+		{Name: "CreateToken", When: master, Command: "kubeadm token create --print-join-command", Register: "join", Global: true},
+		{Name: "RuntimeInfo", When: master, Command: "crictl info -o json", Register: "runtime", Parse: ParseJSON},
+		{Name: "Join", When: `!(host.name == "master1")`, Command: "{{ .Outputs.join }} --node-name {{ .Host.Name }}"},
+		{Name: "Record", Run: func(ctx context.Context, node modules.Node) error {
+			join, ok := Output(ctx, "join")
+			require.True(t, ok)
+			Register(ctx, "seen", join)
+			return nil
+		}},
+		{Name: "Pause", When: master + ` && outputs.runtime.config.sandboxImage == "pause:3.9"`, Run: func(ctx context.Context, node modules.Node) error {
+			Register(ctx, "pause", true)
+			return nil
+		}},
+	}}}}
+	require.NoError(t, p.Run(ctx, nodes))
+
+	assert.True(t, fakes.Host("worker1").Ran(`kubeadm join 10\.0\.0\.1:6443 --token abc\.def --node-name worker1`))
+	assert.False(t, fakes.Host("master1").Ran(`kubeadm join`))
+	seen, _ := p.Outputs.Get("worker1", "seen")
+	assert.Equal(t, "kubeadm join 10.0.0.1:6443 --token abc.def", seen)
+	_, ok := p.Outputs.Get("worker1", "runtime")
+	assert.False(t, ok, "host outputs are not shared")
+	assert.Equal(t, true, p.Outputs.For("master1")["pause"])
+
+	fakes.Host("master1").On(`broken`, connectortest.Result{Stdout: "not json"})
+	p = &Pipeline{Tasks: []Task{{Steps: []Step{{Name: "Broken", When: master, Command: "broken", Register: "x", Parse: ParseJSON}}}}}
+	err := p.Run(ctx, nodes)
+	assert.ErrorContains(t, err, "register x: output is not valid JSON")
+
+	p = &Pipeline{Tasks: []Task{{Steps: []Step{{Name: "Missing", Command: "echo {{ .Outputs.nothing }}"}}}}}
+	assert.Equal(t, errs.Config, errs.KindOf(p.Run(ctx, nodes)))
+
+	for _, s := range []Step{
+		{Name: "Both", Command: "true", Run: func(context.Context, modules.Node) error { return nil }},
+		{Name: "RegisterRun", Register: "x", Run: func(context.Context, modules.Node) error { return nil }},
+		{Name: "Parse", Command: "true", Parse: "yaml"},
+	} {
+		assert.Error(t, s.Validate(), s.Name)
+	}
+}
+
+func TestStrategy(t *testing.T) {
+	ctx := context.Background()
+	nodes := testNodes("node1", "node2", "node3")
+	var (
+		mu              sync.Mutex
+		order           []string
+		running, maxRun int
+	)
+	step := func(name string, fail string) Step {
+		return Step{Name: name, Run: func(ctx context.Context, node modules.Node) error {
+			mu.Lock()
+			running++
+			if running > maxRun {
+				maxRun = running
+			}
+			order = append(order, node.Name()+":"+name)
+			mu.Unlock()
+			time.Sleep(5 * time.Millisecond)
+			mu.Lock()
+			running--
+			mu.Unlock()
+			if node.Name() == fail {
+				return errs.Wrap(errs.Execution, errors.New("member add failed"))
+			}
+			return nil
+		}}
+	}
+	reset := func() {
+		order, maxRun = nil, 0
+	}
+
+	p := &Pipeline{Tasks: []Task{{Name: "Etcd", Strategy: StrategySerial, Steps: []Step{step("Add", ""), step("Start", "")}}}}
+	require.NoError(t, p.Run(ctx, nodes))
+	assert.Equal(t, 1, maxRun)
+	assert.Equal(t, []string{"node1:Add", "node1:Start", "node2:Add", "node2:Start", "node3:Add", "node3:Start"}, order)
+
+	reset()
+	p.Tasks = []Task{{Name: "Upgrade", Strategy: "rolling(2)", Steps: []Step{step("Drain", "node2"), step("Upgrade", "")}}}
+	err := p.Run(ctx, nodes)
+	assert.Equal(t, "node2", errs.HostOf(err))
+	assert.Equal(t, 2, maxRun)
+	assert.ElementsMatch(t, []string{"node1:Drain", "node2:Drain"}, order, "the failed batch stops the task")
+
+	reset()
+	p.Tasks = []Task{{Name: "Packages", Steps: []Step{step("Install", "")}}}
+	require.NoError(t, p.Run(ctx, nodes))
+	assert.Equal(t, 3, maxRun)
+
+	for _, s := range []string{"rolling", "rolling(0)", "rolling(x)", "batch"} {
+		p.Tasks = []Task{{Name: "Bad", Strategy: s, Steps: []Step{step("Install", "")}}}
+		assert.Equal(t, errs.Config, errs.KindOf(p.Validate()), s)
+	}
+}
+
+func TestRebootStep(t *testing.T) {
+	ctx := context.Background()
+	nodes := testNodes("node1", "node2", "node3")
+	var (
+		mu            sync.Mutex
+		down, maxDown int
+	)
+	for i := range nodes {
+		fake := connectortest.NewFake()
+		fake.OnFunc(func(cmd string) bool { return strings.Contains(cmd, "/proc/uptime") }, func(string) connectortest.Result {
+			if fake.Reconnects() > 0 {
+				return connectortest.Result{Stdout: "3.00 4.00\n"}
+			}
+			return connectortest.Result{Stdout: "5000.00 9000.00\n"}
+		}).OnFunc(func(cmd string) bool { return strings.Contains(cmd, "systemctl reboot") }, func(string) connectortest.Result {
+			mu.Lock()
+			down++
+			if down > maxDown {
+				maxDown = down
+			}
+			mu.Unlock()
+			return connectortest.Result{}
+		}).OnReconnect(func() error {
+			time.Sleep(5 * time.Millisecond)
+			mu.Lock()
+			down--
+			mu.Unlock()
+			return nil
+		})
+		nodes[i].Conn = fake
+	}
+
+	p := &Pipeline{Tasks: []Task{{Name: "Kernel", Strategy: "rolling(1)", Steps: []Step{{
+		Name: "Reboot", Reboot: &Reboot{Interval: time.Millisecond},
+	}}}}}
+	require.NoError(t, p.Run(ctx, nodes))
+	assert.Equal(t, 1, maxDown, "one node of the batch reboots at a time")
+	for _, n := range nodes {
+		assert.Equal(t, 1, n.Conn.(*connectortest.Fake).Reconnects(), n.Name())
+	}
+
+	p.Tasks[0].Strategy = ""
+	err := p.Validate()
+	assert.Equal(t, errs.Config, errs.KindOf(err))
+	assert.ErrorContains(t, err, "would reboot every node at once")
+	p.Tasks[0].Steps[0].Reboot.Parallel = true
+	require.NoError(t, p.Validate())
+
+	assert.Error(t, Step{Name: "Bad", Reboot: &Reboot{Timeout: -time.Second}}.Validate())
+	assert.Error(t, Step{Name: "Bad", Reboot: &Reboot{}, Register: "out"}.Validate())
+}
+
+func TestScript(t *testing.T) {
+	ctx := context.Background()
+	fake := connectortest.NewFake().
+		On(`^/bin/bash '/tmp/xmcores/scripts/Check-.*\.sh' 'node1' 'it'\\''s'$`, connectortest.Result{Stdout: "ready\n"}).
+		On(`python3 .*Fail-`, connectortest.Result{Stderr: "Traceback", ExitCode: 1})
+	node := testNodes("node1")[0]
+	node.Conn = fake
+	local := filepath.Join(t.TempDir(), "fail.py")
+	require.NoError(t, os.WriteFile(local, []byte("raise SystemExit(1)\n"), 0644))
+
+	p := &Pipeline{Tasks: []Task{{Steps: []Step{{
+		Name:     "Check",
+		Script:   &Script{Content: "#!/bin/bash\nset -e\necho \"{{ .Host.Name }}\" | grep -q node\n", Args: []string{"{{ .Host.Name }}", "it's"}},
+		Register: "state",
+	}}}}}
+	require.NoError(t, p.Run(ctx, []modules.Node{node}))
+	state, _ := p.Outputs.Get("node1", "state")
+	assert.Equal(t, "ready", state)
+
+	files := fake.Files()
+	require.Len(t, files, 1)
+	content, _ := fake.ReadFile(files[0])
+	assert.Equal(t, "#!/bin/bash\nset -e\necho \"node1\" | grep -q node\n", string(content))
+	info, err := fake.StatRemote(ctx, files[0])
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0700), info.Mode())
+	assert.True(t, fake.Ran(`^rm -f '`+regexp.QuoteMeta(files[0])+`'$`), "the script is removed")
+
+	p = &Pipeline{Tasks: []Task{{Steps: []Step{{
+		Name:   "Fail",
+		Script: &Script{Path: local, Sudo: true, Interpreter: "python3"},
+	}}}}}
+	err = p.Run(ctx, []modules.Node{node})
+	assert.Equal(t, errs.Execution, errs.KindOf(err))
+	assert.True(t, fake.Ran(`^sudo .*rm -f .*/tmp/xmcores/scripts/Fail-`), "the script is removed after a failure, with sudo")
+
+	for _, s := range []*Script{{}, {Path: local, Content: "echo"}} {
+		assert.Error(t, Step{Name: "Bad", Script: s}.Validate())
+	}
+	p.Tasks[0].Steps[0].Script = &Script{Path: filepath.Join(t.TempDir(), "missing.sh")}
+	assert.Equal(t, errs.Config, errs.KindOf(p.Run(ctx, []modules.Node{node})))
+}
+
+func TestAssert(t *testing.T) {
+	ctx := context.Background()
+	fake := connectortest.NewFake().
+		On(`cat /etc/os-release`, connectortest.Result{Stdout: "ID=ubuntu\nID_LIKE=debian\nVERSION_ID=\"22.04\"\n"}).
+		On(`uname -m`, connectortest.Result{Stdout: "x86_64\n"}).
+		On(`nproc`, connectortest.Result{Stdout: "2\n3900\n"}).
+		On(`kubectl get nodes`, connectortest.Result{Stdout: "master1 Ready\nworker1 NotReady\n"})
+	node := testNodes("master1")[0]
+	node.Conn = fake
+
+	p := &Pipeline{Tasks: []Task{{Name: "Preflight", Steps: []Step{
+		{Name: "OS", Assert: &Assert{That: []string{`os_family == "debian"`, `facts.arch == "amd64"`}}},
+		{Name: "Memory", Assert: &Assert{
+			That:    []string{"cpus >= 2", "memory_mb >= 4096"},
+			Message: "{{ .Host.Name }} has {{ .Facts.memory_mb }} MiB of memory, at least 4096 MiB is required",
+		}},
+	}}}}
+	err := p.Run(ctx, []modules.Node{node})
+	assert.Equal(t, errs.Preflight, errs.KindOf(err))
+	assert.Equal(t, "1.2 Preflight/Memory", errs.StepOf(err))
+	assert.EqualError(t, err, `master1: 1.2 Preflight/Memory: master1 has 3900 MiB of memory, at least 4096 MiB is required (assertion "memory_mb >= 4096" failed)`)
+	assert.Len(t, fake.Commands(), 4, "facts are gathered once")
+	assert.True(t, fake.Ran(`sudo -n true`))
+	assert.True(t, fake.Ran(`cat /etc/os-release`))
+
+	p = &Pipeline{Tasks: []Task{{Steps: []Step{
+		{Name: "Nodes", Command: "kubectl get nodes --no-headers -o custom-columns=N:.metadata.name,S:.status.conditions[-1].type", Register: "nodes", Parse: ParseLines},
+		{Name: "Verify", Assert: &Assert{That: []string{`nodes.0 == "master1 Ready"`, `nodes.1 == "worker1 Ready"`}, Kind: AssertVerification}},
+	}}}}
+	err = p.Run(ctx, []modules.Node{node})
+	assert.Equal(t, errs.Verification, errs.KindOf(err))
+	assert.ErrorContains(t, err, `assertion "nodes.1 == \"worker1 Ready\"" failed`)
+
+	for _, a := range []*Assert{{}, {That: []string{"true"}, Kind: "fatal"}} {
+		assert.Error(t, Step{Name: "Bad", Assert: a}.Validate())
+	}
+	assert.Error(t, Step{Name: "Bad", Assert: &Assert{That: []string{"true"}}, Register: "x"}.Validate())
+	p.Tasks = []Task{{Steps: []Step{{Name: "Syntax", Assert: &Assert{That: []string{"cpus >="}}}}}}
+	assert.ErrorContains(t, p.Validate(), `step "Syntax": assert`)
+}
+
+func TestBudgetAndReport(t *testing.T) {
+	ctx := context.Background()
+	nodes := testNodes("node1", "node2")
+	sleep := func(name string, d map[string]time.Duration) Step {
+		return Step{Name: name, Run: func(ctx context.Context, node modules.Node) error {
+			return wait.Sleep(ctx, d[node.Name()])
+		}}
+	}
+	p := &Pipeline{Tasks: []Task{
+		{Name: "Fast", Steps: []Step{sleep("Quick", map[string]time.Duration{"node1": time.Millisecond})}},
+		{Name: "Slow", Steps: []Step{sleep("Pull", map[string]time.Duration{"node1": 5 * time.Millisecond, "node2": 40 * time.Millisecond})}},
+	}}
+	require.NoError(t, p.Run(ctx, nodes))
+	r := p.Report
+	require.Len(t, r.Modules, 2)
+	assert.Equal(t, "Slow", r.Modules[0].Name)
+	assert.GreaterOrEqual(t, r.Modules[0].Duration, 40*time.Millisecond)
+	assert.Equal(t, "node2", r.Hosts[0].Name)
+	assert.Equal(t, []string{"2.1 Slow/Pull", "1.1 Fast/Quick"}, []string{r.Steps[0].Name, r.Steps[1].Name})
+	require.Len(t, r.Costs, 4)
+	assert.Equal(t, Cost{Task: "Slow", Step: "2.1 Slow/Pull", Host: "node2"}, Cost{Task: r.Costs[0].Task, Step: r.Costs[0].Step, Host: r.Costs[0].Host})
+	assert.GreaterOrEqual(t, r.Elapsed, 40*time.Millisecond)
+	assert.Contains(t, r.String(), "Modules:\n  Slow")
+
+	var ran atomic.Bool
+	p = &Pipeline{Budget: 20 * time.Millisecond, Tasks: []Task{{Name: "Upgrade", Steps: []Step{
+		sleep("Hang", map[string]time.Duration{"node1": time.Hour, "node2": time.Hour}),
+		{Name: "After", Run: func(ctx context.Context, node modules.Node) error {
+			ran.Store(true)
+			return nil
+		}},
+	}}}}
+	err := p.Run(ctx, nodes)
+	assert.Equal(t, errs.Execution, errs.KindOf(err))
+	assert.ErrorContains(t, err, "budget of 20ms exceeded")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.False(t, ran.Load())
+	assert.Less(t, p.Report.Elapsed, time.Second)
+}
+
+func TestTimeline(t *testing.T) {
+	nodes := testNodes("node1", "node2")
+	sleep := func(name string, d time.Duration) Step {
+		return Step{Name: name, Run: func(ctx context.Context, node modules.Node) error {
+			return wait.Sleep(ctx, d)
+		}}
+	}
+	tl := &Timeline{}
+	ctx := WithTimeline(context.Background(), tl)
+	require.NoError(t, (&Pipeline{Name: "first", Tasks: []Task{{Name: "Prepare", Steps: []Step{sleep("Pull", 10*time.Millisecond)}}}}).Run(ctx, nodes))
+	require.NoError(t, (&Pipeline{Name: "second", Tasks: []Task{{Name: "Install", Strategy: StrategySerial, Steps: []Step{sleep("Join", 5*time.Millisecond)}}}}).Run(ctx, nodes))
+
+	spans := tl.Spans()
+	require.Len(t, spans, 4)
+	assert.Equal(t, "first", spans[0].Pipeline)
+	assert.Equal(t, "1.1 second/Install/Join", spans[3].Step)
+	// The serial step runs on one host after the other, after the first pipeline.
+	assert.GreaterOrEqual(t, spans[2].Offset, 10*time.Millisecond)
+	assert.GreaterOrEqual(t, spans[3].Offset, spans[2].Offset+5*time.Millisecond)
+
+	dir := t.TempDir()
+	require.NoError(t, tl.WriteFile(filepath.Join(dir, "timeline.json")))
+	data, err := os.ReadFile(filepath.Join(dir, "timeline.json"))
+	require.NoError(t, err)
+	var trace struct {
+		TraceEvents []traceEvent `json:"traceEvents"`
+	}
+	require.NoError(t, json.Unmarshal(data, &trace))
+	var complete, names int
+	for _, e := range trace.TraceEvents {
+		switch e.Ph {
+		case "X":
+			complete++
+			assert.Positive(t, e.Dur)
+		case "M":
+			names++
+		}
+	}
+	assert.Equal(t, 4, complete)
+	assert.Equal(t, 6, names, "2 pipelines and 2 hosts in each")
+
+	require.NoError(t, tl.WriteFile(filepath.Join(dir, "timeline.html")))
+	data, err = os.ReadFile(filepath.Join(dir, "timeline.html"))
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "<td>second</td><td>node2</td>")
+	assert.Contains(t, string(data), "background: hsl(")
+}
+
+func TestQuarantine(t *testing.T) {
+	var attempts sync.Map
+	failOn := func(name string, hosts ...string) Step {
+		return Step{Name: name, Retries: 3, RetryDelay: time.Millisecond, Run: func(ctx context.Context, node modules.Node) error {
+			n, _ := attempts.LoadOrStore(name+"/"+node.Name(), new(atomic.Int32))
+			n.(*atomic.Int32).Add(1)
+			for _, h := range hosts {
+				if node.Name() == h {
+					return errs.Transient(errors.New("disk I/O error"))
+				}
+			}
+			return nil
+		}}
+	}
+	count := func(key string) int32 {
+		n, ok := attempts.Load(key)
+		if !ok {
+			return 0
+		}
+		return n.(*atomic.Int32).Load()
+	}
+
+	nodes := testNodes("node1", "node2", "node3")
+	q := &Quarantine{After: 2}
+	ctx := WithQuarantine(context.Background(), q)
+	p := &Pipeline{Name: "install", Tasks: []Task{{Name: "Install", Steps: []Step{failOn("Flaky", "node2"), failOn("Then")}}}}
+	require.NoError(t, p.Run(ctx, nodes))
+	assert.Equal(t, int32(2), count("Flaky/node2"), "retries stop once the host is quarantined")
+	assert.Equal(t, int32(0), count("Then/node2"))
+	assert.Equal(t, int32(1), count("Then/node1"))
+	assert.Equal(t, []string{"node2"}, p.Report.Quarantined)
+	assert.Contains(t, p.Report.String(), "Quarantined: node2")
+
+	// Later pipelines of the command skip the host too.
+	p = &Pipeline{Name: "verify", Tasks: []Task{{Steps: []Step{failOn("Verify")}}}}
+	require.NoError(t, p.Run(ctx, nodes))
+	assert.Equal(t, int32(0), count("Verify/node2"))
+	assert.Empty(t, p.Report.Quarantined)
+
+	require.Len(t, q.Hosts(), 1)
+	assert.Equal(t, QuarantinedHost{Host: "node2", Step: "1.1 install/Install/Flaky", Failures: 2}, QuarantinedHost{Host: q.Hosts()[0].Host, Step: q.Hosts()[0].Step, Failures: q.Hosts()[0].Failures})
+	err := q.Err()
+	assert.Equal(t, errs.Quarantined, errs.KindOf(err))
+	assert.ErrorContains(t, err, "node2: 2 failed attempt(s), last in 1.1 install/Install/Flaky: disk I/O error")
+
+	// Losing two of three etcd members would lose quorum: one host is
+	// quarantined, the other fails the run.
+	for _, n := range nodes {
+		n.Host.(*connector.BaseHost).AddRole(common.RoleEtcd)
+	}
+	q = &Quarantine{After: 1}
+	p = &Pipeline{Tasks: []Task{{Steps: []Step{failOn("Etcd", "node1", "node2")}}}}
+	err = p.Run(WithQuarantine(context.Background(), q), nodes)
+	assert.ErrorContains(t, err, "not quarantined: 1 of 3 etcd hosts would be left, short of a majority")
+	assert.Len(t, q.Hosts(), 1)
+
+	assert.Equal(t, errs.Config, errs.KindOf(p.Run(WithQuarantine(context.Background(), &Quarantine{}), nodes)))
+}
+
+func TestFailurePolicies(t *testing.T) {
+	ctx := context.Background()
+	var mu sync.Mutex
+	ran := map[string][]string{}
+	step := func(name string, failOn ...string) Step {
+		return Step{Name: name, Run: func(ctx context.Context, node modules.Node) error {
+			mu.Lock()
+			ran[name] = append(ran[name], node.Name())
+			mu.Unlock()
+			for _, h := range failOn {
+				if node.Name() == h {
+					return errs.Wrap(errs.Execution, errors.New("boom"))
+				}
+			}
+			return nil
+		}}
+	}
+	nodes := testNodes("node1", "node2", "node3", "node4")
+
+	optional := step("Optional", "node1")
+	optional.ContinueOnError = true
+	p := &Pipeline{Tasks: []Task{{Steps: []Step{optional, step("Next")}}}}
+	require.NoError(t, p.Run(ctx, nodes))
+	assert.Len(t, ran["Next"], 4)
+
+	ran = map[string][]string{}
+	p = &Pipeline{Tasks: []Task{
+		{Name: "Install", MaxFailPercentage: 50, Steps: []Step{step("Pull", "node1"), step("Start")}},
+		{Name: "Verify", Steps: []Step{step("Check")}},
+	}}
+	err := p.Run(ctx, nodes)
+	assert.Equal(t, errs.Execution, errs.KindOf(err))
+	assert.Equal(t, "node1", errs.HostOf(err))
+	assert.Equal(t, "1.1 Install/Pull", errs.StepOf(err))
+	assert.Equal(t, map[string][]string{
+		"Pull":  {"node1", "node2", "node3", "node4"},
+		"Start": {"node2", "node3", "node4"},
+		"Check": {"node2", "node3", "node4"},
+	}, sortedValues(ran))
+	assert.Equal(t, []string{"node1"}, p.Report.Failed)
+	assert.Contains(t, p.Report.String(), "Failed: node1")
+
+	// Three of four is past 50%: the run stops there.
+	ran = map[string][]string{}
+	p.Tasks[0].Steps[0] = step("Pull", "node1", "node2", "node3")
+	err = p.Run(ctx, nodes)
+	assert.ErrorContains(t, err, "node3: 1.1 Install/Pull: boom")
+	assert.Empty(t, ran["Start"])
+
+	// The first failure cancels the step on the other nodes.
+	p = &Pipeline{AnyErrorsFatal: true, Tasks: []Task{{MaxFailPercentage: 100, Steps: []Step{{Name: "Hang", Run: func(ctx context.Context, node modules.Node) error {
+		if node.Name() == "node1" {
+			return errors.New("disk full")
+		}
+		return wait.Sleep(ctx, time.Hour)
+	}}}}}}
+	err = p.Run(ctx, nodes)
+	assert.EqualError(t, err, "node1: 1.1 Hang: disk full")
+
+	p.Tasks[0].MaxFailPercentage = 101
+	assert.Equal(t, errs.Config, errs.KindOf(p.Validate()))
+}
+
+func TestScriptSandbox(t *testing.T) {
+	fake := connectortest.NewFake()
+	node := testNodes("node1")[0]
+	node.Conn = fake
+	ctx := modules.WithSandbox(context.Background(), modules.NewSandbox(modules.SandboxConfig{User: "ops"}))
+	p := &Pipeline{Tasks: []Task{{Steps: []Step{
+		{Name: "Check", Script: &Script{Content: "true"}},
+		{Name: "Root", Script: &Script{Content: "true", Sudo: true}},
+	}}}}
+	require.NoError(t, p.Run(ctx, []modules.Node{node}))
+	assert.True(t, fake.Ran(`useradd .* ops`), "the sandbox user is created")
+	assert.True(t, fake.Ran(`^sudo .*chown .*ops.* .*/tmp/xmcores/scripts/Check-`), "the script is handed over to the sandbox user")
+	assert.True(t, fake.Ran(`^sudo -u ops -H /bin/sh -c 'cd; /bin/bash '\\''/tmp/xmcores/scripts/Check-`))
+	assert.True(t, fake.Ran(`^rm -f '/tmp/xmcores/scripts/Check-`), "the connecting user removes the script")
+	assert.False(t, fake.Ran(`sudo -u ops .*Root-`), "sudo scripts run as root")
+}
+
+func TestScriptLeftoversRemoved(t *testing.T) {
+	fake := connectortest.NewFake().On(`^rm -f '/tmp/xmcores/scripts/`, connectortest.Result{Err: errors.New("connection reset")})
+	node := testNodes("node1")[0]
+	node.Conn = fake
+	p := &Pipeline{Tasks: []Task{{Steps: []Step{{Name: "Check", Script: &Script{Content: "true"}}}}}}
+	require.NoError(t, p.Run(context.Background(), []modules.Node{node}))
+	assert.True(t, fake.Ran(`rm -rf /tmp/xmcores/scripts/Check-`), "the pipeline removes what the step could not")
+}
@@ -0,0 +1,170 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/mensylisir/xmcores/common"
+	"github.com/mensylisir/xmcores/errs"
+	"github.com/mensylisir/xmcores/modules"
+)
+
+// Quarantine sets aside hosts that keep failing, so that a bad disk or wrong
+// credentials on one host neither abort the run nor go unnoticed: once a
+// host's failed step attempts, retries included, reach After, the step that
+// failed stops retrying and the host skips every later step, provided the
+// hosts left still satisfy Quorum; otherwise the run fails as without a
+// quarantine. Err reports the quarantined hosts once the pipelines have run.
+//
+// Like a Selection, a quarantine is carried by the context (see
+// WithQuarantine), so a host quarantined by one pipeline is skipped by the
+// next ones a command runs, and it is safe for concurrent use.
+type Quarantine struct {
+	// After is how many failed attempts quarantine a host; at least 1.
+	After int
+	// Quorum checks that the run can go on with the healthy hosts out of
+	// all the hosts of a pipeline; nil means DefaultQuorum.
+	Quorum func(healthy, all []modules.Node) error
+
+	mu       sync.Mutex
+	failures map[string]int
+	hosts    []QuarantinedHost
+}
+
+// QuarantinedHost is a host set aside by a Quarantine.
+type QuarantinedHost struct {
+	Host string
+	// Step is the ID of the step whose failure quarantined the host.
+	Step     string
+	Failures int
+	Err      error
+}
+
+type quarantineKey struct{}
+
+// WithQuarantine returns ctx carrying q.
+func WithQuarantine(ctx context.Context, q *Quarantine) context.Context {
+	return context.WithValue(ctx, quarantineKey{}, q)
+}
+
+// QuarantineFrom returns the quarantine carried by ctx, if any.
+func QuarantineFrom(ctx context.Context) (*Quarantine, bool) {
+	q, ok := ctx.Value(quarantineKey{}).(*Quarantine)
+	return q, ok && q != nil
+}
+
+// Validate checks the policy.
+func (q *Quarantine) Validate() error {
+	if q.After < 1 {
+		return errs.Wrap(errs.Config, fmt.Errorf("quarantine: after must be at least 1, got %d", q.After))
+	}
+	return nil
+}
+
+// DefaultQuorum requires a healthy host, a healthy control-plane host when
+// there are any, and a majority of the etcd hosts, without which etcd
+// loses quorum.
+func DefaultQuorum(healthy, all []modules.Node) error {
+	if len(healthy) == 0 {
+		return errors.New("no host would be left")
+	}
+	count := func(nodes []modules.Node, role string) int {
+		n := 0
+		for _, node := range nodes {
+			if node.Host != nil && node.Host.IsRole(role) {
+				n++
+			}
+		}
+		return n
+	}
+	if all := count(all, common.RoleControlPlane); all > 0 && count(healthy, common.RoleControlPlane) == 0 {
+		return errors.New("no control-plane host would be left")
+	}
+	if all := count(all, common.RoleEtcd); all > 0 && count(healthy, common.RoleEtcd) <= all/2 {
+		return fmt.Errorf("%d of %d etcd hosts would be left, short of a majority", count(healthy, common.RoleEtcd), all)
+	}
+	return nil
+}
+
+// fail counts a failed attempt on host and reports whether the host has
+// failed often enough to be quarantined. Failures that are not the host's
+// doing, like a cancelled run or a bad configuration, do not count.
+func (q *Quarantine) fail(ctx context.Context, host string, err error) bool {
+	if ctx.Err() != nil || errs.KindOf(err) == errs.Config {
+		return false
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.failures == nil {
+		q.failures = map[string]int{}
+	}
+	q.failures[host]++
+	return q.failures[host] >= q.After
+}
+
+// admit quarantines node after step failed on it with err, if it failed
+// often enough and the hosts of all left satisfy the quorum. It returns why
+// the node was not quarantined when the quorum forbids it.
+func (q *Quarantine) admit(node modules.Node, all []modules.Node, step string, err error) (bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.failures[node.Name()] < q.After {
+		return false, nil
+	}
+	var healthy []modules.Node
+	for _, n := range all {
+		if n.Name() != node.Name() && !q.quarantinedLocked(n.Name()) {
+			healthy = append(healthy, n)
+		}
+	}
+	quorum := q.Quorum
+	if quorum == nil {
+		quorum = DefaultQuorum
+	}
+	if qerr := quorum(healthy, all); qerr != nil {
+		return false, fmt.Errorf("not quarantined: %w", qerr)
+	}
+	q.hosts = append(q.hosts, QuarantinedHost{Host: node.Name(), Step: step, Failures: q.failures[node.Name()], Err: err})
+	return true, nil
+}
+
+// Quarantined reports whether host is quarantined.
+func (q *Quarantine) Quarantined(host string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.quarantinedLocked(host)
+}
+
+func (q *Quarantine) quarantinedLocked(host string) bool {
+	for _, h := range q.hosts {
+		if h.Host == host {
+			return true
+		}
+	}
+	return false
+}
+
+// Hosts returns the quarantined hosts in the order they were quarantined.
+func (q *Quarantine) Hosts() []QuarantinedHost {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([]QuarantinedHost(nil), q.hosts...)
+}
+
+// Err reports the quarantined hosts, once the pipelines have run, as an
+// error of kind errs.Quarantined; nil when there are none.
+func (q *Quarantine) Err() error {
+	hosts := q.Hosts()
+	if len(hosts) == 0 {
+		return nil
+	}
+	lines := make([]string, 0, len(hosts))
+	for _, h := range hosts {
+		lines = append(lines, fmt.Sprintf("  %s: %d failed attempt(s), last in %s: %v", h.Host, h.Failures, h.Step, h.Err))
+	}
+	return errs.Wrap(errs.Quarantined, fmt.Errorf("%d host(s) quarantined, the run completed without them:\n%s",
+		len(hosts), strings.Join(lines, "\n")))
+}
@@ -0,0 +1,44 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/mensylisir/xmcores/modules"
+	"github.com/mensylisir/xmcores/modules/reboot"
+)
+
+// Reboot is a step body that reboots the node and waits until it is back
+// (see reboot.Node), for kernel or boot parameter changes. Every node of a
+// batch reboots at once, so reboot steps belong in tasks with the serial or
+// rolling(N) strategy; a parallel task may only reboot all its nodes
+// together when Parallel says so.
+type Reboot struct {
+	// Timeout bounds the wait for the node to come back; zero means
+	// reboot.DefaultTimeout.
+	Timeout time.Duration `yaml:"timeout,omitempty" json:"timeout,omitempty" doc:"how long to wait for the node to come back, 10m by default"`
+	// Interval is the delay before the second reconnection attempt; zero
+	// means reboot.DefaultInterval.
+	Interval time.Duration `yaml:"interval,omitempty" json:"interval,omitempty" doc:"delay before the second reconnection attempt, 5s by default, doubled after each failed one up to 1m"`
+	// Parallel allows a task with the parallel strategy to reboot all its
+	// nodes at once.
+	Parallel bool `yaml:"parallel,omitempty" json:"parallel,omitempty" doc:"allow a parallel task to reboot all its nodes at once"`
+}
+
+// Validate checks the reboot definition.
+func (r *Reboot) Validate() error {
+	if err := r.options().Validate(); err != nil {
+		return fmt.Errorf("reboot: %w", err)
+	}
+	return nil
+}
+
+func (r *Reboot) options() reboot.Options {
+	return reboot.Options{Timeout: r.Timeout, Interval: r.Interval}
+}
+
+// run reboots node.
+func (r *Reboot) run(ctx context.Context, node modules.Node) error {
+	return reboot.Node(ctx, node, r.options())
+}
@@ -0,0 +1,178 @@
+package pipeline
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mensylisir/xmcores/logger"
+)
+
+// Cost is the time spent on one step on one host, including retries.
+type Cost struct {
+	Task     string
+	Step     string
+	Host     string
+	Start    time.Time
+	Duration time.Duration
+}
+
+// Total is the time spent on a module, step or host.
+type Total struct {
+	Name     string
+	Duration time.Duration
+}
+
+// Report breaks down where a run spent its time, most expensive first, to
+// help tune slow environments.
+type Report struct {
+	Start time.Time
+	// Elapsed is the wall-clock time of the run.
+	Elapsed time.Duration
+	// Modules and Steps are wall-clock times: a step running on ten hosts at
+	// once costs as much as its slowest host.
+	Modules []Total
+	Steps   []Total
+	// Hosts sums the step costs of each host.
+	Hosts []Total
+	Costs []Cost
+	// Quarantined are the hosts the run quarantined (see Quarantine).
+	Quarantined []string
+	// Failed are the hosts the run went on without, their failure being
+	// tolerated by their task (see Task.MaxFailPercentage).
+	Failed []string
+}
+
+// String formats the report as a table.
+func (r Report) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Total %s\n", r.Elapsed.Round(time.Millisecond))
+	if len(r.Quarantined) > 0 {
+		fmt.Fprintf(&b, "Quarantined: %s\n", strings.Join(r.Quarantined, ", "))
+	}
+	if len(r.Failed) > 0 {
+		fmt.Fprintf(&b, "Failed: %s\n", strings.Join(r.Failed, ", "))
+	}
+	for _, section := range []struct {
+		title  string
+		totals []Total
+	}{{"Modules", r.Modules}, {"Steps", r.Steps}, {"Hosts", r.Hosts}} {
+		if len(section.totals) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "%s:\n", section.title)
+		for _, t := range section.totals {
+			fmt.Fprintf(&b, "  %-40s %12s\n", t.Name, t.Duration.Round(time.Millisecond))
+		}
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// clock times a run: it collects costs, estimates the time left from the
+// steps completed so far and tracks the budget.
+type clock struct {
+	start  time.Time
+	budget time.Duration
+	// units is the number of step runs planned, done those completed and
+	// spent their wall-clock time.
+	units, done int
+	spent       time.Duration
+
+	mu          sync.Mutex
+	costs       []Cost
+	quarantines []string
+	failures    []string
+	modules     map[string]time.Duration
+	steps       map[string]time.Duration
+}
+
+func newClock(budget time.Duration, units int) *clock {
+	return &clock{
+		start:   time.Now(),
+		budget:  budget,
+		units:   units,
+		modules: map[string]time.Duration{},
+		steps:   map[string]time.Duration{},
+	}
+}
+
+// cost records the time a step took on one host since start. It is safe for
+// concurrent use.
+func (c *clock) cost(task, step, host string, start time.Time) {
+	d := time.Since(start)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.costs = append(c.costs, Cost{Task: task, Step: step, Host: host, Start: start, Duration: d})
+}
+
+// quarantined records that host was quarantined. It is safe for concurrent use.
+func (c *clock) quarantined(host string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.quarantines = append(c.quarantines, host)
+}
+
+// failed records that host failed within the tolerance of its task. It is
+// safe for concurrent use.
+func (c *clock) failed(host string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.failures = append(c.failures, host)
+}
+
+// stepDone records the wall-clock time of a step on a batch of nodes and logs
+// the progress and the estimated time left.
+func (c *clock) stepDone(task, step string, d time.Duration) {
+	if task == "" {
+		task = "-"
+	}
+	c.modules[task] += d
+	c.steps[step] += d
+	c.done++
+	c.spent += d
+	if c.done > c.units {
+		c.units = c.done
+	}
+	eta := c.spent / time.Duration(c.done) * time.Duration(c.units-c.done)
+	elapsed := time.Since(c.start)
+	logger.Log.InfofStep(step, "Progress %d/%d steps, elapsed %s, about %s left",
+		c.done, c.units, elapsed.Round(time.Second), eta.Round(time.Second))
+	if c.budget > 0 && elapsed+eta > c.budget {
+		logger.Log.WarnfStep(step, "Estimated total %s exceeds the budget of %s", (elapsed + eta).Round(time.Second), c.budget)
+	}
+}
+
+func (c *clock) report() Report {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r := Report{
+		Start:       c.start,
+		Elapsed:     time.Since(c.start),
+		Costs:       append([]Cost(nil), c.costs...),
+		Quarantined: append([]string(nil), c.quarantines...),
+		Failed:      append([]string(nil), c.failures...),
+	}
+	hosts := map[string]time.Duration{}
+	for _, cost := range c.costs {
+		hosts[cost.Host] += cost.Duration
+	}
+	r.Modules, r.Steps, r.Hosts = totals(c.modules), totals(c.steps), totals(hosts)
+	sort.SliceStable(r.Costs, func(i, j int) bool { return r.Costs[i].Duration > r.Costs[j].Duration })
+	return r
+}
+
+func totals(m map[string]time.Duration) []Total {
+	out := make([]Total, 0, len(m))
+	for name, d := range m {
+		out = append(out, Total{Name: name, Duration: d})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Duration != out[j].Duration {
+			return out[i].Duration > out[j].Duration
+		}
+		return out[i].Name < out[j].Name
+	})
+	return out
+}
@@ -0,0 +1,120 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/google/uuid"
+
+	"github.com/mensylisir/xmcores/common"
+	"github.com/mensylisir/xmcores/errs"
+	"github.com/mensylisir/xmcores/logger"
+	"github.com/mensylisir/xmcores/modules"
+)
+
+// DefaultInterpreter runs scripts that do not name one. Scripts are passed to
+// it rather than executed directly because /tmp is often mounted noexec.
+const DefaultInterpreter = "/bin/bash"
+
+// Script is a step body that is uploaded to the node and run there, for logic
+// that does not fit a quoted one-liner.
+type Script struct {
+	// Path is a local script file. Exactly one of Path and Content is set.
+	Path string `yaml:"path,omitempty" json:"path,omitempty" doc:"local script file, unless content is set"`
+	// Content is the script itself.
+	Content string `yaml:"content,omitempty" json:"content,omitempty" doc:"the script itself, a template like command"`
+	// Args are passed to the script, each quoted as a single word.
+	Args []string `yaml:"args,omitempty" json:"args,omitempty" doc:"arguments, each passed as a single word"`
+	// Sudo runs the script as root; otherwise it runs as the sandbox user
+	// when the context carries a modules.Sandbox, else as the connecting user.
+	Sudo bool `yaml:"sudo,omitempty" json:"sudo,omitempty" doc:"run the script as root rather than as the sandbox or connecting user"`
+	// Interpreter runs the script; empty means DefaultInterpreter.
+	Interpreter string `yaml:"interpreter,omitempty" json:"interpreter,omitempty" doc:"program running the script, /bin/bash by default"`
+}
+
+// Validate checks the script definition.
+func (s *Script) Validate() error {
+	switch {
+	case s.Path == "" && s.Content == "":
+		return errors.New("script: path or content must be set")
+	case s.Path != "" && s.Content != "":
+		return errors.New("script: path and content are mutually exclusive")
+	}
+	return nil
+}
+
+// run uploads the script to a unique file under the temporary directory,
+// runs it with args and returns its stdout. Content and args are templates
+// like Step.Command. The file is removed afterwards, whether the script
+// succeeded or not; if even that fails, it stays tracked (see
+// modules.TrackTemp) for the pipeline to remove at the end.
+func (s *Script) run(ctx context.Context, node modules.Node, step string, data map[string]interface{}) (string, error) {
+	content := []byte(s.Content)
+	if s.Path != "" {
+		var err error
+		if content, err = os.ReadFile(s.Path); err != nil {
+			return "", errs.Wrap(errs.Config, fmt.Errorf("failed to read script: %w", err))
+		}
+	}
+	rendered, err := modules.RenderData(node.Host, string(content), data)
+	if err != nil {
+		return "", errs.Wrap(errs.Config, err)
+	}
+	interpreter := s.Interpreter
+	if interpreter == "" {
+		interpreter = DefaultInterpreter
+	}
+	cmd := []string{interpreter}
+
+	remote := path.Join(common.GetTmpDir(), "scripts", fmt.Sprintf("%s-%s.sh", step, uuid.New().String()))
+	cmd = append(cmd, quote(remote))
+	for _, a := range s.Args {
+		arg, err := modules.RenderData(node.Host, a, data)
+		if err != nil {
+			return "", errs.Wrap(errs.Config, err)
+		}
+		cmd = append(cmd, quote(arg))
+	}
+
+	if err := node.Conn.MkDirAll(ctx, path.Dir(remote), common.FileMode0755); err != nil {
+		return "", fmt.Errorf("failed to create %s: %w", path.Dir(remote), err)
+	}
+	modules.TrackTemp(ctx, node, remote)
+	if err := modules.WriteFile(ctx, node.Conn, []byte(rendered), remote, 0700); err != nil {
+		return "", err
+	}
+	execute := modules.RunUnprivileged
+	if s.Sudo {
+		execute = modules.Run
+	}
+	defer func() {
+		// The directory is the connecting user's, even when the file was
+		// handed over to the sandbox user.
+		if _, err := execute(ctx, node.Conn, "rm -f "+quote(remote)); err != nil {
+			logger.Log.WarnfStep(step, "%s: failed to remove %s: %v", node.Name(), remote, err)
+			return
+		}
+		modules.UntrackTemp(ctx, node, remote)
+	}()
+	if s.Sudo {
+		return modules.Run(ctx, node.Conn, strings.Join(cmd, " "))
+	}
+	if sb, ok := modules.SandboxFrom(ctx); ok {
+		if err := sb.Prepare(ctx, node); err != nil {
+			return "", errs.Wrap(errs.Preflight, fmt.Errorf("sandbox %s: %w", sb.User(), err))
+		}
+		if _, err := modules.Run(ctx, node.Conn, "chown "+quote(sb.User())+" "+quote(remote)); err != nil {
+			return "", err
+		}
+	}
+	return modules.RunSandboxed(ctx, node, strings.Join(cmd, " "))
+}
+
+// quote makes s a single shell word.
+func quote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,145 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/mensylisir/xmcores/errs"
+)
+
+// StepID identifies a step of a pipeline by position and by name. Both are
+// the same from one run of a pipeline to the next, so logs, errors and reports
+// carry the ID and a later run can be pointed at the step (see Selection).
+type StepID struct {
+	Pipeline string
+	// Task and Step are 1-based positions.
+	Task, Step int
+	TaskName   string
+	StepName   string
+}
+
+// Index returns the position of the step, e.g. "2.3" for the third step of
+// the second task.
+func (id StepID) Index() string {
+	return strconv.Itoa(id.Task) + "." + strconv.Itoa(id.Step)
+}
+
+// Path returns "pipeline/task/step", leaving out the names that are empty.
+func (id StepID) Path() string {
+	var parts []string
+	for _, p := range []string{id.Pipeline, id.TaskName, id.StepName} {
+		if p != "" {
+			parts = append(parts, p)
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// String returns the index and the path, e.g. "2.3 control-plane/CertRotate/renew-certs".
+func (id StepID) String() string {
+	return id.Index() + " " + id.Path()
+}
+
+// Matches reports whether sel designates the step: its path or the end of it
+// ("renew-certs", "CertRotate/renew-certs"), its index or its index after the
+// pipeline name ("control-plane/2.3"), or its String.
+func (id StepID) Matches(sel string) bool {
+	path := id.Path()
+	switch sel {
+	case "":
+		return false
+	case path, id.Index(), id.String():
+		return true
+	}
+	if id.Pipeline != "" && sel == id.Pipeline+"/"+id.Index() {
+		return true
+	}
+	return strings.HasSuffix(path, "/"+sel)
+}
+
+// StepIDs returns the IDs of the steps of p in order.
+func (p *Pipeline) StepIDs() []StepID {
+	var ids []StepID
+	for ti, t := range p.Tasks {
+		for si, s := range t.Steps {
+			ids = append(ids, StepID{Pipeline: p.Name, Task: ti + 1, Step: si + 1, TaskName: t.Name, StepName: s.Name})
+		}
+	}
+	return ids
+}
+
+// Selection restricts the steps that pipelines run, to resume a failed run
+// at the step that failed or to run a single step again while debugging. It
+// is carried by the context (see WithSelection), so every pipeline a command
+// runs honours it, and it is safe for concurrent use.
+type Selection struct {
+	// StartAt skips the steps before the first step it matches (see
+	// StepID.Matches), including those of earlier pipelines run with the
+	// same selection.
+	StartAt string
+	// Only runs just the steps it matches.
+	Only string
+
+	mu      sync.Mutex
+	started bool
+	matched bool
+}
+
+type selectionKey struct{}
+
+// WithSelection returns ctx carrying s.
+func WithSelection(ctx context.Context, s *Selection) context.Context {
+	return context.WithValue(ctx, selectionKey{}, s)
+}
+
+// SelectionFrom returns the selection carried by ctx, if any.
+func SelectionFrom(ctx context.Context) (*Selection, bool) {
+	s, ok := ctx.Value(selectionKey{}).(*Selection)
+	return s, ok && s != nil
+}
+
+// selects returns which of ids run. A nil selection runs them all.
+func (s *Selection) selects(ids []StepID) map[StepID]bool {
+	out := make(map[StepID]bool, len(ids))
+	if s == nil {
+		for _, id := range ids {
+			out[id] = true
+		}
+		return out
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range ids {
+		if s.StartAt != "" && !s.started {
+			if !id.Matches(s.StartAt) {
+				continue
+			}
+			s.started = true
+		}
+		if s.Only != "" && !id.Matches(s.Only) {
+			continue
+		}
+		s.matched = true
+		out[id] = true
+	}
+	return out
+}
+
+// Err reports the selectors that matched no step, once the pipelines have run.
+func (s *Selection) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var err error
+	switch {
+	case s.StartAt != "" && !s.started:
+		err = fmt.Errorf("no step matches %q to start at", s.StartAt)
+	case s.Only != "" && !s.matched:
+		err = fmt.Errorf("no step matches %q", s.Only)
+	default:
+		return nil
+	}
+	return errs.Wrap(errs.Config, fmt.Errorf("%w; steps are logged as \"<index> <pipeline>/<task>/<step>\"", err))
+}
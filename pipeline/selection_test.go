@@ -0,0 +1,74 @@
+package pipeline
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mensylisir/xmcores/errs"
+	"github.com/mensylisir/xmcores/modules"
+)
+
+func TestStepIDMatches(t *testing.T) {
+	id := StepID{Pipeline: "control-plane", Task: 2, Step: 3, TaskName: "CertRotate", StepName: "renew-certs"}
+	assert.Equal(t, "2.3 control-plane/CertRotate/renew-certs", id.String())
+	for _, sel := range []string{"renew-certs", "CertRotate/renew-certs", "control-plane/CertRotate/renew-certs", "2.3", "control-plane/2.3", id.String()} {
+		assert.True(t, id.Matches(sel), sel)
+	}
+	for _, sel := range []string{"", "certs", "2.4", "kubelet/2.3", "rotate/renew-certs"} {
+		assert.False(t, id.Matches(sel), sel)
+	}
+	assert.Equal(t, "1.1 check", StepID{Task: 1, Step: 1, StepName: "check"}.String())
+}
+
+func TestSelection(t *testing.T) {
+	var (
+		mu  sync.Mutex
+		ran []string
+	)
+	step := func(name string) Step {
+		return Step{Name: name, Run: func(ctx context.Context, node modules.Node) error {
+			mu.Lock()
+			defer mu.Unlock()
+			ran = append(ran, name)
+			return nil
+		}}
+	}
+	first := &Pipeline{Name: "first", Tasks: []Task{{Name: "A", Steps: []Step{step("a1"), step("a2")}}}}
+	second := &Pipeline{Name: "second", Tasks: []Task{
+		{Name: "B", Steps: []Step{step("b1")}},
+		{Name: "C", Steps: []Step{step("c1"), step("c2")}},
+	}}
+	run := func(sel *Selection) []string {
+		ran = nil
+		ctx := WithSelection(context.Background(), sel)
+		require.NoError(t, first.Run(ctx, testNodes("node1")))
+		require.NoError(t, second.Run(ctx, testNodes("node1")))
+		return ran
+	}
+
+	assert.Equal(t, []string{"a1", "a2", "b1", "c1", "c2"}, run(nil))
+
+	sel := &Selection{StartAt: "second/2.1"}
+	assert.Equal(t, []string{"c1", "c2"}, run(sel), "resumes in a later pipeline")
+	assert.NoError(t, sel.Err())
+
+	sel = &Selection{StartAt: "a2"}
+	assert.Equal(t, []string{"a2", "b1", "c1", "c2"}, run(sel))
+
+	sel = &Selection{Only: "C/c2"}
+	assert.Equal(t, []string{"c2"}, run(sel))
+	assert.NoError(t, sel.Err())
+
+	sel = &Selection{Only: "missing"}
+	assert.Empty(t, run(sel))
+	assert.Equal(t, errs.Config, errs.KindOf(sel.Err()))
+	assert.ErrorContains(t, sel.Err(), `no step matches "missing"`)
+
+	sel = &Selection{StartAt: "b1", Only: "a1"}
+	assert.Empty(t, run(sel))
+	assert.ErrorContains(t, sel.Err(), `no step matches "a1"`)
+}
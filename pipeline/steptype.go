@@ -0,0 +1,159 @@
+package pipeline
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StepType is a kind of step body a pipeline defined in YAML can use, so
+// authors can discover the building blocks available (see StepTypes).
+type StepType struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	Parameters  []StepParameter `json:"parameters"`
+}
+
+// StepParameter is a setting of a step, as written in YAML.
+type StepParameter struct {
+	// Name is the YAML key, dotted for nested settings, e.g. "script.path".
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Description string `json:"description"`
+	Required    bool   `json:"required,omitempty"`
+}
+
+// StepParametersOf returns the parameters of the struct v, or of the struct
+// it points to, from the tags of its fields: the yaml tag names the
+// parameter, which is required unless omitempty, and the doc tag describes
+// it. Fields without a doc tag are left out, and struct fields are expanded
+// into dotted parameters.
+func StepParametersOf(v interface{}) []StepParameter {
+	return stepParameters(reflect.TypeOf(v), "", "")
+}
+
+// stepParameters returns the parameters of the fields of t for step type
+// typ, whose fields are those with a matching step tag; an empty typ
+// selects the fields without a step tag, common to every type.
+func stepParameters(t reflect.Type, prefix, typ string) []StepParameter {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	var out []StepParameter
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, opts, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+		if !f.IsExported() || name == "" || name == "-" {
+			continue
+		}
+		types, tagged := f.Tag.Lookup("step")
+		if tagged != (typ != "") || tagged && !contains(strings.Split(types, ","), typ) {
+			continue
+		}
+		ft := f.Type
+		if ft.Kind() == reflect.Pointer {
+			ft = ft.Elem()
+		}
+		if ft.Kind() == reflect.Struct && ft != reflect.TypeOf(time.Time{}) {
+			out = append(out, stepParameters(ft, prefix+name+".", "")...)
+			continue
+		}
+		doc, ok := f.Tag.Lookup("doc")
+		if !ok {
+			continue
+		}
+		out = append(out, StepParameter{
+			Name:        prefix + name,
+			Type:        parameterType(f.Type),
+			Description: doc,
+			// The field choosing the step type is required by the type.
+			Required: !strings.Contains(opts, "omitempty") || typ != "" && name == typ,
+		})
+	}
+	return out
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// parameterType names the YAML type of a field of type t.
+func parameterType(t reflect.Type) string {
+	if t == reflect.TypeOf(time.Duration(0)) {
+		return "duration"
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return parameterType(t.Elem())
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "bool"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "int"
+	case reflect.Float32, reflect.Float64:
+		return "float"
+	case reflect.Slice, reflect.Array:
+		return "list of " + parameterType(t.Elem())
+	case reflect.Map:
+		return "map of " + parameterType(t.Elem())
+	}
+	return "object"
+}
+
+var stepTypes = struct {
+	mu    sync.RWMutex
+	types map[string]StepType
+}{types: map[string]StepType{}}
+
+func init() {
+	for _, st := range []struct{ name, description string }{
+		{"command", "Run a shell command with sudo on every node"},
+		{"script", "Upload a script to every node and run it, for logic that does not fit a one-liner"},
+		{"assert", "Check expressions against the facts and outputs of every node, running nothing"},
+		{"reboot", "Reboot every node of the batch and wait until it is back, its uptime reset"},
+	} {
+		DefineStepType(StepType{Name: st.name, Description: st.description, Parameters: stepParameters(reflect.TypeOf(Step{}), "", st.name)})
+	}
+}
+
+// CommonStepParameters returns the parameters every step accepts, whatever
+// its type.
+func CommonStepParameters() []StepParameter {
+	return stepParameters(reflect.TypeOf(Step{}), "", "")
+}
+
+// DefineStepType makes a step type discoverable. It panics when the name is
+// empty or already defined.
+func DefineStepType(st StepType) {
+	if st.Name == "" {
+		panic("pipeline: step type without a name")
+	}
+	stepTypes.mu.Lock()
+	defer stepTypes.mu.Unlock()
+	if _, ok := stepTypes.types[st.Name]; ok {
+		panic(fmt.Sprintf("pipeline: step type %s defined twice", st.Name))
+	}
+	stepTypes.types[st.Name] = st
+}
+
+// StepTypes returns the step types sorted by name.
+func StepTypes() []StepType {
+	stepTypes.mu.RLock()
+	defer stepTypes.mu.RUnlock()
+	out := make([]StepType, 0, len(stepTypes.types))
+	for _, st := range stepTypes.types {
+		out = append(out, st)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
@@ -0,0 +1,54 @@
+package pipeline
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/mensylisir/xmcores/modules"
+)
+
+// Task strategies.
+const (
+	// StrategyParallel runs each step on all nodes at once. It is the default.
+	StrategyParallel = "parallel"
+	// StrategySerial runs the whole task on one node after the other, for
+	// operations such as etcd member add or control-plane join.
+	StrategySerial = "serial"
+	// StrategyRolling is the prefix of "rolling(N)", which runs the whole task
+	// on N nodes at a time.
+	StrategyRolling = "rolling"
+)
+
+// batchSize returns how many nodes strategy runs a task on at a time; 0 means
+// all of them.
+func batchSize(strategy string) (int, error) {
+	switch strategy {
+	case "", StrategyParallel:
+		return 0, nil
+	case StrategySerial:
+		return 1, nil
+	}
+	if arg, ok := strings.CutPrefix(strategy, StrategyRolling+"("); ok {
+		if arg, ok = strings.CutSuffix(arg, ")"); ok {
+			n, err := strconv.Atoi(strings.TrimSpace(arg))
+			if err == nil && n > 0 {
+				return n, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("unsupported strategy %q (use %q, %q or %q)", strategy, StrategyParallel, StrategySerial, StrategyRolling+"(N)")
+}
+
+// batches splits nodes into consecutive groups of size; size 0 means one group.
+func batches(nodes []modules.Node, size int) [][]modules.Node {
+	if size <= 0 || size >= len(nodes) {
+		return [][]modules.Node{nodes}
+	}
+	var out [][]modules.Node
+	for len(nodes) > size {
+		out = append(out, nodes[:size])
+		nodes = nodes[size:]
+	}
+	return append(out, nodes)
+}
@@ -0,0 +1,235 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Timeline collects when each step ran on each host across the pipelines a
+// command runs, to be exported as a Gantt chart where steps that serialize
+// the run stand out. It is carried by the context (see WithTimeline), like a
+// Selection, and is safe for concurrent use.
+type Timeline struct {
+	mu   sync.Mutex
+	runs []timelineRun
+}
+
+type timelineRun struct {
+	pipeline string
+	report   Report
+}
+
+type timelineKey struct{}
+
+// WithTimeline returns ctx carrying t.
+func WithTimeline(ctx context.Context, t *Timeline) context.Context {
+	return context.WithValue(ctx, timelineKey{}, t)
+}
+
+// TimelineFrom returns the timeline carried by ctx, if any.
+func TimelineFrom(ctx context.Context) (*Timeline, bool) {
+	t, ok := ctx.Value(timelineKey{}).(*Timeline)
+	return t, ok && t != nil
+}
+
+// Add records the report of a run of the pipeline named name. Run adds its
+// report to the timeline ctx carries.
+func (t *Timeline) Add(name string, r Report) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.runs = append(t.runs, timelineRun{pipeline: name, report: r})
+}
+
+// Span is a step run on a host, placed on the timeline.
+type Span struct {
+	// Pipeline is the name of the pipeline, or "pipeline N" for the Nth
+	// unnamed one.
+	Pipeline string
+	Cost
+	// Offset is the time from the start of the first run to the start of
+	// the step.
+	Offset time.Duration
+}
+
+// Spans returns the recorded steps in the order they started.
+func (t *Timeline) Spans() []Span {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var origin time.Time
+	for _, r := range t.runs {
+		if origin.IsZero() || r.report.Start.Before(origin) {
+			origin = r.report.Start
+		}
+	}
+	var spans []Span
+	for i, r := range t.runs {
+		name := r.pipeline
+		if name == "" {
+			name = fmt.Sprintf("pipeline %d", i+1)
+		}
+		for _, c := range r.report.Costs {
+			spans = append(spans, Span{Pipeline: name, Cost: c, Offset: c.Start.Sub(origin)})
+		}
+	}
+	sort.SliceStable(spans, func(i, j int) bool { return spans[i].Offset < spans[j].Offset })
+	return spans
+}
+
+// WriteFile writes the timeline to path as an HTML page when its extension
+// is .html or .htm, as trace-event JSON otherwise.
+func (t *Timeline) WriteFile(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".html", ".htm":
+		err = t.WriteHTML(f)
+	default:
+		err = t.WriteTrace(f)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// traceEvent is an event of the Chrome trace-event format, which
+// chrome://tracing and Perfetto open.
+type traceEvent struct {
+	Name string            `json:"name"`
+	Cat  string            `json:"cat,omitempty"`
+	Ph   string            `json:"ph"`
+	Ts   int64             `json:"ts"`
+	Dur  int64             `json:"dur,omitempty"`
+	Pid  int               `json:"pid"`
+	Tid  int               `json:"tid"`
+	Args map[string]string `json:"args,omitempty"`
+}
+
+// WriteTrace writes the timeline in the Chrome trace-event format: a
+// process per pipeline, a thread per host and a complete event per step.
+func (t *Timeline) WriteTrace(w io.Writer) error {
+	events := []traceEvent{}
+	pids, tids := map[string]int{}, map[string]map[string]int{}
+	for _, s := range t.Spans() {
+		pid, ok := pids[s.Pipeline]
+		if !ok {
+			pid = len(pids) + 1
+			pids[s.Pipeline] = pid
+			tids[s.Pipeline] = map[string]int{}
+			events = append(events, traceEvent{Name: "process_name", Ph: "M", Pid: pid, Args: map[string]string{"name": s.Pipeline}})
+		}
+		tid, ok := tids[s.Pipeline][s.Host]
+		if !ok {
+			tid = len(tids[s.Pipeline]) + 1
+			tids[s.Pipeline][s.Host] = tid
+			events = append(events, traceEvent{Name: "thread_name", Ph: "M", Pid: pid, Tid: tid, Args: map[string]string{"name": s.Host}})
+		}
+		events = append(events, traceEvent{
+			Name: s.Step,
+			Cat:  s.Task,
+			Ph:   "X",
+			Ts:   s.Offset.Microseconds(),
+			// Zero durations would be dropped and the event lost.
+			Dur:  max(s.Duration.Microseconds(), 1),
+			Pid:  pid,
+			Tid:  tid,
+			Args: map[string]string{"host": s.Host, "duration": s.Duration.Round(time.Millisecond).String()},
+		})
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", " ")
+	return enc.Encode(struct {
+		TraceEvents     []traceEvent `json:"traceEvents"`
+		DisplayTimeUnit string       `json:"displayTimeUnit"`
+	}{events, "ms"})
+}
+
+type htmlRow struct {
+	Pipeline, Host string
+	Bars           []htmlBar
+}
+
+type htmlBar struct {
+	Title       string
+	Left, Width float64
+	Color       template.CSS
+}
+
+// WriteHTML writes the timeline as a self-contained HTML page with a row per
+// pipeline and host, and a bar per step colored by task.
+func (t *Timeline) WriteHTML(w io.Writer) error {
+	spans := t.Spans()
+	var total time.Duration
+	for _, s := range spans {
+		total = max(total, s.Offset+s.Duration)
+	}
+	var rows []*htmlRow
+	index := map[[2]string]*htmlRow{}
+	colors := map[string]template.CSS{}
+	for _, s := range spans {
+		key := [2]string{s.Pipeline, s.Host}
+		row := index[key]
+		if row == nil {
+			row = &htmlRow{Pipeline: s.Pipeline, Host: s.Host}
+			index[key] = row
+			rows = append(rows, row)
+		}
+		if _, ok := colors[s.Task]; !ok {
+			colors[s.Task] = template.CSS(fmt.Sprintf("hsl(%d, 60%%, 55%%)", len(colors)*137%360))
+		}
+		bar := htmlBar{
+			Title: fmt.Sprintf("%s on %s: %s, at +%s", s.Step, s.Host,
+				s.Duration.Round(time.Millisecond), s.Offset.Round(time.Millisecond)),
+			Color: colors[s.Task],
+		}
+		if total > 0 {
+			bar.Left = 100 * float64(s.Offset) / float64(total)
+			bar.Width = 100 * float64(s.Duration) / float64(total)
+		}
+		row.Bars = append(row.Bars, bar)
+	}
+	return timelineTemplate.Execute(w, struct {
+		Total string
+		Rows  []*htmlRow
+	}{total.Round(time.Millisecond).String(), rows})
+}
+
+var timelineTemplate = template.Must(template.New("timeline").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>xm timeline</title>
+<style>
+body { font: 13px sans-serif; margin: 1em; }
+table { border-collapse: collapse; width: 100%; }
+td { padding: 2px 4px; border-bottom: 1px solid #eee; white-space: nowrap; }
+td.track { position: relative; width: 100%; height: 18px; }
+div.bar { position: absolute; top: 3px; height: 14px; min-width: 1px; border-radius: 2px; }
+</style>
+</head>
+<body>
+<p>Total {{.Total}}. Hover a bar for the step and its duration.</p>
+<table>
+{{- range .Rows}}
+<tr><td>{{.Pipeline}}</td><td>{{.Host}}</td><td class="track">
+{{- range .Bars}}<div class="bar" title="{{.Title}}" style="left: {{printf "%.3f" .Left}}%; width: {{printf "%.3f" .Width}}%; background: {{.Color}}"></div>{{end -}}
+</td></tr>
+{{- end}}
+</table>
+</body>
+</html>
+`))
@@ -0,0 +1,438 @@
+package reconcile
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/mensylisir/xmcores/catalog"
+	"github.com/mensylisir/xmcores/common"
+	"github.com/mensylisir/xmcores/config"
+	"github.com/mensylisir/xmcores/download"
+	"github.com/mensylisir/xmcores/errs"
+	"github.com/mensylisir/xmcores/facts"
+	"github.com/mensylisir/xmcores/kube"
+	"github.com/mensylisir/xmcores/logger"
+	"github.com/mensylisir/xmcores/modules"
+	"github.com/mensylisir/xmcores/modules/binaries"
+	"github.com/mensylisir/xmcores/modules/cgroups"
+	"github.com/mensylisir/xmcores/modules/csrapprove"
+	"github.com/mensylisir/xmcores/modules/existing"
+	"github.com/mensylisir/xmcores/modules/ingress"
+	"github.com/mensylisir/xmcores/modules/k8sops"
+	"github.com/mensylisir/xmcores/modules/kubeadm"
+	"github.com/mensylisir/xmcores/modules/nodemeta"
+	"github.com/mensylisir/xmcores/modules/nodeprep"
+	"github.com/mensylisir/xmcores/modules/storage"
+	"github.com/mensylisir/xmcores/modules/systune"
+	"github.com/mensylisir/xmcores/shellquote"
+	"github.com/mensylisir/xmcores/wait"
+)
+
+// DefaultNodeReadyTimeout bounds the wait for a joined or upgraded node to become Ready.
+const DefaultNodeReadyTimeout = 5 * time.Minute
+
+const (
+	joinConfigPath = "/etc/kubernetes/kubeadm-join.yaml"
+	// caHashCmd prints the SHA-256 of the cluster CA public key, the
+	// discovery hash kubeadm join expects.
+	caHashCmd = "openssl x509 -pubkey -in /etc/kubernetes/pki/ca.crt | openssl rsa -pubin -outform der 2>/dev/null | openssl dgst -sha256 -hex | sed 's/^.* //'"
+)
+
+// Env is what a plan runs against.
+type Env struct {
+	Cluster *config.Cluster
+	Client  *kube.Client
+	// Nodes are the connected inventory hosts, keyed by name.
+	Nodes map[string]modules.Node
+	// Drain is used before upgrading a node's kubelet and before removing it.
+	Drain k8sops.DrainOptions
+	// NodeReadyTimeout defaults to DefaultNodeReadyTimeout.
+	NodeReadyTimeout time.Duration
+	// CacheDir keeps the binaries spec.binaries downloads across runs, keyed
+	// by checksum (see download.WithCacheDir); none are kept when empty.
+	CacheDir string
+}
+
+// Outcome is what Apply did besides the steps of the plan.
+type Outcome struct {
+	// NodePrepare has what the swap, SELinux and firewall policies changed
+	// on each joining host.
+	NodePrepare []nodeprep.Result
+	// SysTune has a report per joining host of the sysctls that differed
+	// from the configuration before they were applied.
+	SysTune []systune.Report
+}
+
+// Apply runs the steps of plan in order and stops at the first failure,
+// which is annotated with the failing step. The kubeadm and kubelet binaries
+// of the desired version must already be installed on the nodes being
+// upgraded or joined, unless spec.binaries installs them on the joining
+// ones; what else a joining node has installed is adopted or
+// removed as spec.existingComponents says, and its containerd is set to the
+// cgroup driver of the kubelets. Before a plan that renders the control-plane
+// configuration, the files of spec.security are written to the control-plane
+// hosts. The hosts about to join are prepared before the first step, see
+// prepare.
+func Apply(ctx context.Context, env Env, plan Plan) (Outcome, error) {
+	if env.NodeReadyTimeout == 0 {
+		env.NodeReadyTimeout = DefaultNodeReadyTimeout
+	}
+	joining := make(map[string]bool)
+	var joiningNodes []modules.Node
+	for _, s := range plan.Steps {
+		if s.Op == OpJoin {
+			joining[s.Target] = true
+			if n, ok := env.Nodes[s.Target]; ok {
+				joiningNodes = append(joiningNodes, n)
+			}
+		}
+	}
+	cp, err := primary(env, joining)
+	if err != nil {
+		return Outcome{}, err
+	}
+	if err := deploySecurity(ctx, env, cp, plan); err != nil {
+		return Outcome{}, errs.WithStep(err, "security")
+	}
+	out, err := prepare(ctx, env, cp, joiningNodes)
+	if err != nil {
+		return out, errs.WithStep(err, "prepare")
+	}
+	for i, s := range plan.Steps {
+		logger.Log.InfofModule(moduleName, "[%d/%d] %s", i+1, len(plan.Steps), s)
+		if err := applyStep(ctx, env, cp, s); err != nil {
+			err = errs.WithStep(err, s.String())
+			if s.Target != "" && s.Op != OpInstallAddon {
+				err = errs.WithHost(err, s.Target)
+			}
+			return out, err
+		}
+	}
+	return out, nil
+}
+
+// primary returns the control-plane node commands are run on: the first one
+// in the inventory that is already part of the cluster.
+func primary(env Env, joining map[string]bool) (modules.Node, error) {
+	for _, h := range env.Cluster.HostsByRole(common.RoleControlPlane) {
+		if joining[h.GetName()] {
+			continue
+		}
+		if n, ok := env.Nodes[h.GetName()]; ok {
+			return n, nil
+		}
+	}
+	return modules.Node{}, errs.Wrap(errs.Config, errors.New("no connected control-plane host is part of the cluster"))
+}
+
+func applyStep(ctx context.Context, env Env, cp modules.Node, s Step) error {
+	switch s.Op {
+	case OpUpgradeControlPlane:
+		_, err := modules.Run(ctx, cp.Conn, "kubeadm upgrade apply -y "+shellquote.Quote(env.Cluster.Spec.Kubernetes.Version))
+		return err
+	case OpUpgradeNode:
+		return upgradeNode(ctx, env, s.Target)
+	case OpJoin:
+		return join(ctx, env, cp, s.Target)
+	case OpMetadata:
+		return metadata(ctx, env, cp, s.Target)
+	case OpInstallAddon:
+		return installAddon(ctx, env, cp, s.Target)
+	case OpRemove:
+		return remove(ctx, env, s.Target)
+	default:
+		return fmt.Errorf("unknown operation %q", s.Op)
+	}
+}
+
+func node(env Env, name string) (modules.Node, error) {
+	n, ok := env.Nodes[name]
+	if !ok {
+		return n, errs.Wrap(errs.Config, fmt.Errorf("host %s is not in the inventory", name))
+	}
+	return n, nil
+}
+
+func waitReady(ctx context.Context, env Env, name string) error {
+	return env.Client.WaitForCondition(ctx, kube.NodePath(name), "Ready", wait.Options{Timeout: env.NodeReadyTimeout})
+}
+
+// upgradeNode drains the node, upgrades its kubeadm-managed configuration,
+// restarts the kubelet and uncordons it once it is Ready again.
+func upgradeNode(ctx context.Context, env Env, name string) error {
+	n, err := node(env, name)
+	if err != nil {
+		return err
+	}
+	opts := env.Drain
+	opts.IgnoreDaemonSets = true
+	if err := k8sops.Drain(ctx, env.Client.Clientset(), name, opts); err != nil {
+		return err
+	}
+	upgrade := "kubeadm upgrade node"
+	patched, err := writePatches(ctx, env, n)
+	if err != nil {
+		return err
+	}
+	if patched {
+		upgrade += " --patches " + kubeadm.PatchesDir
+	}
+	if err := modules.RunAll(ctx, n.Conn, upgrade, "systemctl daemon-reload", "systemctl restart kubelet"); err != nil {
+		return err
+	}
+	if err := waitReady(ctx, env, name); err != nil {
+		return err
+	}
+	return k8sops.Uncordon(ctx, env.Client.Clientset(), name)
+}
+
+// join creates a bootstrap token on the control plane, renders the join
+// configuration for the host and runs kubeadm join on it. With
+// spec.binaries, the binaries for the host's architecture are installed
+// first. When the kubelet requests its serving certificate from the cluster,
+// the request is approved once it matches the host.
+func join(ctx context.Context, env Env, cp modules.Node, name string) error {
+	n, err := node(env, name)
+	if err != nil {
+		return err
+	}
+	if err := prepareExisting(ctx, env, n); err != nil {
+		return err
+	}
+	if err := checkNetwork(ctx, env, n); err != nil {
+		return err
+	}
+	if cfg := env.Cluster.Spec.Binaries; cfg != nil {
+		var opts []download.Option
+		if env.CacheDir != "" {
+			opts = append(opts, download.WithCacheDir(env.CacheDir))
+		}
+		if err := binaries.Deploy(ctx, []modules.Node{n}, env.Cluster.Spec.Kubernetes.Version, *cfg, opts...); err != nil {
+			return err
+		}
+	}
+	driver, err := kubeletCgroupDriver(ctx, env, n)
+	if err != nil {
+		return err
+	}
+	if err := cgroups.Apply(ctx, n, driver); err != nil {
+		return err
+	}
+	params, err := joinParams(ctx, env, cp, n.Host.IsRole(common.RoleControlPlane))
+	if err != nil {
+		return err
+	}
+	cfg, err := env.Cluster.KubeadmJoinConfig(n.Host, params)
+	if err != nil {
+		return err
+	}
+	if err := n.Conn.MkDirAll(ctx, path.Dir(joinConfigPath), common.FileMode0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", path.Dir(joinConfigPath), err)
+	}
+	if _, err := modules.WriteFileWith(ctx, n, cfg, joinConfigPath, common.FileMode0600, modules.WriteOptions{Atomic: true}); err != nil {
+		return err
+	}
+	if _, err := writePatches(ctx, env, n); err != nil {
+		return err
+	}
+	if _, err := modules.Run(ctx, n.Conn, "kubeadm join --config "+joinConfigPath); err != nil {
+		return err
+	}
+	if err := waitReady(ctx, env, name); err != nil {
+		return err
+	}
+	if env.Cluster.KubeletServingCSRs(n.Host) {
+		if err := csrapprove.Wait(ctx, env.Client, csrapprove.NodeOf(n.Host), env.NodeReadyTimeout); err != nil {
+			return err
+		}
+	}
+	return metadata(ctx, env, cp, name)
+}
+
+// prepareExisting applies spec.existingComponents to the containerd and
+// kubelet already on a joining node. As the node is not part of the cluster,
+// the kubeadm state beside an adopted kubelet is left by a failed join and is
+// reset. kubeadm join needs both components, so once one is removed the node
+// cannot join until it is installed again.
+func prepareExisting(ctx context.Context, env Env, n modules.Node) error {
+	version := env.Cluster.Spec.Kubernetes.Version
+	decisions, err := existing.Apply(ctx, n, env.Cluster.Spec.ExistingComponents, catalog.NewCatalog(), version)
+	if err != nil {
+		return err
+	}
+	removed := existing.Removed(decisions)
+	if env.Cluster.Spec.Binaries != nil {
+		// join installs the kubelet of spec.binaries in place of the one removed.
+		removed = slices.DeleteFunc(removed, func(c string) bool { return c == facts.ComponentKubelet })
+	}
+	if len(removed) > 0 {
+		return errs.Wrap(errs.Preflight, fmt.Errorf("removed the %s left by an earlier installation; install versions that suit Kubernetes %s and apply again", strings.Join(removed, " and "), version))
+	}
+	for _, d := range decisions {
+		if d.Component.Name == facts.ComponentKubelet && len(d.Component.Configs) > 0 {
+			if _, err := modules.Run(ctx, n.Conn, "kubeadm reset -f"); err != nil {
+				return fmt.Errorf("failed to reset the state of an earlier join: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// checkNetwork checks that a joining node has its internal addresses on the
+// interface and subnets of the configuration, since kubeadm join would
+// otherwise register it with an address of another network.
+func checkNetwork(ctx context.Context, env Env, n modules.Node) error {
+	out, err := modules.RunUnprivileged(ctx, n.Conn, facts.AddressesCommand)
+	if err != nil {
+		return err
+	}
+	if err := env.Cluster.NodeNetwork(n.Name()).CheckAddresses(facts.ParseAddresses(out)); err != nil {
+		return errs.Wrap(errs.Preflight, err)
+	}
+	return nil
+}
+
+// kubeletConfigPath is the ConfigMap holding the KubeletConfiguration that
+// kubeadm join gives to the kubelet of the joining node.
+const kubeletConfigPath = "/api/v1/namespaces/kube-system/configmaps/kubelet-config"
+
+// kubeletCgroupDriver returns the cgroup driver the kubelet of a joining node
+// will run with: that of the cluster, which kubeadm join applies whatever the
+// configuration says, else the configured one.
+func kubeletCgroupDriver(ctx context.Context, env Env, n modules.Node) (string, error) {
+	configured := env.Cluster.KubeletCgroupDriver(n.Host)
+	var cm struct {
+		Data map[string]string `json:"data"`
+	}
+	if err := env.Client.Get(ctx, kubeletConfigPath, &cm); err != nil {
+		if kube.IsNotFound(err) {
+			return configured, nil
+		}
+		return "", fmt.Errorf("failed to read the kubelet configuration of the cluster: %w", err)
+	}
+	var kc struct {
+		CgroupDriver string `yaml:"cgroupDriver"`
+	}
+	if err := yaml.Unmarshal([]byte(cm.Data["kubelet"]), &kc); err != nil {
+		return "", fmt.Errorf("failed to parse the kubelet configuration of the cluster: %w", err)
+	}
+	if kc.CgroupDriver == "" {
+		// The default of the KubeletConfiguration.
+		kc.CgroupDriver = cgroups.DriverCgroupfs
+	}
+	if kc.CgroupDriver != configured {
+		logger.Log.WarnfModule(moduleName, "the kubelets of the cluster use the %s cgroup driver, not %s as configured; %s follows the cluster", kc.CgroupDriver, configured, n.Name())
+	}
+	return kc.CgroupDriver, nil
+}
+
+// writePatches replaces the kubeadm patches xm writes on the node with those
+// of the configuration and reports whether there are any.
+func writePatches(ctx context.Context, env Env, n modules.Node) (bool, error) {
+	patches, err := env.Cluster.KubeadmPatches(n.Host)
+	if err != nil {
+		return false, err
+	}
+	stale := []string{"rm", "-f"}
+	for _, name := range kubeadm.PatchFiles() {
+		stale = append(stale, path.Join(kubeadm.PatchesDir, name))
+	}
+	if _, err := modules.Run(ctx, n.Conn, shellquote.Join(stale...)); err != nil {
+		return false, err
+	}
+	if len(patches) == 0 {
+		return false, nil
+	}
+	if err := n.Conn.MkDirAll(ctx, kubeadm.PatchesDir, common.FileMode0755); err != nil {
+		return false, fmt.Errorf("failed to create %s: %w", kubeadm.PatchesDir, err)
+	}
+	for name, data := range patches {
+		if _, err := modules.WriteFileWith(ctx, n, data, path.Join(kubeadm.PatchesDir, name), common.FileMode0644, modules.WriteOptions{Atomic: true}); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func joinParams(ctx context.Context, env Env, cp modules.Node, controlPlane bool) (kubeadm.JoinParams, error) {
+	p := kubeadm.JoinParams{
+		APIServerEndpoint: env.Cluster.Spec.Kubernetes.ControlPlaneEndpoint,
+		ControlPlane:      controlPlane,
+	}
+	if p.APIServerEndpoint == "" {
+		p.APIServerEndpoint = net.JoinHostPort(cp.Host.GetInternalIPv4Address(), strconv.Itoa(6443))
+	}
+	token, err := modules.Run(ctx, cp.Conn, "kubeadm token create --ttl 30m")
+	if err != nil {
+		return p, err
+	}
+	p.Token = token
+	hash, err := modules.Run(ctx, cp.Conn, caHashCmd)
+	if err != nil {
+		return p, err
+	}
+	p.CACertHashes = []string{"sha256:" + hash}
+	if controlPlane {
+		out, err := modules.Run(ctx, cp.Conn, "kubeadm init phase upload-certs --upload-certs")
+		if err != nil {
+			return p, err
+		}
+		lines := strings.Split(out, "\n")
+		p.CertificateKey = strings.TrimSpace(lines[len(lines)-1])
+	}
+	return p, nil
+}
+
+// metadata applies the labels, annotations and taints the configuration
+// declares for the node.
+func metadata(ctx context.Context, env Env, cp modules.Node, name string) error {
+	for _, m := range env.Cluster.NodeMetadata() {
+		if m.Node == name {
+			return nodemeta.Apply(ctx, cp, []nodemeta.Metadata{m})
+		}
+	}
+	return nil
+}
+
+func installAddon(ctx context.Context, env Env, cp modules.Node, name string) error {
+	spec := env.Cluster.Spec
+	switch {
+	case strings.HasPrefix(name, addonIngressPrefix) && spec.Ingress != nil:
+		return ingress.Deploy(ctx, cp, *spec.Ingress)
+	case strings.HasPrefix(name, addonStoragePrefix) && spec.Storage != nil:
+		nodes := make([]modules.Node, 0, len(env.Nodes))
+		for _, h := range env.Cluster.Hosts() {
+			if n, ok := env.Nodes[h.GetName()]; ok {
+				nodes = append(nodes, n)
+			}
+		}
+		return storage.Deploy(ctx, cp, nodes, *spec.Storage, spec.Kubernetes.Version)
+	default:
+		return fmt.Errorf("addon %s is not configured", name)
+	}
+}
+
+// remove drains the node and deletes it from the cluster. The host itself is
+// not in the inventory any more, so resetting it is left to the operator.
+func remove(ctx context.Context, env Env, name string) error {
+	opts := env.Drain
+	opts.IgnoreDaemonSets = true
+	opts.DeleteEmptyDirData = true
+	if err := k8sops.Drain(ctx, env.Client.Clientset(), name, opts); err != nil {
+		return err
+	}
+	if err := env.Client.Delete(ctx, kube.NodePath(name)); err != nil && !kube.IsNotFound(err) {
+		return fmt.Errorf("failed to delete node %s: %w", name, err)
+	}
+	logger.Log.InfofModule(moduleName, "node %s removed; run kubeadm reset on the host before reusing it", name)
+	return nil
+}
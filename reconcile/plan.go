@@ -0,0 +1,158 @@
+// Package reconcile turns the differences found by the drift package into an
+// ordered plan and carries it out, moving the live cluster toward the
+// configuration: the control plane and kubelets are upgraded, missing nodes
+// joined, node metadata and addons applied, and extra nodes removed.
+package reconcile
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/mensylisir/xmcores/drift"
+)
+
+const moduleName = "Reconcile"
+
+// Operation is what a plan step does.
+type Operation string
+
+// Operations in the order a plan runs them. The control plane is upgraded
+// before anything joins so new nodes come up at the desired version, and
+// removals come last so workloads have somewhere to go.
+const (
+	OpUpgradeControlPlane Operation = "upgrade-control-plane"
+	OpUpgradeNode         Operation = "upgrade-node"
+	OpJoin                Operation = "join"
+	OpMetadata            Operation = "metadata"
+	OpInstallAddon        Operation = "install-addon"
+	OpRemove              Operation = "remove"
+)
+
+var operations = []Operation{OpUpgradeControlPlane, OpUpgradeNode, OpJoin, OpMetadata, OpInstallAddon, OpRemove}
+
+// Addon name prefixes apply can install. The CNI and CoreDNS come with the
+// initial installation and are reported as unsupported when missing.
+const (
+	addonIngressPrefix = "ingress-"
+	addonStoragePrefix = "storage-"
+)
+
+// Step is one action of a plan.
+type Step struct {
+	Op Operation `json:"op"`
+	// Target is the node or addon the step acts on; empty for the control plane.
+	Target  string         `json:"target,omitempty"`
+	Changes []drift.Change `json:"changes"`
+}
+
+func (s Step) String() string {
+	if s.Target == "" {
+		return string(s.Op)
+	}
+	return string(s.Op) + " " + s.Target
+}
+
+// Destructive reports whether the step removes something from the cluster.
+func (s Step) Destructive() bool {
+	return s.Op == OpRemove
+}
+
+// Plan is the ordered list of steps that reconciles the cluster.
+type Plan struct {
+	Steps []Step `json:"steps"`
+	// Unsupported are the changes apply cannot carry out, such as kubeadm
+	// settings fixed at installation time or a node changing role.
+	Unsupported []drift.Change `json:"unsupported,omitempty"`
+}
+
+// Empty reports whether there is nothing to do.
+func (p Plan) Empty() bool {
+	return len(p.Steps) == 0
+}
+
+// Destructive returns the steps that need confirmation.
+func (p Plan) Destructive() []Step {
+	var steps []Step
+	for _, s := range p.Steps {
+		if s.Destructive() {
+			steps = append(steps, s)
+		}
+	}
+	return steps
+}
+
+// NewPlan groups changes into steps, one per operation and target.
+func NewPlan(changes []drift.Change) Plan {
+	var plan Plan
+	index := make(map[string]int)
+	add := func(op Operation, target string, c drift.Change) {
+		key := string(op) + "/" + target
+		i, ok := index[key]
+		if !ok {
+			i = len(plan.Steps)
+			index[key] = i
+			plan.Steps = append(plan.Steps, Step{Op: op, Target: target})
+		}
+		plan.Steps[i].Changes = append(plan.Steps[i].Changes, c)
+	}
+
+	for _, c := range changes {
+		switch {
+		case c.Kind == drift.KindVersion && c.Field == "":
+			add(OpUpgradeControlPlane, "", c)
+		case c.Kind == drift.KindVersion:
+			add(OpUpgradeNode, c.Name, c)
+		case c.Kind == drift.KindNode && c.Action == drift.ActionAdd:
+			add(OpJoin, c.Name, c)
+		case c.Kind == drift.KindNode && c.Action == drift.ActionRemove:
+			add(OpRemove, c.Name, c)
+		case c.Kind == drift.KindLabel || c.Kind == drift.KindTaint:
+			add(OpMetadata, c.Name, c)
+		case c.Kind == drift.KindAddon && c.Action == drift.ActionAdd &&
+			(strings.HasPrefix(c.Name, addonIngressPrefix) || strings.HasPrefix(c.Name, addonStoragePrefix)):
+			add(OpInstallAddon, c.Name, c)
+		default:
+			plan.Unsupported = append(plan.Unsupported, c)
+		}
+	}
+
+	sort.SliceStable(plan.Steps, func(i, j int) bool {
+		a, b := plan.Steps[i], plan.Steps[j]
+		if a.Op != b.Op {
+			return opOrder(a.Op) < opOrder(b.Op)
+		}
+		return a.Target < b.Target
+	})
+	return plan
+}
+
+func opOrder(op Operation) int {
+	for i, o := range operations {
+		if o == op {
+			return i
+		}
+	}
+	return len(operations)
+}
+
+// Format renders the plan with the changes behind each step.
+func Format(p Plan) string {
+	var b strings.Builder
+	if p.Empty() {
+		b.WriteString("Nothing to apply: the cluster matches the configuration.\n")
+	}
+	for i, s := range p.Steps {
+		fmt.Fprintf(&b, "%d. %s\n", i+1, s)
+		for _, c := range s.Changes {
+			fmt.Fprintf(&b, "     %s\n", c)
+		}
+	}
+	if len(p.Unsupported) > 0 {
+		b.WriteString("Not handled by apply, change manually:\n")
+		for _, c := range p.Unsupported {
+			fmt.Fprintf(&b, "     %s\n", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,155 @@
+package reconcile
+
+import (
+	"context"
+	"sort"
+
+	"github.com/mensylisir/xmcores/catalog"
+	"github.com/mensylisir/xmcores/common"
+	"github.com/mensylisir/xmcores/errs"
+	"github.com/mensylisir/xmcores/modules"
+	"github.com/mensylisir/xmcores/modules/binaries"
+	"github.com/mensylisir/xmcores/modules/imagepreload"
+	"github.com/mensylisir/xmcores/modules/nodeprep"
+	"github.com/mensylisir/xmcores/modules/osrepo"
+	"github.com/mensylisir/xmcores/modules/proxy"
+	"github.com/mensylisir/xmcores/modules/security"
+	"github.com/mensylisir/xmcores/modules/systune"
+	"github.com/mensylisir/xmcores/modules/timesync"
+)
+
+// controlPlaneSteps reports whether plan renders the control-plane
+// configuration on a node: it upgrades the control plane or joins a
+// control-plane host.
+func controlPlaneSteps(env Env, plan Plan) bool {
+	for _, s := range plan.Steps {
+		switch s.Op {
+		case OpUpgradeControlPlane:
+			return true
+		case OpJoin:
+			if n, ok := env.Nodes[s.Target]; ok && n.Host.IsRole(common.RoleControlPlane) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// deploySecurity writes the audit policy and encryption configuration of
+// spec.security to the connected control-plane hosts, cp first so its
+// encryption key is the one kept, since the apiserver flags kubeadm renders
+// point at them.
+func deploySecurity(ctx context.Context, env Env, cp modules.Node, plan Plan) error {
+	sec := env.Cluster.Spec.Security
+	if sec == nil || !controlPlaneSteps(env, plan) {
+		return nil
+	}
+	nodes := []modules.Node{cp}
+	for _, h := range env.Cluster.HostsByRole(common.RoleControlPlane) {
+		if n, ok := env.Nodes[h.GetName()]; ok && h.GetName() != cp.Name() {
+			nodes = append(nodes, n)
+		}
+	}
+	return security.Deploy(ctx, nodes, *sec)
+}
+
+// clusterAddons are the addons of the catalog every node runs pods of: the
+// pause image, CoreDNS and the pod network plugin.
+func clusterAddons(env Env) []string {
+	addons := []string{"pause", "coredns"}
+	if _, ok := catalog.NewCatalog().AddonImages(env.Cluster.Spec.Network.Plugin); ok {
+		addons = append(addons, env.Cluster.Spec.Network.Plugin)
+	}
+	return addons
+}
+
+// checkAddons fails when an image of clusterAddons is not published for the
+// architecture of one of the joining hosts, whose pods would otherwise never
+// pull.
+func checkAddons(ctx context.Context, env Env, joining []modules.Node) error {
+	byArch, err := binaries.Arches(ctx, joining)
+	if err != nil {
+		return err
+	}
+	arches := make([]string, 0, len(byArch))
+	for arch := range byArch {
+		arches = append(arches, arch)
+	}
+	sort.Strings(arches)
+	if err := catalog.NewCatalog().ValidateAddons(clusterAddons(env), arches); err != nil {
+		return errs.Wrap(errs.Preflight, err)
+	}
+	return nil
+}
+
+// CheckArtifacts fetches the checksums of the binaries spec.binaries
+// downloads for the hosts plan joins, see binaries.Checksums. Run while
+// planning, it keeps them in the cache store of ctx for the Apply after it.
+func CheckArtifacts(ctx context.Context, env Env, plan Plan) error {
+	cfg := env.Cluster.Spec.Binaries
+	if cfg == nil {
+		return nil
+	}
+	var joining []modules.Node
+	for _, s := range plan.Steps {
+		if n, ok := env.Nodes[s.Target]; ok && s.Op == OpJoin {
+			joining = append(joining, n)
+		}
+	}
+	if len(joining) == 0 {
+		return nil
+	}
+	return binaries.Checksums(ctx, joining, env.Cluster.Spec.Kubernetes.Version, *cfg)
+}
+
+// prepare readies the hosts about to join before any of them does. Their
+// architectures are checked against the addon images first, see checkAddons.
+// They are given the proxy of spec.proxy and pointed at the offline repository served
+// from cp before anything is installed, their swap, SELinux and firewall policies are applied and their
+// kernel tuned, and their clocks are synchronized, since
+// the certificates the control plane issues them are only valid from its own
+// time. The images of spec.imagePreload are imported last, so the kubelet
+// finds them when it starts the static and DaemonSet pods.
+func prepare(ctx context.Context, env Env, cp modules.Node, joining []modules.Node) (Outcome, error) {
+	var out Outcome
+	if len(joining) == 0 {
+		return out, nil
+	}
+	if err := checkAddons(ctx, env, joining); err != nil {
+		return out, err
+	}
+	if cfg, ok := env.Cluster.Proxy(); ok {
+		if err := proxy.Deploy(ctx, joining, cfg); err != nil {
+			return out, err
+		}
+	}
+	if cfg := env.Cluster.Spec.OSRepository; cfg != nil {
+		if err := osrepo.Deploy(ctx, cp, joining, *cfg); err != nil {
+			return out, err
+		}
+	}
+	results, err := nodeprep.Deploy(ctx, joining, env.Cluster.Spec.NodePrepare)
+	out.NodePrepare = results
+	if err != nil {
+		return out, err
+	}
+	// The profiles of a host may add kernel modules and sysctls of their own.
+	for _, n := range joining {
+		reports, err := systune.Deploy(ctx, []modules.Node{n}, env.Cluster.SysTune(n.Name()))
+		out.SysTune = append(out.SysTune, reports...)
+		if err != nil {
+			return out, err
+		}
+	}
+	if cfg := env.Cluster.Spec.TimeSync; cfg != nil {
+		if err := timesync.Deploy(ctx, joining, *cfg); err != nil {
+			return out, err
+		}
+	}
+	if cfg := env.Cluster.Spec.ImagePreload; cfg != nil {
+		if err := imagepreload.Deploy(ctx, joining, *cfg); err != nil {
+			return out, err
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,261 @@
+package reconcile
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mensylisir/xmcores/catalog"
+	"github.com/mensylisir/xmcores/common"
+	"github.com/mensylisir/xmcores/config"
+	"github.com/mensylisir/xmcores/connector"
+	"github.com/mensylisir/xmcores/connector/connectortest"
+	"github.com/mensylisir/xmcores/drift"
+	"github.com/mensylisir/xmcores/errs"
+	"github.com/mensylisir/xmcores/modules"
+	"github.com/mensylisir/xmcores/modules/binaries"
+	"github.com/mensylisir/xmcores/modules/imagepreload"
+	"github.com/mensylisir/xmcores/modules/osrepo"
+	"github.com/mensylisir/xmcores/modules/proxy"
+	"github.com/mensylisir/xmcores/modules/security"
+	"github.com/mensylisir/xmcores/modules/systune"
+	"github.com/mensylisir/xmcores/modules/timesync"
+)
+
+func TestNewPlan(t *testing.T) {
+	plan := NewPlan([]drift.Change{
+		{Action: drift.ActionRemove, Kind: drift.KindNode, Name: "old"},
+		{Action: drift.ActionAdd, Kind: drift.KindAddon, Name: "ingress-nginx"},
+		{Action: drift.ActionAdd, Kind: drift.KindAddon, Name: "calico"},
+		{Action: drift.ActionAdd, Kind: drift.KindLabel, Name: "worker1", Field: "tier", Desired: "edge"},
+		{Action: drift.ActionAdd, Kind: drift.KindTaint, Name: "worker1", Field: "dedicated", Desired: "dedicated=edge:NoSchedule"},
+		{Action: drift.ActionAdd, Kind: drift.KindNode, Name: "worker2"},
+		{Action: drift.ActionUpdate, Kind: drift.KindVersion, Name: "worker1", Field: "kubelet", Desired: "v1.31.2", Observed: "v1.30.5"},
+		{Action: drift.ActionUpdate, Kind: drift.KindVersion, Name: "control-plane", Desired: "v1.31.2", Observed: "v1.30.5"},
+		{Action: drift.ActionUpdate, Kind: drift.KindSetting, Name: "serviceSubnet", Desired: "10.233.0.0/18", Observed: "10.96.0.0/12"},
+	})
+
+	var steps []string
+	for _, s := range plan.Steps {
+		steps = append(steps, s.String())
+	}
+	assert.Equal(t, []string{
+		"upgrade-control-plane",
+		"upgrade-node worker1",
+		"join worker2",
+		"metadata worker1",
+		"install-addon ingress-nginx",
+		"remove old",
+	}, steps)
+	assert.Len(t, plan.Steps[3].Changes, 2)
+
+	require.Len(t, plan.Destructive(), 1)
+	assert.Equal(t, "old", plan.Destructive()[0].Target)
+	require.Len(t, plan.Unsupported, 2)
+	assert.Equal(t, "calico", plan.Unsupported[0].Name)
+	assert.Equal(t, drift.KindSetting, plan.Unsupported[1].Kind)
+
+	out := Format(plan)
+	assert.Contains(t, out, "6. remove old\n")
+	assert.Contains(t, out, "Not handled by apply")
+
+	assert.True(t, NewPlan(nil).Empty())
+	assert.Contains(t, Format(NewPlan(nil)), "Nothing to apply")
+}
+
+func TestCheckSkew(t *testing.T) {
+	cat := catalog.NewCatalog()
+	plan := NewPlan([]drift.Change{
+		{Action: drift.ActionUpdate, Kind: drift.KindVersion, Name: "control-plane", Desired: "v1.31.2", Observed: "v1.28.3"},
+	})
+	err := CheckSkew(plan, cat, "v1.31.2")
+	var pathErr *UpgradePathError
+	require.ErrorAs(t, err, &pathErr)
+	assert.Equal(t, []string{"v1.29.10", "v1.30.6", "v1.31.2"}, pathErr.Path)
+	assert.Equal(t, errs.Config, errs.KindOf(err))
+	assert.EqualError(t, err, "upgrading from v1.28.3 to v1.31.2 skips minor releases; upgrade one minor release at a time: v1.29.10 -> v1.30.6 -> v1.31.2")
+
+	plan = NewPlan([]drift.Change{
+		{Action: drift.ActionUpdate, Kind: drift.KindVersion, Name: "control-plane", Desired: "v1.31.2", Observed: "v1.30.5"},
+		{Action: drift.ActionUpdate, Kind: drift.KindVersion, Name: "worker1", Field: "kubelet", Desired: "v1.31.2", Observed: "v1.30.5"},
+	})
+	assert.NoError(t, CheckSkew(plan, cat, "v1.31.2"))
+
+	plan = NewPlan([]drift.Change{
+		{Action: drift.ActionUpdate, Kind: drift.KindVersion, Name: "worker1", Field: "kubelet", Desired: "v1.31.2", Observed: "v1.30.5"},
+		{Action: drift.ActionUpdate, Kind: drift.KindVersion, Name: "worker2", Field: "kubelet", Desired: "v1.30.5", Observed: "v1.26.1"},
+	})
+	err = CheckSkew(plan, cat, "v1.30.5")
+	assert.ErrorContains(t, err, "worker1: version skew: kubelet v1.31.2 is newer than kube-apiserver v1.30.5")
+	assert.ErrorContains(t, err, "worker2: version skew: kubelet v1.26.1 is more than 3 minor releases older")
+}
+
+func TestPrepareExisting(t *testing.T) {
+	ctx := context.Background()
+	cluster := &config.Cluster{}
+	cluster.Spec.Kubernetes.Version = "v1.30.2"
+	env := Env{Cluster: cluster}
+	h := connector.NewHost()
+	h.SetName("worker2")
+	components := "binary\tkubelet\t/usr/bin/kubelet\tinactive\tkubelet\tKubernetes v1.30.0\nconfig\t/etc/kubernetes/kubelet.conf\n"
+	fake := connectortest.NewFake().
+		On(`command -v \$c`, connectortest.Result{Stdout: components}).
+		On(`cat /etc/os-release`, connectortest.Result{Stdout: "ID=ubuntu\n"})
+	require.NoError(t, prepareExisting(ctx, env, modules.Node{Host: h, Conn: fake}))
+	assert.True(t, fake.Ran(`kubeadm reset -f`), "the state of the failed join is reset")
+	assert.False(t, fake.Ran(`apt-get remove`), "the kubelet is adopted")
+
+	cluster.Spec.Kubernetes.Version = "v1.31.2"
+	fake = connectortest.NewFake().
+		On(`command -v \$c`, connectortest.Result{Stdout: components}).
+		On(`cat /etc/os-release`, connectortest.Result{Stdout: "ID=ubuntu\n"})
+	err := prepareExisting(ctx, env, modules.Node{Host: h, Conn: fake})
+	assert.Equal(t, errs.Preflight, errs.KindOf(err))
+	assert.ErrorContains(t, err, "removed the kubelet left by an earlier installation")
+	assert.True(t, fake.Ran(`apt-get remove -y kubelet`))
+
+	cluster.Spec.Binaries = &binaries.Config{LocalPath: t.TempDir()}
+	fake = connectortest.NewFake().
+		On(`command -v \$c`, connectortest.Result{Stdout: components}).
+		On(`cat /etc/os-release`, connectortest.Result{Stdout: "ID=ubuntu\n"})
+	assert.NoError(t, prepareExisting(ctx, env, modules.Node{Host: h, Conn: fake}), "join installs the kubelet of spec.binaries")
+}
+
+func TestCheckNetwork(t *testing.T) {
+	ctx := context.Background()
+	cluster := &config.Cluster{}
+	cluster.Spec.Hosts = []config.Host{{Interface: "eth1"}}
+	cluster.Spec.Hosts[0].Name = "worker2"
+	cluster.Spec.Hosts[0].InternalAddress = "10.0.0.22"
+	cluster.Spec.Network.NodeSubnets = []string{"10.0.0.0/16"}
+	env := Env{Cluster: cluster}
+	h := connector.NewHost()
+	h.SetName("worker2")
+
+	fake := connectortest.NewFake().On(`ip -o addr show`, connectortest.Result{Stdout: "2: eth1    inet 10.0.0.22/16 brd 10.0.255.255 scope global eth1\n"})
+	require.NoError(t, checkNetwork(ctx, env, modules.Node{Host: h, Conn: fake}))
+
+	fake = connectortest.NewFake().On(`ip -o addr show`, connectortest.Result{Stdout: "2: eth0    inet 10.0.0.22/16 brd 10.0.255.255 scope global eth0\n"})
+	err := checkNetwork(ctx, env, modules.Node{Host: h, Conn: fake})
+	assert.Equal(t, errs.Preflight, errs.KindOf(err))
+	assert.ErrorContains(t, err, "internal address 10.0.0.22 is on interface eth0, not eth1")
+}
+
+// testEnv returns an environment with the hosts named in roles, each
+// connected to a fake of fakes.
+func testEnv(fakes *connectortest.Connector, roles map[string]string) Env {
+	cluster := &config.Cluster{}
+	cluster.Spec.Kubernetes.Version = "v1.31.2"
+	for _, name := range []string{"master1", "master2", "worker1", "worker2"} {
+		if role, ok := roles[name]; ok {
+			h := config.Host{Roles: []string{role}}
+			h.Name = name
+			h.InternalAddress = "10.0.0." + name[len(name)-1:]
+			cluster.Spec.Hosts = append(cluster.Spec.Hosts, h)
+		}
+	}
+	env := Env{Cluster: cluster, Nodes: map[string]modules.Node{}}
+	for _, h := range cluster.Hosts() {
+		env.Nodes[h.GetName()] = modules.Node{Host: h, Conn: fakes.Host(h.GetName())}
+	}
+	return env
+}
+
+func TestDeploySecurity(t *testing.T) {
+	ctx := context.Background()
+	fakes := connectortest.NewConnector()
+	env := testEnv(fakes, map[string]string{"master1": common.RoleControlPlane, "master2": common.RoleControlPlane, "worker1": common.RoleWorker})
+	env.Cluster.Spec.Security = &security.Config{Audit: &security.AuditConfig{}}
+	cp := env.Nodes["master1"]
+
+	require.NoError(t, deploySecurity(ctx, env, cp, Plan{Steps: []Step{{Op: OpJoin, Target: "worker1"}}}))
+	assert.Empty(t, fakes.Host("master1").Commands(), "joining a worker renders no control-plane configuration")
+
+	require.NoError(t, deploySecurity(ctx, env, cp, Plan{Steps: []Step{{Op: OpJoin, Target: "master2"}}}))
+	for _, name := range []string{"master1", "master2"} {
+		assert.True(t, fakes.Host(name).Ran(`mv -f .* /etc/kubernetes/audit/policy\.yaml`), name)
+	}
+	assert.Empty(t, fakes.Host("worker1").Commands())
+}
+
+func TestPrepare(t *testing.T) {
+	ctx := context.Background()
+	fakes := connectortest.NewConnector()
+	env := testEnv(fakes, map[string]string{"master1": common.RoleControlPlane, "worker1": common.RoleWorker, "worker2": common.RoleWorker})
+	env.Cluster.Spec.Proxy = &proxy.Config{HTTPSProxy: "http://proxy.lab:3128"}
+	env.Cluster.Spec.OSRepository = &osrepo.Config{LocalPath: t.TempDir(), Type: osrepo.TypeDeb, Serve: osrepo.ServeFile}
+	env.Cluster.Spec.TimeSync = &timesync.Config{Provider: timesync.ProviderTimesyncd, Servers: []string{"ntp.lab"}}
+	env.Cluster.Spec.Profiles = []config.Profile{{Name: "gpu", KernelModules: []string{"nvidia"}}}
+	env.Cluster.Spec.Hosts[2].Profiles = []string{"gpu"}
+	const pause = "sha256:7031c1b283388d2c2e09b57badb803c05ebed362dc88d84b480cc47f72a21097"
+	layout := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(layout, "oci-layout"), []byte(`{"imageLayoutVersion":"1.0.0"}`), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(layout, "index.json"), []byte(`{"schemaVersion":2,"manifests":[{"digest":"`+pause+`",
+ "annotations":{"org.opencontainers.image.ref.name":"registry.k8s.io/pause:3.10"}}]}`), 0o644))
+	env.Cluster.Spec.ImagePreload = &imagepreload.Config{Path: layout}
+	fakes.Host("worker1").On(`^sysctl -n net\.ipv4\.ip_forward$`, connectortest.Result{Stdout: "0\n"})
+	fakes.Host("worker1").On(`^uname -m$`, connectortest.Result{Stdout: "x86_64\n"})
+	fakes.Host("worker2").On(`^uname -m$`, connectortest.Result{Stdout: "aarch64\n"})
+	for _, name := range []string{"worker1", "worker2"} {
+		fakes.Host(name).
+			On(`^sysctl -n `, connectortest.Result{Stdout: "1\n"}).
+			On(`cat /etc/os-release`, connectortest.Result{Stdout: "ID=ubuntu\n"}).
+			On(`df -P`, connectortest.Result{Stdout: "/dev/sda1 51474912 0 51474912 0% /\n/dev/sda1 3276800 0 3276800 0% /\n"}).
+			On(`timedatectl show -p NTPSynchronized`, connectortest.Result{Stdout: "yes\n"}).
+			On(`images ls`, connectortest.Result{Stdout: "REF TYPE DIGEST SIZE PLATFORMS LABELS\nregistry.k8s.io/pause:3.10 index " + pause + " 311.5 KiB linux/amd64 -\n"})
+	}
+
+	out, err := prepare(ctx, env, env.Nodes["master1"], []modules.Node{env.Nodes["worker1"], env.Nodes["worker2"]})
+	require.NoError(t, err)
+	require.Len(t, out.NodePrepare, 2)
+	assert.Equal(t, "disabled", out.NodePrepare[0].Swap)
+	assert.True(t, fakes.Host("worker1").Ran(`firewall-cmd --reload`), "the kubelet port is opened")
+	require.Len(t, out.SysTune, 2)
+	assert.Equal(t, []systune.Drift{{Key: "net.ipv4.ip_forward", Expected: "1", Actual: "0"}}, out.SysTune[0].Drift)
+	assert.Equal(t, "worker2", out.SysTune[1].Node)
+	assert.True(t, fakes.Host("worker2").Ran(`modprobe nvidia`), "the modules of the host profiles are loaded")
+	assert.False(t, fakes.Host("worker1").Ran(`modprobe nvidia`))
+	for _, name := range []string{"worker1", "worker2"} {
+		apt, ok := fakes.Host(name).ReadFile(proxy.AptConfig)
+		require.True(t, ok, name)
+		assert.Contains(t, string(apt), `Acquire::https::Proxy "http://proxy.lab:3128";`)
+		repo, ok := fakes.Host(name).ReadFile("/etc/apt/sources.list.d/xmcores-offline.list")
+		require.True(t, ok, name)
+		assert.Equal(t, "deb [trusted=yes] file:///opt/xmcores/repo ./\n", string(repo))
+		assert.True(t, fakes.Host(name).Ran(`systemctl restart systemd-timesyncd`), name)
+		assert.True(t, fakes.Host(name).Ran(`ctr -n k8s\.io images ls`), "the preloaded images are checked on %s", name)
+	}
+	assert.Empty(t, fakes.Host("master1").Commands(), "the cluster members are left alone")
+}
+
+func TestCheckAddons(t *testing.T) {
+	ctx := context.Background()
+	fakes := connectortest.NewConnector()
+	env := testEnv(fakes, map[string]string{"master1": common.RoleControlPlane, "worker1": common.RoleWorker})
+	env.Cluster.Spec.Network.Plugin = config.NetworkCalico
+	fakes.Host("worker1").On(`^uname -m$`, connectortest.Result{Stdout: "armv7l\n"})
+
+	err := checkAddons(ctx, env, []modules.Node{env.Nodes["worker1"]})
+	assert.Equal(t, errs.Preflight, errs.KindOf(err))
+	assert.ErrorContains(t, err, "addon calico image docker.io/calico/node lacks arm")
+
+	env.Cluster.Spec.Network.Plugin = config.NetworkFlannel
+	assert.NoError(t, checkAddons(ctx, env, []modules.Node{env.Nodes["worker1"]}), "flannel is published for arm")
+}
+
+func TestWritePatches(t *testing.T) {
+	ctx := context.Background()
+	fakes := connectortest.NewConnector()
+	env := testEnv(fakes, map[string]string{"master1": common.RoleControlPlane})
+	env.Cluster.Spec.Kubernetes.ExtraArgs.APIServer = map[string]string{"audit-log-maxage": "30"}
+
+	patched, err := writePatches(ctx, env, env.Nodes["master1"])
+	require.NoError(t, err)
+	assert.True(t, patched)
+	assert.True(t, fakes.Host("master1").Ran(`mv -f /etc/kubernetes/patches/\.kube-apiserver\+json\.yaml\.[0-9a-f]{8}\.tmp /etc/kubernetes/patches/kube-apiserver\+json\.yaml`),
+		"the patches are moved into place, never read half written")
+}
@@ -0,0 +1,68 @@
+package reconcile
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/mensylisir/xmcores/catalog"
+	"github.com/mensylisir/xmcores/errs"
+)
+
+// UpgradePathError refuses a control-plane upgrade that skips minor releases.
+type UpgradePathError struct {
+	From, To string
+	// Path lists the versions to apply one after the other, To last.
+	Path []string
+}
+
+func (e *UpgradePathError) Error() string {
+	return fmt.Sprintf("upgrading from %s to %s skips minor releases; upgrade one minor release at a time: %s",
+		e.From, e.To, strings.Join(e.Path, " -> "))
+}
+
+// CheckSkew refuses plans that break the Kubernetes version skew policy
+// encoded in cat: control-plane upgrades that skip minor releases, which fail
+// with an *UpgradePathError offering the hops, and kubelets that would be
+// newer than, or too far behind, a control plane at version.
+func CheckSkew(plan Plan, cat *catalog.Catalog, version string) error {
+	apiserver := version
+	var problems []string
+	for _, s := range plan.Steps {
+		if s.Op != OpUpgradeControlPlane {
+			continue
+		}
+		for _, c := range s.Changes {
+			apiserver = c.Desired
+			path, err := cat.UpgradePath(c.Observed, c.Desired)
+			if err != nil {
+				return errs.Wrap(errs.Config, err)
+			}
+			if len(path) > 1 {
+				return errs.Wrap(errs.Config, &UpgradePathError{From: c.Observed, To: c.Desired, Path: path})
+			}
+		}
+	}
+	for _, s := range plan.Steps {
+		if s.Op != OpUpgradeNode {
+			continue
+		}
+		for _, c := range s.Changes {
+			// The kubelet runs the observed version against the upgraded
+			// control plane until its own upgrade.
+			for _, kubelet := range []string{c.Observed, c.Desired} {
+				if kubelet == "" {
+					continue
+				}
+				if err := catalog.CheckKubeletSkew(apiserver, kubelet); err != nil {
+					problems = append(problems, fmt.Sprintf("%s: %v", s.Target, err))
+					break
+				}
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return errs.Wrap(errs.Config, errors.New(strings.Join(problems, "; ")))
+	}
+	return nil
+}
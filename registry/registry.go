@@ -0,0 +1,534 @@
+// Package registry is a small client of the OCI distribution (Docker Registry
+// HTTP API v2) used to push images to a private registry from the controller.
+// It speaks the token and basic authentication schemes registries such as
+// Harbor, distribution and Nexus offer.
+package registry
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mensylisir/xmcores/common"
+)
+
+// DefaultTimeout bounds a request without a body. Blob uploads are bounded
+// by their context only, since layers can be large.
+const DefaultTimeout = 30 * time.Second
+
+// Manifest media types.
+const (
+	MediaTypeOCIManifest    = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeOCIIndex       = "application/vnd.oci.image.index.v1+json"
+	MediaTypeDockerManifest = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeDockerList     = "application/vnd.docker.distribution.manifest.list.v2+json"
+)
+
+// manifestTypes is the Accept header of manifest requests.
+var manifestTypes = strings.Join([]string{MediaTypeOCIIndex, MediaTypeOCIManifest, MediaTypeDockerList, MediaTypeDockerManifest}, ", ")
+
+// Config is the private registry of the cluster.
+type Config struct {
+	// Address is the host and optional port of the registry, e.g.
+	// registry.lab:5000.
+	Address string `yaml:"address" json:"address"`
+	// Namespace is prepended to the repository of every image pushed, e.g.
+	// kubernetes for registry.lab/kubernetes/pause.
+	Namespace string `yaml:"namespace,omitempty" json:"namespace,omitempty"`
+	Username  string `yaml:"username,omitempty" json:"username,omitempty"`
+	Password  string `yaml:"password,omitempty" json:"password,omitempty"`
+	// CAFile is a PEM file on the controller with the CA certificates the
+	// registry certificate is verified with, in addition to the system ones.
+	CAFile string `yaml:"caFile,omitempty" json:"caFile,omitempty"`
+	// PlainHTTP talks to the registry over HTTP instead of HTTPS.
+	PlainHTTP bool `yaml:"plainHTTP,omitempty" json:"plainHTTP,omitempty"`
+	// InsecureSkipVerify accepts any registry certificate.
+	InsecureSkipVerify bool `yaml:"insecureSkipVerify,omitempty" json:"insecureSkipVerify,omitempty"`
+}
+
+// Validate checks the configuration.
+func (c *Config) Validate() error {
+	if c.Address == "" {
+		return errors.New("registry address must be set")
+	}
+	if strings.Contains(c.Address, "://") || strings.ContainsAny(c.Address, "/ \t") {
+		return fmt.Errorf("registry address %q must be a host and optional port, without scheme or path", c.Address)
+	}
+	if c.Namespace != "" && !validRepository(c.Namespace) {
+		return fmt.Errorf("invalid registry namespace %q", c.Namespace)
+	}
+	if (c.Username == "") != (c.Password == "") {
+		return errors.New("registry username and password must be set together")
+	}
+	if c.CAFile != "" {
+		if _, err := os.Stat(c.CAFile); err != nil {
+			return fmt.Errorf("registry CA file: %w", err)
+		}
+	}
+	return nil
+}
+
+// validRepository reports whether s is a repository path: lowercase
+// components of letters, digits and separators.
+func validRepository(s string) bool {
+	for _, part := range strings.Split(s, "/") {
+		if part == "" || strings.IndexFunc(part, func(r rune) bool {
+			return !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '.' || r == '_' || r == '-')
+		}) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Client sends requests to a registry.
+type Client struct {
+	base     string
+	username string
+	password string
+	http     *http.Client
+	// stream has no timeout, for uploads.
+	stream *http.Client
+
+	mu     sync.Mutex
+	tokens map[string]string
+}
+
+// NewClient creates a client of the registry cfg describes.
+func NewClient(cfg Config) (*Client, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: cfg.InsecureSkipVerify, MinVersion: tls.VersionTLS12}
+	if cfg.CAFile != "" {
+		data, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the registry CA: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no valid certificates in %s", cfg.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	scheme := "https"
+	if cfg.PlainHTTP {
+		scheme = "http"
+	}
+	return &Client{
+		base:     scheme + "://" + cfg.Address,
+		username: cfg.Username,
+		password: cfg.Password,
+		http:     &http.Client{Transport: transport, Timeout: DefaultTimeout},
+		stream:   &http.Client{Transport: transport},
+		tokens:   make(map[string]string),
+	}, nil
+}
+
+// StatusError is returned for responses with a status code of 400 or above.
+type StatusError struct {
+	Code int
+	// Message is the first error the registry reported, if any.
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("registry returned %d %s: %s", e.Code, http.StatusText(e.Code), e.Message)
+	}
+	return fmt.Sprintf("registry returned %d %s", e.Code, http.StatusText(e.Code))
+}
+
+// IsNotFound reports whether err is a 404 from the registry.
+func IsNotFound(err error) bool {
+	var se *StatusError
+	return errors.As(err, &se) && se.Code == http.StatusNotFound
+}
+
+// IsUnauthorized reports whether err is a 401 or 403 from the registry.
+func IsUnauthorized(err error) bool {
+	var se *StatusError
+	return errors.As(err, &se) && (se.Code == http.StatusUnauthorized || se.Code == http.StatusForbidden)
+}
+
+// request describes a request to send. body is called for every attempt, so
+// that the request can be repeated after authenticating.
+type request struct {
+	method      string
+	url         string
+	scope       string
+	contentType string
+	accept      string
+	size        int64
+	body        func() (io.ReadCloser, error)
+	// stream lifts DefaultTimeout, for uploads.
+	stream bool
+}
+
+// do sends req, authenticating for its scope when the registry asks to. The
+// response body is closed unless the status is below 400; the caller closes
+// it then.
+func (c *Client) do(ctx context.Context, req request) (*http.Response, error) {
+	resp, err := c.send(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+		if err := c.authenticate(ctx, challenge, req.scope); err != nil {
+			return nil, fmt.Errorf("%s %s: %w", req.method, c.path(req.url), err)
+		}
+		if resp, err = c.send(ctx, req); err != nil {
+			return nil, err
+		}
+	}
+	if resp.StatusCode >= 400 {
+		defer resp.Body.Close()
+		return nil, fmt.Errorf("%s %s: %w", req.method, c.path(req.url), statusError(resp))
+	}
+	return resp, nil
+}
+
+func (c *Client) send(ctx context.Context, req request) (*http.Response, error) {
+	var body io.ReadCloser
+	if req.body != nil {
+		var err error
+		if body, err = req.body(); err != nil {
+			return nil, err
+		}
+	}
+	r, err := http.NewRequestWithContext(ctx, req.method, req.url, body)
+	if err != nil {
+		if body != nil {
+			body.Close()
+		}
+		return nil, fmt.Errorf("failed to build request %s %s: %w", req.method, c.path(req.url), err)
+	}
+	if body != nil {
+		r.ContentLength = req.size
+		r.Header.Set("Content-Type", req.contentType)
+	}
+	if req.accept != "" {
+		r.Header.Set("Accept", req.accept)
+	}
+	r.Header.Set("User-Agent", common.AppName)
+	c.authorize(r, req.scope)
+	hc := c.http
+	if req.stream {
+		hc = c.stream
+	}
+	resp, err := hc.Do(r)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %w", req.method, c.path(req.url), err)
+	}
+	return resp, nil
+}
+
+// path returns u without the registry address, for messages.
+func (c *Client) path(u string) string {
+	return strings.TrimPrefix(u, c.base)
+}
+
+func statusError(resp *http.Response) error {
+	se := &StatusError{Code: resp.StatusCode}
+	var body struct {
+		Errors []struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if json.Unmarshal(data, &body) == nil && len(body.Errors) > 0 {
+		se.Message = strings.TrimSpace(body.Errors[0].Code + " " + body.Errors[0].Message)
+	}
+	return se
+}
+
+// authorize sets the credentials of scope on r: the token obtained for it,
+// else the basic credentials.
+func (c *Client) authorize(r *http.Request, scope string) {
+	c.mu.Lock()
+	token := c.tokens[scope]
+	c.mu.Unlock()
+	switch {
+	case token != "":
+		r.Header.Set("Authorization", "Bearer "+token)
+	case c.username != "":
+		r.SetBasicAuth(c.username, c.password)
+	}
+}
+
+// authenticate answers the challenge of a 401 response. Basic challenges
+// are answered by the credentials authorize already sends, so only a
+// missing username fails them; token challenges get a token for scope from
+// the realm.
+func (c *Client) authenticate(ctx context.Context, challenge, scope string) error {
+	scheme, params := parseChallenge(challenge)
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if c.username == "" {
+			return &StatusError{Code: http.StatusUnauthorized, Message: "the registry requires a username and password"}
+		}
+		return &StatusError{Code: http.StatusUnauthorized, Message: "the registry rejected the username and password"}
+	case "bearer":
+	default:
+		return fmt.Errorf("unsupported authentication challenge %q", challenge)
+	}
+	realm := params["realm"]
+	if realm == "" {
+		return fmt.Errorf("token challenge without realm: %q", challenge)
+	}
+	q := url.Values{}
+	if s := params["service"]; s != "" {
+		q.Set("service", s)
+	}
+	if scope != "" {
+		q.Set("scope", scope)
+	}
+	u := realm
+	if len(q) > 0 {
+		sep := "?"
+		if strings.Contains(u, "?") {
+			sep = "&"
+		}
+		u += sep + q.Encode()
+	}
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return fmt.Errorf("invalid token realm %q: %w", realm, err)
+	}
+	r.Header.Set("User-Agent", common.AppName)
+	if c.username != "" {
+		r.SetBasicAuth(c.username, c.password)
+	}
+	resp, err := c.http.Do(r)
+	if err != nil {
+		return fmt.Errorf("failed to get a token from %s: %w", realm, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("failed to get a token from %s: %w", realm, statusError(resp))
+	}
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return fmt.Errorf("invalid token response from %s: %w", realm, err)
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	if token.Token == "" {
+		return fmt.Errorf("%s returned no token", realm)
+	}
+	c.mu.Lock()
+	c.tokens[scope] = token.Token
+	c.mu.Unlock()
+	return nil
+}
+
+// parseChallenge splits a WWW-Authenticate header such as
+// Bearer realm="https://auth/token",service="registry" into its scheme and
+// parameters.
+func parseChallenge(h string) (string, map[string]string) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(h), " ")
+	params := map[string]string{}
+	for rest = strings.TrimSpace(rest); rest != ""; {
+		var key string
+		key, rest, _ = strings.Cut(rest, "=")
+		key = strings.ToLower(strings.TrimSpace(key))
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := 1
+			for end < len(rest) && rest[end] != '"' {
+				if rest[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			value = strings.ReplaceAll(rest[1:min(end, len(rest))], `\"`, `"`)
+			rest = rest[min(end+1, len(rest)):]
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+			rest = "," + rest
+		}
+		params[key] = strings.TrimSpace(value)
+		_, rest, _ = strings.Cut(rest, ",")
+		rest = strings.TrimSpace(rest)
+	}
+	return scheme, params
+}
+
+func pushScope(repo string) string {
+	return "repository:" + repo + ":pull,push"
+}
+
+// Check calls the version check endpoint of the registry, authenticating
+// when it asks to, which proves that it is reachable, trusted and accepts
+// the credentials.
+func (c *Client) Check(ctx context.Context) error {
+	resp, err := c.do(ctx, request{method: http.MethodGet, url: c.base + "/v2/"})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// ManifestDigest returns the digest of the manifest ref (a tag or digest)
+// of repo, or "" if the registry does not have it.
+func (c *Client) ManifestDigest(ctx context.Context, repo, ref string) (string, error) {
+	resp, err := c.do(ctx, request{
+		method: http.MethodHead,
+		url:    c.base + "/v2/" + repo + "/manifests/" + ref,
+		scope:  pushScope(repo),
+		accept: manifestTypes,
+	})
+	if IsNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return resp.Header.Get("Docker-Content-Digest"), nil
+}
+
+// BlobExists reports whether repo has the blob digest.
+func (c *Client) BlobExists(ctx context.Context, repo, digest string) (bool, error) {
+	resp, err := c.do(ctx, request{
+		method: http.MethodHead,
+		url:    c.base + "/v2/" + repo + "/blobs/" + digest,
+		scope:  pushScope(repo),
+	})
+	if IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	return true, nil
+}
+
+// PushBlob uploads the blob digest of size bytes to repo in a single
+// request. open returns its content, once per attempt.
+func (c *Client) PushBlob(ctx context.Context, repo, digest string, size int64, open func() (io.ReadCloser, error)) error {
+	resp, err := c.do(ctx, request{
+		method: http.MethodPost,
+		url:    c.base + "/v2/" + repo + "/blobs/uploads/",
+		scope:  pushScope(repo),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to start the upload of %s: %w", digest, err)
+	}
+	resp.Body.Close()
+	location, err := c.resolve(resp.Header.Get("Location"))
+	if err != nil {
+		return fmt.Errorf("failed to start the upload of %s: %w", digest, err)
+	}
+	u, err := url.Parse(location)
+	if err != nil {
+		return fmt.Errorf("invalid upload location %q: %w", location, err)
+	}
+	q := u.Query()
+	q.Set("digest", digest)
+	u.RawQuery = q.Encode()
+	resp, err = c.do(ctx, request{
+		method:      http.MethodPut,
+		url:         u.String(),
+		scope:       pushScope(repo),
+		contentType: "application/octet-stream",
+		size:        size,
+		body:        open,
+		stream:      true,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload %s: %w", digest, err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// resolve makes the Location header of an upload absolute.
+func (c *Client) resolve(location string) (string, error) {
+	if location == "" {
+		return "", errors.New("the registry returned no upload location")
+	}
+	base, err := url.Parse(c.base + "/")
+	if err != nil {
+		return "", err
+	}
+	ref, err := url.Parse(location)
+	if err != nil {
+		return "", fmt.Errorf("invalid upload location %q: %w", location, err)
+	}
+	return base.ResolveReference(ref).String(), nil
+}
+
+// PushManifest stores data, a manifest of mediaType, as ref of repo.
+func (c *Client) PushManifest(ctx context.Context, repo, ref, mediaType string, data []byte) error {
+	resp, err := c.do(ctx, request{
+		method:      http.MethodPut,
+		url:         c.base + "/v2/" + repo + "/manifests/" + ref,
+		scope:       pushScope(repo),
+		contentType: mediaType,
+		size:        int64(len(data)),
+		body: func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(data)), nil
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to push the manifest %s:%s: %w", repo, ref, err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Ref splits an image reference such as registry.k8s.io/coredns/coredns:v1.11.3
+// into its repository without the registry host, coredns/coredns, and its tag
+// or digest. Images of Docker Hub without namespace are in library/.
+func Ref(image string) (repo, ref string) {
+	name := image
+	if i := strings.Index(name, "@"); i >= 0 {
+		name, ref = name[:i], name[i+1:]
+	} else if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name, ref = name[:i], name[i+1:]
+	}
+	if ref == "" {
+		ref = "latest"
+	}
+	if first, rest, ok := strings.Cut(name, "/"); ok && (strings.ContainsAny(first, ".:") || first == "localhost") {
+		if first == "docker.io" && !strings.Contains(rest, "/") {
+			rest = "library/" + rest
+		}
+		return rest, ref
+	}
+	if !strings.Contains(name, "/") {
+		name = "library/" + name
+	}
+	return name, ref
+}
+
+// FormatRef is the inverse of Ref for the registry at address.
+func FormatRef(address, repo, ref string) string {
+	if strings.Contains(ref, ":") {
+		return address + "/" + repo + "@" + ref
+	}
+	return address + "/" + repo + ":" + ref
+}
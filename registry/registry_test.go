@@ -0,0 +1,90 @@
+package registry
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRef(t *testing.T) {
+	for image, want := range map[string][2]string{
+		"registry.k8s.io/coredns/coredns:v1.11.3": {"coredns/coredns", "v1.11.3"},
+		"registry.lab:5000/pause":                 {"pause", "latest"},
+		"docker.io/nginx:1.27":                    {"library/nginx", "1.27"},
+		"calico/node:v3.28.0":                     {"calico/node", "v3.28.0"},
+		"localhost/app@sha256:abc":                {"app", "sha256:abc"},
+	} {
+		repo, ref := Ref(image)
+		assert.Equal(t, want, [2]string{repo, ref}, image)
+	}
+	assert.Equal(t, "r.lab/app@sha256:abc", FormatRef("r.lab", "app", "sha256:abc"))
+	assert.Equal(t, "r.lab/app:1", FormatRef("r.lab", "app", "1"))
+}
+
+func TestParseChallenge(t *testing.T) {
+	scheme, params := parseChallenge(`Bearer realm="https://auth.lab/token",service="harbor-registry",scope="repository:a/b:pull,push"`)
+	assert.Equal(t, "Bearer", scheme)
+	assert.Equal(t, map[string]string{
+		"realm":   "https://auth.lab/token",
+		"service": "harbor-registry",
+		"scope":   "repository:a/b:pull,push",
+	}, params)
+	scheme, params = parseChallenge(`Basic realm=registry`)
+	assert.Equal(t, "Basic", scheme)
+	assert.Equal(t, map[string]string{"realm": "registry"}, params)
+}
+
+func TestConfigValidate(t *testing.T) {
+	assert.NoError(t, (&Config{Address: "registry.lab:5000", Namespace: "k8s/images"}).Validate())
+	assert.ErrorContains(t, (&Config{}).Validate(), "address must be set")
+	assert.ErrorContains(t, (&Config{Address: "https://registry.lab"}).Validate(), "without scheme")
+	assert.ErrorContains(t, (&Config{Address: "r.lab", Namespace: "K8s"}).Validate(), "invalid registry namespace")
+	assert.ErrorContains(t, (&Config{Address: "r.lab", Username: "admin"}).Validate(), "set together")
+}
+
+func TestTokenAuth(t *testing.T) {
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/token":
+			user, pass, _ := r.BasicAuth()
+			if user != "admin" || pass != "secret" || r.URL.Query().Get("scope") != "repository:app:pull,push" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			_, _ = io.WriteString(w, `{"token":"t0k"}`)
+		case r.Header.Get("Authorization") != "Bearer t0k":
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+srv.URL+`/token",service="lab"`)
+			w.WriteHeader(http.StatusUnauthorized)
+		case r.URL.Path == "/v2/app/manifests/1.0":
+			w.Header().Set("Docker-Content-Digest", "sha256:abc")
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = io.WriteString(w, `{"errors":[{"code":"MANIFEST_UNKNOWN","message":"manifest unknown"}]}`)
+		}
+	}))
+	defer srv.Close()
+	ctx := context.Background()
+	addr := strings.TrimPrefix(srv.URL, "http://")
+
+	c, err := NewClient(Config{Address: addr, PlainHTTP: true, Username: "admin", Password: "secret"})
+	require.NoError(t, err)
+	digest, err := c.ManifestDigest(ctx, "app", "1.0")
+	require.NoError(t, err)
+	assert.Equal(t, "sha256:abc", digest)
+	digest, err = c.ManifestDigest(ctx, "app", "2.0")
+	require.NoError(t, err)
+	assert.Empty(t, digest, "a missing manifest is not an error")
+
+	c, err = NewClient(Config{Address: addr, PlainHTTP: true, Username: "admin", Password: "wrong"})
+	require.NoError(t, err)
+	_, err = c.ManifestDigest(ctx, "app", "1.0")
+	assert.ErrorContains(t, err, "failed to get a token")
+	assert.True(t, IsUnauthorized(err))
+}
@@ -0,0 +1,294 @@
+// Package runhook runs the hooks of the cluster configuration around the xm
+// commands that change the cluster: local commands, or HTTP endpoints
+// notified with a JSON body, told about the run through XM_* environment
+// variables or the same fields in the body. They let ticketing or CMDB
+// systems follow the runs without changes to the pipelines.
+package runhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// DefaultTimeout bounds a hook that sets no timeout.
+const DefaultTimeout = 30 * time.Second
+
+// Events a hook runs on.
+const (
+	EventPreRun      = "preRun"
+	EventPostSuccess = "postSuccess"
+	EventPostFailure = "postFailure"
+)
+
+// Statuses of a run, XM_RUN_STATUS.
+const (
+	StatusRunning   = "running"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+)
+
+// Hook is a local command or an HTTP endpoint.
+type Hook struct {
+	// Name identifies the hook in logs and errors; the command or URL when
+	// unset.
+	Name string `yaml:"name,omitempty" json:"name,omitempty"`
+	// Command is run locally with sh -c, with the run metadata added to the
+	// environment.
+	Command string `yaml:"command,omitempty" json:"command,omitempty"`
+	// URL is sent a POST request with the run metadata as JSON; any status
+	// other than 2xx fails the hook.
+	URL string `yaml:"url,omitempty" json:"url,omitempty"`
+	// Headers are added to the request to URL, e.g. Authorization.
+	Headers map[string]string `yaml:"headers,omitempty" json:"headers,omitempty"`
+	// Timeout bounds the command or the request, DefaultTimeout by default.
+	Timeout time.Duration `yaml:"timeout,omitempty" json:"timeout,omitempty"`
+	// Commands restricts the hook to these xm commands, e.g. apply or
+	// "certs rotate"; it runs around all of them when empty.
+	Commands []string `yaml:"commands,omitempty" json:"commands,omitempty"`
+}
+
+// Config holds the hooks of each event. PreRun hooks run in order before the
+// run and the first failure aborts it; all the hooks of PostSuccess or
+// PostFailure run once it finished, whatever their outcome.
+type Config struct {
+	PreRun      []Hook `yaml:"preRun,omitempty" json:"preRun,omitempty"`
+	PostSuccess []Hook `yaml:"postSuccess,omitempty" json:"postSuccess,omitempty"`
+	PostFailure []Hook `yaml:"postFailure,omitempty" json:"postFailure,omitempty"`
+}
+
+// SetDefaults fills unset fields.
+func (c *Config) SetDefaults() {
+	for _, hooks := range [][]Hook{c.PreRun, c.PostSuccess, c.PostFailure} {
+		for i := range hooks {
+			if hooks[i].Timeout == 0 {
+				hooks[i].Timeout = DefaultTimeout
+			}
+		}
+	}
+}
+
+// Validate checks the configuration.
+func (c *Config) Validate() error {
+	var errs []error
+	for _, e := range []struct {
+		field string
+		hooks []Hook
+	}{{EventPreRun, c.PreRun}, {EventPostSuccess, c.PostSuccess}, {EventPostFailure, c.PostFailure}} {
+		for i, h := range e.hooks {
+			if err := h.Validate(); err != nil {
+				errs = append(errs, fmt.Errorf("%s[%d]: %w", e.field, i, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Validate checks the hook.
+func (h Hook) Validate() error {
+	switch {
+	case h.Command == "" && h.URL == "":
+		return errors.New("command or url must be set")
+	case h.Command != "" && h.URL != "":
+		return errors.New("command and url must not both be set")
+	case h.Timeout < 0:
+		return fmt.Errorf("invalid timeout %s", h.Timeout)
+	}
+	if h.URL != "" {
+		u, err := url.Parse(h.URL)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("url: %q is not a URL such as https://cmdb.example.com/hooks/xm", h.URL)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("url: unsupported scheme %q (want http or https)", u.Scheme)
+		}
+	} else if len(h.Headers) > 0 {
+		return errors.New("headers require url")
+	}
+	return nil
+}
+
+// String names the hook.
+func (h Hook) String() string {
+	switch {
+	case h.Name != "":
+		return h.Name
+	case h.URL != "":
+		return h.URL
+	}
+	return h.Command
+}
+
+// applies reports whether the hook runs around command.
+func (h Hook) applies(command string) bool {
+	if len(h.Commands) == 0 {
+		return true
+	}
+	for _, c := range h.Commands {
+		if c == command {
+			return true
+		}
+	}
+	return false
+}
+
+// Run is the metadata of an xm run handed to the hooks.
+type Run struct {
+	Cluster  string    `json:"cluster"`
+	Command  string    `json:"command"`
+	Event    string    `json:"event"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	// Error is the error of a failed run.
+	Error string `json:"error,omitempty"`
+}
+
+// Status returns the status of the run: running before it finished.
+func (r Run) Status() string {
+	switch {
+	case r.Finished.IsZero():
+		return StatusRunning
+	case r.Error != "":
+		return StatusFailed
+	}
+	return StatusSucceeded
+}
+
+// Env returns the environment variables describing the run.
+func (r Run) Env() []string {
+	env := []string{
+		"XM_HOOK_EVENT=" + r.Event,
+		"XM_CLUSTER=" + r.Cluster,
+		"XM_COMMAND=" + r.Command,
+		"XM_RUN_STARTED=" + r.Started.UTC().Format(time.RFC3339),
+		"XM_RUN_STATUS=" + r.Status(),
+	}
+	if !r.Finished.IsZero() {
+		env = append(env,
+			"XM_RUN_FINISHED="+r.Finished.UTC().Format(time.RFC3339),
+			"XM_RUN_DURATION="+fmt.Sprint(int64(r.Finished.Sub(r.Started).Seconds())))
+	}
+	if r.Error != "" {
+		env = append(env, "XM_RUN_ERROR="+r.Error)
+	}
+	return env
+}
+
+// payload is the body sent to URL hooks.
+type payload struct {
+	Run
+	Status string `json:"status"`
+	// Duration is in seconds.
+	Duration int64 `json:"duration,omitempty"`
+}
+
+// Before runs the preRun hooks of run.Command in order and returns the error
+// of the first one that fails.
+func (c *Config) Before(ctx context.Context, run Run) error {
+	run.Event = EventPreRun
+	for _, h := range c.PreRun {
+		if !h.applies(run.Command) {
+			continue
+		}
+		if err := h.Run(ctx, run); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// After runs the postSuccess or postFailure hooks of run.Command, as given
+// by run.Error, and returns the errors of those that failed.
+func (c *Config) After(ctx context.Context, run Run) error {
+	hooks := c.PostSuccess
+	run.Event = EventPostSuccess
+	if run.Error != "" {
+		hooks = c.PostFailure
+		run.Event = EventPostFailure
+	}
+	var errs []error
+	for _, h := range hooks {
+		if !h.applies(run.Command) {
+			continue
+		}
+		if err := h.Run(ctx, run); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Run runs the hook for run.
+func (h Hook) Run(ctx context.Context, run Run) error {
+	timeout := h.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	var err error
+	if h.URL != "" {
+		err = h.notify(ctx, run)
+	} else {
+		err = h.exec(ctx, run)
+	}
+	if err != nil {
+		return fmt.Errorf("%s hook %s: %w", run.Event, h, err)
+	}
+	return nil
+}
+
+// exec runs the command of the hook, failing with its output.
+func (h Hook) exec(ctx context.Context, run Run) error {
+	var out bytes.Buffer
+	cmd := exec.CommandContext(ctx, "sh", "-c", h.Command)
+	cmd.Env = append(os.Environ(), run.Env()...)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	// Children of the shell that outlive it keep the output open.
+	cmd.WaitDelay = time.Second
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(out.String()); msg != "" {
+			return fmt.Errorf("%w: %s", err, msg)
+		}
+		return err
+	}
+	return nil
+}
+
+// notify posts the run to the URL of the hook.
+func (h Hook) notify(ctx context.Context, run Run) error {
+	p := payload{Run: run, Status: run.Status()}
+	if !run.Finished.IsZero() {
+		p.Duration = int64(run.Finished.Sub(run.Started).Seconds())
+	}
+	body, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range h.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package runhook
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		hook Hook
+		want string
+	}{
+		{"command", Hook{Command: "true"}, ""},
+		{"url", Hook{URL: "https://cmdb.example.com/hooks", Headers: map[string]string{"Authorization": "Bearer x"}}, ""},
+		{"empty", Hook{}, "command or url must be set"},
+		{"both", Hook{Command: "true", URL: "https://cmdb.example.com"}, "must not both be set"},
+		{"scheme", Hook{URL: "ftp://cmdb.example.com"}, "unsupported scheme"},
+		{"not a url", Hook{URL: "cmdb"}, "not a URL"},
+		{"headers without url", Hook{Command: "true", Headers: map[string]string{"a": "b"}}, "headers require url"},
+		{"timeout", Hook{Command: "true", Timeout: -time.Second}, "invalid timeout"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.hook.Validate()
+			if tc.want == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, tc.want)
+			}
+		})
+	}
+
+	c := Config{PostFailure: []Hook{{Command: "true"}, {}}}
+	assert.ErrorContains(t, c.Validate(), "postFailure[1]: command or url must be set")
+	c.SetDefaults()
+	assert.Equal(t, DefaultTimeout, c.PostFailure[0].Timeout)
+}
+
+func TestCommandHooks(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "env")
+	record := `echo "$XM_HOOK_EVENT $XM_CLUSTER $XM_COMMAND $XM_RUN_STATUS $XM_RUN_ERROR" >> ` + out
+	c := Config{
+		PreRun:      []Hook{{Command: record}, {Command: "exit 1", Commands: []string{"certs rotate"}}},
+		PostSuccess: []Hook{{Command: record}},
+		PostFailure: []Hook{{Command: "echo denied >&2; exit 3"}, {Command: record}},
+	}
+	started := time.Now()
+	run := Run{Cluster: "demo", Command: "apply", Started: started}
+	require.NoError(t, c.Before(context.Background(), run))
+
+	run.Finished = started.Add(time.Minute)
+	require.NoError(t, c.After(context.Background(), run))
+
+	run.Error = "boom"
+	err := c.After(context.Background(), run)
+	assert.ErrorContains(t, err, "postFailure hook echo denied >&2; exit 3: exit status 3: denied")
+
+	data, err := os.ReadFile(out)
+	require.NoError(t, err)
+	assert.Equal(t, "preRun demo apply running \npostSuccess demo apply succeeded \npostFailure demo apply failed boom\n", string(data))
+
+	run = Run{Cluster: "demo", Command: "certs rotate", Started: started}
+	assert.ErrorContains(t, c.Before(context.Background(), run), "preRun hook exit 1: exit status 1")
+}
+
+func TestURLHook(t *testing.T) {
+	var got map[string]interface{}
+	var auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&got))
+		if got["status"] == StatusFailed {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	h := Hook{Name: "cmdb", URL: srv.URL, Headers: map[string]string{"Authorization": "Bearer token"}}
+	started := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	run := Run{Cluster: "demo", Command: "apply", Event: EventPostSuccess, Started: started, Finished: started.Add(90 * time.Second)}
+	require.NoError(t, h.Run(context.Background(), run))
+	assert.Equal(t, "Bearer token", auth)
+	assert.Equal(t, "demo", got["cluster"])
+	assert.Equal(t, "apply", got["command"])
+	assert.Equal(t, EventPostSuccess, got["event"])
+	assert.Equal(t, StatusSucceeded, got["status"])
+	assert.Equal(t, float64(90), got["duration"])
+
+	run.Error = "boom"
+	assert.EqualError(t, h.Run(context.Background(), run), "postSuccess hook cmdb: status 503")
+}
+
+func TestTimeout(t *testing.T) {
+	h := Hook{Command: "sleep 5", Timeout: 50 * time.Millisecond}
+	start := time.Now()
+	assert.Error(t, h.Run(context.Background(), Run{Event: EventPreRun}))
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
@@ -0,0 +1,137 @@
+// Package runtime holds the process-wide settings of xm: how it logs. The
+// xm command builds them from its global flags; programs embedding xmcores
+// build them with NewOptions and apply them to the logger the same way.
+package runtime
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/mensylisir/xmcores/errs"
+	"github.com/mensylisir/xmcores/logger"
+)
+
+// Options are the process-wide settings of xm.
+type Options struct {
+	// LogLevel is the default level of the console.
+	LogLevel logrus.Level
+	// ComponentLevels override LogLevel per component (see logger.ParseLevelOverrides).
+	ComponentLevels map[string]logrus.Level
+	// DebugBuffer is how many entries are kept in memory to be reported on
+	// failure, whatever their level; 0 keeps none.
+	DebugBuffer int
+	// Sinks receive the log in addition to the console.
+	Sinks []logger.Sink
+	// Rotation rotates the log file written next to the console (see
+	// XM_LOG_OUTPUT_PATH); the zero value leaves the default rotation.
+	Rotation logger.Rotation
+}
+
+// Option sets a field of Options.
+type Option func(*Options)
+
+// WithLogLevel sets the default log level.
+func WithLogLevel(level logrus.Level) Option {
+	return func(o *Options) { o.LogLevel = level }
+}
+
+// WithComponentLevels sets per-component log levels, replacing earlier ones.
+func WithComponentLevels(levels map[string]logrus.Level) Option {
+	return func(o *Options) { o.ComponentLevels = levels }
+}
+
+// WithDebugBuffer sets how many entries are kept for failure reports.
+func WithDebugBuffer(size int) Option {
+	return func(o *Options) { o.DebugBuffer = size }
+}
+
+// WithSinks adds log sinks.
+func WithSinks(sinks ...logger.Sink) Option {
+	return func(o *Options) { o.Sinks = append(o.Sinks, sinks...) }
+}
+
+// WithRotation sets the rotation of the log file.
+func WithRotation(r logger.Rotation) Option {
+	return func(o *Options) { o.Rotation = r }
+}
+
+// NewOptions returns the defaults, info level and a debug buffer of
+// logger.DefaultRingSize entries, with opts applied, once validated.
+func NewOptions(opts ...Option) (*Options, error) {
+	o := &Options{LogLevel: logrus.InfoLevel, DebugBuffer: logger.DefaultRingSize}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if err := o.Validate(); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// Validate checks each setting and the settings that conflict, like two file
+// sinks writing, and rotating, the same file.
+func (o *Options) Validate() error {
+	var errList []error
+	if o.LogLevel > logrus.TraceLevel {
+		errList = append(errList, fmt.Errorf("invalid log level %d", o.LogLevel))
+	}
+	for component, level := range o.ComponentLevels {
+		if component == "" {
+			errList = append(errList, errors.New("component levels: empty component name"))
+		}
+		if level > logrus.TraceLevel {
+			errList = append(errList, fmt.Errorf("component levels: invalid level %d for %s", level, component))
+		}
+	}
+	if o.DebugBuffer < 0 {
+		errList = append(errList, fmt.Errorf("debug buffer must not be negative, got %d", o.DebugBuffer))
+	}
+	files := map[string]int{}
+	for i, s := range o.Sinks {
+		if err := s.Validate(); err != nil {
+			errList = append(errList, fmt.Errorf("sinks[%d]: %w", i, err))
+			continue
+		}
+		if s.Type != logger.SinkFile {
+			continue
+		}
+		path := filepath.Clean(s.Path)
+		if j, ok := files[path]; ok {
+			errList = append(errList, fmt.Errorf("sinks[%d]: %s is also written by sinks[%d]", i, s.Path, j))
+		}
+		files[path] = i
+	}
+	if err := o.Rotation.Validate(); err != nil {
+		errList = append(errList, fmt.Errorf("rotation: %w", err))
+	}
+	if err := errors.Join(errList...); err != nil {
+		return errs.Wrap(errs.Config, err)
+	}
+	return nil
+}
+
+// Apply validates o and configures xl accordingly. The sinks are opened and
+// must be closed with xl.CloseSinks.
+func (o *Options) Apply(xl *logger.XMLog) error {
+	if err := o.Validate(); err != nil {
+		return err
+	}
+	xl.SetComponentLevels(o.LogLevel, o.ComponentLevels)
+	if o.DebugBuffer > 0 {
+		xl.SetRingBuffer(logger.NewRingBuffer(o.DebugBuffer))
+	}
+	for _, s := range o.Sinks {
+		if err := xl.AddSink(s); err != nil {
+			return errs.Wrap(errs.Config, err)
+		}
+	}
+	if o.Rotation != (logger.Rotation{}) {
+		if err := xl.SetRotation(o.Rotation); err != nil {
+			return errs.Wrap(errs.Config, fmt.Errorf("log rotation: %w", err))
+		}
+	}
+	return nil
+}
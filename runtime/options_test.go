@@ -0,0 +1,47 @@
+package runtime
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mensylisir/xmcores/errs"
+	"github.com/mensylisir/xmcores/logger"
+)
+
+func TestOptions(t *testing.T) {
+	o, err := NewOptions()
+	require.NoError(t, err)
+	assert.Equal(t, logrus.InfoLevel, o.LogLevel)
+	assert.Equal(t, logger.DefaultRingSize, o.DebugBuffer)
+
+	path := filepath.Join(t.TempDir(), "xm.log")
+	o, err = NewOptions(
+		WithLogLevel(logrus.WarnLevel),
+		WithComponentLevels(map[string]logrus.Level{"connector": logrus.DebugLevel}),
+		WithDebugBuffer(0),
+		WithSinks(logger.Sink{Type: logger.SinkFile, Path: path}),
+	)
+	require.NoError(t, err)
+	assert.Equal(t, logrus.WarnLevel, o.LogLevel)
+	assert.Zero(t, o.DebugBuffer)
+	assert.Len(t, o.Sinks, 1)
+
+	for name, opts := range map[string][]Option{
+		"negative buffer": {WithDebugBuffer(-1)},
+		"bad level":       {WithLogLevel(logrus.Level(42))},
+		"empty component": {WithComponentLevels(map[string]logrus.Level{"": logrus.DebugLevel})},
+		"bad sink":        {WithSinks(logger.Sink{Type: "carrier-pigeon"})},
+		"bad rotation":    {WithRotation(logger.Rotation{MaxBackups: -1})},
+		"same file": {WithSinks(
+			logger.Sink{Type: logger.SinkFile, Path: path},
+			logger.Sink{Type: logger.SinkFile, Path: filepath.Join(filepath.Dir(path), ".", "xm.log")},
+		)},
+	} {
+		_, err := NewOptions(opts...)
+		assert.Equal(t, errs.Config, errs.KindOf(err), name)
+	}
+}
@@ -0,0 +1,464 @@
+package shellquote
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// stepDirs hold the code that builds remote commands.
+var stepDirs = []string{"../connector", "../modules", "../pipeline", "../reconcile", "../client", "../kube"}
+
+// runFuncs take a command line as one of their arguments.
+var runFuncs = map[string]bool{
+	"Run": true, "RunUnprivileged": true, "RunWith": true, "RunAll": true, "Exec": true,
+	"Succeeds": true, "SudoCommand": true, "sudoCommand": true, "Execute": true, "ExecWith": true, "execute": true,
+	"Kubectl": true,
+}
+
+// quoteFuncs return words that are safe to interpolate into a command line.
+var quoteFuncs = map[string]bool{"Quote": true, "Join": true, "quote": true, "shellQuote": true}
+
+// okMarker on the line of an interpolation accepts it, for arguments known to
+// be safe words (e.g. validated names).
+const okMarker = "shellquote:ok"
+
+// TestStepCommandsQuoteInterpolations is a vet-style check: every string
+// interpolated into a command passed to Run and friends, with fmt.Sprintf,
+// fmt.Fprintf into a buffer or + concatenation, must be a literal, a constant
+// or the result of a quoting function.
+func TestStepCommandsQuoteInterpolations(t *testing.T) {
+	var findings []string
+	for _, dir := range stepDirs {
+		err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+			if err != nil || !info.IsDir() {
+				return err
+			}
+			f, err := checkPackage(p)
+			findings = append(findings, f...)
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	sort.Strings(findings)
+	for _, f := range findings {
+		t.Error(f)
+	}
+}
+
+func checkPackage(dir string) ([]string, error) {
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, dir, func(fi os.FileInfo) bool {
+		return !strings.HasSuffix(fi.Name(), "_test.go")
+	}, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	var findings []string
+	for _, pkg := range pkgs {
+		consts := map[string]bool{}
+		for _, f := range pkg.Files {
+			for _, d := range f.Decls {
+				if gd, ok := d.(*ast.GenDecl); ok && gd.Tok == token.CONST {
+					for _, s := range gd.Specs {
+						for _, n := range s.(*ast.ValueSpec).Names {
+							consts[n.Name] = true
+						}
+					}
+				}
+			}
+		}
+		for _, f := range pkg.Files {
+			ok := okLines(fset, f)
+			for _, d := range f.Decls {
+				fn, isFunc := d.(*ast.FuncDecl)
+				if !isFunc || fn.Body == nil {
+					continue
+				}
+				for _, arg := range newFuncChecker(fn.Body, consts).unsafe() {
+					pos := fset.Position(arg.Pos())
+					if ok[pos.Line] {
+						continue
+					}
+					findings = append(findings, fmt.Sprintf("%s:%d: unquoted %s interpolated into a shell command; use shellquote.Quote",
+						filepath.ToSlash(pos.Filename), pos.Line, exprString(arg)))
+				}
+			}
+		}
+	}
+	return findings, nil
+}
+
+func okLines(fset *token.FileSet, f *ast.File) map[int]bool {
+	lines := map[int]bool{}
+	for _, g := range f.Comments {
+		if strings.Contains(g.Text(), okMarker) {
+			lines[fset.Position(g.End()).Line] = true
+			lines[fset.Position(g.End()).Line+1] = true
+		}
+	}
+	return lines
+}
+
+// funcChecker follows the commands built in one function body: the arguments
+// of run functions, the values assigned to the variables passed to them and
+// the writes to the buffers whose String() is.
+type funcChecker struct {
+	consts  map[string]bool
+	assigns map[string][]ast.Expr
+	writes  map[string][]*ast.CallExpr
+	// cmdVars and bufVars are the variables already known to hold a command.
+	cmdVars, bufVars map[string]bool
+	queue            []queued
+	found            []ast.Expr
+	// checking are the variables whose assignments safe is following.
+	checking map[string]bool
+}
+
+// queued is a part of a command still to check, see command.
+type queued struct {
+	e     ast.Expr
+	whole bool
+}
+
+func newFuncChecker(body *ast.BlockStmt, consts map[string]bool) *funcChecker {
+	c := &funcChecker{
+		consts:   consts,
+		assigns:  map[string][]ast.Expr{},
+		writes:   map[string][]*ast.CallExpr{},
+		cmdVars:  map[string]bool{},
+		bufVars:  map[string]bool{},
+		checking: map[string]bool{},
+	}
+	ast.Inspect(body, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.AssignStmt:
+			if len(n.Lhs) == len(n.Rhs) {
+				for i, lhs := range n.Lhs {
+					if id, ok := lhs.(*ast.Ident); ok {
+						c.assigns[id.Name] = append(c.assigns[id.Name], n.Rhs[i])
+					}
+				}
+			}
+		case *ast.ValueSpec:
+			for i, id := range n.Names {
+				if i < len(n.Values) {
+					c.assigns[id.Name] = append(c.assigns[id.Name], n.Values[i])
+				} else {
+					c.assigns[id.Name] = append(c.assigns[id.Name], nil)
+				}
+			}
+		case *ast.CallExpr:
+			if buf := writtenBuffer(n); buf != "" {
+				c.writes[buf] = append(c.writes[buf], n)
+			}
+			if isRunCall(n) {
+				for _, arg := range n.Args {
+					c.command(arg, true)
+				}
+			}
+		}
+		return true
+	})
+	return c
+}
+
+// writtenBuffer returns the variable that a fmt.Fprintf or WriteString call
+// writes to, or "".
+func writtenBuffer(call *ast.CallExpr) string {
+	sel, ok := call.Fun.(*ast.SelectorExpr)
+	if !ok || len(call.Args) == 0 {
+		return ""
+	}
+	target := call.Args[0]
+	if pkg, ok := sel.X.(*ast.Ident); !ok || pkg.Name != "fmt" || sel.Sel.Name != "Fprintf" {
+		if sel.Sel.Name != "WriteString" {
+			return ""
+		}
+		target = sel.X
+	}
+	if u, ok := target.(*ast.UnaryExpr); ok && u.Op == token.AND {
+		target = u.X
+	}
+	if id, ok := target.(*ast.Ident); ok {
+		return id.Name
+	}
+	return ""
+}
+
+// unsafe returns the unquoted interpolations found in the commands.
+func (c *funcChecker) unsafe() []ast.Expr {
+	for len(c.queue) > 0 {
+		q := c.queue[0]
+		c.queue = c.queue[1:]
+		c.command(q.e, q.whole)
+	}
+	return c.found
+}
+
+// command checks e, a command or part of one. A variable passed as a whole
+// command is followed to its assignments; within a concatenation it must
+// also have been assigned in the function, parameters being unchecked input.
+func (c *funcChecker) command(e ast.Expr, whole bool) {
+	switch x := e.(type) {
+	case nil:
+	case *ast.BinaryExpr:
+		if x.Op != token.ADD {
+			return
+		}
+		c.command(x.X, false)
+		c.command(x.Y, false)
+	case *ast.ParenExpr:
+		c.command(x.X, whole)
+	case *ast.CompositeLit:
+		// A list of commands, as passed to RunAll.
+		for _, elt := range x.Elts {
+			c.command(elt, true)
+		}
+	case *ast.CallExpr:
+		switch {
+		case funcName(x) == "append" && len(x.Args) > 0:
+			for _, arg := range x.Args {
+				c.command(arg, true)
+			}
+		case isFmt(x, "Sprintf"):
+			c.found = append(c.found, unsafeArgs(x, 0, c.safe)...)
+		case isFmt(x, "Fprintf"):
+			c.found = append(c.found, unsafeArgs(x, 1, c.safe)...)
+		case funcName(x) == "WriteString" && len(x.Args) == 1:
+			c.command(x.Args[0], false)
+		case funcName(x) == "String" && len(x.Args) == 0:
+			if buf, ok := x.Fun.(*ast.SelectorExpr).X.(*ast.Ident); ok && !c.bufVars[buf.Name] {
+				c.bufVars[buf.Name] = true
+				for _, w := range c.writes[buf.Name] {
+					c.queue = append(c.queue, queued{e: w})
+				}
+			}
+		default:
+			// Within a concatenation, what any other call returns is
+			// interpolated as it is.
+			if !whole && !safeArg(x, c.consts) {
+				c.found = append(c.found, x)
+			}
+		}
+	case *ast.Ident:
+		if c.consts[x.Name] || c.cmdVars[x.Name] {
+			return
+		}
+		values, assigned := c.assigns[x.Name]
+		if !assigned && !whole {
+			c.found = append(c.found, x)
+			return
+		}
+		c.cmdVars[x.Name] = true
+		for _, v := range values {
+			c.queue = append(c.queue, queued{e: v, whole: whole})
+		}
+	default:
+		if !whole && !safeArg(e, c.consts) {
+			c.found = append(c.found, e)
+		}
+	}
+}
+
+// isRunCall reports whether call runs a command. Execute is also a method of
+// the templates, so only connector.Execute counts.
+func isRunCall(call *ast.CallExpr) bool {
+	name := funcName(call)
+	if sel, ok := call.Fun.(*ast.SelectorExpr); ok && name == "Execute" {
+		pkg, ok := sel.X.(*ast.Ident)
+		return ok && pkg.Name == "connector"
+	}
+	return runFuncs[name]
+}
+
+func funcName(call *ast.CallExpr) string {
+	switch f := call.Fun.(type) {
+	case *ast.Ident:
+		return f.Name
+	case *ast.SelectorExpr:
+		return f.Sel.Name
+	}
+	return ""
+}
+
+func isFmt(call *ast.CallExpr, name string) bool {
+	sel, ok := call.Fun.(*ast.SelectorExpr)
+	if !ok {
+		return false
+	}
+	pkg, ok := sel.X.(*ast.Ident)
+	return ok && pkg.Name == "fmt" && sel.Sel.Name == name
+}
+
+// unsafeArgs returns the arguments of a Sprintf or Fprintf call, whose format
+// is argument format, that are formatted as strings (%s, %v, %q) and are
+// neither literals, constants nor quoted. Calls with a non-literal format are
+// not checked.
+func unsafeArgs(call *ast.CallExpr, format int, safe func(ast.Expr) bool) []ast.Expr {
+	if len(call.Args) <= format {
+		return nil
+	}
+	lit, ok := call.Args[format].(*ast.BasicLit)
+	if !ok || lit.Kind != token.STRING {
+		return nil
+	}
+	verbs, err := strconv.Unquote(lit.Value)
+	if err != nil {
+		return nil
+	}
+	args := call.Args[format+1:]
+	var unsafe []ast.Expr
+	seen := map[int]bool{}
+	for _, i := range stringVerbArgs(verbs) {
+		if i >= len(args) || seen[i] {
+			continue
+		}
+		seen[i] = true
+		if !safe(args[i]) {
+			unsafe = append(unsafe, args[i])
+		}
+	}
+	return unsafe
+}
+
+// stringVerbArgs returns the argument indexes that format prints with a
+// string verb, honouring explicit indexes such as %[1]s.
+func stringVerbArgs(format string) []int {
+	var idx []int
+	arg := 0
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			continue
+		}
+		i++
+		for i < len(format) && strings.IndexByte("+-# 0", format[i]) >= 0 {
+			i++
+		}
+		if i < len(format) && format[i] == '[' {
+			end := strings.IndexByte(format[i:], ']')
+			if end < 0 {
+				return idx
+			}
+			if n, err := strconv.Atoi(format[i+1 : i+end]); err == nil {
+				arg = n - 1
+			}
+			i += end + 1
+		}
+		for i < len(format) && (format[i] >= '0' && format[i] <= '9' || format[i] == '.' || format[i] == '*') {
+			i++
+		}
+		if i >= len(format) || format[i] == '%' {
+			continue
+		}
+		if strings.IndexByte("svq", format[i]) >= 0 {
+			idx = append(idx, arg)
+		}
+		arg++
+	}
+	return idx
+}
+
+// safe reports whether arg is safe to interpolate: see safeArg, or a variable
+// only ever assigned such values, e.g. p := shellquote.Quote(remotePath).
+func (c *funcChecker) safe(arg ast.Expr) bool {
+	if safeArg(arg, c.consts) {
+		return true
+	}
+	id, ok := arg.(*ast.Ident)
+	if !ok || len(c.assigns[id.Name]) == 0 || c.checking[id.Name] {
+		return false
+	}
+	c.checking[id.Name] = true
+	defer delete(c.checking, id.Name)
+	for _, v := range c.assigns[id.Name] {
+		if v == nil || !c.safe(v) {
+			return false
+		}
+	}
+	return true
+}
+
+func safeArg(arg ast.Expr, consts map[string]bool) bool {
+	switch a := arg.(type) {
+	case *ast.BasicLit:
+		return true
+	case *ast.Ident:
+		return consts[a.Name]
+	case *ast.SelectorExpr:
+		// Exported package-level names such as common.KubeConfigDir are
+		// fixed paths and options.
+		pkg, ok := a.X.(*ast.Ident)
+		return ok && pkg.Obj == nil && ast.IsExported(a.Sel.Name) && pkg.Name == strings.ToLower(pkg.Name)
+	case *ast.CallExpr:
+		return quoteFuncs[funcName(a)]
+	case *ast.ParenExpr:
+		return safeArg(a.X, consts)
+	}
+	return false
+}
+
+func exprString(e ast.Expr) string {
+	var b strings.Builder
+	if err := printExpr(&b, e); err != nil {
+		return "argument"
+	}
+	return b.String()
+}
+
+func printExpr(b *strings.Builder, e ast.Expr) error {
+	switch x := e.(type) {
+	case *ast.Ident:
+		b.WriteString(x.Name)
+	case *ast.SelectorExpr:
+		if err := printExpr(b, x.X); err != nil {
+			return err
+		}
+		b.WriteString("." + x.Sel.Name)
+	case *ast.CallExpr:
+		if err := printExpr(b, x.Fun); err != nil {
+			return err
+		}
+		b.WriteString("(...)")
+	case *ast.IndexExpr:
+		if err := printExpr(b, x.X); err != nil {
+			return err
+		}
+		b.WriteString("[...]")
+	default:
+		b.WriteString(fmt.Sprintf("%T", e))
+	}
+	return nil
+}
+
+func TestCheckPackage(t *testing.T) {
+	findings, err := checkPackage("testdata/unsafe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"testdata/unsafe/unsafe.go:18: unquoted path",
+		"testdata/unsafe/unsafe.go:19: unquoted name",
+		"testdata/unsafe/unsafe.go:20: unquoted path",
+		"testdata/unsafe/unsafe.go:23: unquoted name",
+		"testdata/unsafe/unsafe.go:27: unquoted keyPath(...)",
+	}
+	if len(findings) != len(want) {
+		t.Fatalf("got findings %q, want %d", findings, len(want))
+	}
+	sort.Strings(findings)
+	for i, f := range findings {
+		if !strings.HasPrefix(f, want[i]+" ") {
+			t.Errorf("finding %q, want %q", f, want[i])
+		}
+	}
+}
@@ -0,0 +1,39 @@
+// Package shellquote builds POSIX shell command lines from untrusted words,
+// such as paths and names taken from the cluster configuration, so that a
+// word is always passed as one argument and never interpreted by the remote
+// shell.
+package shellquote
+
+import (
+	"strings"
+)
+
+// safe reports whether r can appear unquoted in a word without the shell
+// giving it a meaning.
+func safe(r rune) bool {
+	switch {
+	case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		return true
+	}
+	return strings.ContainsRune("@%+=:,./-_", r)
+}
+
+// Quote returns s as a single shell word. Words made only of letters, digits
+// and common path punctuation are returned as is, so commands stay readable
+// in logs; others are enclosed in single quotes.
+func Quote(s string) string {
+	if s != "" && strings.IndexFunc(s, func(r rune) bool { return !safe(r) }) < 0 {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// Join quotes every argument and joins them into a command line running
+// argv[0] with the rest as its arguments.
+func Join(argv ...string) string {
+	words := make([]string, len(argv))
+	for i, a := range argv {
+		words[i] = Quote(a)
+	}
+	return strings.Join(words, " ")
+}
@@ -0,0 +1,36 @@
+package shellquote
+
+import (
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuote(t *testing.T) {
+	for in, want := range map[string]string{
+		"/etc/kubernetes/admin.conf": "/etc/kubernetes/admin.conf",
+		"kube-apiserver":             "kube-apiserver",
+		"":                           "''",
+		"a b":                        "'a b'",
+		"it's":                       `'it'\''s'`,
+		"$(reboot)":                  "'$(reboot)'",
+		"x;rm -rf /":                 "'x;rm -rf /'",
+		"~/.ssh":                     "'~/.ssh'",
+	} {
+		assert.Equal(t, want, Quote(in), in)
+	}
+	assert.Equal(t, `grep -q 'server: x$' /etc/kubernetes/kubelet.conf`, Join("grep", "-q", "server: x$", "/etc/kubernetes/kubelet.conf"))
+}
+
+func TestJoinRoundTrip(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("no sh")
+	}
+	argv := []string{"printf", `%s|`, "a b", "it's", "$(id)", "`id`", `\n`, "*", ""}
+	out, err := exec.Command(sh, "-c", Join(argv...)).Output()
+	require.NoError(t, err)
+	assert.Equal(t, "a b|it's|$(id)|`id`|\\n|*||", string(out))
+}
@@ -0,0 +1,30 @@
+// Package unsafe builds commands the interpolation check must report.
+package unsafe
+
+import (
+	"bytes"
+	"fmt"
+)
+
+const dir = "/etc/xm"
+
+func Run(cmd string) {}
+
+func quote(s string) string { return s }
+
+func keyPath() string { return "/root/.ssh/id" }
+
+func commands(name, path, owner string) {
+	Run(fmt.Sprintf("rm -f %s", path))
+	Run("mkdir -p " + dir + "/" + name)
+	cmd := "chown " + quote(owner) + " " + path
+	Run(cmd)
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "mv -f %s %s", quote(path), name)
+	Run(buf.String())
+	// shellquote:ok: accepted.
+	Run("cat " + path)
+	Run("rm -f " + keyPath())
+	p := quote(path)
+	Run(fmt.Sprintf("cat %s", p))
+}
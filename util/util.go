@@ -338,7 +338,7 @@ func CombineErrors(errs ...error) error {
 	if len(errStrings) == 0 {
 		return nil
 	}
-	return fmt.Errorf(strings.Join(errStrings, "; "))
+	return errors.New(strings.Join(errStrings, "; "))
 }
 
 // StringPtr returns a pointer to the string value.
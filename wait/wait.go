@@ -0,0 +1,163 @@
+// Package wait polls conditions until they hold, a timeout expires or the
+// context is cancelled. Modules use it instead of hand-written sleep loops when
+// they wait for ports, endpoints, files, services or Kubernetes objects.
+package wait
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/mensylisir/xmcores/connector"
+	"github.com/mensylisir/xmcores/errs"
+	"github.com/mensylisir/xmcores/logger"
+	"github.com/mensylisir/xmcores/modules"
+)
+
+const (
+	DefaultTimeout  = 5 * time.Minute
+	DefaultInterval = 2 * time.Second
+)
+
+// ErrTimeout is returned (wrapped) when a condition does not hold in time. The
+// error is classified as errs.Verification.
+var ErrTimeout = errors.New("timed out")
+
+// Options control how long and how often a condition is checked.
+type Options struct {
+	// Timeout bounds the whole wait.
+	Timeout time.Duration
+	// Interval is the delay after the first failed check.
+	Interval time.Duration
+	// Factor multiplies the delay after every failed check; values below 1 keep it constant.
+	Factor float64
+	// MaxInterval caps the delay when Factor grows it. Zero means no cap.
+	MaxInterval time.Duration
+}
+
+// SetDefaults fills in unset fields.
+func (o *Options) SetDefaults() {
+	if o.Timeout == 0 {
+		o.Timeout = DefaultTimeout
+	}
+	if o.Interval == 0 {
+		o.Interval = DefaultInterval
+	}
+}
+
+// next returns the delay following d.
+func (o Options) next(d time.Duration) time.Duration {
+	if o.Factor <= 1 {
+		return d
+	}
+	d = time.Duration(float64(d) * o.Factor)
+	if o.MaxInterval > 0 && d > o.MaxInterval {
+		d = o.MaxInterval
+	}
+	return d
+}
+
+// Condition reports whether the awaited state is reached. An error means "not
+// yet" and is kept as the reason reported when the wait times out.
+type Condition func(ctx context.Context) (bool, error)
+
+// Poll checks cond until it returns true. what describes the awaited state in
+// logs and errors, e.g. "port 10.0.0.1:6443".
+func Poll(ctx context.Context, opts Options, what string, cond Condition) error {
+	opts.SetDefaults()
+	pollCtx, cancel := context.WithTimeout(ctx, opts.Timeout)
+	defer cancel()
+
+	var lastErr error
+	delay := opts.Interval
+	for {
+		done, err := cond(pollCtx)
+		if done && err == nil {
+			return nil
+		}
+		// Keep the previous reason when the deadline interrupted this check.
+		if err != nil && (pollCtx.Err() == nil || lastErr == nil) {
+			lastErr = err
+			logger.Log.Debugf("Waiting for %s: %v", what, err)
+		}
+		t := time.NewTimer(delay)
+		select {
+		case <-pollCtx.Done():
+			t.Stop()
+			if ctx.Err() != nil {
+				return fmt.Errorf("waiting for %s: %w", what, ctx.Err())
+			}
+			if lastErr != nil {
+				return errs.Wrap(errs.Verification, fmt.Errorf("%w after %s waiting for %s: %w", ErrTimeout, opts.Timeout, what, lastErr))
+			}
+			return errs.Wrap(errs.Verification, fmt.Errorf("%w after %s waiting for %s", ErrTimeout, opts.Timeout, what))
+		case <-t.C:
+		}
+		delay = opts.next(delay)
+	}
+}
+
+// Sleep pauses for d or until ctx is done, returning ctx.Err() in that case.
+func Sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// TCP waits until a TCP connection to addr (host:port) succeeds from the controller.
+func TCP(ctx context.Context, addr string, opts Options) error {
+	return Poll(ctx, opts, "port "+addr, func(ctx context.Context) (bool, error) {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return false, err
+		}
+		conn.Close()
+		return true, nil
+	})
+}
+
+// HTTP waits until a GET of url answers 200 OK. A nil client uses
+// http.DefaultClient; pass one with a TLS config for self-signed endpoints.
+func HTTP(ctx context.Context, client *http.Client, url string, opts Options) error {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return Poll(ctx, opts, url, func(ctx context.Context) (bool, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return false, err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return false, err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return false, fmt.Errorf("status %s", resp.Status)
+		}
+		return true, nil
+	})
+}
+
+// RemoteFile waits until path exists on the host behind exec.
+func RemoteFile(ctx context.Context, exec connector.Executor, path string, opts Options) error {
+	return Poll(ctx, opts, "file "+path, func(ctx context.Context) (bool, error) {
+		return modules.Succeeds(ctx, exec, "test -e "+path)
+	})
+}
+
+// UnitActive waits until the systemd unit is active on the host behind exec.
+func UnitActive(ctx context.Context, exec connector.Executor, unit string, opts Options) error {
+	return Poll(ctx, opts, "unit "+unit, func(ctx context.Context) (bool, error) {
+		return modules.Succeeds(ctx, exec, "systemctl is-active --quiet "+unit)
+	})
+}
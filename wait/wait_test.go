@@ -0,0 +1,72 @@
+package wait
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func fast(timeout time.Duration) Options {
+	return Options{Timeout: timeout, Interval: time.Millisecond}
+}
+
+func TestPoll(t *testing.T) {
+	calls := 0
+	err := Poll(context.Background(), fast(time.Second), "three calls", func(context.Context) (bool, error) {
+		calls++
+		return calls == 3, nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 3, calls)
+
+	err = Poll(context.Background(), fast(20*time.Millisecond), "never", func(context.Context) (bool, error) {
+		return false, errors.New("still starting")
+	})
+	assert.ErrorIs(t, err, ErrTimeout)
+	assert.ErrorContains(t, err, "waiting for never: still starting")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = Poll(ctx, fast(time.Second), "cancelled", func(context.Context) (bool, error) { return false, nil })
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.NotErrorIs(t, err, ErrTimeout)
+}
+
+func TestOptionsNext(t *testing.T) {
+	constant := Options{Interval: time.Second}
+	assert.Equal(t, time.Second, constant.next(time.Second))
+
+	backoff := Options{Factor: 2, MaxInterval: 3 * time.Second}
+	assert.Equal(t, 2*time.Second, backoff.next(time.Second))
+	assert.Equal(t, 3*time.Second, backoff.next(2*time.Second))
+}
+
+func TestTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := ln.Addr().String()
+	require.NoError(t, TCP(context.Background(), addr, fast(time.Second)))
+
+	ln.Close()
+	assert.ErrorIs(t, TCP(context.Background(), addr, fast(20*time.Millisecond)), ErrTimeout)
+}
+
+func TestHTTP(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls < 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+	require.NoError(t, HTTP(context.Background(), nil, srv.URL+"/healthz", fast(time.Second)))
+	assert.Equal(t, 2, calls)
+}
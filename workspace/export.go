@@ -0,0 +1,293 @@
+package workspace
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+
+	"github.com/mensylisir/xmcores/common"
+)
+
+// An exported state archive is a gzipped tar of the cluster directory,
+// sealed with XChaCha20-Poly1305 under a key derived from a passphrase with
+// scrypt:
+//
+//	stateMagic | salt (16 bytes) | nonce (24 bytes) | ciphertext
+const (
+	stateMagic   = "xm-state-v1\n"
+	manifestFile = "manifest.json"
+	saltSize     = 16
+	// scrypt parameters recommended for interactive use in 2017, when
+	// deriving a key takes about 100ms.
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// ErrPassphrase is returned (wrapped) when an archive cannot be opened with
+// the given passphrase, or was altered.
+var ErrPassphrase = errors.New("wrong passphrase or corrupted archive")
+
+// Certificate describes a certificate the cluster was set up with, so the
+// receiver of an archive knows when it expires without decoding it.
+type Certificate struct {
+	Name     string    `json:"name"`
+	Subject  string    `json:"subject"`
+	Issuer   string    `json:"issuer"`
+	NotAfter time.Time `json:"notAfter"`
+}
+
+// Manifest is stored in an archive next to the cluster files.
+type Manifest struct {
+	Cluster  string    `json:"cluster"`
+	Exported time.Time `json:"exported"`
+	// Hostname is the workstation the archive was exported from.
+	Hostname     string        `json:"hostname,omitempty"`
+	Files        []string      `json:"files"`
+	Certificates []Certificate `json:"certificates,omitempty"`
+}
+
+// exported reports whether the file at rel, relative to the cluster
+// directory, belongs in an archive. The lock is tied to this workstation,
+// diagnostic bundles and downloaded artifacts are large and can be collected
+// or fetched again; the store of cached values, such as gathered facts, is
+// kept.
+func exported(rel string) bool {
+	switch rel = filepath.ToSlash(rel); {
+	case rel == configFile, rel == kubeconfigFile, rel == historyFile, rel == changesFile:
+		return true
+	case strings.HasPrefix(rel, cacheDir+"/"+storeDir+"/"):
+		return true
+	}
+	return false
+}
+
+// Export writes the state of the cluster, encrypted with passphrase, to w.
+// Cluster, Exported, Hostname and Files of m are filled in.
+func (c *Cluster) Export(w io.Writer, passphrase []byte, m Manifest) error {
+	if len(passphrase) == 0 {
+		return errors.New("a passphrase is required to export the cluster state")
+	}
+	if _, err := os.Stat(c.Dir); err != nil {
+		return fmt.Errorf("cluster %s: %w", c.Name, err)
+	}
+	m.Cluster, m.Exported, m.Files = c.Name, time.Now().UTC(), nil
+	m.Hostname, _ = os.Hostname()
+
+	var files []string
+	err := filepath.WalkDir(c.Dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(c.Dir, p)
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() && exported(rel) {
+			files = append(files, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list the files of cluster %s: %w", c.Name, err)
+	}
+	m.Files = files
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	manifest, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeEntry(tw, manifestFile, manifest, m.Exported); err != nil {
+		return err
+	}
+	for _, rel := range files {
+		data, err := os.ReadFile(c.Path(filepath.FromSlash(rel)))
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", rel, err)
+		}
+		if err := writeEntry(tw, rel, data, m.Exported); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("failed to write archive: %w", err)
+	}
+	if err := gz.Close(); err != nil {
+		return fmt.Errorf("failed to write archive: %w", err)
+	}
+
+	sealed, err := seal(passphrase, buf.Bytes())
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(sealed); err != nil {
+		return fmt.Errorf("failed to write archive: %w", err)
+	}
+	return nil
+}
+
+func writeEntry(tw *tar.Writer, name string, data []byte, mtime time.Time) error {
+	hdr := &tar.Header{Name: name, Mode: int64(common.FileMode0600), Size: int64(len(data)), ModTime: mtime}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("failed to write archive: %w", err)
+	}
+	if _, err := tw.Write(data); err != nil {
+		return fmt.Errorf("failed to write archive: %w", err)
+	}
+	return nil
+}
+
+// ReadArchive decrypts the archive read from r and returns its manifest and
+// files, keyed by their path relative to the cluster directory.
+func ReadArchive(r io.Reader, passphrase []byte) (Manifest, map[string][]byte, error) {
+	var m Manifest
+	sealed, err := io.ReadAll(r)
+	if err != nil {
+		return m, nil, fmt.Errorf("failed to read archive: %w", err)
+	}
+	plain, err := open(passphrase, sealed)
+	if err != nil {
+		return m, nil, err
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(plain))
+	if err != nil {
+		return m, nil, fmt.Errorf("failed to read archive: %w", err)
+	}
+	files := map[string][]byte{}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return m, nil, fmt.Errorf("failed to read archive: %w", err)
+		}
+		name := path.Clean(hdr.Name)
+		if hdr.Typeflag != tar.TypeReg || (name != manifestFile && !exported(name)) {
+			return m, nil, fmt.Errorf("unexpected archive entry %q", hdr.Name)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return m, nil, fmt.Errorf("failed to read archive: %w", err)
+		}
+		files[name] = data
+	}
+	data, ok := files[manifestFile]
+	if !ok {
+		return m, nil, errors.New("archive has no manifest")
+	}
+	delete(files, manifestFile)
+	if err := json.Unmarshal(data, &m); err != nil {
+		return m, nil, fmt.Errorf("failed to parse archive manifest: %w", err)
+	}
+	return m, files, nil
+}
+
+// Import decrypts the archive read from r into the directory of the cluster
+// called name, or the exported cluster's name when empty. An existing cluster
+// is only replaced with overwrite, and never while it is locked.
+func (w *Workspace) Import(r io.Reader, passphrase []byte, name string, overwrite bool) (*Cluster, Manifest, error) {
+	m, files, err := ReadArchive(r, passphrase)
+	if err != nil {
+		return nil, m, err
+	}
+	if name == "" {
+		name = m.Cluster
+	}
+	c, err := w.Cluster(name)
+	if err != nil {
+		return nil, m, err
+	}
+	if _, err := os.Stat(c.Dir); err == nil {
+		if !overwrite {
+			return nil, m, fmt.Errorf("cluster %s already exists in %s", name, w.Root)
+		}
+		unlock, err := c.Lock("import state")
+		if err != nil {
+			return nil, m, err
+		}
+		defer unlock()
+	}
+	for rel, data := range files {
+		p := c.Path(filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(p), common.FileMode0700); err != nil {
+			return nil, m, fmt.Errorf("failed to create %s: %w", filepath.Dir(p), err)
+		}
+		if err := os.WriteFile(p, data, common.FileMode0600); err != nil {
+			return nil, m, fmt.Errorf("failed to write %s: %w", p, err)
+		}
+	}
+	return c, m, nil
+}
+
+func deriveKey(passphrase, salt []byte) ([]byte, error) {
+	key, err := scrypt.Key(passphrase, salt, scryptN, scryptR, scryptP, chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive key: %w", err)
+	}
+	return key, nil
+}
+
+func seal(passphrase, plain []byte) ([]byte, error) {
+	salt := make([]byte, saltSize)
+	nonce := make([]byte, chacha20poly1305.NonceSizeX)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	key, err := deriveKey(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	out := append([]byte(stateMagic), salt...)
+	out = append(out, nonce...)
+	return aead.Seal(out, nonce, plain, []byte(stateMagic)), nil
+}
+
+func open(passphrase, sealed []byte) ([]byte, error) {
+	if !bytes.HasPrefix(sealed, []byte(stateMagic)) {
+		return nil, errors.New("not an xm state archive")
+	}
+	sealed = sealed[len(stateMagic):]
+	if len(sealed) < saltSize+chacha20poly1305.NonceSizeX {
+		return nil, errors.New("truncated xm state archive")
+	}
+	salt, nonce, ciphertext := sealed[:saltSize], sealed[saltSize:saltSize+chacha20poly1305.NonceSizeX], sealed[saltSize+chacha20poly1305.NonceSizeX:]
+	key, err := deriveKey(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := aead.Open(nil, nonce, ciphertext, []byte(stateMagic))
+	if err != nil {
+		return nil, ErrPassphrase
+	}
+	return plain, nil
+}
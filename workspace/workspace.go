@@ -0,0 +1,566 @@
+// Package workspace lays out the local work directory. Every cluster gets a
+// directory named after its metadata.name holding its configuration, admin
+// kubeconfig, run history, lock and caches, so one work directory can manage
+// several clusters side by side:
+//
+//	<root>/clusters/<name>/cluster.yaml
+//	<root>/clusters/<name>/kubeconfig
+//	<root>/clusters/<name>/history.jsonl
+//	<root>/clusters/<name>/changes.jsonl
+//	<root>/clusters/<name>/lock
+//	<root>/clusters/<name>/cache/
+//	<root>/clusters/<name>/cache/store/
+//	<root>/clusters/<name>/diag/
+//
+// History, caches and diagnostic bundles grow with every run; GC trims them
+// according to a Retention. The change journal is an audit record and is
+// never trimmed. Export and Import move the state of a cluster
+// between workstations in an encrypted archive.
+package workspace
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/mensylisir/xmcores/cache"
+	"github.com/mensylisir/xmcores/common"
+	"github.com/mensylisir/xmcores/modules"
+)
+
+const (
+	clustersDir    = "clusters"
+	configFile     = "cluster.yaml"
+	kubeconfigFile = "kubeconfig"
+	historyFile    = "history.jsonl"
+	changesFile    = "changes.jsonl"
+	lockFile       = "lock"
+	cacheDir       = "cache"
+	storeDir       = "store"
+	diagDir        = "diag"
+)
+
+// ErrLocked is returned (wrapped) when another run holds the cluster lock.
+var ErrLocked = errors.New("cluster is locked by another run")
+
+// Workspace is a work directory.
+type Workspace struct {
+	Root string
+}
+
+// New returns the workspace rooted at root. Nothing is created until a
+// cluster directory is written to.
+func New(root string) *Workspace {
+	return &Workspace{Root: root}
+}
+
+// Cluster is the directory of one cluster in the workspace.
+type Cluster struct {
+	Name string
+	Dir  string
+}
+
+// ValidateName rejects cluster names that cannot be used as a directory name.
+func ValidateName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("invalid cluster name %q", name)
+	}
+	return nil
+}
+
+// Cluster returns the directory of the cluster called name.
+func (w *Workspace) Cluster(name string) (*Cluster, error) {
+	if err := ValidateName(name); err != nil {
+		return nil, err
+	}
+	return &Cluster{Name: name, Dir: filepath.Join(w.Root, clustersDir, name)}, nil
+}
+
+// Path joins elem to the cluster directory.
+func (c *Cluster) Path(elem ...string) string {
+	return filepath.Join(append([]string{c.Dir}, elem...)...)
+}
+
+// KubeconfigPath is where the admin kubeconfig of the cluster is kept.
+func (c *Cluster) KubeconfigPath() string {
+	return c.Path(kubeconfigFile)
+}
+
+// CacheDir is the directory for downloads and other cached artifacts of the cluster.
+func (c *Cluster) CacheDir() string {
+	return c.Path(cacheDir)
+}
+
+// Store is the cache of values computed or downloaded for the cluster, such
+// as published checksums, shared by its runs.
+func (c *Cluster) Store() *cache.Store {
+	return cache.NewStore(c.Path(cacheDir, storeDir))
+}
+
+// DiagDir is the directory for diagnostic bundles of the cluster.
+func (c *Cluster) DiagDir() string {
+	return c.Path(diagDir)
+}
+
+func (c *Cluster) write(name string, data []byte, mode os.FileMode) error {
+	if err := os.MkdirAll(c.Dir, common.FileMode0700); err != nil {
+		return fmt.Errorf("failed to create %s: %w", c.Dir, err)
+	}
+	if err := os.WriteFile(c.Path(name), data, mode); err != nil {
+		return fmt.Errorf("failed to write %s: %w", c.Path(name), err)
+	}
+	return nil
+}
+
+// SaveConfig keeps a copy of the configuration last used for the cluster.
+func (c *Cluster) SaveConfig(data []byte) error {
+	return c.write(configFile, data, common.FileMode0600)
+}
+
+// SaveKubeconfig stores the admin kubeconfig of the cluster.
+func (c *Cluster) SaveKubeconfig(data []byte) error {
+	return c.write(kubeconfigFile, data, common.FileMode0600)
+}
+
+// lockInfo identifies the holder of a lock.
+type lockInfo struct {
+	PID      int       `json:"pid"`
+	Hostname string    `json:"hostname"`
+	Command  string    `json:"command"`
+	Since    time.Time `json:"since"`
+}
+
+func (l lockInfo) String() string {
+	return fmt.Sprintf("%s (pid %d on %s since %s)", l.Command, l.PID, l.Hostname, l.Since.Format(time.RFC3339))
+}
+
+// stale reports whether the lock was left behind by a process of this
+// machine that no longer exists.
+func (l lockInfo) stale() bool {
+	if host, _ := os.Hostname(); host != l.Hostname || l.PID <= 0 {
+		return false
+	}
+	p, err := os.FindProcess(l.PID)
+	if err != nil {
+		return true
+	}
+	return errors.Is(p.Signal(syscall.Signal(0)), os.ErrProcessDone)
+}
+
+// Lock takes the cluster lock for command, so two runs cannot change the
+// same cluster at once. A lock left by a crashed run on this machine is
+// taken over. The returned function releases the lock.
+func (c *Cluster) Lock(command string) (func() error, error) {
+	if err := os.MkdirAll(c.Dir, common.FileMode0700); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %w", c.Dir, err)
+	}
+	host, _ := os.Hostname()
+	data, err := json.Marshal(lockInfo{PID: os.Getpid(), Hostname: host, Command: command, Since: time.Now()})
+	if err != nil {
+		return nil, err
+	}
+	path := c.Path(lockFile)
+	for attempt := 0; ; attempt++ {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, common.FileMode0600)
+		if err == nil {
+			_, err = f.Write(data)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				_ = os.Remove(path)
+				return nil, fmt.Errorf("failed to write %s: %w", path, err)
+			}
+			return func() error { return os.Remove(path) }, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, fmt.Errorf("failed to lock cluster %s: %w", c.Name, err)
+		}
+		holder, rerr := c.lockHolder()
+		if rerr != nil {
+			return nil, rerr
+		}
+		if attempt > 0 || !holder.stale() {
+			return nil, fmt.Errorf("%s: %w: %s", c.Name, ErrLocked, holder)
+		}
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("failed to remove stale lock %s: %w", path, err)
+		}
+	}
+}
+
+func (c *Cluster) lockHolder() (lockInfo, error) {
+	var l lockInfo
+	data, err := os.ReadFile(c.Path(lockFile))
+	if err != nil {
+		return l, fmt.Errorf("failed to read lock of cluster %s: %w", c.Name, err)
+	}
+	if err := json.Unmarshal(data, &l); err != nil {
+		return l, fmt.Errorf("failed to parse lock of cluster %s: %w", c.Name, err)
+	}
+	return l, nil
+}
+
+// Locked returns the holder of the cluster lock, or false when it is free.
+func (c *Cluster) Locked() (string, bool) {
+	l, err := c.lockHolder()
+	if err != nil {
+		return "", false
+	}
+	return l.String(), true
+}
+
+// Run is an entry of the run history.
+type Run struct {
+	// ID identifies the run; runs recorded by older versions have none.
+	ID       string    `json:"id,omitempty"`
+	Command  string    `json:"command"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	// Error is the failure message, empty for successful runs.
+	Error string `json:"error,omitempty"`
+	// Hosts are the transfer and execution statistics of the hosts the run
+	// connected to, sorted by name.
+	Hosts []HostStats `json:"hosts,omitempty"`
+}
+
+// HostStats sums what a run did over the connections to a host.
+type HostStats struct {
+	Host       string `json:"host"`
+	Uploaded   int64  `json:"uploaded"`
+	Downloaded int64  `json:"downloaded"`
+	Commands   int    `json:"commands"`
+	// Failures counts the commands that could not run or exited non-zero and
+	// the failed transfers.
+	Failures    int           `json:"failures"`
+	MeanLatency time.Duration `json:"meanLatency"`
+}
+
+// Succeeded reports whether the run finished without error.
+func (r Run) Succeeded() bool {
+	return r.Error == ""
+}
+
+// RecordRun appends r to the run history.
+func (c *Cluster) RecordRun(r Run) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(c.Dir, common.FileMode0700); err != nil {
+		return fmt.Errorf("failed to create %s: %w", c.Dir, err)
+	}
+	f, err := os.OpenFile(c.Path(historyFile), os.O_WRONLY|os.O_CREATE|os.O_APPEND, common.FileMode0600)
+	if err != nil {
+		return fmt.Errorf("failed to open run history: %w", err)
+	}
+	_, err = f.Write(append(data, '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to record run: %w", err)
+	}
+	return nil
+}
+
+// History returns the recorded runs, oldest first. Unreadable lines are skipped.
+func (c *Cluster) History() ([]Run, error) {
+	f, err := os.Open(c.Path(historyFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open run history: %w", err)
+	}
+	defer f.Close()
+	var runs []Run
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var r Run
+		if json.Unmarshal(sc.Bytes(), &r) == nil {
+			runs = append(runs, r)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read run history: %w", err)
+	}
+	return runs, nil
+}
+
+// Run returns the recorded run whose ID is id or starts with it.
+func (c *Cluster) Run(id string) (Run, error) {
+	runs, err := c.History()
+	if err != nil {
+		return Run{}, err
+	}
+	var found []Run
+	for _, r := range runs {
+		if id != "" && strings.HasPrefix(r.ID, id) {
+			found = append(found, r)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return Run{}, fmt.Errorf("no run %q in the history of cluster %s", id, c.Name)
+	case 1:
+		return found[0], nil
+	}
+	return Run{}, fmt.Errorf("run ID %q is ambiguous, %d runs match", id, len(found))
+}
+
+// RecordChanges appends changes to the change journal of the cluster (see
+// modules.JournalConfig).
+func (c *Cluster) RecordChanges(changes []modules.Change) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	var buf bytes.Buffer
+	for _, ch := range changes {
+		data, err := json.Marshal(ch)
+		if err != nil {
+			return err
+		}
+		buf.Write(append(data, '\n'))
+	}
+	if err := os.MkdirAll(c.Dir, common.FileMode0700); err != nil {
+		return fmt.Errorf("failed to create %s: %w", c.Dir, err)
+	}
+	f, err := os.OpenFile(c.Path(changesFile), os.O_WRONLY|os.O_CREATE|os.O_APPEND, common.FileMode0600)
+	if err != nil {
+		return fmt.Errorf("failed to open change journal: %w", err)
+	}
+	_, err = f.Write(buf.Bytes())
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to record changes: %w", err)
+	}
+	return nil
+}
+
+// Changes returns the journaled changes, oldest first. Unreadable lines are
+// skipped.
+func (c *Cluster) Changes() ([]modules.Change, error) {
+	f, err := os.Open(c.Path(changesFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open change journal: %w", err)
+	}
+	defer f.Close()
+	var changes []modules.Change
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var ch modules.Change
+		if json.Unmarshal(sc.Bytes(), &ch) == nil {
+			changes = append(changes, ch)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read change journal: %w", err)
+	}
+	return changes, nil
+}
+
+// ChangesOf returns the journaled changes of the run whose ID is id or starts
+// with it, or the change whose ID is id.
+func (c *Cluster) ChangesOf(id string) ([]modules.Change, error) {
+	all, err := c.Changes()
+	if err != nil {
+		return nil, err
+	}
+	var (
+		found []modules.Change
+		runs  = map[string]bool{}
+	)
+	for _, ch := range all {
+		if id != "" && (ch.ID == id || strings.HasPrefix(ch.Run, id)) {
+			found = append(found, ch)
+			runs[ch.Run] = true
+		}
+	}
+	switch {
+	case len(found) == 0:
+		return nil, fmt.Errorf("no change %q in the journal of cluster %s", id, c.Name)
+	case len(runs) > 1:
+		return nil, fmt.Errorf("run ID %q is ambiguous, %d runs match", id, len(runs))
+	}
+	return found, nil
+}
+
+// Info summarizes what the workspace knows about a cluster.
+type Info struct {
+	Name string `json:"name"`
+	Runs int    `json:"runs"`
+	// LastRun is nil when nothing has been recorded yet.
+	LastRun *Run `json:"lastRun,omitempty"`
+	// Kubeconfig is the path of the stored admin kubeconfig, if any.
+	Kubeconfig string `json:"kubeconfig,omitempty"`
+	LockedBy   string `json:"lockedBy,omitempty"`
+}
+
+// Clusters lists the clusters of the workspace, sorted by name.
+func (w *Workspace) Clusters() ([]Info, error) {
+	entries, err := os.ReadDir(filepath.Join(w.Root, clustersDir))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list clusters: %w", err)
+	}
+	var infos []Info
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		c, err := w.Cluster(e.Name())
+		if err != nil {
+			continue
+		}
+		runs, err := c.History()
+		if err != nil {
+			return nil, fmt.Errorf("cluster %s: %w", c.Name, err)
+		}
+		info := Info{Name: c.Name, Runs: len(runs)}
+		if len(runs) > 0 {
+			info.LastRun = &runs[len(runs)-1]
+		}
+		if _, err := os.Stat(c.KubeconfigPath()); err == nil {
+			info.Kubeconfig = c.KubeconfigPath()
+		}
+		info.LockedBy, _ = c.Locked()
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos, nil
+}
+
+// Retention bounds what a cluster directory keeps.
+type Retention struct {
+	// MaxRuns is how many of the latest runs the history keeps; zero keeps all.
+	MaxRuns int
+	// MaxAge is how long cached artifacts and diagnostic bundles are kept
+	// after they were last modified; zero keeps them.
+	MaxAge time.Duration
+}
+
+// DefaultRetention is applied after every run.
+var DefaultRetention = Retention{MaxRuns: 200, MaxAge: 30 * 24 * time.Hour}
+
+// GC applies r to the cluster directory and returns the paths it removed or,
+// for the history, rewrote.
+func (c *Cluster) GC(r Retention) ([]string, error) {
+	var changed []string
+	if r.MaxRuns > 0 {
+		trimmed, err := c.trimHistory(r.MaxRuns)
+		if err != nil {
+			return changed, err
+		}
+		if trimmed {
+			changed = append(changed, c.Path(historyFile))
+		}
+	}
+	if r.MaxAge > 0 {
+		cutoff := time.Now().Add(-r.MaxAge)
+		removed, err := c.Store().Prune(cutoff)
+		changed = append(changed, removed...)
+		if err != nil {
+			return changed, err
+		}
+		for _, dir := range []string{c.CacheDir(), c.DiagDir()} {
+			removed, err := removeOlder(dir, cutoff)
+			changed = append(changed, removed...)
+			if err != nil {
+				return changed, err
+			}
+		}
+	}
+	return changed, nil
+}
+
+// trimHistory keeps the last max lines of the history.
+func (c *Cluster) trimHistory(max int) (bool, error) {
+	path := c.Path(historyFile)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to read run history: %w", err)
+	}
+	lines := strings.SplitAfter(string(data), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) <= max {
+		return false, nil
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strings.Join(lines[len(lines)-max:], "")), common.FileMode0600); err != nil {
+		return false, fmt.Errorf("failed to trim run history: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return false, fmt.Errorf("failed to trim run history: %w", err)
+	}
+	return true, nil
+}
+
+// removeOlder removes the entries of dir last modified before cutoff. A
+// directory counts as modified when anything inside it was.
+func removeOlder(dir string, cutoff time.Time) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %w", dir, err)
+	}
+	var removed []string
+	for _, e := range entries {
+		path := filepath.Join(dir, e.Name())
+		latest, err := lastModified(path)
+		if err != nil {
+			return removed, err
+		}
+		if latest.After(cutoff) {
+			continue
+		}
+		if err := os.RemoveAll(path); err != nil {
+			return removed, fmt.Errorf("failed to remove %s: %w", path, err)
+		}
+		removed = append(removed, path)
+	}
+	return removed, nil
+}
+
+func lastModified(root string) (time.Time, error) {
+	var latest time.Time
+	err := filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+		return nil
+	})
+	if err != nil {
+		return latest, fmt.Errorf("failed to inspect %s: %w", root, err)
+	}
+	return latest, nil
+}
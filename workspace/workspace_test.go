@@ -0,0 +1,222 @@
+package workspace
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mensylisir/xmcores/cache"
+	"github.com/mensylisir/xmcores/modules"
+)
+
+func TestClusters(t *testing.T) {
+	ws := New(t.TempDir())
+	infos, err := ws.Clusters()
+	require.NoError(t, err)
+	assert.Empty(t, infos)
+
+	prod, err := ws.Cluster("prod")
+	require.NoError(t, err)
+	dev, err := ws.Cluster("dev")
+	require.NoError(t, err)
+	require.NoError(t, prod.SaveKubeconfig([]byte("apiVersion: v1\n")))
+	start := time.Now()
+	require.NoError(t, prod.RecordRun(Run{Command: "apply", Started: start, Finished: start, Error: "boom"}))
+	require.NoError(t, prod.RecordRun(Run{Command: "diff", Started: start, Finished: start}))
+	require.NoError(t, dev.SaveConfig([]byte("kind: Cluster\n")))
+
+	infos, err = ws.Clusters()
+	require.NoError(t, err)
+	require.Len(t, infos, 2)
+	assert.Equal(t, "dev", infos[0].Name)
+	assert.Nil(t, infos[0].LastRun)
+	assert.Empty(t, infos[0].Kubeconfig)
+	assert.Equal(t, "prod", infos[1].Name)
+	assert.Equal(t, 2, infos[1].Runs)
+	assert.Equal(t, "diff", infos[1].LastRun.Command)
+	assert.True(t, infos[1].LastRun.Succeeded())
+	assert.Equal(t, prod.KubeconfigPath(), infos[1].Kubeconfig)
+
+	history, err := prod.History()
+	require.NoError(t, err)
+	assert.False(t, history[0].Succeeded())
+
+	_, err = ws.Cluster("../x")
+	assert.Error(t, err)
+}
+
+func TestLock(t *testing.T) {
+	c, err := New(t.TempDir()).Cluster("prod")
+	require.NoError(t, err)
+
+	unlock, err := c.Lock("apply")
+	require.NoError(t, err)
+	holder, locked := c.Locked()
+	assert.True(t, locked)
+	assert.Contains(t, holder, "apply")
+
+	_, err = c.Lock("upgrade")
+	assert.True(t, errors.Is(err, ErrLocked))
+	require.NoError(t, unlock())
+	_, locked = c.Locked()
+	assert.False(t, locked)
+
+	// A lock left by a process that is gone is taken over.
+	host, _ := os.Hostname()
+	data, err := json.Marshal(lockInfo{PID: 1 << 30, Hostname: host, Command: "apply"})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(c.Path(lockFile), data, 0600))
+	unlock, err = c.Lock("apply")
+	require.NoError(t, err)
+	require.NoError(t, unlock())
+}
+
+func TestGC(t *testing.T) {
+	c, err := New(t.TempDir()).Cluster("prod")
+	require.NoError(t, err)
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		require.NoError(t, c.RecordRun(Run{Command: fmt.Sprintf("apply-%d", i), Started: start, Finished: start}))
+	}
+	old := time.Now().Add(-48 * time.Hour)
+	for _, p := range []string{c.Path("cache", "v1.29", "kubeadm"), c.Path("cache", "v1.30", "kubeadm"), c.Path("diag", "old.tar.gz"), c.Path("diag", "new.tar.gz")} {
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0o700))
+		require.NoError(t, os.WriteFile(p, []byte("x"), 0o600))
+	}
+	for _, p := range []string{c.Path("cache", "v1.29", "kubeadm"), c.Path("cache", "v1.29"), c.Path("diag", "old.tar.gz")} {
+		require.NoError(t, os.Chtimes(p, old, old))
+	}
+
+	key, err := cache.Key("checksum of an old release")
+	require.NoError(t, err)
+	require.NoError(t, c.Store().Put("checksum", key, []byte(`"ab"`)))
+	stored := c.Path("cache", "store", "checksum", key[:2], key)
+	require.NoError(t, os.Chtimes(stored, old, old))
+
+	changed, err := c.GC(Retention{MaxRuns: 2, MaxAge: 24 * time.Hour})
+	require.NoError(t, err)
+	assert.Equal(t, []string{c.Path("history.jsonl"), stored, c.Path("cache", "v1.29"), c.DiagDir() + "/old.tar.gz"}, changed)
+	runs, err := c.History()
+	require.NoError(t, err)
+	require.Len(t, runs, 2)
+	assert.Equal(t, "apply-3", runs[0].Command)
+	assert.FileExists(t, c.Path("cache", "v1.30", "kubeadm"))
+	assert.FileExists(t, c.Path("diag", "new.tar.gz"))
+
+	changed, err = c.GC(Retention{})
+	require.NoError(t, err)
+	assert.Empty(t, changed, "a zero retention keeps everything")
+}
+
+func TestExportImport(t *testing.T) {
+	src, err := New(t.TempDir()).Cluster("prod")
+	require.NoError(t, err)
+	require.NoError(t, src.SaveConfig([]byte("kind: Cluster\n")))
+	require.NoError(t, src.SaveKubeconfig([]byte("apiVersion: v1\n")))
+	require.NoError(t, src.RecordRun(Run{Command: "apply", Started: time.Now(), Finished: time.Now()}))
+	require.NoError(t, src.Store().Put("facts", "master1", []byte(`{"os":"ubuntu"}`)))
+	require.NoError(t, os.MkdirAll(src.DiagDir(), 0o700))
+	require.NoError(t, os.WriteFile(filepath.Join(src.DiagDir(), "bundle.tar.gz"), []byte("x"), 0o600))
+	unlock, err := src.Lock("apply")
+	require.NoError(t, err)
+	defer unlock()
+
+	var archive bytes.Buffer
+	require.NoError(t, src.Export(&archive, []byte("s3cret"), Manifest{Certificates: []Certificate{{Name: "ca"}}}))
+	assert.NotContains(t, archive.String(), "kind: Cluster", "the archive is encrypted")
+
+	ws := New(t.TempDir())
+	_, _, err = ws.Import(bytes.NewReader(archive.Bytes()), []byte("wrong"), "", false)
+	assert.ErrorIs(t, err, ErrPassphrase)
+
+	dst, m, err := ws.Import(bytes.NewReader(archive.Bytes()), []byte("s3cret"), "", false)
+	require.NoError(t, err)
+	assert.Equal(t, "prod", m.Cluster)
+	assert.Equal(t, "ca", m.Certificates[0].Name)
+	data, err := os.ReadFile(dst.KubeconfigPath())
+	require.NoError(t, err)
+	assert.Equal(t, "apiVersion: v1\n", string(data))
+	runs, err := dst.History()
+	require.NoError(t, err)
+	assert.Len(t, runs, 1)
+	facts, ok := dst.Store().Get("facts", "master1")
+	assert.True(t, ok)
+	assert.Equal(t, `{"os":"ubuntu"}`, string(facts))
+	_, locked := dst.Locked()
+	assert.False(t, locked, "the lock stays on the exporting workstation")
+	assert.NoDirExists(t, dst.DiagDir())
+
+	_, _, err = ws.Import(bytes.NewReader(archive.Bytes()), []byte("s3cret"), "", false)
+	assert.ErrorContains(t, err, "already exists")
+	_, _, err = ws.Import(bytes.NewReader(archive.Bytes()), []byte("s3cret"), "", true)
+	require.NoError(t, err)
+	staging, _, err := ws.Import(bytes.NewReader(archive.Bytes()), []byte("s3cret"), "staging", false)
+	require.NoError(t, err)
+	assert.FileExists(t, staging.KubeconfigPath())
+}
+
+func TestRun(t *testing.T) {
+	c, err := New(t.TempDir()).Cluster("demo")
+	require.NoError(t, err)
+	start := time.Now()
+	require.NoError(t, c.RecordRun(Run{Command: "old", Started: start, Finished: start}))
+	require.NoError(t, c.RecordRun(Run{ID: "ab12cd34", Command: "apply", Started: start, Finished: start,
+		Hosts: []HostStats{{Host: "master1", Uploaded: 42, Commands: 3, Failures: 1, MeanLatency: time.Second}}}))
+	require.NoError(t, c.RecordRun(Run{ID: "ab99ee00", Command: "diff", Started: start, Finished: start}))
+
+	r, err := c.Run("ab12")
+	require.NoError(t, err)
+	assert.Equal(t, "apply", r.Command)
+	assert.Equal(t, []HostStats{{Host: "master1", Uploaded: 42, Commands: 3, Failures: 1, MeanLatency: time.Second}}, r.Hosts)
+
+	_, err = c.Run("ab")
+	assert.ErrorContains(t, err, "ambiguous")
+	_, err = c.Run("ff")
+	assert.ErrorContains(t, err, `no run "ff"`)
+	_, err = c.Run("")
+	assert.Error(t, err, "runs without an ID cannot be looked up")
+}
+
+func TestChanges(t *testing.T) {
+	c, err := New(t.TempDir()).Cluster("demo")
+	require.NoError(t, err)
+	changes, err := c.Changes()
+	require.NoError(t, err)
+	assert.Empty(t, changes)
+
+	require.NoError(t, c.RecordChanges([]modules.Change{
+		{ID: "ab12cd34.1", Run: "ab12cd34", Host: "master1", Kind: modules.ChangeFile, Path: "/etc/chrony.conf", Sum: "new", PriorSum: "old", Backup: "/var/lib/xm/backups/old"},
+		{ID: "ab12cd34.2", Run: "ab12cd34", Host: "master1", Kind: modules.ChangeService, Action: modules.ServiceRestart, Service: "chronyd"},
+	}))
+	require.NoError(t, c.RecordChanges(nil))
+	require.NoError(t, c.RecordChanges([]modules.Change{{ID: "ab99ee00.1", Run: "ab99ee00", Host: "master1", Kind: modules.ChangeFile, Reverts: "ab12cd34.1"}}))
+
+	changes, err = c.Changes()
+	require.NoError(t, err)
+	require.Len(t, changes, 3)
+	assert.Equal(t, "/var/lib/xm/backups/old", changes[0].Backup)
+
+	changes, err = c.ChangesOf("ab12")
+	require.NoError(t, err)
+	assert.Len(t, changes, 2)
+	changes, err = c.ChangesOf("ab12cd34.2")
+	require.NoError(t, err)
+	require.Len(t, changes, 1)
+	assert.Equal(t, "chronyd", changes[0].Service)
+	_, err = c.ChangesOf("ab")
+	assert.ErrorContains(t, err, "ambiguous")
+	_, err = c.ChangesOf("ff")
+	assert.ErrorContains(t, err, `no change "ff"`)
+
+	changed, err := c.GC(Retention{MaxRuns: 1, MaxAge: time.Nanosecond})
+	require.NoError(t, err)
+	assert.NotContains(t, changed, c.Path(changesFile), "the journal is not trimmed")
+}